@@ -0,0 +1,5 @@
+module github.com/photonlines/Go-Web-Server
+
+go 1.25.0
+
+require golang.org/x/image v0.45.0
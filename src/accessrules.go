@@ -0,0 +1,313 @@
+// Access rules which admins can change while we run: the rates of our rate limiters (see
+// tools.go), lists of client addresses to allow and deny, and our redirect rules (see
+// redirects.go). /debug/access-rules returns them as JSON, and admins can PUT a JSON object with
+// any of their sections to replace those sections, i.e.
+//
+//	{
+//		"rate_limits": {"tools": {"per_minute": 40, "burst": 10}},
+//		"deny": ["203.0.113.0/24", "198.51.100.7"],
+//		"allow": ["203.0.113.5"],
+//		"redirects": [{"match": "exact", "from": "/qr", "to": "/qr-code-generator"}]
+//	}
+//
+// Changes apply straight away, without a restart. Every section is checked before any of them
+// is applied, so a bad change is refused as a whole, and each section changed is written to our
+// log as an AUDIT entry naming the admin account.
+//
+// Requests from denied addresses are refused with a 403 ahead of everything but our logging and
+// metrics. The allow list overrides the deny list (so that a few addresses can be let through a
+// denied range), and allowed addresses aren't rate limited.
+//
+// Given -access-rules-file, the rules admins set are saved to it and applied again when we
+// start, over the rates we're built with and the rules of the -redirects file, so that they
+// survive restarts.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const MAX_ACCESS_RULES_SIZE = 1 << 20 // The largest set of access rules we accept
+
+// The rate of a rate limiter, as set by an admin
+type rateLimitSetting struct {
+	PerMinute int `json:"per_minute"`
+	Burst     int `json:"burst"`
+}
+
+// Our access rules as saved to the -access-rules-file, and as PUT to /debug/access-rules. The
+// sections which aren't set are left as they are.
+type accessRulesDocument struct {
+	RateLimits map[string]rateLimitSetting `json:"rate_limits,omitempty"`
+	Allow      *[]string                   `json:"allow,omitempty"`
+	Deny       *[]string                   `json:"deny,omitempty"`
+	Redirects  *[]redirectDefinition       `json:"redirects,omitempty"`
+}
+
+// Our client address lists, along with the rules admins have set (which are what we save)
+var accessRules = struct {
+	mutex sync.RWMutex
+	allow []netip.Prefix
+	deny  []netip.Prefix
+	saved accessRulesDocument
+}{}
+
+// Returns the given addresses and ranges (i.e. 203.0.113.0/24) as prefixes
+func parseAddressPrefixes(values []string) ([]netip.Prefix, error) {
+
+	prefixes := make([]netip.Prefix, 0, len(values))
+
+	for _, value := range values {
+
+		value = strings.TrimSpace(value)
+
+		if strings.Contains(value, "/") {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		address, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(address.Unmap(), address.Unmap().BitLen()))
+
+	}
+
+	return prefixes, nil
+
+}
+
+// Returns whether the given address is in one of the given prefixes
+func prefixesContain(prefixes []netip.Prefix, address netip.Addr) bool {
+	return slices.ContainsFunc(prefixes, func(prefix netip.Prefix) bool {
+		return prefix.Contains(address)
+	})
+}
+
+// Returns whether the given client address is on our allow list
+func clientAllowed(client string) bool {
+
+	address, err := netip.ParseAddr(client)
+	if err != nil {
+		return false
+	}
+
+	accessRules.mutex.RLock()
+	defer accessRules.mutex.RUnlock()
+
+	return prefixesContain(accessRules.allow, address.Unmap())
+
+}
+
+// Returns whether the given client address is denied (on our deny list but not our allow list)
+func clientDenied(client string) bool {
+
+	address, err := netip.ParseAddr(client)
+	if err != nil {
+		return false
+	}
+	address = address.Unmap()
+
+	accessRules.mutex.RLock()
+	defer accessRules.mutex.RUnlock()
+
+	return prefixesContain(accessRules.deny, address) && !prefixesContain(accessRules.allow, address)
+
+}
+
+// Returns a handler which refuses the requests of denied clients. Our access rules handler
+// itself (which is admin-only) is left reachable, so that admins can't lock themselves out.
+func accessRulesHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if clientDenied(clientAddress(r)) && !strings.HasSuffix(r.URL.Path, "/debug/access-rules") {
+			incrementCounter("access_denied_requests_total")
+			writeError(w, r, newAppError(http.StatusForbidden, "forbidden", "Requests from your address aren't allowed."))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+
+	})
+}
+
+// Check the given access rules and apply them, returning the names of the sections they change.
+// Nothing is applied unless every section is valid.
+func applyAccessRules(document accessRulesDocument) ([]string, error) {
+
+	for name, setting := range document.RateLimits {
+		if rateLimiters[name] == nil {
+			return nil, fmt.Errorf("unknown rate limit %q: expected one of %s", name,
+				strings.Join(slices.Sorted(maps.Keys(rateLimiters)), ", "))
+		}
+		if setting.PerMinute <= 0 || setting.Burst <= 0 {
+			return nil, fmt.Errorf("the %s rate limit needs a per_minute and burst above 0", name)
+		}
+	}
+
+	var allow, deny []netip.Prefix
+	var err error
+
+	if document.Allow != nil {
+		if allow, err = parseAddressPrefixes(*document.Allow); err != nil {
+			return nil, fmt.Errorf("allow: %w", err)
+		}
+	}
+
+	if document.Deny != nil {
+		if deny, err = parseAddressPrefixes(*document.Deny); err != nil {
+			return nil, fmt.Errorf("deny: %w", err)
+		}
+	}
+
+	var rules []redirectRule
+
+	if document.Redirects != nil {
+		if rules, err = newRedirectRules(*document.Redirects); err != nil {
+			return nil, fmt.Errorf("redirects: %w", err)
+		}
+	}
+
+	var changed []string
+
+	accessRules.mutex.Lock()
+	defer accessRules.mutex.Unlock()
+
+	if len(document.RateLimits) > 0 {
+		for name, setting := range document.RateLimits {
+			rateLimiters[name].setRate(setting.PerMinute, setting.Burst)
+			if accessRules.saved.RateLimits == nil {
+				accessRules.saved.RateLimits = map[string]rateLimitSetting{}
+			}
+			accessRules.saved.RateLimits[name] = setting
+		}
+		changed = append(changed, "rate_limits")
+	}
+
+	if document.Allow != nil {
+		accessRules.allow, accessRules.saved.Allow = allow, document.Allow
+		changed = append(changed, "allow")
+	}
+
+	if document.Deny != nil {
+		accessRules.deny, accessRules.saved.Deny = deny, document.Deny
+		changed = append(changed, "deny")
+	}
+
+	if document.Redirects != nil {
+		setRedirectRules(rules, *document.Redirects)
+		accessRules.saved.Redirects = document.Redirects
+		changed = append(changed, "redirects")
+	}
+
+	return changed, nil
+
+}
+
+// Load and apply the access rules saved to the given file (a missing file has none)
+func loadAccessRules(path string) error {
+
+	var document accessRulesDocument
+
+	if err := loadJSONFile(path, &document); err != nil {
+		return err
+	}
+
+	_, err := applyAccessRules(document)
+	return err
+
+}
+
+// Returns our current access rules
+func currentAccessRules() accessRulesDocument {
+
+	rateLimits := map[string]rateLimitSetting{}
+	for name, limiter := range rateLimiters {
+		perMinute, burst := limiter.rate()
+		rateLimits[name] = rateLimitSetting{PerMinute: perMinute, Burst: burst}
+	}
+
+	accessRules.mutex.RLock()
+	allow, deny := accessRules.saved.Allow, accessRules.saved.Deny
+	accessRules.mutex.RUnlock()
+
+	redirects.mutex.RLock()
+	definitions := append([]redirectDefinition{}, redirects.definitions...)
+	redirects.mutex.RUnlock()
+
+	return accessRulesDocument{
+		RateLimits: rateLimits,
+		Allow:      listOrEmpty(allow),
+		Deny:       listOrEmpty(deny),
+		Redirects:  &definitions,
+	}
+
+}
+
+// Returns the given list, or an empty one if it's nil (so that we list it as [])
+func listOrEmpty(list *[]string) *[]string {
+	if list == nil {
+		return &[]string{}
+	}
+	return list
+}
+
+// This is our admin-only access rules handler. GET requests return our access rules, while PUT
+// requests replace the sections of them they include (see the top of this file).
+func accessRulesAdminHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method == http.MethodPut {
+
+		var document accessRulesDocument
+
+		decoder := json.NewDecoder(io.LimitReader(r.Body, MAX_ACCESS_RULES_SIZE))
+		decoder.DisallowUnknownFields()
+
+		if err := decoder.Decode(&document); err != nil {
+			writeError(w, r, badRequestError("The request body must be a JSON object with rate_limits, allow, deny and / or redirects fields.").Wrap(err))
+			return
+		}
+
+		changed, err := applyAccessRules(document)
+
+		if err != nil {
+			writeError(w, r, badRequestError(err.Error()))
+			return
+		}
+
+		for _, section := range changed {
+			incrementCounter("access_rule_changes_total", "section", section)
+			logger.Printf("AUDIT admin account %q changed the %s access rules", adminAccount(r), section)
+		}
+
+		if accessRulesFile != "" && len(changed) > 0 {
+			accessRules.mutex.RLock()
+			err := saveJSONFile(accessRulesFile, accessRules.saved)
+			accessRules.mutex.RUnlock()
+			if err != nil {
+				writeError(w, r, internalError(err).WithDetail("The access rules were applied, but couldn't be saved."))
+				return
+			}
+		}
+
+	}
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(currentAccessRules())
+
+}
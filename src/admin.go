@@ -0,0 +1,140 @@
+// Admin authentication. Admin-only endpoints (i.e. our debug pages) are protected by a token
+// passed in via the -admin-token flag. Clients authenticate using either a bearer token or HTTP
+// basic auth with the token as the password, so that browsers can simply prompt for it. When
+// no admin token is configured, admin endpoints are disabled entirely. Failed logins are
+// throttled and locked out (see loginguard.go), and once admins have enrolled in two-factor
+// authentication logins also need a code from their authenticator app (see totp.go).
+//
+// Browsers send an admin's basic credentials (and session cookie) whichever site a form comes
+// from, so adminOnly rejects such requests which change anything (anything but a GET, HEAD or
+// OPTIONS) unless they pass our CSRF check (see csrf.go). Bearer tokens are only ever sent by
+// scripts, so their requests aren't checked.
+
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Returns a handler which only passes on requests from authenticated admins
+func adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// Pretend admin endpoints don't exist when they're disabled
+		if adminToken == "" {
+			writeError(w, r, notFoundError())
+			return
+		}
+
+		if wait := loginWait(r); wait > 0 && hasAdminCredentials(r) {
+			writeLoginThrottled(w, r, wait)
+			return
+		}
+
+		if !isAdminRequest(r) {
+			message := "You need to sign in as an admin to view this page."
+			if twoFactorRequired() {
+				message = "You need to sign in as an admin to view this page, with the code from your authenticator app straight after the token in your password."
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin", charset="UTF-8"`)
+			writeError(w, r, newAppError(http.StatusUnauthorized, "unauthorized", message))
+			return
+		}
+
+		if usesBrowserCredentials(r) {
+			if err := checkCSRF(r, r.FormValue(CSRF_FIELD_NAME)); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+
+		// Browsers resend the code they signed in with, which won't be valid for long
+		if account := adminAccount(r); twoFactorRequired() && !validAdminSession(r, account) {
+			startAdminSession(w, r, account)
+		}
+
+		next.ServeHTTP(w, r)
+
+	})
+}
+
+// Check whether the request changes something with credentials a browser sends by itself
+func usesBrowserCredentials(r *http.Request) bool {
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+
+	_, _, basic := r.BasicAuth()
+	_, err := r.Cookie(ADMIN_SESSION_COOKIE_NAME)
+
+	return basic || err == nil
+
+}
+
+// Check whether the request carries our admin token. Requests which supply credentials are
+// login attempts, so they're refused while their account or address must wait, and their
+// failures and successes are recorded.
+func isAdminRequest(r *http.Request) bool {
+
+	if adminToken == "" || !hasAdminCredentials(r) || loginWait(r) > 0 {
+		return false
+	}
+
+	supplied, code := suppliedAdminToken(r), r.Header.Get(TOTP_CODE_HEADER)
+	twoFactor := twoFactorRequired()
+
+	// Browsers only prompt for a password, so it can carry the code straight after the token
+	if twoFactor && code == "" && len(supplied) > len(adminToken) {
+		supplied, code = supplied[:len(adminToken)], supplied[len(adminToken):]
+	}
+
+	// Compare in constant time so that the token can't be guessed via timing attacks
+	if subtle.ConstantTimeCompare([]byte(supplied), []byte(adminToken)) != 1 {
+		recordLoginFailure(r)
+		return false
+	}
+
+	if account := adminAccount(r); twoFactor && !validAdminSession(r, account) && !checkSecondFactor(account, code) {
+		recordLoginFailure(r)
+		return false
+	}
+
+	recordLoginSuccess(r)
+
+	return true
+
+}
+
+// Returns the token the request supplies, via basic auth or as a bearer token
+func suppliedAdminToken(r *http.Request) string {
+
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+
+	bearer, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	return bearer
+
+}
+
+// Check whether the request supplies our admin token (perhaps followed by a two-factor code),
+// without counting it as a login attempt. This only tells other users of the Authorization header
+// that it's meant for us: adminOnly still checks the request.
+func suppliesAdminToken(r *http.Request) bool {
+	supplied := suppliedAdminToken(r)
+	if adminToken == "" || len(supplied) < len(adminToken) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(supplied[:len(adminToken)]), []byte(adminToken)) == 1
+}
+
+// Check whether the request supplies admin credentials at all
+func hasAdminCredentials(r *http.Request) bool {
+	_, _, basic := r.BasicAuth()
+	return basic || strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminOnlyChecksCSRFForBrowserCredentials(t *testing.T) {
+
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "admin-test-token"
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+
+	tests := []struct {
+		name   string
+		method string
+		bearer bool   // Whether the token is sent as a bearer token rather than via basic auth
+		header string // A header to send along with it ("" for none)
+		value  string
+		status int
+	}{
+		{"GET with basic auth", http.MethodGet, false, "", "", http.StatusOK},
+		{"POST with basic auth", http.MethodPost, false, "", "", http.StatusForbidden},
+		{"POST with basic auth from a script", http.MethodPost, false, CSRF_SCRIPT_HEADER, "curl", http.StatusOK},
+		{"PUT with basic auth", http.MethodPut, false, "Content-Type", "text/plain", http.StatusForbidden},
+		{"PUT of JSON with basic auth", http.MethodPut, false, "Content-Type", "application/json", http.StatusOK},
+		{"POST with a bearer token", http.MethodPost, true, "", "", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			r := httptest.NewRequest(test.method, "/debug/profiles", strings.NewReader("{}"))
+			if test.bearer {
+				r.Header.Set("Authorization", "Bearer "+adminToken)
+			} else {
+				r.SetBasicAuth("admin", adminToken)
+			}
+			if test.header != "" {
+				r.Header.Set(test.header, test.value)
+			}
+			w := httptest.NewRecorder()
+
+			adminOnly(ok).ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+
+		})
+	}
+
+}
@@ -0,0 +1,135 @@
+// Error alerting and panic recovery. Panics are recovered and turned into 500 responses, and
+// when 5xx responses (or panics) occur above a threshold rate we send a rate limited alert to
+// the webhook configured via the -alert-webhook flag.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// A server error which occurred while handling a request
+type errorEvent struct {
+	At        time.Time
+	RequestID string
+	Method    string
+	Path      string
+	Status    int
+	Summary   string
+}
+
+// Tracks recent server errors and decides when we should alert on them
+type errorAlerter struct {
+	mutex     sync.Mutex
+	notifier  *webhookNotifier
+	threshold int           // Alert when we see at least this many errors...
+	window    time.Duration // ...within this window
+	cooldown  time.Duration // The minimum time between two alerts
+	events    []time.Time
+	lastAlert time.Time
+}
+
+// Our error alerter. It's nil (and errors are only logged) unless an alert webhook is set.
+var errorAlerts *errorAlerter
+
+// Record a server error, sending an alert if we've crossed our threshold and haven't
+// alerted recently
+func (alerter *errorAlerter) record(event errorEvent) {
+
+	alerter.mutex.Lock()
+	defer alerter.mutex.Unlock()
+
+	// Forget about errors which have fallen out of our window
+	cutoff := event.At.Add(-alerter.window)
+	for len(alerter.events) > 0 && alerter.events[0].Before(cutoff) {
+		alerter.events = alerter.events[1:]
+	}
+	alerter.events = append(alerter.events, event.At)
+
+	if len(alerter.events) < alerter.threshold || event.At.Sub(alerter.lastAlert) < alerter.cooldown {
+		return
+	}
+
+	alerter.lastAlert = event.At
+
+	alerter.notifier.notify(webhookMessage{
+		Text: fmt.Sprintf(":rotating_light: %d server errors in the last %v. Latest: %s %s (%d) %s, request ID %s",
+			len(alerter.events), alerter.window, event.Method, event.Path, event.Status, event.Summary, event.RequestID),
+		Fields: map[string]interface{}{
+			"error_count": len(alerter.events),
+			"window":      alerter.window.String(),
+			"request_id":  event.RequestID,
+			"method":      event.Method,
+			"route":       event.Path,
+			"status":      event.Status,
+			"summary":     event.Summary,
+		},
+		RequestID: event.RequestID,
+	})
+
+}
+
+// Returns a handler which recovers from panics in the handlers it calls and records server
+// errors for alerting
+func errorAlertHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		recorder := newStatusRecorder(w)
+
+		defer func() {
+			summary := ""
+
+			if recovered := recover(); recovered != nil {
+				// http.ErrAbortHandler is used to deliberately abort a response, so we let
+				// the server handle it as usual
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+
+				incrementCounter("http_panics_total")
+				summary = fmt.Sprintf("panic: %v", recovered)
+				logger.Printf("ERROR %s\n%s", summary, debug.Stack())
+
+				// We can only send an error response if the handler hasn't started one
+				if !recorder.wroteHeader {
+					writeError(recorder, r, internalError(fmt.Errorf("%s", summary)))
+				}
+				recorder.status = http.StatusInternalServerError
+			}
+
+			if recorder.status < http.StatusInternalServerError || errorAlerts == nil {
+				return
+			}
+
+			requestID, _ := r.Context().Value(REQUEST_ID_KEY).(string)
+
+			// Handlers record the details of their errors on the request trace (see writeError)
+			if summary == "" {
+				summary = http.StatusText(recorder.status)
+				if trace := traceFromContext(r.Context()); trace != nil {
+					trace.mutex.Lock()
+					if trace.Error != "" {
+						summary = trace.Error
+					}
+					trace.mutex.Unlock()
+				}
+			}
+
+			errorAlerts.record(errorEvent{
+				At:        time.Now(),
+				RequestID: requestID,
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Status:    recorder.status,
+				Summary:   summary,
+			})
+		}()
+
+		next.ServeHTTP(recorder, r)
+
+	})
+}
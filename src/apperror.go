@@ -0,0 +1,181 @@
+// Structured application errors used by all of our handlers. Each error carries a public
+// message which is safe to show to our users, along with an internal detail / wrapped cause
+// which is only ever written to our log. Errors are rendered either as an HTML error page
+// or as a JSON error envelope depending on what the client asked for.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// An AppError describes an error we want to report back to the client
+type AppError struct {
+	Code    string // Machine readable error code (i.e. "not_found")
+	Status  int    // The HTTP status code we respond with
+	Message string // User-facing message which is safe to display to the client
+	Detail  string // Internal detail which is only ever logged
+	Err     error  // The (optional) underlying cause of the error
+}
+
+func (appError *AppError) Error() string {
+	errorString := appError.Code + ": " + appError.Message
+	if appError.Detail != "" {
+		errorString += " (" + appError.Detail + ")"
+	}
+	if appError.Err != nil {
+		errorString += ": " + appError.Err.Error()
+	}
+	return errorString
+}
+
+// Unwrap allows errors.Is / errors.As to inspect the underlying cause of our error
+func (appError *AppError) Unwrap() error {
+	return appError.Err
+}
+
+// Create a new application error with the given status, code and public message
+func newAppError(status int, code string, message string) *AppError {
+	return &AppError{Code: code, Status: status, Message: message}
+}
+
+// Returns a copy of our error with the given internal detail attached
+func (appError *AppError) WithDetail(format string, args ...interface{}) *AppError {
+	errorCopy := *appError
+	errorCopy.Detail = fmt.Sprintf(format, args...)
+	return &errorCopy
+}
+
+// Returns a copy of our error wrapping the given underlying cause
+func (appError *AppError) Wrap(err error) *AppError {
+	errorCopy := *appError
+	errorCopy.Err = err
+	return &errorCopy
+}
+
+// Commonly used errors:
+
+func notFoundError() *AppError {
+	return newAppError(http.StatusNotFound, "not_found", "The page you requested could not be found.")
+}
+
+func badRequestError(message string) *AppError {
+	return newAppError(http.StatusBadRequest, "bad_request", message)
+}
+
+func internalError(err error) *AppError {
+	return newAppError(http.StatusInternalServerError, "internal_error",
+		"Something went wrong on our end. Please try again later.").Wrap(err)
+}
+
+// The JSON error envelope we respond with for API / JSON requests
+type errorEnvelope struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// The body content of our HTML error page. The values are escaped by html/template.
+const ERROR_PAGE_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>{{ .Status }} {{ .StatusText }}</h2>
+		<p>{{ .Message }}</p>
+		{{ if .RequestID }}<p><small>Request ID: {{ .RequestID }}</small></p>{{ end }}
+	</div>
+`
+
+// The data we pass into our error page body template
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Message    string
+	RequestID  string
+}
+
+// Write the given error out to the client. Errors which aren't AppErrors are treated as
+// internal errors so that their details never leak to the client. The full error (including
+// the internal detail and cause) is written to our log for server errors.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+
+	var appError *AppError
+	if !errors.As(err, &appError) {
+		appError = internalError(err)
+	}
+
+	requestID, _ := r.Context().Value(REQUEST_ID_KEY).(string)
+
+	if appError.Status >= http.StatusInternalServerError {
+		logger.Println("ERROR", requestID, r.Method, r.URL.Path, appError.Error())
+
+		// Record the error on our request trace so that it shows up in our error alerts
+		if trace := traceFromContext(r.Context()); trace != nil {
+			trace.mutex.Lock()
+			trace.Error = appError.Error()
+			trace.mutex.Unlock()
+		}
+	}
+
+	// The error may have been returned by a handler which already set its own headers (i.e.
+	// a content length or disposition), which no longer apply to our error response
+	w.Header().Del("Content-Length")
+	w.Header().Del("Content-Disposition")
+
+	if wantsJSON(r) {
+		setContentType(w, CONTENT_TYPE_JSON)
+		w.WriteHeader(appError.Status)
+		json.NewEncoder(w).Encode(errorEnvelope{Error: errorBody{
+			Code:      appError.Code,
+			Message:   appError.Message,
+			RequestID: requestID,
+		}})
+		return
+	}
+
+	// Construct the body of our error page and render it within our main template. If we can't
+	// render our templates, we fall back to a plain text response.
+	var body template.HTML
+	var page []byte
+
+	err = fmt.Errorf("the error page template failed to load")
+	if errorPageTemplate != nil {
+		body, err = renderFragment(errorPageTemplate, errorPageData{
+			Status:     appError.Status,
+			StatusText: http.StatusText(appError.Status),
+			Message:    appError.Message,
+			RequestID:  requestID,
+		})
+	}
+
+	if err == nil {
+		page, err = executeMainTemplate("error", HtmlData{
+			Title:       http.StatusText(appError.Status),
+			CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+			BodyContent: body,
+		})
+	}
+
+	if err != nil {
+		http.Error(w, appError.Message, appError.Status)
+		return
+	}
+
+	setContentType(w, CONTENT_TYPE_HTML)
+	w.WriteHeader(appError.Status)
+	w.Write(page)
+
+}
+
+// Check whether the client would prefer a JSON response over an HTML page
+func wantsJSON(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
@@ -0,0 +1,406 @@
+// ASCII art. /ascii draws text as FIGlet style banners (see figlet.go) and converts uploaded
+// images to ASCII art on the server, either shown on the page or returned as plain text for
+// terminals and scripts (with format=text):
+//
+//	curl "http://localhost:8080/ascii?text=Hello&font=slant&format=text"
+//	curl -F image=@photo.jpg -F width=100 -F colour=true -F format=text http://localhost:8080/ascii
+//
+// Images are scaled down to a character per cell, and each cell's brightness picks a character
+// from a ramp running from dense (dark) to sparse (light). Coloured art keeps each cell's
+// colour, as 24-bit ANSI escapes in plain text or as coloured spans on the page.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"image"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	ASCII_WIDTH          = 80 // The width of our art by default, in characters
+	MIN_ASCII_WIDTH      = 10
+	MAX_ASCII_WIDTH      = 300
+	MAX_ASCII_ROWS       = 300 // Taller images are squashed to fit
+	MAX_BANNER_TEXT      = 200 // The most characters we'll draw as a banner
+	MAX_ASCII_IMAGE_SIZE = 10 << 20
+	MAX_ASCII_CHARACTERS = 70
+	ASCII_CELL_ASPECT    = 0.5 // Characters are about twice as tall as they are wide
+)
+
+// The characters of our art, from dense (for the darkest cells) to sparse (for the lightest)
+type asciiCharset struct {
+	Name       string
+	Title      string
+	Characters string
+}
+
+var asciiCharsets = []asciiCharset{
+	{Name: "standard", Title: "Standard", Characters: "@%#*+=-:. "},
+	{Name: "detailed", Title: "Detailed", Characters: "$@B%8&WM#*oahkbdpqwmZO0QLCJUYXzcvunxrjft/\\|()1{}[]?-_+~<>i!lI;:,\"^`'. "},
+	{Name: "blocks", Title: "Blocks", Characters: "█▓▒░ "},
+	{Name: "binary", Title: "Binary", Characters: "# "},
+}
+
+// How to draw our art
+type asciiOptions struct {
+	Text       string
+	Font       string
+	Width      int
+	Charset    string
+	Characters string // Our own characters, which take the place of the charset's
+	Invert     bool   // Sparse characters for dark cells, for light text on a dark background
+	Colour     bool
+	Format     string // html or text
+}
+
+// A piece of ASCII art, with the colours of its characters if it's coloured
+type asciiArt struct {
+	Lines   [][]rune
+	Colours [][]colour
+}
+
+type asciiPageData struct {
+	Options  asciiOptions
+	Fonts    []string
+	Charsets []asciiCharset
+	Art      template.HTML
+	TextURL  string // The banner as plain text
+}
+
+const ASCII_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>ASCII art</h2>
+		<h4>Banner</h4>
+		<form action="{{ url "/ascii" }}" method="GET">
+			<input type="text" name="text" size=40 maxlength=200 placeholder="Text" value="{{ .Options.Text }}">
+			<select name="font">
+				{{ range .Fonts }}<option{{ if eq . $.Options.Font }} selected{{ end }}>{{ . }}</option>{{ end }}
+			</select>
+			<label>Width <input type="number" name="width" min=10 max=300 value="{{ .Options.Width }}"></label>
+			<input type="submit" value="Draw">
+		</form>
+		<h4>Image</h4>
+		<form action="{{ url "/ascii" }}" method="POST" enctype="multipart/form-data">
+			<input type="file" name="image" accept="image/png,image/jpeg,image/gif">
+			<label>Width <input type="number" name="width" min=10 max=300 value="{{ .Options.Width }}"></label>
+			<select name="charset">
+				{{ range .Charsets }}<option value="{{ .Name }}"{{ if eq .Name $.Options.Charset }} selected{{ end }}>{{ .Title }}</option>{{ end }}
+			</select>
+			<label><input type="checkbox" name="invert" value="true"{{ if .Options.Invert }} checked{{ end }}> Invert</label>
+			<label><input type="checkbox" name="colour" value="true"{{ if .Options.Colour }} checked{{ end }}> Colour</label>
+			<input type="submit" value="Convert">
+		</form>
+		{{ if .Art }}
+		<pre style="display: inline-block; text-align: left; line-height: 1; font-size: 10px;">{{ .Art }}</pre>
+		{{ end }}
+		{{ if .TextURL }}<p><a href="{{ .TextURL }}">As plain text</a></p>{{ end }}
+	</div>
+`
+
+func init() {
+	registerPage(Page{Title: "ASCII Art", Path: "/ascii", Order: 74, Visible: true, Section: SECTION_DEMOS, Handler: asciiHandler,
+		Methods: []string{http.MethodGet, http.MethodPost}})
+}
+
+// Read our options from the request's form (which for images is a multipart form)
+func parseASCIIOptions(form url.Values) (asciiOptions, error) {
+
+	options := asciiOptions{
+		Text:       strings.TrimSpace(form.Get("text")),
+		Font:       form.Get("font"),
+		Width:      ASCII_WIDTH,
+		Charset:    form.Get("charset"),
+		Characters: form.Get("chars"),
+		Invert:     form.Get("invert") == "true",
+		Colour:     form.Get("colour") == "true",
+		Format:     form.Get("format"),
+	}
+
+	if options.Font == "" {
+		options.Font = "standard"
+	} else if _, found := figletFonts[options.Font]; !found {
+		return options, badRequestError("Unknown font. Choose one of " + strings.Join(figletFontNames, ", ") + ".")
+	}
+
+	if options.Charset == "" {
+		options.Charset = asciiCharsets[0].Name
+	} else if !slices.ContainsFunc(asciiCharsets, func(charset asciiCharset) bool { return charset.Name == options.Charset }) {
+		return options, badRequestError("Unknown charset. Choose one of standard, detailed, blocks or binary.")
+	}
+
+	if value := form.Get("width"); value != "" {
+		var err error
+		if options.Width, err = strconv.Atoi(value); err != nil || options.Width < MIN_ASCII_WIDTH || options.Width > MAX_ASCII_WIDTH {
+			return options, badRequestError(fmt.Sprintf("The width must be from %d to %d characters.", MIN_ASCII_WIDTH, MAX_ASCII_WIDTH))
+		}
+	}
+
+	if len([]rune(options.Text)) > MAX_BANNER_TEXT {
+		return options, badRequestError(fmt.Sprintf("Banners can have at most %d characters.", MAX_BANNER_TEXT))
+	}
+
+	if characters := []rune(options.Characters); options.Characters != "" &&
+		(len(characters) < 2 || len(characters) > MAX_ASCII_CHARACTERS || slices.ContainsFunc(characters, unicode.IsControl)) {
+		return options, badRequestError(fmt.Sprintf("The chars must be from 2 to %d printable characters.", MAX_ASCII_CHARACTERS))
+	}
+
+	if options.Format != "" && options.Format != "html" && options.Format != "text" {
+		return options, badRequestError("The format must be html or text.")
+	}
+
+	return options, nil
+
+}
+
+// Returns the characters our options draw with, from those for the darkest cells to those for
+// the lightest
+func (options asciiOptions) ramp() []rune {
+
+	characters := []rune(options.Characters)
+	if len(characters) == 0 {
+		i := slices.IndexFunc(asciiCharsets, func(charset asciiCharset) bool { return charset.Name == options.Charset })
+		characters = []rune(asciiCharsets[i].Characters)
+	}
+
+	if options.Invert {
+		characters = slices.Clone(characters)
+		slices.Reverse(characters)
+	}
+
+	return characters
+
+}
+
+// Draw the text as a banner in the font
+func bannerArt(options asciiOptions) asciiArt {
+	var art asciiArt
+	for _, line := range figletFonts[options.Font].banner(options.Text, options.Width) {
+		art.Lines = append(art.Lines, []rune(line))
+	}
+	return art
+}
+
+// Convert an image to ASCII art of the width in our options. The image is drawn onto white, so
+// transparent areas come out as the lightest character.
+func imageArt(source io.ReadSeeker, options asciiOptions) (asciiArt, error) {
+
+	config, _, err := image.DecodeConfig(source)
+
+	if err != nil {
+		return asciiArt{}, newAppError(http.StatusUnsupportedMediaType, "unsupported_image",
+			"The image isn't a PNG, JPEG or GIF image.").Wrap(err)
+	}
+
+	if config.Width*config.Height > MAX_SOURCE_PIXELS {
+		return asciiArt{}, newAppError(http.StatusUnprocessableEntity, "image_too_large",
+			"The image is too large to convert.").WithDetail("%dx%d", config.Width, config.Height)
+	}
+
+	if _, err := source.Seek(0, io.SeekStart); err != nil {
+		return asciiArt{}, internalError(err)
+	}
+
+	sourceImage, _, err := image.Decode(source)
+
+	if err != nil {
+		return asciiArt{}, newAppError(http.StatusUnprocessableEntity, "corrupt_image",
+			"The image could not be decoded.").Wrap(err)
+	}
+
+	bounds := sourceImage.Bounds()
+	width := min(options.Width, bounds.Dx())
+	rows := int(math.Round(float64(width) * float64(bounds.Dy()) / float64(bounds.Dx()) * ASCII_CELL_ASPECT))
+	rows = min(max(rows, 1), MAX_ASCII_ROWS)
+
+	scaled := scaleImage(sourceImage, width, rows)
+	ramp := options.ramp()
+
+	art := asciiArt{Lines: make([][]rune, rows)}
+	if options.Colour {
+		art.Colours = make([][]colour, rows)
+	}
+
+	for y := range rows {
+		art.Lines[y] = make([]rune, width)
+		if options.Colour {
+			art.Colours[y] = make([]colour, width)
+		}
+		for x := range width {
+			// Our pixels have premultiplied alpha, so drawing them onto white adds the white
+			// which shows through them
+			pixel := scaled.RGBAAt(x, y)
+			cell := colour{R: pixel.R + (255 - pixel.A), G: pixel.G + (255 - pixel.A), B: pixel.B + (255 - pixel.A)}
+			brightness := (0.2126*float64(cell.R) + 0.7152*float64(cell.G) + 0.0722*float64(cell.B)) / 256
+			art.Lines[y][x] = ramp[int(brightness*float64(len(ramp)))]
+			if options.Colour {
+				art.Colours[y][x] = cell
+			}
+		}
+	}
+
+	return art, nil
+
+}
+
+// Returns the art as plain text, with ANSI escapes for its colours if it has them
+func (art asciiArt) text() string {
+
+	var output strings.Builder
+
+	for y, line := range art.Lines {
+		if art.Colours == nil {
+			output.WriteString(string(line))
+			output.WriteByte('\n')
+			continue
+		}
+		for x, character := range line {
+			// Only changes of colour need an escape
+			if cell := art.Colours[y][x]; x == 0 || cell != art.Colours[y][x-1] {
+				fmt.Fprintf(&output, "\x1b[38;2;%d;%d;%dm", cell.R, cell.G, cell.B)
+			}
+			output.WriteRune(character)
+		}
+		output.WriteString("\x1b[0m\n")
+	}
+
+	return output.String()
+
+}
+
+// Returns the art for our page, with runs of the same colour wrapped in coloured spans
+func (art asciiArt) html() template.HTML {
+
+	if art.Colours == nil {
+		return template.HTML(html.EscapeString(art.text()))
+	}
+
+	var output strings.Builder
+
+	for y, line := range art.Lines {
+		for start := 0; start < len(line); {
+			end := start + 1
+			for end < len(line) && art.Colours[y][end] == art.Colours[y][start] {
+				end++
+			}
+			fmt.Fprintf(&output, "<span style=\"color: %s\">%s</span>", art.Colours[y][start].Hex(), html.EscapeString(string(line[start:end])))
+			start = end
+		}
+		output.WriteByte('\n')
+	}
+
+	// template-audit: our colours are hex codes and the art's text is escaped above
+	return template.HTML(output.String())
+
+}
+
+// Read the uploaded image of a multipart form and convert it
+func uploadedImageArt(w http.ResponseWriter, r *http.Request) (asciiArt, asciiOptions, error) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_ASCII_IMAGE_SIZE+1<<20)
+
+	if err := r.ParseMultipartForm(MAX_ASCII_IMAGE_SIZE); err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return asciiArt{}, asciiOptions{}, newAppError(http.StatusRequestEntityTooLarge, "too_large",
+				fmt.Sprintf("Images are limited to %d bytes.", MAX_ASCII_IMAGE_SIZE)).Wrap(err)
+		}
+		return asciiArt{}, asciiOptions{}, badRequestError("The image must be sent as multipart/form-data.").Wrap(err)
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	options, err := parseASCIIOptions(r.Form)
+	if err != nil {
+		return asciiArt{}, options, err
+	}
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		return asciiArt{}, options, badRequestError("The image is missing.").Wrap(err)
+	}
+	defer file.Close()
+
+	endSpan := startSpan(r.Context(), "ascii: image")
+	art, err := imageArt(file, options)
+	endSpan()
+
+	return art, options, err
+
+}
+
+// This is our ASCII art page. GET requests draw banners of their text and POST requests convert
+// their uploaded image.
+func asciiHandler(w http.ResponseWriter, r *http.Request) {
+
+	var art asciiArt
+	var options asciiOptions
+	var err error
+
+	data := asciiPageData{Fonts: figletFontNames, Charsets: asciiCharsets}
+
+	if r.Method == http.MethodPost {
+
+		if art, options, err = uploadedImageArt(w, r); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		incrementCounter("ascii_art_total", "kind", "image")
+
+	} else {
+
+		if options, err = parseASCIIOptions(r.URL.Query()); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		if options.Text != "" {
+			endSpan := startSpan(r.Context(), "ascii: banner")
+			art = bannerArt(options)
+			endSpan()
+
+			query := r.URL.Query()
+			query.Set("format", "text")
+			data.TextURL = urlFor("/ascii") + "?" + query.Encode()
+
+			incrementCounter("ascii_art_total", "kind", "banner")
+		}
+
+	}
+
+	if options.Format == "text" {
+		setContentType(w, "text/plain; charset=utf-8")
+		io.WriteString(w, art.text())
+		return
+	}
+
+	data.Options = options
+	if art.Lines != nil {
+		data.Art = art.html()
+	}
+
+	body, err := renderFragment(asciiBodyTemplate, data)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the ascii body template"))
+		return
+	}
+
+	renderMainTemplate(w, r, "ascii", HtmlData{
+		Title:       "Golang ASCII Art",
+		Description: "FIGlet style text banners and image to ASCII art conversion.",
+		Keywords:    "golang web server ascii art figlet banner image ansi",
+		CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+		BodyContent: body,
+	})
+
+}
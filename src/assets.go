@@ -0,0 +1,110 @@
+// Subresource Integrity for the CSS and JavaScript files our pages load from CDNs. Each asset in
+// our HtmlData can carry an integrity hash, which browsers check the downloaded file against
+// before using it, so a compromised (or silently changed) CDN file can't run within our pages.
+//
+// Rather than hard-coding hashes, we compute them at startup from vendored copies of the CDN
+// files. The -vendor-dir flag points at a directory laid out by host and path, i.e.
+//
+//	vendor/cdnjs.cloudflare.com/ajax/libs/jquery/3.4.1/jquery.min.js
+//
+// holds the copy of https://cdnjs.cloudflare.com/ajax/libs/jquery/3.4.1/jquery.min.js. Assets
+// without a vendored copy (i.e. Google Fonts stylesheets, which differ per browser) are loaded
+// without an integrity hash.
+
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// An external CSS or JavaScript file loaded by one of our pages
+type Asset struct {
+	URL         string
+	Integrity   string // The Subresource Integrity hash of the file (i.e. sha384-...)
+	CrossOrigin string // The CORS mode the file is fetched with (needed for integrity checks)
+
+	// Whether the page can't be shown (or its inline scripts can't run) without the file, in which
+	// case it's loaded before the page is rendered. Other files are loaded without holding up the
+	// first paint (see styles.go).
+	Critical bool
+}
+
+// The integrity hashes of our CDN assets, by URL. This is filled in at startup (before we
+// start serving) so it doesn't need a lock.
+var assetIntegrity = map[string]string{}
+
+// Returns the assets for the given URLs, along with their integrity hashes where we know them
+func assets(urls ...string) []Asset {
+
+	list := make([]Asset, 0, len(urls))
+
+	for _, url := range urls {
+		asset := Asset{URL: url}
+		if integrity, ok := assetIntegrity[url]; ok {
+			asset.Integrity = integrity
+			// Integrity checks only work for cross origin files fetched with CORS
+			asset.CrossOrigin = "anonymous"
+		}
+		list = append(list, asset)
+	}
+
+	return list
+
+}
+
+// Returns the assets for the given URLs, marked as critical (see Asset)
+func criticalAssets(urls ...string) []Asset {
+	list := assets(urls...)
+	for i := range list {
+		list[i].Critical = true
+	}
+	return list
+}
+
+// Returns the Subresource Integrity hash of the given file contents
+func subresourceIntegrity(data []byte) string {
+	sum := sha512.Sum384(data)
+	return "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Compute the integrity hashes of the vendored copies of our CDN assets within the given
+// directory, returning the number of files hashed
+func loadAssetIntegrity(dir string) (int, error) {
+
+	count := 0
+
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(dir, path)
+
+		if err != nil {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+
+		if err != nil {
+			return err
+		}
+
+		url := "https://" + filepath.ToSlash(relativePath)
+		assetIntegrity[url] = subresourceIntegrity(data)
+		count++
+
+		logger.Printf("Asset integrity: %s %s", url, assetIntegrity[url])
+
+		return nil
+
+	})
+
+	return count, err
+
+}
@@ -0,0 +1,496 @@
+// Barcodes. Alongside our QR codes (see qrcode.go) we generate the common 1D barcodes: Code 128
+// for short runs of ASCII text and EAN-13 / EAN-8 for retail product numbers. Any of them can be
+// drawn as an SVG or PNG image via /api/v1/codes/{type}, i.e.
+//
+//	/api/v1/codes/ean13?text=400638133393&format=png
+//
+// Code 128 (ISO/IEC 15417) is written using code set B for text, switching to code set C (which
+// packs two digits into each symbol) for runs of digits. EAN codes (ISO/IEC 15420) are given
+// with or without their final check digit, and a check digit which is given must be correct,
+// since a mistyped product number would otherwise produce a barcode which scans as the wrong
+// product. You can find a good description of both symbologies here:
+// https://www.barcodefaq.com/1d/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	MAX_CODE128_TEXT    = 80
+	DEFAULT_CODE_SCALE  = 4 // The size of a module, in pixels
+	MAX_CODE_SCALE      = 20
+	DEFAULT_CODE_HEIGHT = 80 // The height of 1D barcodes, in pixels
+	MAX_CODE_HEIGHT     = 1000
+)
+
+// A kind of code we generate
+type codeType struct {
+	Name  string
+	Title string
+}
+
+// The kinds of code we generate, in the order our generator page lists them
+var codeTypes = []codeType{
+	{"qr", "QR code"},
+	{"code128", "Code 128"},
+	{"ean13", "EAN-13"},
+	{"ean8", "EAN-8"},
+}
+
+// A code which is ready to be drawn. Modules are indexed as modules[y][x] and are true for dark
+// modules. 1D barcodes have a single row of modules, which is stretched to the image's height.
+type generatedCode struct {
+	modules   [][]bool
+	quietZone int    // The light modules needed either side of the code
+	caption   string // The human readable text printed beneath 1D barcodes
+}
+
+// Returns true if we generate the given type of code
+func isCodeType(name string) bool {
+	return slices.ContainsFunc(codeTypes, func(t codeType) bool { return t.Name == name })
+}
+
+// Encode the given text as the given type of code
+func generateCode(kind string, text string) (*generatedCode, error) {
+
+	switch kind {
+	case "qr":
+		code, err := encodeQRCode([]byte(text))
+		if err != nil {
+			return nil, err
+		}
+		return &generatedCode{modules: code.modules, quietZone: 4}, nil
+	case "code128":
+		bars, err := encodeCode128(text)
+		if err != nil {
+			return nil, err
+		}
+		return &generatedCode{modules: [][]bool{bars}, quietZone: 10, caption: text}, nil
+	case "ean13", "ean8":
+		length := 13
+		if kind == "ean8" {
+			length = 8
+		}
+		digits, err := eanDigits(text, length)
+		if err != nil {
+			return nil, err
+		}
+		return &generatedCode{modules: [][]bool{encodeEAN(digits)}, quietZone: 11, caption: digits}, nil
+	}
+
+	return nil, fmt.Errorf("unknown code type %q", kind)
+
+}
+
+// The bar and space patterns of the Code 128 symbols, indexed by their values (103 - 105 are
+// the start symbols of code sets A, B and C). Each symbol is 11 modules wide.
+var code128Patterns = [...]string{
+	"11011001100", "11001101100", "11001100110", "10010011000", "10010001100",
+	"10001001100", "10011001000", "10011000100", "10001100100", "11001001000",
+	"11001000100", "11000100100", "10110011100", "10011011100", "10011001110",
+	"10111001100", "10011101100", "10011100110", "11001110010", "11001011100",
+	"11001001110", "11011100100", "11001110100", "11101101110", "11101001100",
+	"11100101100", "11100100110", "11101100100", "11100110100", "11100110010",
+	"11011011000", "11011000110", "11000110110", "10100011000", "10001011000",
+	"10001000110", "10110001000", "10001101000", "10001100010", "11010001000",
+	"11000101000", "11000100010", "10110111000", "10110001110", "10001101110",
+	"10111011000", "10111000110", "10001110110", "11101110110", "11010001110",
+	"11000101110", "11011101000", "11011100010", "11011101110", "11101011000",
+	"11101000110", "11100010110", "11101101000", "11101100010", "11100011010",
+	"11101111010", "11001000010", "11110001010", "10100110000", "10100001100",
+	"10010110000", "10010000110", "10000101100", "10000100110", "10110010000",
+	"10110000100", "10011010000", "10011000010", "10000110100", "10000110010",
+	"11000010010", "11001010000", "11110111010", "11000010100", "10001111010",
+	"10100111100", "10010111100", "10010011110", "10111100100", "10011110100",
+	"10011110010", "11110100100", "11110010100", "11110010010", "11011011110",
+	"11011110110", "11110110110", "10101111000", "10100011110", "10001011110",
+	"10111101000", "10111100010", "11110101000", "11110100010", "10111011110",
+	"10111101110", "11101011110", "11110101110", "11010000100", "11010010000",
+	"11010011100",
+}
+
+// The stop symbol, which includes the final bar of the code
+const CODE128_STOP = "1100011101011"
+
+// The Code 128 symbols we switch code sets with
+const (
+	CODE128_CODE_C  = 99
+	CODE128_CODE_B  = 100
+	CODE128_START_B = 104
+	CODE128_START_C = 105
+)
+
+// Encode the given printable ASCII text as a Code 128 barcode
+func encodeCode128(text string) ([]bool, error) {
+
+	if text == "" || len(text) > MAX_CODE128_TEXT {
+		return nil, fmt.Errorf("Code 128 barcodes hold between 1 and %d characters", MAX_CODE128_TEXT)
+	}
+
+	for _, c := range text {
+		if c < ' ' || c > '~' {
+			return nil, fmt.Errorf("Code 128 barcodes can only hold printable ASCII characters, not %q", c)
+		}
+	}
+
+	// Code set C is worth switching to for runs of at least four digits at either end of our
+	// text, or six in the middle of it (since we then have to switch back again). Runs of an
+	// odd length leave one digit in code set B, at whichever end of the run we switch at.
+	inCodeC := make([]bool, len(text))
+
+	for start := 0; start < len(text); {
+		end := start
+		for end < len(text) && text[end] >= '0' && text[end] <= '9' {
+			end++
+		}
+		if end == start {
+			start++
+			continue
+		}
+		run := end - start
+		worth := run >= 6 || run >= 4 && (start == 0 || end == len(text)) || run == 2 && run == len(text)
+		if worth {
+			from := end - run&^1
+			if start == 0 {
+				from = start
+			}
+			for i := from; i < from+run&^1; i++ {
+				inCodeC[i] = true
+			}
+		}
+		start = end
+	}
+
+	symbols := []int{CODE128_START_B}
+	if inCodeC[0] {
+		symbols[0] = CODE128_START_C
+	}
+
+	for i := 0; i < len(text); {
+		codeC := inCodeC[i]
+		if i > 0 && codeC != inCodeC[i-1] {
+			if codeC {
+				symbols = append(symbols, CODE128_CODE_C)
+			} else {
+				symbols = append(symbols, CODE128_CODE_B)
+			}
+		}
+		if codeC {
+			pair, _ := strconv.Atoi(text[i : i+2])
+			symbols = append(symbols, pair)
+			i += 2
+		} else {
+			symbols = append(symbols, int(text[i]-' '))
+			i++
+		}
+	}
+
+	// The check symbol is the weighted sum of our symbols (with the start symbol's weight
+	// being 1, like the first symbol after it)
+	checksum := symbols[0]
+	for i, symbol := range symbols[1:] {
+		checksum += (i + 1) * symbol
+	}
+	symbols = append(symbols, checksum%103)
+
+	var bars []bool
+	for _, symbol := range symbols {
+		bars = appendPattern(bars, code128Patterns[symbol])
+	}
+
+	return appendPattern(bars, CODE128_STOP), nil
+
+}
+
+// Append the modules of the given pattern of 1s (bars) and 0s (spaces)
+func appendPattern(bars []bool, pattern string) []bool {
+	for _, module := range pattern {
+		bars = append(bars, module == '1')
+	}
+	return bars
+}
+
+// The left hand (odd parity, or L) patterns of the EAN digits. The right hand (R) patterns are
+// these inverted, and the even parity (G) patterns are the R patterns reversed.
+var eanPatterns = [...]string{
+	"0001101", "0011001", "0010011", "0111101", "0100011",
+	"0110001", "0101111", "0111011", "0110111", "0001011",
+}
+
+// The parities of the left hand digits of an EAN-13 code, which encode its first digit
+var ean13Parities = [...]string{
+	"LLLLLL", "LLGLGG", "LLGGLG", "LLGGGL", "LGLLGG",
+	"LGGLLG", "LGGGLL", "LGLGLG", "LGLGGL", "LGGLGL",
+}
+
+// Returns the check digit for the given EAN digits (without a check digit)
+func eanCheckDigit(digits string) byte {
+
+	sum := 0
+	for i := range len(digits) {
+		weight := 1
+		if (len(digits)-i)%2 == 1 {
+			weight = 3 // The digits are weighted 3, 1, 3, ... from the right
+		}
+		sum += int(digits[i]-'0') * weight
+	}
+
+	return byte('0' + (10-sum%10)%10)
+
+}
+
+// Validate the given EAN number, which may leave out its check digit, returning all of its
+// digits (i.e. length 13 for EAN-13)
+func eanDigits(text string, length int) (string, error) {
+
+	text = strings.TrimSpace(text)
+
+	for _, c := range text {
+		if c < '0' || c > '9' {
+			return "", fmt.Errorf("EAN-%d codes can only hold digits, not %q", length, c)
+		}
+	}
+
+	switch len(text) {
+	case length - 1:
+		return text + string(eanCheckDigit(text)), nil
+	case length:
+		if check := eanCheckDigit(text[:length-1]); text[length-1] != check {
+			return "", fmt.Errorf("the check digit of %s should be %c", text, check)
+		}
+		return text, nil
+	}
+
+	return "", fmt.Errorf("EAN-%d codes hold %d digits (or %d without the check digit)", length, length, length-1)
+
+}
+
+// Encode the given EAN-13 or EAN-8 digits (including the check digit)
+func encodeEAN(digits string) []bool {
+
+	// EAN-13 codes encode their first digit in the parities of the left hand digits, while
+	// EAN-8 codes always use odd parity
+	parities := "LLLL"
+	if len(digits) == 13 {
+		parities = ean13Parities[digits[0]-'0']
+		digits = digits[1:]
+	}
+
+	half := len(digits) / 2
+	bars := appendPattern(nil, "101")
+
+	for i := range len(digits) {
+		pattern := []byte(eanPatterns[digits[i]-'0'])
+		if i < half && parities[i] == 'G' {
+			for a, b := 0, len(pattern)-1; a < b; a, b = a+1, b-1 {
+				pattern[a], pattern[b] = pattern[b], pattern[a]
+			}
+			pattern = invertPattern(pattern)
+		} else if i >= half {
+			pattern = invertPattern(pattern)
+		}
+		if i == half {
+			bars = appendPattern(bars, "01010")
+		}
+		bars = appendPattern(bars, string(pattern))
+	}
+
+	return appendPattern(bars, "101")
+
+}
+
+// Swap the bars and spaces of the given pattern
+func invertPattern(pattern []byte) []byte {
+	for i := range pattern {
+		pattern[i] ^= '0' ^ '1'
+	}
+	return pattern
+}
+
+// The size of the image of our code (in pixels) at the given scale and bar height. The bar
+// height is ignored for 2D codes.
+func (code *generatedCode) imageSize(scale int, height int) (int, int) {
+
+	width := (len(code.modules[0]) + 2*code.quietZone) * scale
+
+	if len(code.modules) > 1 {
+		return width, (len(code.modules) + 2*code.quietZone) * scale
+	}
+
+	return width, height
+
+}
+
+// Draw our code as a black and white PNG image
+func (code *generatedCode) png(scale int, height int) ([]byte, error) {
+
+	width, height := code.imageSize(scale, height)
+	canvas := image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{color.White, color.Black})
+
+	for y := range height {
+		row := code.modules[0]
+		if len(code.modules) > 1 {
+			moduleY := y/scale - code.quietZone
+			if moduleY < 0 || moduleY >= len(code.modules) {
+				continue
+			}
+			row = code.modules[moduleY]
+		}
+		for x := range width {
+			if module := x/scale - code.quietZone; module >= 0 && module < len(row) && row[module] {
+				canvas.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+
+	var encoded bytes.Buffer
+	err := png.Encode(&encoded, canvas)
+
+	return encoded.Bytes(), err
+
+}
+
+// Draw our code as an SVG image. Each run of dark modules is drawn as a single rectangle, and
+// 1D barcodes have their caption written beneath them.
+func (code *generatedCode) svg(scale int, height int) []byte {
+
+	width, barHeight := code.imageSize(scale, height)
+	if code.caption != "" {
+		height = barHeight + 2*scale + 16
+	} else {
+		height = barHeight
+	}
+
+	var output bytes.Buffer
+
+	fmt.Fprintf(&output, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		width, height, width, height)
+	fmt.Fprintf(&output, `<rect width="%d" height="%d" fill="#fff"/>`, width, height)
+
+	for y, row := range code.modules {
+		top, rowHeight := (y+code.quietZone)*scale, scale
+		if len(code.modules) == 1 {
+			top, rowHeight = 0, barHeight
+		}
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			run := 1
+			for x+run < len(row) && row[x+run] {
+				run++
+			}
+			fmt.Fprintf(&output, `<rect x="%d" y="%d" width="%d" height="%d"/>`, (x+code.quietZone)*scale, top, run*scale, rowHeight)
+			x += run // The module after our run is light, so we can skip it too
+		}
+	}
+
+	if code.caption != "" {
+		fmt.Fprintf(&output, `<text x="%d" y="%d" font-family="monospace" font-size="16" text-anchor="middle">%s</text>`,
+			width/2, height-4, html.EscapeString(code.caption))
+	}
+
+	output.WriteString(`</svg>`)
+
+	return output.Bytes()
+
+}
+
+// Parse the given positive number from our query string, which defaults to the given value
+func codeDimension(r *http.Request, name string, defaultValue int, maximum int) (int, error) {
+
+	value := r.URL.Query().Get(name)
+
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	number, err := strconv.Atoi(value)
+
+	if err != nil || number < 1 || number > maximum {
+		return 0, badRequestError(fmt.Sprintf("The %s parameter must be a number from 1 to %d.", name, maximum))
+	}
+
+	return number, nil
+
+}
+
+// This is our code handler, which draws the text parameter as a QR code or barcode. The format
+// parameter picks an SVG (the default) or PNG image, scale sets the size of each module and
+// height sets the height of 1D barcodes (both in pixels).
+func codeHandler(w http.ResponseWriter, r *http.Request) {
+
+	kind := r.PathValue("type")
+	query := r.URL.Query()
+
+	if !isCodeType(kind) {
+		writeError(w, r, notFoundError())
+		return
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = "svg"
+	} else if format != "svg" && format != "png" {
+		writeError(w, r, badRequestError("The format parameter must be svg or png."))
+		return
+	}
+
+	scale, err := codeDimension(r, "scale", DEFAULT_CODE_SCALE, MAX_CODE_SCALE)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	height, err := codeDimension(r, "height", DEFAULT_CODE_HEIGHT, MAX_CODE_HEIGHT)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	code, err := generateCode(kind, query.Get("text"))
+
+	if err != nil {
+		writeError(w, r, newAppError(http.StatusBadRequest, "invalid_code", capitalise(err.Error())+".").Wrap(err))
+		return
+	}
+
+	incrementCounter("codes_generated_total", "type", kind, "format", format)
+
+	// The same request always draws the same code
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+
+	if format == "png" {
+		encoded, err := code.png(scale, height)
+		if err != nil {
+			writeError(w, r, internalError(err).WithDetail("encoding a %s PNG", kind))
+			return
+		}
+		setContentType(w, "image/png")
+		w.Write(encoded)
+		return
+	}
+
+	setContentType(w, "image/svg+xml")
+	w.Write(code.svg(scale, height))
+
+}
+
+// Returns the given message with its first letter in upper case
+func capitalise(message string) string {
+	if message == "" {
+		return message
+	}
+	return strings.ToUpper(message[:1]) + message[1:]
+}
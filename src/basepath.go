@@ -0,0 +1,76 @@
+// Base path support, allowing the server to run behind a proxy under a sub-path (i.e. /demo).
+// Incoming requests must start with the base path, which is stripped before routing, and all
+// of the links we generate within our templates are prefixed with it.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Normalise the base path passed in via the -base-path flag so that it either is empty or
+// starts with a slash and doesn't end with one (i.e. "demo/" becomes "/demo")
+func normaliseBasePath(path string) (string, error) {
+
+	path = strings.Trim(path, "/")
+
+	if path == "" {
+		return "", nil
+	}
+
+	if strings.ContainsAny(path, "?#") {
+		return "", fmt.Errorf("invalid base path %q: must not contain a query or fragment", path)
+	}
+
+	return "/" + path, nil
+
+}
+
+// Returns the URL of the given site relative path (i.e. "/excel") taking our base path into
+// account. This is also available within our templates as the "url" function.
+func urlFor(path string) string {
+	return basePath + path
+}
+
+// Returns a handler which validates and strips our base path from incoming requests before
+// handing them off to our router. Requests outside of our base path receive a 404.
+func basePathHandler(next http.Handler) http.Handler {
+
+	// Without a base path there's nothing for us to do
+	if basePath == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// Redirect /demo to /demo/ so that our index page is found
+		if r.URL.Path == basePath {
+			target := basePath + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+
+		if !strings.HasPrefix(r.URL.Path, basePath+"/") {
+			writeError(w, r, notFoundError())
+			return
+		}
+
+		// Shallow copy our request and URL so that we don't modify the original request
+		// (which our logging middleware uses)
+		strippedRequest := new(http.Request)
+		*strippedRequest = *r
+		strippedURL := *r.URL
+		strippedRequest.URL = &strippedURL
+		strippedRequest.URL.Path = strings.TrimPrefix(r.URL.Path, basePath)
+		strippedRequest.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, basePath)
+
+		next.ServeHTTP(w, strippedRequest)
+
+	})
+
+}
@@ -0,0 +1,779 @@
+// A Brotli (RFC 7932) encoder. Go's standard library only has a gzip encoder and we don't want
+// to take on a dependency (or cgo) for our compression middleware, so this is a compact
+// encoder of our own. Input is split into meta-blocks of up to BROTLI_BLOCK_SIZE bytes, each
+// of which is compressed with LZ77 (using hash chains, searched more deeply at higher
+// qualities) and Huffman coded with a single prefix code per alphabet. Meta-blocks which
+// wouldn't get any smaller (i.e. of images or other compressed data) are stored uncompressed.
+//
+// The reference encoder additionally uses context modelling, block splitting and a built in
+// dictionary, which we don't, so our output is valid Brotli but with compression ratios
+// closer to gzip's than to the reference encoder's at the same quality.
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+const (
+	BROTLI_WINDOW_BITS   = 20                                      // Our sliding window is 1MB
+	BROTLI_MAX_DISTANCE  = 1<<BROTLI_WINDOW_BITS - 16              // The furthest back a match can be
+	BROTLI_BLOCK_SIZE    = 1 << 18                                 // How much input goes into a meta-block
+	BROTLI_HASH_BITS     = 15                                      // The size of our match hash table
+	BROTLI_MIN_MATCH     = 4                                       // The shortest match we look for
+	BROTLI_MAX_MATCH     = 1 << 16                                 // The longest match we look for
+	BROTLI_MIN_QUALITY   = 1                                       // Our fastest (and least thorough) quality
+	BROTLI_MAX_QUALITY   = 11                                      // Our slowest (and most thorough) quality
+	BROTLI_REPEAT_LENGTH = 16                                      // Code length code: repeat the previous length
+	BROTLI_REPEAT_ZERO   = 17                                      // Code length code: repeat a zero length
+	BROTLI_SIZE_LIMIT    = BROTLI_BLOCK_SIZE + BROTLI_MAX_DISTANCE // When we slide our window
+)
+
+// The base values and extra bits of the insert and copy length codes (RFC 7932 section 5)
+var (
+	brotliInsertBase  = []uint32{0, 1, 2, 3, 4, 5, 6, 8, 10, 14, 18, 26, 34, 50, 66, 98, 130, 194, 322, 578, 1090, 2114, 6210, 22594}
+	brotliInsertExtra = []uint8{0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 12, 14, 24}
+	brotliCopyBase    = []uint32{2, 3, 4, 5, 6, 7, 8, 9, 10, 12, 14, 18, 22, 30, 38, 54, 70, 102, 134, 198, 326, 582, 1094, 2118}
+	brotliCopyExtra   = []uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 24}
+)
+
+// The order in which the code lengths of the code length alphabet are stored, along with the
+// static prefix code they're stored with (as the value and bit count we write)
+var (
+	brotliCodeLengthOrder = []int{1, 2, 3, 4, 0, 5, 17, 6, 16, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	brotliCodeLengthValue = []uint64{0, 7, 3, 2, 1, 15}
+	brotliCodeLengthBits  = []uint{2, 4, 3, 2, 2, 4}
+)
+
+// A bit writer. Brotli packs its bits starting from the least significant bit of each byte.
+type brotliBitWriter struct {
+	output      []byte
+	accumulator uint64
+	count       uint
+}
+
+func (writer *brotliBitWriter) write(bits uint, value uint64) {
+	writer.accumulator |= value << writer.count
+	writer.count += bits
+	for writer.count >= 8 {
+		writer.output = append(writer.output, byte(writer.accumulator))
+		writer.accumulator >>= 8
+		writer.count -= 8
+	}
+}
+
+// Pad our output with zero bits up to the next byte boundary
+func (writer *brotliBitWriter) align() {
+	if writer.count > 0 {
+		writer.write(8-writer.count, 0)
+	}
+}
+
+// A single LZ77 command: a number of literals followed by a copy of earlier data
+type brotliCommand struct {
+	insert   int
+	copy     int // Zero for the final (insert only) command of a meta-block
+	distance int
+}
+
+// A brotliWriter compresses the data written to it, writing the Brotli stream to the
+// underlying writer
+type brotliWriter struct {
+	w        io.Writer
+	bits     brotliBitWriter
+	maxTries int  // How many earlier positions we compare against when looking for a match
+	lazy     bool // Whether we check if waiting a byte gives us a longer match
+	started  bool
+	err      error
+
+	// Our window holds previously compressed data (as far back as a match can reach) followed
+	// by the input we haven't compressed yet, starting at pending. head and chain are our hash
+	// chains: head holds the most recent position for each hash, and chain the position before
+	// each position with the same hash (or -1).
+	window  []byte
+	pending int
+	head    []int32
+	chain   []int32
+}
+
+// Create a new Brotli writer with the given quality (from 1 to 11)
+func newBrotliWriter(w io.Writer, quality int) *brotliWriter {
+
+	quality = min(max(quality, BROTLI_MIN_QUALITY), BROTLI_MAX_QUALITY)
+
+	writer := &brotliWriter{
+		w:        w,
+		maxTries: 1 << (quality - 1),
+		lazy:     quality >= 4,
+		head:     make([]int32, 1<<BROTLI_HASH_BITS),
+	}
+
+	for i := range writer.head {
+		writer.head[i] = -1
+	}
+
+	return writer
+
+}
+
+func (writer *brotliWriter) Write(p []byte) (int, error) {
+
+	if writer.err != nil {
+		return 0, writer.err
+	}
+
+	writer.window = append(writer.window, p...)
+
+	for len(writer.window)-writer.pending >= BROTLI_BLOCK_SIZE {
+		writer.compressBlock(writer.pending + BROTLI_BLOCK_SIZE)
+	}
+
+	return len(p), writer.writeOutput()
+
+}
+
+// Compress everything written so far and write it out, ending on a byte boundary (with an
+// empty metadata block) so that the client can decompress all of it straight away
+func (writer *brotliWriter) Flush() error {
+
+	if writer.err != nil {
+		return writer.err
+	}
+
+	writer.compressBlock(len(writer.window))
+	writer.startStream()
+
+	writer.bits.write(1, 0) // ISLAST
+	writer.bits.write(2, 3) // MNIBBLES (a metadata block)
+	writer.bits.write(1, 0) // Reserved
+	writer.bits.write(2, 0) // MSKIPBYTES (no metadata)
+	writer.bits.align()
+
+	return writer.writeOutput()
+
+}
+
+// Compress any remaining input and end our stream
+func (writer *brotliWriter) Close() error {
+
+	if writer.err != nil {
+		return writer.err
+	}
+
+	writer.compressBlock(len(writer.window))
+	writer.startStream()
+
+	writer.bits.write(1, 1) // ISLAST
+	writer.bits.write(1, 1) // ISLASTEMPTY
+	writer.bits.align()
+
+	if err := writer.writeOutput(); err != nil {
+		return err
+	}
+
+	writer.err = io.ErrClosedPipe
+	return nil
+
+}
+
+func (writer *brotliWriter) writeOutput() error {
+
+	if len(writer.bits.output) > 0 && writer.err == nil {
+		_, writer.err = writer.w.Write(writer.bits.output)
+		writer.bits.output = writer.bits.output[:0]
+	}
+
+	return writer.err
+
+}
+
+// Write our stream header (the window size) if we haven't already
+func (writer *brotliWriter) startStream() {
+	if !writer.started {
+		writer.bits.write(1, 1)
+		writer.bits.write(3, BROTLI_WINDOW_BITS-17)
+		writer.started = true
+	}
+}
+
+func brotliHash(data []byte) uint32 {
+	return (binary.LittleEndian.Uint32(data) * 0x1E35A7BD) >> (32 - BROTLI_HASH_BITS)
+}
+
+// Add the given window position to our hash chains
+func (writer *brotliWriter) insertHash(position int) {
+	if position+4 <= len(writer.window) {
+		hash := brotliHash(writer.window[position:])
+		writer.chain[position] = writer.head[hash]
+		writer.head[hash] = int32(position)
+	}
+}
+
+// Find the longest earlier match for the data at the given position, not reaching past end
+func (writer *brotliWriter) findMatch(position int, end int) (length int, distance int) {
+
+	limit := min(end-position, BROTLI_MAX_MATCH)
+
+	if limit < BROTLI_MIN_MATCH {
+		return 0, 0
+	}
+
+	window := writer.window
+	candidate := writer.head[brotliHash(window[position:])]
+
+	for tries := writer.maxTries; candidate >= 0 && tries > 0; tries-- {
+
+		candidateDistance := position - int(candidate)
+		if candidateDistance > BROTLI_MAX_DISTANCE {
+			break
+		}
+
+		// Only compare the whole match if it could beat the best one we have
+		if window[int(candidate)+length] == window[position+length] {
+			matchLength := 0
+			for matchLength < limit && window[int(candidate)+matchLength] == window[position+matchLength] {
+				matchLength++
+			}
+			if matchLength > length {
+				length, distance = matchLength, candidateDistance
+				if length == limit {
+					break
+				}
+			}
+		}
+
+		candidate = writer.chain[candidate]
+
+	}
+
+	if length < BROTLI_MIN_MATCH {
+		return 0, 0
+	}
+
+	return length, distance
+
+}
+
+// Compress our pending input up to the given window position as a single meta-block
+func (writer *brotliWriter) compressBlock(end int) {
+
+	start := writer.pending
+
+	if end <= start {
+		return
+	}
+
+	writer.startStream()
+
+	for len(writer.chain) < len(writer.window) {
+		writer.chain = append(writer.chain, -1)
+	}
+
+	var commands []brotliCommand
+	var literals []byte
+
+	position, literalStart := start, start
+
+	for position < end {
+
+		if end-position < BROTLI_MIN_MATCH {
+			break
+		}
+
+		length, distance := writer.findMatch(position, end)
+		writer.insertHash(position)
+
+		if length == 0 {
+			position++
+			continue
+		}
+
+		// Our match may be beaten by one starting at the next byte, in which case we emit this
+		// byte as a literal instead
+		if writer.lazy && length < BROTLI_MAX_MATCH {
+			if nextLength, _ := writer.findMatch(position+1, end); nextLength > length {
+				position++
+				continue
+			}
+		}
+
+		commands = append(commands, brotliCommand{insert: position - literalStart, copy: length, distance: distance})
+		literals = append(literals, writer.window[literalStart:position]...)
+
+		for i := position + 1; i < position+length; i++ {
+			writer.insertHash(i)
+		}
+
+		position += length
+		literalStart = position
+
+	}
+
+	if literalStart < end {
+		commands = append(commands, brotliCommand{insert: end - literalStart})
+		literals = append(literals, writer.window[literalStart:end]...)
+	}
+
+	writer.writeMetaBlock(writer.window[start:end], commands, literals)
+	writer.pending = end
+
+	// Drop the data which is too far back to be matched against, shifting our hash chains
+	if len(writer.window) > BROTLI_SIZE_LIMIT && writer.pending > BROTLI_MAX_DISTANCE {
+		drop := writer.pending - BROTLI_MAX_DISTANCE
+		writer.window = append(writer.window[:0], writer.window[drop:]...)
+		writer.chain = append(writer.chain[:0], writer.chain[drop:]...)
+		writer.pending -= drop
+
+		shift := func(positions []int32) {
+			for i, position := range positions {
+				positions[i] = max(position-int32(drop), -1)
+			}
+		}
+		shift(writer.head)
+		shift(writer.chain)
+	}
+
+}
+
+// Returns the code for the given insert or copy length
+func brotliLengthCode(base []uint32, length int) int {
+	code := len(base) - 1
+	for uint32(length) < base[code] {
+		code--
+	}
+	return code
+}
+
+// Returns the insert and copy command code for the given insert and copy length codes. We
+// always use the codes with an explicit distance.
+func brotliCommandCode(insertCode int, copyCode int) int {
+	cells := [3][3]int{{128, 192, 384}, {256, 320, 512}, {448, 576, 640}}
+	return cells[insertCode>>3][copyCode>>3] | (insertCode&7)<<3 | copyCode&7
+}
+
+// Returns the distance code for the given distance, along with its extra bits (assuming no
+// postfix bits or direct distance codes)
+func brotliDistanceCode(distance int) (code int, extraBits uint, extra uint64) {
+	value := distance + 3
+	bits := uint(0)
+	for value>>(bits+1) > 1 {
+		bits++
+	}
+	prefix := (value >> bits) & 1
+	return 16 + 2*(int(bits)-1) + prefix, bits, uint64(value - (2+prefix)<<bits)
+}
+
+// Write out a meta-block of the given data, compressed with the given commands unless that
+// takes more bits than the data itself (i.e. for data which is already compressed), in which
+// case we store the data as it is
+func (writer *brotliWriter) writeMetaBlock(data []byte, commands []brotliCommand, literals []byte) {
+
+	bits := &writer.bits
+	saved := *bits
+
+	writer.writeCompressedMetaBlock(len(data), commands, literals)
+
+	// An uncompressed meta-block's data starts at the byte boundary after its header
+	compressedBits := 8*(len(bits.output)-len(saved.output)) + int(bits.count) - int(saved.count)
+	uncompressedBits := (int(saved.count)+brotliMetaBlockHeaderBits(len(data))+7)/8*8 - int(saved.count) + 8*len(data)
+
+	if compressedBits <= uncompressedBits {
+		return
+	}
+
+	bits.output, bits.accumulator, bits.count = bits.output[:len(saved.output)], saved.accumulator, saved.count
+
+	writer.writeMetaBlockHeader(len(data))
+	bits.write(1, 1) // ISUNCOMPRESSED
+	bits.align()
+	bits.output = append(bits.output, data...)
+
+}
+
+// Returns the number of nibbles a meta-block of the given length stores its length in
+func brotliLengthNibbles(length int) int {
+	nibbles := 4
+	for length-1 >= 1<<(4*nibbles) {
+		nibbles++
+	}
+	return nibbles
+}
+
+// Returns the number of bits in the header of a meta-block of the given length, up to and
+// including ISUNCOMPRESSED
+func brotliMetaBlockHeaderBits(length int) int {
+	return 1 + 2 + 4*brotliLengthNibbles(length) + 1
+}
+
+// Write out the header of a (non-final) meta-block of the given length, up to ISUNCOMPRESSED
+func (writer *brotliWriter) writeMetaBlockHeader(length int) {
+	nibbles := brotliLengthNibbles(length)
+	writer.bits.write(1, 0) // ISLAST
+	writer.bits.write(2, uint64(nibbles-4))
+	writer.bits.write(uint(4*nibbles), uint64(length-1))
+}
+
+// Write out a compressed meta-block containing the given commands
+func (writer *brotliWriter) writeCompressedMetaBlock(length int, commands []brotliCommand, literals []byte) {
+
+	bits := &writer.bits
+
+	// Gather the statistics for our prefix codes
+	literalHistogram := make([]uint32, 256)
+	commandHistogram := make([]uint32, 704)
+	distanceHistogram := make([]uint32, 64)
+
+	for _, literal := range literals {
+		literalHistogram[literal]++
+	}
+
+	for _, command := range commands {
+		copyLength := max(command.copy, 4)
+		commandHistogram[brotliCommandCode(brotliLengthCode(brotliInsertBase, command.insert), brotliLengthCode(brotliCopyBase, copyLength))]++
+		if command.copy > 0 {
+			code, _, _ := brotliDistanceCode(command.distance)
+			distanceHistogram[code]++
+		}
+	}
+
+	// Our meta-block header
+	writer.writeMetaBlockHeader(length)
+	bits.write(1, 0) // ISUNCOMPRESSED
+	bits.write(1, 0) // A single literal block type
+	bits.write(1, 0) // A single command block type
+	bits.write(1, 0) // A single distance block type
+	bits.write(2, 0) // NPOSTFIX
+	bits.write(4, 0) // NDIRECT
+	bits.write(2, 0) // The literal context mode (irrelevant with a single prefix code)
+	bits.write(1, 0) // A single literal prefix code
+	bits.write(1, 0) // A single distance prefix code
+
+	literalLengths, literalCodes := bits.writePrefixCode(literalHistogram, 8)
+	commandLengths, commandCodes := bits.writePrefixCode(commandHistogram, 10)
+	distanceLengths, distanceCodes := bits.writePrefixCode(distanceHistogram, 6)
+
+	// And finally our commands
+	for _, command := range commands {
+
+		insertCode := brotliLengthCode(brotliInsertBase, command.insert)
+		copyLength := max(command.copy, 4)
+		copyCode := brotliLengthCode(brotliCopyBase, copyLength)
+		commandCode := brotliCommandCode(insertCode, copyCode)
+
+		bits.write(uint(commandLengths[commandCode]), uint64(commandCodes[commandCode]))
+		bits.write(uint(brotliInsertExtra[insertCode]), uint64(uint32(command.insert)-brotliInsertBase[insertCode]))
+		bits.write(uint(brotliCopyExtra[copyCode]), uint64(uint32(copyLength)-brotliCopyBase[copyCode]))
+
+		for _, literal := range literals[:command.insert] {
+			bits.write(uint(literalLengths[literal]), uint64(literalCodes[literal]))
+		}
+		literals = literals[command.insert:]
+
+		// The meta-block ends after the literals of our final command, so its distance (and
+		// copy) are never read
+		if command.copy > 0 {
+			code, extraBits, extra := brotliDistanceCode(command.distance)
+			bits.write(uint(distanceLengths[code]), uint64(distanceCodes[code]))
+			bits.write(extraBits, extra)
+		}
+
+	}
+
+}
+
+// Write out the prefix code for the given histogram, returning the code lengths and (bit
+// reversed) codes of each symbol
+func (writer *brotliBitWriter) writePrefixCode(histogram []uint32, alphabetBits uint) ([]uint8, []uint16) {
+
+	var symbols []int
+	for symbol, count := range histogram {
+		if count > 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+
+	lengths := make([]uint8, len(histogram))
+
+	// Up to four symbols can be stored as a "simple" prefix code, where the code lengths are
+	// implied by the number of symbols
+	if len(symbols) <= 4 {
+
+		if len(symbols) == 0 {
+			symbols = []int{0}
+		}
+
+		// The most frequent symbols come first as they may get the shorter codes
+		sort.SliceStable(symbols, func(i, j int) bool {
+			return histogram[symbols[i]] > histogram[symbols[j]]
+		})
+
+		writer.write(2, 1)
+		writer.write(2, uint64(len(symbols)-1))
+		for _, symbol := range symbols {
+			writer.write(alphabetBits, uint64(symbol))
+		}
+
+		implied := [][]uint8{{0}, {1, 1}, {1, 2, 2}, {2, 2, 2, 2}}[len(symbols)-1]
+
+		// With four symbols we choose between lengths of 2, 2, 2, 2 and 1, 2, 3, 3 (which is
+		// shorter when the most frequent symbol outnumbers the two least frequent)
+		if len(symbols) == 4 {
+			if histogram[symbols[0]] > histogram[symbols[2]]+histogram[symbols[3]] {
+				implied = []uint8{1, 2, 3, 3}
+				writer.write(1, 1)
+			} else {
+				writer.write(1, 0)
+			}
+		}
+
+		for i, symbol := range symbols {
+			lengths[symbol] = implied[i]
+		}
+
+		return lengths, brotliCanonicalCodes(lengths)
+
+	}
+
+	copy(lengths, huffmanCodeLengths(histogram, 15))
+	writer.writeCodeLengths(lengths)
+
+	return lengths, brotliCanonicalCodes(lengths)
+
+}
+
+// Write out a "complex" prefix code: the code lengths of our symbols, run length encoded and
+// themselves Huffman coded
+func (writer *brotliBitWriter) writeCodeLengths(lengths []uint8) {
+
+	// Run length encode our code lengths, leaving out any trailing zeros
+	end := len(lengths)
+	for end > 0 && lengths[end-1] == 0 {
+		end--
+	}
+
+	var codes, extras []uint8
+	emit := func(code uint8, extra uint8) {
+		codes = append(codes, code)
+		extras = append(extras, extra)
+	}
+
+	previous := uint8(8)
+
+	for i := 0; i < end; {
+
+		value := lengths[i]
+		repetitions := 1
+		for i+repetitions < end && lengths[i+repetitions] == value {
+			repetitions++
+		}
+		i += repetitions
+
+		if value == 0 {
+			brotliRunLengthCodes(emit, 0, repetitions, BROTLI_REPEAT_ZERO, 3, 11)
+			continue
+		}
+
+		if value != previous {
+			emit(value, 0)
+			repetitions--
+		}
+		brotliRunLengthCodes(emit, value, repetitions, BROTLI_REPEAT_LENGTH, 2, 7)
+		previous = value
+
+	}
+
+	// Huffman code our run length codes
+	histogram := make([]uint32, 18)
+	for _, code := range codes {
+		histogram[code]++
+	}
+
+	codeLengths := huffmanCodeLengths(histogram, 5)
+
+	used := 0
+	for _, length := range codeLengths {
+		if length > 0 {
+			used++
+		}
+	}
+
+	// The code lengths are stored in a special order, leaving out the trailing zeros (unless
+	// only one code is used, in which case the decoder reads all of them)
+	stored := len(brotliCodeLengthOrder)
+	if used > 1 {
+		for codeLengths[brotliCodeLengthOrder[stored-1]] == 0 {
+			stored--
+		}
+	}
+
+	writer.write(2, 0) // HSKIP
+	for _, code := range brotliCodeLengthOrder[:stored] {
+		writer.write(brotliCodeLengthBits[codeLengths[code]], brotliCodeLengthValue[codeLengths[code]])
+	}
+
+	// A lone code takes up no bits at all
+	if used == 1 {
+		for code := range codeLengths {
+			codeLengths[code] = 0
+		}
+	}
+
+	huffmanCodes := brotliCanonicalCodes(codeLengths)
+
+	for i, code := range codes {
+		writer.write(uint(codeLengths[code]), uint64(huffmanCodes[code]))
+		switch code {
+		case BROTLI_REPEAT_LENGTH:
+			writer.write(2, uint64(extras[i]))
+		case BROTLI_REPEAT_ZERO:
+			writer.write(3, uint64(extras[i]))
+		}
+	}
+
+}
+
+// Emit the given number of repetitions of a code length, using the given repeat code (with
+// extra bits) for runs of three or more. Consecutive repeat codes multiply, so long runs are
+// written as a few repeat codes, most significant first.
+func brotliRunLengthCodes(emit func(code uint8, extra uint8), value uint8, repetitions int, repeatCode uint8, extraBits uint, awkward int) {
+
+	// A run of this length can't be written with repeat codes alone
+	if repetitions == awkward {
+		emit(value, 0)
+		repetitions--
+	}
+
+	if repetitions < 3 {
+		for ; repetitions > 0; repetitions-- {
+			emit(value, 0)
+		}
+		return
+	}
+
+	var extras []uint8
+	repetitions -= 3
+	for {
+		extras = append(extras, uint8(repetitions&(1<<extraBits-1)))
+		repetitions >>= extraBits
+		if repetitions == 0 {
+			break
+		}
+		repetitions--
+	}
+
+	for i := len(extras) - 1; i >= 0; i-- {
+		emit(repeatCode, extras[i])
+	}
+
+}
+
+// Returns the lengths of the Huffman codes for the given histogram, no longer than the given
+// limit. If the optimal code is too long, we flatten the histogram until it fits.
+func huffmanCodeLengths(histogram []uint32, limit int) []uint8 {
+
+	lengths := make([]uint8, len(histogram))
+
+	type huffmanNode struct {
+		count       uint32
+		symbol      int
+		left, right int
+	}
+
+	for minimum := uint32(1); ; minimum *= 2 {
+
+		var nodes []huffmanNode
+		for symbol, count := range histogram {
+			if count > 0 {
+				nodes = append(nodes, huffmanNode{count: max(count, minimum), symbol: symbol, left: -1, right: -1})
+			}
+		}
+
+		if len(nodes) == 0 {
+			return lengths
+		}
+
+		if len(nodes) == 1 {
+			lengths[nodes[0].symbol] = 1
+			return lengths
+		}
+
+		sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].count < nodes[j].count })
+
+		// Our leaves (in order of count) and the internal nodes we create (which are also
+		// created in order of count) form two queues we repeatedly take the smallest from
+		leaves := len(nodes)
+		nextLeaf, nextInternal := 0, leaves
+
+		smallest := func() int {
+			if nextLeaf < leaves && (nextInternal >= len(nodes) || nodes[nextLeaf].count <= nodes[nextInternal].count) {
+				nextLeaf++
+				return nextLeaf - 1
+			}
+			nextInternal++
+			return nextInternal - 1
+		}
+
+		for len(nodes) < 2*leaves-1 {
+			left, right := smallest(), smallest()
+			nodes = append(nodes, huffmanNode{count: nodes[left].count + nodes[right].count, left: left, right: right})
+		}
+
+		// The length of each code is the depth of its leaf
+		depths := make([]int, len(nodes))
+		maxDepth := 0
+		for i := len(nodes) - 1; i >= leaves; i-- {
+			depths[nodes[i].left] = depths[i] + 1
+			depths[nodes[i].right] = depths[i] + 1
+		}
+		for i := 0; i < leaves; i++ {
+			maxDepth = max(maxDepth, depths[i])
+		}
+
+		if maxDepth <= limit {
+			for i := 0; i < leaves; i++ {
+				lengths[nodes[i].symbol] = uint8(depths[i])
+			}
+			return lengths
+		}
+
+	}
+
+}
+
+// Returns the canonical prefix codes for the given code lengths. The codes are bit reversed,
+// as prefix codes are packed starting from their most significant bit.
+func brotliCanonicalCodes(lengths []uint8) []uint16 {
+
+	var lengthCounts [16]int
+	for _, length := range lengths {
+		lengthCounts[length]++
+	}
+	lengthCounts[0] = 0
+
+	var nextCode [16]int
+	code := 0
+	for length := 1; length < 16; length++ {
+		code = (code + lengthCounts[length-1]) << 1
+		nextCode[length] = code
+	}
+
+	codes := make([]uint16, len(lengths))
+
+	for symbol, length := range lengths {
+		if length == 0 {
+			continue
+		}
+		code := nextCode[length]
+		nextCode[length]++
+		reversed := 0
+		for i := 0; i < int(length); i++ {
+			reversed = reversed<<1 | code>>i&1
+		}
+		codes[symbol] = uint16(reversed)
+	}
+
+	return codes
+
+}
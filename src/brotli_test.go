@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// A bit reader for our test decoder, which reads bits starting from the least significant bit
+// of each byte
+type brotliBitReader struct {
+	data     []byte
+	position int // In bits
+}
+
+func (reader *brotliBitReader) read(bits int) (int, error) {
+	value := 0
+	for i := 0; i < bits; i++ {
+		if reader.position >= 8*len(reader.data) {
+			return 0, errors.New("unexpected end of stream")
+		}
+		value |= int(reader.data[reader.position/8]>>(reader.position%8)&1) << i
+		reader.position++
+	}
+	return value, nil
+}
+
+func (reader *brotliBitReader) align() {
+	reader.position = (reader.position + 7) / 8 * 8
+}
+
+// A canonical prefix code, decoded a bit at a time
+type brotliTestCode struct {
+	counts  [16]int // The number of codes of each length
+	symbols []int   // By code length, then by symbol
+}
+
+func newBrotliTestCode(lengths []int) (*brotliTestCode, error) {
+
+	code := &brotliTestCode{}
+	for length := 1; length < 16; length++ {
+		for symbol, symbolLength := range lengths {
+			if symbolLength == length {
+				code.counts[length]++
+				code.symbols = append(code.symbols, symbol)
+			}
+		}
+	}
+
+	// A lone symbol takes up no bits at all, otherwise the code must be complete
+	if len(code.symbols) == 1 {
+		code.counts = [16]int{}
+		return code, nil
+	}
+
+	space := 1 << 15
+	for length := 1; length < 16; length++ {
+		space -= code.counts[length] << (15 - length)
+	}
+	if space != 0 {
+		return nil, fmt.Errorf("incomplete or oversubscribed prefix code with lengths %v", lengths)
+	}
+
+	return code, nil
+
+}
+
+func (code *brotliTestCode) decode(reader *brotliBitReader) (int, error) {
+
+	if len(code.symbols) == 1 {
+		return code.symbols[0], nil
+	}
+
+	value, first, index := 0, 0, 0
+	for length := 1; length < 16; length++ {
+		bit, err := reader.read(1)
+		if err != nil {
+			return 0, err
+		}
+		value |= bit
+		count := code.counts[length]
+		if value-first < count {
+			return code.symbols[index+value-first], nil
+		}
+		index += count
+		first = (first + count) << 1
+		value <<= 1
+	}
+
+	return 0, errors.New("invalid prefix code")
+
+}
+
+// Read a prefix code over an alphabet of the given size (RFC 7932 section 3.4 and 3.5)
+func readBrotliTestCode(reader *brotliBitReader, alphabetSize int) (*brotliTestCode, error) {
+
+	alphabetBits := 0
+	for 1<<alphabetBits < alphabetSize {
+		alphabetBits++
+	}
+
+	lengths := make([]int, alphabetSize)
+
+	hskip, err := reader.read(2)
+	if err != nil {
+		return nil, err
+	}
+
+	if hskip == 1 {
+		count, err := reader.read(2)
+		if err != nil {
+			return nil, err
+		}
+		symbols := make([]int, count+1)
+		for i := range symbols {
+			if symbols[i], err = reader.read(alphabetBits); err != nil {
+				return nil, err
+			}
+			if symbols[i] >= alphabetSize || lengths[symbols[i]] != 0 {
+				return nil, fmt.Errorf("invalid simple prefix code symbol %d", symbols[i])
+			}
+			lengths[symbols[i]] = -1
+		}
+		implied := [][]int{{0}, {1, 1}, {1, 2, 2}, {2, 2, 2, 2}}[count]
+		if count == 3 {
+			if selected, err := reader.read(1); err != nil {
+				return nil, err
+			} else if selected == 1 {
+				implied = []int{1, 2, 3, 3}
+			}
+		}
+		for i, symbol := range symbols {
+			lengths[symbol] = implied[i]
+		}
+		if count == 0 {
+			return &brotliTestCode{symbols: symbols}, nil
+		}
+		return newBrotliTestCode(lengths)
+	}
+
+	// The code lengths of our code are themselves prefix coded, with a static code
+	codeLengthLengths := make([]int, len(brotliCodeLengthOrder))
+	space, used := 32, 0
+	for _, symbol := range brotliCodeLengthOrder[hskip:] {
+		if space <= 0 {
+			break
+		}
+		peek := *reader
+		bits, _ := peek.read(4)
+		length, size := 0, 2
+		switch {
+		case bits&3 == 0:
+			length = 0
+		case bits&3 == 2:
+			length = 3
+		case bits&3 == 1:
+			length = 4
+		case bits&7 == 3:
+			length, size = 2, 3
+		case bits&15 == 7:
+			length, size = 1, 4
+		default:
+			length, size = 5, 4
+		}
+		if _, err := reader.read(size); err != nil {
+			return nil, err
+		}
+		codeLengthLengths[symbol] = length
+		if length > 0 {
+			space -= 32 >> length
+			used++
+		}
+	}
+	if used != 1 && space != 0 {
+		return nil, errors.New("invalid code length code")
+	}
+
+	codeLengthCode, err := newBrotliTestCode(codeLengthLengths)
+	if err != nil {
+		return nil, err
+	}
+
+	symbol, previous, repeat, repeatLength := 0, 8, 0, 0
+	space = 1 << 15
+	for symbol < alphabetSize && space > 0 {
+		code, err := codeLengthCode.decode(reader)
+		if err != nil {
+			return nil, err
+		}
+		if code < BROTLI_REPEAT_LENGTH {
+			repeat = 0
+			lengths[symbol] = code
+			symbol++
+			if code != 0 {
+				previous = code
+				space -= 1 << 15 >> code
+			}
+			continue
+		}
+		extraBits, length := 2, previous
+		if code == BROTLI_REPEAT_ZERO {
+			extraBits, length = 3, 0
+		}
+		if repeatLength != length {
+			repeat, repeatLength = 0, length
+		}
+		previousRepeat := repeat
+		if repeat > 0 {
+			repeat = (repeat - 2) << extraBits
+		}
+		extra, err := reader.read(extraBits)
+		if err != nil {
+			return nil, err
+		}
+		repeat += extra + 3
+		delta := repeat - previousRepeat
+		if symbol+delta > alphabetSize {
+			return nil, errors.New("code lengths run past the alphabet")
+		}
+		for range delta {
+			lengths[symbol] = repeatLength
+			symbol++
+		}
+		if repeatLength != 0 {
+			space -= delta << 15 >> repeatLength
+		}
+	}
+
+	return newBrotliTestCode(lengths)
+
+}
+
+// Decode the given Brotli stream. This handles what our encoder produces (along with the distance
+// ring buffer of the format), and fails on the features it doesn't use: block switching, context
+// modelling and the built in dictionary.
+func decodeBrotliForTest(stream []byte) ([]byte, error) {
+
+	reader := &brotliBitReader{data: stream}
+	var output []byte
+
+	windowBits := 16
+	if large, err := reader.read(1); err != nil {
+		return nil, err
+	} else if large == 1 {
+		bits, _ := reader.read(3)
+		if bits == 0 {
+			return nil, errors.New("unexpected window size")
+		}
+		windowBits = 17 + bits
+	}
+	maxDistance := 1<<windowBits - 16
+
+	distances := []int{16, 15, 11, 4} // The last distance is at the end
+
+	for {
+
+		last, err := reader.read(1)
+		if err != nil {
+			return nil, err
+		}
+		if last == 1 {
+			if empty, _ := reader.read(1); empty == 1 {
+				break
+			}
+		}
+
+		nibbles, err := reader.read(2)
+		if err != nil {
+			return nil, err
+		}
+
+		// Metadata blocks are skipped
+		if nibbles == 3 {
+			if reserved, _ := reader.read(1); reserved != 0 {
+				return nil, errors.New("reserved bit set")
+			}
+			skipBytes, _ := reader.read(2)
+			skip := 0
+			if skipBytes > 0 {
+				skip, _ = reader.read(8 * skipBytes)
+				skip++
+			}
+			reader.align()
+			reader.position += 8 * skip
+			continue
+		}
+
+		length, err := reader.read(4 * (nibbles + 4))
+		if err != nil {
+			return nil, err
+		}
+		length++
+
+		if last == 0 {
+			if uncompressed, _ := reader.read(1); uncompressed == 1 {
+				reader.align()
+				start := reader.position / 8
+				if start+length > len(stream) {
+					return nil, errors.New("uncompressed meta-block runs past the stream")
+				}
+				output = append(output, stream[start:start+length]...)
+				reader.position += 8 * length
+				continue
+			}
+		}
+
+		// A single block type of each kind and a single prefix code for each alphabet
+		for range 3 {
+			if types, _ := reader.read(1); types != 0 {
+				return nil, errors.New("block switching isn't supported")
+			}
+		}
+		postfix, _ := reader.read(2)
+		direct, _ := reader.read(4)
+		direct <<= postfix
+		reader.read(2) // The literal context mode
+		for range 2 {
+			if trees, _ := reader.read(1); trees != 0 {
+				return nil, errors.New("context modelling isn't supported")
+			}
+		}
+
+		literalCode, err := readBrotliTestCode(reader, 256)
+		if err != nil {
+			return nil, fmt.Errorf("literal code: %w", err)
+		}
+		commandCode, err := readBrotliTestCode(reader, 704)
+		if err != nil {
+			return nil, fmt.Errorf("command code: %w", err)
+		}
+		distanceCode, err := readBrotliTestCode(reader, 16+direct+48<<postfix)
+		if err != nil {
+			return nil, fmt.Errorf("distance code: %w", err)
+		}
+
+		for remaining := length; remaining > 0; {
+
+			command, err := commandCode.decode(reader)
+			if err != nil {
+				return nil, err
+			}
+
+			cell := command >> 6
+			insertCode := []int{0, 0, 0, 0, 8, 8, 0, 16, 8, 16, 16}[cell] + command>>3&7
+			copyCode := []int{0, 8, 0, 8, 0, 8, 16, 0, 16, 8, 16}[cell] + command&7
+
+			insertExtra, _ := reader.read(int(brotliInsertExtra[insertCode]))
+			copyExtra, _ := reader.read(int(brotliCopyExtra[copyCode]))
+			insert := int(brotliInsertBase[insertCode]) + insertExtra
+			copyLength := int(brotliCopyBase[copyCode]) + copyExtra
+
+			if insert > remaining {
+				return nil, errors.New("literals run past the meta-block")
+			}
+			for range insert {
+				literal, err := literalCode.decode(reader)
+				if err != nil {
+					return nil, err
+				}
+				output = append(output, byte(literal))
+			}
+			remaining -= insert
+
+			if remaining == 0 {
+				break
+			}
+
+			code := 0
+			if command >= 128 {
+				if code, err = distanceCode.decode(reader); err != nil {
+					return nil, err
+				}
+			}
+
+			last, secondLast := distances[3], distances[2]
+			var distance int
+			switch {
+			case code < 4:
+				distance = distances[3-code]
+			case code < 10:
+				distance = last + []int{-1, 1, -2, 2, -3, 3}[code-4]
+			case code < 16:
+				distance = secondLast + []int{-1, 1, -2, 2, -3, 3}[code-10]
+			case code < 16+direct:
+				distance = code - 15
+			default:
+				code -= direct + 16
+				extraBits := 1 + code>>(postfix+1)
+				extra, err := reader.read(extraBits)
+				if err != nil {
+					return nil, err
+				}
+				offset := (2+(code>>postfix)&1)<<extraBits - 4
+				distance = (offset+extra)<<postfix + code&(1<<postfix-1) + direct + 1
+			}
+
+			if distance <= 0 || distance > min(len(output), maxDistance) {
+				return nil, fmt.Errorf("invalid distance %d at %d", distance, len(output))
+			}
+			if code != 0 {
+				distances = append(distances[1:], distance)
+			}
+
+			if copyLength > remaining {
+				return nil, errors.New("copy runs past the meta-block")
+			}
+			for range copyLength {
+				output = append(output, output[len(output)-distance])
+			}
+			remaining -= copyLength
+
+		}
+
+		if last == 1 {
+			break
+		}
+
+	}
+
+	return output, nil
+
+}
+
+// Returns text which repeats itself with variations, like a web page does
+func brotliTestText(size int) []byte {
+	random := rand.New(rand.NewSource(1))
+	words := strings.Fields("the quick brown fox jumps over lazy dog <div class=\"main-content\"> </div> golang server")
+	var text bytes.Buffer
+	for text.Len() < size {
+		text.WriteString(words[random.Intn(len(words))])
+		text.WriteByte(" \n"[random.Intn(8)/7])
+	}
+	return text.Bytes()[:size]
+}
+
+func TestBrotliWriterRoundTrips(t *testing.T) {
+
+	random := make([]byte, 3*BROTLI_BLOCK_SIZE/2)
+	rand.New(rand.NewSource(2)).Read(random)
+
+	inputs := []struct {
+		name   string
+		chunks [][]byte // Written one after the other, flushing after each but the last
+	}{
+		{"empty", [][]byte{{}}},
+		{"short", [][]byte{[]byte("hello")}},
+		{"a single byte repeated", [][]byte{bytes.Repeat([]byte{'a'}, 100000)}},
+		{"repetitive", [][]byte{bytes.Repeat([]byte("<p>Hello, world!</p>\n"), 5000)}},
+		{"random", [][]byte{random}},
+		{"large", [][]byte{brotliTestText(3*BROTLI_BLOCK_SIZE + 12345)}},
+		{"past the window", [][]byte{append(brotliTestText(BROTLI_SIZE_LIMIT), brotliTestText(BROTLI_BLOCK_SIZE)...)}},
+		{"flushed", [][]byte{[]byte("data: one\n\n"), []byte("data: two\n\n"), {}, []byte("data: one\n\ndata: three\n\n")}},
+		{"flushed mid block", [][]byte{brotliTestText(BROTLI_BLOCK_SIZE + 100), random[:1000], brotliTestText(5000)}},
+	}
+
+	for _, quality := range []int{BROTLI_MIN_QUALITY, 4, 6, 9, BROTLI_MAX_QUALITY} {
+		for _, input := range inputs {
+			t.Run(fmt.Sprintf("%s at quality %d", input.name, quality), func(t *testing.T) {
+
+				var compressed bytes.Buffer
+				writer := newBrotliWriter(&compressed, quality)
+
+				var want []byte
+				for i, chunk := range input.chunks {
+					writer.Write(chunk)
+					want = append(want, chunk...)
+					if i < len(input.chunks)-1 {
+						if err := writer.Flush(); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+				if err := writer.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				got, err := decodeBrotliForTest(compressed.Bytes())
+				if err != nil {
+					t.Fatalf("decoding: %v", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("got %d bytes back, want the %d bytes we compressed", len(got), len(want))
+				}
+
+			})
+		}
+	}
+
+}
+
+func TestBrotliWriterStoresIncompressibleData(t *testing.T) {
+
+	random := make([]byte, 2*BROTLI_BLOCK_SIZE+1000)
+	rand.New(rand.NewSource(3)).Read(random)
+
+	var compressed bytes.Buffer
+	writer := newBrotliWriter(&compressed, BROTLI_MAX_QUALITY)
+	writer.Write(random)
+	writer.Close()
+
+	// Each meta-block costs a few bytes of header, but its data is stored as it is
+	if overhead := compressed.Len() - len(random); overhead > 16 {
+		t.Errorf("got %d bytes from %d random bytes, want no more than 16 bytes more", compressed.Len(), len(random))
+	}
+
+	if got, err := decodeBrotliForTest(compressed.Bytes()); err != nil || !bytes.Equal(got, random) {
+		t.Errorf("the stored data didn't round trip (%v)", err)
+	}
+
+}
@@ -0,0 +1,85 @@
+// Canary routing for our proxy mode. With -canary set to a second upstream origin, part of our
+// traffic goes to it rather than to our main (-proxy) upstream, so that the server can be used
+// as a tiny canary router:
+//
+//	-proxy http://localhost:3000 -canary http://localhost:3001 -canary-percent 5 -canary-match header:X-Canary=1
+//
+// Requests matching -canary-match (a header or cookie, with an optional value) always go to the
+// canary, and -canary-percent percent of the remaining requests do too. Responses from each
+// upstream are cached separately, and proxied requests are counted per upstream in the
+// proxy_upstream_requests_total metric.
+
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+)
+
+// Our canary upstream, along with the requests which are sent to it
+type canaryRoute struct {
+	target  *proxyTarget
+	percent float64 // The percentage of (non matching) requests sent to the canary
+	source  string  // What we match requests on: header or cookie (or "" to match nothing)
+	name    string  // The header or cookie name
+	value   string  // The value the header or cookie must have ("" for any value)
+}
+
+// Create a new canary route to the given upstream. The match is in the form header:<name>,
+// header:<name>=<value>, cookie:<name> or cookie:<name>=<value>.
+func newCanaryRoute(upstream string, percent float64, match string) (*canaryRoute, error) {
+
+	target, err := newProxyTarget("canary", upstream)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("the canary percentage must be between 0 and 100")
+	}
+
+	route := &canaryRoute{target: target, percent: percent}
+
+	if match != "" {
+
+		source, nameValue, found := strings.Cut(match, ":")
+		route.name, route.value, _ = strings.Cut(nameValue, "=")
+
+		if !found || source != "header" && source != "cookie" || route.name == "" {
+			return nil, fmt.Errorf("invalid canary match %q: expected header:<name>[=<value>] or cookie:<name>[=<value>]", match)
+		}
+
+		route.source = source
+
+	}
+
+	return route, nil
+
+}
+
+// Returns whether the given request should go to our canary
+func (route *canaryRoute) matches(r *http.Request) bool {
+
+	var value string
+	var present bool
+
+	switch route.source {
+	case "header":
+		values := r.Header.Values(route.name)
+		value, present = strings.Join(values, ", "), len(values) > 0
+	case "cookie":
+		if cookie, err := r.Cookie(route.name); err == nil {
+			value, present = cookie.Value, true
+		}
+	}
+
+	if present && (route.value == "" || value == route.value) {
+		return true
+	}
+
+	return rand.Float64()*100 < route.percent
+
+}
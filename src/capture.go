@@ -0,0 +1,516 @@
+// Request capture and replay. To reproduce a bug reported with a request ID from our logs, an
+// admin can capture full requests (method, URL, headers and body) matching a filter into a
+// bounded in-memory store, and later replay a captured request against our own handler stack
+// or another server (i.e. a development copy with extra logging).
+//
+// A filter is a comma separated list of conditions which must all match, each in the form
+// field:value with the fields path (path prefix), method, status (status class) and ua (user
+// agent substring), i.e. "path:/api,method:POST,status:5xx". Filters are set with the -capture
+// flag or at runtime via our admin API:
+//
+//	PUT    /debug/capture                  {"filter": "path:/api,status:5xx"} starts capturing
+//	GET    /debug/capture                  lists the filter and the captured requests
+//	DELETE /debug/capture                  stops capturing and clears our captured requests
+//	GET    /debug/capture/{id}             returns a captured request
+//	POST   /debug/capture/{id}/replay      replays it locally (or against ?target=URL)
+//
+// Captured requests never keep their credentials (see credentialHeaders), so neither
+// the capture API nor a replay can leak them. Replays can only be sent to ourselves, our
+// upstreams in proxy mode (-proxy and -canary), our -site-url or the origins given by the
+// -replay-targets flag, and like our other admin forms they need a CSRF token or an
+// X-Requested-With header (see adminOnly).
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CAPTURE_STORE_CAPACITY = 200      // The number of captured requests we keep
+	MAX_CAPTURE_BODY_SIZE  = 64 << 10 // The most of each request (and replayed response) body we keep
+)
+
+// The header we mark replayed requests with (and which stops them from being captured again)
+const REPLAY_HEADER = "X-Replay-Of"
+
+// The headers which carry credentials, which we never capture (or echo, see inspect.go). Headers
+// starting with CAPTURE_CREDENTIAL_HEADER_PREFIX (i.e. X-Admin-OTP) are dropped too.
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key", CSRF_SCRIPT_HEADER}
+
+const CAPTURE_CREDENTIAL_HEADER_PREFIX = "X-Admin-"
+
+// The origins (other than our upstreams and -site-url) captured requests can be replayed
+// against, i.e. a development copy of the site (see the -replay-targets flag)
+var replayTargets string
+
+// A single condition of a capture filter
+type captureCondition struct {
+	field string // One of "path", "method", "status" or "ua"
+	value string
+}
+
+// A capture filter. All of its conditions must match for a request to be captured.
+type captureFilter []captureCondition
+
+// Parse a filter in the form field:value,field:value (i.e. "path:/api,status:5xx"). An empty
+// filter captures every request.
+func parseCaptureFilter(filterString string) (captureFilter, error) {
+
+	filter := captureFilter{}
+
+	for _, conditionString := range strings.Split(filterString, ",") {
+
+		conditionString = strings.TrimSpace(conditionString)
+
+		if conditionString == "" {
+			continue
+		}
+
+		field, value, found := strings.Cut(conditionString, ":")
+		if !found || value == "" {
+			return nil, fmt.Errorf("invalid capture condition %q: expected field:value", conditionString)
+		}
+
+		switch field {
+		case "path", "ua":
+		case "method":
+			value = strings.ToUpper(value)
+		case "status":
+			value = strings.ToLower(value)
+			if len(value) != 3 || value[1:] != "xx" || value[0] < '1' || value[0] > '5' {
+				return nil, fmt.Errorf("invalid status class %q: expected 1xx to 5xx", value)
+			}
+		default:
+			return nil, fmt.Errorf("invalid capture field %q: expected path, method, status or ua", field)
+		}
+
+		filter = append(filter, captureCondition{field: field, value: value})
+
+	}
+
+	return filter, nil
+
+}
+
+func (filter captureFilter) String() string {
+	var conditions []string
+	for _, condition := range filter {
+		conditions = append(conditions, condition.field+":"+condition.value)
+	}
+	return strings.Join(conditions, ",")
+}
+
+// Check the conditions of our filter which only depend on the request (we don't know the
+// status until the request has been handled)
+func (filter captureFilter) matchesRequest(r *http.Request) bool {
+	for _, condition := range filter {
+		switch condition.field {
+		case "path":
+			if !strings.HasPrefix(r.URL.Path, condition.value) {
+				return false
+			}
+		case "method":
+			if r.Method != condition.value {
+				return false
+			}
+		case "ua":
+			if !strings.Contains(r.UserAgent(), condition.value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Check the status conditions of our filter
+func (filter captureFilter) matchesStatus(status int) bool {
+	for _, condition := range filter {
+		if condition.field == "status" && statusClass(status) != condition.value {
+			return false
+		}
+	}
+	return true
+}
+
+// Register the admin routes of our capture API
+func registerCaptureRoutes(router *http.ServeMux) {
+	handleRoute(router, "/debug/capture", adminOnly(http.HandlerFunc(captureHandler)),
+		http.MethodGet, http.MethodPut, http.MethodDelete)
+	handleRoute(router, "/debug/capture/{id}", adminOnly(http.HandlerFunc(capturedRequestHandler)))
+	handleRoute(router, "/debug/capture/{id}/replay", adminOnly(http.HandlerFunc(replayHandler)), http.MethodPost)
+}
+
+// A captured request
+type capturedRequest struct {
+	RequestID     string      `json:"request_id"`
+	Captured      time.Time   `json:"captured"`
+	Method        string      `json:"method"`
+	URL           string      `json:"url"` // The path and query
+	Host          string      `json:"host"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body,omitempty"` // Base64 encoded in JSON
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+	RemoteAddr    string      `json:"remote_addr"`
+	Status        int         `json:"status"`
+}
+
+// Our capture filter (nil when we aren't capturing) along with our bounded store of captured
+// requests. Once full, the oldest captured request is evicted.
+type captureStore struct {
+	mutex    sync.Mutex
+	filter   captureFilter
+	order    []string
+	requests map[string]*capturedRequest
+}
+
+var captures = &captureStore{requests: make(map[string]*capturedRequest)}
+
+// The handler replayed requests are sent through (our full handler stack, set in main)
+var localHandler http.Handler
+
+// Returns the current capture filter (or nil if we aren't capturing)
+func (store *captureStore) currentFilter() captureFilter {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.filter
+}
+
+// Start capturing requests matching the given filter (or stop capturing with a nil filter,
+// which also clears the requests we've captured)
+func (store *captureStore) setFilter(filter captureFilter) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.filter = filter
+
+	if filter == nil {
+		store.order = nil
+		clear(store.requests)
+	}
+
+}
+
+func (store *captureStore) add(request *capturedRequest) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	// Clients can supply their own request IDs, so we may see the same ID more than once
+	if _, exists := store.requests[request.RequestID]; !exists {
+		store.order = append(store.order, request.RequestID)
+	}
+	store.requests[request.RequestID] = request
+
+	if len(store.order) > CAPTURE_STORE_CAPACITY {
+		delete(store.requests, store.order[0])
+		store.order = store.order[1:]
+	}
+
+}
+
+func (store *captureStore) get(requestID string) *capturedRequest {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.requests[requestID]
+}
+
+// Returns a handler which captures the requests matching our capture filter. This needs to
+// run within our tracing handler, which assigns request IDs.
+func requestCaptureHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		filter := captures.currentFilter()
+
+		// We never capture our own debug endpoints, requests we're replaying, or requests which
+		// hold passwords (see password.go)
+		if filter == nil || strings.HasPrefix(r.URL.Path, urlFor("/debug/")) || r.Header.Get(REPLAY_HEADER) != "" ||
+			isPasswordPath(r.URL.Path) || !filter.matchesRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		requestID, _ := r.Context().Value(REQUEST_ID_KEY).(string)
+
+		captured := &capturedRequest{
+			RequestID:  requestID,
+			Captured:   time.Now(),
+			Method:     r.Method,
+			URL:        r.URL.RequestURI(),
+			Host:       r.Host,
+			Header:     r.Header.Clone(),
+			RemoteAddr: loggedAddress(r),
+		}
+		anonymizeHeaders(captured.Header)
+		dropCredentialHeaders(captured.Header)
+
+		// Read the start of the body up front (so that we have it even if our handler never
+		// reads it), and hand our handler the full body
+		if r.Body != nil && r.Body != http.NoBody {
+			body, err := io.ReadAll(io.LimitReader(r.Body, MAX_CAPTURE_BODY_SIZE+1))
+			if len(body) > MAX_CAPTURE_BODY_SIZE {
+				captured.BodyTruncated = true
+			}
+			captured.Body = body[:min(len(body), MAX_CAPTURE_BODY_SIZE)]
+			r.Body = &capturedBody{Reader: io.MultiReader(bytes.NewReader(body), &errorReader{err: err}, r.Body), Closer: r.Body}
+		}
+
+		recorder := newStatusRecorder(w)
+		next.ServeHTTP(recorder, r)
+
+		if filter.matchesStatus(recorder.status) {
+			captured.Status = recorder.status
+			captures.add(captured)
+			incrementCounter("requests_captured_total")
+		}
+
+	})
+}
+
+// Returns whether the given header carries credentials (see credentialHeaders)
+func isCredentialHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	return slices.Contains(credentialHeaders, name) || strings.HasPrefix(name, CAPTURE_CREDENTIAL_HEADER_PREFIX)
+}
+
+// Drop the headers which carry credentials from the given (captured copy of the) headers
+func dropCredentialHeaders(header http.Header) {
+	for name := range header {
+		if isCredentialHeader(name) {
+			delete(header, name)
+		}
+	}
+}
+
+// A request body which reads from the start we've already read followed by the rest of the
+// original body
+type capturedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// A reader which returns the given error (if any) and otherwise nothing, so that an error
+// reading the start of a body is passed on to our handler
+type errorReader struct {
+	err error
+}
+
+func (reader *errorReader) Read([]byte) (int, error) {
+	if reader.err != nil {
+		return 0, reader.err
+	}
+	return 0, io.EOF
+}
+
+// A summary of a captured request for our listing
+type capturedRequestSummary struct {
+	RequestID string    `json:"request_id"`
+	Captured  time.Time `json:"captured"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Status    int       `json:"status"`
+}
+
+// This is our capture handler. It lists, starts and stops capturing (see the top of this file).
+func captureHandler(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case http.MethodPut:
+		var settings struct {
+			Filter string `json:"filter"`
+		}
+
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&settings); err != nil {
+			writeError(w, r, badRequestError("The request body must be a JSON object with a filter.").Wrap(err))
+			return
+		}
+
+		filter, err := parseCaptureFilter(settings.Filter)
+
+		if err != nil {
+			writeError(w, r, badRequestError(err.Error()))
+			return
+		}
+
+		captures.setFilter(filter)
+
+	case http.MethodDelete:
+		captures.setFilter(nil)
+	}
+
+	captures.mutex.Lock()
+	defer captures.mutex.Unlock()
+
+	listing := struct {
+		Capturing bool                     `json:"capturing"`
+		Filter    string                   `json:"filter"`
+		Requests  []capturedRequestSummary `json:"requests"`
+	}{Capturing: captures.filter != nil, Filter: captures.filter.String(), Requests: []capturedRequestSummary{}}
+
+	// Most recent first
+	for i := len(captures.order) - 1; i >= 0; i-- {
+		request := captures.requests[captures.order[i]]
+		listing.Requests = append(listing.Requests, capturedRequestSummary{
+			RequestID: request.RequestID,
+			Captured:  request.Captured,
+			Method:    request.Method,
+			URL:       request.URL,
+			Status:    request.Status,
+		})
+	}
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	json.NewEncoder(w).Encode(listing)
+
+}
+
+// This is our captured request handler. It returns the full captured request as JSON.
+func capturedRequestHandler(w http.ResponseWriter, r *http.Request) {
+
+	captured := captures.get(r.PathValue("id"))
+
+	if captured == nil {
+		writeError(w, r, capturedRequestNotFoundError())
+		return
+	}
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	json.NewEncoder(w).Encode(captured)
+
+}
+
+// The result of replaying a captured request
+type replayResult struct {
+	RequestID     string      `json:"request_id"` // The ID of the replayed request
+	Target        string      `json:"target"`
+	Status        int         `json:"status"`
+	Header        http.Header `json:"header"`
+	Body          string      `json:"body"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+	Duration      string      `json:"duration"`
+}
+
+// Returns whether captured requests can be replayed against the given origin (i.e.
+// http://localhost:9000): one of our upstreams, our -site-url or one of our -replay-targets
+func allowedReplayTarget(origin string) bool {
+
+	var allowed []string
+	for _, list := range []string{proxyUpstream, canaryUpstream, siteURL, replayTargets} {
+		allowed = append(allowed, strings.Split(list, ",")...)
+	}
+
+	for _, candidate := range allowed {
+		parsed, err := url.Parse(strings.TrimSpace(candidate))
+		if err == nil && parsed.Host != "" && strings.EqualFold(parsed.Scheme+"://"+parsed.Host, origin) {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// This is our replay handler. It replays a captured request against our own handler stack, or
+// against the server given by the target query parameter (i.e. ?target=http://localhost:9000),
+// and returns the response as JSON.
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+
+	captured := captures.get(r.PathValue("id"))
+
+	if captured == nil {
+		writeError(w, r, capturedRequestNotFoundError())
+		return
+	}
+
+	if captured.BodyTruncated {
+		writeError(w, r, newAppError(http.StatusConflict, "body_truncated",
+			"The body of this request was too large to capture in full, so it can't be replayed."))
+		return
+	}
+
+	target := r.URL.Query().Get("target")
+	replayID := fmt.Sprintf("%s-replay-%d", captured.RequestID, time.Now().UnixNano())
+	started := time.Now()
+
+	result := replayResult{RequestID: replayID, Target: "local"}
+	var response *http.Response
+
+	if target == "" {
+		request := httptest.NewRequestWithContext(r.Context(), captured.Method, captured.URL, bytes.NewReader(captured.Body))
+		request.Header = captured.Header.Clone()
+		request.Header.Set("X-Request-Id", replayID)
+		request.Header.Set(REPLAY_HEADER, captured.RequestID)
+		request.Host = captured.Host
+		request.RemoteAddr = captured.RemoteAddr
+
+		recorder := httptest.NewRecorder()
+		localHandler.ServeHTTP(recorder, request)
+		response = recorder.Result()
+
+	} else {
+		targetURL, err := url.Parse(target)
+
+		if err != nil || (targetURL.Scheme != "http" && targetURL.Scheme != "https") || targetURL.Host == "" {
+			writeError(w, r, badRequestError("The target must be an http:// or https:// URL."))
+			return
+		}
+
+		result.Target = targetURL.Scheme + "://" + targetURL.Host
+
+		if !allowedReplayTarget(result.Target) {
+			writeError(w, r, newAppError(http.StatusForbidden, "replay_target_not_allowed",
+				"Captured requests can only be replayed against this server, its upstreams, its -site-url or the -replay-targets origins."))
+			return
+		}
+		request, err := http.NewRequestWithContext(r.Context(), captured.Method,
+			result.Target+captured.URL, bytes.NewReader(captured.Body))
+
+		if err != nil {
+			writeError(w, r, badRequestError("The captured request can't be sent to that target.").Wrap(err))
+			return
+		}
+
+		request.Header = captured.Header.Clone()
+		request.Header.Set("X-Request-Id", replayID)
+		request.Header.Set(REPLAY_HEADER, captured.RequestID)
+
+		response, err = outbound.Do(request)
+
+		if err != nil {
+			writeError(w, r, newAppError(http.StatusBadGateway, "replay_failed",
+				"The captured request couldn't be replayed against the target.").Wrap(err))
+			return
+		}
+	}
+	defer response.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(response.Body, MAX_CAPTURE_BODY_SIZE+1))
+
+	result.Status = response.StatusCode
+	result.Header = response.Header
+	result.Body = string(body[:min(len(body), MAX_CAPTURE_BODY_SIZE)])
+	result.BodyTruncated = len(body) > MAX_CAPTURE_BODY_SIZE
+	result.Duration = time.Since(started).String()
+
+	incrementCounter("requests_replayed_total")
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	json.NewEncoder(w).Encode(result)
+
+}
+
+func capturedRequestNotFoundError() *AppError {
+	return newAppError(http.StatusNotFound, "capture_not_found",
+		"No captured request was found for that request ID. Only requests matching the capture filter are kept.")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCapturedRequestsDropCredentials(t *testing.T) {
+
+	captures.setFilter(captureFilter{})
+	t.Cleanup(func() { captures.setFilter(nil) })
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/fake", nil)
+	r = r.WithContext(context.WithValue(r.Context(), REQUEST_ID_KEY, "captured-request"))
+	r.SetBasicAuth("admin", "secret")
+	r.Header.Set("Cookie", "csrf=0123456789abcdef")
+	r.Header.Set("X-Api-Key", "key")
+	r.Header.Set(TOTP_CODE_HEADER, "123456")
+	r.Header.Set(ADMIN_ACCOUNT_HEADER, "admin")
+	r.Header.Set(CSRF_SCRIPT_HEADER, "curl")
+	r.Header.Set("Accept", "application/json")
+
+	requestCaptureHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(httptest.NewRecorder(), r)
+
+	captured := captures.get("captured-request")
+	if captured == nil {
+		t.Fatal("the request wasn't captured")
+	}
+
+	for _, name := range []string{"Authorization", "Cookie", "X-Api-Key", TOTP_CODE_HEADER, ADMIN_ACCOUNT_HEADER, CSRF_SCRIPT_HEADER} {
+		if value := captured.Header.Get(name); value != "" {
+			t.Errorf("got the %s header captured as %q, want it dropped", name, value)
+		}
+	}
+	if captured.Header.Get("Accept") != "application/json" {
+		t.Errorf("got the Accept header captured as %q, want it kept", captured.Header.Get("Accept"))
+	}
+
+}
+
+func TestReplayTargetsAreLimitedToOurOrigins(t *testing.T) {
+
+	defer func(upstream, canary, site, targets string) {
+		proxyUpstream, canaryUpstream, siteURL, replayTargets = upstream, canary, site, targets
+	}(proxyUpstream, canaryUpstream, siteURL, replayTargets)
+
+	proxyUpstream = "http://10.0.0.1:3000, http://10.0.0.2:3000"
+	canaryUpstream = "http://10.0.0.3:3000"
+	siteURL = "https://example.com/"
+	replayTargets = "http://localhost:9000"
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"http://10.0.0.1:3000", true},
+		{"http://10.0.0.2:3000", true},
+		{"http://10.0.0.3:3000", true},
+		{"https://example.com", true},
+		{"HTTPS://Example.com", true},
+		{"http://localhost:9000", true},
+		{"http://example.com", false},
+		{"http://localhost:9001", false},
+		{"https://attacker.example", false},
+	}
+
+	for _, test := range tests {
+		if allowed := allowedReplayTarget(test.origin); allowed != test.allowed {
+			t.Errorf("got %s allowed %t, want %t", test.origin, allowed, test.allowed)
+		}
+	}
+
+}
@@ -0,0 +1,215 @@
+// Certificate reloading and expiry monitoring. Certificates are renewed in place (i.e. by
+// certbot), so rather than needing a restart to pick up a renewed certificate, we check our
+// -tls-cert and -tls-key files every TLS_CERT_CHECK_INTERVAL and reload them when they change.
+// Our TLS configuration hands out whatever certificate we hold (via GetCertificate), so new
+// handshakes get the new certificate straight away, and its OCSP staple is fetched afresh.
+//
+// A renewal which doesn't load (i.e. a key which doesn't match the certificate, which we can
+// briefly see between the two files being written) or whose chain is invalid is logged as an
+// error and leaves our current certificate in place. The days until our certificate expires
+// are in the tls_certificate_expiry_days gauge, and within -tls-expiry-warning days of expiry
+// we log a warning (once a day) and /status reports us as degraded, so that a forgotten
+// renewal is noticed before it becomes an outage.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	TLS_CERT_CHECK_INTERVAL         = 30 * time.Second
+	TLS_EXPIRY_WARNING_INTERVAL     = 24 * time.Hour // How often we repeat our expiry warning
+	DEFAULT_TLS_EXPIRY_WARNING_DAYS = 14
+)
+
+// The state of our certificate files: when we last saw them change, when we last loaded them,
+// why they last failed to load, and when we last warned about our certificate's expiry
+var certificateWatch = struct {
+	mutex    sync.Mutex
+	modified [2]time.Time
+	loaded   time.Time
+	err      string
+	warned   time.Time
+}{}
+
+// Our certificate, as shown in the TLS section of /status
+type certificateStatus struct {
+	Subject         string    `json:"subject"`
+	Issuer          string    `json:"issuer"`
+	NotAfter        time.Time `json:"not_after"`
+	DaysUntilExpiry float64   `json:"days_until_expiry"`
+	Expiring        bool      `json:"expiring"`
+	Loaded          time.Time `json:"loaded"`
+	ReloadError     string    `json:"reload_error,omitempty"`
+}
+
+// Check our certificate files for changes (and our certificate for expiry) every
+// TLS_CERT_CHECK_INTERVAL until the server exits
+func watchCertificate(certFile string, keyFile string) {
+
+	certificateWatch.mutex.Lock()
+	certificateWatch.modified = certificateFilesModified(certFile, keyFile)
+	certificateWatch.loaded = time.Now().UTC()
+	certificateWatch.mutex.Unlock()
+
+	checkCertificateExpiry()
+
+	go func() {
+		for range time.Tick(TLS_CERT_CHECK_INTERVAL) {
+			modified := certificateFilesModified(certFile, keyFile)
+			certificateWatch.mutex.Lock()
+			changed := modified != certificateWatch.modified
+			certificateWatch.modified = modified
+			certificateWatch.mutex.Unlock()
+			if changed {
+				reloadCertificate(certFile, keyFile)
+			}
+			checkCertificateExpiry()
+		}
+	}()
+
+}
+
+// Returns when our certificate and key files were last modified (zero for files we can't stat,
+// so that a file which is briefly missing while it's replaced counts as a change)
+func certificateFilesModified(certFile string, keyFile string) [2]time.Time {
+	var modified [2]time.Time
+	for i, path := range []string{certFile, keyFile} {
+		if info, err := os.Stat(path); err == nil {
+			modified[i] = info.ModTime()
+		}
+	}
+	return modified
+}
+
+// Load our certificate files again, replacing our certificate if they're valid
+func reloadCertificate(certFile string, keyFile string) {
+
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil {
+		err = checkCertificateChain(&certificate)
+	}
+
+	certificateWatch.mutex.Lock()
+	defer certificateWatch.mutex.Unlock()
+
+	if err != nil {
+		certificateWatch.err = err.Error()
+		incrementCounter("tls_certificate_reloads_total", "result", "failed")
+		logger.Printf("ERROR keeping the current TLS certificate, as %s and %s are invalid: %v", certFile, keyFile, err)
+		return
+	}
+
+	tlsState.mutex.Lock()
+	tlsState.certificate, tlsState.ocsp = &certificate, nil
+	tlsState.mutex.Unlock()
+
+	// Our old staple is for our old certificate
+	select {
+	case ocspRefresh <- struct{}{}:
+	default:
+	}
+
+	certificateWatch.loaded, certificateWatch.err = time.Now().UTC(), ""
+	certificateWatch.warned = time.Time{}
+	incrementCounter("tls_certificate_reloads_total", "result", "reloaded")
+	logger.Printf("Reloaded the TLS certificate for %s, valid until %v", certificate.Leaf.Subject.CommonName, certificate.Leaf.NotAfter)
+
+}
+
+// Check that a certificate is currently valid and that its chain is in order: each certificate
+// must be signed by the one after it, as clients expect
+func checkCertificateChain(certificate *tls.Certificate) error {
+
+	leaf := certificate.Leaf
+	if leaf == nil {
+		return errors.New("the certificate couldn't be parsed")
+	}
+
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("the certificate isn't valid until %v", leaf.NotBefore)
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("the certificate expired at %v", leaf.NotAfter)
+	}
+
+	chain := []*x509.Certificate{leaf}
+	for i, raw := range certificate.Certificate[1:] {
+		parsed, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("certificate %d of the chain couldn't be parsed: %w", i+2, err)
+		}
+		chain = append(chain, parsed)
+	}
+
+	for i := range len(chain) - 1 {
+		if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+			return fmt.Errorf("certificate %d of the chain (%s) isn't signed by the next one (%s), so the chain is incomplete or out of order: %w",
+				i+1, chain[i].Subject.CommonName, chain[i+1].Subject.CommonName, err)
+		}
+	}
+
+	return nil
+
+}
+
+// Update our expiry gauge, warning (at most once every TLS_EXPIRY_WARNING_INTERVAL) when our
+// certificate is close to expiring
+func checkCertificateExpiry() {
+
+	status := currentCertificateStatus()
+	if status == nil {
+		return
+	}
+
+	setGauge("tls_certificate_expiry_days", status.DaysUntilExpiry)
+
+	if !status.Expiring {
+		return
+	}
+
+	certificateWatch.mutex.Lock()
+	defer certificateWatch.mutex.Unlock()
+
+	if time.Since(certificateWatch.warned) >= TLS_EXPIRY_WARNING_INTERVAL {
+		certificateWatch.warned = time.Now()
+		logger.Printf("WARN the TLS certificate for %s expires in %.1f days (at %v), renew it", status.Subject, status.DaysUntilExpiry, status.NotAfter)
+	}
+
+}
+
+// Returns the state of the certificate we serve, or nil if we don't serve HTTPS
+func currentCertificateStatus() *certificateStatus {
+
+	tlsState.mutex.Lock()
+	certificate := tlsState.certificate
+	tlsState.mutex.Unlock()
+
+	if certificate == nil || certificate.Leaf == nil {
+		return nil
+	}
+
+	certificateWatch.mutex.Lock()
+	defer certificateWatch.mutex.Unlock()
+
+	days := time.Until(certificate.Leaf.NotAfter).Hours() / 24
+
+	return &certificateStatus{
+		Subject:         certificate.Leaf.Subject.CommonName,
+		Issuer:          certificate.Leaf.Issuer.CommonName,
+		NotAfter:        certificate.Leaf.NotAfter.UTC(),
+		DaysUntilExpiry: days,
+		Expiring:        days < float64(tlsExpiryWarningDays),
+		Loaded:          certificateWatch.loaded,
+		ReloadError:     certificateWatch.err,
+	}
+
+}
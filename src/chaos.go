@@ -0,0 +1,281 @@
+// Chaos mode (fault injection). People using this server as a test upstream can have it inject
+// latency, errors and dropped connections into its responses, to exercise their clients' retry
+// and timeout logic. Faults are described by rules passed in via the (repeatable) -chaos flag,
+// each a comma separated list of settings:
+//
+//	-chaos "path:/api,latency:2s,latency-rate:0.5,error-rate:0.1,drop-rate:0.01"
+//
+//   - path: the path prefix the rule applies to (defaults to every path)
+//   - latency: the longest delay we add (each delay is random, up to this long)
+//   - latency-rate: the probability of a request being delayed (defaults to 1 with a latency)
+//   - error-rate: the probability of a request failing with error-status (defaults to 500)
+//   - drop-rate: the probability of a request's connection being closed without a response
+//
+// The first rule whose path matches a request applies. Admins can turn chaos mode on and off
+// (or replace the rules) at runtime via /debug/chaos, which along with /health and /metrics is
+// never affected by our faults.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A single chaos rule
+type chaosRule struct {
+	Path        string        `json:"path"`
+	Latency     time.Duration `json:"latency_ns,omitempty"`
+	LatencyRate float64       `json:"latency_rate,omitempty"`
+	ErrorRate   float64       `json:"error_rate,omitempty"`
+	ErrorStatus int           `json:"error_status,omitempty"`
+	DropRate    float64       `json:"drop_rate,omitempty"`
+}
+
+// Parse a rule in the form setting:value,setting:value (see the top of this file)
+func parseChaosRule(ruleString string) (chaosRule, error) {
+
+	rule := chaosRule{Path: "/", LatencyRate: -1, ErrorStatus: http.StatusInternalServerError}
+
+	for _, setting := range strings.Split(ruleString, ",") {
+
+		setting = strings.TrimSpace(setting)
+
+		if setting == "" {
+			continue
+		}
+
+		name, value, found := strings.Cut(setting, ":")
+		if !found || value == "" {
+			return rule, fmt.Errorf("invalid chaos setting %q: expected name:value", setting)
+		}
+
+		var err error
+
+		switch name {
+		case "path":
+			rule.Path = value
+		case "latency":
+			rule.Latency, err = time.ParseDuration(value)
+			if err == nil && rule.Latency < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "latency-rate":
+			rule.LatencyRate, err = parseProbability(value)
+		case "error-rate":
+			rule.ErrorRate, err = parseProbability(value)
+		case "error-status":
+			rule.ErrorStatus, err = strconv.Atoi(value)
+			if err == nil && (rule.ErrorStatus < 400 || rule.ErrorStatus > 599) {
+				err = fmt.Errorf("must be a 4xx or 5xx status")
+			}
+		case "drop-rate":
+			rule.DropRate, err = parseProbability(value)
+		default:
+			return rule, fmt.Errorf("invalid chaos setting %q: expected path, latency, latency-rate, error-rate, error-status or drop-rate", name)
+		}
+
+		if err != nil {
+			return rule, fmt.Errorf("invalid chaos %s %q: %v", name, value, err)
+		}
+
+	}
+
+	// Rules with a latency delay every request unless told otherwise
+	if rule.LatencyRate < 0 {
+		rule.LatencyRate = 0
+		if rule.Latency > 0 {
+			rule.LatencyRate = 1
+		}
+	}
+
+	return rule, nil
+
+}
+
+// Parse a probability between 0 and 1
+func parseProbability(value string) (float64, error) {
+
+	probability, err := strconv.ParseFloat(value, 64)
+
+	if err != nil || probability < 0 || probability > 1 {
+		return 0, fmt.Errorf("must be between 0 and 1")
+	}
+
+	return probability, nil
+
+}
+
+// The list of chaos rules passed in via the -chaos flag. It implements flag.Value so that the
+// flag can be repeated.
+type chaosRules []chaosRule
+
+var chaosFlagRules chaosRules
+
+func (rules *chaosRules) String() string {
+	return fmt.Sprint(len(*rules), " rules")
+}
+
+func (rules *chaosRules) Set(ruleString string) error {
+
+	rule, err := parseChaosRule(ruleString)
+
+	if err != nil {
+		return err
+	}
+
+	*rules = append(*rules, rule)
+
+	return nil
+
+}
+
+// Our chaos mode state. Chaos mode starts enabled when rules are passed in via -chaos.
+var chaos = struct {
+	mutex   sync.Mutex
+	enabled bool
+	rules   chaosRules
+}{}
+
+// Returns the chaos rule which applies to the given request (if chaos mode is enabled)
+func chaosRuleFor(r *http.Request) (chaosRule, bool) {
+
+	// Make sure chaos mode can always be monitored and switched off
+	if strings.HasPrefix(r.URL.Path, urlFor("/debug/")) || r.URL.Path == urlFor("/health") ||
+		r.URL.Path == urlFor("/metrics") {
+		return chaosRule{}, false
+	}
+
+	chaos.mutex.Lock()
+	defer chaos.mutex.Unlock()
+
+	if !chaos.enabled {
+		return chaosRule{}, false
+	}
+
+	for _, rule := range chaos.rules {
+		if strings.HasPrefix(r.URL.Path, rule.Path) {
+			return rule, true
+		}
+	}
+
+	return chaosRule{}, false
+
+}
+
+// Returns a handler which injects the faults of our chaos rules into the responses of the
+// given handler
+func chaosHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		rule, ok := chaosRuleFor(r)
+
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if rule.Latency > 0 && rand.Float64() < rule.LatencyRate {
+			delay := rand.N(rule.Latency + 1)
+			incrementCounter("chaos_faults_total", "fault", "latency")
+			w.Header().Set("X-Chaos-Latency", delay.String())
+
+			endSpan := startSpan(r.Context(), "chaos: latency")
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+			}
+			endSpan()
+		}
+
+		switch {
+		case rand.Float64() < rule.DropRate:
+			incrementCounter("chaos_faults_total", "fault", "drop")
+			dropConnection(w)
+
+		case rand.Float64() < rule.ErrorRate:
+			incrementCounter("chaos_faults_total", "fault", "error")
+			writeError(w, r, newAppError(rule.ErrorStatus, "chaos_injected",
+				"This error was injected by chaos mode."))
+
+		default:
+			next.ServeHTTP(w, r)
+		}
+
+	})
+}
+
+// Close the connection of our response without sending anything
+func dropConnection(w http.ResponseWriter) {
+
+	connection, _, err := http.NewResponseController(w).Hijack()
+
+	if err != nil {
+		// Connections can't be hijacked over HTTP/2, but aborting the handler resets the
+		// stream instead
+		panic(http.ErrAbortHandler)
+	}
+
+	connection.Close()
+
+}
+
+// This is our chaos handler for admins. GET requests return the chaos mode state, while PUT
+// requests update it with a JSON object with enabled and (optionally) rules fields, i.e.
+//
+//	{"enabled": true, "rules": ["path:/api,error-rate:0.2"]}
+func chaosAdminHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method == http.MethodPut {
+
+		var settings struct {
+			Enabled *bool     `json:"enabled"`
+			Rules   *[]string `json:"rules"`
+		}
+
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&settings); err != nil {
+			writeError(w, r, badRequestError("The request body must be a JSON object with enabled and / or rules fields.").Wrap(err))
+			return
+		}
+
+		var rules chaosRules
+
+		if settings.Rules != nil {
+			for _, ruleString := range *settings.Rules {
+				if err := rules.Set(ruleString); err != nil {
+					writeError(w, r, badRequestError(err.Error()))
+					return
+				}
+			}
+		}
+
+		chaos.mutex.Lock()
+		if settings.Rules != nil {
+			chaos.rules = rules
+		}
+		if settings.Enabled != nil {
+			chaos.enabled = *settings.Enabled
+		}
+		chaos.mutex.Unlock()
+
+	}
+
+	chaos.mutex.Lock()
+	defer chaos.mutex.Unlock()
+
+	setGauge("chaos_enabled", map[bool]float64{false: 0, true: 1}[chaos.enabled])
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": chaos.enabled,
+		"rules":   append(chaosRules{}, chaos.rules...),
+	})
+
+}
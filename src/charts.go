@@ -0,0 +1,539 @@
+// Server-side chart rendering. /chart draws simple line, bar and pie charts as SVG or PNG so
+// that our demos don't have to depend on third-party chart services (like the deprecated
+// Google Charts API). Charts can be described via the query string, i.e.
+//
+//	/chart?type=bar&title=Visitors&labels=Mon,Tue,Wed&data=12,19,7&data=5,8,11&names=New,Returning
+//
+// or by POSTing the same description as JSON (see chartRequest). Charts are first laid out as a
+// list of simple shapes, which are then either written out as SVG elements or rasterised into
+// a PNG. The standard library has no font rendering, so PNG charts are drawn without text.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The default and maximum sizes of our charts (in pixels)
+const (
+	DEFAULT_CHART_WIDTH  = 600
+	DEFAULT_CHART_HEIGHT = 400
+	MAX_CHART_DIMENSION  = 2000
+)
+
+// The most series / values per series we'll draw
+const (
+	MAX_CHART_SERIES = 10
+	MAX_CHART_VALUES = 1000
+)
+
+// The largest JSON chart description we'll accept
+const MAX_CHART_REQUEST_SIZE = 1 << 20
+
+// The colours we cycle through for our series / pie slices
+var chartPalette = []color.RGBA{
+	{0x1f, 0x77, 0xb4, 0xff},
+	{0xff, 0x7f, 0x0e, 0xff},
+	{0x2c, 0xa0, 0x2c, 0xff},
+	{0xd6, 0x27, 0x28, 0xff},
+	{0x94, 0x67, 0xbd, 0xff},
+	{0x8c, 0x56, 0x4b, 0xff},
+	{0xe3, 0x77, 0xc2, 0xff},
+	{0x7f, 0x7f, 0x7f, 0xff},
+}
+
+var (
+	chartAxisColour = color.RGBA{0x33, 0x33, 0x33, 0xff}
+	chartGridColour = color.RGBA{0xdd, 0xdd, 0xdd, 0xff}
+)
+
+// A series of values to plot
+type chartSeries struct {
+	Name   string    `json:"name"`
+	Values []float64 `json:"values"`
+}
+
+// The description of a chart, either decoded from a JSON request body or built from the
+// query string
+type chartRequest struct {
+	Type   string        `json:"type"`
+	Title  string        `json:"title"`
+	Labels []string      `json:"labels"`
+	Series []chartSeries `json:"series"`
+	Width  int           `json:"width"`
+	Height int           `json:"height"`
+	Format string        `json:"format"`
+}
+
+// The shapes our charts are made of. Points are flattened x, y pairs.
+type chartShape struct {
+	kind        string // rect, polygon, polyline or text
+	points      []float64
+	fill        color.RGBA
+	stroke      color.RGBA
+	strokeWidth float64
+	text        string
+	anchor      string
+	fontSize    int
+}
+
+// A chart which has been laid out and is ready to be rendered
+type chartLayout struct {
+	width  int
+	height int
+	shapes []chartShape
+}
+
+// This is our chart handler
+func chartHandler(w http.ResponseWriter, r *http.Request) {
+
+	chart, err := parseChartRequest(w, r)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Requests for the same chart at the same time share it (see coalesce.go), so our key is
+	// the whole (validated) description
+	key, err := json.Marshal(chart)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("encoding a chart description"))
+		return
+	}
+
+	drawing, err := chartFlights.do(r.Context(), string(key), func() ([]byte, error) {
+
+		endSpan := startSpan(r.Context(), "chart: "+chart.Type)
+		layout := layoutChart(chart)
+		endSpan()
+
+		incrementCounter("charts_rendered_total", "type", chart.Type, "format", chart.Format)
+
+		if chart.Format != "png" {
+			return layout.svg(), nil
+		}
+
+		var encoded bytes.Buffer
+		err := png.Encode(&encoded, layout.rasterise())
+		return encoded.Bytes(), err
+
+	})
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("drawing a %s chart", chart.Format))
+		return
+	}
+
+	setContentType(w, map[string]string{"svg": "image/svg+xml", "png": "image/png"}[chart.Format])
+	w.Write(drawing)
+
+}
+
+// Build our chart description from a JSON request body (POST) or the query string (GET). The
+// format and size can be overridden via the query string in both cases.
+func parseChartRequest(w http.ResponseWriter, r *http.Request) (*chartRequest, error) {
+
+	chart := &chartRequest{}
+	query := r.URL.Query()
+
+	if r.Method == http.MethodPost {
+
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_CHART_REQUEST_SIZE))
+		decoder.DisallowUnknownFields()
+
+		if err := decoder.Decode(chart); err != nil {
+			return nil, badRequestError("The chart description isn't valid JSON.").Wrap(err)
+		}
+
+	} else {
+
+		chart.Type = query.Get("type")
+		chart.Title = query.Get("title")
+
+		if labels := query.Get("labels"); labels != "" {
+			chart.Labels = strings.Split(labels, ",")
+		}
+
+		names := strings.Split(query.Get("names"), ",")
+
+		for i, data := range query["data"] {
+			series := chartSeries{}
+			if i < len(names) {
+				series.Name = names[i]
+			}
+			for _, field := range strings.Split(data, ",") {
+				value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+				if err != nil {
+					return nil, badRequestError(fmt.Sprintf("%q is not a number.", field))
+				}
+				series.Values = append(series.Values, value)
+			}
+			chart.Series = append(chart.Series, series)
+		}
+
+	}
+
+	for field, target := range map[string]*int{"w": &chart.Width, "h": &chart.Height} {
+		if value := query.Get(field); value != "" {
+			size, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, badRequestError(fmt.Sprintf("The %s parameter must be a whole number of pixels.", field))
+			}
+			*target = size
+		}
+	}
+
+	if format := query.Get("format"); format != "" {
+		chart.Format = format
+	}
+
+	return chart, chart.validate()
+
+}
+
+// Fill in our defaults and check the chart description makes sense
+func (chart *chartRequest) validate() error {
+
+	chart.Type = strings.ToLower(chart.Type)
+	chart.Format = strings.ToLower(chart.Format)
+
+	if chart.Type == "" {
+		chart.Type = "line"
+	}
+	if chart.Format == "" {
+		chart.Format = "svg"
+	}
+	if chart.Width == 0 {
+		chart.Width = DEFAULT_CHART_WIDTH
+	}
+	if chart.Height == 0 {
+		chart.Height = DEFAULT_CHART_HEIGHT
+	}
+
+	switch {
+	case chart.Type != "line" && chart.Type != "bar" && chart.Type != "pie":
+		return badRequestError("The chart type must be line, bar or pie.")
+	case chart.Format != "svg" && chart.Format != "png":
+		return badRequestError("The chart format must be svg or png.")
+	case chart.Width < 100 || chart.Width > MAX_CHART_DIMENSION ||
+		chart.Height < 100 || chart.Height > MAX_CHART_DIMENSION:
+		return badRequestError(fmt.Sprintf("Charts must be between 100 and %d pixels in size.", MAX_CHART_DIMENSION))
+	case len(chart.Series) == 0:
+		return badRequestError("The chart has no data.")
+	case len(chart.Series) > MAX_CHART_SERIES:
+		return badRequestError(fmt.Sprintf("Charts are limited to %d series.", MAX_CHART_SERIES))
+	}
+
+	for _, series := range chart.Series {
+		if len(series.Values) == 0 || len(series.Values) > MAX_CHART_VALUES {
+			return badRequestError(fmt.Sprintf("Each series must have between 1 and %d values.", MAX_CHART_VALUES))
+		}
+		for _, value := range series.Values {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return badRequestError("Chart values must be finite numbers.")
+			}
+			if chart.Type == "pie" && value < 0 {
+				return badRequestError("Pie chart values can't be negative.")
+			}
+		}
+	}
+
+	return nil
+
+}
+
+// Lay out our chart as a list of shapes
+func layoutChart(chart *chartRequest) *chartLayout {
+
+	layout := &chartLayout{width: chart.Width, height: chart.Height}
+
+	// A white background, so that our PNGs aren't transparent
+	layout.rect(0, 0, float64(chart.Width), float64(chart.Height), color.RGBA{0xff, 0xff, 0xff, 0xff})
+
+	if chart.Title != "" {
+		layout.text(float64(chart.Width)/2, 24, chart.Title, "middle", 16)
+	}
+
+	if chart.Type == "pie" {
+		layoutPieChart(layout, chart)
+	} else {
+		layoutAxisChart(layout, chart)
+	}
+
+	return layout
+
+}
+
+// Lay out a line or bar chart, including its axes, grid lines and labels
+func layoutAxisChart(layout *chartLayout, chart *chartRequest) {
+
+	left, right, top, bottom := 60.0, float64(chart.Width)-20, 40.0, float64(chart.Height)-40
+
+	// Our value axis always includes zero so that bars have something to stand on
+	minimum, maximum, count := 0.0, 0.0, 0
+	for _, series := range chart.Series {
+		for _, value := range series.Values {
+			minimum, maximum = math.Min(minimum, value), math.Max(maximum, value)
+		}
+		count = max(count, len(series.Values))
+	}
+	if maximum == minimum {
+		maximum = minimum + 1
+	}
+
+	valueY := func(value float64) float64 {
+		return bottom - (value-minimum)/(maximum-minimum)*(bottom-top)
+	}
+
+	// Grid lines and value labels
+	const ticks = 5
+	for i := 0; i <= ticks; i++ {
+		value := minimum + (maximum-minimum)*float64(i)/ticks
+		y := valueY(value)
+		layout.line([]float64{left, y, right, y}, chartGridColour, 1)
+		layout.text(left-6, y+4, strconv.FormatFloat(value, 'g', 4, 64), "end", 11)
+	}
+
+	// The width of each category (a label / value index) along the x axis
+	slot := (right - left) / float64(count)
+
+	for i := 0; i < count && i < len(chart.Labels); i++ {
+		layout.text(left+slot*(float64(i)+0.5), bottom+18, chart.Labels[i], "middle", 11)
+	}
+
+	for s, series := range chart.Series {
+
+		colour := chartPalette[s%len(chartPalette)]
+
+		if chart.Type == "bar" {
+			barWidth := slot * 0.8 / float64(len(chart.Series))
+			for i, value := range series.Values {
+				x := left + slot*float64(i) + slot*0.1 + barWidth*float64(s)
+				y0, y1 := valueY(math.Max(value, 0)), valueY(math.Min(value, 0))
+				layout.rect(x, y0, barWidth, y1-y0, colour)
+			}
+		} else {
+			var points []float64
+			for i, value := range series.Values {
+				points = append(points, left+slot*(float64(i)+0.5), valueY(value))
+			}
+			layout.line(points, colour, 2)
+		}
+
+		// A legend entry for each named series
+		if series.Name != "" {
+			layout.rect(left+float64(s)*100, float64(chart.Height)-14, 10, 10, colour)
+			layout.text(left+float64(s)*100+14, float64(chart.Height)-5, series.Name, "start", 11)
+		}
+	}
+
+	// Our axes
+	layout.line([]float64{left, top, left, bottom}, chartAxisColour, 1)
+	layout.line([]float64{left, valueY(0), right, valueY(0)}, chartAxisColour, 1)
+
+}
+
+// Lay out a pie chart of our first series. Each slice is approximated by a polygon so that
+// it can be drawn the same way in SVG and PNG.
+func layoutPieChart(layout *chartLayout, chart *chartRequest) {
+
+	values := chart.Series[0].Values
+
+	total := 0.0
+	for _, value := range values {
+		total += value
+	}
+	if total == 0 {
+		return
+	}
+
+	centreX, centreY := float64(chart.Width)/2, float64(chart.Height)/2+10
+	radius := math.Min(float64(chart.Width), float64(chart.Height)-40)/2 - 30
+
+	angle := -math.Pi / 2
+
+	for i, value := range values {
+
+		sweep := value / total * 2 * math.Pi
+		points := []float64{centreX, centreY}
+
+		steps := max(1, int(sweep/(math.Pi/90)))
+		for step := 0; step <= steps; step++ {
+			a := angle + sweep*float64(step)/float64(steps)
+			points = append(points, centreX+radius*math.Cos(a), centreY+radius*math.Sin(a))
+		}
+
+		layout.shapes = append(layout.shapes, chartShape{
+			kind:   "polygon",
+			points: points,
+			fill:   chartPalette[i%len(chartPalette)],
+		})
+
+		if i < len(chart.Labels) && sweep > 0 {
+			middle := angle + sweep/2
+			layout.text(centreX+(radius+16)*math.Cos(middle), centreY+(radius+16)*math.Sin(middle)+4,
+				chart.Labels[i], "middle", 11)
+		}
+
+		angle += sweep
+	}
+
+}
+
+func (layout *chartLayout) rect(x, y, width, height float64, fill color.RGBA) {
+	layout.shapes = append(layout.shapes, chartShape{
+		kind:   "rect",
+		points: []float64{x, y, x + width, y + height},
+		fill:   fill,
+	})
+}
+
+func (layout *chartLayout) line(points []float64, stroke color.RGBA, width float64) {
+	layout.shapes = append(layout.shapes, chartShape{
+		kind:        "polyline",
+		points:      points,
+		stroke:      stroke,
+		strokeWidth: width,
+	})
+}
+
+func (layout *chartLayout) text(x, y float64, text string, anchor string, fontSize int) {
+	layout.shapes = append(layout.shapes, chartShape{
+		kind:     "text",
+		points:   []float64{x, y},
+		text:     text,
+		anchor:   anchor,
+		fontSize: fontSize,
+	})
+}
+
+// Write out our chart as an SVG document
+func (layout *chartLayout) svg() []byte {
+
+	var svg bytes.Buffer
+
+	fmt.Fprintf(&svg, "<svg xmlns='http://www.w3.org/2000/svg' width='%d' height='%d' "+
+		"viewBox='0 0 %d %d' font-family='Open Sans, sans-serif'>\n",
+		layout.width, layout.height, layout.width, layout.height)
+
+	for _, shape := range layout.shapes {
+		p := shape.points
+		switch shape.kind {
+		case "rect":
+			fmt.Fprintf(&svg, "<rect x='%.1f' y='%.1f' width='%.1f' height='%.1f' fill='%s'/>\n",
+				p[0], p[1], p[2]-p[0], p[3]-p[1], svgColour(shape.fill))
+		case "polygon":
+			fmt.Fprintf(&svg, "<polygon points='%s' fill='%s' stroke='white'/>\n",
+				svgPoints(p), svgColour(shape.fill))
+		case "polyline":
+			fmt.Fprintf(&svg, "<polyline points='%s' fill='none' stroke='%s' stroke-width='%g'/>\n",
+				svgPoints(p), svgColour(shape.stroke), shape.strokeWidth)
+		case "text":
+			fmt.Fprintf(&svg, "<text x='%.1f' y='%.1f' text-anchor='%s' font-size='%d'>%s</text>\n",
+				p[0], p[1], shape.anchor, shape.fontSize, html.EscapeString(shape.text))
+		}
+	}
+
+	fmt.Fprintln(&svg, "</svg>")
+
+	return svg.Bytes()
+
+}
+
+func svgColour(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func svgPoints(points []float64) string {
+	var pairs []string
+	for i := 0; i+1 < len(points); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%.1f,%.1f", points[i], points[i+1]))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// Draw our chart into an image. Text is skipped since we have no fonts to draw it with.
+func (layout *chartLayout) rasterise() *image.RGBA {
+
+	canvas := image.NewRGBA(image.Rect(0, 0, layout.width, layout.height))
+
+	for _, shape := range layout.shapes {
+		p := shape.points
+		switch shape.kind {
+		case "rect":
+			fillRect(canvas, p[0], p[1], p[2], p[3], shape.fill)
+		case "polygon":
+			fillPolygon(canvas, p, shape.fill)
+		case "polyline":
+			for i := 0; i+3 < len(p); i += 2 {
+				drawLine(canvas, p[i], p[i+1], p[i+2], p[i+3], shape.strokeWidth, shape.stroke)
+			}
+		}
+	}
+
+	return canvas
+
+}
+
+func fillRect(canvas *image.RGBA, x0, y0, x1, y1 float64, colour color.RGBA) {
+	for y := int(math.Round(y0)); y < int(math.Round(y1)); y++ {
+		for x := int(math.Round(x0)); x < int(math.Round(x1)); x++ {
+			canvas.SetRGBA(x, y, colour)
+		}
+	}
+}
+
+// Fill a polygon using the even-odd rule, one scanline at a time
+func fillPolygon(canvas *image.RGBA, points []float64, colour color.RGBA) {
+
+	count := len(points) / 2
+	bounds := canvas.Bounds()
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+
+		scanY := float64(y) + 0.5
+		var crossings []float64
+
+		for i := 0; i < count; i++ {
+			x0, y0 := points[i*2], points[i*2+1]
+			x1, y1 := points[(i+1)%count*2], points[(i+1)%count*2+1]
+			if (y0 <= scanY) != (y1 <= scanY) {
+				crossings = append(crossings, x0+(scanY-y0)/(y1-y0)*(x1-x0))
+			}
+		}
+
+		sort.Float64s(crossings)
+
+		for i := 0; i+1 < len(crossings); i += 2 {
+			for x := int(math.Round(crossings[i])); x < int(math.Round(crossings[i+1])); x++ {
+				canvas.SetRGBA(x, y, colour)
+			}
+		}
+	}
+
+}
+
+// Draw a line of the given width by stamping squares along it
+func drawLine(canvas *image.RGBA, x0, y0, x1, y1 float64, width float64, colour color.RGBA) {
+
+	steps := int(math.Max(math.Abs(x1-x0), math.Abs(y1-y0))) + 1
+	half := width / 2
+
+	for step := 0; step <= steps; step++ {
+		x := x0 + (x1-x0)*float64(step)/float64(steps)
+		y := y0 + (y1-y0)*float64(step)/float64(steps)
+		fillRect(canvas, x-half, y-half, x+half, y+half, colour)
+	}
+
+}
@@ -0,0 +1,205 @@
+// Manual control of our circuit breakers: the per host breakers of our outbound client (see
+// outbound.go) and, in proxy mode, the health of our upstreams (see upstreams.go), which works as
+// a breaker for each upstream. /debug/circuits lists the state of each of them, and admins can
+// POST to it to trip a circuit (so that we stop calling a dependency they know to be broken,
+// without waiting for it to fail) or reset one (so that we call it again straight away, i.e.
+// once it's been fixed):
+//
+//	POST /debug/circuits?kind=outbound&host=api.example.com&action=trip
+//	POST /debug/circuits?kind=upstream&host=10.0.0.1:3000&action=reset
+//
+// Like our other admin forms, a POST must carry a CSRF token or an X-Requested-With header (see
+// adminOnly).
+//
+// A tripped circuit stays open until it's reset, whatever our health checks find. Every change
+// of state, automatic or manual, is written to our log as an AUDIT entry (naming the admin
+// account for manual changes). When every main upstream is out of rotation our proxy still
+// tries them all (see upstreams.go), so tripping all of them doesn't take the site down.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The state of a circuit as listed by /debug/circuits
+type circuitStatus struct {
+	Kind      string    `json:"kind"` // outbound or upstream
+	Name      string    `json:"name,omitempty"`
+	Host      string    `json:"host"`
+	State     string    `json:"state"`
+	Failures  int       `json:"consecutive_failures"`
+	OpenUntil time.Time `json:"open_until,omitzero"`
+	Tripped   bool      `json:"tripped"`
+}
+
+// Returns the name of the given circuit state, as we show it
+func circuitStateName(state int) string {
+	switch state {
+	case CIRCUIT_OPEN:
+		return "open"
+	case CIRCUIT_HALF_OPEN:
+		return "half_open"
+	}
+	return "closed"
+}
+
+// Returns the state of our outbound client's circuits, for the hosts which have failed at
+// least once (the others are closed)
+func (outbound *outboundClient) circuits() []circuitStatus {
+
+	outbound.mutex.Lock()
+	defer outbound.mutex.Unlock()
+
+	var circuits []circuitStatus
+	for host, breaker := range outbound.breakers {
+		status := circuitStatus{
+			Kind:     "outbound",
+			Host:     host,
+			State:    circuitStateName(breaker.state),
+			Failures: breaker.failures,
+			Tripped:  breaker.tripped,
+		}
+		if breaker.state == CIRCUIT_OPEN && !breaker.tripped {
+			status.OpenUntil = breaker.openUntil
+		}
+		circuits = append(circuits, status)
+	}
+
+	return circuits
+
+}
+
+// Open (tripped) or close the circuit for the given host until it's changed again
+func (outbound *outboundClient) setTripped(host string, tripped bool) {
+
+	outbound.mutex.Lock()
+	defer outbound.mutex.Unlock()
+
+	breaker := outbound.breakers[host]
+	if breaker == nil {
+		breaker = &circuitBreaker{}
+		outbound.breakers[host] = breaker
+	}
+
+	breaker.tripped = tripped
+	breaker.failures = 0
+	breaker.trial = false
+
+	if tripped {
+		outbound.setState(host, breaker, CIRCUIT_OPEN)
+	} else {
+		outbound.setState(host, breaker, CIRCUIT_CLOSED)
+	}
+
+}
+
+// Returns the state of our target's circuit
+func (target *proxyTarget) circuit() circuitStatus {
+
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	status := circuitStatus{
+		Kind:     "upstream",
+		Name:     target.name,
+		Host:     target.url.Host,
+		State:    "closed",
+		Failures: target.failures,
+		Tripped:  target.tripped,
+	}
+	if !target.healthy {
+		status.State = "open"
+	}
+
+	return status
+
+}
+
+// Take our target out of rotation until it's reset (tripped), or put it back now
+func (target *proxyTarget) setTripped(tripped bool) {
+
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	target.tripped = tripped
+	target.failures = 0
+	target.successes = 0
+
+	switch {
+	case tripped && target.healthy:
+		target.healthy = false
+		target.downSince = time.Now()
+		target.lastError = "tripped by an admin"
+		target.setHealthGauge()
+	case !tripped && !target.healthy:
+		target.markHealthy()
+	}
+
+}
+
+// Returns our admin-only circuits handler (the proxy is nil when we're not in proxy mode), which
+// lists the state of our circuits as JSON, and trips or resets one when POSTed to
+func circuitsAdminHandler(proxy *cachingProxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		targets := proxyTargets(proxy)
+
+		if r.Method == http.MethodPost {
+
+			kind, host, action := r.FormValue("kind"), r.FormValue("host"), r.FormValue("action")
+
+			if action != "trip" && action != "reset" {
+				writeError(w, r, badRequestError("The action must be trip or reset."))
+				return
+			}
+			tripped := action == "trip"
+
+			switch kind {
+			case "outbound":
+				if host == "" || strings.ContainsAny(host, "/ ") {
+					writeError(w, r, badRequestError("The host must be the host (and port) of an outbound call, i.e. api.example.com."))
+					return
+				}
+				outbound.setTripped(host, tripped)
+
+			case "upstream":
+				index := slices.IndexFunc(targets, func(target *proxyTarget) bool {
+					return target.url.Host == host
+				})
+				if index < 0 {
+					writeError(w, r, newAppError(http.StatusNotFound, "not_found", fmt.Sprintf("%q isn't one of our upstreams.", host)))
+					return
+				}
+				targets[index].setTripped(tripped)
+
+			default:
+				writeError(w, r, badRequestError("The kind must be outbound or upstream."))
+				return
+			}
+
+			incrementCounter("circuit_manual_changes_total", "kind", kind, "action", action)
+			logger.Printf("AUDIT admin account %q %s the %s circuit for %s", adminAccount(r),
+				map[bool]string{false: "reset", true: "tripped"}[tripped], kind, host)
+
+		}
+
+		circuits := outbound.circuits()
+		for _, target := range targets {
+			circuits = append(circuits, target.circuit())
+		}
+		slices.SortFunc(circuits, func(a, b circuitStatus) int {
+			return strings.Compare(a.Kind+" "+a.Host, b.Kind+" "+b.Host)
+		})
+
+		setContentType(w, CONTENT_TYPE_JSON)
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{"circuits": circuits})
+
+	}
+}
@@ -0,0 +1,79 @@
+// Request coalescing. Drawing our SVG surface or a chart takes a while, so when many clients ask
+// for the same drawing at once (i.e. a link to a chart was just shared) we draw it once: the
+// first request for a drawing draws it, and the requests for the same drawing which arrive
+// while it's being drawn wait for it and share the result (much like golang.org/x/sync's
+// singleflight, which we don't depend on). Shared results are counted by group in the
+// requests_coalesced_total metric.
+//
+// Nothing is kept once a drawing is done, so this isn't a cache: a request which arrives after
+// the drawing finishes draws it again.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// A drawing in progress, which the requests for the same drawing wait for
+type flight struct {
+	done   chan struct{}
+	result []byte
+	err    error
+}
+
+// A group of drawings in progress, by key. A key must identify everything that goes into the
+// drawing, since requests with the same key share it.
+type flightGroup struct {
+	name    string
+	mutex   sync.Mutex
+	flights map[string]*flight
+}
+
+// Our groups of drawings
+var (
+	surfaceFlights = newFlightGroup("svg")
+	chartFlights   = newFlightGroup("chart")
+)
+
+func newFlightGroup(name string) *flightGroup {
+	return &flightGroup{name: name, flights: make(map[string]*flight)}
+}
+
+// Returns the drawing with the given key, drawing it unless it's already being drawn (in which
+// case we wait for it, or until our context is done). The result is shared, so it must not be
+// modified.
+func (group *flightGroup) do(ctx context.Context, key string, draw func() ([]byte, error)) ([]byte, error) {
+
+	group.mutex.Lock()
+
+	if current, found := group.flights[key]; found {
+		group.mutex.Unlock()
+		select {
+		case <-current.done:
+			incrementCounter("requests_coalesced_total", "group", group.name)
+			return current.result, current.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	current := &flight{done: make(chan struct{})}
+	group.flights[key] = current
+	group.mutex.Unlock()
+
+	// Whatever happens (even if drawing panics), the requests waiting for us are let go
+	defer func() {
+		group.mutex.Lock()
+		delete(group.flights, key)
+		group.mutex.Unlock()
+		close(current.done)
+	}()
+
+	current.err = errors.New("the drawing we were waiting for failed")
+	current.result, current.err = draw()
+
+	return current.result, current.err
+
+}
@@ -0,0 +1,406 @@
+// Colour palettes. /colors (and GET /api/v1/colors for scripts) takes a seed colour and works
+// out the palettes which harmonise with it on the server, by turning its hue around the colour
+// wheel in HSL: complementary, analogous, triadic, split complementary and tetradic palettes,
+// along with a monochromatic palette and shades of the seed from light to dark. Each palette
+// comes with the CSS for a gradient through its colours.
+//
+// Palettes can also colour our SVG surface drawing (see svgHandler), which shades each cell of
+// the surface by its height: /svg?palette=3366cc,cc9933 runs from the first colour at the
+// lowest point of the surface to the last at the highest.
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEFAULT_SEED_COLOUR   = "#3366cc"
+	DEFAULT_GRADIENT      = 90 // The angle of our gradients, in degrees (90 runs left to right)
+	MAX_PALETTE_COLOURS   = 16 // The most colours a palette can give our surface drawing
+	SHADES_OF_SEED_COLOUR = 9
+)
+
+// An RGB colour
+type colour struct {
+	R, G, B uint8
+}
+
+// A way of picking colours which go with a seed colour. Each colour of the palette is the seed
+// with its hue turned by the given degrees and its lightness changed by the given amount.
+type colourScheme struct {
+	Name      string
+	Title     string
+	Hues      []float64
+	Lightness []float64 // Optional, one for each hue
+}
+
+var colourSchemes = []colourScheme{
+	{Name: "complementary", Title: "Complementary", Hues: []float64{0, 180}},
+	{Name: "analogous", Title: "Analogous", Hues: []float64{-30, 0, 30}},
+	{Name: "triadic", Title: "Triadic", Hues: []float64{0, 120, 240}},
+	{Name: "split-complementary", Title: "Split complementary", Hues: []float64{0, 150, 210}},
+	{Name: "tetradic", Title: "Tetradic", Hues: []float64{0, 90, 180, 270}},
+	{Name: "monochromatic", Title: "Monochromatic", Hues: []float64{0, 0, 0, 0, 0},
+		Lightness: []float64{-0.3, -0.15, 0, 0.15, 0.3}},
+}
+
+// A colour of a palette, as we show it and return it from our API
+type paletteColour struct {
+	Hex  string `json:"hex"`
+	RGB  [3]int `json:"rgb"`
+	HSL  [3]int `json:"hsl"`  // The hue in degrees, and the saturation and lightness in percent
+	Text string `json:"text"` // The colour (black or white) of text which is readable on it
+}
+
+type colourPalette struct {
+	Scheme   string          `json:"scheme"`
+	Title    string          `json:"-"`
+	Colours  []paletteColour `json:"colours"`
+	Gradient string          `json:"gradient"` // A CSS linear-gradient through the colours
+}
+
+type colourPageData struct {
+	Seed     string
+	Angle    int
+	Shades   []paletteColour
+	Palettes []colourPalette
+}
+
+func (palette colourPalette) GradientCSS() template.CSS {
+	// Our gradients are made by us from hex colours, so they're safe to use in style attributes
+	return template.CSS(palette.Gradient)
+}
+
+// Returns the palette as our surface drawing's palette parameter (hex colours without their #)
+func (palette colourPalette) Query() string {
+	hexes := make([]string, len(palette.Colours))
+	for i, c := range palette.Colours {
+		hexes[i] = strings.TrimPrefix(c.Hex, "#")
+	}
+	return strings.Join(hexes, ",")
+}
+
+const COLORS_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>Colour palettes</h2>
+		<form action="{{ url "/colors" }}" method="GET">
+			<label>Seed colour <input type="color" name="seed" value="{{ .Seed }}"></label>
+			<label>Gradient angle <input type="number" name="angle" min=0 max=360 value="{{ .Angle }}"></label>
+			<input type="submit" value="Generate">
+		</form>
+		<h4>Shades</h4>
+		<div style="display: flex;">
+			{{ range .Shades }}<div style="flex: 1; padding: 20px 0; background: {{ .Hex }}; color: {{ .Text }};">{{ .Hex }}</div>{{ end }}
+		</div>
+		{{ range .Palettes }}
+		<h4>{{ .Title }}</h4>
+		<div style="display: flex;">
+			{{ range .Colours }}<div style="flex: 1; padding: 30px 0; background: {{ .Hex }}; color: {{ .Text }};">{{ .Hex }}<br><small>hsl({{ index .HSL 0 }}, {{ index .HSL 1 }}%, {{ index .HSL 2 }}%)</small></div>{{ end }}
+		</div>
+		<div style="height: 30px; background: {{ .GradientCSS }};"></div>
+		<p><code>background: {{ .Gradient }};</code></p>
+		<p><a href="{{ url "/svg" }}?palette={{ .Query }}">Colour the SVG surface with this palette</a></p>
+		{{ end }}
+	</div>
+`
+
+func init() {
+	registerPage(Page{Title: "Colours", Path: "/colors", Order: 76, Visible: true, Section: SECTION_UTILITIES, Handler: colorsHandler})
+}
+
+// Parse a hex colour, with or without its #, in either its long (#3366cc) or short (#36c) form
+func parseColour(value string) (colour, error) {
+
+	hex := strings.TrimPrefix(strings.TrimSpace(value), "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+
+	number, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 6 || err != nil {
+		return colour{}, badRequestError(fmt.Sprintf("%q isn't a hex colour (like #3366cc).", value))
+	}
+
+	return colour{R: uint8(number >> 16), G: uint8(number >> 8), B: uint8(number)}, nil
+
+}
+
+// Parse a palette of comma separated hex colours. No palette gives no colours.
+func parsePalette(value string) ([]colour, error) {
+
+	if value == "" {
+		return nil, nil
+	}
+
+	hexes := strings.Split(value, ",")
+	if len(hexes) > MAX_PALETTE_COLOURS {
+		return nil, badRequestError(fmt.Sprintf("Palettes can have up to %d colours.", MAX_PALETTE_COLOURS))
+	}
+
+	palette := make([]colour, len(hexes))
+	for i, hex := range hexes {
+		var err error
+		if palette[i], err = parseColour(hex); err != nil {
+			return nil, err
+		}
+	}
+
+	return palette, nil
+
+}
+
+func (c colour) Hex() string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// Returns the colour's hue (in degrees), saturation and lightness (from 0 to 1)
+func (c colour) HSL() (float64, float64, float64) {
+
+	r, g, b := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+	high, low := max(r, g, b), min(r, g, b)
+	lightness := (high + low) / 2
+
+	// Greys have no hue or saturation
+	if high == low {
+		return 0, 0, lightness
+	}
+
+	chroma := high - low
+	saturation := chroma / (1 - math.Abs(2*lightness-1))
+
+	var hue float64
+	switch high {
+	case r:
+		hue = math.Mod((g-b)/chroma, 6)
+	case g:
+		hue = (b-r)/chroma + 2
+	default:
+		hue = (r-g)/chroma + 4
+	}
+
+	return math.Mod(hue*60+360, 360), saturation, lightness
+
+}
+
+// Returns the colour with the given hue (in degrees, turned as far as you like), saturation and
+// lightness (which are kept between 0 and 1)
+func hslColour(hue, saturation, lightness float64) colour {
+
+	hue = math.Mod(math.Mod(hue, 360)+360, 360)
+	saturation, lightness = min(max(saturation, 0), 1), min(max(lightness, 0), 1)
+
+	chroma := (1 - math.Abs(2*lightness-1)) * saturation
+	x := chroma * (1 - math.Abs(math.Mod(hue/60, 2)-1))
+
+	var r, g, b float64
+	switch {
+	case hue < 60:
+		r, g, b = chroma, x, 0
+	case hue < 120:
+		r, g, b = x, chroma, 0
+	case hue < 180:
+		r, g, b = 0, chroma, x
+	case hue < 240:
+		r, g, b = 0, x, chroma
+	case hue < 300:
+		r, g, b = x, 0, chroma
+	default:
+		r, g, b = chroma, 0, x
+	}
+
+	offset := lightness - chroma/2
+	channel := func(value float64) uint8 { return uint8(math.Round((value + offset) * 255)) }
+
+	return colour{R: channel(r), G: channel(g), B: channel(b)}
+
+}
+
+// Returns the relative luminance of the colour, as defined by WCAG
+func (c colour) luminance() float64 {
+	linear := func(channel uint8) float64 {
+		value := float64(channel) / 255
+		if value <= 0.03928 {
+			return value / 12.92
+		}
+		return math.Pow((value+0.055)/1.055, 2.4)
+	}
+	return 0.2126*linear(c.R) + 0.7152*linear(c.G) + 0.0722*linear(c.B)
+}
+
+// Returns black or white, whichever contrasts more with the colour
+func (c colour) textColour() string {
+	// Black contrasts more when (L + 0.05) / 0.05 > 1.05 / (L + 0.05), which is when L > 0.179
+	if c.luminance() > 0.179 {
+		return "#000000"
+	}
+	return "#ffffff"
+}
+
+func (c colour) paletteColour() paletteColour {
+	hue, saturation, lightness := c.HSL()
+	return paletteColour{
+		Hex:  c.Hex(),
+		RGB:  [3]int{int(c.R), int(c.G), int(c.B)},
+		HSL:  [3]int{int(math.Round(hue)) % 360, int(math.Round(saturation * 100)), int(math.Round(lightness * 100))},
+		Text: c.textColour(),
+	}
+}
+
+// Returns the colour found the given fraction (from 0 to 1) of the way along a palette, mixing
+// the colours either side of it
+func paletteColourAt(palette []colour, fraction float64) colour {
+
+	if len(palette) == 1 {
+		return palette[0]
+	}
+
+	position := min(max(fraction, 0), 1) * float64(len(palette)-1)
+	i := min(int(position), len(palette)-2)
+	mix := position - float64(i)
+
+	channel := func(from, to uint8) uint8 {
+		return uint8(math.Round(float64(from) + (float64(to)-float64(from))*mix))
+	}
+
+	from, to := palette[i], palette[i+1]
+	return colour{R: channel(from.R, to.R), G: channel(from.G, to.G), B: channel(from.B, to.B)}
+
+}
+
+// Work out the palette of the given scheme for the seed colour, with a gradient at the angle
+func generatePalette(seed colour, scheme colourScheme, angle int) colourPalette {
+
+	hue, saturation, lightness := seed.HSL()
+
+	palette := colourPalette{Scheme: scheme.Name, Title: scheme.Title}
+	stops := make([]string, len(scheme.Hues))
+
+	for i, turn := range scheme.Hues {
+		shade := lightness
+		if scheme.Lightness != nil {
+			shade = min(max(lightness+scheme.Lightness[i], 0.05), 0.95)
+		}
+		c := seed
+		if turn != 0 || shade != lightness {
+			c = hslColour(hue+turn, saturation, shade)
+		}
+		palette.Colours = append(palette.Colours, c.paletteColour())
+		stops[i] = fmt.Sprintf("%s %d%%", c.Hex(), int(math.Round(float64(i)*100/float64(len(scheme.Hues)-1))))
+	}
+
+	palette.Gradient = fmt.Sprintf("linear-gradient(%ddeg, %s)", angle, strings.Join(stops, ", "))
+	return palette
+
+}
+
+// Returns the seed colour's shades, from light to dark
+func colourShades(seed colour) []paletteColour {
+	hue, saturation, _ := seed.HSL()
+	shades := make([]paletteColour, SHADES_OF_SEED_COLOUR)
+	for i := range shades {
+		shades[i] = hslColour(hue, saturation, 0.9-0.8*float64(i)/(SHADES_OF_SEED_COLOUR-1)).paletteColour()
+	}
+	return shades
+}
+
+// Parse the seed colour, gradient angle and (optionally) scheme of a palette request
+func parseColourRequest(r *http.Request) (colour, int, []colourScheme, error) {
+
+	query := r.URL.Query()
+
+	seed, err := parseColour(cmp.Or(query.Get("seed"), DEFAULT_SEED_COLOUR))
+	if err != nil {
+		return colour{}, 0, nil, err
+	}
+
+	angle := DEFAULT_GRADIENT
+	if value := query.Get("angle"); value != "" {
+		if angle, err = strconv.Atoi(value); err != nil || angle < 0 || angle > 360 {
+			return colour{}, 0, nil, badRequestError("The angle must be a number of degrees from 0 to 360.")
+		}
+	}
+
+	schemes := colourSchemes
+	if name := query.Get("scheme"); name != "" {
+		i := slices.IndexFunc(colourSchemes, func(scheme colourScheme) bool { return scheme.Name == name })
+		if i < 0 {
+			names := make([]string, len(colourSchemes))
+			for j, scheme := range colourSchemes {
+				names[j] = scheme.Name
+			}
+			return colour{}, 0, nil, badRequestError("Unknown scheme. Choose one of " + strings.Join(names, ", ") + ".")
+		}
+		schemes = colourSchemes[i : i+1]
+	}
+
+	return seed, angle, schemes, nil
+
+}
+
+// This is our colours page, which shows the palettes and shades of the seed colour
+func colorsHandler(w http.ResponseWriter, r *http.Request) {
+
+	seed, angle, schemes, err := parseColourRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	data := colourPageData{Seed: seed.Hex(), Angle: angle, Shades: colourShades(seed)}
+	for _, scheme := range schemes {
+		data.Palettes = append(data.Palettes, generatePalette(seed, scheme, angle))
+	}
+
+	incrementCounter("palettes_total", "source", "page")
+
+	body, err := renderFragment(colorsBodyTemplate, data)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the colours body template"))
+		return
+	}
+
+	renderMainTemplate(w, r, "colors", HtmlData{
+		Title:       "Golang Colour Palettes",
+		Description: "Harmonious colour palettes and CSS gradients generated from a seed colour.",
+		Keywords:    "golang web server colour color palette gradient hsl generator",
+		CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+		BodyContent: body,
+	})
+
+}
+
+// This is our colours API, which returns the palettes (or the one palette of the given scheme)
+// and shades of the seed colour
+func colorsAPIHandler(w http.ResponseWriter, r *http.Request) {
+
+	seed, angle, schemes, err := parseColourRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	response := struct {
+		Seed     paletteColour   `json:"seed"`
+		Shades   []paletteColour `json:"shades"`
+		Palettes []colourPalette `json:"palettes"`
+	}{Seed: seed.paletteColour(), Shades: colourShades(seed)}
+
+	for _, scheme := range schemes {
+		response.Palettes = append(response.Palettes, generatePalette(seed, scheme, angle))
+	}
+
+	incrementCounter("palettes_total", "source", "api")
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	json.NewEncoder(w).Encode(response)
+
+}
@@ -0,0 +1,301 @@
+// Lifecycle managed components. The parts of the server which run in the background or hold
+// state (our JSON file stores, the uptime recorder, metrics sampler and watchdog, upstream health
+// checks, scheduled jobs, webhook notifiers, the event publisher and our demo apps) are
+// components, which main registers by name along with the components they depend on:
+//
+//	registerComponent("uptime-recorder", newUptimeRecorder(uptimeInterval), "uptime-store")
+//
+// startComponents starts them all before we serve, each after the components it depends on,
+// and stopComponents stops them once we've stopped serving, in the reverse order, so that a
+// component can rely on its dependencies for as long as it runs. When a component fails to
+// start, the ones already started are stopped again and the error names the component, and
+// failures to stop are logged (and returned together) without holding up the rest of the
+// shutdown. The state of each component is shown on /status.
+//
+// Dependencies on components which aren't registered (i.e. because their flag isn't set) are
+// ignored, while a cycle of dependencies stops us from starting.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const COMPONENT_START_TIMEOUT = 30 * time.Second // How long our components have to start
+
+// The states of a component
+const (
+	COMPONENT_STOPPED = "stopped"
+	COMPONENT_RUNNING = "running"
+	COMPONENT_FAILED  = "failed"
+)
+
+// A Component is started before we serve and stopped when we shut down
+type Component interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
+
+// A component along with its name, dependencies and state
+type registeredComponent struct {
+	name      string
+	component Component
+	dependsOn []string
+	state     string
+	err       error
+}
+
+// Our components, in the order they were registered, and in the order they were started
+var components = struct {
+	mutex      sync.Mutex
+	registered []*registeredComponent
+	started    []*registeredComponent
+}{}
+
+// Add a component, which depends on the named components
+func registerComponent(name string, component Component, dependsOn ...string) {
+
+	components.mutex.Lock()
+	defer components.mutex.Unlock()
+
+	components.registered = append(components.registered, &registeredComponent{
+		name:      name,
+		component: component,
+		dependsOn: dependsOn,
+		state:     COMPONENT_STOPPED,
+	})
+
+}
+
+// Returns our components in the order they should be started: each after its dependencies, and
+// otherwise in the order they were registered. The caller must hold our components mutex.
+func componentStartOrder() ([]*registeredComponent, error) {
+
+	byName := map[string]*registeredComponent{}
+	for _, registered := range components.registered {
+		if byName[registered.name] != nil {
+			return nil, fmt.Errorf("there are two components named %s", registered.name)
+		}
+		byName[registered.name] = registered
+	}
+
+	var order []*registeredComponent
+	visited := map[string]bool{}
+	visiting := map[string]bool{}
+
+	var visit func(registered *registeredComponent, path []string) error
+	visit = func(registered *registeredComponent, path []string) error {
+		path = append(path, registered.name)
+		if visiting[registered.name] {
+			return fmt.Errorf("the components depend on each other: %s", strings.Join(path, " -> "))
+		}
+		if visited[registered.name] {
+			return nil
+		}
+		visiting[registered.name] = true
+		for _, name := range registered.dependsOn {
+			if dependency := byName[name]; dependency != nil {
+				if err := visit(dependency, path); err != nil {
+					return err
+				}
+			}
+		}
+		visiting[registered.name] = false
+		visited[registered.name] = true
+		order = append(order, registered)
+		return nil
+	}
+
+	for _, registered := range components.registered {
+		if err := visit(registered, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+
+}
+
+// Start our components in dependency order. If one fails, those already started are stopped
+// again and its error is returned.
+func startComponents(ctx context.Context) error {
+
+	components.mutex.Lock()
+	order, err := componentStartOrder()
+	components.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	for _, registered := range order {
+
+		started := time.Now()
+		err := registered.component.Start(ctx)
+
+		components.mutex.Lock()
+		if err != nil {
+			registered.state, registered.err = COMPONENT_FAILED, err
+		} else {
+			registered.state = COMPONENT_RUNNING
+			components.started = append(components.started, registered)
+		}
+		components.mutex.Unlock()
+
+		if err != nil {
+			incrementCounter("component_failures_total", "component", registered.name, "phase", "start")
+			if stopErr := stopComponents(ctx); stopErr != nil {
+				err = errors.Join(err, stopErr)
+			}
+			return fmt.Errorf("starting %s: %w", registered.name, err)
+		}
+
+		logger.Printf("Started the %s component in %v", registered.name, time.Since(started).Round(time.Microsecond))
+
+	}
+
+	return nil
+
+}
+
+// Stop the components we've started, in the reverse of the order they were started, logging and
+// returning the errors of those which fail
+func stopComponents(ctx context.Context) error {
+
+	components.mutex.Lock()
+	started := components.started
+	components.started = nil
+	components.mutex.Unlock()
+
+	var errs []error
+
+	for i := len(started) - 1; i >= 0; i-- {
+
+		registered := started[i]
+		err := registered.component.Stop(ctx)
+
+		components.mutex.Lock()
+		if err != nil {
+			registered.state, registered.err = COMPONENT_FAILED, err
+		} else {
+			registered.state = COMPONENT_STOPPED
+		}
+		components.mutex.Unlock()
+
+		if err != nil {
+			incrementCounter("component_failures_total", "component", registered.name, "phase", "stop")
+			logger.Printf("ERROR stopping the %s component: %v", registered.name, err)
+			errs = append(errs, fmt.Errorf("stopping %s: %w", registered.name, err))
+			continue
+		}
+
+		logger.Printf("Stopped the %s component", registered.name)
+
+	}
+
+	return errors.Join(errs...)
+
+}
+
+// The state of a component as shown on /status
+type componentStatus struct {
+	Name      string   `json:"name"`
+	State     string   `json:"state"`
+	DependsOn []string `json:"depends_on,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// Returns the state of our components, in the order they were registered
+func currentComponentStatus() []componentStatus {
+
+	components.mutex.Lock()
+	defer components.mutex.Unlock()
+
+	statuses := []componentStatus{}
+	for _, registered := range components.registered {
+		status := componentStatus{Name: registered.name, State: registered.state, DependsOn: registered.dependsOn}
+		if registered.err != nil {
+			status.Error = registered.err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+
+}
+
+// A component made from functions, either of which may be nil
+type componentFuncs struct {
+	start func(ctx context.Context) error
+	stop  func(ctx context.Context) error
+}
+
+func (funcs componentFuncs) Start(ctx context.Context) error {
+	if funcs.start == nil {
+		return nil
+	}
+	return funcs.start(ctx)
+}
+
+func (funcs componentFuncs) Stop(ctx context.Context) error {
+	if funcs.stop == nil {
+		return nil
+	}
+	return funcs.stop(ctx)
+}
+
+// A component which runs a function in the background every interval, until it's stopped
+type tickerComponent struct {
+	interval time.Duration
+	tick     func(now time.Time)
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// Create a component which calls the given function every interval
+func newTickerComponent(interval time.Duration, tick func(now time.Time)) *tickerComponent {
+	return &tickerComponent{interval: interval, tick: tick}
+}
+
+func (component *tickerComponent) Start(ctx context.Context) error {
+
+	// Our loop outlives the context we're started with, so it gets one of its own
+	runCtx, cancel := context.WithCancel(context.Background())
+	component.cancel, component.done = cancel, make(chan struct{})
+
+	go func() {
+		defer close(component.done)
+		ticker := time.NewTicker(component.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				component.tick(now)
+			case <-runCtx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+
+}
+
+// Stop our loop, waiting (until the given context is done) for a tick in progress to finish
+func (component *tickerComponent) Stop(ctx context.Context) error {
+
+	component.cancel()
+
+	select {
+	case <-component.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+}
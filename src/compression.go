@@ -0,0 +1,347 @@
+// Response compression. Responses with a compressible content type are compressed with Brotli
+// (see brotli.go) or gzip, whichever the client's Accept-Encoding header prefers (Brotli wins
+// a tie). How hard we compress is configured per content type with the -compression-levels
+// flag, which takes a comma separated list of content types (or type/* wildcards) and levels
+// from 1 to 11 (a level of 0 turns compression off for the type):
+//
+//	-compression-levels "text/html=9,application/json=4,text/csv=0"
+//
+// Levels are used as the Brotli quality, while gzip uses them up to its maximum level of 9.
+//
+// Handlers which serve precompressed files (i.e. a style.css.br sidecar for style.css, see
+// site.go) set their own Content-Encoding, and their responses are passed through untouched.
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Responses smaller than this (when we know their size) aren't worth compressing
+const MIN_COMPRESSION_SIZE = 1024
+
+// The compression level we use for compressible types which haven't been configured
+const DEFAULT_COMPRESSION_LEVEL = 5
+
+// The compression level for each content type (or type/* wildcard). Types which aren't listed
+// here (i.e. images, PDFs and archives, which are already compressed) are left alone.
+var compressionLevels = map[string]int{
+	"text/*":                    DEFAULT_COMPRESSION_LEVEL,
+	"application/json":          DEFAULT_COMPRESSION_LEVEL,
+	"application/javascript":    DEFAULT_COMPRESSION_LEVEL,
+	"application/xml":           DEFAULT_COMPRESSION_LEVEL,
+	"application/manifest+json": DEFAULT_COMPRESSION_LEVEL,
+	"application/wasm":          DEFAULT_COMPRESSION_LEVEL,
+	"application/yaml":          DEFAULT_COMPRESSION_LEVEL,
+	"image/svg+xml":             DEFAULT_COMPRESSION_LEVEL,
+	"image/x-icon":              DEFAULT_COMPRESSION_LEVEL,
+}
+
+// Parse the value of our -compression-levels flag (i.e. "text/html=9,text/csv=0"), adding to
+// (or overriding) our default levels
+func parseCompressionLevels(value string) error {
+
+	for _, entry := range strings.Split(value, ",") {
+
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		contentType, levelValue, found := strings.Cut(entry, "=")
+		contentType = strings.ToLower(strings.TrimSpace(contentType))
+
+		if !found || !strings.Contains(contentType, "/") {
+			return fmt.Errorf("%q should be in the form type/subtype=level", entry)
+		}
+
+		level, err := strconv.Atoi(strings.TrimSpace(levelValue))
+
+		if err != nil || level < 0 || level > BROTLI_MAX_QUALITY {
+			return fmt.Errorf("the level for %s must be a number from 0 to %d", contentType, BROTLI_MAX_QUALITY)
+		}
+
+		compressionLevels[contentType] = level
+
+	}
+
+	return nil
+
+}
+
+// Returns the compression level for the given Content-Type header (0 if the type shouldn't be
+// compressed)
+func compressionLevel(contentType string) int {
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	if err != nil {
+		return 0
+	}
+
+	if level, ok := compressionLevels[mediaType]; ok {
+		return level
+	}
+
+	majorType, _, _ := strings.Cut(mediaType, "/")
+
+	return compressionLevels[majorType+"/*"]
+
+}
+
+// Returns the encodings we support (br and gzip) which the given Accept-Encoding header
+// accepts, most preferred first (Brotli wins a tie)
+func acceptedEncodings(acceptEncoding string) []string {
+
+	qualities := map[string]float64{}
+
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+
+		coding, params, _ := strings.Cut(entry, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		quality := 1.0
+
+		if name, value, found := strings.Cut(strings.TrimSpace(params), "="); found && strings.TrimSpace(name) == "q" {
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				quality = parsed
+			}
+		}
+
+		if coding != "" {
+			qualities[coding] = quality
+		}
+
+	}
+
+	// A wildcard covers any of our encodings which aren't listed explicitly
+	if wildcard, ok := qualities["*"]; ok {
+		for _, encoding := range []string{"br", "gzip"} {
+			if _, listed := qualities[encoding]; !listed {
+				qualities[encoding] = wildcard
+			}
+		}
+	}
+
+	var encodings []string
+
+	for _, encoding := range []string{"br", "gzip"} {
+		if qualities[encoding] > 0 {
+			encodings = append(encodings, encoding)
+		}
+	}
+
+	if len(encodings) == 2 && qualities["gzip"] > qualities["br"] {
+		encodings[0], encodings[1] = encodings[1], encodings[0]
+	}
+
+	return encodings
+
+}
+
+// Returns the encoding the client prefers, or an empty string if it doesn't accept any of ours
+func preferredEncoding(acceptEncoding string) string {
+
+	if encodings := acceptedEncodings(acceptEncoding); len(encodings) > 0 {
+		return encodings[0]
+	}
+
+	return ""
+
+}
+
+// Returns a handler which compresses the responses of the given handler
+func compressionHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		encoding := preferredEncoding(r.Header.Get("Accept-Encoding"))
+
+		writer := &compressionWriter{
+			ResponseWriter: w,
+			request:        r,
+			encoding:       encoding,
+			status:         http.StatusOK,
+		}
+
+		// We tag the ETags of our compressed responses with their encoding (see decide), so
+		// we remove the tag again for our handlers to be able to answer conditional requests
+		ifNoneMatch := r.Header.Get("If-None-Match")
+		if untagged := strings.ReplaceAll(ifNoneMatch, "-"+encoding+`"`, `"`); encoding != "" && untagged != ifNoneMatch {
+			r.Header.Set("If-None-Match", untagged)
+			writer.untagged = true
+		}
+		defer writer.close()
+
+		next.ServeHTTP(writer, r)
+
+	})
+}
+
+// The writers our encoders provide
+type compressionEncoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// A compressionWriter compresses the response written to it. We hold on to the start of the
+// response (up to MIN_COMPRESSION_SIZE bytes) before deciding whether to compress it, so that
+// small responses can be sent as they are.
+type compressionWriter struct {
+	http.ResponseWriter
+	request  *http.Request
+	encoding string // The encoding the client prefers (if any)
+	status   int
+	buffer   []byte
+	decided  bool
+	untagged bool // Whether we removed our encoding from the request's If-None-Match header
+	encoder  compressionEncoder
+}
+
+func (writer *compressionWriter) WriteHeader(status int) {
+
+	// Informational responses (i.e. 103 Early Hints) are passed straight through
+	if status < http.StatusOK {
+		writer.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if !writer.decided {
+		writer.status = status
+	}
+
+}
+
+func (writer *compressionWriter) Write(data []byte) (int, error) {
+
+	if !writer.decided {
+		writer.buffer = append(writer.buffer, data...)
+		if len(writer.buffer) < MIN_COMPRESSION_SIZE {
+			return len(data), nil
+		}
+		if err := writer.decide(false); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
+	if writer.encoder != nil {
+		return writer.encoder.Write(data)
+	}
+
+	return writer.ResponseWriter.Write(data)
+
+}
+
+// Flush sends everything written so far on to the client (compressing it if we're
+// compressing the response)
+func (writer *compressionWriter) Flush() {
+
+	if !writer.decided {
+		writer.decide(false)
+	}
+
+	if writer.encoder != nil {
+		writer.encoder.Flush()
+	}
+
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+}
+
+// Unwrap allows http.ResponseController to reach the underlying response writer
+func (writer *compressionWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// Decide whether to compress our response, write out our headers and whatever we've buffered.
+// When our handler has finished, we know the full size of the response.
+func (writer *compressionWriter) decide(finished bool) error {
+
+	writer.decided = true
+	header := writer.Header()
+
+	if header.Get("Content-Type") == "" && len(writer.buffer) > 0 {
+		header.Set("Content-Type", http.DetectContentType(writer.buffer))
+	}
+
+	level := compressionLevel(header.Get("Content-Type"))
+
+	// Caches need to know that compressible responses depend on the Accept-Encoding header
+	if level > 0 && header.Get("Content-Encoding") == "" {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	contentLength, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		contentLength = -1
+	}
+
+	small := finished && len(writer.buffer) < MIN_COMPRESSION_SIZE ||
+		contentLength >= 0 && contentLength < MIN_COMPRESSION_SIZE
+
+	compress := level > 0 && writer.encoding != "" && !small &&
+		writer.request.Method != http.MethodHead &&
+		writer.status != http.StatusNoContent && writer.status != http.StatusNotModified &&
+		writer.status != http.StatusPartialContent &&
+		header.Get("Content-Encoding") == "" &&
+		!strings.Contains(header.Get("Cache-Control"), "no-transform")
+
+	// Ranges (and validators) of our compressed responses differ from the original's. A not
+	// modified response stands in for the compressed response the client has cached.
+	if compress || writer.untagged && writer.status == http.StatusNotModified {
+		if eTag := header.Get("ETag"); strings.HasSuffix(eTag, `"`) {
+			header.Set("ETag", strings.TrimSuffix(eTag, `"`)+"-"+writer.encoding+`"`)
+		}
+	}
+
+	if compress {
+		header.Set("Content-Encoding", writer.encoding)
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+
+		if writer.encoding == "br" {
+			writer.encoder = newBrotliWriter(writer.ResponseWriter, level)
+		} else {
+			writer.encoder, _ = gzip.NewWriterLevel(writer.ResponseWriter, min(level, gzip.BestCompression))
+		}
+
+		incrementCounter("http_compressed_responses_total", "encoding", writer.encoding)
+	}
+
+	writer.ResponseWriter.WriteHeader(writer.status)
+
+	buffered := writer.buffer
+	writer.buffer = nil
+
+	if len(buffered) == 0 {
+		return nil
+	}
+
+	if writer.encoder != nil {
+		_, err = writer.encoder.Write(buffered)
+	} else {
+		_, err = writer.ResponseWriter.Write(buffered)
+	}
+
+	return err
+
+}
+
+// Finish our response once our handler has returned
+func (writer *compressionWriter) close() {
+
+	if !writer.decided {
+		writer.decide(true)
+	}
+
+	if writer.encoder != nil {
+		writer.encoder.Close()
+	}
+
+}
@@ -0,0 +1,120 @@
+// Connection limits. Our rate limits (see tools.go) only see requests, so a client which opens
+// thousands of connections without sending anything would still tie up our goroutines and file
+// descriptors. Our listener therefore caps how many connections each client address may have
+// open at once (-max-conns-per-ip) and how many we have open in total (-max-conns), and resets
+// the connections over those limits as soon as they're accepted, before any of our HTTP
+// handling (or TLS) runs for them.
+//
+// The listener only sees the address the connection comes from, so behind a load balancer or
+// reverse proxy every connection comes from the proxy: set -max-conns-per-ip to 0 there.
+
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+const (
+	DEFAULT_MAX_CONNECTIONS_PER_IP = 100
+	DEFAULT_MAX_CONNECTIONS        = 10000
+)
+
+// A listener which resets connections over our limits (0 for no limit)
+type limitedListener struct {
+	net.Listener
+	perIP  int
+	total  int
+	mutex  sync.Mutex
+	open   int
+	counts map[string]int // Our open connections, by client address
+}
+
+// A connection accepted by our limited listener, which gives its place back when it's closed
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func newLimitedListener(listener net.Listener, perIP int, total int) *limitedListener {
+	return &limitedListener{Listener: listener, perIP: perIP, total: total, counts: make(map[string]int)}
+}
+
+// Accept the next connection within our limits, resetting any over them
+func (listener *limitedListener) Accept() (net.Conn, error) {
+
+	for {
+
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		address, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			address = conn.RemoteAddr().String()
+		}
+
+		if reason := listener.admit(address); reason != "" {
+			incrementCounter("connections_rejected_total", "reason", reason)
+			resetConnection(conn)
+			continue
+		}
+
+		return &limitedConn{Conn: conn, release: func() { listener.leave(address) }}, nil
+
+	}
+
+}
+
+// Take a place for a connection from the given address. Returns why there isn't one (per_ip or
+// total), or nothing if there is.
+func (listener *limitedListener) admit(address string) string {
+
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	switch {
+	case listener.total > 0 && listener.open >= listener.total:
+		return "total"
+	case listener.perIP > 0 && listener.counts[address] >= listener.perIP:
+		return "per_ip"
+	}
+
+	listener.open++
+	listener.counts[address]++
+	setGauge("connections_open", float64(listener.open))
+
+	return ""
+
+}
+
+// Give back the place of a connection from the given address
+func (listener *limitedListener) leave(address string) {
+
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	listener.open--
+	if listener.counts[address]--; listener.counts[address] <= 0 {
+		delete(listener.counts, address)
+	}
+	setGauge("connections_open", float64(listener.open))
+
+}
+
+// Closing a connection more than once (which net/http can do) only gives its place back once
+func (conn *limitedConn) Close() error {
+	conn.once.Do(conn.release)
+	return conn.Conn.Close()
+}
+
+// Close a connection with a reset rather than the usual goodbye, so that we don't hold on to it
+// while the client takes its time to close its end
+func resetConnection(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
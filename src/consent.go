@@ -0,0 +1,222 @@
+// Cookie consent. With -cookie-consent set, our pages show a consent banner until the visitor
+// accepts or rejects non-essential cookies, and non-essential cookies are only set once they've
+// been accepted. Cookies we need to work (our consent cookie itself and the sticky session
+// cookie of our proxy mode) are essential, while the visitor ID cookie of our experiments (see
+// experiments.go) is not: visitors who haven't accepted cookies aren't enrolled in experiments
+// bucketed by cookie.
+//
+// The choice is stored on the server, keyed by a random consent ID kept in a cookie, so that it
+// can be looked up (i.e. as a record of consent) and changed later. GET /consent returns the
+// visitor's choice as JSON, while POST /consent (with choice=accepted or choice=rejected) stores
+// it. Choices are kept in memory, and in the JSON file given via -consent-file (if any) so that
+// they survive restarts.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CONSENT_COOKIE_NAME    = "consent_id"
+	CONSENT_COOKIE_MAX_AGE = 365 * 24 * time.Hour
+	CONSENT_ACCEPTED       = "accepted"
+	CONSENT_REJECTED       = "rejected"
+	MAX_CONSENT_RECORDS    = 100000 // The oldest choices are forgotten beyond this
+)
+
+// A visitor's cookie choice
+type consentRecord struct {
+	Choice    string    `json:"choice"`
+	DecidedAt time.Time `json:"decided_at,omitzero"`
+}
+
+// Our bounded store of cookie choices, keyed by consent ID
+type consentStore struct {
+	mutex   sync.Mutex
+	file    string // Where our choices are saved ("" to keep them in memory only)
+	order   []string
+	records map[string]consentRecord
+}
+
+var consents = &consentStore{records: make(map[string]consentRecord)}
+
+// Load our stored choices from the given JSON file (if it exists), saving our choices to it from
+// now on
+func loadConsents(path string) error {
+
+	consents.mutex.Lock()
+	defer consents.mutex.Unlock()
+
+	consents.file = path
+
+	var records map[string]consentRecord
+
+	if err := loadJSONFile(path, &records); err != nil {
+		return err
+	}
+
+	for id, record := range records {
+		consents.records[id] = record
+		consents.order = append(consents.order, id)
+	}
+
+	// Make sure we forget the oldest choices first
+	slices.SortFunc(consents.order, func(a, b string) int {
+		return consents.records[a].DecidedAt.Compare(consents.records[b].DecidedAt)
+	})
+
+	return nil
+
+}
+
+// Returns the choice stored for the given consent ID
+func (store *consentStore) get(id string) (consentRecord, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	record, found := store.records[id]
+	return record, found
+}
+
+// Store the choice of the given consent ID, saving our choices to our file (if we have one)
+func (store *consentStore) set(id string, record consentRecord) error {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, found := store.records[id]; !found {
+		if len(store.order) >= MAX_CONSENT_RECORDS {
+			delete(store.records, store.order[0])
+			store.order = store.order[1:]
+		}
+		store.order = append(store.order, id)
+	}
+
+	store.records[id] = record
+
+	if store.file == "" {
+		return nil
+	}
+
+	return saveJSONFile(store.file, store.records)
+
+}
+
+// Returns the cookie choice of the request's visitor ("" if they haven't made one)
+func cookieConsent(r *http.Request) string {
+
+	cookie, err := r.Cookie(CONSENT_COOKIE_NAME)
+
+	if err != nil {
+		return ""
+	}
+
+	record, _ := consents.get(cookie.Value)
+
+	return record.Choice
+
+}
+
+// Returns whether we may set non-essential cookies for the request's visitor
+func nonEssentialCookiesAllowed(r *http.Request) bool {
+	return !cookieConsentEnabled || cookieConsent(r) == CONSENT_ACCEPTED
+}
+
+// Returns whether our pages should show the consent banner to the request's visitor
+func showConsentBanner(r *http.Request) bool {
+	return cookieConsentEnabled && cookieConsent(r) == ""
+}
+
+// This is our consent handler. GET returns the visitor's choice, while POST stores it and sends
+// the visitor back to the page they made it on (or returns the choice to JSON clients).
+func consentHandler(w http.ResponseWriter, r *http.Request) {
+
+	var id string
+	if cookie, err := r.Cookie(CONSENT_COOKIE_NAME); err == nil {
+		id = cookie.Value
+	}
+
+	record, _ := consents.get(id)
+
+	if r.Method == http.MethodPost {
+
+		choice := r.FormValue("choice")
+
+		if choice != CONSENT_ACCEPTED && choice != CONSENT_REJECTED {
+			writeError(w, r, badRequestError("The choice must be accepted or rejected."))
+			return
+		}
+
+		// Visitors get a new consent ID when we don't know their current one (i.e. it's been
+		// forgotten), so that IDs are never picked by the visitor
+		if _, found := consents.get(id); !found {
+			idBytes := make([]byte, 16)
+			rand.Read(idBytes)
+			id = hex.EncodeToString(idBytes)
+		}
+
+		record = consentRecord{Choice: choice, DecidedAt: time.Now().UTC()}
+
+		if err := consents.set(id, record); err != nil {
+			writeError(w, r, internalError(err).WithDetail("saving the cookie choice"))
+			return
+		}
+
+		incrementCounter("cookie_consent_total", "choice", choice)
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     CONSENT_COOKIE_NAME,
+			Value:    id,
+			Path:     urlFor("/"),
+			MaxAge:   int(CONSENT_COOKIE_MAX_AGE.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		// Rejecting cookies removes the non-essential cookies we've already set
+		if choice == CONSENT_REJECTED {
+			http.SetCookie(w, &http.Cookie{Name: VISITOR_COOKIE_NAME, Path: urlFor("/"), MaxAge: -1})
+		}
+
+		// Only send browsers back to one of our own pages
+		if !wantsJSON(r) {
+			target := r.FormValue("return")
+			if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+				target = "/"
+			}
+			http.Redirect(w, r, urlFor(target), http.StatusSeeOther)
+			return
+		}
+
+	}
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	w.Header().Set("Cache-Control", "no-store")
+
+	json.NewEncoder(w).Encode(record)
+
+}
+
+// This is our consent banner partial which is rendered as part of our main HTML template. You
+// can find the raw file in the templates folder (consent.tmpl).
+const CONSENT_HTML_TEMPLATE = `
+{{ define "consent" }}
+	{{ if .ConsentBanner }}
+	<div class="consent-banner" style="position: fixed; bottom: 0; left: 0; right: 0; padding: 12px; background: #333; color: #fff; text-align: center;">
+		This site uses an essential cookie to remember your choice, and optional cookies for experiments.
+		<form action="{{ url "/consent" }}" method="POST" style="display: inline;">
+			<input type="hidden" name="return" value="{{ .ConsentReturn }}">
+			<button type="submit" name="choice" value="accepted">Accept</button>
+			<button type="submit" name="choice" value="rejected">Reject</button>
+		</form>
+	</div>
+	{{ end }}
+{{ end }}
+`
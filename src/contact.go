@@ -0,0 +1,304 @@
+// Contact form demo. /contact takes a name, email address, subject and message, which we check
+// before passing them on: with email configured (see mail.go) and -contact-to set, messages are
+// emailed to those addresses, and otherwise they're only stored. Either way, admins can read the
+// messages we've received (the most recent MAX_CONTACT_MESSAGES of them) at /debug/contact, and
+// they're saved to -contact-file (if given) so that they survive restarts.
+//
+// Spam is kept out with a honeypot field (hidden from people, but filled in by many bots), whose
+// messages we pretend to accept but drop, and by limiting each client to CONTACT_RATE_LIMIT
+// messages per minute. Our form is decoded and checked by our forms module (see forms.go), and
+// carries a CSRF token (see csrf.go).
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	CONTACT_RATE_LIMIT   = 3 // How many messages a client may send per minute
+	CONTACT_RATE_BURST   = 3
+	MAX_CONTACT_MESSAGES = 500
+)
+
+// The fields of our contact form. The limits match the maxLength attributes of our form.
+type contactForm struct {
+	Name     string `form:"name" label:"Your name" validate:"trim,required,max=100,oneline"`
+	Email    string `form:"email" label:"Your email address" validate:"trim,required,email,max=254"`
+	Subject  string `form:"subject" label:"The subject" validate:"trim,max=150,oneline"`
+	Message  string `form:"message" label:"Your message" validate:"trim,required,min=10,max=5000"`
+	Honeypot string `form:"website"` // Hidden from people, but filled in by many bots
+}
+
+// A message sent via our contact form
+type contactMessage struct {
+	ID       string    `json:"id"`
+	Received time.Time `json:"received"`
+	Name     string    `json:"name"`
+	Email    string    `json:"email"`
+	Subject  string    `json:"subject,omitempty"`
+	Message  string    `json:"message"`
+	Status   string    `json:"status"` // emailed, stored or email_failed
+}
+
+// The messages we've received, oldest first
+var contactMessages = struct {
+	mutex    sync.Mutex
+	file     string // Where our messages are saved ("" to keep them in memory only)
+	messages []contactMessage
+}{}
+
+// The rate limiter for our contact form
+var contactRateLimiter = newRateLimiter("contact", CONTACT_RATE_LIMIT, CONTACT_RATE_BURST)
+
+func init() {
+	registerPage(Page{Title: "Contact", Path: "/contact", Order: 90, Visible: true, Section: SECTION_SITE, Handler: contactHandler,
+		Methods: []string{http.MethodGet, http.MethodPost}})
+}
+
+// Load our stored messages from the given JSON file (if it exists), saving our messages to it
+// from now on
+func loadContactMessages(path string) error {
+
+	contactMessages.mutex.Lock()
+	defer contactMessages.mutex.Unlock()
+
+	contactMessages.file = path
+
+	return loadJSONFile(path, &contactMessages.messages)
+
+}
+
+// Store the given message, forgetting our oldest messages beyond MAX_CONTACT_MESSAGES
+func storeContactMessage(message contactMessage) {
+
+	contactMessages.mutex.Lock()
+	defer contactMessages.mutex.Unlock()
+
+	contactMessages.messages = append(contactMessages.messages, message)
+
+	if excess := len(contactMessages.messages) - MAX_CONTACT_MESSAGES; excess > 0 {
+		contactMessages.messages = contactMessages.messages[excess:]
+	}
+
+	if contactMessages.file == "" {
+		return
+	}
+
+	if err := saveJSONFile(contactMessages.file, contactMessages.messages); err != nil {
+		logger.Println("Failed to save the contact messages:", err)
+	}
+
+}
+
+// Email the given message to our contact addresses
+func emailContactMessage(message contactMessage) error {
+
+	to, err := parseMailAddresses(contactTo)
+
+	if err != nil {
+		return err
+	}
+
+	subject := "Contact form message"
+	if message.Subject != "" {
+		subject += ": " + message.Subject
+	}
+
+	body := fmt.Sprintf("From: %s <%s>\nReceived: %s\nMessage ID: %s\n\n%s\n",
+		message.Name, message.Email, message.Received.Format(time.RFC1123), message.ID, message.Message)
+
+	return sendMail("contact", to, subject, body)
+
+}
+
+// This is a template string we use to construct the body of our contact page
+const CONTACT_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>Contact</h2>
+		<form action="{{ url "/contact" }}" method="POST">
+			<p><input maxLength=100 size=40 name="name" value="{{ .Fields.Name }}" placeholder="Your name"></p>
+			{{ with .Form.Problem "name" }}<p><small>{{ . }}</small></p>{{ end }}
+			<p><input maxLength=254 size=40 name="email" value="{{ .Fields.Email }}" placeholder="Your email address"></p>
+			{{ with .Form.Problem "email" }}<p><small>{{ . }}</small></p>{{ end }}
+			<p><input maxLength=150 size=40 name="subject" value="{{ .Fields.Subject }}" placeholder="Subject (optional)"></p>
+			{{ with .Form.Problem "subject" }}<p><small>{{ . }}</small></p>{{ end }}
+			<p><textarea name="message" rows=8 cols=60 maxLength=5000 placeholder="Your message">{{ .Fields.Message }}</textarea></p>
+			{{ with .Form.Problem "message" }}<p><small>{{ . }}</small></p>{{ end }}
+			<p style="display: none;"><input name="website" tabindex="-1" autocomplete="off" placeholder="Leave this empty"></p>
+			<input type="hidden" name="csrf_token" value="{{ .Form.CSRFToken }}">
+			<input type="submit" value="Send">
+		</form>
+	</div>
+`
+
+// The data we pass into our contact body template
+type contactPageData struct {
+	Fields contactForm
+	Form   *Form
+}
+
+// This is our contact handler. GET displays our form, while POST checks and passes on a
+// message, sending browsers back to a blank form (with a flash thanking them, see flash.go) once
+// it's sent.
+func contactHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Our token (and the cookie behind it) must be set before we write anything
+	data := contactPageData{Form: newForm(w, r)}
+	status := http.StatusOK
+
+	if r.Method == http.MethodPost {
+
+		if err := data.Form.Decode(w, r, &data.Fields); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		if data.Fields.Honeypot != "" {
+			// Let the bot think it succeeded, so that it doesn't try again
+			incrementCounter("contact_messages_total", "result", "spam")
+			contactSent(w, r, nil)
+			return
+		}
+
+		if err := data.Form.CheckCSRF(r); err != nil {
+			incrementCounter("contact_messages_total", "result", "csrf")
+			writeError(w, r, err)
+			return
+		}
+
+		if wait := contactRateLimiter.reserve(clientAddress(r)); wait > 0 {
+			incrementCounter("contact_messages_total", "result", "rate_limited")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, r, newAppError(http.StatusTooManyRequests, "rate_limited",
+				"You're sending messages too quickly. Please wait a moment and try again."))
+			return
+		}
+
+		if !data.Form.Valid() {
+			incrementCounter("contact_messages_total", "result", "invalid")
+			if wantsJSON(r) {
+				writeFormProblems(w, data.Form)
+				return
+			}
+			status = http.StatusUnprocessableEntity
+		} else {
+			message := contactMessage{
+				Name:    data.Fields.Name,
+				Email:   data.Fields.Email,
+				Subject: data.Fields.Subject,
+				Message: data.Fields.Message,
+			}
+			id := make([]byte, 8)
+			rand.Read(id)
+			message.ID = hex.EncodeToString(id)
+			message.Received = time.Now().UTC()
+			message.Status = "stored"
+
+			if mailConfigured() && contactTo != "" {
+				message.Status = "emailed"
+				if err := emailContactMessage(message); err != nil {
+					message.Status = "email_failed"
+					logger.Printf("Failed to email contact message %s: %v", message.ID, err)
+				}
+			}
+
+			storeContactMessage(message)
+			incrementCounter("contact_messages_total", "result", message.Status)
+			contactSent(w, r, &message)
+			return
+		}
+
+	}
+
+	body, err := renderFragment(contactBodyTemplate, data)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the contact body template"))
+		return
+	}
+
+	renderMainTemplate(w, r, "contact", HtmlData{
+		Title:       "Golang Contact Form",
+		Description: "A contact form with validation, spam protection and email delivery.",
+		Keywords:    "golang web server contact form smtp honeypot rate limit",
+		CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+		BodyContent: body,
+		Status:      status,
+	})
+
+}
+
+// Tell the client their message was sent (the message is nil for the messages we drop as spam)
+func contactSent(w http.ResponseWriter, r *http.Request, message *contactMessage) {
+
+	if wantsJSON(r) {
+		id := ""
+		if message != nil {
+			id = message.ID
+		}
+		setContentType(w, CONTENT_TYPE_JSON)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"id": id})
+		return
+	}
+
+	// Redirecting means a refresh of the page doesn't send the message again
+	addFlash(w, r, FLASH_SUCCESS, "Thanks for your message, we'll be in touch.")
+	http.Redirect(w, r, urlFor("/contact"), http.StatusSeeOther)
+
+}
+
+// This is a template string we use to construct the body of our admin-only messages page
+const CONTACT_MESSAGES_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>Contact Messages</h2>
+		{{ range . }}
+		<h4>{{ if .Subject }}{{ .Subject }}{{ else }}(no subject){{ end }}</h4>
+		<p><small>From {{ .Name }} &lt;{{ .Email }}&gt; at {{ .Received.Format "2 Jan 2006 15:04 MST" }} ({{ .Status }})</small></p>
+		<p style="white-space: pre-wrap;">{{ .Message }}</p>
+		{{ else }}
+		<p>No messages yet.</p>
+		{{ end }}
+	</div>
+`
+
+// This is our admin-only contact messages handler, which lists the messages we've received,
+// most recent first
+func contactMessagesHandler(w http.ResponseWriter, r *http.Request) {
+
+	contactMessages.mutex.Lock()
+	messages := make([]contactMessage, 0, len(contactMessages.messages))
+	for index := len(contactMessages.messages) - 1; index >= 0; index-- {
+		messages = append(messages, contactMessages.messages[index])
+	}
+	contactMessages.mutex.Unlock()
+
+	if wantsJSON(r) {
+		setContentType(w, CONTENT_TYPE_JSON)
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{"messages": messages})
+		return
+	}
+
+	body, err := renderFragment(contactMessagesTemplate, messages)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the contact messages body template"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	renderMainTemplate(w, r, "contact messages", HtmlData{
+		Title:       "Contact Messages",
+		BodyContent: body,
+	})
+
+}
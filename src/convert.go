@@ -0,0 +1,468 @@
+// CSV and JSON conversion. POST a CSV file to /api/v1/convert/csv-to-json, or a JSON array to
+// /api/v1/convert/json-to-csv, and the converted data is streamed back as it's read, so inputs
+// of hundreds of megabytes (up to MAX_CONVERT_SIZE) are converted without being held in memory.
+//
+// The query parameters control the conversion:
+//
+//   - delimiter: the CSV field delimiter, a single character (or "tab"), defaulting to a comma
+//   - header: whether the CSV has a header row (the default, header=true). CSV with a header is
+//     converted to an array of objects keyed by the header, and without one to an array of
+//     arrays. The other way around, arrays of objects get a header row listing the keys of the
+//     first object (objects' other keys are dropped), which header=false leaves out.
+//   - infer: whether to infer the types of CSV fields (the default, infer=true), turning numbers,
+//     true / false and empty fields into JSON numbers, booleans and nulls rather than strings
+//
+// Problems with the start of the input (i.e. a JSON body which isn't an array) are reported as
+// errors, but once we've started streaming our response all we can do is stop, so errors part
+// way through are reported in the X-Conversion-Error trailer (and the output is left truncated).
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	MAX_CONVERT_SIZE         = 1 << 30 // The largest input we'll convert
+	CONVERT_IDLE_TIMEOUT     = time.Minute
+	CONVERT_PROGRESS_RECORDS = 1000 // How often (in records) we push back our deadlines
+	CONVERT_ERROR_TRAILER    = "X-Conversion-Error"
+)
+
+// JSON's number syntax, which the numbers we infer must follow
+var jsonNumberPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// The options of a conversion
+type convertOptions struct {
+	delimiter rune
+	header    bool
+	infer     bool
+}
+
+// Parse the conversion options of the given request
+func parseConvertOptions(r *http.Request) (convertOptions, error) {
+
+	query := r.URL.Query()
+	options := convertOptions{delimiter: ',', header: true, infer: true}
+
+	switch delimiter := query.Get("delimiter"); {
+	case delimiter == "":
+	case delimiter == "tab" || delimiter == `\t`:
+		options.delimiter = '\t'
+	case utf8.RuneCountInString(delimiter) == 1:
+		options.delimiter, _ = utf8.DecodeRuneInString(delimiter)
+	default:
+		return options, badRequestError("The delimiter must be a single character (or tab).")
+	}
+
+	if options.delimiter == '"' || options.delimiter == '\r' || options.delimiter == '\n' || options.delimiter == utf8.RuneError {
+		return options, badRequestError("The delimiter can't be a quote or a line break.")
+	}
+
+	for name, value := range map[string]*bool{"header": &options.header, "infer": &options.infer} {
+		if parameter := query.Get(name); parameter != "" {
+			parsed, err := strconv.ParseBool(parameter)
+			if err != nil {
+				return options, badRequestError(fmt.Sprintf("The %s parameter must be true or false.", name))
+			}
+			*value = parsed
+		}
+	}
+
+	return options, nil
+
+}
+
+// A conversion in progress, which keeps the deadlines of its request ahead of it and reports
+// errors part way through in our trailer
+type conversion struct {
+	w       http.ResponseWriter
+	r       *http.Request
+	output  *bufio.Writer
+	records int
+	started bool // Whether any of our output has been written to the response
+}
+
+// Write our buffered output to the response
+func (conversion *conversion) Write(data []byte) (int, error) {
+	conversion.started = true
+	return conversion.w.Write(data)
+}
+
+// Start a conversion, which may read its input while writing its output
+func startConversion(w http.ResponseWriter, r *http.Request) *conversion {
+
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_CONVERT_SIZE)
+
+	// Without full duplex, HTTP/1 requests can't be read once we've started writing our response
+	if err := http.NewResponseController(w).EnableFullDuplex(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logger.Println("WARN could not enable full duplex for", r.URL.Path, err)
+	}
+
+	extendReadDeadline(w, r, CONVERT_IDLE_TIMEOUT)
+	extendWriteDeadline(w, r, CONVERT_IDLE_TIMEOUT)
+
+	conversion := &conversion{w: w, r: r}
+	conversion.output = bufio.NewWriterSize(conversion, 64<<10)
+
+	return conversion
+
+}
+
+// Start writing our output of the given content type. Errors from here on are reported in our
+// trailer.
+func (conversion *conversion) begin(contentType string) {
+	conversion.w.Header().Set("Trailer", CONVERT_ERROR_TRAILER)
+	setContentType(conversion.w, contentType)
+}
+
+// Count a converted record, pushing back our deadlines every so often while we make progress
+func (conversion *conversion) progress() {
+
+	conversion.records++
+
+	if conversion.records%CONVERT_PROGRESS_RECORDS == 0 {
+		extendReadDeadline(conversion.w, conversion.r, CONVERT_IDLE_TIMEOUT)
+		extendWriteDeadline(conversion.w, conversion.r, CONVERT_IDLE_TIMEOUT)
+	}
+
+}
+
+// Finish our conversion, reporting the given error (if any) in our trailer
+func (conversion *conversion) finish(direction string, err error) {
+
+	if err == nil {
+		err = conversion.output.Flush()
+	}
+
+	if err != nil {
+
+		incrementCounter("conversions_total", "direction", direction, "result", "failed")
+
+		// Errors within the first part of the input (before we've written anything) can
+		// still be reported as usual
+		if !conversion.started {
+			conversion.w.Header().Del("Trailer")
+			writeError(conversion.w, conversion.r, convertReadError(err, "The input can't be converted: "+err.Error()))
+			return
+		}
+
+		conversion.w.Header().Set(CONVERT_ERROR_TRAILER, err.Error())
+		return
+
+	}
+
+	incrementCounter("conversions_total", "direction", direction, "result", "converted")
+
+}
+
+// Returns the JSON value of the given CSV field
+func csvFieldJSON(field string, infer bool) []byte {
+
+	if infer {
+		switch {
+		case field == "":
+			return []byte("null")
+		case field == "true" || field == "false":
+			return []byte(field)
+		case jsonNumberPattern.MatchString(field):
+			// Numbers too large for a float64 are kept as strings, since most JSON parsers
+			// can't read them
+			if _, err := strconv.ParseFloat(field, 64); err == nil {
+				return []byte(field)
+			}
+		}
+	}
+
+	value, _ := json.Marshal(field)
+	return value
+
+}
+
+// Returns the CSV reader for the given request body
+func newConvertCSVReader(body io.Reader, options convertOptions) *csv.Reader {
+	reader := csv.NewReader(bufio.NewReaderSize(body, 64<<10))
+	reader.Comma = options.delimiter
+	reader.FieldsPerRecord = -1 // Rows may have differing numbers of fields
+	reader.ReuseRecord = true
+	return reader
+}
+
+// This is our CSV to JSON conversion handler
+func csvToJSONHandler(w http.ResponseWriter, r *http.Request) {
+
+	options, err := parseConvertOptions(r)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	conversion := startConversion(w, r)
+	reader := newConvertCSVReader(r.Body, options)
+
+	var header []string
+
+	if options.header {
+		record, err := reader.Read()
+		if err != nil && err != io.EOF {
+			writeError(w, r, convertReadError(err, "The CSV header can't be read."))
+			return
+		}
+		for _, field := range record {
+			key, _ := json.Marshal(field)
+			header = append(header, string(key))
+		}
+	}
+
+	conversion.begin(CONTENT_TYPE_JSON)
+	conversion.finish("csv-to-json", conversion.writeCSVAsJSON(reader, header, options))
+
+}
+
+// Convert the records of the given CSV into a JSON array (of objects keyed by the given header,
+// or of arrays if we have no header)
+func (conversion *conversion) writeCSVAsJSON(reader *csv.Reader, header []string, options convertOptions) error {
+
+	output := conversion.output
+	output.WriteString("[")
+
+	for {
+
+		record, err := reader.Read()
+
+		if err == io.EOF {
+			_, err := output.WriteString("\n]\n")
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		if conversion.records > 0 {
+			output.WriteString(",")
+		}
+		output.WriteString("\n")
+
+		if options.header {
+			// Fields beyond the header are keyed by their (one based) position
+			output.WriteString("{")
+			for index, field := range record {
+				if index > 0 {
+					output.WriteString(",")
+				}
+				if index < len(header) {
+					output.WriteString(header[index])
+				} else {
+					fmt.Fprintf(output, `"%d"`, index+1)
+				}
+				output.WriteString(":")
+				output.Write(csvFieldJSON(field, options.infer))
+			}
+			output.WriteString("}")
+		} else {
+			output.WriteString("[")
+			for index, field := range record {
+				if index > 0 {
+					output.WriteString(",")
+				}
+				output.Write(csvFieldJSON(field, options.infer))
+			}
+			output.WriteString("]")
+		}
+
+		conversion.progress()
+
+	}
+
+}
+
+// Returns the CSV field of the given JSON value (strings are unquoted, null is empty and other
+// values are written as JSON)
+func jsonValueField(value json.RawMessage) string {
+
+	var text string
+
+	switch {
+	case bytes.Equal(value, []byte("null")):
+		return ""
+	case json.Unmarshal(value, &text) == nil:
+		return text
+	}
+
+	var compacted bytes.Buffer
+	if json.Compact(&compacted, value) == nil {
+		return compacted.String()
+	}
+
+	return string(value)
+
+}
+
+// Read the next element of a JSON array, which is either an object (returning its keys and
+// values in order) or an array (returning its values with no keys)
+func readJSONRecord(decoder *json.Decoder) (keys []string, values []json.RawMessage, err error) {
+
+	token, err := decoder.Token()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch token {
+
+	case json.Delim('{'):
+		keys = []string{}
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, nil, err
+			}
+			var value json.RawMessage
+			if err := decoder.Decode(&value); err != nil {
+				return nil, nil, err
+			}
+			keys = append(keys, key.(string))
+			values = append(values, value)
+		}
+
+	case json.Delim('['):
+		for decoder.More() {
+			var value json.RawMessage
+			if err := decoder.Decode(&value); err != nil {
+				return nil, nil, err
+			}
+			values = append(values, value)
+		}
+
+	default:
+		return nil, nil, fmt.Errorf("the element ending at byte %d isn't an object or an array", decoder.InputOffset())
+	}
+
+	// Skip the object or array's closing delimiter
+	if _, err := decoder.Token(); err != nil {
+		return nil, nil, err
+	}
+
+	return keys, values, nil
+
+}
+
+// This is our JSON to CSV conversion handler
+func jsonToCSVHandler(w http.ResponseWriter, r *http.Request) {
+
+	options, err := parseConvertOptions(r)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	conversion := startConversion(w, r)
+	decoder := json.NewDecoder(bufio.NewReaderSize(r.Body, 64<<10))
+
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		writeError(w, r, convertReadError(err, "The JSON must be an array of objects or arrays."))
+		return
+	}
+
+	conversion.begin("text/csv; charset=utf-8")
+	conversion.finish("json-to-csv", conversion.writeJSONAsCSV(decoder, options))
+
+}
+
+// Convert the elements of the given JSON array (whose opening bracket we've read) into CSV
+func (conversion *conversion) writeJSONAsCSV(decoder *json.Decoder, options convertOptions) error {
+
+	writer := csv.NewWriter(conversion.output)
+	writer.Comma = options.delimiter
+
+	// The columns of our objects, from the keys of the first one
+	var columns map[string]int
+
+	for decoder.More() {
+
+		keys, values, err := readJSONRecord(decoder)
+
+		if err != nil {
+			return err
+		}
+
+		if keys != nil && columns == nil {
+			columns = map[string]int{}
+			for _, key := range keys {
+				if _, found := columns[key]; !found {
+					columns[key] = len(columns)
+				}
+			}
+			if options.header {
+				header := make([]string, len(columns))
+				for key, index := range columns {
+					header[index] = key
+				}
+				if err := writer.Write(header); err != nil {
+					return err
+				}
+			}
+		}
+
+		var record []string
+
+		if keys != nil {
+			record = make([]string, len(columns))
+			for index, key := range keys {
+				if column, found := columns[key]; found {
+					record[column] = jsonValueField(values[index])
+				}
+			}
+		} else {
+			for _, value := range values {
+				record = append(record, jsonValueField(value))
+			}
+		}
+
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+
+		conversion.progress()
+
+	}
+
+	// Make sure the array is closed, so a truncated input isn't mistaken for a complete one
+	if _, err := decoder.Token(); err != nil {
+		return err
+	}
+
+	writer.Flush()
+	return writer.Error()
+
+}
+
+// Turn an error reading the start of a conversion's input into the error we report
+func convertReadError(err error, message string) error {
+
+	var maxBytesError *http.MaxBytesError
+
+	if errors.As(err, &maxBytesError) {
+		return newAppError(http.StatusRequestEntityTooLarge, "input_too_large",
+			fmt.Sprintf("Conversions are limited to %d bytes.", MAX_CONVERT_SIZE)).Wrap(err)
+	}
+
+	appError := badRequestError(message)
+	if err != nil {
+		appError = appError.Wrap(err)
+	}
+	return appError
+
+}
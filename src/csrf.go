@@ -0,0 +1,112 @@
+// CSRF protection for our forms, so that another site can't have its visitors' browsers submit
+// our forms for them. We use signed double-submit tokens: each visitor gets a random nonce in
+// our CSRF cookie (which is strictly necessary, so it doesn't wait for cookie consent), and our
+// forms carry a token which is the nonce and an expiry signed with our signing keys (see
+// signing.go). A submission is only accepted when its token is signed by one of our keys,
+// hasn't expired and carries the nonce in the visitor's cookie, which other sites can neither
+// read nor set.
+//
+// Tokens are signed with our newest key and verified with all of them, so rotating our keys
+// doesn't invalidate the forms visitors already have open.
+//
+// Scripts and API clients can skip the token by sending an X-Requested-With header (any value)
+// or a JSON body, which a browser won't send to us for another site without first asking us
+// (with a CORS preflight, which we never allow). The Accept header doesn't count: any site can
+// have a browser send Accept: application/json along with a form.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CSRF_COOKIE_NAME    = "csrf"
+	CSRF_FIELD_NAME     = "csrf_token"
+	CSRF_TOKEN_LIFETIME = 4 * time.Hour
+	CSRF_NONCE_LENGTH   = 16 // In bytes, before they're hex encoded
+	CSRF_SCRIPT_HEADER  = "X-Requested-With"
+)
+
+// Returns a CSRF token for a form on the page we're rendering, giving the visitor our CSRF
+// cookie if they don't have one yet. Must be called before the response's headers are written.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+
+	nonce := ""
+	if cookie, err := r.Cookie(CSRF_COOKIE_NAME); err == nil && len(cookie.Value) == 2*CSRF_NONCE_LENGTH {
+		nonce = cookie.Value
+	} else {
+		random := make([]byte, CSRF_NONCE_LENGTH)
+		rand.Read(random)
+		nonce = hex.EncodeToString(random)
+		http.SetCookie(w, &http.Cookie{
+			Name:     CSRF_COOKIE_NAME,
+			Value:    nonce,
+			Path:     urlFor("/"),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	expires := time.Now().Add(CSRF_TOKEN_LIFETIME).Unix()
+
+	return signValue("csrf:" + nonce + ":" + strconv.FormatInt(expires, 10))
+
+}
+
+// Returns whether the given token is valid for the given request. Forms which stream their
+// files (see uploads.go) read their token themselves, rather than parsing the whole form.
+func validCSRFTokenValue(r *http.Request, token string) bool {
+
+	cookie, err := r.Cookie(CSRF_COOKIE_NAME)
+	if err != nil {
+		return false
+	}
+
+	value, ok := verifySignedValue(token)
+	if !ok {
+		return false
+	}
+
+	fields := strings.Split(value, ":")
+	if len(fields) != 3 || fields[0] != "csrf" {
+		return false
+	}
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(fields[1]), []byte(cookie.Value)) == 1
+
+}
+
+// Returns whether the given request can't have been forged by another site, so needn't carry
+// a CSRF token: it has an X-Requested-With header or a JSON body, neither of which browsers
+// send cross-site without our permission
+func csrfExempt(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return r.Header.Get(CSRF_SCRIPT_HEADER) != "" || mediaType == "application/json"
+}
+
+// Returns an error unless the given request is exempt from CSRF checks or the given token
+// (which it submitted) is valid
+func checkCSRF(r *http.Request, token string) error {
+	if csrfExempt(r) || validCSRFTokenValue(r, token) {
+		return nil
+	}
+	return invalidCSRFError()
+}
+
+// The error a form submitted without a valid CSRF token gets
+func invalidCSRFError() *AppError {
+	return newAppError(http.StatusForbidden, "csrf_token_invalid", "This form has expired. Please reload the page and try again.")
+}
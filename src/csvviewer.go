@@ -0,0 +1,560 @@
+// CSV viewer demo. A CSV file uploaded via /csv-viewer is stored in our upload directory (using
+// the same streaming upload as /upload) and can then be browsed a page at a time at
+// /csv-viewer/{id}, with sorting and filtering done on the server as we stream through the file,
+// so the browser only ever receives the rows it displays.
+//
+// Uploaded files are private, so each uploaded CSV is viewed through a random ID rather than its
+// file name. The IDs are kept in a hidden index file within the upload directory (which the
+// upload listings skip), so they survive restarts.
+//
+// Sorting only needs to hold the rows up to the end of the requested page, so pages are limited
+// to the first MAX_CSV_VIEWER_WINDOW rows of a sort (filtering narrows them down further).
+
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CSV_VIEWER_INDEX_FILE     = ".csv-viewer.json"
+	MAX_CSV_VIEWER_FILES      = 1000 // The uploads we keep IDs for (the oldest are forgotten)
+	DEFAULT_CSV_VIEWER_ROWS   = 25
+	MAX_CSV_VIEWER_ROWS       = 500
+	MAX_CSV_VIEWER_WINDOW     = 10 * 1000 // How far into a sorted file we'll page
+	MAX_CSV_VIEWER_FILTER     = 200
+	CSV_VIEWER_PAGE_LINK_SPAN = 3 // The page links we display either side of the current page
+)
+
+// An uploaded CSV file we can view
+type csvViewerFile struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"` // The file's name within our upload directory
+	Uploaded time.Time `json:"uploaded"`
+}
+
+// The CSV files we can view, oldest first
+var csvViewerFiles = struct {
+	mutex sync.Mutex
+	files []csvViewerFile
+}{}
+
+func init() {
+	registerPage(Page{Title: "CSV Viewer", Path: "/csv-viewer", Order: 55, Visible: true, Section: SECTION_UTILITIES, Handler: csvViewerHandler,
+		Methods: []string{http.MethodGet, http.MethodPost}})
+}
+
+// Load the index of our viewable CSV files from our upload directory
+func loadCSVViewerFiles() error {
+
+	csvViewerFiles.mutex.Lock()
+	defer csvViewerFiles.mutex.Unlock()
+
+	return loadJSONFile(filepath.Join(uploadDir, CSV_VIEWER_INDEX_FILE), &csvViewerFiles.files)
+
+}
+
+// Add the given uploaded file to our index, returning its ID
+func addCSVViewerFile(name string) (string, error) {
+
+	csvViewerFiles.mutex.Lock()
+	defer csvViewerFiles.mutex.Unlock()
+
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	file := csvViewerFile{ID: hex.EncodeToString(id), Name: name, Uploaded: time.Now().UTC()}
+
+	csvViewerFiles.files = append(csvViewerFiles.files, file)
+
+	if excess := len(csvViewerFiles.files) - MAX_CSV_VIEWER_FILES; excess > 0 {
+		csvViewerFiles.files = csvViewerFiles.files[excess:]
+	}
+
+	return file.ID, saveJSONFile(filepath.Join(uploadDir, CSV_VIEWER_INDEX_FILE), csvViewerFiles.files)
+
+}
+
+// Returns the viewable file with the given ID
+func csvViewerFileByID(id string) (csvViewerFile, bool) {
+
+	csvViewerFiles.mutex.Lock()
+	defer csvViewerFiles.mutex.Unlock()
+
+	for _, file := range csvViewerFiles.files {
+		if file.ID == id {
+			return file, true
+		}
+	}
+
+	return csvViewerFile{}, false
+
+}
+
+// The rows to view of a CSV file
+type csvViewerQuery struct {
+	Page    int    `json:"page"`
+	PerPage int    `json:"per_page"`
+	Sort    int    `json:"sort"` // The column to sort by (zero based, -1 to keep the file's order)
+	Order   string `json:"order"`
+	Filter  string `json:"filter,omitempty"`
+	Column  int    `json:"column"` // The column to filter (-1 to filter every column)
+}
+
+// A page of rows of a CSV file
+type csvViewerPage struct {
+	Columns []string   `json:"columns"`
+	Rows    [][]string `json:"rows"`
+	Total   int        `json:"total"` // The number of rows matching our filter
+}
+
+// Parse the query of the given request
+func parseCSVViewerQuery(r *http.Request) (csvViewerQuery, error) {
+
+	query := csvViewerQuery{Page: 1, PerPage: DEFAULT_CSV_VIEWER_ROWS, Sort: -1, Order: "asc", Column: -1}
+	values := r.URL.Query()
+
+	number := func(name string, minimum int, maximum int, value *int) error {
+		if parameter := values.Get(name); parameter != "" {
+			parsed, err := strconv.Atoi(parameter)
+			if err != nil || parsed < minimum || parsed > maximum {
+				return badRequestError(fmt.Sprintf("The %s parameter must be a number from %d to %d.", name, minimum, maximum))
+			}
+			*value = parsed
+		}
+		return nil
+	}
+
+	for _, err := range []error{
+		number("page", 1, MAX_CSV_VIEWER_WINDOW, &query.Page),
+		number("per_page", 1, MAX_CSV_VIEWER_ROWS, &query.PerPage),
+		number("sort", -1, MAX_SPREADSHEET_COLUMNS, &query.Sort),
+		number("column", -1, MAX_SPREADSHEET_COLUMNS, &query.Column),
+	} {
+		if err != nil {
+			return query, err
+		}
+	}
+
+	if order := values.Get("order"); order != "" {
+		if order != "asc" && order != "desc" {
+			return query, badRequestError("The order parameter must be asc or desc.")
+		}
+		query.Order = order
+	}
+
+	query.Filter = strings.TrimSpace(values.Get("filter"))
+
+	if len(query.Filter) > MAX_CSV_VIEWER_FILTER {
+		return query, badRequestError(fmt.Sprintf("The filter can be at most %d characters long.", MAX_CSV_VIEWER_FILTER))
+	}
+
+	if query.Sort >= 0 && query.Page*query.PerPage > MAX_CSV_VIEWER_WINDOW {
+		return query, badRequestError(fmt.Sprintf("Sorted files can only be paged through their first %d rows (try filtering them).", MAX_CSV_VIEWER_WINDOW))
+	}
+
+	return query, nil
+
+}
+
+// Compare the given CSV fields, numerically if they're both numbers
+func compareCSVFields(a string, b string) int {
+
+	aNumber, aErr := strconv.ParseFloat(strings.TrimSpace(a), 64)
+	bNumber, bErr := strconv.ParseFloat(strings.TrimSpace(b), 64)
+
+	if aErr == nil && bErr == nil {
+		return cmp.Compare(aNumber, bNumber)
+	}
+
+	return cmp.Compare(strings.ToLower(a), strings.ToLower(b))
+
+}
+
+// Read the requested page of the given CSV file, streaming through its rows (after its header)
+func readCSVViewerPage(input io.Reader, query csvViewerQuery) (csvViewerPage, error) {
+
+	reader := csv.NewReader(input)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	header, err := reader.Read()
+
+	if err == io.EOF {
+		return csvViewerPage{Columns: []string{}, Rows: [][]string{}}, nil
+	} else if err != nil {
+		return csvViewerPage{}, err
+	}
+
+	page := csvViewerPage{Columns: header, Rows: [][]string{}}
+	filter := strings.ToLower(query.Filter)
+	offset := (query.Page - 1) * query.PerPage
+	window := offset + query.PerPage
+
+	// Our sort falls back to the order of the rows within the file, so that it's stable
+	type numberedRow struct {
+		number int
+		fields []string
+	}
+	var sorted []numberedRow
+
+	field := func(fields []string, column int) string {
+		if column < len(fields) {
+			return fields[column]
+		}
+		return ""
+	}
+
+	compare := func(a numberedRow, b numberedRow) int {
+		order := compareCSVFields(field(a.fields, query.Sort), field(b.fields, query.Sort))
+		if query.Order == "desc" {
+			order = -order
+		}
+		if order == 0 {
+			return cmp.Compare(a.number, b.number)
+		}
+		return order
+	}
+
+	for number := 0; ; number++ {
+
+		fields, err := reader.Read()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return page, err
+		}
+
+		if filter != "" {
+			matched := false
+			for column, value := range fields {
+				if (query.Column < 0 || column == query.Column) && strings.Contains(strings.ToLower(value), filter) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+
+		page.Total++
+
+		if query.Sort < 0 {
+			if page.Total > offset && len(page.Rows) < query.PerPage {
+				page.Rows = append(page.Rows, fields)
+			}
+			continue
+		}
+
+		// Keep the rows which sort within our window, in order
+		row := numberedRow{number: number, fields: fields}
+		position, _ := slices.BinarySearchFunc(sorted, row, compare)
+		if position < window {
+			sorted = slices.Insert(sorted, position, row)
+			sorted = sorted[:min(len(sorted), window)]
+		}
+
+	}
+
+	if query.Sort >= 0 {
+		for _, row := range sorted[min(offset, len(sorted)):] {
+			page.Rows = append(page.Rows, row.fields)
+		}
+	}
+
+	return page, nil
+
+}
+
+// This is a template string we use to construct the body of our CSV viewer upload page
+const CSV_VIEWER_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>CSV Viewer</h2>
+		<p>Upload a CSV file (with a header row) to browse it a page at a time, sorted and filtered on the server.</p>
+		<form action="{{ url "/csv-viewer" }}" method="POST" enctype="multipart/form-data">
+			<input type="hidden" name="csrf_token" value="{{ .CSRFToken }}">
+			<input type="file" name="file" accept=".csv,text/csv">
+			<br>
+			<input type="submit" value="View">
+		</form>
+	</div>
+`
+
+// This is a template string we use to construct the body of our CSV viewer table page
+const CSV_VIEWER_TABLE_TEMPLATE = `
+	<div class = "main-content" style="width: 90%; overflow: auto;">
+		<h2>{{ .Name }}</h2>
+		<form action="{{ .Path }}" method="GET">
+			<input name="filter" value="{{ .Query.Filter }}" maxLength=200 placeholder="Filter rows">
+			<select name="column">
+				<option value="-1">Any column</option>
+				{{ range $index, $column := .Page.Columns }}<option value="{{ $index }}"{{ if eq $index $.Query.Column }} selected{{ end }}>{{ $column }}</option>{{ end }}
+			</select>
+			{{ if ge .Query.Sort 0 }}<input type="hidden" name="sort" value="{{ .Query.Sort }}"><input type="hidden" name="order" value="{{ .Query.Order }}">{{ end }}
+			<input type="hidden" name="per_page" value="{{ .Query.PerPage }}">
+			<input type="submit" value="Filter">
+		</form>
+		<p><small>{{ .Page.Total }} rows{{ if .Query.Filter }} match{{ end }}</small></p>
+		<table style="margin: auto; border-collapse: collapse;">
+			<tr>{{ range .Headings }}<th style="border: 1px solid #ccc; padding: 2px 6px;"><a href="{{ .URL }}" style="color: black;">{{ .Name }}{{ .Arrow }}</a></th>{{ end }}</tr>
+			{{ range .Page.Rows }}
+			<tr>{{ range . }}<td style="border: 1px solid #ccc; padding: 2px 6px;">{{ . }}</td>{{ end }}</tr>
+			{{ end }}
+		</table>
+		<p>{{ range .Pages }}{{ if .Current }}<strong>{{ .Number }}</strong>{{ else if .URL }}<a href="{{ .URL }}">{{ .Number }}</a>{{ else }}…{{ end }} {{ end }}</p>
+	</div>
+`
+
+// A column heading of our table, which sorts by its column (or reverses the sort)
+type csvViewerHeading struct {
+	Name  string
+	URL   string
+	Arrow string
+}
+
+// A link to a page of our table (with no URL for a gap in the page numbers)
+type csvViewerPageLink struct {
+	Number  int
+	URL     string
+	Current bool
+}
+
+// The data we pass into our CSV viewer table template
+type csvViewerTableData struct {
+	Name     string
+	Path     string
+	Query    csvViewerQuery
+	Page     csvViewerPage
+	Headings []csvViewerHeading
+	Pages    []csvViewerPageLink
+}
+
+// Returns the URL of our table with the given query
+func (data csvViewerTableData) url(query csvViewerQuery) string {
+
+	values := url.Values{}
+	values.Set("page", strconv.Itoa(query.Page))
+	values.Set("per_page", strconv.Itoa(query.PerPage))
+	if query.Sort >= 0 {
+		values.Set("sort", strconv.Itoa(query.Sort))
+		values.Set("order", query.Order)
+	}
+	if query.Filter != "" {
+		values.Set("filter", query.Filter)
+		values.Set("column", strconv.Itoa(query.Column))
+	}
+
+	return data.Path + "?" + values.Encode()
+
+}
+
+// Work out the links of our column headings and pages
+func (data *csvViewerTableData) addLinks() {
+
+	for column, name := range data.Page.Columns {
+		query := data.Query
+		query.Page = 1
+		query.Sort = column
+		query.Order = "asc"
+		heading := csvViewerHeading{Name: name}
+		if data.Query.Sort == column {
+			if data.Query.Order == "asc" {
+				query.Order = "desc"
+				heading.Arrow = " ▲"
+			} else {
+				heading.Arrow = " ▼"
+			}
+		}
+		heading.URL = data.url(query)
+		data.Headings = append(data.Headings, heading)
+	}
+
+	pages := max(1, (data.Page.Total+data.Query.PerPage-1)/data.Query.PerPage)
+	if data.Query.Sort >= 0 {
+		pages = min(pages, MAX_CSV_VIEWER_WINDOW/data.Query.PerPage)
+	}
+
+	// The first and last pages, along with the pages around the current one
+	for number := 1; number <= pages; number++ {
+		near := number >= data.Query.Page-CSV_VIEWER_PAGE_LINK_SPAN && number <= data.Query.Page+CSV_VIEWER_PAGE_LINK_SPAN
+		if number != 1 && number != pages && !near {
+			if len(data.Pages) > 0 && data.Pages[len(data.Pages)-1].URL != "" {
+				data.Pages = append(data.Pages, csvViewerPageLink{})
+			}
+			continue
+		}
+		query := data.Query
+		query.Page = number
+		data.Pages = append(data.Pages, csvViewerPageLink{Number: number, URL: data.url(query), Current: number == data.Query.Page})
+	}
+
+}
+
+// This is our CSV viewer handler. GET displays our upload form, while POST stores an uploaded
+// CSV and sends the browser on to view it.
+func csvViewerHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Our token (and the cookie behind it) must be set before we write anything
+	form := newForm(w, r)
+
+	if r.Method == http.MethodPost {
+
+		uploaded, err := receiveUpload(w, r, form)
+
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		// We view a single file, so any others are left as ordinary uploads
+		path := filepath.Join(uploadDir, uploaded[0].Name)
+
+		if err := checkCSVFile(path); err != nil {
+			os.Remove(path)
+			writeError(w, r, badRequestError(fmt.Sprintf("%s isn't a CSV file with a header row.", uploaded[0].Name)).Wrap(err))
+			return
+		}
+
+		id, err := addCSVViewerFile(uploaded[0].Name)
+
+		if err != nil {
+			writeError(w, r, internalError(err).WithDetail("saving the CSV viewer index"))
+			return
+		}
+
+		incrementCounter("csv_viewer_uploads_total")
+
+		if wantsJSON(r) {
+			setContentType(w, CONTENT_TYPE_JSON)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]string{"id": id, "url": urlFor("/csv-viewer/" + id)})
+			return
+		}
+
+		http.Redirect(w, r, urlFor("/csv-viewer/"+id), http.StatusSeeOther)
+		return
+
+	}
+
+	body, err := renderFragment(csvViewerBodyTemplate, form)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the CSV viewer body template"))
+		return
+	}
+
+	renderCSVViewerPage(w, r, body)
+
+}
+
+// Check that the file at the given path starts with a CSV header row
+func checkCSVFile(path string) error {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.LazyQuotes = true
+
+	header, err := reader.Read()
+	if err == nil && len(header) == 0 {
+		err = errors.New("the header row is empty")
+	}
+
+	return err
+
+}
+
+// This is our CSV viewer table handler, which displays a page of an uploaded CSV file
+func csvViewerTableHandler(w http.ResponseWriter, r *http.Request) {
+
+	file, found := csvViewerFileByID(r.PathValue("id"))
+
+	if !found {
+		writeError(w, r, notFoundError())
+		return
+	}
+
+	query, err := parseCSVViewerQuery(r)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	input, err := os.Open(filepath.Join(uploadDir, file.Name))
+
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, r, notFoundError())
+		return
+	} else if err != nil {
+		writeError(w, r, internalError(err).WithDetail("opening %s", file.Name))
+		return
+	}
+	defer input.Close()
+
+	endSpan := startSpan(r.Context(), "read")
+	page, err := readCSVViewerPage(input, query)
+	endSpan()
+
+	if err != nil {
+		writeError(w, r, newAppError(http.StatusUnprocessableEntity, "invalid_csv", "The file isn't valid CSV.").Wrap(err))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if wantsJSON(r) {
+		setContentType(w, CONTENT_TYPE_JSON)
+		json.NewEncoder(w).Encode(struct {
+			Name string `json:"name"`
+			csvViewerQuery
+			csvViewerPage
+		}{file.Name, query, page})
+		return
+	}
+
+	data := csvViewerTableData{Name: file.Name, Path: urlFor("/csv-viewer/" + file.ID), Query: query, Page: page}
+	data.addLinks()
+
+	body, err := renderFragment(csvViewerTableTemplate, data)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the CSV viewer table template"))
+		return
+	}
+
+	renderCSVViewerPage(w, r, body)
+
+}
+
+// Render the given body within our main template
+func renderCSVViewerPage(w http.ResponseWriter, r *http.Request, body template.HTML) {
+	renderMainTemplate(w, r, "csv-viewer", HtmlData{
+		Title:       "Golang CSV Viewer",
+		Description: "Browse uploaded CSV files with server-side paging, sorting and filtering.",
+		Keywords:    "golang web server csv viewer paging sorting filtering",
+		CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+		BodyContent: body,
+	})
+}
@@ -0,0 +1,61 @@
+// Per-route read / write deadline control. Our server's global timeouts (READ_TIMEOUT and
+// WRITE_TIMEOUT) would cut off large uploads, downloads and long lived streams, so specific
+// routes / handlers can extend or clear their deadlines using an http.ResponseController.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// How long the log download (and other potentially large downloads) may take to write
+const DOWNLOAD_WRITE_TIMEOUT = 5 * time.Minute
+
+// Returns a handler which replaces the server's write deadline for the requests it handles.
+// A timeout of zero clears the write deadline entirely (i.e. for long lived streams).
+func writeDeadlineHandler(timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		extendWriteDeadline(w, r, timeout)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Move the write deadline of the given response to the given timeout from now (or clear it
+// if the timeout is zero). Streaming handlers can call this periodically to keep the deadline
+// ahead of them while they're still making progress. Response writers which don't support
+// deadlines (i.e. the writer used to answer HEAD requests) are left as they are.
+func extendWriteDeadline(w http.ResponseWriter, r *http.Request, timeout time.Duration) {
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	err := http.NewResponseController(w).SetWriteDeadline(deadline)
+
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		requestID, _ := r.Context().Value(REQUEST_ID_KEY).(string)
+		logger.Println("WARN could not set the write deadline for", requestID, r.URL.Path, err)
+	}
+
+}
+
+// Move the read deadline of the given request to the given timeout from now (or clear it if
+// the timeout is zero), i.e. so that large uploads aren't cut off by our global ReadTimeout.
+func extendReadDeadline(w http.ResponseWriter, r *http.Request, timeout time.Duration) {
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	err := http.NewResponseController(w).SetReadDeadline(deadline)
+
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		requestID, _ := r.Context().Value(REQUEST_ID_KEY).(string)
+		logger.Println("WARN could not set the read deadline for", requestID, r.URL.Path, err)
+	}
+
+}
@@ -0,0 +1,102 @@
+// Self-contained demo applications. A demo app brings everything it needs with it (its page and
+// navbar entry, its other routes, such as an API, its templates and any cleanup at shutdown)
+// and registers itself from an init function in its own file:
+//
+//	func init() {
+//		registerDemoApp(diffApp{})
+//	}
+//
+// so adding one doesn't mean touching routeHandler, templates.go or features.go: its routes are
+// added to our router, its page to our navbar and sitemap, its templates are parsed (and test
+// executed) with ours, and it becomes a feature (see features.go) named after it, covering all
+// of its routes. It's shut down along with the server.
+//
+// As nothing else refers to a demo app, its file can be left out of a build with a build tag,
+// i.e. diff.go starts with //go:build !nodiff, so go build -tags nodiff,nohash builds the server
+// without the diff and hash demos. Apps which other code depends on (i.e. the colour functions
+// shared by several demos) have to stay in, and are still registered the older way.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// A DemoApp is a demo application which registers itself via registerDemoApp
+type DemoApp interface {
+	Name() string                       // The name of the app's feature (i.e. diff)
+	NavEntry() *Page                    // The app's page, shown in the navbar (or nil if it has none)
+	Routes() []DemoRoute                // The app's other routes
+	Templates() []templateDefinition    // The app's templates (see templates.go)
+	Shutdown(ctx context.Context) error // Called when the server shuts down
+}
+
+// A route of a demo app
+type DemoRoute struct {
+	Pattern string // The router pattern (i.e. /api/v1/diff)
+	Handler http.Handler
+	Methods []string // The methods the route accepts (defaults to GET)
+}
+
+// demoAppDefaults can be embedded in a demo app for the methods it has nothing to return from
+type demoAppDefaults struct{}
+
+func (demoAppDefaults) NavEntry() *Page                    { return nil }
+func (demoAppDefaults) Routes() []DemoRoute                { return nil }
+func (demoAppDefaults) Templates() []templateDefinition    { return nil }
+func (demoAppDefaults) Shutdown(ctx context.Context) error { return nil }
+
+// Our demo apps, in the order they registered. Like our page registry, it should be treated as
+// read-only once the server starts handling requests.
+var demoApps []DemoApp
+
+// Add a demo app, along with its page and its feature
+func registerDemoApp(app DemoApp) {
+
+	demoApps = append(demoApps, app)
+
+	var patterns []string
+	if page := app.NavEntry(); page != nil {
+		registerPage(*page)
+		patterns = append(patterns, routePattern(page.Path))
+	}
+	for _, route := range app.Routes() {
+		patterns = append(patterns, route.Pattern)
+	}
+
+	registerFeature(app.Name(), patterns...)
+
+}
+
+// Add the routes of our demo apps to the given router (their pages are routed with the rest of
+// our page registry)
+func registerDemoAppRoutes(router *http.ServeMux) {
+	for _, app := range demoApps {
+		for _, route := range app.Routes() {
+			handleRoute(router, route.Pattern, route.Handler, route.Methods...)
+		}
+	}
+}
+
+// Returns the templates of our demo apps
+func demoAppTemplates() []templateDefinition {
+	var definitions []templateDefinition
+	for _, app := range demoApps {
+		definitions = append(definitions, app.Templates()...)
+	}
+	return definitions
+}
+
+// Shut down each of our demo apps (in the reverse of the order they registered), returning
+// their errors
+func shutdownDemoApps(ctx context.Context) error {
+	var errs []error
+	for i := len(demoApps) - 1; i >= 0; i-- {
+		if err := demoApps[i].Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,615 @@
+// Our text diff utility. /diff compares two pasted texts line by line on the server and shows
+// their differences as a unified diff or side by side, while POST /api/v1/diff returns them as
+// structured hunks (along with the unified diff) for scripts.
+//
+// Differences are found with Myers' algorithm, which finds the fewest lines to delete and
+// insert. Its cost grows with the number of differences, so texts which differ by more than
+// MAX_DIFF_EDITS lines have the part between their common start and end replaced wholesale
+// instead, which is still a correct (if less readable) diff.
+
+//go:build !nodiff
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	MAX_DIFF_SIZE    = 1 << 20 // The largest text we'll compare
+	MAX_DIFF_EDITS   = 1000    // The most line differences we'll search for
+	DIFF_CONTEXT     = 3       // The unchanged lines shown around changes by default
+	MAX_DIFF_CONTEXT = 100
+)
+
+// An edit which turns one text into another
+type diffOp byte
+
+const (
+	DIFF_EQUAL  diffOp = ' '
+	DIFF_DELETE diffOp = '-'
+	DIFF_INSERT diffOp = '+'
+)
+
+// The names of our edits in diff lines
+var diffKinds = map[diffOp]string{DIFF_EQUAL: "context", DIFF_DELETE: "delete", DIFF_INSERT: "insert"}
+
+// A line of a diff, with its line numbers in the old and new texts (0 where it isn't in one)
+type diffLine struct {
+	Kind      string `json:"kind"` // context, delete or insert
+	Text      string `json:"text"`
+	Old       int    `json:"old,omitempty"`
+	New       int    `json:"new,omitempty"`
+	NoNewline bool   `json:"no_newline,omitempty"` // If the line ends its text without a line break
+}
+
+// A group of nearby changes along with the unchanged lines around them
+type diffHunk struct {
+	OldStart int        `json:"old_start"`
+	OldLines int        `json:"old_lines"`
+	NewStart int        `json:"new_start"`
+	NewLines int        `json:"new_lines"`
+	Lines    []diffLine `json:"lines"`
+}
+
+// The differences between two texts
+type textDiff struct {
+	Identical  bool       `json:"identical"`
+	Insertions int        `json:"insertions"`
+	Deletions  int        `json:"deletions"`
+	Hunks      []diffHunk `json:"hunks"`
+	Unified    string     `json:"unified"`
+}
+
+// Split the given text into lines, keeping their line breaks so that a missing final line
+// break counts as a difference
+func splitDiffLines(text string) []string {
+	lines := strings.SplitAfter(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Returns the edits which turn the old lines into the new ones
+func diffLines(old, new []string) []diffOp {
+
+	// Lines are compared as numbers, which is quicker than comparing strings
+	ids := map[string]int{}
+	number := func(lines []string) []int {
+		numbers := make([]int, len(lines))
+		for i, line := range lines {
+			if _, found := ids[line]; !found {
+				ids[line] = len(ids)
+			}
+			numbers[i] = ids[line]
+		}
+		return numbers
+	}
+	a, b := number(old), number(new)
+
+	// Our common start and end are left out of the search
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for range prefix {
+		ops = append(ops, DIFF_EQUAL)
+	}
+
+	middle, found := myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])
+	if !found {
+		for range len(a) - prefix - suffix {
+			middle = append(middle, DIFF_DELETE)
+		}
+		for range len(b) - prefix - suffix {
+			middle = append(middle, DIFF_INSERT)
+		}
+	}
+	ops = append(ops, middle...)
+
+	for range suffix {
+		ops = append(ops, DIFF_EQUAL)
+	}
+
+	return ops
+
+}
+
+// Find the shortest edits which turn a into b with Myers' algorithm, giving up (and returning
+// false) after MAX_DIFF_EDITS. See "An O(ND) Difference Algorithm and Its Variations" (1986).
+func myersDiff(a, b []int) ([]diffOp, bool) {
+
+	n, m := len(a), len(b)
+	offset := n + m + 1
+
+	// furthest[offset+k] is the furthest x reached on diagonal k (where k = x - y). We keep the
+	// part of it each step started with, so that we can trace our path back afterwards.
+	furthest := make([]int, 2*offset+1)
+	var trace [][]int
+
+	for d := 0; d <= n+m; d++ {
+
+		if d > MAX_DIFF_EDITS {
+			return nil, false
+		}
+
+		trace = append(trace, append([]int(nil), furthest[offset-d-1:offset+d+2]...))
+
+		for k := -d; k <= d; k += 2 {
+
+			var x int
+			if k == -d || k != d && furthest[offset+k-1] < furthest[offset+k+1] {
+				x = furthest[offset+k+1] // Down from diagonal k + 1 (an insertion)
+			} else {
+				x = furthest[offset+k-1] + 1 // Right from diagonal k - 1 (a deletion)
+			}
+
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			furthest[offset+k] = x
+
+			if x >= n && y >= m {
+				return backtrackDiff(trace, n, m), true
+			}
+
+		}
+
+	}
+
+	return nil, false
+
+}
+
+// Trace the path of our search back from the end of both texts, returning its edits in order
+func backtrackDiff(trace [][]int, n, m int) []diffOp {
+
+	var reversed []diffOp
+	x, y := n, m
+
+	for d := len(trace) - 1; d >= 0; d-- {
+
+		// Our snapshot of step d covers diagonals -d - 1 to d + 1
+		furthest := func(k int) int { return trace[d][k+d+1] }
+
+		k := x - y
+		previousK := k - 1
+		if k == -d || k != d && furthest(k-1) < furthest(k+1) {
+			previousK = k + 1
+		}
+		previousX := furthest(previousK)
+		previousY := previousX - previousK
+
+		for x > previousX && y > previousY {
+			reversed = append(reversed, DIFF_EQUAL)
+			x, y = x-1, y-1
+		}
+
+		if d > 0 {
+			if x == previousX {
+				reversed = append(reversed, DIFF_INSERT)
+			} else {
+				reversed = append(reversed, DIFF_DELETE)
+			}
+		}
+
+		x, y = previousX, previousY
+
+	}
+
+	ops := make([]diffOp, len(reversed))
+	for i, op := range reversed {
+		ops[len(ops)-1-i] = op
+	}
+
+	return ops
+
+}
+
+// Compare the given texts, grouping their changes into hunks with the given number of
+// unchanged lines around them
+func diffTexts(oldText, newText string, context int) textDiff {
+
+	old, new := splitDiffLines(oldText), splitDiffLines(newText)
+	ops := diffLines(old, new)
+
+	// The lines of our diff, numbered within each text
+	lines := make([]diffLine, len(ops))
+	changes := []int{}
+	oldNumber, newNumber := 0, 0
+	diff := textDiff{Hunks: []diffHunk{}}
+
+	for i, op := range ops {
+		var text string
+		switch op {
+		case DIFF_EQUAL:
+			oldNumber, newNumber = oldNumber+1, newNumber+1
+			text = new[newNumber-1]
+			lines[i] = diffLine{Old: oldNumber, New: newNumber}
+		case DIFF_DELETE:
+			oldNumber++
+			text = old[oldNumber-1]
+			lines[i] = diffLine{Old: oldNumber}
+			diff.Deletions++
+			changes = append(changes, i)
+		case DIFF_INSERT:
+			newNumber++
+			text = new[newNumber-1]
+			lines[i] = diffLine{New: newNumber}
+			diff.Insertions++
+			changes = append(changes, i)
+		}
+		text, found := strings.CutSuffix(text, "\n")
+		lines[i].Kind, lines[i].Text, lines[i].NoNewline = diffKinds[op], text, !found
+	}
+
+	diff.Identical = len(changes) == 0
+
+	// Changes close enough for their context to meet share a hunk
+	for start := 0; start < len(changes); {
+
+		end := start
+		for end+1 < len(changes) && changes[end+1]-changes[end] <= 2*context+1 {
+			end++
+		}
+
+		first, last := max(changes[start]-context, 0), min(changes[end]+context, len(lines)-1)
+		hunk := diffHunk{Lines: lines[first : last+1]}
+
+		// Hunks which are empty in a text start at the line before them, as in diff -u
+		hunk.OldStart, hunk.NewStart = 0, 0
+		for _, line := range lines[:first] {
+			hunk.OldStart = max(hunk.OldStart, line.Old)
+			hunk.NewStart = max(hunk.NewStart, line.New)
+		}
+		for _, line := range hunk.Lines {
+			if line.Old > 0 {
+				hunk.OldLines++
+			}
+			if line.New > 0 {
+				hunk.NewLines++
+			}
+		}
+		if hunk.OldLines > 0 {
+			hunk.OldStart++
+		}
+		if hunk.NewLines > 0 {
+			hunk.NewStart++
+		}
+
+		diff.Hunks = append(diff.Hunks, hunk)
+		start = end + 1
+
+	}
+
+	diff.Unified = unifiedDiff(diff.Hunks)
+
+	return diff
+
+}
+
+// Returns the given hunks as a unified diff (as diff -u and git diff print)
+func unifiedDiff(hunks []diffHunk) string {
+
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var output strings.Builder
+	output.WriteString("--- old\n+++ new\n")
+
+	for _, hunk := range hunks {
+		output.WriteString(hunk.header() + "\n")
+		for _, line := range hunk.Lines {
+			output.WriteString(line.prefix() + line.Text + "\n")
+			if line.NoNewline {
+				output.WriteString("\\ No newline at end of file\n")
+			}
+		}
+	}
+
+	return output.String()
+
+}
+
+// Returns our hunk's @@ header
+func (hunk diffHunk) header() string {
+	lineRange := func(start, lines int) string {
+		if lines == 1 {
+			return strconv.Itoa(start)
+		}
+		return fmt.Sprintf("%d,%d", start, lines)
+	}
+	return fmt.Sprintf("@@ -%s +%s @@", lineRange(hunk.OldStart, hunk.OldLines), lineRange(hunk.NewStart, hunk.NewLines))
+}
+
+// Returns the character which starts our line in a unified diff
+func (line diffLine) prefix() string {
+	switch line.Kind {
+	case "delete":
+		return "-"
+	case "insert":
+		return "+"
+	}
+	return " "
+}
+
+// A row of our side by side view, which has a line from either text (or both)
+type diffRow struct {
+	Old *diffLine
+	New *diffLine
+}
+
+// Lay out the given hunk side by side. Unchanged lines share a row, while deleted lines are
+// paired with the lines inserted in their place.
+func (hunk diffHunk) rows() []diffRow {
+
+	var rows []diffRow
+	lines := hunk.Lines
+
+	for i := 0; i < len(lines); {
+
+		if lines[i].Kind == "context" {
+			rows = append(rows, diffRow{Old: &lines[i], New: &lines[i]})
+			i++
+			continue
+		}
+
+		var deleted, inserted []*diffLine
+		for ; i < len(lines) && lines[i].Kind != "context"; i++ {
+			if lines[i].Kind == "delete" {
+				deleted = append(deleted, &lines[i])
+			} else {
+				inserted = append(inserted, &lines[i])
+			}
+		}
+
+		for row := range max(len(deleted), len(inserted)) {
+			var pair diffRow
+			if row < len(deleted) {
+				pair.Old = deleted[row]
+			}
+			if row < len(inserted) {
+				pair.New = inserted[row]
+			}
+			rows = append(rows, pair)
+		}
+
+	}
+
+	return rows
+
+}
+
+// The data we pass into our diff body template
+type diffPageData struct {
+	Old     string
+	New     string
+	View    string // unified or side-by-side
+	Context int
+	Diff    *textDiff
+	Hunks   []diffPageHunk
+}
+
+// The body content of our diff page. The values are escaped by html/template.
+const DIFF_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>Text Diff</h2>
+		<form action="{{ url "/diff" }}" method="POST">
+			<textarea name="old" rows=12 cols=50 spellcheck="false" placeholder="Old text">{{ .Old }}</textarea>
+			<textarea name="new" rows=12 cols=50 spellcheck="false" placeholder="New text">{{ .New }}</textarea>
+			<p>
+				<select name="view">
+					<option value="unified"{{ if eq .View "unified" }} selected{{ end }}>Unified</option>
+					<option value="side-by-side"{{ if eq .View "side-by-side" }} selected{{ end }}>Side by side</option>
+				</select>
+				<input type="number" name="context" min=0 max=100 value="{{ .Context }}" title="Unchanged lines around changes">
+				<input type="submit" value="Compare">
+			</p>
+		</form>
+		{{ with .Diff }}
+		{{ if .Identical }}
+		<p>The texts are identical.</p>
+		{{ else }}
+		<p><small>{{ .Insertions }} lines inserted, {{ .Deletions }} lines deleted</small></p>
+		{{ if eq $.View "side-by-side" }}
+		<table style="margin: auto; border-collapse: collapse; font-family: monospace; text-align: left;">
+			{{ range $.Hunks }}
+			<tr><td colspan=4 style="color: #888; padding-top: 8px;">{{ .Header }}</td></tr>
+			{{ range .Rows }}
+			<tr>
+				{{ with .Old }}<td style="color: #888;">{{ .Old }}</td><td style="white-space: pre;{{ if eq .Kind "delete" }} background: #fdd;{{ end }}">{{ .Text }}</td>{{ else }}<td></td><td></td>{{ end }}
+				{{ with .New }}<td style="color: #888;">{{ .New }}</td><td style="white-space: pre;{{ if eq .Kind "insert" }} background: #dfd;{{ end }}">{{ .Text }}</td>{{ else }}<td></td><td></td>{{ end }}
+			</tr>
+			{{ end }}
+			{{ end }}
+		</table>
+		{{ else }}
+		<pre style="text-align: left;">{{ range $.Hunks }}<span style="color: #888;">{{ .Header }}</span>
+{{ range .Lines }}{{ if eq .Kind "delete" }}<span style="background: #fdd;">-{{ .Text }}</span>{{ else if eq .Kind "insert" }}<span style="background: #dfd;">+{{ .Text }}</span>{{ else }} {{ .Text }}{{ end }}
+{{ if .NoNewline }}\ No newline at end of file
+{{ end }}{{ end }}{{ end }}</pre>
+		{{ end }}
+		{{ end }}
+		{{ end }}
+	</div>
+`
+
+// The hunks of a diff as our template displays them
+type diffPageHunk struct {
+	Header string
+	Lines  []diffLine
+	Rows   []diffRow
+}
+
+var diffBodyTemplate *template.Template
+
+// Our text comparison demo app (see demoapps.go)
+type diffApp struct {
+	demoAppDefaults
+}
+
+func init() {
+	registerDemoApp(diffApp{})
+}
+
+func (diffApp) Name() string {
+	return "diff"
+}
+
+func (diffApp) NavEntry() *Page {
+	return &Page{Title: "Diff", Path: "/diff", Order: 77, Visible: true, Section: SECTION_UTILITIES, Handler: diffHandler,
+		Methods: []string{http.MethodGet, http.MethodPost}}
+}
+
+func (diffApp) Routes() []DemoRoute {
+	return []DemoRoute{{Pattern: "/api/v1/diff", Handler: http.HandlerFunc(diffAPIHandler), Methods: []string{http.MethodPost}}}
+}
+
+func (diffApp) Templates() []templateDefinition {
+	return []templateDefinition{{
+		name:       "diff.body",
+		source:     DIFF_BODY_TEMPLATE,
+		target:     &diffBodyTemplate,
+		sampleData: diffPageData{View: "side-by-side", Diff: &textDiff{}, Hunks: []diffPageHunk{{Lines: []diffLine{{NoNewline: true}}, Rows: []diffRow{{Old: &diffLine{}}}}}},
+	}}
+}
+
+// Returns the number of context lines in the given value, which defaults to DIFF_CONTEXT
+func parseDiffContext(value string) (int, error) {
+
+	if value == "" {
+		return DIFF_CONTEXT, nil
+	}
+
+	context, err := strconv.Atoi(value)
+	if err != nil || context < 0 || context > MAX_DIFF_CONTEXT {
+		return 0, badRequestError(fmt.Sprintf("The context must be a number of lines from 0 to %d.", MAX_DIFF_CONTEXT))
+	}
+
+	return context, nil
+
+}
+
+// This is our diff handler. GET requests display our form, while POST requests compare the
+// submitted texts and display their differences below it.
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+
+	data := diffPageData{View: "unified", Context: DIFF_CONTEXT}
+
+	if r.Method == http.MethodPost {
+
+		r.Body = http.MaxBytesReader(w, r.Body, 2*MAX_DIFF_SIZE+64<<10)
+
+		if err := r.ParseForm(); err != nil {
+			writeError(w, r, badRequestError("The texts are too large to compare.").Wrap(err))
+			return
+		}
+
+		context, err := parseDiffContext(r.PostForm.Get("context"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		data.Old, data.New, data.Context = r.PostForm.Get("old"), r.PostForm.Get("new"), context
+		if r.PostForm.Get("view") == "side-by-side" {
+			data.View = "side-by-side"
+		}
+
+		diff, err := compareTexts(r, data.Old, data.New, data.Context)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		data.Diff = &diff
+		for _, hunk := range diff.Hunks {
+			data.Hunks = append(data.Hunks, diffPageHunk{Header: hunk.header(), Lines: hunk.Lines, Rows: hunk.rows()})
+		}
+
+	}
+
+	body, err := renderFragment(diffBodyTemplate, data)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the diff body template"))
+		return
+	}
+
+	renderMainTemplate(w, r, "diff", HtmlData{
+		Title:       "Golang Text Diff",
+		Description: "Compare two texts line by line, as a unified diff or side by side.",
+		Keywords:    "golang web server text diff compare unified side by side",
+		CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+		BodyContent: body,
+	})
+
+}
+
+// Check the size of the given texts and compare them
+func compareTexts(r *http.Request, oldText, newText string, context int) (textDiff, error) {
+
+	if len(oldText) > MAX_DIFF_SIZE || len(newText) > MAX_DIFF_SIZE {
+		return textDiff{}, newAppError(http.StatusRequestEntityTooLarge, "too_large",
+			fmt.Sprintf("Texts may be at most %d bytes.", MAX_DIFF_SIZE))
+	}
+
+	endSpan := startSpan(r.Context(), "diff")
+	diff := diffTexts(oldText, newText, context)
+	endSpan()
+
+	incrementCounter("diffs_total", "identical", strconv.FormatBool(diff.Identical))
+
+	return diff, nil
+
+}
+
+// This is our diff API. It takes a JSON object with the old and new texts (and optionally the
+// number of context lines) and returns their differences as hunks and as a unified diff.
+func diffAPIHandler(w http.ResponseWriter, r *http.Request) {
+
+	var request struct {
+		Old     *string `json:"old"`
+		New     *string `json:"new"`
+		Context *int    `json:"context"`
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*MAX_DIFF_SIZE+64<<10))
+
+	if err := decoder.Decode(&request); err != nil || request.Old == nil || request.New == nil {
+		writeError(w, r, badRequestError("The request must be a JSON object with the old and new texts to compare.").Wrap(err))
+		return
+	}
+
+	context := DIFF_CONTEXT
+	if request.Context != nil {
+		if *request.Context < 0 || *request.Context > MAX_DIFF_CONTEXT {
+			writeError(w, r, badRequestError(fmt.Sprintf("The context must be a number of lines from 0 to %d.", MAX_DIFF_CONTEXT)))
+			return
+		}
+		context = *request.Context
+	}
+
+	diff, err := compareTexts(r, *request.Old, *request.New, context)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	json.NewEncoder(w).Encode(diff)
+
+}
@@ -0,0 +1,222 @@
+// A/B experiments. For anyone trying out variations of the demo pages, experiments passed in
+// via the (repeatable) -experiment flag split visitors into buckets, i.e.
+//
+//	-experiment home:control,blue -experiment nav:control=80,compact=20
+//
+// gives each visitor a bucket for the home experiment (an even split) and for the nav
+// experiment (an 80 / 20 split). Visitors are bucketed deterministically, by a visitor ID
+// cookie (or their IP address with -experiment-key ip), so they stay in the same buckets
+// between requests. Handlers can find a visitor's bucket via experimentBucket, while pages get
+// experiment-<name>-<bucket> classes on their body element, so that variations can be styled
+// in CSS. Requests are counted per bucket (and status class) in experiment_requests_total.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	VISITOR_COOKIE_NAME    = "visitor_id"
+	VISITOR_COOKIE_MAX_AGE = 365 * 24 * time.Hour
+)
+
+// Experiment and bucket names end up in CSS class names and metric labels, so we keep them simple
+var experimentNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// A single experiment and its (weighted) buckets
+type experiment struct {
+	name    string
+	buckets []experimentBucketWeight
+	total   int // The sum of our bucket weights
+}
+
+type experimentBucketWeight struct {
+	name   string
+	weight int
+}
+
+// Parse an experiment in the form name:bucket,bucket or name:bucket=weight,bucket=weight
+func parseExperiment(experimentString string) (experiment, error) {
+
+	name, bucketList, found := strings.Cut(experimentString, ":")
+
+	if !found || !experimentNamePattern.MatchString(name) {
+		return experiment{}, fmt.Errorf("invalid experiment %q: expected name:bucket,bucket (with lower case names)", experimentString)
+	}
+
+	parsed := experiment{name: name}
+	seen := map[string]bool{}
+
+	for _, bucketString := range strings.Split(bucketList, ",") {
+
+		bucket, weightString, weighted := strings.Cut(strings.TrimSpace(bucketString), "=")
+		weight := 1
+
+		if weighted {
+			var err error
+			weight, err = strconv.Atoi(weightString)
+			if err != nil || weight < 1 {
+				return experiment{}, fmt.Errorf("invalid experiment %s bucket weight %q: must be a positive whole number", name, weightString)
+			}
+		}
+
+		if !experimentNamePattern.MatchString(bucket) {
+			return experiment{}, fmt.Errorf("invalid experiment %s bucket %q: expected a lower case name", name, bucket)
+		}
+
+		if seen[bucket] {
+			return experiment{}, fmt.Errorf("invalid experiment %s: the bucket %s is listed more than once", name, bucket)
+		}
+		seen[bucket] = true
+
+		parsed.buckets = append(parsed.buckets, experimentBucketWeight{name: bucket, weight: weight})
+		parsed.total += weight
+
+	}
+
+	if len(parsed.buckets) < 2 {
+		return experiment{}, fmt.Errorf("invalid experiment %s: expected at least two buckets", name)
+	}
+
+	return parsed, nil
+
+}
+
+// Returns the bucket of the given visitor. Hashing the experiment name along with the visitor
+// means that a visitor's buckets in different experiments are independent of each other.
+func (experiment experiment) bucketFor(visitor string) string {
+
+	hash := fnv.New32a()
+	hash.Write([]byte(experiment.name + "\x00" + visitor))
+	position := int(hash.Sum32() % uint32(experiment.total))
+
+	for _, bucket := range experiment.buckets {
+		if position < bucket.weight {
+			return bucket.name
+		}
+		position -= bucket.weight
+	}
+
+	return experiment.buckets[len(experiment.buckets)-1].name
+
+}
+
+// The list of experiments passed in via the -experiment flag. It implements flag.Value so that
+// the flag can be repeated.
+type experimentList []experiment
+
+var experiments experimentList
+
+func (list *experimentList) String() string {
+	return fmt.Sprint(len(*list), " experiments")
+}
+
+func (list *experimentList) Set(experimentString string) error {
+
+	parsed, err := parseExperiment(experimentString)
+
+	if err != nil {
+		return err
+	}
+
+	for _, existing := range *list {
+		if existing.name == parsed.name {
+			return fmt.Errorf("the experiment %s is defined more than once", parsed.name)
+		}
+	}
+
+	*list = append(*list, parsed)
+
+	return nil
+
+}
+
+// Returns the bucket the request's visitor is in for the named experiment (or "" if there's no
+// such experiment)
+func experimentBucket(r *http.Request, name string) string {
+	return experimentBuckets(r.Context())[name]
+}
+
+// Returns the buckets (keyed by experiment name) of the visitor of the request with the given
+// context
+func experimentBuckets(ctx context.Context) map[string]string {
+	buckets, _ := ctx.Value(EXPERIMENT_BUCKETS_KEY).(map[string]string)
+	return buckets
+}
+
+// Returns a handler which assigns each visitor to a bucket of each of our experiments, making
+// the buckets available via the request context
+func experimentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// There's nothing to do without experiments, and our debugging and monitoring
+		// endpoints aren't part of any experiment
+		if len(experiments) == 0 || strings.HasPrefix(r.URL.Path, urlFor("/debug/")) ||
+			r.URL.Path == urlFor("/health") || r.URL.Path == urlFor("/metrics") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Visitors who haven't accepted non-essential cookies don't get a visitor ID cookie,
+		// so they aren't part of our experiments (see consent.go)
+		if experimentKey == "cookie" && !nonEssentialCookiesAllowed(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		visitor := visitorID(w, r)
+		buckets := make(map[string]string, len(experiments))
+
+		for _, experiment := range experiments {
+			buckets[experiment.name] = experiment.bucketFor(visitor)
+		}
+
+		recorder := newStatusRecorder(w)
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), EXPERIMENT_BUCKETS_KEY, buckets)))
+
+		for name, bucket := range buckets {
+			incrementCounter("experiment_requests_total", "experiment", name, "bucket", bucket,
+				"class", statusClass(recorder.status))
+		}
+
+	})
+}
+
+// Returns the ID we bucket the request's visitor by: their visitor ID cookie (which we set
+// for new visitors), or their IP address when -experiment-key is ip
+func visitorID(w http.ResponseWriter, r *http.Request) string {
+
+	if experimentKey == "ip" {
+		return clientAddress(r)
+	}
+
+	if cookie, err := r.Cookie(VISITOR_COOKIE_NAME); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	visitor := hex.EncodeToString(id)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     VISITOR_COOKIE_NAME,
+		Value:    visitor,
+		Path:     urlFor("/"),
+		MaxAge:   int(VISITOR_COOKIE_MAX_AGE.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return visitor
+
+}
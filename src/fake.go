@@ -0,0 +1,239 @@
+// Fake data, for developers using the server as a source of test fixtures. GET /api/v1/fake
+// returns records of made up people (names, emails, phone numbers, addresses and companies)
+// along with lorem ipsum sentences and paragraphs, as JSON or CSV:
+//
+//	/api/v1/fake?fields=name,email,address&count=10&seed=42&format=csv
+//
+// The same seed always gives the same records, so tests can depend on them. Each record has its
+// own generator (seeded from the seed and the record's number) and its fields are generated in
+// a fixed order, so asking for more records or more fields doesn't change the ones you had.
+// Requests without a seed get a random one, which is returned in the X-Fake-Seed header so
+// that they can be repeated.
+//
+// Nothing generated belongs to anyone: emails use the example.com, example.org and example.net
+// domains (which are reserved for examples by RFC 2606) and phone numbers are from the
+// 555-0100 to 555-0199 range reserved for fiction.
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	FAKE_RECORDS     = 10 // The records we generate by default
+	MAX_FAKE_RECORDS = 1000
+	FAKE_SEED_HEADER = "X-Fake-Seed"
+)
+
+// The fields we can generate, in the order they're generated
+var fakeFields = []string{"first_name", "last_name", "name", "username", "email", "phone", "street",
+	"city", "state", "postcode", "country", "address", "company", "sentence", "paragraph"}
+
+// The fields we generate by default
+var defaultFakeFields = []string{"name", "email", "phone", "address"}
+
+var (
+	fakeFirstNames = strings.Fields(`Olivia Liam Emma Noah Amelia Oliver Ava Elijah Sophia James
+		Isabella William Mia Benjamin Charlotte Lucas Harper Henry Evelyn Theodore Abigail Jack
+		Emily Levi Ella Alexander Elizabeth Jackson Camila Mateo Luna Daniel Sofia Michael Avery
+		Mason Mila Sebastian Aria Ethan Scarlett Logan Penelope Owen Layla Samuel Chloe Jacob
+		Victoria Asher Madison Aiden Eleanor John Grace Joseph Nora Wyatt Riley David Zoey Leo
+		Hannah Luke Hazel Julian Lily Hudson Ellie Grayson Violet Matthew Lillian Ezra Zoe Gabriel
+		Stella Carter Aurora Isaac Natalie Jayden Emilia Luca Everly Anthony Leah Dylan Aubrey`)
+	fakeLastNames = strings.Fields(`Smith Johnson Williams Brown Jones Garcia Miller Davis
+		Rodriguez Martinez Hernandez Lopez Gonzalez Wilson Anderson Thomas Taylor Moore Jackson
+		Martin Lee Perez Thompson White Harris Sanchez Clark Ramirez Lewis Robinson Walker Young
+		Allen King Wright Scott Torres Nguyen Hill Flores Green Adams Nelson Baker Hall Rivera
+		Campbell Mitchell Carter Roberts Gomez Phillips Evans Turner Diaz Parker Cruz Edwards
+		Collins Reyes Stewart Morris Morales Murphy Cook Rogers Gutierrez Ortiz Morgan Cooper
+		Peterson Bailey Reed Kelly Howard Ramos Kim Cox Ward Richardson Watson Brooks Chavez Wood`)
+	fakeStreetNames = strings.Fields(`Maple Oak Pine Cedar Elm Washington Lake Hill Park Main
+		Sunset Highland Lincoln Jefferson Church Spring Meadow River Forest Willow Chestnut Walnut
+		Franklin Madison Adams Birch Ridge Valley Mill Cherry Dogwood Sycamore Magnolia Laurel`)
+	fakeStreetSuffixes = strings.Fields(`Street Avenue Road Lane Drive Court Boulevard Way Place Terrace`)
+	fakeDomains        = []string{"example.com", "example.org", "example.net"}
+	fakeCompanyWords   = strings.Fields(`Acme Globex Initech Umbrella Stark Wayne Hooli Vandelay
+		Cyberdyne Soylent Tyrell Wonka Gringotts Aperture Oscorp Monarch Dunder Prestige Sterling`)
+	fakeCompanySuffixes = []string{"Inc.", "LLC", "Group", "Partners", "& Sons", "Holdings", "Labs", "Industries"}
+	fakeLoremWords      = strings.Fields(`lorem ipsum dolor sit amet consectetur adipiscing elit sed do
+		eiusmod tempor incididunt ut labore et dolore magna aliqua enim ad minim veniam quis
+		nostrud exercitation ullamco laboris nisi aliquip ex ea commodo consequat duis aute irure
+		in reprehenderit voluptate velit esse cillum eu fugiat nulla pariatur excepteur sint
+		occaecat cupidatat non proident sunt culpa qui officia deserunt mollit anim id est laborum`)
+)
+
+// The cities of our addresses, with their states and the first digits of their postcodes
+var fakeCities = []struct{ city, state, postcode string }{
+	{"Springfield", "IL", "627"}, {"Portland", "OR", "972"}, {"Austin", "TX", "787"},
+	{"Madison", "WI", "537"}, {"Boulder", "CO", "803"}, {"Burlington", "VT", "054"},
+	{"Savannah", "GA", "314"}, {"Santa Fe", "NM", "875"}, {"Ann Arbor", "MI", "481"},
+	{"Asheville", "NC", "288"}, {"Boise", "ID", "837"}, {"Providence", "RI", "029"},
+	{"Des Moines", "IA", "503"}, {"Spokane", "WA", "992"}, {"Tucson", "AZ", "857"},
+	{"Richmond", "VA", "232"}, {"Columbus", "OH", "432"}, {"Omaha", "NE", "681"},
+	{"Salem", "MA", "019"}, {"Lexington", "KY", "405"},
+}
+
+// A made up person, whose fields are generated in order from their own generator
+type fakeRecord map[string]string
+
+// Generate the record with the given number for the given seed. The sentence and paragraph are
+// only generated if they're wanted, as they come last and take the longest.
+func generateFakeRecord(seed uint64, number int, wanted map[string]bool) fakeRecord {
+
+	random := rand.New(rand.NewPCG(seed, uint64(number)))
+	pick := func(values []string) string { return values[random.IntN(len(values))] }
+
+	record := fakeRecord{}
+
+	record["first_name"] = pick(fakeFirstNames)
+	record["last_name"] = pick(fakeLastNames)
+	record["name"] = record["first_name"] + " " + record["last_name"]
+	record["username"] = strings.ToLower(record["first_name"][:1]+record["last_name"]) + strconv.Itoa(random.IntN(100))
+	record["email"] = strings.ToLower(record["first_name"]+"."+record["last_name"]) + "@" + pick(fakeDomains)
+	record["phone"] = fmt.Sprintf("(%d) 555-01%02d", 201+random.IntN(789), random.IntN(100))
+
+	city := fakeCities[random.IntN(len(fakeCities))]
+	record["street"] = fmt.Sprintf("%d %s %s", 1+random.IntN(9999), pick(fakeStreetNames), pick(fakeStreetSuffixes))
+	record["city"], record["state"], record["country"] = city.city, city.state, "United States"
+	record["postcode"] = fmt.Sprintf("%s%02d", city.postcode, random.IntN(100))
+	record["address"] = fmt.Sprintf("%s, %s, %s %s", record["street"], city.city, city.state, record["postcode"])
+
+	if random.IntN(2) == 0 {
+		record["company"] = pick(fakeCompanyWords) + " " + pick(fakeCompanySuffixes)
+	} else {
+		record["company"] = record["last_name"] + " " + pick(fakeCompanySuffixes)
+	}
+
+	if wanted["sentence"] || wanted["paragraph"] {
+		record["sentence"] = loremSentence(random)
+	}
+
+	if wanted["paragraph"] {
+		sentences := make([]string, 3+random.IntN(4))
+		for i := range sentences {
+			sentences[i] = loremSentence(random)
+		}
+		record["paragraph"] = strings.Join(sentences, " ")
+	}
+
+	return record
+
+}
+
+// Returns a lorem ipsum sentence of 6 to 14 words, with the odd comma
+func loremSentence(random *rand.Rand) string {
+
+	words := make([]string, 6+random.IntN(9))
+	for i := range words {
+		words[i] = fakeLoremWords[random.IntN(len(fakeLoremWords))]
+		if i > 1 && i < len(words)-2 && random.IntN(8) == 0 {
+			words[i] += ","
+		}
+	}
+
+	return capitalise(strings.Join(words, " ")) + "."
+
+}
+
+// This is our fake data handler. It takes the fields to generate (as a comma separated list),
+// the number of records, the seed and the format (json or csv).
+func fakeDataHandler(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+
+	fields := defaultFakeFields
+	if value := query.Get("fields"); value != "" {
+		fields = strings.Split(value, ",")
+	}
+
+	wanted := map[string]bool{}
+	for _, field := range fields {
+		if !slices.Contains(fakeFields, field) {
+			writeError(w, r, badRequestError(fmt.Sprintf("Unknown field %q, expected any of %s.", field, strings.Join(fakeFields, ", "))))
+			return
+		}
+		wanted[field] = true
+	}
+
+	count := FAKE_RECORDS
+	if value := query.Get("count"); value != "" {
+		var err error
+		if count, err = strconv.Atoi(value); err != nil || count < 0 || count > MAX_FAKE_RECORDS {
+			writeError(w, r, badRequestError(fmt.Sprintf("The count must be a number from 0 to %d.", MAX_FAKE_RECORDS)))
+			return
+		}
+	}
+
+	// Our random seeds fit in 53 bits, so that JavaScript can read them from the JSON
+	seed := rand.Uint64() >> 11
+	if value := query.Get("seed"); value != "" {
+		var err error
+		if seed, err = strconv.ParseUint(value, 10, 64); err != nil {
+			writeError(w, r, badRequestError("The seed must be a positive whole number."))
+			return
+		}
+	}
+
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeError(w, r, badRequestError("The format must be json or csv."))
+		return
+	}
+
+	endSpan := startSpan(r.Context(), "fake data")
+	records := make([]fakeRecord, count)
+	for i := range records {
+		records[i] = generateFakeRecord(seed, i, wanted)
+	}
+	endSpan()
+
+	addCounter("fake_records_total", float64(count), "format", cmp.Or(format, "json"))
+	w.Header().Set(FAKE_SEED_HEADER, strconv.FormatUint(seed, 10))
+
+	var output bytes.Buffer
+
+	if format == "csv" {
+		writer := csv.NewWriter(&output)
+		writer.Write(fields)
+		for _, record := range records {
+			row := make([]string, len(fields))
+			for i, field := range fields {
+				row[i] = record[field]
+			}
+			writer.Write(csvSafeRow(row))
+		}
+		writer.Flush()
+		setContentType(w, "text/csv; charset=utf-8")
+		w.Write(output.Bytes())
+		return
+	}
+
+	// Our records keep their fields in the order they were asked for
+	list := make([]any, len(records))
+	for i, record := range records {
+		object := documentObject{}
+		for _, field := range fields {
+			object = append(object, documentMember{Key: field, Value: record[field]})
+		}
+		list[i] = object
+	}
+
+	writeJSONDocument(&output, documentObject{
+		{Key: "seed", Value: json.Number(strconv.FormatUint(seed, 10))},
+		{Key: "records", Value: list},
+	})
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	w.Write(output.Bytes())
+
+}
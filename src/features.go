@@ -0,0 +1,197 @@
+// Feature flags. Each of our demo apps and API groups is a feature which can be switched off at
+// startup via the -disable-features flag (i.e. -disable-features pdf,graphql) or at runtime by
+// admins via /debug/features. The routes of a disabled feature respond with our 404 page, and
+// its pages disappear from the navigation bar and the sitemap.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Feature is a named group of routes which can be switched on and off
+type Feature struct {
+	Name     string   `json:"name"`
+	Patterns []string `json:"patterns"` // The router patterns of the feature's routes
+	Enabled  bool     `json:"enabled"`
+}
+
+// Our features, along with the routes they cover. Routes which aren't part of a feature (i.e.
+// our home page, health checks and admin endpoints) are always enabled.
+var features = struct {
+	mutex     sync.RWMutex
+	byName    map[string]*Feature
+	byPattern map[string]*Feature
+}{byName: map[string]*Feature{}, byPattern: map[string]*Feature{}}
+
+func init() {
+	registerFeature("excel", "/excel", "/export/spreadsheet", "/api/v1/spreadsheet/evaluate",
+		"/api/v1/sheets/{name}", "/api/v1/sheets/{name}/revisions", "/sheets/{name}", "/sheets/{name}/diff", "/api/v1/xlsx/fill")
+	registerFeature("qr-code", "/qr-code-generator", "/feeds/qr-codes.atom", "/api/v1/codes/{type}")
+	registerFeature("svg", "/svg")
+	registerFeature("sphere", "/sphere")
+	registerFeature("upload", "/upload", "/uploads/{name}", "/files/download-all", "/shared/{token}", "/debug/share")
+	registerFeature("weather", "/weather")
+	registerFeature("tools", "/tools")
+	registerFeature("images", "/img/resize")
+	registerFeature("charts", "/chart")
+	registerFeature("pdf", "/export/pdf")
+	registerFeature("graphql", "/api/graphql", "/graphiql", SHORT_URL_PATH_PREFIX+"{code}", PASTE_PATH_PREFIX+"{id}",
+		"/feeds/pastes.atom", "/feeds/short-urls.atom")
+	registerFeature("uptime", "/uptime")
+	registerFeature("contact", "/contact")
+	registerFeature("convert", "/api/v1/convert/csv-to-json", "/api/v1/convert/json-to-csv")
+	registerFeature("search", "/search", "/api/v1/search")
+	registerFeature("csv-viewer", "/csv-viewer", "/csv-viewer/{id}")
+	registerFeature("highlight", "/api/v1/highlight")
+	registerFeature("markdown", "/api/v1/markdown")
+	registerFeature("format", "/format", "/api/v1/format/{action}")
+	registerFeature("password", "/password", "/api/v1/password/generate", "/api/v1/password/strength")
+	registerFeature("fake", "/api/v1/fake")
+	registerFeature("colors", "/colors", "/api/v1/colors")
+	registerFeature("ascii", "/ascii")
+	registerFeature("maze", "/maze")
+	registerFeature("inspect", "/echo", "/headers", "/delay/{seconds}", "/status/{code}")
+}
+
+// Add a new (enabled) feature covering the given router patterns
+func registerFeature(name string, patterns ...string) {
+
+	feature := &Feature{Name: name, Patterns: patterns, Enabled: true}
+
+	features.byName[name] = feature
+	for _, pattern := range patterns {
+		features.byPattern[pattern] = feature
+	}
+
+	setGauge("feature_enabled", 1, "feature", name)
+
+}
+
+// Returns whether the route with the given router pattern is enabled
+func routeEnabled(pattern string) bool {
+
+	features.mutex.RLock()
+	defer features.mutex.RUnlock()
+
+	feature, found := features.byPattern[pattern]
+
+	return !found || feature.Enabled
+
+}
+
+// Returns whether the given page is enabled
+func pageEnabled(page Page) bool {
+	return routeEnabled(routePattern(page.Path))
+}
+
+// Switch the named features on or off, i.e. {"pdf": false}. Unknown feature names are rejected
+// (without changing anything).
+func setFeatures(enabled map[string]bool) error {
+
+	features.mutex.Lock()
+	defer features.mutex.Unlock()
+
+	for name := range enabled {
+		if _, found := features.byName[name]; !found {
+			return fmt.Errorf("unknown feature %q (expected one of %s)", name, strings.Join(featureNames(), ", "))
+		}
+	}
+
+	for name, on := range enabled {
+		features.byName[name].Enabled = on
+		setGauge("feature_enabled", map[bool]float64{false: 0, true: 1}[on], "feature", name)
+	}
+
+	// Our cached pages link to the features which were enabled when they were rendered
+	clearPageCache()
+
+	return nil
+
+}
+
+// Disable the features in the given comma separated list (our -disable-features flag)
+func disableFeatures(names string) error {
+
+	enabled := map[string]bool{}
+
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			enabled[name] = false
+		}
+	}
+
+	return setFeatures(enabled)
+
+}
+
+// Returns the (sorted) names of our features. The caller must hold our features mutex.
+func featureNames() []string {
+
+	var names []string
+	for name := range features.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+
+}
+
+// Returns a handler which responds with a 404 while the route with the given pattern is
+// disabled. It wraps our method handling, so that disabled routes don't answer OPTIONS
+// requests (or reveal their methods) either.
+func featureHandler(pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if !routeEnabled(pattern) {
+			incrementCounter("feature_disabled_requests_total", "route", pattern)
+			writeError(w, r, notFoundError())
+			return
+		}
+
+		next.ServeHTTP(w, r)
+
+	})
+}
+
+// This is our features handler for admins. GET requests list our features, while PUT requests
+// switch features on or off with a JSON object of feature names, i.e.
+//
+//	{"pdf": false, "graphql": true}
+func featuresAdminHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method == http.MethodPut {
+
+		var enabled map[string]bool
+
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&enabled); err != nil {
+			writeError(w, r, badRequestError("The request body must be a JSON object of feature names and whether they're enabled.").Wrap(err))
+			return
+		}
+
+		if err := setFeatures(enabled); err != nil {
+			writeError(w, r, badRequestError(err.Error()))
+			return
+		}
+
+	}
+
+	features.mutex.RLock()
+	defer features.mutex.RUnlock()
+
+	var list []Feature
+	for _, name := range featureNames() {
+		list = append(list, *features.byName[name])
+	}
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	json.NewEncoder(w).Encode(map[string]interface{}{"features": list})
+
+}
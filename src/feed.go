@@ -0,0 +1,202 @@
+// Atom feeds (RFC 4287). Demos which create public content can offer a feed of their most recent
+// items by building an atomFeed (see newAtomFeed) and serving it with writeAtomFeed. Feed and
+// entry IDs are absolute URLs, built from -site-url (or the request) like our sitemap's.
+//
+// Our feeds:
+//
+//   - /feeds/qr-codes.atom: the QR codes visitors chose to share publicly
+//   - /feeds/pastes.atom: the pastes created via our GraphQL API (see graphqldata.go)
+//   - /feeds/short-urls.atom: the short URLs created via our GraphQL API
+
+package main
+
+import (
+	"cmp"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	CONTENT_TYPE_ATOM  = "application/atom+xml; charset=utf-8"
+	MAX_FEED_ENTRIES   = 50  // The number of recent items our feeds list
+	MAX_FEED_SUMMARY   = 200 // The most characters of an item's text an entry's summary holds
+	MAX_SHARED_QR_TEXT = 512
+)
+
+// XML elements used to construct our feeds
+type atomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	XMLNS   string      `xml:"xmlns,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Links   []atomLink `xml:"link"`
+	Summary string     `xml:"summary,omitempty"`
+}
+
+// Create an (empty) feed with the given title, served from the given path
+func newAtomFeed(r *http.Request, title, path string) *atomFeed {
+
+	self := siteBaseURL(r) + urlFor(path)
+
+	return &atomFeed{
+		XMLNS:  "http://www.w3.org/2005/Atom",
+		ID:     self,
+		Title:  title,
+		Author: atomPerson{Name: "Golang Web Server"},
+		Links:  []atomLink{{Rel: "self", Type: "application/atom+xml", Href: self}},
+	}
+
+}
+
+// Add an entry to our feed. The link is the path of the entry's page, which (along with when
+// the entry was created) identifies it.
+func (feed *atomFeed) add(r *http.Request, title, path, summary string, created time.Time) {
+
+	link := siteBaseURL(r) + urlFor(path)
+
+	feed.Entries = append(feed.Entries, atomEntry{
+		// Several entries can share a page, so the creation time makes our IDs unique
+		ID:      fmt.Sprintf("%s#%d", link, created.UnixNano()),
+		Title:   title,
+		Updated: created.UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Rel: "alternate", Type: "text/html", Href: link}},
+		Summary: summary,
+	})
+
+}
+
+// Returns the start of the given text, for the summary of an entry
+func feedSummary(text string) string {
+	if utf8.RuneCountInString(text) <= MAX_FEED_SUMMARY {
+		return text
+	}
+	return string([]rune(text)[:MAX_FEED_SUMMARY]) + "…"
+}
+
+// Write out our feed. It was last updated when its newest (first) entry was created, or when
+// the server started if it has no entries.
+func writeAtomFeed(w http.ResponseWriter, r *http.Request, feed *atomFeed) {
+
+	feed.Updated = serverStarted.UTC().Format(time.RFC3339)
+	if len(feed.Entries) > 0 {
+		feed.Updated = feed.Entries[0].Updated
+	}
+
+	feedXML, err := xml.MarshalIndent(feed, "", "  ")
+
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("marshalling the %s feed", feed.Title))
+		return
+	}
+
+	setContentType(w, CONTENT_TYPE_ATOM)
+	fmt.Fprint(w, xml.Header)
+	w.Write(feedXML)
+
+}
+
+// A QR code a visitor chose to share publicly
+type sharedQRCode struct {
+	Text    string
+	Created time.Time
+}
+
+// The QR codes shared most recently, newest first
+var sharedQRCodes = struct {
+	mutex sync.Mutex
+	codes []sharedQRCode
+}{}
+
+// Share the QR code for the given text in our QR code feed
+func shareQRCode(text string) {
+
+	sharedQRCodes.mutex.Lock()
+	defer sharedQRCodes.mutex.Unlock()
+
+	// Refreshing the page of a shared QR code doesn't share it again
+	if len(sharedQRCodes.codes) > 0 && sharedQRCodes.codes[0].Text == text {
+		return
+	}
+
+	code := sharedQRCode{Text: text, Created: time.Now()}
+
+	sharedQRCodes.codes = append([]sharedQRCode{code}, sharedQRCodes.codes[:min(len(sharedQRCodes.codes), MAX_FEED_ENTRIES-1)]...)
+
+	incrementCounter("qr_codes_shared_total")
+
+}
+
+// This is our QR code feed handler, which lists the QR codes shared most recently
+func qrCodeFeedHandler(w http.ResponseWriter, r *http.Request) {
+
+	feed := newAtomFeed(r, "Shared QR Codes", "/feeds/qr-codes.atom")
+
+	sharedQRCodes.mutex.Lock()
+	for _, code := range sharedQRCodes.codes {
+		feed.add(r, code.Text, "/qr-code-generator?qr_code_text="+url.QueryEscape(code.Text),
+			"A QR code for "+code.Text, code.Created)
+	}
+	sharedQRCodes.mutex.Unlock()
+
+	writeAtomFeed(w, r, feed)
+
+}
+
+// This is our paste feed handler, which lists the pastes created most recently
+func pasteFeedHandler(w http.ResponseWriter, r *http.Request) {
+
+	feed := newAtomFeed(r, "Recent Pastes", "/feeds/pastes.atom")
+
+	graphQLData.mutex.Lock()
+	pastes := newestFirst(graphQLData.pastes)
+	graphQLData.mutex.Unlock()
+
+	for _, paste := range pastes[:min(len(pastes), MAX_FEED_ENTRIES)] {
+		feed.add(r, cmp.Or(paste.Title, "Untitled paste"), PASTE_PATH_PREFIX+paste.ID, feedSummary(paste.Content), paste.Created)
+	}
+
+	writeAtomFeed(w, r, feed)
+
+}
+
+// This is our short URL feed handler, which lists the short URLs created most recently
+func shortURLFeedHandler(w http.ResponseWriter, r *http.Request) {
+
+	feed := newAtomFeed(r, "Recent Short URLs", "/feeds/short-urls.atom")
+
+	graphQLData.mutex.Lock()
+	shortURLs := newestFirst(graphQLData.shortURLs)
+	graphQLData.mutex.Unlock()
+
+	for _, short := range shortURLs[:min(len(shortURLs), MAX_FEED_ENTRIES)] {
+		feed.add(r, short.URL, SHORT_URL_PATH_PREFIX+short.Code, "A short URL for "+short.URL, short.Created)
+	}
+
+	writeAtomFeed(w, r, feed)
+
+}
@@ -0,0 +1,390 @@
+// FIGlet fonts, for the banners of our ASCII art page (see ascii.go). A FIGlet font draws each
+// character as a few lines of ASCII, and banners are laid out the way the figlet command lays
+// them out: characters are either drawn at their full width, moved together until they touch
+// (kerning) or overlapped by a column and merged (smushing), as the font's layout asks for.
+//
+// The fonts in fonts/ come with FIGlet (http://www.figlet.org) and carry their authors' notes
+// in their headers. See http://www.jave.de/figlet/figfont.html for the format.
+
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//go:embed fonts/*.flf
+var figletFontFiles embed.FS
+
+// The layout bits of a font's header. The low six bits are the smushing rules.
+const (
+	FIGLET_SMUSH_EQUAL     = 1   // Equal characters merge into one
+	FIGLET_SMUSH_LOWLINE   = 2   // An underscore is replaced by a bracket, slash or bar
+	FIGLET_SMUSH_HIERARCHY = 4   // Of |, /\, [], {}, () and <>, the later class wins
+	FIGLET_SMUSH_PAIR      = 8   // Opposing brackets become a bar
+	FIGLET_SMUSH_BIG_X     = 16  // /\ becomes |, \/ becomes Y and >< becomes X
+	FIGLET_SMUSH_HARDBLANK = 32  // Two hardblanks merge into one
+	FIGLET_KERN            = 64  // Characters are moved together until they touch
+	FIGLET_SMUSH           = 128 // Characters are overlapped and merged by the rules above
+)
+
+// A parsed FIGlet font
+type figletFont struct {
+	Name      string
+	height    int
+	hardblank rune
+	layout    int
+	glyphs    map[rune][][]rune
+}
+
+// Our fonts, by name
+var figletFonts = map[string]*figletFont{}
+
+// The names of our fonts, in order
+var figletFontNames []string
+
+func init() {
+
+	files, err := figletFontFiles.ReadDir("fonts")
+	if err != nil {
+		panic(err)
+	}
+
+	for _, file := range files {
+		data, err := figletFontFiles.ReadFile("fonts/" + file.Name())
+		if err != nil {
+			panic(err)
+		}
+		name := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
+		font, err := parseFigletFont(name, string(data))
+		if err != nil {
+			panic(fmt.Sprintf("parsing the %s font: %v", name, err))
+		}
+		figletFonts[name] = font
+		figletFontNames = append(figletFontNames, name)
+	}
+
+	slices.Sort(figletFontNames)
+
+}
+
+// Parse a font. Its header is followed by comment lines, the characters from space to tilde,
+// seven German characters (ÄÖÜäöüß) and then any other characters, each of which starts with
+// a line giving its code.
+func parseFigletFont(name string, data string) (*figletFont, error) {
+
+	lines := strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+
+	header := strings.Fields(lines[0])
+	if len(header) < 6 || !strings.HasPrefix(header[0], "flf2a") || len(header[0]) < 6 {
+		return nil, errors.New("not a FIGlet font")
+	}
+
+	numbers := make([]int, len(header)-1)
+	for i, field := range header[1:] {
+		var err error
+		if numbers[i], err = strconv.Atoi(field); err != nil {
+			return nil, fmt.Errorf("the header field %q isn't a number", field)
+		}
+	}
+
+	hardblank, _ := utf8.DecodeRuneInString(header[0][5:])
+	font := &figletFont{Name: name, height: numbers[0], hardblank: hardblank, glyphs: map[rune][][]rune{}}
+
+	// Newer fonts give their full layout, while older ones only have the old layout (where -1
+	// is full width, 0 is kerning and anything else is smushing by those rules)
+	switch oldLayout := numbers[3]; {
+	case len(numbers) >= 7:
+		font.layout = numbers[6]
+	case oldLayout < 0:
+		font.layout = 0
+	case oldLayout == 0:
+		font.layout = FIGLET_KERN
+	default:
+		font.layout = FIGLET_SMUSH | oldLayout
+	}
+
+	if font.height < 1 {
+		return nil, errors.New("the font has no height")
+	}
+
+	lines = lines[1+numbers[4]:]
+
+	// Read the next glyph from our lines. Each line of a glyph ends with an end mark (usually
+	// @), which is doubled on its last line.
+	readGlyph := func() ([][]rune, bool) {
+		if len(lines) < font.height {
+			return nil, false
+		}
+		glyph := make([][]rune, font.height)
+		for i, line := range lines[:font.height] {
+			line = strings.TrimRight(line, " \t")
+			if line != "" {
+				endMark := line[len(line)-1:]
+				line = strings.TrimRight(line, endMark)
+			}
+			glyph[i] = []rune(line)
+		}
+		lines = lines[font.height:]
+		return glyph, true
+	}
+
+	required := []rune{}
+	for character := ' '; character <= '~'; character++ {
+		required = append(required, character)
+	}
+	required = append(required, []rune("ÄÖÜäöüß")...)
+
+	for _, character := range required {
+		glyph, found := readGlyph()
+		if !found {
+			return nil, fmt.Errorf("the font is missing %q", character)
+		}
+		font.glyphs[character] = glyph
+	}
+
+	// Code tagged characters. Negative codes aren't Unicode, so we skip them.
+	for len(lines) > font.height {
+		fields := strings.Fields(lines[0])
+		lines = lines[1:]
+		if len(fields) == 0 {
+			continue
+		}
+		code, err := strconv.ParseInt(fields[0], 0, 32)
+		glyph, found := readGlyph()
+		if !found {
+			break
+		}
+		if err == nil && code >= 0 {
+			font.glyphs[rune(code)] = glyph
+		}
+	}
+
+	return font, nil
+
+}
+
+// Returns how wide a glyph is
+func glyphWidth(glyph [][]rune) int {
+	width := 0
+	for _, row := range glyph {
+		width = max(width, len(row))
+	}
+	return width
+}
+
+// Merge two characters which overlap, by the font's smushing rules. Returns 0 if they can't be
+// merged.
+func (font *figletFont) smush(left, right rune, leftWidth, rightWidth int) rune {
+
+	if left == ' ' {
+		return right
+	}
+	if right == ' ' {
+		return left
+	}
+
+	// Characters which are a column wide (like spaces) are never merged
+	if leftWidth < 2 || rightWidth < 2 || font.layout&FIGLET_SMUSH == 0 {
+		return 0
+	}
+
+	rules := font.layout & 63
+
+	// Without any rules, the right character wins (unless one of them is a hardblank)
+	if rules == 0 {
+		if right == font.hardblank {
+			return left
+		}
+		return right
+	}
+
+	if left == font.hardblank || right == font.hardblank {
+		if rules&FIGLET_SMUSH_HARDBLANK != 0 && left == right {
+			return left
+		}
+		return 0
+	}
+
+	if rules&FIGLET_SMUSH_EQUAL != 0 && left == right {
+		return left
+	}
+
+	if rules&FIGLET_SMUSH_LOWLINE != 0 {
+		if left == '_' && strings.ContainsRune("|/\\[]{}()<>", right) {
+			return right
+		}
+		if right == '_' && strings.ContainsRune("|/\\[]{}()<>", left) {
+			return left
+		}
+	}
+
+	if rules&FIGLET_SMUSH_HIERARCHY != 0 {
+		classes := []string{"|", "/\\", "[]", "{}", "()", "<>"}
+		leftClass := slices.IndexFunc(classes, func(class string) bool { return strings.ContainsRune(class, left) })
+		rightClass := slices.IndexFunc(classes, func(class string) bool { return strings.ContainsRune(class, right) })
+		if leftClass >= 0 && rightClass >= 0 && leftClass != rightClass {
+			if leftClass > rightClass {
+				return left
+			}
+			return right
+		}
+	}
+
+	if rules&FIGLET_SMUSH_PAIR != 0 {
+		switch string([]rune{left, right}) {
+		case "[]", "][", "{}", "}{", "()", ")(":
+			return '|'
+		}
+	}
+
+	if rules&FIGLET_SMUSH_BIG_X != 0 {
+		switch string([]rune{left, right}) {
+		case "/\\":
+			return '|'
+		case "\\/":
+			return 'Y'
+		case "><":
+			return 'X'
+		}
+	}
+
+	return 0
+
+}
+
+// Draw a line of text in the font. Characters the font doesn't have are drawn as question marks.
+func (font *figletFont) render(text string) []string {
+
+	output := make([][]rune, font.height)
+	previousWidth := 0
+
+	for _, character := range text {
+
+		glyph, found := font.glyphs[character]
+		if !found {
+			glyph = font.glyphs['?']
+		}
+		width := glyphWidth(glyph)
+
+		// Work out how far the glyph can move left into what we've drawn so far, which is the
+		// least that any of its rows can
+		overlap := 0
+		if font.layout&(FIGLET_KERN|FIGLET_SMUSH) != 0 {
+			overlap = width
+			for row := range font.height {
+				line, glyphRow := output[row], glyph[row]
+				// The last character drawn on the row, and the glyph's first on its row (where
+				// 0 is nothing at all)
+				lineEdge, glyphEdge := max(len(line)-1, 0), 0
+				for lineEdge > 0 && line[lineEdge] == ' ' {
+					lineEdge--
+				}
+				for glyphEdge < len(glyphRow) && glyphRow[glyphEdge] == ' ' {
+					glyphEdge++
+				}
+				var left, right rune
+				if lineEdge < len(line) {
+					left = line[lineEdge]
+				}
+				if glyphEdge < len(glyphRow) {
+					right = glyphRow[glyphEdge]
+				}
+				amount := glyphEdge + len(line) - 1 - lineEdge
+				if left == 0 || left == ' ' || (right != 0 && font.smush(left, right, previousWidth, width) != 0) {
+					amount++
+				}
+				overlap = min(overlap, amount)
+			}
+		}
+
+		for row := range font.height {
+			line, glyphRow := output[row], glyph[row]
+			// Pad out short rows, so that every row of the glyph lines up
+			glyphRow = append(slices.Clone(glyphRow), []rune(strings.Repeat(" ", width-len(glyphRow)))...)
+			for k := range min(overlap, len(glyphRow)) {
+				column := len(line) - overlap + k
+				if column < 0 {
+					continue
+				}
+				merged := font.smush(line[column], glyphRow[k], previousWidth, width)
+				if merged == 0 {
+					merged = glyphRow[k]
+				}
+				line[column] = merged
+			}
+			output[row] = append(line, glyphRow[min(overlap, len(glyphRow)):]...)
+		}
+
+		previousWidth = width
+
+	}
+
+	lines := make([]string, font.height)
+	for row, line := range output {
+		lines[row] = strings.TrimRight(strings.ReplaceAll(string(line), string(font.hardblank), " "), " ")
+	}
+
+	return lines
+
+}
+
+// Returns how wide the widest line is
+func bannerWidth(lines []string) int {
+	width := 0
+	for _, line := range lines {
+		width = max(width, utf8.RuneCountInString(line))
+	}
+	return width
+}
+
+// Draw a banner of the text, wrapping its words (or if they're too wide on their own, their
+// characters) to keep each line of the banner within the given width
+func (font *figletFont) banner(text string, width int) []string {
+
+	var banner []string
+
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+
+		current := ""
+
+		flush := func() {
+			banner = append(banner, font.render(current)...)
+			current = ""
+		}
+
+		for _, word := range strings.Fields(line) {
+
+			candidate := strings.TrimPrefix(current+" "+word, " ")
+			if bannerWidth(font.render(candidate)) <= width {
+				current = candidate
+				continue
+			}
+
+			if current != "" {
+				flush()
+			}
+
+			// Words too wide for a line on their own are broken between their characters
+			for _, character := range word {
+				if current != "" && bannerWidth(font.render(current+string(character))) > width {
+					flush()
+				}
+				current += string(character)
+			}
+
+		}
+
+		flush()
+
+	}
+
+	return banner
+
+}
@@ -0,0 +1,59 @@
+// Helpers for serving files from disk. Files are served via http.ServeContent, which gives us
+// Accept-Ranges / Content-Range handling (so that interrupted downloads can be resumed and
+// media can be seeked) along with conditional requests based on the file's modification time.
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Serve the file at the given path. If a download name is given, the browser is asked to save
+// the file under that name rather than displaying it.
+func serveFile(w http.ResponseWriter, r *http.Request, path string, downloadName string) {
+
+	file, err := os.Open(path)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		writeError(w, r, notFoundError().WithDetail("opening %s", path))
+		return
+	}
+
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("opening %s", path))
+		return
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("reading the file info of %s", path))
+		return
+	}
+
+	if fileInfo.IsDir() {
+		writeError(w, r, notFoundError().WithDetail("%s is a directory", path))
+		return
+	}
+
+	if downloadName != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": downloadName,
+		}))
+	}
+
+	// ServeContent would sniff the content type of files without a known extension, which we
+	// want to avoid (i.e. so that HTML in a text file is never rendered), so we always set one
+	if w.Header().Get("Content-Type") == "" {
+		setContentType(w, contentTypeFor(path))
+	}
+
+	http.ServeContent(w, r, filepath.Base(path), fileInfo.ModTime(), file)
+
+}
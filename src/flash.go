@@ -0,0 +1,164 @@
+// Flash messages. Once a form has been POSTed, we send the browser on to a page with a GET (so
+// that reloading the page doesn't submit the form again), and tell the visitor how it went with
+// a flash message: a one-off notice shown at the top of the next page we render for them, and
+// then cleared. Flashes are either successes (i.e. "Your message was sent."), errors or info,
+// which are styled to match.
+//
+// The server has no sessions of its own, so a visitor's pending flashes are kept in our flash
+// cookie, signed with our signing keys (see signing.go) so that another site can't have a page
+// of ours show a message of its choosing, and expiring after FLASH_LIFETIME. Like our CSRF
+// cookie, it's strictly necessary, so it doesn't wait for cookie consent (see consent.go).
+//
+// addFlash queues a flash before the redirect, and renderMainTemplate takes the visitor's
+// flashes (clearing our cookie) for the "flashes" partial below to show. Both set a cookie, so
+// they must be called before the response's headers are written: pages responding with a status
+// other than 200 set it as the Status of their HtmlData rather than writing it themselves. Error
+// pages leave the visitor's flashes for the next page.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FLASH_COOKIE_NAME = "flash"
+	FLASH_LIFETIME    = 5 * time.Minute
+	MAX_FLASHES       = 5   // The oldest are dropped beyond this, keeping our cookie small
+	MAX_FLASH_LENGTH  = 300 // In characters, longer messages are cut short
+	FLASH_SUCCESS     = "success"
+	FLASH_ERROR       = "error"
+	FLASH_INFO        = "info"
+)
+
+var flashKinds = []string{FLASH_SUCCESS, FLASH_ERROR, FLASH_INFO}
+
+// A one-off message for the visitor
+type Flash struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// Queue a flash of the given kind for the next page we render for the visitor
+func addFlash(w http.ResponseWriter, r *http.Request, kind string, format string, args ...interface{}) {
+
+	// Our kinds are fixed, so an unknown one is a mistake in our code
+	if !slices.Contains(flashKinds, kind) {
+		panic(fmt.Sprintf("unknown flash kind %q", kind))
+	}
+
+	message := []rune(fmt.Sprintf(format, args...))
+	if len(message) > MAX_FLASH_LENGTH {
+		message = append(message[:MAX_FLASH_LENGTH-1], '…')
+	}
+
+	flashes := append(queuedFlashes(w, r), Flash{Kind: kind, Message: string(message)})
+	if len(flashes) > MAX_FLASHES {
+		flashes = flashes[len(flashes)-MAX_FLASHES:]
+	}
+
+	encoded, _ := json.Marshal(flashes)
+	expires := time.Now().Add(FLASH_LIFETIME).Unix()
+
+	setFlashCookie(w, r, signValue("flash:"+strconv.FormatInt(expires, 10)+":"+string(encoded)), int(FLASH_LIFETIME.Seconds()))
+	incrementCounter("flashes_total", "kind", kind)
+
+}
+
+// Returns the visitor's flashes and clears them, so that they're only shown once
+func takeFlashes(w http.ResponseWriter, r *http.Request) []Flash {
+
+	cookie, err := r.Cookie(FLASH_COOKIE_NAME)
+	if err != nil {
+		return nil
+	}
+
+	setFlashCookie(w, r, "", -1)
+
+	return parseFlashes(cookie.Value)
+
+}
+
+// Returns the flashes queued so far: those this response already queued (for a second call to
+// addFlash), or those the visitor hasn't seen yet
+func queuedFlashes(w http.ResponseWriter, r *http.Request) []Flash {
+
+	var queued []string
+	for _, header := range w.Header().Values("Set-Cookie") {
+		if cookie, err := http.ParseSetCookie(header); err == nil && cookie.Name == FLASH_COOKIE_NAME {
+			queued = append(queued, cookie.Value)
+		}
+	}
+
+	if len(queued) > 0 {
+		// We're about to replace our cookie, so the browser needn't be sent it twice
+		w.Header()["Set-Cookie"] = slices.DeleteFunc(w.Header().Values("Set-Cookie"), func(header string) bool {
+			return strings.HasPrefix(header, FLASH_COOKIE_NAME+"=")
+		})
+		return parseFlashes(queued[len(queued)-1])
+	}
+
+	if cookie, err := r.Cookie(FLASH_COOKIE_NAME); err == nil {
+		return parseFlashes(cookie.Value)
+	}
+
+	return nil
+
+}
+
+// Returns the flashes within the given cookie value, if we signed it and it hasn't expired
+func parseFlashes(signed string) []Flash {
+
+	value, ok := verifySignedValue(signed)
+	if !ok {
+		return nil
+	}
+
+	value, found := strings.CutPrefix(value, "flash:")
+	expiry, encoded, _ := strings.Cut(value, ":")
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	if !found || err != nil || time.Now().Unix() > expires {
+		return nil
+	}
+
+	var flashes []Flash
+	if err := json.Unmarshal([]byte(encoded), &flashes); err != nil {
+		return nil
+	}
+
+	return slices.DeleteFunc(flashes, func(flash Flash) bool {
+		return !slices.Contains(flashKinds, flash.Kind)
+	})
+
+}
+
+// Set our flash cookie to the given value (a negative maxAge clears it)
+func setFlashCookie(w http.ResponseWriter, r *http.Request, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     FLASH_COOKIE_NAME,
+		Value:    value,
+		Path:     urlFor("/"),
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// This is our flash partial, which is rendered at the top of the <body> of our main HTML
+// template. You can find the raw file in the templates folder (flash.tmpl).
+const FLASH_HTML_TEMPLATE = `
+{{ define "flashes" }}
+	{{ with .Flashes }}
+	<div class="flashes" role="status">
+		{{ range . }}<p class="flash flash-{{ .Kind }}">{{ .Message }}</p>{{ end }}
+	</div>
+	{{ end }}
+{{ end }}
+`
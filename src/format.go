@@ -0,0 +1,275 @@
+// Our JSON / YAML formatter. /format (and POST /api/v1/format/{action} for scripts) pretty
+// prints, minifies, validates and converts between JSON and YAML documents on the server (see
+// yaml.go for our YAML support). Invalid documents are reported with the line and column of
+// their error, which the page points out beneath the offending line.
+//
+// JSON documents are validated more strictly than json.Valid does, as duplicate keys are
+// errors in both formats. Minified YAML is written as compact JSON, which is also valid YAML.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const MAX_FORMAT_SIZE = 1 << 20 // The largest document we'll format
+
+// The things we can do with a document
+var formatActions = []string{"pretty", "minify", "validate", "to-json", "to-yaml"}
+
+// The data we pass into our formatter body template
+type formatPageData struct {
+	Document string
+	From     string
+	Action   string
+	Actions  []string
+	Output   string
+	Error    string
+	Snippet  string // The line with the error and a caret beneath its column
+}
+
+// The body content of our formatter page. The values are escaped by html/template.
+const FORMAT_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>JSON / YAML Formatter</h2>
+		<form action="{{ url "/format" }}" method="POST">
+			<textarea name="document" rows=16 cols=80 spellcheck="false" placeholder="Paste a JSON or YAML document">{{ .Document }}</textarea>
+			<p>
+				<select name="from">
+					<option value="json"{{ if eq .From "json" }} selected{{ end }}>JSON</option>
+					<option value="yaml"{{ if eq .From "yaml" }} selected{{ end }}>YAML</option>
+				</select>
+				{{ range .Actions }}
+				<button type="submit" name="action" value="{{ . }}">{{ . }}</button>
+				{{ end }}
+			</p>
+		</form>
+		{{ if .Error }}
+		<h4>Invalid document</h4>
+		<p>{{ .Error }}</p>
+		{{ if .Snippet }}<pre>{{ .Snippet }}</pre>{{ end }}
+		{{ else if .Output }}
+		<h4>{{ .Action }}</h4>
+		<pre>{{ .Output }}</pre>
+		{{ end }}
+	</div>
+`
+
+func init() {
+	registerPage(Page{Title: "Formatter", Path: "/format", Order: 75, Visible: true, Section: SECTION_UTILITIES, Handler: formatHandler,
+		Methods: []string{http.MethodGet, http.MethodPost}})
+}
+
+// Parse the given document in the given format (json or yaml)
+func parseDocument(source string, from string) (any, error) {
+	if from == "yaml" {
+		return parseYAMLDocument(source)
+	}
+	return parseJSONDocument(source)
+}
+
+// Carry out the given action on the given document, returning its output and the format the
+// output is in. Invalid documents return a *documentError.
+func formatDocument(source string, from string, action string) (string, string, error) {
+
+	document, err := parseDocument(source, from)
+	if err != nil {
+		return "", "", err
+	}
+
+	to := from
+	switch action {
+	case "to-json", "minify":
+		to = "json"
+	case "to-yaml":
+		to = "yaml"
+	case "validate":
+		return "", from, nil
+	}
+
+	if to == "yaml" {
+		var output strings.Builder
+		writeYAMLDocument(&output, document)
+		return output.String(), to, nil
+	}
+
+	var compact bytes.Buffer
+	if err := writeJSONDocument(&compact, document); err != nil {
+		return "", "", err
+	}
+
+	if action == "minify" {
+		return compact.String(), to, nil
+	}
+
+	var indented bytes.Buffer
+	json.Indent(&indented, compact.Bytes(), "", "  ")
+
+	return indented.String() + "\n", to, nil
+
+}
+
+// Returns the line of the given source which the given error is on, with a caret beneath its
+// column
+func documentErrorSnippet(source string, err *documentError) string {
+
+	lines := strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n")
+	if err.Line > len(lines) {
+		return ""
+	}
+
+	line := strings.ReplaceAll(lines[err.Line-1], "\t", " ")
+
+	return line + "\n" + strings.Repeat(" ", err.Column-1) + "^"
+
+}
+
+// Returns the format of the given name, or of the given content type if the name is empty
+func documentFormat(name string, contentType string) (string, error) {
+
+	if name == "" {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		if strings.Contains(mediaType, "yaml") {
+			return "yaml", nil
+		}
+		return "json", nil
+	}
+
+	if name != "json" && name != "yaml" {
+		return "", badRequestError(fmt.Sprintf("Unknown format %q, expected json or yaml.", name))
+	}
+
+	return name, nil
+
+}
+
+// This is our formatter handler. GET requests display our form, while POST requests carry out
+// the chosen action on the submitted document and display its output (or error) below it.
+func formatHandler(w http.ResponseWriter, r *http.Request) {
+
+	data := formatPageData{From: "json", Actions: formatActions}
+
+	if r.Method == http.MethodPost {
+
+		r.Body = http.MaxBytesReader(w, r.Body, MAX_FORMAT_SIZE+64<<10)
+
+		if err := r.ParseForm(); err != nil {
+			writeError(w, r, badRequestError("The document is too large to format.").Wrap(err))
+			return
+		}
+
+		from, err := documentFormat(r.PostForm.Get("from"), "")
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		data.Document, data.From, data.Action = r.PostForm.Get("document"), from, r.PostForm.Get("action")
+
+		if !slices.Contains(formatActions, data.Action) {
+			writeError(w, r, badRequestError("Unknown action. Choose one of "+strings.Join(formatActions, ", ")+"."))
+			return
+		}
+
+		endSpan := startSpan(r.Context(), "format: "+data.Action)
+		output, _, err := formatDocument(data.Document, data.From, data.Action)
+		endSpan()
+
+		var documentErr *documentError
+		switch {
+		case errors.As(err, &documentErr):
+			data.Error = documentErr.Error()
+			data.Snippet = documentErrorSnippet(data.Document, documentErr)
+		case err != nil:
+			data.Error = err.Error()
+		case data.Action == "validate":
+			data.Output = "The document is valid " + strings.ToUpper(data.From) + "."
+		default:
+			data.Output = output
+		}
+
+		incrementCounter("documents_formatted_total", "action", data.Action, "valid", fmt.Sprint(err == nil))
+
+	}
+
+	body, err := renderFragment(formatBodyTemplate, data)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the formatter body template"))
+		return
+	}
+
+	renderMainTemplate(w, r, "format", HtmlData{
+		Title:       "Golang JSON / YAML Formatter",
+		Description: "Pretty print, minify, validate and convert JSON and YAML documents.",
+		Keywords:    "golang web server json yaml formatter validator converter",
+		CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+		BodyContent: body,
+	})
+
+}
+
+// This is our formatter API. It carries out the action in the path on the request's body,
+// which is JSON or YAML depending on the from parameter (or the request's content type). The
+// output is returned in its own format, while validate returns a JSON report. Invalid
+// documents are 422 errors which give the error's location.
+func formatAPIHandler(w http.ResponseWriter, r *http.Request) {
+
+	action := r.PathValue("action")
+	if !slices.Contains(formatActions, action) {
+		writeError(w, r, notFoundError())
+		return
+	}
+
+	from, err := documentFormat(r.URL.Query().Get("from"), r.Header.Get("Content-Type"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	source, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_FORMAT_SIZE))
+	if err != nil {
+		writeError(w, r, newAppError(http.StatusRequestEntityTooLarge, "too_large",
+			fmt.Sprintf("Documents may be at most %d bytes.", MAX_FORMAT_SIZE)).Wrap(err))
+		return
+	}
+
+	endSpan := startSpan(r.Context(), "format: "+action)
+	output, to, err := formatDocument(string(source), from, action)
+	endSpan()
+
+	incrementCounter("documents_formatted_total", "action", action, "valid", fmt.Sprint(err == nil))
+
+	var documentErr *documentError
+
+	if action == "validate" {
+		report := map[string]any{"valid": err == nil, "format": from}
+		if errors.As(err, &documentErr) {
+			report["error"] = documentErr
+		}
+		setContentType(w, CONTENT_TYPE_JSON)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+
+	if err != nil {
+		writeError(w, r, newAppError(http.StatusUnprocessableEntity, "invalid_document", err.Error()))
+		return
+	}
+
+	if to == "yaml" {
+		setContentType(w, "application/yaml")
+	} else {
+		setContentType(w, CONTENT_TYPE_JSON)
+	}
+
+	io.WriteString(w, output)
+
+}
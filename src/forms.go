@@ -0,0 +1,325 @@
+// Form handling and validation. Our forms are decoded into structs whose fields are tagged with
+// the name of their form field, a label for our messages and declarative validation rules:
+//
+//	type contactForm struct {
+//		Name  string `form:"name" label:"Your name" validate:"trim,required,max=100,oneline"`
+//		Email string `form:"email" label:"Your email address" validate:"trim,required,email"`
+//	}
+//
+// Form.Decode fills such a struct in from the query string (for GET and HEAD requests), from a
+// URL encoded body, or from the fields of a multipart body (leaving its files alone). Fields
+// which weren't submitted keep their values (apart from checkboxes, which aren't submitted when
+// they're unticked), so defaults can be set beforehand. Each field is then checked against its
+// rules in order, and the first problem with each field is recorded by field name. The rules are:
+//
+//   - trim removes the whitespace around the value (before the rules after it are checked)
+//   - required means the value can't be empty
+//   - min=N and max=N limit the length of the value in characters (or, for numbers, the value)
+//   - oneline means the value can't contain line breaks
+//   - email means the value must be a plain email address (i.e. you@example.com)
+//   - oneof=a|b|c means the value must be one of those given
+//
+// Fields can be strings, string slices (for repeated fields, whose rules apply to each value),
+// booleans (i.e. checkboxes, which are true when they're submitted as anything but "", "off",
+// "false" or "0") and ints. Checks which can't be written as rules (i.e. against a list which is
+// only known at runtime) can be made by implementing formChecker, which is called once the rules
+// have been checked.
+//
+// A Form also carries what a page needs to show the form again: a CSRF token (see csrf.go) and
+// the problems with the values just submitted, which pages show beside each field. The values
+// themselves stay in the struct, so the form is shown with them filled in (and nothing has to
+// be typed in again). POSTed forms are checked with CheckCSRF, which lets through only the
+// requests another site can't forge (see csrfExempt).
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	MAX_FORM_SIZE   = 1 << 20 // The largest form body we decode (forms with files stream them, see uploads.go)
+	FORM_TAG        = "form"
+	FORM_LABEL_TAG  = "label"
+	FORM_RULES_TAG  = "validate"
+	FORM_FILE_FIELD = "file" // The field the problems with a form's files are recorded under
+)
+
+// A form as we render it: its CSRF token, and the problems with the values last submitted to it
+// (by field name)
+type Form struct {
+	CSRFToken string
+	Problems  map[string]string
+
+	// The fields of a submission whose body is streamed rather than parsed (see uploads.go), as
+	// they're read, which our checks use in place of the body
+	streamed url.Values
+}
+
+// Implemented by form structs with checks which can't be written as rules. It's called once
+// the rules have been checked, and records any problems it finds with the form's Problem.
+type formChecker interface {
+	checkForm(form *Form)
+}
+
+// Returns a new form for the page we're rendering, with a CSRF token unless the client is a
+// JSON client. Like csrfToken, it must be called before the response's headers are written.
+func newForm(w http.ResponseWriter, r *http.Request) *Form {
+	form := &Form{Problems: map[string]string{}}
+	if !wantsJSON(r) {
+		form.CSRFToken = csrfToken(w, r)
+	}
+	return form
+}
+
+// Returns the problem with the given field ("" if it's fine)
+func (form *Form) Problem(field string) string {
+	return form.Problems[field]
+}
+
+// Record a problem with the given field, unless it already has one
+func (form *Form) AddProblem(field string, format string, args ...interface{}) {
+	if _, found := form.Problems[field]; !found {
+		form.Problems[field] = fmt.Sprintf(format, args...)
+	}
+}
+
+// Returns whether the values last submitted are free of problems
+func (form *Form) Valid() bool {
+	return len(form.Problems) == 0
+}
+
+// Returns an error if the given submission of our form doesn't carry a valid CSRF token (see
+// csrfExempt for the requests which needn't)
+func (form *Form) CheckCSRF(r *http.Request) error {
+	if form.streamed != nil {
+		return checkCSRF(r, form.streamed.Get(CSRF_FIELD_NAME))
+	}
+	return checkCSRF(r, r.FormValue(CSRF_FIELD_NAME))
+}
+
+// Decode the given submission of our form into the struct pointed to by target and check it,
+// recording its problems. Returns an error if the submission couldn't be read at all.
+func (form *Form) Decode(w http.ResponseWriter, r *http.Request, target interface{}) error {
+
+	values, err := submittedValues(w, r)
+	if err != nil {
+		return err
+	}
+
+	value := reflect.ValueOf(target).Elem()
+
+	for i := range value.NumField() {
+
+		field := value.Type().Field(i)
+		name := field.Tag.Get(FORM_TAG)
+		if name == "" {
+			continue
+		}
+
+		label := cmp.Or(field.Tag.Get(FORM_LABEL_TAG), capitalise(name))
+		rules := strings.Split(field.Tag.Get(FORM_RULES_TAG), ",")
+		submitted, found := values[name]
+
+		if problem := decodeFormField(value.Field(i), submitted, found, rules, label); problem != "" {
+			form.AddProblem(name, "%s", problem)
+		}
+
+	}
+
+	if checker, ok := target.(formChecker); ok {
+		checker.checkForm(form)
+	}
+
+	return nil
+
+}
+
+// Returns the values submitted to our form: the query string for GET and HEAD requests, and the
+// fields of the body otherwise
+func submittedValues(w http.ResponseWriter, r *http.Request) (url.Values, error) {
+
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return r.URL.Query(), nil
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_FORM_SIZE)
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(MAX_FORM_SIZE); err != nil {
+			return nil, badRequestError("The form couldn't be read.").Wrap(err)
+		}
+		defer r.MultipartForm.RemoveAll()
+		return r.MultipartForm.Value, nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, badRequestError("The form couldn't be read.").Wrap(err)
+	}
+
+	return r.PostForm, nil
+
+}
+
+// Set the given struct field from its submitted values and check it against its rules,
+// returning the first problem with it
+func decodeFormField(field reflect.Value, submitted []string, found bool, rules []string, label string) string {
+
+	switch field.Kind() {
+
+	case reflect.String:
+		if found {
+			field.SetString(submitted[0])
+		}
+		text := field.String()
+		problem := checkFormValue(&text, rules, label)
+		field.SetString(text)
+		return problem
+
+	case reflect.Slice:
+		if found {
+			field.Set(reflect.ValueOf(slices.Clone(submitted)))
+		}
+		for j := range field.Len() {
+			text := field.Index(j).String()
+			problem := checkFormValue(&text, rules, label)
+			field.Index(j).SetString(text)
+			if problem != "" {
+				return problem
+			}
+		}
+		return ""
+
+	case reflect.Bool:
+		// Unticked checkboxes aren't submitted at all
+		field.SetBool(found && !slices.Contains([]string{"", "off", "false", "0"}, strings.ToLower(submitted[0])))
+		return ""
+
+	case reflect.Int:
+		if found && strings.TrimSpace(submitted[0]) != "" {
+			number, err := strconv.Atoi(strings.TrimSpace(submitted[0]))
+			if err != nil {
+				return label + " must be a whole number."
+			}
+			field.SetInt(int64(number))
+		}
+		return checkFormNumber(int(field.Int()), rules, label)
+
+	}
+
+	panic(fmt.Sprintf("form fields can't be of type %s", field.Type()))
+
+}
+
+// Check the given text against the given rules, returning the first problem with it. The text
+// is trimmed in place by the trim rule.
+func checkFormValue(text *string, rules []string, label string) string {
+
+	minimum, maximum := formRuleLimit(rules, "min"), formRuleLimit(rules, "max")
+	length := utf8.RuneCountInString(*text)
+
+	for _, rule := range rules {
+
+		name, argument, _ := strings.Cut(rule, "=")
+
+		switch name {
+		case "trim":
+			*text = strings.TrimSpace(*text)
+			length = utf8.RuneCountInString(*text)
+		case "required":
+			if *text == "" {
+				return "Please enter " + lowerFirst(label) + "."
+			}
+		case "min", "max":
+			// Empty values are only checked by required
+			if *text != "" && (minimum >= 0 && length < minimum || maximum >= 0 && length > maximum) {
+				switch {
+				case minimum >= 0 && maximum >= 0:
+					return fmt.Sprintf("%s must be between %d and %d characters long.", label, minimum, maximum)
+				case minimum >= 0:
+					return fmt.Sprintf("%s must be at least %d characters long.", label, minimum)
+				default:
+					return fmt.Sprintf("%s can be at most %d characters long.", label, maximum)
+				}
+			}
+		case "oneline":
+			if strings.ContainsAny(*text, "\r\n") {
+				return label + " must be on one line."
+			}
+		case "email":
+			if address, err := mail.ParseAddress(*text); *text != "" && (err != nil || address.Address != *text) {
+				return "Please enter a valid email address (i.e. you@example.com)."
+			}
+		case "oneof":
+			if *text != "" && !slices.Contains(strings.Split(argument, "|"), *text) {
+				return fmt.Sprintf("%s must be one of %s.", label, strings.ReplaceAll(argument, "|", ", "))
+			}
+		case "":
+		default:
+			panic(fmt.Sprintf("unknown form rule %q", rule))
+		}
+
+	}
+
+	return ""
+
+}
+
+// Check the given number against the min and max of the given rules
+func checkFormNumber(number int, rules []string, label string) string {
+
+	minimum, maximum := formRuleLimit(rules, "min"), formRuleLimit(rules, "max")
+
+	switch {
+	case minimum >= 0 && number < minimum || maximum >= 0 && number > maximum:
+		if minimum >= 0 && maximum >= 0 {
+			return fmt.Sprintf("%s must be between %d and %d.", label, minimum, maximum)
+		} else if minimum >= 0 {
+			return fmt.Sprintf("%s must be at least %d.", label, minimum)
+		}
+		return fmt.Sprintf("%s can be at most %d.", label, maximum)
+	}
+
+	return ""
+
+}
+
+// Returns the argument of the given limit rule (i.e. 100 for max=100), or -1 if there isn't one
+func formRuleLimit(rules []string, name string) int {
+	for _, rule := range rules {
+		if argument, found := strings.CutPrefix(rule, name+"="); found {
+			limit, err := strconv.Atoi(argument)
+			if err != nil {
+				panic(fmt.Sprintf("invalid form rule %q", rule))
+			}
+			return limit
+		}
+	}
+	return -1
+}
+
+// Returns the given text with its first letter in lower case (i.e. "Your name" becomes "your
+// name", for the middle of a sentence)
+func lowerFirst(text string) string {
+	first, size := utf8.DecodeRuneInString(text)
+	return string(unicode.ToLower(first)) + text[size:]
+}
+
+// Respond to a JSON client with the problems with its submission of our form
+func writeFormProblems(w http.ResponseWriter, form *Form) {
+	setContentType(w, CONTENT_TYPE_JSON)
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{"problems": form.Problems})
+}
@@ -0,0 +1,497 @@
+// Geo-IP lookups and geo blocking. Given a MaxMind format database (i.e. GeoLite2-Country.mmdb
+// or GeoLite2-City.mmdb) via -geoip-db, we look up the country (and, with a city database, the
+// region) of each request's client, add them to its access log line (as country= and region=
+// fields, see tags.go) and count requests by them in the http_requests_by_country_total metric.
+//
+// -geo-allow and -geo-deny take comma separated ISO country codes (i.e. -geo-deny KP,IR) to serve
+// only the countries allowed, or to refuse those denied, with a 403. Clients whose country we
+// can't tell (i.e. private addresses, such as our health checks) are always served, as are the
+// addresses on the allow list of our access rules (see accessrules.go).
+//
+// The database is checked for changes every GEOIP_CHECK_INTERVAL and reloaded when it changes
+// (i.e. when geoipupdate replaces it), without a restart. A database which doesn't load is logged
+// as an error and leaves the one we have in place.
+//
+// The database format is read here with the standard library: a binary search tree over the bits
+// of an address, whose leaves point into a data section of typed values (see
+// https://maxmind.github.io/MaxMind-DB/).
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	GEOIP_CHECK_INTERVAL = 30 * time.Second
+	MMDB_MAX_DEPTH       = 32 // How deeply we follow nested values
+)
+
+// The marker which starts the metadata of a MaxMind database
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// The location of an address, as far as our database knows it
+type geoLocation struct {
+	Country string // The ISO 3166-1 code of the country, i.e. GB
+	Region  string // The ISO 3166-2 code of the region, i.e. GB-SCT (only in city databases)
+}
+
+// A MaxMind database loaded into memory
+type mmdbReader struct {
+	data         []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	databaseType string
+	dataStart    uint // Where the data section starts
+	ipv4Start    uint // The node IPv4 addresses start from (in IPv6 databases)
+}
+
+// Our database, along with when its file was last modified and loaded, and our country rules
+var geoIP = struct {
+	mutex    sync.RWMutex
+	reader   *mmdbReader
+	modified time.Time
+	loaded   time.Time
+	allow    map[string]bool
+	deny     map[string]bool
+}{}
+
+// Parse a MaxMind database
+func newMMDBReader(data []byte) (*mmdbReader, error) {
+
+	markerAt := bytes.LastIndex(data, mmdbMetadataMarker)
+	if markerAt < 0 {
+		return nil, errors.New("this isn't a MaxMind database (it has no metadata)")
+	}
+
+	metadataStart := uint(markerAt + len(mmdbMetadataMarker))
+	value, _, err := decodeMMDBValue(data[metadataStart:], 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("reading the metadata: %w", err)
+	}
+	metadata, ok := value.(map[string]any)
+	if !ok {
+		return nil, errors.New("the metadata isn't a map")
+	}
+
+	reader := &mmdbReader{data: data}
+	reader.nodeCount, _ = mmdbUint(metadata["node_count"])
+	reader.recordSize, _ = mmdbUint(metadata["record_size"])
+	reader.ipVersion, _ = mmdbUint(metadata["ip_version"])
+	reader.databaseType, _ = metadata["database_type"].(string)
+
+	if reader.recordSize != 24 && reader.recordSize != 28 && reader.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", reader.recordSize)
+	}
+	if reader.ipVersion != 4 && reader.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", reader.ipVersion)
+	}
+
+	treeSize := reader.nodeCount * reader.recordSize / 4
+	reader.dataStart = treeSize + 16
+	if reader.dataStart > uint(markerAt) {
+		return nil, errors.New("the search tree is larger than the database")
+	}
+
+	// IPv4 addresses live under 96 zero bits of an IPv6 tree
+	if reader.ipVersion == 6 {
+		for range 96 {
+			if reader.ipv4Start >= reader.nodeCount {
+				break
+			}
+			reader.ipv4Start = reader.record(reader.ipv4Start, 0)
+		}
+	}
+
+	return reader, nil
+
+}
+
+// Returns the left (0) or right (1) record of the given node
+func (reader *mmdbReader) record(node uint, bit uint) uint {
+
+	offset := node * reader.recordSize / 4
+	b := reader.data[offset : offset+reader.recordSize/4]
+
+	switch reader.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	return uint(binary.BigEndian.Uint32(b[bit*4:]))
+
+}
+
+// Returns the data the database holds for the given address (nil if it has none)
+func (reader *mmdbReader) lookup(address netip.Addr) (any, error) {
+
+	address = address.Unmap()
+
+	node, bits := uint(0), address.AsSlice()
+	if address.Is4() && reader.ipVersion == 6 {
+		node = reader.ipv4Start
+	} else if address.Is6() && reader.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(bits)*8 && node < reader.nodeCount; i++ {
+		node = reader.record(node, uint(bits[i/8]>>(7-i%8)&1))
+	}
+
+	switch {
+	case node == reader.nodeCount:
+		return nil, nil
+	case node < reader.nodeCount:
+		return nil, errors.New("the search tree is deeper than the address")
+	}
+
+	// Records point past the 16 byte separator after the search tree into the data section
+	if node < reader.nodeCount+16 {
+		return nil, errors.New("the search tree points into the data section separator")
+	}
+
+	offset := node - reader.nodeCount - 16
+	if offset >= uint(len(reader.data))-reader.dataStart {
+		return nil, errors.New("the search tree points beyond the data")
+	}
+
+	value, _, err := decodeMMDBValue(reader.data[reader.dataStart:], offset, 0)
+	return value, err
+
+}
+
+// Returns the location of the given address
+func (reader *mmdbReader) location(address netip.Addr) (geoLocation, error) {
+
+	value, err := reader.lookup(address)
+	if err != nil || value == nil {
+		return geoLocation{}, err
+	}
+
+	record, _ := value.(map[string]any)
+	isoCode := func(value any) string {
+		entry, _ := value.(map[string]any)
+		code, _ := entry["iso_code"].(string)
+		return code
+	}
+
+	location := geoLocation{Country: isoCode(record["country"])}
+	if location.Country == "" {
+		location.Country = isoCode(record["registered_country"])
+	}
+	if subdivisions, _ := record["subdivisions"].([]any); len(subdivisions) > 0 && location.Country != "" {
+		if region := isoCode(subdivisions[0]); region != "" {
+			location.Region = location.Country + "-" + region
+		}
+	}
+
+	return location, nil
+
+}
+
+// Decode the value at the given offset of the given data section, returning it along with the
+// offset of the value after it
+func decodeMMDBValue(section []byte, offset uint, depth int) (any, uint, error) {
+
+	if depth > MMDB_MAX_DEPTH {
+		return nil, 0, errors.New("the data is nested too deeply")
+	}
+
+	read := func(n uint) ([]byte, error) {
+		if offset+n > uint(len(section)) {
+			return nil, errors.New("the data ends early")
+		}
+		b := section[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+
+	control, err := read(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	kind, size := uint(control[0]>>5), uint(control[0]&0x1f)
+
+	// Pointers point at a value elsewhere in the section
+	if kind == 1 {
+		extra, err := read(uint(size>>3) + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		pointer := uint(0)
+		if len(extra) < 4 {
+			pointer = size & 0x07
+		}
+		for _, b := range extra {
+			pointer = pointer<<8 | uint(b)
+		}
+		pointer += [4]uint{0, 2048, 526336, 0}[len(extra)-1]
+		value, _, err := decodeMMDBValue(section, pointer, depth+1)
+		return value, offset, err
+	}
+
+	// Extended types are numbered from 8 in the byte after the control byte
+	if kind == 0 {
+		extended, err := read(1)
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + uint(extended[0])
+	}
+
+	if size >= 29 {
+		extra, err := read(size - 28)
+		if err != nil {
+			return nil, 0, err
+		}
+		n := uint(0)
+		for _, b := range extra {
+			n = n<<8 | uint(b)
+		}
+		size = [3]uint{29, 285, 65821}[len(extra)-1] + n
+	}
+
+	switch kind {
+	case 7: // Map
+		entries := make(map[string]any, min(size, 64))
+		for range size {
+			var key, value any
+			if key, offset, err = decodeMMDBValue(section, offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			if value, offset, err = decodeMMDBValue(section, offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("a map key isn't a string")
+			}
+			entries[name] = value
+		}
+		return entries, offset, nil
+
+	case 11: // Array
+		values := make([]any, 0, min(size, 64))
+		for range size {
+			var value any
+			if value, offset, err = decodeMMDBValue(section, offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			values = append(values, value)
+		}
+		return values, offset, nil
+
+	case 14: // Boolean, whose value is its size
+		return size != 0, offset, nil
+	}
+
+	payload, err := read(size)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch kind {
+	case 2: // UTF-8 string
+		return string(payload), offset, nil
+	case 3: // Double
+		if size != 8 {
+			return nil, 0, errors.New("a double isn't 8 bytes")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(payload)), offset, nil
+	case 4: // Bytes
+		return bytes.Clone(payload), offset, nil
+	case 5, 6, 9, 10: // Unsigned integers of 16, 32, 64 and 128 bits (we keep up to 64)
+		n := uint64(0)
+		for _, b := range payload {
+			n = n<<8 | uint64(b)
+		}
+		return n, offset, nil
+	case 8: // Signed 32 bit integer
+		n := uint32(0)
+		for _, b := range payload {
+			n = n<<8 | uint32(b)
+		}
+		return int64(int32(n)), offset, nil
+	case 15: // Float
+		if size != 4 {
+			return nil, 0, errors.New("a float isn't 4 bytes")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(payload))), offset, nil
+	}
+
+	return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+
+}
+
+// Returns the given decoded value as an unsigned integer
+func mmdbUint(value any) (uint, bool) {
+	n, ok := value.(uint64)
+	return uint(n), ok
+}
+
+// Returns the given comma separated country codes as a set (nil if there are none)
+func parseCountryCodes(list string) (map[string]bool, error) {
+
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+
+	codes := map[string]bool{}
+	for code := range strings.SplitSeq(list, ",") {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if len(code) != 2 || strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return nil, fmt.Errorf("%q isn't a two letter country code", code)
+		}
+		codes[code] = true
+	}
+
+	return codes, nil
+
+}
+
+// Load (or reload) our database from the given file
+func loadGeoIPDatabase(path string) error {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	reader, err := newMMDBReader(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	geoIP.mutex.Lock()
+	geoIP.reader, geoIP.modified, geoIP.loaded = reader, info.ModTime(), time.Now().UTC()
+	geoIP.mutex.Unlock()
+
+	logger.Printf("Loaded the %s geo-IP database from %s (%d nodes)", reader.databaseType, path, reader.nodeCount)
+	return nil
+
+}
+
+// Returns a component which loads our database from the given file, and reloads it whenever it
+// changes (see components.go)
+func newGeoIPComponent(path string, allow string, deny string) Component {
+
+	watcher := newTickerComponent(GEOIP_CHECK_INTERVAL, func(now time.Time) {
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return
+		}
+
+		geoIP.mutex.RLock()
+		changed := !info.ModTime().Equal(geoIP.modified)
+		geoIP.mutex.RUnlock()
+
+		if changed {
+			if err := loadGeoIPDatabase(path); err != nil {
+				incrementCounter("geoip_reload_failures_total")
+				logger.Println("ERROR reloading the geo-IP database, keeping the current one:", err)
+			}
+		}
+
+	})
+
+	return componentFuncs{
+		start: func(ctx context.Context) error {
+			allowed, err := parseCountryCodes(allow)
+			if err != nil {
+				return fmt.Errorf("invalid -geo-allow: %w", err)
+			}
+			denied, err := parseCountryCodes(deny)
+			if err != nil {
+				return fmt.Errorf("invalid -geo-deny: %w", err)
+			}
+			geoIP.mutex.Lock()
+			geoIP.allow, geoIP.deny = allowed, denied
+			geoIP.mutex.Unlock()
+			if err := loadGeoIPDatabase(path); err != nil {
+				return fmt.Errorf("invalid -geoip-db: %w", err)
+			}
+			return watcher.Start(ctx)
+		},
+		stop: watcher.Stop,
+	}
+
+}
+
+// Returns the location of the given client address (empty if we don't know it), and whether our
+// country rules refuse it
+func locateClient(client string) (geoLocation, bool) {
+
+	address, err := netip.ParseAddr(client)
+	if err != nil {
+		return geoLocation{}, false
+	}
+
+	geoIP.mutex.RLock()
+	defer geoIP.mutex.RUnlock()
+
+	if geoIP.reader == nil {
+		return geoLocation{}, false
+	}
+
+	location, err := geoIP.reader.location(address)
+	if err != nil || location.Country == "" {
+		return geoLocation{}, false
+	}
+
+	blocked := geoIP.deny[location.Country] || geoIP.allow != nil && !geoIP.allow[location.Country]
+	return location, blocked
+
+}
+
+// Returns a handler which adds the location of each request's client to its log line and our
+// metrics, and refuses the clients of the countries our rules block
+func geoIPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		client := clientAddress(r)
+		location, blocked := locateClient(client)
+
+		if location.Country == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		addLogField(r.Context(), "country", location.Country)
+		if location.Region != "" {
+			addLogField(r.Context(), "region", location.Region)
+		}
+		incrementCounter("http_requests_by_country_total", "country", location.Country, "region", location.Region)
+
+		if blocked && !clientAllowed(client) {
+			incrementCounter("geo_blocked_requests_total", "country", location.Country)
+			writeError(w, r, newAppError(http.StatusForbidden, "geo_blocked", "This site isn't available in your country."))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+
+	})
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+func TestMMDBLookupChecksRecords(t *testing.T) {
+
+	// A single node whose left record points into the separator after the search tree, and
+	// whose right record points past the end of the data
+	data := make([]byte, 8+16+4)
+	binary.BigEndian.PutUint32(data[0:], 1+5)
+	binary.BigEndian.PutUint32(data[4:], 1+16+100)
+	reader := &mmdbReader{data: data, nodeCount: 1, recordSize: 32, ipVersion: 4, dataStart: 8 + 16}
+
+	for _, address := range []string{"1.2.3.4", "200.1.2.3"} {
+		if value, err := reader.lookup(netip.MustParseAddr(address)); err == nil {
+			t.Errorf("got %v for %s, want an error", value, address)
+		}
+	}
+
+}
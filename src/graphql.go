@@ -0,0 +1,591 @@
+// Our GraphQL API. /api/graphql exposes the server's demo data (its status, pages, routes,
+// uploads and request traces, along with todo items, pastes and short URLs, see graphqldata.go)
+// through a single schema, using the engine in graphqlexec.go.
+// Queries can be sent as GET requests (?query=...&variables=...) or as JSON POST requests
+// ({"query": ..., "variables": ..., "operationName": ...}), while mutations must be POSTed. POSTs
+// must be sent as application/json, which a browser won't send to us for another site without a
+// CORS preflight, so other sites can't have an admin's browser run our mutations. In -dev mode,
+// a GraphiQL playground for exploring the API is served at /graphiql.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The largest GraphQL request body we'll accept
+const MAX_GRAPHQL_REQUEST_SIZE = 1 << 20
+
+// When our server started, which we report in our status
+var serverStarted = time.Now()
+
+// Our GraphQL schema (see newDemoGraphQLSchema)
+var demoSchema = newDemoGraphQLSchema()
+
+// The error returned by fields which only admins can query
+var errGraphQLAdminOnly = errors.New("Only admins can access this field.")
+
+// A GraphQL request
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// A GraphQL response. Data is left out entirely when the request couldn't be executed.
+type graphQLResponse struct {
+	Data   interface{}     `json:"data,omitempty"`
+	Errors []*graphQLError `json:"errors,omitempty"`
+}
+
+// Build our schema
+func newDemoGraphQLSchema() *graphQLSchema {
+
+	schema := newGraphQLSchema("Query", "Mutation")
+
+	adminOnlyField := func(resolve graphQLResolver) graphQLResolver {
+		return func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+			if !graphQLAdminRequest(r) {
+				return nil, errGraphQLAdminOnly
+			}
+			return resolve(r, source, args)
+		}
+	}
+
+	milliseconds := func(duration time.Duration) float64 {
+		return float64(duration) / float64(time.Millisecond)
+	}
+
+	schema.addType(&graphQLType{name: "Query", kind: "OBJECT", fields: []*graphQLField{
+		{
+			name:        "status",
+			description: "The current status of the server.",
+			typeRef:     "Status!",
+			resolve: func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				return struct{}{}, nil
+			},
+		},
+		{
+			name:        "pages",
+			description: "The (enabled) demo pages served by the server.",
+			typeRef:     "[Page!]!",
+			resolve: func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				var pages []Page
+				for _, page := range pageRegistry {
+					if pageEnabled(page) {
+						pages = append(pages, page)
+					}
+				}
+				return pages, nil
+			},
+		},
+		{
+			name:        "routes",
+			description: "All of the routes registered with the server.",
+			typeRef:     "[Route!]!",
+			resolve: func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				return routeRegistry, nil
+			},
+		},
+		{
+			name:        "uploads",
+			description: "The uploaded files, most recent first (admins only).",
+			typeRef:     "[Upload!]!",
+			resolve: adminOnlyField(func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				files, err := listUploads()
+				return files, err
+			}),
+		},
+		{
+			name:        "trace",
+			description: "The timing breakdown of a recent request (admins only).",
+			typeRef:     "Trace",
+			args:        []graphQLArgument{{name: "id", description: "The request ID.", typeRef: "ID!"}},
+			resolve: adminOnlyField(func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				id, _ := args["id"].(string)
+				return traces.get(id), nil
+			}),
+		},
+		{
+			name:        "todos",
+			description: "The todo items, oldest first.",
+			typeRef:     "[Todo!]!",
+			resolve: func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				graphQLData.mutex.Lock()
+				defer graphQLData.mutex.Unlock()
+				return slices.Clone(graphQLData.todos), nil
+			},
+		},
+		{
+			name:        "pastes",
+			description: "The pastes, most recent first.",
+			typeRef:     "[Paste!]!",
+			resolve: func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				graphQLData.mutex.Lock()
+				defer graphQLData.mutex.Unlock()
+				return newestFirst(graphQLData.pastes), nil
+			},
+		},
+		{
+			name:        "paste",
+			description: "A paste.",
+			typeRef:     "Paste",
+			args:        []graphQLArgument{{name: "id", description: "The paste's ID.", typeRef: "ID!"}},
+			resolve: func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				id, _ := args["id"].(string)
+				if paste, ok := findPaste(id); ok {
+					return paste, nil
+				}
+				return nil, nil
+			},
+		},
+		{
+			name:        "shortUrls",
+			description: "The short URLs, most recent first.",
+			typeRef:     "[ShortUrl!]!",
+			resolve: func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				graphQLData.mutex.Lock()
+				defer graphQLData.mutex.Unlock()
+				return newestFirst(graphQLData.shortURLs), nil
+			},
+		},
+		{
+			name:        "shortUrl",
+			description: "A short URL.",
+			typeRef:     "ShortUrl",
+			args:        []graphQLArgument{{name: "code", description: "The short URL's code.", typeRef: "String!"}},
+			resolve: func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				code, _ := args["code"].(string)
+				if short, ok := findShortURL(code, false); ok {
+					return short, nil
+				}
+				return nil, nil
+			},
+		},
+	}})
+
+	schema.addType(&graphQLType{name: "Mutation", kind: "OBJECT", fields: []*graphQLField{
+		{
+			name:        "addTodo",
+			description: "Add a todo item.",
+			typeRef:     "Todo!",
+			args:        []graphQLArgument{{name: "title", description: "What needs doing.", typeRef: "String!"}},
+			resolve: func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				title, _ := args["title"].(string)
+				return addTodo(r, title)
+			},
+		},
+		{
+			name:        "setTodoDone",
+			description: "Tick off (or untick) a todo item.",
+			typeRef:     "Todo!",
+			args: []graphQLArgument{
+				{name: "id", description: "The todo item's ID.", typeRef: "ID!"},
+				{name: "done", description: "Whether it's done.", typeRef: "Boolean!"},
+			},
+			resolve: func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				id, _ := args["id"].(string)
+				done, _ := args["done"].(bool)
+				return setTodoDone(id, done)
+			},
+		},
+		{
+			name:        "deleteTodo",
+			description: "Delete a todo item.",
+			typeRef:     "Boolean!",
+			args:        []graphQLArgument{{name: "id", description: "The todo item's ID.", typeRef: "ID!"}},
+			resolve: func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				id, _ := args["id"].(string)
+				if !deleteTodo(id) {
+					return nil, errGraphQLNotFound
+				}
+				return true, nil
+			},
+		},
+		{
+			name:        "createPaste",
+			description: "Share a piece of text.",
+			typeRef:     "Paste!",
+			args: []graphQLArgument{
+				{name: "content", description: "The text.", typeRef: "String!"},
+				{name: "title", description: "An optional title.", typeRef: "String"},
+			},
+			resolve: func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				content, _ := args["content"].(string)
+				title, _ := args["title"].(string)
+				return createPaste(r, title, content)
+			},
+		},
+		{
+			name:        "deletePaste",
+			description: "Delete a paste (admins only).",
+			typeRef:     "Boolean!",
+			args:        []graphQLArgument{{name: "id", description: "The paste's ID.", typeRef: "ID!"}},
+			resolve: adminOnlyField(func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				id, _ := args["id"].(string)
+				if !deletePaste(id) {
+					return nil, errGraphQLNotFound
+				}
+				return true, nil
+			}),
+		},
+		{
+			name:        "createShortUrl",
+			description: "Shorten a URL, which then redirects from /s/{code} (admins only).",
+			typeRef:     "ShortUrl!",
+			args:        []graphQLArgument{{name: "url", description: "An absolute http or https URL.", typeRef: "String!"}},
+			resolve: adminOnlyField(func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				target, _ := args["url"].(string)
+				return createShortURL(r, target)
+			}),
+		},
+		{
+			name:        "deleteShortUrl",
+			description: "Delete a short URL (admins only).",
+			typeRef:     "Boolean!",
+			args:        []graphQLArgument{{name: "code", description: "The short URL's code.", typeRef: "String!"}},
+			resolve: adminOnlyField(func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				code, _ := args["code"].(string)
+				if !deleteShortURL(code) {
+					return nil, errGraphQLNotFound
+				}
+				return true, nil
+			}),
+		},
+		{
+			name:        "deleteUpload",
+			description: "Delete an uploaded file (admins only).",
+			typeRef:     "Boolean!",
+			args:        []graphQLArgument{{name: "name", description: "The name of the file.", typeRef: "String!"}},
+			resolve: adminOnlyField(func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				requested, _ := args["name"].(string)
+				name := sanitiseFileName(requested)
+				if name == "" {
+					return nil, fmt.Errorf("%q is not a valid file name.", requested)
+				}
+				err := os.Remove(filepath.Join(uploadDir, name))
+				if errors.Is(err, os.ErrNotExist) {
+					return nil, fmt.Errorf("There is no upload named %q.", name)
+				}
+				if err != nil {
+					logger.Println("ERROR deleting upload", name, err)
+					return nil, errors.New("The upload could not be deleted.")
+				}
+				logger.Println("Deleted upload", name)
+				return true, nil
+			}),
+		},
+	}})
+
+	schema.addType(&graphQLType{name: "Status", kind: "OBJECT", fields: []*graphQLField{
+		{name: "healthy", typeRef: "Boolean!", resolve: graphQLProperty(func(struct{}) interface{} {
+			return atomic.LoadInt32(&healthy) == 1
+		})},
+		{name: "startedAt", typeRef: "String!", resolve: graphQLProperty(func(struct{}) interface{} {
+			return serverStarted.UTC().Format(time.RFC3339)
+		})},
+		{name: "uptimeSeconds", typeRef: "Float!", resolve: graphQLProperty(func(struct{}) interface{} {
+			return time.Since(serverStarted).Seconds()
+		})},
+		{name: "goVersion", typeRef: "String!", resolve: graphQLProperty(func(struct{}) interface{} {
+			return runtime.Version()
+		})},
+		{name: "goroutines", typeRef: "Int!", resolve: graphQLProperty(func(struct{}) interface{} {
+			return runtime.NumGoroutine()
+		})},
+	}})
+
+	schema.addType(&graphQLType{name: "Page", kind: "OBJECT", fields: []*graphQLField{
+		{name: "title", typeRef: "String!", resolve: graphQLProperty(func(page Page) interface{} { return page.Title })},
+		{name: "path", typeRef: "String!", resolve: graphQLProperty(func(page Page) interface{} { return page.Path })},
+		{name: "url", typeRef: "String!", resolve: graphQLProperty(func(page Page) interface{} { return urlFor(page.Path) })},
+		{name: "visible", typeRef: "Boolean!", resolve: graphQLProperty(func(page Page) interface{} { return page.Visible })},
+	}})
+
+	schema.addType(&graphQLType{name: "Route", kind: "OBJECT", fields: []*graphQLField{
+		{name: "pattern", typeRef: "String!", resolve: graphQLProperty(func(route Route) interface{} { return route.Pattern })},
+		{name: "methods", typeRef: "[String!]!", resolve: graphQLProperty(func(route Route) interface{} { return route.Methods })},
+	}})
+
+	schema.addType(&graphQLType{name: "Upload", kind: "OBJECT", fields: []*graphQLField{
+		{name: "name", typeRef: "String!", resolve: graphQLProperty(func(upload uploadedFile) interface{} { return upload.Name })},
+		{name: "size", typeRef: "Float!", description: "The size of the file in bytes.",
+			resolve: graphQLProperty(func(upload uploadedFile) interface{} { return upload.Size })},
+		{name: "modified", typeRef: "String!", resolve: graphQLProperty(func(upload uploadedFile) interface{} {
+			return upload.Modified.UTC().Format(time.RFC3339)
+		})},
+	}})
+
+	schema.addType(&graphQLType{name: "Todo", kind: "OBJECT", fields: []*graphQLField{
+		{name: "id", typeRef: "ID!", resolve: graphQLProperty(func(todo todoItem) interface{} { return todo.ID })},
+		{name: "title", typeRef: "String!", resolve: graphQLProperty(func(todo todoItem) interface{} { return todo.Title })},
+		{name: "done", typeRef: "Boolean!", resolve: graphQLProperty(func(todo todoItem) interface{} { return todo.Done })},
+		{name: "created", typeRef: "String!", resolve: graphQLProperty(func(todo todoItem) interface{} {
+			return todo.Created.Format(time.RFC3339)
+		})},
+	}})
+
+	schema.addType(&graphQLType{name: "Paste", kind: "OBJECT", fields: []*graphQLField{
+		{name: "id", typeRef: "ID!", resolve: graphQLProperty(func(paste paste) interface{} { return paste.ID })},
+		{name: "title", typeRef: "String", resolve: graphQLProperty(func(paste paste) interface{} {
+			if paste.Title == "" {
+				return nil
+			}
+			return paste.Title
+		})},
+		{name: "content", typeRef: "String!", resolve: graphQLProperty(func(paste paste) interface{} { return paste.Content })},
+		{name: "created", typeRef: "String!", resolve: graphQLProperty(func(paste paste) interface{} {
+			return paste.Created.Format(time.RFC3339)
+		})},
+	}})
+
+	schema.addType(&graphQLType{name: "ShortUrl", kind: "OBJECT", fields: []*graphQLField{
+		{name: "code", typeRef: "String!", resolve: graphQLProperty(func(short shortURL) interface{} { return short.Code })},
+		{name: "url", typeRef: "String!", description: "The URL the short URL redirects to.",
+			resolve: graphQLProperty(func(short shortURL) interface{} { return short.URL })},
+		{name: "shortUrl", typeRef: "String!", description: "The short URL itself.",
+			resolve: func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				return siteBaseURL(r) + urlFor(SHORT_URL_PATH_PREFIX+source.(shortURL).Code), nil
+			}},
+		{name: "visits", typeRef: "Int!", resolve: graphQLProperty(func(short shortURL) interface{} { return short.Visits })},
+		{name: "created", typeRef: "String!", resolve: graphQLProperty(func(short shortURL) interface{} {
+			return short.Created.Format(time.RFC3339)
+		})},
+	}})
+
+	schema.addType(&graphQLType{name: "Trace", kind: "OBJECT", fields: []*graphQLField{
+		{name: "requestId", typeRef: "ID!", resolve: graphQLProperty(func(trace *requestTrace) interface{} { return trace.RequestID })},
+		{name: "method", typeRef: "String!", resolve: graphQLProperty(func(trace *requestTrace) interface{} { return trace.Method })},
+		{name: "path", typeRef: "String!", resolve: graphQLProperty(func(trace *requestTrace) interface{} { return trace.Path })},
+		{name: "status", typeRef: "Int!", resolve: graphQLProperty(func(trace *requestTrace) interface{} { return trace.Status })},
+		{name: "started", typeRef: "String!", resolve: graphQLProperty(func(trace *requestTrace) interface{} {
+			return trace.Started.UTC().Format(time.RFC3339Nano)
+		})},
+		{name: "durationMs", typeRef: "Float!", resolve: graphQLProperty(func(trace *requestTrace) interface{} {
+			return milliseconds(trace.Duration)
+		})},
+		{name: "error", typeRef: "String", resolve: graphQLProperty(func(trace *requestTrace) interface{} {
+			if trace.Error == "" {
+				return nil
+			}
+			return trace.Error
+		})},
+		{name: "spans", typeRef: "[Span!]!", resolve: graphQLProperty(func(trace *requestTrace) interface{} {
+			trace.mutex.Lock()
+			defer trace.mutex.Unlock()
+			return append([]traceSpan{}, trace.Spans...)
+		})},
+	}})
+
+	schema.addType(&graphQLType{name: "Span", kind: "OBJECT", fields: []*graphQLField{
+		{name: "name", typeRef: "String!", resolve: graphQLProperty(func(span traceSpan) interface{} { return span.Name })},
+		{name: "startMs", typeRef: "Float!", resolve: graphQLProperty(func(span traceSpan) interface{} {
+			return milliseconds(span.Start)
+		})},
+		{name: "durationMs", typeRef: "Float!", resolve: graphQLProperty(func(span traceSpan) interface{} {
+			return milliseconds(span.Duration)
+		})},
+	}})
+
+	schema.addIntrospectionFields()
+
+	return schema
+
+}
+
+// This is our GraphQL handler
+func graphQLHandler(w http.ResponseWriter, r *http.Request) {
+
+	request := graphQLRequest{}
+
+	if r.Method == http.MethodPost {
+
+		// Forms can be posted from other sites as text/plain, with a body which is valid JSON
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			writeError(w, r, newAppError(http.StatusUnsupportedMediaType, "unsupported_media_type",
+				"GraphQL requests must be sent as application/json."))
+			return
+		}
+
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_GRAPHQL_REQUEST_SIZE))
+
+		if err := decoder.Decode(&request); err != nil {
+			writeError(w, r, badRequestError("GraphQL requests must be sent as JSON.").Wrap(err))
+			return
+		}
+
+	} else {
+
+		query := r.URL.Query()
+		request.Query = query.Get("query")
+		request.OperationName = query.Get("operationName")
+
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &request.Variables); err != nil {
+				writeError(w, r, badRequestError("The variables parameter must be a JSON object.").Wrap(err))
+				return
+			}
+		}
+
+	}
+
+	document, err := parseGraphQL(request.Query)
+
+	if err != nil {
+		writeGraphQLResponse(w, http.StatusBadRequest, graphQLResponse{Errors: []*graphQLError{asGraphQLError(err)}})
+		return
+	}
+
+	operation, err := selectGraphQLOperation(document, request.OperationName)
+
+	if err != nil {
+		writeGraphQLResponse(w, http.StatusBadRequest, graphQLResponse{Errors: []*graphQLError{asGraphQLError(err)}})
+		return
+	}
+
+	// Mutations change our state, so they can't be sent via GET (i.e. from a link)
+	if operation.kind != "query" && r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeGraphQLResponse(w, http.StatusMethodNotAllowed, graphQLResponse{Errors: []*graphQLError{{
+			Message: fmt.Sprintf("%s operations must be sent via POST.", operation.kind),
+		}}})
+		return
+	}
+
+	// Admins are authenticated at most once per request, however many admin only fields they
+	// select, as two factor codes can only be used once
+	admin := sync.OnceValue(func() bool { return isAdminRequest(r) })
+	r = r.WithContext(context.WithValue(r.Context(), GRAPHQL_ADMIN_KEY, admin))
+
+	endSpan := startSpan(r.Context(), "graphql: "+operation.kind)
+	data, errs := executeGraphQL(r, demoSchema, document, operation, request.Variables)
+	endSpan()
+
+	incrementCounter("graphql_operations_total", "type", operation.kind)
+	if len(errs) > 0 {
+		addCounter("graphql_errors_total", float64(len(errs)))
+	}
+
+	writeGraphQLResponse(w, http.StatusOK, graphQLResponse{Data: data, Errors: errs})
+
+}
+
+// Returns whether the given GraphQL request was made by an admin, authenticating them on the
+// first call (see graphQLHandler)
+func graphQLAdminRequest(r *http.Request) bool {
+	if admin, ok := r.Context().Value(GRAPHQL_ADMIN_KEY).(func() bool); ok {
+		return admin()
+	}
+	return isAdminRequest(r)
+}
+
+// Pick the operation to execute. Documents with several operations must name the one they want.
+func selectGraphQLOperation(document *graphQLDocument, name string) (*graphQLOperation, error) {
+
+	if len(document.operations) == 0 {
+		return nil, errors.New("The document doesn't contain any operations.")
+	}
+
+	if name == "" {
+		if len(document.operations) > 1 {
+			return nil, errors.New("An operationName is required for documents with several operations.")
+		}
+		operation := document.operations[0]
+		if operation.kind == "subscription" {
+			return nil, errors.New("Subscriptions aren't supported.")
+		}
+		return operation, nil
+	}
+
+	for _, operation := range document.operations {
+		if operation.name == name {
+			if operation.kind == "subscription" {
+				return nil, errors.New("Subscriptions aren't supported.")
+			}
+			return operation, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unknown operation named %q.", name)
+
+}
+
+func asGraphQLError(err error) *graphQLError {
+	var graphQLErr *graphQLError
+	if errors.As(err, &graphQLErr) {
+		return graphQLErr
+	}
+	return &graphQLError{Message: err.Error()}
+}
+
+func writeGraphQLResponse(w http.ResponseWriter, status int, response graphQLResponse) {
+	setContentType(w, CONTENT_TYPE_JSON)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// This is our GraphiQL playground page, which loads GraphiQL (and React) from a CDN like our
+// other demos do
+const GRAPHIQL_PAGE_TEMPLATE = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<title>GraphiQL</title>
+	<style>
+		body { margin: 0; }
+		#graphiql { height: 100vh; }
+	</style>
+	<link rel="stylesheet" href="https://unpkg.com/graphiql@3/graphiql.min.css">
+	<script crossorigin src="https://unpkg.com/react@18/umd/react.production.min.js"></script>
+	<script crossorigin src="https://unpkg.com/react-dom@18/umd/react-dom.production.min.js"></script>
+	<script crossorigin src="https://unpkg.com/graphiql@3/graphiql.min.js"></script>
+</head>
+<body>
+	<div id="graphiql">Loading...</div>
+	<script>
+		var fetcher = GraphiQL.createFetcher({ url: {{ url "/api/graphql" }} });
+		ReactDOM.createRoot(document.getElementById('graphiql')).render(
+			React.createElement(GraphiQL, { fetcher: fetcher, defaultQuery: {{ .DefaultQuery }} })
+		);
+	</script>
+</body>
+</html>
+`
+
+// The data we pass into our GraphiQL page template
+type graphiQLPageData struct {
+	DefaultQuery string
+}
+
+// This is our GraphiQL playground handler (only registered in -dev mode)
+func graphiQLHandler(w http.ResponseWriter, r *http.Request) {
+
+	setContentType(w, CONTENT_TYPE_HTML)
+
+	err := graphiQLPageTemplate.Execute(w, graphiQLPageData{
+		DefaultQuery: strings.Join([]string{
+			"{",
+			"  status { healthy uptimeSeconds goVersion }",
+			"  pages { title url }",
+			"}",
+		}, "\n"),
+	})
+
+	if err != nil {
+		logger.Println("ERROR executing the GraphiQL page template", err)
+	}
+
+}
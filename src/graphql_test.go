@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGraphQLMutationsMustBeSentAsJSON(t *testing.T) {
+
+	defer func(dir string, token string) { uploadDir, adminToken = dir, token }(uploadDir, adminToken)
+	uploadDir, adminToken = t.TempDir(), "secret"
+
+	upload := filepath.Join(uploadDir, "photo.png")
+	body := `{"query": "mutation { deleteUpload(name: \"photo.png\") }"}`
+
+	tests := []struct {
+		name        string
+		contentType string
+		status      int
+		deleted     bool
+	}{
+		// The body of a text/plain form can be valid JSON, and such forms can come from any site
+		{"text/plain", "text/plain", http.StatusUnsupportedMediaType, false},
+		{"form", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType, false},
+		{"no content type", "", http.StatusUnsupportedMediaType, false},
+		{"JSON", "application/json; charset=utf-8", http.StatusOK, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			if err := os.WriteFile(upload, []byte("png"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/api/graphql", strings.NewReader(body))
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+			r.SetBasicAuth("admin", adminToken)
+			w := httptest.NewRecorder()
+
+			graphQLHandler(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("got status %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+			if _, err := os.Stat(upload); os.IsNotExist(err) != test.deleted {
+				t.Errorf("got the upload deleted %t, want %t: %s", os.IsNotExist(err), test.deleted, w.Body)
+			}
+
+		})
+	}
+
+}
+
+func TestGraphQLShortURLsAreCreatedByAdmins(t *testing.T) {
+
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "secret"
+
+	body := `{"query": "mutation { createShortUrl(url: \"https://example.com/\") { code } }"}`
+
+	for _, admin := range []bool{false, true} {
+
+		r := httptest.NewRequest(http.MethodPost, "/api/graphql", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if admin {
+			r.SetBasicAuth("admin", adminToken)
+		}
+		w := httptest.NewRecorder()
+
+		graphQLHandler(w, r)
+
+		if created := !strings.Contains(w.Body.String(), `"errors"`); created != admin {
+			t.Errorf("got a short URL created %t for an admin %t, want %t: %s", created, admin, admin, w.Body)
+		}
+
+	}
+
+}
@@ -0,0 +1,327 @@
+// The todo items, pastes and short URLs of our GraphQL API (see graphql.go). They're demo data,
+// so they're kept in memory only: we keep the latest MAX_TODOS, MAX_PASTES and MAX_SHORT_URLS
+// of each, and each client can only add so many a minute. Anyone can add, tick off or delete a
+// todo item and add a paste, while only admins can delete pastes. Short URLs redirect from
+// /s/{code} to anywhere, so only admins can create (and delete) them, lest our name be lent to
+// phishing links. Pastes are served as plain text from /pastes/{id}.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	MAX_TODOS               = 200
+	MAX_PASTES              = 200
+	MAX_SHORT_URLS          = 500
+	MAX_TODO_TITLE_LENGTH   = 200 // In characters
+	MAX_PASTE_TITLE_LENGTH  = 100 // In characters
+	MAX_PASTE_SIZE          = 64 << 10
+	MAX_SHORT_URL_LENGTH    = 2048
+	GRAPHQL_ADD_RATE_LIMIT  = 20 // How many items a client may add per minute
+	GRAPHQL_ADD_RATE_BURST  = 10
+	SHORT_URL_CODE_LENGTH   = 4 // In bytes, before they're hex encoded
+	GRAPHQL_ITEM_ID_LENGTH  = 8 // In bytes, before they're hex encoded
+	SHORT_URL_PATH_PREFIX   = "/s/"
+	PASTE_PATH_PREFIX       = "/pastes/"
+	SHORT_URL_CODE_ATTEMPTS = 10
+)
+
+// A todo item
+type todoItem struct {
+	ID      string
+	Title   string
+	Done    bool
+	Created time.Time
+}
+
+// A paste: a piece of text shared via our API
+type paste struct {
+	ID      string
+	Title   string
+	Content string
+	Created time.Time
+}
+
+// A short URL, which redirects from /s/{code} to its URL
+type shortURL struct {
+	Code    string
+	URL     string
+	Visits  int64
+	Created time.Time
+}
+
+// Our todo items, pastes and short URLs, oldest first
+var graphQLData = struct {
+	mutex     sync.Mutex
+	todos     []todoItem
+	pastes    []paste
+	shortURLs []shortURL
+}{}
+
+// The rate limiter for the items added via our GraphQL API
+var graphQLAddRateLimiter = newRateLimiter("graphql-add", GRAPHQL_ADD_RATE_LIMIT, GRAPHQL_ADD_RATE_BURST)
+
+// The error returned when an item can't be found
+var errGraphQLNotFound = errors.New("There is no such item.")
+
+// Returns an error when the client who made the given request is adding items too quickly
+func reserveGraphQLAdd(r *http.Request) error {
+	if graphQLAddRateLimiter.reserve(clientAddress(r)) > 0 {
+		return errors.New("You're adding items too quickly. Please wait a moment and try again.")
+	}
+	return nil
+}
+
+// Returns a new random ID of the given length (in bytes, before it's hex encoded)
+func newGraphQLItemID(length int) string {
+	id := make([]byte, length)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Append the given item to the given list, forgetting our oldest items beyond the given limit
+func appendLimited[T any](items []T, item T, limit int) []T {
+	items = append(items, item)
+	if excess := len(items) - limit; excess > 0 {
+		items = slices.Delete(items, 0, excess)
+	}
+	return items
+}
+
+// Returns a copy of the given items, newest first
+func newestFirst[T any](items []T) []T {
+	reversed := slices.Clone(items)
+	slices.Reverse(reversed)
+	return reversed
+}
+
+// Returns the given text trimmed, or an error naming the field when it's missing or too long
+func graphQLText(field string, value string, required bool, maxLength int) (string, error) {
+	value = strings.TrimSpace(value)
+	if required && value == "" {
+		return "", fmt.Errorf("The %s is required.", field)
+	}
+	if utf8.RuneCountInString(value) > maxLength {
+		return "", fmt.Errorf("The %s must be at most %d characters long.", field, maxLength)
+	}
+	return value, nil
+}
+
+// Add a todo item with the given title
+func addTodo(r *http.Request, title string) (todoItem, error) {
+
+	title, err := graphQLText("title", title, true, MAX_TODO_TITLE_LENGTH)
+	if err != nil {
+		return todoItem{}, err
+	}
+
+	if err := reserveGraphQLAdd(r); err != nil {
+		return todoItem{}, err
+	}
+
+	todo := todoItem{ID: newGraphQLItemID(GRAPHQL_ITEM_ID_LENGTH), Title: title, Created: time.Now().UTC()}
+
+	graphQLData.mutex.Lock()
+	defer graphQLData.mutex.Unlock()
+
+	graphQLData.todos = appendLimited(graphQLData.todos, todo, MAX_TODOS)
+
+	return todo, nil
+
+}
+
+// Tick off (or untick) the todo item with the given ID
+func setTodoDone(id string, done bool) (todoItem, error) {
+
+	graphQLData.mutex.Lock()
+	defer graphQLData.mutex.Unlock()
+
+	index := slices.IndexFunc(graphQLData.todos, func(todo todoItem) bool { return todo.ID == id })
+	if index < 0 {
+		return todoItem{}, errGraphQLNotFound
+	}
+
+	graphQLData.todos[index].Done = done
+
+	return graphQLData.todos[index], nil
+
+}
+
+// Delete the todo item with the given ID, returning whether it existed
+func deleteTodo(id string) bool {
+
+	graphQLData.mutex.Lock()
+	defer graphQLData.mutex.Unlock()
+
+	count := len(graphQLData.todos)
+	graphQLData.todos = slices.DeleteFunc(graphQLData.todos, func(todo todoItem) bool { return todo.ID == id })
+
+	return len(graphQLData.todos) < count
+
+}
+
+// Add a paste with the given title (which is optional) and content
+func createPaste(r *http.Request, title string, content string) (paste, error) {
+
+	title, err := graphQLText("title", title, false, MAX_PASTE_TITLE_LENGTH)
+	if err != nil {
+		return paste{}, err
+	}
+
+	if strings.TrimSpace(content) == "" {
+		return paste{}, errors.New("The content is required.")
+	}
+	if len(content) > MAX_PASTE_SIZE {
+		return paste{}, fmt.Errorf("The content must be at most %d bytes long.", MAX_PASTE_SIZE)
+	}
+
+	if err := reserveGraphQLAdd(r); err != nil {
+		return paste{}, err
+	}
+
+	created := paste{ID: newGraphQLItemID(GRAPHQL_ITEM_ID_LENGTH), Title: title, Content: content, Created: time.Now().UTC()}
+
+	graphQLData.mutex.Lock()
+	defer graphQLData.mutex.Unlock()
+
+	graphQLData.pastes = appendLimited(graphQLData.pastes, created, MAX_PASTES)
+
+	return created, nil
+
+}
+
+// Returns the paste with the given ID (and whether there is one)
+func findPaste(id string) (paste, bool) {
+
+	graphQLData.mutex.Lock()
+	defer graphQLData.mutex.Unlock()
+
+	index := slices.IndexFunc(graphQLData.pastes, func(paste paste) bool { return paste.ID == id })
+	if index < 0 {
+		return paste{}, false
+	}
+
+	return graphQLData.pastes[index], true
+
+}
+
+// This is our paste handler, which serves the text of the paste /pastes/{id} as plain text
+func pasteHandler(w http.ResponseWriter, r *http.Request) {
+
+	found, ok := findPaste(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, notFoundError())
+		return
+	}
+
+	setContentType(w, CONTENT_TYPE_TEXT)
+	io.WriteString(w, found.Content)
+
+}
+
+// Delete the paste with the given ID, returning whether it existed
+func deletePaste(id string) bool {
+
+	graphQLData.mutex.Lock()
+	defer graphQLData.mutex.Unlock()
+
+	count := len(graphQLData.pastes)
+	graphQLData.pastes = slices.DeleteFunc(graphQLData.pastes, func(paste paste) bool { return paste.ID == id })
+
+	return len(graphQLData.pastes) < count
+
+}
+
+// Add a short URL for the given URL, which must be an absolute http or https URL
+func createShortURL(r *http.Request, target string) (shortURL, error) {
+
+	target = strings.TrimSpace(target)
+	parsed, err := url.Parse(target)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return shortURL{}, errors.New("The URL must be an absolute http or https URL.")
+	}
+	if len(target) > MAX_SHORT_URL_LENGTH {
+		return shortURL{}, fmt.Errorf("The URL must be at most %d characters long.", MAX_SHORT_URL_LENGTH)
+	}
+
+	if err := reserveGraphQLAdd(r); err != nil {
+		return shortURL{}, err
+	}
+
+	graphQLData.mutex.Lock()
+	defer graphQLData.mutex.Unlock()
+
+	for range SHORT_URL_CODE_ATTEMPTS {
+		code := newGraphQLItemID(SHORT_URL_CODE_LENGTH)
+		if slices.ContainsFunc(graphQLData.shortURLs, func(short shortURL) bool { return short.Code == code }) {
+			continue
+		}
+		created := shortURL{Code: code, URL: parsed.String(), Created: time.Now().UTC()}
+		graphQLData.shortURLs = appendLimited(graphQLData.shortURLs, created, MAX_SHORT_URLS)
+		return created, nil
+	}
+
+	return shortURL{}, errors.New("The short URL could not be created. Please try again.")
+
+}
+
+// Returns the short URL with the given code (and whether there is one), counting a visit to it
+// when asked to
+func findShortURL(code string, visit bool) (shortURL, bool) {
+
+	graphQLData.mutex.Lock()
+	defer graphQLData.mutex.Unlock()
+
+	index := slices.IndexFunc(graphQLData.shortURLs, func(short shortURL) bool { return short.Code == code })
+	if index < 0 {
+		return shortURL{}, false
+	}
+
+	if visit {
+		graphQLData.shortURLs[index].Visits++
+	}
+
+	return graphQLData.shortURLs[index], true
+
+}
+
+// Delete the short URL with the given code, returning whether it existed
+func deleteShortURL(code string) bool {
+
+	graphQLData.mutex.Lock()
+	defer graphQLData.mutex.Unlock()
+
+	count := len(graphQLData.shortURLs)
+	graphQLData.shortURLs = slices.DeleteFunc(graphQLData.shortURLs, func(short shortURL) bool { return short.Code == code })
+
+	return len(graphQLData.shortURLs) < count
+
+}
+
+// This is our short URL handler, which redirects /s/{code} to the short URL's URL
+func shortURLHandler(w http.ResponseWriter, r *http.Request) {
+
+	short, ok := findShortURL(r.PathValue("code"), true)
+	if !ok {
+		writeError(w, r, notFoundError())
+		return
+	}
+
+	incrementCounter("short_url_visits_total")
+
+	http.Redirect(w, r, short.URL, http.StatusFound)
+
+}
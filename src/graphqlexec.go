@@ -0,0 +1,1106 @@
+// A small GraphQL engine: a lexer and parser for GraphQL documents (operations, variables,
+// fragments and the @skip / @include directives) and an executor which resolves them against a
+// schema of Go types and resolver functions. The engine also answers introspection queries
+// (__schema, __type and __typename) so that tools like GraphiQL can load our schema. Input
+// object types, interfaces, unions and subscriptions aren't supported. Our schema itself can
+// be found in graphql.go.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A GraphQL schema: our object, scalar and enum types along with the root operation types
+type graphQLSchema struct {
+	queryType    string
+	mutationType string
+	types        map[string]*graphQLType
+	typeNames    []string // The order our types were added in, for introspection
+}
+
+// A named GraphQL type. The kind is OBJECT, SCALAR or ENUM.
+type graphQLType struct {
+	name        string
+	kind        string
+	description string
+	fields      []*graphQLField
+	enumValues  []string
+}
+
+// A field of an object type. Type references use GraphQL syntax, i.e. "[Page!]!".
+type graphQLField struct {
+	name        string
+	description string
+	typeRef     string
+	args        []graphQLArgument
+	resolve     graphQLResolver
+}
+
+// An argument of a field or directive
+type graphQLArgument struct {
+	name        string
+	description string
+	typeRef     string
+}
+
+// A directive our executor understands
+type graphQLDirective struct {
+	name        string
+	description string
+	locations   []string
+	args        []graphQLArgument
+}
+
+// Resolves the value of a field given the value of its parent object (the source) and the
+// field's arguments
+type graphQLResolver func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error)
+
+// The directives we support
+var graphQLDirectives = []graphQLDirective{
+	{
+		name:        "include",
+		description: "Only include this field or fragment if the argument is true.",
+		locations:   []string{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"},
+		args:        []graphQLArgument{{name: "if", typeRef: "Boolean!"}},
+	},
+	{
+		name:        "skip",
+		description: "Skip this field or fragment if the argument is true.",
+		locations:   []string{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"},
+		args:        []graphQLArgument{{name: "if", typeRef: "Boolean!"}},
+	},
+}
+
+// Returns a new schema containing the built in scalars and introspection types
+func newGraphQLSchema(queryType string, mutationType string) *graphQLSchema {
+
+	schema := &graphQLSchema{queryType: queryType, mutationType: mutationType, types: map[string]*graphQLType{}}
+
+	for _, scalar := range []string{"String", "Int", "Float", "Boolean", "ID"} {
+		schema.addType(&graphQLType{name: scalar, kind: "SCALAR"})
+	}
+
+	schema.addIntrospectionTypes()
+
+	return schema
+
+}
+
+func (schema *graphQLSchema) addType(definition *graphQLType) {
+	schema.types[definition.name] = definition
+	schema.typeNames = append(schema.typeNames, definition.name)
+}
+
+// Returns the field with the given name (or nil if the type doesn't have one)
+func (definition *graphQLType) field(name string) *graphQLField {
+	for _, field := range definition.fields {
+		if field.name == name {
+			return field
+		}
+	}
+	return nil
+}
+
+// Returns a resolver which reads a value from its source object of type T
+func graphQLProperty[T any](get func(source T) interface{}) graphQLResolver {
+	return func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+		return get(source.(T)), nil
+	}
+}
+
+// Lexing:
+
+// A token of a GraphQL document. Kinds are punctuators (p), names (n), ints (i), floats (f),
+// strings (s) and the end of the document (e).
+type graphQLToken struct {
+	kind   byte
+	value  string
+	line   int
+	column int
+}
+
+// An error in a GraphQL request, reported in the errors list of our response
+type graphQLError struct {
+	Message   string            `json:"message"`
+	Locations []graphQLLocation `json:"locations,omitempty"`
+	Path      []interface{}     `json:"path,omitempty"`
+}
+
+type graphQLLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+func (err *graphQLError) Error() string {
+	return err.Message
+}
+
+// Split a GraphQL document into tokens
+func lexGraphQL(source string) ([]graphQLToken, error) {
+
+	var tokens []graphQLToken
+	line, lineStart := 1, 0
+
+	for i := 0; i < len(source); {
+
+		c := source[i]
+		token := graphQLToken{line: line, column: i - lineStart + 1}
+
+		switch {
+		case c == '\n':
+			line, lineStart = line+1, i+1
+			i++
+			continue
+
+		case c == ' ' || c == '\t' || c == '\r' || c == ',' || strings.HasPrefix(source[i:], "\uFEFF"):
+			_, size := utf8.DecodeRuneInString(source[i:])
+			i += size
+			continue
+
+		case c == '#':
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+			continue
+
+		case strings.HasPrefix(source[i:], "..."):
+			token.kind, token.value = 'p', "..."
+			i += 3
+
+		case strings.ContainsRune("!$&():=@[]{}|", rune(c)):
+			token.kind, token.value = 'p', string(c)
+			i++
+
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			start := i
+			for i < len(source) && (source[i] == '_' || (source[i] >= 'a' && source[i] <= 'z') ||
+				(source[i] >= 'A' && source[i] <= 'Z') || (source[i] >= '0' && source[i] <= '9')) {
+				i++
+			}
+			token.kind, token.value = 'n', source[start:i]
+
+		case c == '-' || (c >= '0' && c <= '9'):
+			start := i
+			token.kind = 'i'
+			i++
+			for i < len(source) && strings.ContainsRune("0123456789.eE+-", rune(source[i])) {
+				if strings.ContainsRune(".eE", rune(source[i])) {
+					token.kind = 'f'
+				}
+				i++
+			}
+			token.value = source[start:i]
+
+		case strings.HasPrefix(source[i:], `"""`):
+			end := strings.Index(source[i+3:], `"""`)
+			if end < 0 {
+				return nil, graphQLSyntaxError(token, "Unterminated block string.")
+			}
+			token.kind, token.value = 's', graphQLBlockString(source[i+3:i+3+end])
+			line += strings.Count(source[i:i+3+end], "\n")
+			i += end + 6
+
+		case c == '"':
+			value, length, err := graphQLStringValue(source[i:])
+			if err != nil {
+				return nil, graphQLSyntaxError(token, err.Error())
+			}
+			token.kind, token.value = 's', value
+			i += length
+
+		default:
+			return nil, graphQLSyntaxError(token, fmt.Sprintf("Unexpected character %q.", c))
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	return append(tokens, graphQLToken{kind: 'e', line: line, column: len(source) - lineStart + 1}), nil
+
+}
+
+// Read a quoted string, returning its value and its length in the source
+func graphQLStringValue(source string) (string, int, error) {
+
+	var value strings.Builder
+
+	for i := 1; i < len(source); i++ {
+		switch source[i] {
+		case '"':
+			return value.String(), i + 1, nil
+		case '\n':
+			return "", 0, fmt.Errorf("Unterminated string.")
+		case '\\':
+			if i+1 >= len(source) {
+				return "", 0, fmt.Errorf("Unterminated string.")
+			}
+			i++
+			switch source[i] {
+			case 'b':
+				value.WriteByte('\b')
+			case 'f':
+				value.WriteByte('\f')
+			case 'n':
+				value.WriteByte('\n')
+			case 'r':
+				value.WriteByte('\r')
+			case 't':
+				value.WriteByte('\t')
+			case 'u':
+				if i+4 >= len(source) {
+					return "", 0, fmt.Errorf("Invalid unicode escape.")
+				}
+				code, err := strconv.ParseUint(source[i+1:i+5], 16, 32)
+				if err != nil {
+					return "", 0, fmt.Errorf("Invalid unicode escape.")
+				}
+				value.WriteRune(rune(code))
+				i += 4
+			default:
+				value.WriteByte(source[i])
+			}
+		default:
+			value.WriteByte(source[i])
+		}
+	}
+
+	return "", 0, fmt.Errorf("Unterminated string.")
+
+}
+
+// Block strings have their common indentation and leading / trailing blank lines removed
+func graphQLBlockString(raw string) string {
+
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && (indent < 0 || len(line)-len(trimmed) < indent) {
+			indent = len(line) - len(trimmed)
+		}
+	}
+
+	for i := 1; i < len(lines) && indent > 0; i++ {
+		if len(lines[i]) >= indent {
+			lines[i] = lines[i][indent:]
+		}
+	}
+
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return strings.Join(lines, "\n")
+
+}
+
+func graphQLSyntaxError(token graphQLToken, message string) *graphQLError {
+	return &graphQLError{
+		Message:   "Syntax Error: " + message,
+		Locations: []graphQLLocation{{Line: token.line, Column: token.column}},
+	}
+}
+
+// Parsing:
+
+// A parsed GraphQL document
+type graphQLDocument struct {
+	operations []*graphQLOperation
+	fragments  map[string]*graphQLFragment
+}
+
+// A query or mutation
+type graphQLOperation struct {
+	kind       string
+	name       string
+	defaults   map[string]interface{} // The default values of our variables
+	selections []*graphQLSelection
+}
+
+type graphQLFragment struct {
+	typeCondition string
+	selections    []*graphQLSelection
+}
+
+// A field, fragment spread or inline fragment
+type graphQLSelection struct {
+	alias         string
+	name          string
+	arguments     map[string]interface{}
+	directives    map[string]map[string]interface{}
+	selections    []*graphQLSelection
+	fragment      string // The name of a fragment spread
+	inline        bool   // Whether this is an inline fragment
+	typeCondition string
+	token         graphQLToken
+}
+
+// The key a field's value is returned under
+func (selection *graphQLSelection) responseKey() string {
+	if selection.alias != "" {
+		return selection.alias
+	}
+	return selection.name
+}
+
+// A reference to a variable, i.e. $id
+type graphQLVariable string
+
+// An enum value, i.e. OBJECT
+type graphQLEnum string
+
+type graphQLParser struct {
+	tokens   []graphQLToken
+	position int
+}
+
+// Parse a GraphQL document
+func parseGraphQL(source string) (document *graphQLDocument, err error) {
+
+	tokens, err := lexGraphQL(source)
+
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &graphQLParser{tokens: tokens}
+	document = &graphQLDocument{fragments: map[string]*graphQLFragment{}}
+
+	// Our parsing methods panic with a *graphQLError on unexpected tokens, which saves
+	// checking for errors at every step of our recursive descent
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			syntaxError, ok := recovered.(*graphQLError)
+			if !ok {
+				panic(recovered)
+			}
+			document, err = nil, syntaxError
+		}
+	}()
+
+	for parser.peek().kind != 'e' {
+
+		token := parser.peek()
+
+		switch {
+		case token.value == "{":
+			document.operations = append(document.operations, &graphQLOperation{
+				kind:       "query",
+				selections: parser.selectionSet(),
+			})
+
+		case token.kind == 'n' && (token.value == "query" || token.value == "mutation" || token.value == "subscription"):
+			document.operations = append(document.operations, parser.operation())
+
+		case token.kind == 'n' && token.value == "fragment":
+			parser.next()
+			name := parser.expect('n', "").value
+			parser.expect('n', "on")
+			fragment := &graphQLFragment{typeCondition: parser.expect('n', "").value}
+			parser.directives()
+			fragment.selections = parser.selectionSet()
+			document.fragments[name] = fragment
+
+		default:
+			parser.unexpected()
+		}
+	}
+
+	return document, nil
+
+}
+
+func (parser *graphQLParser) peek() graphQLToken {
+	return parser.tokens[parser.position]
+}
+
+func (parser *graphQLParser) next() graphQLToken {
+	token := parser.tokens[parser.position]
+	if token.kind != 'e' {
+		parser.position++
+	}
+	return token
+}
+
+// Returns true (and moves past it) if the next token is the given punctuator
+func (parser *graphQLParser) skip(punctuator string) bool {
+	if token := parser.peek(); token.kind == 'p' && token.value == punctuator {
+		parser.position++
+		return true
+	}
+	return false
+}
+
+// Returns the next token, which must be of the given kind (and value, if one is given)
+func (parser *graphQLParser) expect(kind byte, value string) graphQLToken {
+	token := parser.peek()
+	if token.kind != kind || (value != "" && token.value != value) {
+		parser.unexpected()
+	}
+	return parser.next()
+}
+
+func (parser *graphQLParser) unexpected() {
+	parser.unexpectedToken(parser.peek())
+}
+
+func (parser *graphQLParser) unexpectedToken(token graphQLToken) {
+	if token.kind == 'e' {
+		panic(graphQLSyntaxError(token, "Unexpected end of document."))
+	}
+	panic(graphQLSyntaxError(token, fmt.Sprintf("Unexpected %q.", token.value)))
+}
+
+func (parser *graphQLParser) operation() *graphQLOperation {
+
+	operation := &graphQLOperation{kind: parser.next().value, defaults: map[string]interface{}{}}
+
+	if parser.peek().kind == 'n' {
+		operation.name = parser.next().value
+	}
+
+	if parser.skip("(") {
+		for !parser.skip(")") {
+			parser.expect('p', "$")
+			name := parser.expect('n', "").value
+			parser.expect('p', ":")
+			parser.typeRef()
+			if parser.skip("=") {
+				operation.defaults[name] = parser.value()
+			}
+			parser.directives()
+		}
+	}
+
+	parser.directives()
+	operation.selections = parser.selectionSet()
+
+	return operation
+
+}
+
+// Skip over a type reference, i.e. [String!]! (we don't check the types of our variables)
+func (parser *graphQLParser) typeRef() {
+	if parser.skip("[") {
+		parser.typeRef()
+		parser.expect('p', "]")
+	} else {
+		parser.expect('n', "")
+	}
+	parser.skip("!")
+}
+
+func (parser *graphQLParser) selectionSet() []*graphQLSelection {
+
+	var selections []*graphQLSelection
+
+	parser.expect('p', "{")
+
+	for !parser.skip("}") {
+
+		selection := &graphQLSelection{token: parser.peek()}
+
+		if parser.skip("...") {
+			if token := parser.peek(); token.kind == 'n' && token.value != "on" {
+				selection.fragment = parser.next().value
+				selection.directives = parser.directives()
+			} else {
+				selection.inline = true
+				if token.kind == 'n' {
+					parser.next()
+					selection.typeCondition = parser.expect('n', "").value
+				}
+				selection.directives = parser.directives()
+				selection.selections = parser.selectionSet()
+			}
+			selections = append(selections, selection)
+			continue
+		}
+
+		selection.name = parser.expect('n', "").value
+
+		if parser.skip(":") {
+			selection.alias = selection.name
+			selection.name = parser.expect('n', "").value
+		}
+
+		selection.arguments = parser.arguments()
+		selection.directives = parser.directives()
+
+		if token := parser.peek(); token.kind == 'p' && token.value == "{" {
+			selection.selections = parser.selectionSet()
+		}
+
+		selections = append(selections, selection)
+	}
+
+	return selections
+
+}
+
+func (parser *graphQLParser) arguments() map[string]interface{} {
+
+	arguments := map[string]interface{}{}
+
+	if parser.skip("(") {
+		for !parser.skip(")") {
+			name := parser.expect('n', "").value
+			parser.expect('p', ":")
+			arguments[name] = parser.value()
+		}
+	}
+
+	return arguments
+
+}
+
+func (parser *graphQLParser) directives() map[string]map[string]interface{} {
+
+	directives := map[string]map[string]interface{}{}
+
+	for parser.skip("@") {
+		name := parser.expect('n', "").value
+		directives[name] = parser.arguments()
+	}
+
+	return directives
+
+}
+
+func (parser *graphQLParser) value() interface{} {
+
+	token := parser.next()
+
+	switch token.kind {
+	case 'i':
+		value, err := strconv.Atoi(token.value)
+		if err != nil {
+			panic(graphQLSyntaxError(token, fmt.Sprintf("Invalid int %q.", token.value)))
+		}
+		return value
+	case 'f':
+		value, err := strconv.ParseFloat(token.value, 64)
+		if err != nil {
+			panic(graphQLSyntaxError(token, fmt.Sprintf("Invalid float %q.", token.value)))
+		}
+		return value
+	case 's':
+		return token.value
+	case 'n':
+		switch token.value {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		return graphQLEnum(token.value)
+	}
+
+	switch token.value {
+	case "$":
+		return graphQLVariable(parser.expect('n', "").value)
+	case "[":
+		list := []interface{}{}
+		for !parser.skip("]") {
+			list = append(list, parser.value())
+		}
+		return list
+	case "{":
+		object := map[string]interface{}{}
+		for !parser.skip("}") {
+			name := parser.expect('n', "").value
+			parser.expect('p', ":")
+			object[name] = parser.value()
+		}
+		return object
+	}
+
+	parser.unexpectedToken(token)
+	return nil
+
+}
+
+// Execution:
+
+// The state of a single operation's execution
+type graphQLExecution struct {
+	request   *http.Request
+	schema    *graphQLSchema
+	fragments map[string]*graphQLFragment
+	variables map[string]interface{}
+	errors    []*graphQLError
+}
+
+// An object in our response. Its fields are kept in the order they were selected in, as the
+// GraphQL specification requires.
+type graphQLResult struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (result *graphQLResult) MarshalJSON() ([]byte, error) {
+
+	var output strings.Builder
+	output.WriteByte('{')
+
+	for i, key := range result.keys {
+		if i > 0 {
+			output.WriteByte(',')
+		}
+		keyJSON, _ := json.Marshal(key)
+		valueJSON, err := json.Marshal(result.values[key])
+		if err != nil {
+			return nil, err
+		}
+		output.Write(keyJSON)
+		output.WriteByte(':')
+		output.Write(valueJSON)
+	}
+
+	output.WriteByte('}')
+
+	return []byte(output.String()), nil
+
+}
+
+// Execute the given operation of a document, returning its data along with any field errors
+func executeGraphQL(r *http.Request, schema *graphQLSchema, document *graphQLDocument,
+	operation *graphQLOperation, variables map[string]interface{}) (*graphQLResult, []*graphQLError) {
+
+	execution := &graphQLExecution{
+		request:   r,
+		schema:    schema,
+		fragments: document.fragments,
+		variables: map[string]interface{}{},
+	}
+
+	for name, value := range operation.defaults {
+		execution.variables[name] = value
+	}
+	for name, value := range variables {
+		execution.variables[name] = value
+	}
+
+	rootType := schema.types[schema.queryType]
+	if operation.kind == "mutation" {
+		rootType = schema.types[schema.mutationType]
+	}
+
+	data := execution.selectionSet(rootType, nil, operation.selections, nil)
+
+	return data, execution.errors
+
+}
+
+func (execution *graphQLExecution) addError(selection *graphQLSelection, path []interface{}, message string) {
+	execution.errors = append(execution.errors, &graphQLError{
+		Message:   message,
+		Locations: []graphQLLocation{{Line: selection.token.line, Column: selection.token.column}},
+		Path:      path,
+	})
+}
+
+// Resolve the selected fields of an object
+func (execution *graphQLExecution) selectionSet(objectType *graphQLType, source interface{},
+	selections []*graphQLSelection, path []interface{}) *graphQLResult {
+
+	result := &graphQLResult{values: map[string]interface{}{}}
+	fields := map[string][]*graphQLSelection{}
+
+	execution.collectFields(objectType, selections, result, fields, map[string]bool{})
+
+	for _, key := range result.keys {
+
+		selection := fields[key][0]
+		fieldPath := append(append([]interface{}{}, path...), key)
+
+		// Fields selected more than once under the same key have their selections merged
+		var subSelections []*graphQLSelection
+		for _, duplicate := range fields[key] {
+			subSelections = append(subSelections, duplicate.selections...)
+		}
+
+		if selection.name == "__typename" {
+			result.values[key] = objectType.name
+			continue
+		}
+
+		field := objectType.field(selection.name)
+
+		if field == nil {
+			execution.addError(selection, fieldPath,
+				fmt.Sprintf("Cannot query field %q on type %q.", selection.name, objectType.name))
+			result.values[key] = nil
+			continue
+		}
+
+		// Objects must have their fields selected, while scalars and enums have no fields
+		fieldType := execution.schema.types[strings.Trim(field.typeRef, "[]!")]
+		if fieldType.kind == "OBJECT" && len(subSelections) == 0 {
+			execution.addError(selection, fieldPath, fmt.Sprintf("Field %q of type %q must have a selection of subfields.",
+				selection.name, field.typeRef))
+			result.values[key] = nil
+			continue
+		}
+		if fieldType.kind != "OBJECT" && len(subSelections) > 0 {
+			execution.addError(selection, fieldPath, fmt.Sprintf("Field %q must not have a selection since type %q has no subfields.",
+				selection.name, field.typeRef))
+			result.values[key] = nil
+			continue
+		}
+
+		arguments, _ := execution.resolveValue(selection.arguments).(map[string]interface{})
+
+		value, err := field.resolve(execution.request, source, arguments)
+
+		if err != nil {
+			execution.addError(selection, fieldPath, err.Error())
+			result.values[key] = nil
+			continue
+		}
+
+		result.values[key] = execution.completeValue(field.typeRef, value, subSelections, fieldPath)
+	}
+
+	return result
+
+}
+
+// Expand our fragments and apply our directives, grouping the selected fields by their key
+func (execution *graphQLExecution) collectFields(objectType *graphQLType, selections []*graphQLSelection,
+	result *graphQLResult, fields map[string][]*graphQLSelection, visitedFragments map[string]bool) {
+
+	for _, selection := range selections {
+
+		if !execution.included(selection) {
+			continue
+		}
+
+		switch {
+		case selection.fragment != "":
+			fragment, ok := execution.fragments[selection.fragment]
+			if !ok || visitedFragments[selection.fragment] || fragment.typeCondition != objectType.name {
+				continue
+			}
+			visitedFragments[selection.fragment] = true
+			execution.collectFields(objectType, fragment.selections, result, fields, visitedFragments)
+
+		case selection.inline:
+			if selection.typeCondition == "" || selection.typeCondition == objectType.name {
+				execution.collectFields(objectType, selection.selections, result, fields, visitedFragments)
+			}
+
+		default:
+			key := selection.responseKey()
+			if _, ok := fields[key]; !ok {
+				result.keys = append(result.keys, key)
+			}
+			fields[key] = append(fields[key], selection)
+		}
+	}
+
+}
+
+// Applies the @skip and @include directives
+func (execution *graphQLExecution) included(selection *graphQLSelection) bool {
+
+	if arguments, ok := selection.directives["skip"]; ok && execution.resolveValue(arguments["if"]) == true {
+		return false
+	}
+
+	if arguments, ok := selection.directives["include"]; ok && execution.resolveValue(arguments["if"]) != true {
+		return false
+	}
+
+	return true
+
+}
+
+// Replace any variables within an argument value with their values
+func (execution *graphQLExecution) resolveValue(value interface{}) interface{} {
+
+	switch value := value.(type) {
+	case graphQLVariable:
+		return execution.variables[string(value)]
+	case graphQLEnum:
+		return string(value)
+	case []interface{}:
+		resolved := make([]interface{}, len(value))
+		for i, item := range value {
+			resolved[i] = execution.resolveValue(item)
+		}
+		return resolved
+	case map[string]interface{}:
+		resolved := map[string]interface{}{}
+		for name, item := range value {
+			resolved[name] = execution.resolveValue(item)
+		}
+		return resolved
+	}
+
+	return value
+
+}
+
+// Turn a resolved value into its response value according to its type
+func (execution *graphQLExecution) completeValue(typeRef string, value interface{},
+	subSelections []*graphQLSelection, path []interface{}) interface{} {
+
+	typeRef = strings.TrimSuffix(typeRef, "!")
+
+	if value == nil {
+		return nil
+	}
+
+	reflected := reflect.ValueOf(value)
+	if (reflected.Kind() == reflect.Pointer || reflected.Kind() == reflect.Slice) && reflected.IsNil() {
+		if reflected.Kind() == reflect.Slice && strings.HasPrefix(typeRef, "[") {
+			return []interface{}{}
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(typeRef, "[") {
+		itemType := typeRef[1 : len(typeRef)-1]
+		list := make([]interface{}, reflected.Len())
+		for i := range list {
+			list[i] = execution.completeValue(itemType, reflected.Index(i).Interface(), subSelections,
+				append(append([]interface{}{}, path...), i))
+		}
+		return list
+	}
+
+	namedType := execution.schema.types[typeRef]
+
+	if namedType.kind != "OBJECT" {
+		return value
+	}
+
+	return execution.selectionSet(namedType, value, subSelections, path)
+
+}
+
+// Introspection:
+
+// A reference to a (possibly wrapped) type, i.e. [Page!]!, as seen by introspection queries
+type graphQLTypeRef struct {
+	schema *graphQLSchema
+	ref    string
+}
+
+// Add the introspection types (__Schema, __Type etc.) to our schema, along with the __schema
+// and __type fields of our query type (see addIntrospectionFields)
+func (schema *graphQLSchema) addIntrospectionTypes() {
+
+	typeRef := func(ref string) graphQLTypeRef { return graphQLTypeRef{schema: schema, ref: ref} }
+
+	none := graphQLProperty(func(interface{}) interface{} { return nil })
+	alwaysFalse := graphQLProperty(func(interface{}) interface{} { return false })
+
+	schema.addType(&graphQLType{name: "__TypeKind", kind: "ENUM", enumValues: []string{
+		"SCALAR", "OBJECT", "INTERFACE", "UNION", "ENUM", "INPUT_OBJECT", "LIST", "NON_NULL",
+	}})
+
+	schema.addType(&graphQLType{name: "__DirectiveLocation", kind: "ENUM", enumValues: []string{
+		"QUERY", "MUTATION", "SUBSCRIPTION", "FIELD", "FRAGMENT_DEFINITION", "FRAGMENT_SPREAD", "INLINE_FRAGMENT",
+		"VARIABLE_DEFINITION", "SCHEMA", "SCALAR", "OBJECT", "FIELD_DEFINITION", "ARGUMENT_DEFINITION",
+		"INTERFACE", "UNION", "ENUM", "ENUM_VALUE", "INPUT_OBJECT", "INPUT_FIELD_DEFINITION",
+	}})
+
+	schema.addType(&graphQLType{name: "__Schema", kind: "OBJECT", fields: []*graphQLField{
+		{name: "description", typeRef: "String", resolve: none},
+		{name: "types", typeRef: "[__Type!]!", resolve: graphQLProperty(func(schema *graphQLSchema) interface{} {
+			var types []graphQLTypeRef
+			for _, name := range schema.typeNames {
+				types = append(types, typeRef(name))
+			}
+			return types
+		})},
+		{name: "queryType", typeRef: "__Type!", resolve: graphQLProperty(func(schema *graphQLSchema) interface{} {
+			return typeRef(schema.queryType)
+		})},
+		{name: "mutationType", typeRef: "__Type", resolve: graphQLProperty(func(schema *graphQLSchema) interface{} {
+			if schema.mutationType == "" {
+				return nil
+			}
+			return typeRef(schema.mutationType)
+		})},
+		{name: "subscriptionType", typeRef: "__Type", resolve: none},
+		{name: "directives", typeRef: "[__Directive!]!", resolve: graphQLProperty(func(*graphQLSchema) interface{} {
+			return graphQLDirectives
+		})},
+	}})
+
+	schema.addType(&graphQLType{name: "__Type", kind: "OBJECT", fields: []*graphQLField{
+		{name: "kind", typeRef: "__TypeKind!", resolve: graphQLProperty(func(t graphQLTypeRef) interface{} {
+			return t.kind()
+		})},
+		{name: "name", typeRef: "String", resolve: graphQLProperty(func(t graphQLTypeRef) interface{} {
+			if named := t.named(); named != nil {
+				return named.name
+			}
+			return nil
+		})},
+		{name: "description", typeRef: "String", resolve: graphQLProperty(func(t graphQLTypeRef) interface{} {
+			if named := t.named(); named != nil && named.description != "" {
+				return named.description
+			}
+			return nil
+		})},
+		{name: "specifiedByURL", typeRef: "String", resolve: none},
+		{name: "fields", typeRef: "[__Field!]",
+			args: []graphQLArgument{{name: "includeDeprecated", typeRef: "Boolean"}},
+			resolve: graphQLProperty(func(t graphQLTypeRef) interface{} {
+				named := t.named()
+				if named == nil || named.kind != "OBJECT" {
+					return nil
+				}
+				fields := []*graphQLField{}
+				for _, field := range named.fields {
+					if !strings.HasPrefix(field.name, "__") {
+						fields = append(fields, field)
+					}
+				}
+				return fields
+			})},
+		{name: "interfaces", typeRef: "[__Type!]", resolve: graphQLProperty(func(t graphQLTypeRef) interface{} {
+			if t.kind() == "OBJECT" {
+				return []graphQLTypeRef{}
+			}
+			return nil
+		})},
+		{name: "possibleTypes", typeRef: "[__Type!]", resolve: none},
+		{name: "enumValues", typeRef: "[__EnumValue!]",
+			args: []graphQLArgument{{name: "includeDeprecated", typeRef: "Boolean"}},
+			resolve: graphQLProperty(func(t graphQLTypeRef) interface{} {
+				if named := t.named(); named != nil && named.kind == "ENUM" {
+					return named.enumValues
+				}
+				return nil
+			})},
+		{name: "inputFields", typeRef: "[__InputValue!]",
+			args:    []graphQLArgument{{name: "includeDeprecated", typeRef: "Boolean"}},
+			resolve: none},
+		{name: "ofType", typeRef: "__Type", resolve: graphQLProperty(func(t graphQLTypeRef) interface{} {
+			switch t.kind() {
+			case "NON_NULL":
+				return typeRef(strings.TrimSuffix(t.ref, "!"))
+			case "LIST":
+				return typeRef(t.ref[1 : len(t.ref)-1])
+			}
+			return nil
+		})},
+		{name: "isOneOf", typeRef: "Boolean", resolve: none},
+	}})
+
+	schema.addType(&graphQLType{name: "__Field", kind: "OBJECT", fields: []*graphQLField{
+		{name: "name", typeRef: "String!", resolve: graphQLProperty(func(f *graphQLField) interface{} { return f.name })},
+		{name: "description", typeRef: "String", resolve: graphQLProperty(func(f *graphQLField) interface{} {
+			if f.description == "" {
+				return nil
+			}
+			return f.description
+		})},
+		{name: "args", typeRef: "[__InputValue!]!",
+			args:    []graphQLArgument{{name: "includeDeprecated", typeRef: "Boolean"}},
+			resolve: graphQLProperty(func(f *graphQLField) interface{} { return f.args })},
+		{name: "type", typeRef: "__Type!", resolve: graphQLProperty(func(f *graphQLField) interface{} {
+			return typeRef(f.typeRef)
+		})},
+		{name: "isDeprecated", typeRef: "Boolean!", resolve: alwaysFalse},
+		{name: "deprecationReason", typeRef: "String", resolve: none},
+	}})
+
+	schema.addType(&graphQLType{name: "__InputValue", kind: "OBJECT", fields: []*graphQLField{
+		{name: "name", typeRef: "String!", resolve: graphQLProperty(func(a graphQLArgument) interface{} { return a.name })},
+		{name: "description", typeRef: "String", resolve: graphQLProperty(func(a graphQLArgument) interface{} {
+			if a.description == "" {
+				return nil
+			}
+			return a.description
+		})},
+		{name: "type", typeRef: "__Type!", resolve: graphQLProperty(func(a graphQLArgument) interface{} {
+			return typeRef(a.typeRef)
+		})},
+		{name: "defaultValue", typeRef: "String", resolve: none},
+		{name: "isDeprecated", typeRef: "Boolean!", resolve: alwaysFalse},
+		{name: "deprecationReason", typeRef: "String", resolve: none},
+	}})
+
+	schema.addType(&graphQLType{name: "__EnumValue", kind: "OBJECT", fields: []*graphQLField{
+		{name: "name", typeRef: "String!", resolve: graphQLProperty(func(name string) interface{} { return name })},
+		{name: "description", typeRef: "String", resolve: none},
+		{name: "isDeprecated", typeRef: "Boolean!", resolve: alwaysFalse},
+		{name: "deprecationReason", typeRef: "String", resolve: none},
+	}})
+
+	schema.addType(&graphQLType{name: "__Directive", kind: "OBJECT", fields: []*graphQLField{
+		{name: "name", typeRef: "String!", resolve: graphQLProperty(func(d graphQLDirective) interface{} { return d.name })},
+		{name: "description", typeRef: "String", resolve: graphQLProperty(func(d graphQLDirective) interface{} {
+			return d.description
+		})},
+		{name: "locations", typeRef: "[__DirectiveLocation!]!", resolve: graphQLProperty(func(d graphQLDirective) interface{} {
+			return d.locations
+		})},
+		{name: "args", typeRef: "[__InputValue!]!",
+			args:    []graphQLArgument{{name: "includeDeprecated", typeRef: "Boolean"}},
+			resolve: graphQLProperty(func(d graphQLDirective) interface{} { return d.args })},
+		{name: "isRepeatable", typeRef: "Boolean!", resolve: alwaysFalse},
+	}})
+
+}
+
+// Add the __schema and __type introspection fields to our query type. This must be called once
+// our query type has been added to the schema.
+func (schema *graphQLSchema) addIntrospectionFields() {
+
+	queryType := schema.types[schema.queryType]
+
+	queryType.fields = append(queryType.fields,
+		&graphQLField{name: "__schema", typeRef: "__Schema!",
+			resolve: func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				return schema, nil
+			}},
+		&graphQLField{name: "__type", typeRef: "__Type",
+			args: []graphQLArgument{{name: "name", typeRef: "String!"}},
+			resolve: func(r *http.Request, source interface{}, args map[string]interface{}) (interface{}, error) {
+				name, _ := args["name"].(string)
+				if _, ok := schema.types[name]; !ok {
+					return nil, nil
+				}
+				return graphQLTypeRef{schema: schema, ref: name}, nil
+			}},
+	)
+
+}
+
+func (t graphQLTypeRef) kind() string {
+	switch {
+	case strings.HasSuffix(t.ref, "!"):
+		return "NON_NULL"
+	case strings.HasPrefix(t.ref, "["):
+		return "LIST"
+	}
+	return t.schema.types[t.ref].kind
+}
+
+// Returns the named type this reference refers to, or nil for lists and non null types
+func (t graphQLTypeRef) named() *graphQLType {
+	if kind := t.kind(); kind == "NON_NULL" || kind == "LIST" {
+		return nil
+	}
+	return t.schema.types[t.ref]
+}
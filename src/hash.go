@@ -0,0 +1,464 @@
+// Our hashing and ID generator utility, for quick ops use from a browser. /hash shows the MD5,
+// SHA-1, SHA-256 and SHA-512 digests of pasted text or uploaded files, and generates UUIDs and
+// ULIDs. Scripts can use POST /api/v1/hash (which hashes the request's body) along with
+// GET /api/v1/uuid and GET /api/v1/ulid.
+//
+// Files are hashed as they're streamed in, so they're never held in memory or written to disk,
+// and may be as large as our uploads (see the -max-upload-size flag).
+//
+// UUIDs are version 4 (random) or version 7 (which start with a timestamp, so they sort by when
+// they were made). ULIDs also start with a timestamp, and those made within the same
+// millisecond count up from each other, so they sort in the order they were made too.
+
+//go:build !nohash
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_HASH_TEXT_SIZE = 1 << 20                            // The most pasted text we'll hash
+	MAX_GENERATED_IDS  = 1000                               // The most UUIDs or ULIDs we'll generate at once
+	ULID_ALPHABET      = "0123456789ABCDEFGHJKMNPQRSTVWXYZ" // Crockford's base 32
+)
+
+// A hash function we offer
+type hashAlgorithm struct {
+	Name  string
+	Title string
+	New   func() hash.Hash
+}
+
+// The hash functions we offer, in the order we display them
+var hashAlgorithms = []hashAlgorithm{
+	{Name: "md5", Title: "MD5", New: md5.New},
+	{Name: "sha1", Title: "SHA-1", New: sha1.New},
+	{Name: "sha256", Title: "SHA-256", New: sha256.New},
+	{Name: "sha512", Title: "SHA-512", New: sha512.New},
+}
+
+// The digests of some text or a file
+type hashResult struct {
+	Name    string            `json:"name,omitempty"` // The file's name (empty for text)
+	Size    int64             `json:"size"`
+	Digests map[string]string `json:"digests"` // Hex encoded, keyed by our algorithm names
+}
+
+// The kinds of IDs we generate
+var idKinds = map[string]func() string{
+	"uuid4": newUUIDv4,
+	"uuid7": newUUIDv7,
+	"ulid":  newULID,
+}
+
+// The last ULID we generated, which the next ULID counts up from if it's made within the same
+// millisecond
+var lastULID = struct {
+	mutex sync.Mutex
+	time  int64
+	id    [16]byte
+}{}
+
+// The data we pass into our hash body template
+type hashPageData struct {
+	Text       string
+	Algorithms []hashAlgorithm
+	Results    []hashResult
+	Generate   string
+	Count      int
+	IDs        []string
+}
+
+// The body content of our hash page. The values are escaped by html/template.
+const HASH_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>Hashes</h2>
+		<form action="{{ url "/hash" }}" method="POST" enctype="multipart/form-data">
+			<textarea name="text" rows=6 cols=80 spellcheck="false" placeholder="Text to hash">{{ .Text }}</textarea>
+			<p>
+				<input type="file" name="file" multiple>
+				<input type="submit" value="Hash">
+			</p>
+		</form>
+		{{ range .Results }}
+		<h4>{{ if .Name }}{{ .Name }}{{ else }}Text{{ end }} ({{ .Size }} bytes)</h4>
+		<table style="margin: auto; text-align: left;">
+			{{ $digests := .Digests }}
+			{{ range $.Algorithms }}
+			<tr><th>{{ .Title }}</th><td><code>{{ index $digests .Name }}</code></td></tr>
+			{{ end }}
+		</table>
+		{{ end }}
+		<h2>IDs</h2>
+		<form action="{{ url "/hash" }}" method="GET">
+			<select name="generate">
+				<option value="uuid4"{{ if eq .Generate "uuid4" }} selected{{ end }}>UUID (version 4, random)</option>
+				<option value="uuid7"{{ if eq .Generate "uuid7" }} selected{{ end }}>UUID (version 7, time ordered)</option>
+				<option value="ulid"{{ if eq .Generate "ulid" }} selected{{ end }}>ULID</option>
+			</select>
+			<input type="number" name="count" min=1 max=1000 value="{{ .Count }}">
+			<input type="submit" value="Generate">
+		</form>
+		{{ if .IDs }}
+		<pre>{{ range .IDs }}{{ . }}
+{{ end }}</pre>
+		{{ end }}
+	</div>
+`
+
+var hashBodyTemplate *template.Template
+
+// Our hashing and ID demo app (see demoapps.go)
+type hashApp struct {
+	demoAppDefaults
+}
+
+func init() {
+	registerDemoApp(hashApp{})
+}
+
+func (hashApp) Name() string {
+	return "hash"
+}
+
+func (hashApp) NavEntry() *Page {
+	return &Page{Title: "Hash", Path: "/hash", Order: 78, Visible: true, Section: SECTION_UTILITIES, Handler: hashHandler,
+		Methods: []string{http.MethodGet, http.MethodPost}}
+}
+
+func (hashApp) Routes() []DemoRoute {
+	return []DemoRoute{
+		{Pattern: "/api/v1/hash", Handler: http.HandlerFunc(hashAPIHandler), Methods: []string{http.MethodPost}},
+		{Pattern: "/api/v1/uuid", Handler: http.HandlerFunc(uuidHandler), Methods: []string{http.MethodGet}},
+		{Pattern: "/api/v1/ulid", Handler: http.HandlerFunc(ulidHandler), Methods: []string{http.MethodGet}},
+	}
+}
+
+func (hashApp) Templates() []templateDefinition {
+	return []templateDefinition{{
+		name:       "hash.body",
+		source:     HASH_BODY_TEMPLATE,
+		target:     &hashBodyTemplate,
+		sampleData: hashPageData{Algorithms: hashAlgorithms, Results: []hashResult{{Digests: map[string]string{"md5": "sample"}}}, IDs: []string{"sample"}},
+	}}
+}
+
+// Hash everything the given reader holds with all of our algorithms
+func hashReader(reader io.Reader) (hashResult, error) {
+
+	hashes := make([]hash.Hash, len(hashAlgorithms))
+	writers := make([]io.Writer, len(hashAlgorithms))
+	for i, algorithm := range hashAlgorithms {
+		hashes[i] = algorithm.New()
+		writers[i] = hashes[i]
+	}
+
+	size, err := io.Copy(io.MultiWriter(writers...), reader)
+	if err != nil {
+		return hashResult{}, err
+	}
+
+	result := hashResult{Size: size, Digests: map[string]string{}}
+	for i, algorithm := range hashAlgorithms {
+		result.Digests[algorithm.Name] = hex.EncodeToString(hashes[i].Sum(nil))
+	}
+
+	return result, nil
+
+}
+
+// Returns a request error for the given error while reading a request body
+func hashReadError(err error) error {
+
+	var maxBytesError *http.MaxBytesError
+
+	if errors.As(err, &maxBytesError) {
+		return newAppError(http.StatusRequestEntityTooLarge, "too_large",
+			fmt.Sprintf("Files may be at most %d bytes.", maxUploadSize)).Wrap(err)
+	}
+
+	return badRequestError("The request was incomplete or malformed.").Wrap(err)
+
+}
+
+// Hash the pasted text and files of the given multipart form, returning the text along with
+// the digests
+func hashForm(w http.ResponseWriter, r *http.Request) (string, []hashResult, error) {
+
+	// Large files take longer than our server's global read timeout
+	extendReadDeadline(w, r, UPLOAD_READ_TIMEOUT)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+	multipartReader, err := r.MultipartReader()
+	if err != nil {
+		return "", nil, badRequestError("The form must be sent as multipart/form-data.").Wrap(err)
+	}
+
+	var text string
+	var results []hashResult
+
+	for {
+		part, err := multipartReader.NextPart()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return "", nil, hashReadError(err)
+		}
+
+		switch {
+		case part.FileName() != "":
+			result, err := hashReader(part)
+			if err != nil {
+				return "", nil, hashReadError(err)
+			}
+			result.Name = sanitiseFileName(part.FileName())
+			results = append(results, result)
+
+		case part.FormName() == "text":
+			value, err := io.ReadAll(io.LimitReader(part, MAX_HASH_TEXT_SIZE+1))
+			if err != nil {
+				return "", nil, hashReadError(err)
+			}
+			if len(value) > MAX_HASH_TEXT_SIZE {
+				return "", nil, newAppError(http.StatusRequestEntityTooLarge, "too_large",
+					fmt.Sprintf("Text may be at most %d bytes (upload it as a file instead).", MAX_HASH_TEXT_SIZE))
+			}
+			if text = string(value); text != "" {
+				result, _ := hashReader(bytes.NewReader(value))
+				results = append([]hashResult{result}, results...)
+			}
+		}
+	}
+
+	return text, results, nil
+
+}
+
+// This is our hash handler. POST requests hash the submitted text and files, while GET
+// requests with a generate parameter generate IDs. The results are displayed below our forms.
+func hashHandler(w http.ResponseWriter, r *http.Request) {
+
+	data := hashPageData{Algorithms: hashAlgorithms, Generate: "uuid4", Count: 1}
+
+	if r.Method == http.MethodPost {
+
+		endSpan := startSpan(r.Context(), "hash")
+		text, results, err := hashForm(w, r)
+		endSpan()
+
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		data.Text, data.Results = text, results
+		incrementCounter("hashes_total", "source", "page")
+
+	} else if kind := r.URL.Query().Get("generate"); kind != "" {
+
+		ids, err := generateIDs(kind, r.URL.Query().Get("count"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		data.Generate, data.Count, data.IDs = kind, len(ids), ids
+
+	}
+
+	body, err := renderFragment(hashBodyTemplate, data)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the hash body template"))
+		return
+	}
+
+	renderMainTemplate(w, r, "hash", HtmlData{
+		Title:       "Golang Hashes and IDs",
+		Description: "MD5, SHA-1, SHA-256 and SHA-512 digests of text and files, and UUID and ULID generation.",
+		Keywords:    "golang web server md5 sha1 sha256 sha512 hash uuid ulid generator",
+		CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+		BodyContent: body,
+	})
+
+}
+
+// This is our hash API, which returns the digests of the request's body
+func hashAPIHandler(w http.ResponseWriter, r *http.Request) {
+
+	extendReadDeadline(w, r, UPLOAD_READ_TIMEOUT)
+
+	endSpan := startSpan(r.Context(), "hash")
+	result, err := hashReader(http.MaxBytesReader(w, r.Body, maxUploadSize))
+	endSpan()
+
+	if err != nil {
+		writeError(w, r, hashReadError(err))
+		return
+	}
+
+	incrementCounter("hashes_total", "source", "api")
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	json.NewEncoder(w).Encode(result)
+
+}
+
+// Generate the given number (1 by default) of the given kind of ID
+func generateIDs(kind string, count string) ([]string, error) {
+
+	newID, found := idKinds[kind]
+	if !found {
+		return nil, badRequestError("Unknown kind of ID. Choose one of uuid4, uuid7 or ulid.")
+	}
+
+	n := 1
+	if count != "" {
+		var err error
+		if n, err = strconv.Atoi(count); err != nil || n < 1 || n > MAX_GENERATED_IDS {
+			return nil, badRequestError(fmt.Sprintf("The count must be a number from 1 to %d.", MAX_GENERATED_IDS))
+		}
+	}
+
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = newID()
+	}
+
+	incrementCounter("ids_generated_total", "kind", kind)
+
+	return ids, nil
+
+}
+
+// This is our UUID API. The version parameter chooses version 4 (the default) or 7 UUIDs, and
+// the count parameter how many to generate.
+func uuidHandler(w http.ResponseWriter, r *http.Request) {
+
+	version := r.URL.Query().Get("version")
+	if version == "" {
+		version = "4"
+	}
+	if version != "4" && version != "7" {
+		writeError(w, r, badRequestError("The UUID version must be 4 or 7."))
+		return
+	}
+
+	ids, err := generateIDs("uuid"+version, r.URL.Query().Get("count"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	json.NewEncoder(w).Encode(map[string][]string{"uuids": ids})
+
+}
+
+// This is our ULID API. The count parameter chooses how many to generate.
+func ulidHandler(w http.ResponseWriter, r *http.Request) {
+
+	ids, err := generateIDs("ulid", r.URL.Query().Get("count"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	json.NewEncoder(w).Encode(map[string][]string{"ulids": ids})
+
+}
+
+// Returns the given 16 bytes in the standard UUID format
+func formatUUID(id [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+// Returns a new random (version 4) UUID. See RFC 9562.
+func newUUIDv4() string {
+	var id [16]byte
+	rand.Read(id[:])
+	id[6] = id[6]&0x0f | 0x40 // Version 4
+	id[8] = id[8]&0x3f | 0x80 // The RFC 9562 variant
+	return formatUUID(id)
+}
+
+// Returns a new time ordered (version 7) UUID, which starts with the Unix time in milliseconds
+func newUUIDv7() string {
+	var id [16]byte
+	rand.Read(id[6:])
+	milliseconds := uint64(time.Now().UnixMilli())
+	binary.BigEndian.PutUint16(id[0:2], uint16(milliseconds>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(milliseconds))
+	id[6] = id[6]&0x0f | 0x70 // Version 7
+	id[8] = id[8]&0x3f | 0x80 // The RFC 9562 variant
+	return formatUUID(id)
+}
+
+// Returns a new ULID: 48 bits of Unix time in milliseconds followed by 80 random bits, in
+// Crockford's base 32. See https://github.com/ulid/spec.
+func newULID() string {
+
+	lastULID.mutex.Lock()
+	defer lastULID.mutex.Unlock()
+
+	now := time.Now().UnixMilli()
+	id := lastULID.id
+
+	// Within the same millisecond we add one to our last ULID's random bits, so that our ULIDs
+	// stay in order. If they're all ones (which is vanishingly unlikely) we start afresh.
+	incremented := false
+	if now == lastULID.time {
+		for i := 15; i >= 6 && !incremented; i-- {
+			id[i]++
+			incremented = id[i] != 0
+		}
+	}
+
+	if !incremented {
+		rand.Read(id[6:])
+	}
+
+	binary.BigEndian.PutUint16(id[0:2], uint16(now>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(now))
+	lastULID.time, lastULID.id = now, id
+
+	// Each character holds 5 of the ULID's 128 bits, which are padded with 2 leading zero bits
+	var encoded strings.Builder
+	for i := range 26 {
+		value := 0
+		for bit := i*5 - 2; bit < i*5+3; bit++ {
+			value <<= 1
+			if bit >= 0 && id[bit/8]&(0x80>>(bit%8)) != 0 {
+				value |= 1
+			}
+		}
+		encoded.WriteByte(ULID_ALPHABET[value])
+	}
+
+	return encoded.String()
+
+}
@@ -0,0 +1,207 @@
+// Header rewrite rules. The (repeatable) -header-rule flag adds, removes or rewrites the headers
+// of the requests we receive (before they reach our handlers, or are proxied to an upstream) or
+// of the responses we send, for the paths under a prefix. Each rule takes the form
+//
+//	<request|response> <path prefix> <action> <header name> [value]
+//
+// where the action is one of:
+//
+//   - set: replace the header with the value
+//   - add: add the value to the header (keeping any existing values)
+//   - remove: remove the header
+//   - rewrite: replace the matches of a regular expression within the header's values, with
+//     the value being the expression and its replacement separated by a space
+//
+// Values can include {request_id} and {client_ip}, which are replaced with the request's ID and
+// the client's IP address. For example:
+//
+//	-header-rule "response / remove Server"
+//	-header-rule "response /svg set X-Frame-Options SAMEORIGIN"
+//	-header-rule "request / set X-Forwarded-Request-Id {request_id}"
+//	-header-rule "response / rewrite Location ^http://(.*)$ https://$1"
+//
+// Rules are applied in the order they're given, so a later rule sees the headers left by the
+// earlier ones. Response rules are applied just before the response's headers are written, so
+// they see (and can change) the headers set by every handler and middleware.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// A single header rule
+type headerRule struct {
+	response    bool // Whether the rule applies to responses (rather than requests)
+	pathPrefix  string
+	action      string
+	name        string
+	value       string
+	pattern     *regexp.Regexp // The expression of rewrite rules
+	replacement string         // The replacement of rewrite rules
+}
+
+// The list of header rules passed in via the -header-rule flag. It implements flag.Value so
+// that the flag can be repeated.
+type headerRules []headerRule
+
+var headerRuleList headerRules
+
+func (rules *headerRules) String() string {
+	return fmt.Sprint(len(*rules), " rules")
+}
+
+func (rules *headerRules) Set(ruleString string) error {
+
+	fields := strings.Fields(ruleString)
+
+	if len(fields) < 4 {
+		return fmt.Errorf("invalid header rule %q: expected <request|response> <path prefix> <action> <header name> [value]", ruleString)
+	}
+
+	rule := headerRule{
+		response:   fields[0] == "response",
+		pathPrefix: fields[1],
+		action:     fields[2],
+		name:       http.CanonicalHeaderKey(fields[3]),
+		value:      strings.Join(fields[4:], " "),
+	}
+
+	if fields[0] != "request" && fields[0] != "response" {
+		return fmt.Errorf("invalid header rule %q: rules apply to a request or a response", ruleString)
+	}
+
+	if !strings.HasPrefix(rule.pathPrefix, "/") {
+		return fmt.Errorf("invalid header rule %q: the path prefix must start with a /", ruleString)
+	}
+
+	switch rule.action {
+	case "set", "add":
+		if rule.value == "" {
+			return fmt.Errorf("invalid header rule %q: %s rules need a value", ruleString, rule.action)
+		}
+
+	case "remove":
+		if rule.value != "" {
+			return fmt.Errorf("invalid header rule %q: remove rules don't take a value", ruleString)
+		}
+
+	case "rewrite":
+		expression, replacement, found := strings.Cut(rule.value, " ")
+		if !found {
+			return fmt.Errorf("invalid header rule %q: rewrite rules need an expression and a replacement", ruleString)
+		}
+		pattern, err := regexp.Compile(expression)
+		if err != nil {
+			return fmt.Errorf("invalid header rule %q: %v", ruleString, err)
+		}
+		rule.pattern, rule.replacement = pattern, replacement
+
+	default:
+		return fmt.Errorf("invalid header rule %q: expected a set, add, remove or rewrite action", ruleString)
+	}
+
+	*rules = append(*rules, rule)
+
+	return nil
+
+}
+
+// Apply the rules for the requests (or responses) of the given request to the given headers
+func (rules headerRules) apply(r *http.Request, header http.Header, response bool) {
+
+	for _, rule := range rules {
+
+		if rule.response != response || !strings.HasPrefix(r.URL.Path, rule.pathPrefix) {
+			continue
+		}
+
+		switch rule.action {
+		case "set":
+			header.Set(rule.name, expandHeaderValue(r, rule.value))
+		case "add":
+			header.Add(rule.name, expandHeaderValue(r, rule.value))
+		case "remove":
+			header.Del(rule.name)
+		case "rewrite":
+			for index, value := range header[rule.name] {
+				header[rule.name][index] = rule.pattern.ReplaceAllString(value, rule.replacement)
+			}
+		}
+
+	}
+
+}
+
+// Replace the placeholders in the given header value
+func expandHeaderValue(r *http.Request, value string) string {
+
+	if !strings.Contains(value, "{") {
+		return value
+	}
+
+	requestID, _ := r.Context().Value(REQUEST_ID_KEY).(string)
+
+	return strings.NewReplacer("{request_id}", requestID, "{client_ip}", clientAddress(r)).Replace(value)
+
+}
+
+// Returns a handler which applies our header rules to requests and responses
+func headerRulesHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if len(headerRuleList) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Our handlers may hold on to the original request, so we change a copy of it
+		r = r.Clone(r.Context())
+		headerRuleList.apply(r, r.Header, false)
+
+		next.ServeHTTP(&headerRulesWriter{ResponseWriter: w, r: r}, r)
+
+	})
+}
+
+// A headerRulesWriter applies our response header rules just before the headers are written
+type headerRulesWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	wroteHeader bool
+}
+
+func (writer *headerRulesWriter) applyRules() {
+	if !writer.wroteHeader {
+		writer.wroteHeader = true
+		headerRuleList.apply(writer.r, writer.Header(), true)
+	}
+}
+
+func (writer *headerRulesWriter) WriteHeader(status int) {
+	// Informational responses (i.e. 103 Early Hints) come before the real headers
+	if status >= 200 {
+		writer.applyRules()
+	}
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *headerRulesWriter) Write(data []byte) (int, error) {
+	writer.applyRules()
+	return writer.ResponseWriter.Write(data)
+}
+
+func (writer *headerRulesWriter) Flush() {
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		writer.applyRules()
+		flusher.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying response writer
+func (writer *headerRulesWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestHeaderRulesApplyInOrder(t *testing.T) {
+
+	defer func(rules headerRules) { headerRuleList = rules }(headerRuleList)
+
+	tests := []struct {
+		name     string
+		rules    []string
+		path     string
+		header   string   // The response header we check
+		want     []string // Its values (nil for none)
+		received []string // The values of the X-Test request header our handler saw, if we check them
+	}{
+		{
+			name:   "a later set overrides an earlier one",
+			rules:  []string{"response / set X-Test one", "response / set X-Test two"},
+			path:   "/",
+			header: "X-Test",
+			want:   []string{"two"},
+		},
+		{
+			name:   "a later remove undoes an earlier set",
+			rules:  []string{"response / set X-Test one", "response / remove X-Test"},
+			path:   "/",
+			header: "X-Test",
+			want:   nil,
+		},
+		{
+			name:   "a later set restores an earlier remove",
+			rules:  []string{"response / remove X-Test", "response / set X-Test one"},
+			path:   "/",
+			header: "X-Test",
+			want:   []string{"one"},
+		},
+		{
+			name:   "adds keep their order",
+			rules:  []string{"response / add X-Test one", "response / add X-Test two"},
+			path:   "/",
+			header: "X-Test",
+			want:   []string{"one", "two"},
+		},
+		{
+			name:   "a rewrite sees the value an earlier rule set",
+			rules:  []string{"response / set Location http://example.com/", "response / rewrite Location ^http://(.*)$ https://$1"},
+			path:   "/",
+			header: "Location",
+			want:   []string{"https://example.com/"},
+		},
+		{
+			name:   "the later of two matching prefixes wins",
+			rules:  []string{"response / set X-Frame-Options DENY", "response /svg set X-Frame-Options SAMEORIGIN"},
+			path:   "/svg",
+			header: "X-Frame-Options",
+			want:   []string{"SAMEORIGIN"},
+		},
+		{
+			name:   "a later rule wins even when its prefix is shorter",
+			rules:  []string{"response /svg set X-Frame-Options SAMEORIGIN", "response / set X-Frame-Options DENY"},
+			path:   "/svg",
+			header: "X-Frame-Options",
+			want:   []string{"DENY"},
+		},
+		{
+			name:   "rules for other paths don't apply",
+			rules:  []string{"response / set X-Frame-Options DENY", "response /svg set X-Frame-Options SAMEORIGIN"},
+			path:   "/excel",
+			header: "X-Frame-Options",
+			want:   []string{"DENY"},
+		},
+		{
+			name:   "response rules override the headers our handlers set",
+			rules:  []string{"response / set X-Handler rule"},
+			path:   "/",
+			header: "X-Handler",
+			want:   []string{"rule"},
+		},
+		{
+			name:   "response rules can remove the headers our handlers set",
+			rules:  []string{"response / remove X-Handler"},
+			path:   "/",
+			header: "X-Handler",
+			want:   nil,
+		},
+		{
+			name:     "request rules apply in order too",
+			rules:    []string{"request / set X-Test one", "request / add X-Test two", "request / rewrite X-Test ^one$ first"},
+			path:     "/",
+			header:   "X-Handler",
+			want:     []string{"handler"},
+			received: []string{"first", "two"},
+		},
+		{
+			name:     "request and response rules don't affect each other",
+			rules:    []string{"request / set X-Test request", "response / remove X-Test"},
+			path:     "/",
+			header:   "X-Test",
+			want:     nil,
+			received: []string{"request"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			headerRuleList = nil
+			for _, rule := range test.rules {
+				if err := headerRuleList.Set(rule); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var received []string
+			handler := headerRulesHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r.Header.Values("X-Test")
+				w.Header().Set("X-Handler", "handler")
+				w.Write([]byte("ok"))
+			}))
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+			if got := w.Result().Header.Values(test.header); !slices.Equal(got, test.want) {
+				t.Errorf("got %s %q, want %q", test.header, got, test.want)
+			}
+			if test.received != nil && !slices.Equal(received, test.received) {
+				t.Errorf("our handler got X-Test %q, want %q", received, test.received)
+			}
+
+		})
+	}
+
+}
@@ -0,0 +1,437 @@
+// Server-side syntax highlighting. POST /api/v1/highlight takes a JSON object with some code and
+// its language and returns the code as HTML, with its keywords, strings, comments and so on
+// wrapped in spans (i.e. <span class="hl-keyword">func</span>) which HIGHLIGHT_CSS_TEMPLATE
+// styles. Our markdown pages highlight their fenced code blocks the same way (see markdown.go),
+// so none of our pages need a client-side highlighter.
+//
+// Rather than parsing each language properly we tokenise it with a small table of its keywords,
+// comment and string delimiters, which is how most highlighters work and is plenty for display.
+// Markup (HTML and XML) has its own tokeniser for tags, attributes and comments.
+//
+// The generated HTML is safe to embed in any page: every piece of the code is HTML escaped and
+// the only markup we add is our own spans, so highlighting can never pass through markup (or
+// scripts) which were in the code.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The largest code we'll highlight
+const MAX_HIGHLIGHT_SIZE = 1 << 20
+
+// This is our highlighting stylesheet (for pages which include highlighted code)
+const HIGHLIGHT_CSS_TEMPLATE = `
+<style>
+	pre code { display: block; text-align: left; overflow-x: auto; padding: 8px; background: #f6f8fa; }
+	.hl-keyword { color: #d73a49; }
+	.hl-builtin { color: #6f42c1; }
+	.hl-string { color: #032f62; }
+	.hl-number { color: #005cc5; }
+	.hl-comment { color: #6a737d; font-style: italic; }
+	.hl-tag { color: #22863a; }
+	.hl-attr { color: #6f42c1; }
+</style>
+`
+
+// A language we can highlight
+type highlightLanguage struct {
+	names         []string // Its name followed by any aliases (i.e. js for javascript)
+	keywords      []string
+	builtins      []string // Built in types, functions and constants
+	lineComments  []string
+	blockComments [][2]string
+	quotes        string   // The characters which start (and end) strings
+	rawQuotes     string   // The characters which start strings without escape sequences
+	longStrings   []string // Delimiters of strings which may span lines (i.e. Python's """)
+	ignoreCase    bool     // Whether keywords are case insensitive (i.e. SQL)
+	markup        bool     // Whether the language is HTML / XML
+}
+
+// The languages we highlight
+var highlightLanguages = []highlightLanguage{
+	{
+		names: []string{"go", "golang"},
+		keywords: []string{"break", "case", "chan", "const", "continue", "default", "defer", "else",
+			"fallthrough", "for", "func", "go", "goto", "if", "import", "interface", "map", "package",
+			"range", "return", "select", "struct", "switch", "type", "var"},
+		builtins: []string{"any", "bool", "byte", "comparable", "complex64", "complex128", "error",
+			"float32", "float64", "int", "int8", "int16", "int32", "int64", "rune", "string", "uint",
+			"uint8", "uint16", "uint32", "uint64", "uintptr", "true", "false", "iota", "nil", "append",
+			"cap", "clear", "close", "complex", "copy", "delete", "imag", "len", "make", "max", "min",
+			"new", "panic", "print", "println", "real", "recover"},
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        "\"'`",
+		rawQuotes:     "`",
+	},
+	{
+		names: []string{"javascript", "js", "typescript", "ts"},
+		keywords: []string{"async", "await", "break", "case", "catch", "class", "const", "continue",
+			"debugger", "default", "delete", "do", "else", "export", "extends", "finally", "for",
+			"from", "function", "if", "import", "in", "instanceof", "interface", "let", "new", "of",
+			"return", "static", "super", "switch", "this", "throw", "try", "type", "typeof", "var",
+			"void", "while", "with", "yield"},
+		builtins: []string{"true", "false", "null", "undefined", "NaN", "Infinity", "Array", "Boolean",
+			"Date", "Error", "JSON", "Map", "Math", "Number", "Object", "Promise", "RegExp", "Set",
+			"String", "Symbol", "console", "document", "window"},
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        "\"'`",
+	},
+	{
+		names:    []string{"json"},
+		builtins: []string{"true", "false", "null"},
+		quotes:   "\"",
+	},
+	{
+		names: []string{"python", "py"},
+		keywords: []string{"and", "as", "assert", "async", "await", "break", "class", "continue",
+			"def", "del", "elif", "else", "except", "finally", "for", "from", "global", "if", "import",
+			"in", "is", "lambda", "nonlocal", "not", "or", "pass", "raise", "return", "try", "while",
+			"with", "yield"},
+		builtins: []string{"True", "False", "None", "self", "print", "len", "range", "int", "str",
+			"float", "list", "dict", "set", "tuple", "bool", "open", "enumerate", "zip", "isinstance"},
+		lineComments: []string{"#"},
+		quotes:       "\"'",
+		longStrings:  []string{`"""`, `'''`},
+	},
+	{
+		names: []string{"bash", "sh", "shell"},
+		keywords: []string{"case", "do", "done", "elif", "else", "esac", "export", "fi", "for",
+			"function", "if", "in", "local", "return", "then", "until", "while"},
+		builtins: []string{"cd", "echo", "exit", "printf", "read", "set", "shift", "source", "test",
+			"unset"},
+		lineComments: []string{"#"},
+		quotes:       "\"'",
+		rawQuotes:    "'",
+	},
+	{
+		names: []string{"sql"},
+		keywords: []string{"add", "all", "alter", "and", "as", "asc", "between", "by", "case", "create",
+			"delete", "desc", "distinct", "drop", "else", "end", "exists", "from", "group", "having",
+			"in", "index", "inner", "insert", "into", "is", "join", "key", "left", "like", "limit",
+			"not", "null", "offset", "on", "or", "order", "outer", "primary", "right", "select", "set",
+			"table", "then", "union", "unique", "update", "values", "when", "where", "with"},
+		builtins: []string{"avg", "count", "max", "min", "sum", "coalesce", "integer", "text",
+			"varchar", "boolean", "timestamp", "true", "false"},
+		lineComments:  []string{"--"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        "'\"",
+		ignoreCase:    true,
+	},
+	{
+		names:         []string{"css"},
+		keywords:      []string{"important"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        "\"'",
+	},
+	{
+		names:  []string{"html", "xml", "svg"},
+		markup: true,
+	},
+}
+
+// Returns the language with the given name or alias
+func findHighlightLanguage(name string) (*highlightLanguage, bool) {
+
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	for i := range highlightLanguages {
+		if slices.Contains(highlightLanguages[i].names, name) {
+			return &highlightLanguages[i], true
+		}
+	}
+
+	return nil, false
+
+}
+
+// Returns the names of the languages we highlight (along with "text", for no highlighting)
+func highlightLanguageNames() []string {
+
+	names := []string{"text"}
+	for _, language := range highlightLanguages {
+		names = append(names, language.names[0])
+	}
+
+	return names
+
+}
+
+// Highlight the given code as the given language. Unknown languages (and "text") are escaped
+// without any highlighting.
+func highlightCode(code string, languageName string) template.HTML {
+
+	language, found := findHighlightLanguage(languageName)
+
+	if !found {
+		return template.HTML(html.EscapeString(code))
+	}
+
+	var output strings.Builder
+
+	if language.markup {
+		highlightMarkup(&output, code)
+	} else {
+		language.highlight(&output, code)
+	}
+
+	// template-audit: our highlighters escape every token they write
+	return template.HTML(output.String())
+
+}
+
+// Write the given text to our output, escaped and wrapped in a span of the given class
+func writeHighlightSpan(output *strings.Builder, class string, text string) {
+	output.WriteString(`<span class="hl-` + class + `">`)
+	output.WriteString(html.EscapeString(text))
+	output.WriteString(`</span>`)
+}
+
+// Returns true if the given rune can be part of an identifier
+func isIdentifierRune(r rune) bool {
+	return r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Tokenise and highlight the given code
+func (language *highlightLanguage) highlight(output *strings.Builder, code string) {
+
+	// The end of the token starting at i which ends with the given delimiter (or the end of
+	// our code, if it's never closed)
+	until := func(i int, delimiter string) int {
+		if end := strings.Index(code[i:], delimiter); end >= 0 {
+			return i + end + len(delimiter)
+		}
+		return len(code)
+	}
+
+	plain := 0 // The start of the text we haven't written yet
+
+	token := func(start int, end int, class string) {
+		output.WriteString(html.EscapeString(code[plain:start]))
+		writeHighlightSpan(output, class, code[start:end])
+		plain = end
+	}
+
+	for i := 0; i < len(code); {
+
+		rest := code[i:]
+
+		if _, found := hasAnyPrefix(rest, language.lineComments); found {
+			end := len(code)
+			if index := strings.IndexByte(rest, '\n'); index >= 0 {
+				end = i + index
+			}
+			token(i, end, "comment")
+			i = end
+			continue
+		}
+
+		if comment := slices.IndexFunc(language.blockComments, func(delimiters [2]string) bool {
+			return strings.HasPrefix(rest, delimiters[0])
+		}); comment >= 0 {
+			delimiters := language.blockComments[comment]
+			token(i, until(i+len(delimiters[0]), delimiters[1]), "comment")
+			i = plain
+			continue
+		}
+
+		if delimiter, found := hasAnyPrefix(rest, language.longStrings); found {
+			token(i, until(i+len(delimiter), delimiter), "string")
+			i = plain
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(rest)
+
+		switch {
+
+		case strings.ContainsRune(language.quotes, r):
+			end := i + size
+			for end < len(code) && code[end] != byte(r) {
+				// Escape sequences can escape our quote, and only backquoted strings span lines
+				if code[end] == '\\' && !strings.ContainsRune(language.rawQuotes, r) {
+					end++
+				} else if code[end] == '\n' && r != '`' {
+					break
+				}
+				end++
+			}
+			if end < len(code) && code[end] == byte(r) {
+				end++
+			}
+			token(i, min(end, len(code)), "string")
+			i = plain
+
+		case unicode.IsDigit(r) && (i == 0 || !isIdentifierRune(rune(code[i-1]))):
+			end := i
+			for end < len(code) && (isIdentifierRune(rune(code[end])) || code[end] == '.') {
+				end++
+			}
+			token(i, end, "number")
+			i = end
+
+		case isIdentifierRune(r):
+			end := i
+			for end < len(code) {
+				next, nextSize := utf8.DecodeRuneInString(code[end:])
+				if !isIdentifierRune(next) {
+					break
+				}
+				end += nextSize
+			}
+			word := code[i:end]
+			if language.ignoreCase {
+				word = strings.ToLower(word)
+			}
+			if slices.Contains(language.keywords, word) {
+				token(i, end, "keyword")
+			} else if slices.Contains(language.builtins, word) {
+				token(i, end, "builtin")
+			}
+			i = end
+
+		default:
+			i += size
+		}
+	}
+
+	output.WriteString(html.EscapeString(code[plain:]))
+
+}
+
+// Returns the first of the given prefixes which the given text starts with
+func hasAnyPrefix(text string, prefixes []string) (string, bool) {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(text, prefix) {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// Tokenise and highlight the given HTML or XML, which is made up of text, comments and tags
+// (which have a name, then attributes with optional quoted values)
+func highlightMarkup(output *strings.Builder, code string) {
+
+	for i := 0; i < len(code); {
+
+		rest := code[i:]
+
+		if strings.HasPrefix(rest, "<!--") {
+			end := len(code)
+			if index := strings.Index(rest[4:], "-->"); index >= 0 {
+				end = i + 4 + index + 3
+			}
+			writeHighlightSpan(output, "comment", code[i:end])
+			i = end
+			continue
+		}
+
+		if rest[0] != '<' {
+			end := len(code)
+			if index := strings.IndexByte(rest, '<'); index >= 0 {
+				end = i + index
+			}
+			output.WriteString(html.EscapeString(code[i:end]))
+			i = end
+			continue
+		}
+
+		// The tag's opening bracket and name (i.e. "<div", "</p" or "<?xml")
+		end := i + 1
+		for end < len(code) && strings.IndexByte("/?!", code[end]) >= 0 {
+			end++
+		}
+		for end < len(code) && !isMarkupSpace(code[end]) && code[end] != '>' && code[end] != '/' {
+			end++
+		}
+		writeHighlightSpan(output, "tag", code[i:end])
+		i = end
+
+		// Its attributes, up to the closing bracket
+		for i < len(code) && code[i] != '>' {
+			switch {
+			case isMarkupSpace(code[i]) || code[i] == '=':
+				output.WriteString(html.EscapeString(code[i : i+1]))
+				i++
+			case code[i] == '"' || code[i] == '\'':
+				end := len(code)
+				if index := strings.IndexByte(code[i+1:], code[i]); index >= 0 {
+					end = i + 1 + index + 1
+				}
+				writeHighlightSpan(output, "string", code[i:end])
+				i = end
+			case code[i] == '/' || code[i] == '?':
+				writeHighlightSpan(output, "tag", code[i:i+1])
+				i++
+			default:
+				end := i
+				for end < len(code) && !isMarkupSpace(code[end]) && strings.IndexByte("=>/", code[end]) < 0 {
+					end++
+				}
+				writeHighlightSpan(output, "attr", code[i:end])
+				i = end
+			}
+		}
+
+		if i < len(code) {
+			writeHighlightSpan(output, "tag", ">")
+			i++
+		}
+	}
+
+}
+
+// Returns true for the white space characters of markup
+func isMarkupSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// This is our highlighting API handler
+func highlightHandler(w http.ResponseWriter, r *http.Request) {
+
+	var request struct {
+		Code     *string `json:"code"`
+		Language string  `json:"language"`
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_HIGHLIGHT_SIZE))
+
+	if err := decoder.Decode(&request); err != nil || request.Code == nil {
+		writeError(w, r, badRequestError("The request must be a JSON object with the code to highlight and its language.").Wrap(err))
+		return
+	}
+
+	language := "text"
+
+	if name := strings.ToLower(strings.TrimSpace(request.Language)); name != "" && name != language {
+		found, ok := findHighlightLanguage(name)
+		if !ok {
+			writeError(w, r, badRequestError(fmt.Sprintf("Unknown language %q, expected one of %s (or their aliases).",
+				request.Language, strings.Join(highlightLanguageNames(), ", "))))
+			return
+		}
+		language = found.names[0]
+	}
+
+	endSpan := startSpan(r.Context(), "highlight: "+language)
+	highlighted := highlightCode(*request.Code, language)
+	endSpan()
+
+	incrementCounter("code_highlighted_total", "language", language)
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	json.NewEncoder(w).Encode(map[string]string{"language": language, "html": string(highlighted)})
+
+}
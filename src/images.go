@@ -0,0 +1,379 @@
+// Image thumbnailing and resizing. /img/resize?src=...&w=...&h=... decodes one of our embedded
+// static images (i.e. src=/icon-512.png) or an uploaded image (i.e. src=/uploads/photo.jpg,
+// admins only since uploads are private), scales it and re-encodes it as a JPEG or PNG. The
+// generated thumbnails are kept in an LRU cache (bounded by their total size) so that repeated requests are cheap.
+// Thumbnails of uploads are private too, so they're never kept by shared caches.
+//
+// Sources can be PNG, JPEG and GIF images (decoded by Go's standard library) or WebP images
+// (decoded by golang.org/x/image/webp, which can't encode them, so they're re-encoded as PNGs).
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "golang.org/x/image/webp"
+)
+
+// The largest width / height we'll generate
+const MAX_IMAGE_DIMENSION = 2048
+
+// The largest source image (in pixels) we're willing to decode
+const MAX_SOURCE_PIXELS = 50 * 1000 * 1000
+
+// How many bytes of generated images we keep in our cache
+const IMAGE_CACHE_CAPACITY = 32 << 20
+
+// The quality of the JPEGs we generate
+const JPEG_QUALITY = 85
+
+// A generated (resized and encoded) image
+type resizedImage struct {
+	key         string
+	data        []byte
+	contentType string
+	eTag        string
+}
+
+// A least recently used cache of generated images, bounded by the total size of the images it
+// holds
+type imageCache struct {
+	mutex    sync.Mutex
+	capacity int64
+	size     int64
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+// Our thumbnail cache
+var thumbnails = newImageCache(IMAGE_CACHE_CAPACITY)
+
+func newImageCache(capacity int64) *imageCache {
+	return &imageCache{capacity: capacity, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// Returns the cached image with the given key (marking it as recently used)
+func (cache *imageCache) get(key string) (*resizedImage, bool) {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	cache.order.MoveToFront(element)
+	return element.Value.(*resizedImage), true
+
+}
+
+// Add an image to our cache, evicting the least recently used images if we're full
+func (cache *imageCache) add(resized *resizedImage) {
+
+	// Images which would push everything else out of our cache aren't worth keeping
+	if int64(len(resized.data)) > cache.capacity/4 {
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if element, ok := cache.entries[resized.key]; ok {
+		cache.size -= int64(len(element.Value.(*resizedImage).data))
+		element.Value = resized
+		cache.order.MoveToFront(element)
+	} else {
+		cache.entries[resized.key] = cache.order.PushFront(resized)
+	}
+
+	cache.size += int64(len(resized.data))
+
+	for cache.size > cache.capacity && cache.order.Len() > 0 {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*resizedImage).key)
+		cache.size -= int64(len(oldest.Value.(*resizedImage).data))
+		incrementCounter("image_cache_evictions_total")
+	}
+
+	setGauge("image_cache_entries", float64(cache.order.Len()))
+	setGauge("image_cache_bytes", float64(cache.size))
+
+}
+
+// This is our image resize handler
+func imageResizeHandler(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+
+	width, err := imageDimension(query.Get("w"))
+	if err != nil {
+		writeError(w, r, badRequestError("The w parameter must be a whole number of pixels.").Wrap(err))
+		return
+	}
+
+	height, err := imageDimension(query.Get("h"))
+	if err != nil {
+		writeError(w, r, badRequestError("The h parameter must be a whole number of pixels.").Wrap(err))
+		return
+	}
+
+	format := strings.ToLower(query.Get("format"))
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	if format != "" && format != "jpeg" && format != "png" {
+		writeError(w, r, badRequestError("The format parameter must be jpeg or png."))
+		return
+	}
+
+	source, modified, err := openImageSource(r, query.Get("src"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer source.Close()
+
+	// Uploads can be replaced, so their modification time is part of our cache key
+	key := fmt.Sprintf("%s|%d|%d|%s|%d", query.Get("src"), width, height, format, modified.UnixNano())
+
+	resized, ok := thumbnails.get(key)
+
+	if ok {
+		incrementCounter("image_cache_hits_total")
+	} else {
+		incrementCounter("image_cache_misses_total")
+
+		endSpan := startSpan(r.Context(), "image: resize")
+		resized, err = resizeImage(source, width, height, format)
+		endSpan()
+
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		resized.key = key
+		thumbnails.add(resized)
+	}
+
+	setContentType(w, resized.contentType)
+	if strings.HasPrefix(query.Get("src"), "/uploads/") {
+		w.Header().Set("Cache-Control", "private, no-store")
+	} else {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(STATIC_FILE_MAX_AGE.Seconds())))
+	}
+	w.Header().Set("ETag", resized.eTag)
+
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(resized.data))
+
+}
+
+// Parse a width / height parameter. Zero means the dimension wasn't given.
+func imageDimension(value string) (int, error) {
+
+	if value == "" {
+		return 0, nil
+	}
+
+	dimension, err := strconv.Atoi(value)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if dimension < 1 || dimension > MAX_IMAGE_DIMENSION {
+		return 0, fmt.Errorf("%d is outside of 1 - %d", dimension, MAX_IMAGE_DIMENSION)
+	}
+
+	return dimension, nil
+
+}
+
+// Open the image with the given src path, returning its modification time
+func openImageSource(r *http.Request, src string) (io.ReadSeekCloser, time.Time, error) {
+
+	if src == "" {
+		return nil, time.Time{}, badRequestError("The src parameter is required.")
+	}
+
+	if name, ok := strings.CutPrefix(src, "/uploads/"); ok {
+
+		if !isAdminRequest(r) {
+			return nil, time.Time{}, newAppError(http.StatusUnauthorized, "unauthorized",
+				"Only admins can resize uploaded images.")
+		}
+
+		name = sanitiseFileName(name)
+		if name == "" {
+			return nil, time.Time{}, notFoundError()
+		}
+
+		file, err := os.Open(filepath.Join(uploadDir, name))
+		if err != nil {
+			return nil, time.Time{}, notFoundError().WithDetail("opening upload %s: %v", name, err)
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, time.Time{}, internalError(err).WithDetail("reading the file info of %s", name)
+		}
+
+		return file, info.ModTime(), nil
+
+	}
+
+	fileData, err := staticFiles.ReadFile("static/" + strings.TrimPrefix(src, "/"))
+
+	if err != nil {
+		return nil, time.Time{}, notFoundError().WithDetail("reading static image %s: %v", src, err)
+	}
+
+	return nopSeekCloser{bytes.NewReader(fileData)}, time.Time{}, nil
+
+}
+
+// Wraps a bytes.Reader so it can stand in for a file
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+// Decode, scale and encode the given image. If only one of the width and height is given, the
+// other is chosen to preserve the image's aspect ratio. The output format defaults to the
+// format of the source (with GIFs becoming PNGs).
+func resizeImage(source io.ReadSeeker, width int, height int, format string) (*resizedImage, error) {
+
+	config, sourceFormat, err := image.DecodeConfig(source)
+
+	if err != nil {
+		incrementCounter("image_resize_errors_total", "reason", "unsupported")
+		return nil, newAppError(http.StatusUnsupportedMediaType, "unsupported_image",
+			"The source isn't a PNG, JPEG, GIF or WebP image.").Wrap(err)
+	}
+
+	if config.Width*config.Height > MAX_SOURCE_PIXELS {
+		incrementCounter("image_resize_errors_total", "reason", "too_large")
+		return nil, newAppError(http.StatusUnprocessableEntity, "image_too_large",
+			"The source image is too large to resize.").
+			WithDetail("%dx%d", config.Width, config.Height)
+	}
+
+	if _, err := source.Seek(0, io.SeekStart); err != nil {
+		return nil, internalError(err)
+	}
+
+	sourceImage, _, err := image.Decode(source)
+
+	if err != nil {
+		incrementCounter("image_resize_errors_total", "reason", "corrupt")
+		return nil, newAppError(http.StatusUnprocessableEntity, "corrupt_image",
+			"The source image could not be decoded.").Wrap(err)
+	}
+
+	bounds := sourceImage.Bounds()
+
+	switch {
+	case width == 0 && height == 0:
+		width, height = bounds.Dx(), bounds.Dy()
+	case width == 0:
+		width = max(1, bounds.Dx()*height/bounds.Dy())
+	case height == 0:
+		height = max(1, bounds.Dy()*width/bounds.Dx())
+	}
+
+	width, height = min(width, MAX_IMAGE_DIMENSION), min(height, MAX_IMAGE_DIMENSION)
+
+	scaled := scaleImage(sourceImage, width, height)
+
+	if format == "" {
+		format = "png"
+		if sourceFormat == "jpeg" {
+			format = "jpeg"
+		}
+	}
+
+	var encoded bytes.Buffer
+	resized := &resizedImage{contentType: "image/" + format}
+
+	if format == "jpeg" {
+		// JPEGs have no transparency, so we flatten our image onto a white background
+		flattened := image.NewRGBA(scaled.Bounds())
+		draw.Draw(flattened, flattened.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.Draw(flattened, flattened.Bounds(), scaled, image.Point{}, draw.Over)
+		err = jpeg.Encode(&encoded, flattened, &jpeg.Options{Quality: JPEG_QUALITY})
+	} else {
+		err = png.Encode(&encoded, scaled)
+	}
+
+	if err != nil {
+		return nil, internalError(err).WithDetail("encoding a %dx%d %s", width, height, format)
+	}
+
+	resized.data = encoded.Bytes()
+	resized.eTag = fmt.Sprintf("\"%x\"", sha256.Sum256(resized.data))
+
+	return resized, nil
+
+}
+
+// Scale an image to the given size. Each pixel of our new image is the average of the source
+// pixels it covers (a box filter), which gives smooth thumbnails when shrinking images and
+// falls back to nearest neighbour sampling when enlarging them.
+func scaleImage(source image.Image, width int, height int) *image.RGBA {
+
+	bounds := source.Bounds()
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*bounds.Dy()/height)
+
+		for x := 0; x < width; x++ {
+
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*bounds.Dx()/width)
+
+			var red, green, blue, alpha, count uint64
+
+			for sourceY := y0; sourceY < y1; sourceY++ {
+				for sourceX := x0; sourceX < x1; sourceX++ {
+					r, g, b, a := source.At(sourceX, sourceY).RGBA()
+					red, green, blue, alpha = red+uint64(r), green+uint64(g), blue+uint64(b), alpha+uint64(a)
+					count++
+				}
+			}
+
+			scaled.SetRGBA(x, y, color.RGBA{
+				R: uint8(red / count >> 8),
+				G: uint8(green / count >> 8),
+				B: uint8(blue / count >> 8),
+				A: uint8(alpha / count >> 8),
+			})
+		}
+	}
+
+	return scaled
+
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImageResizeHandlerDecodesWebPAndKeepsUploadsPrivate(t *testing.T) {
+
+	defer func(dir string, token string) { uploadDir, adminToken = dir, token }(uploadDir, adminToken)
+	uploadDir, adminToken = t.TempDir(), "secret"
+
+	// 1x1 pixel WebP images, lossless and lossy
+	for name, encoded := range map[string]string{
+		"lossless.webp": "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA==",
+		"lossy.webp":    "UklGRiIAAABXRUJQVlA4IBYAAAAwAQCdASoBAAEADsD+JaQAA3AAAAAA",
+	} {
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(uploadDir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		src          string
+		contentType  string
+		cacheControl string
+	}{
+		{"/uploads/lossless.webp", "image/png", "private, no-store"},
+		{"/uploads/lossy.webp", "image/png", "private, no-store"},
+		{"/icon-512.png", "image/png", "public"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+
+			r := httptest.NewRequest(http.MethodGet, "/img/resize?w=4&src="+test.src, nil)
+			r.SetBasicAuth("admin", adminToken)
+			w := httptest.NewRecorder()
+
+			imageResizeHandler(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != test.contentType {
+				t.Errorf("got a Content-Type of %q, want %q", got, test.contentType)
+			}
+			if got := w.Header().Get("Cache-Control"); !strings.HasPrefix(got, test.cacheControl) {
+				t.Errorf("got a Cache-Control of %q, want %q", got, test.cacheControl)
+			}
+
+		})
+	}
+
+}
+
+func TestImageCacheEvictsToItsByteBudget(t *testing.T) {
+
+	cache := newImageCache(100)
+
+	cache.add(&resizedImage{key: "a", data: make([]byte, 20)})
+	cache.add(&resizedImage{key: "b", data: make([]byte, 25)})
+	cache.add(&resizedImage{key: "c", data: make([]byte, 25)})
+	cache.add(&resizedImage{key: "a", data: make([]byte, 25)}) // Replacing an image frees the old one
+	cache.add(&resizedImage{key: "d", data: make([]byte, 25)})
+	cache.add(&resizedImage{key: "huge", data: make([]byte, 26)}) // Over a quarter of the budget
+
+	if cache.size != 100 {
+		t.Errorf("got a size of %d bytes, want 100", cache.size)
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if _, ok := cache.get(key); !ok {
+			t.Errorf("%q was evicted", key)
+		}
+	}
+	if _, ok := cache.get("huge"); ok {
+		t.Error("an image over a quarter of the budget was cached")
+	}
+
+	cache.add(&resizedImage{key: "e", data: make([]byte, 10)})
+
+	if _, ok := cache.get("a"); ok {
+		t.Error("the least recently used image wasn't evicted")
+	}
+	if cache.size != 85 {
+		t.Errorf("got a size of %d bytes, want 85", cache.size)
+	}
+
+}
@@ -0,0 +1,182 @@
+// Request inspection endpoints, similar to httpbin.org. These are handy when using this server
+// as a test target for HTTP clients and proxies:
+//
+//   - /echo returns the request (method, URL, query, headers and body) as JSON
+//   - /headers returns just the request headers as JSON
+//
+// The values of headers which carry credentials (i.e. Cookie and Authorization) are redacted.
+//   - /delay/{seconds} waits before returning the request as JSON (up to MAX_ECHO_DELAY)
+//   - /status/{code} responds with the given status code
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	MAX_ECHO_BODY_SIZE = 1 << 20          // The most of a request body we echo back
+	MAX_ECHO_DELAY     = 10 * time.Second // The longest /delay/{seconds} waits
+)
+
+// The methods our inspection endpoints accept
+var inspectionMethods = []string{
+	http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete,
+}
+
+// A request as returned by our inspection endpoints. Bodies which aren't valid UTF-8 are
+// base64 encoded (with body_encoding set to base64).
+type echoedRequest struct {
+	Method        string            `json:"method"`
+	URL           string            `json:"url"`
+	Path          string            `json:"path"`
+	Query         url.Values        `json:"query"`
+	Headers       map[string]string `json:"headers"`
+	Body          string            `json:"body"`
+	BodyEncoding  string            `json:"body_encoding,omitempty"`
+	BodyTruncated bool              `json:"body_truncated,omitempty"`
+	Origin        string            `json:"origin"`
+	RequestID     string            `json:"request_id"`
+}
+
+func registerInspectionRoutes(router *http.ServeMux) {
+	handleRoute(router, "/echo", http.HandlerFunc(echoHandler), inspectionMethods...)
+	handleRoute(router, "/headers", http.HandlerFunc(headersHandler))
+	handleRoute(router, "/delay/{seconds}", http.HandlerFunc(delayHandler), inspectionMethods...)
+	handleRoute(router, "/status/{code}", http.HandlerFunc(statusHandler), inspectionMethods...)
+}
+
+// This is our echo handler, which returns the request as JSON
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+
+	echoed, err := echoRequest(r)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeInspectionJSON(w, echoed)
+
+}
+
+// This is our headers handler, which returns the request headers as JSON
+func headersHandler(w http.ResponseWriter, r *http.Request) {
+	writeInspectionJSON(w, map[string]interface{}{"headers": requestHeaders(r)})
+}
+
+// This is our delay handler, which waits for the given number of seconds (fractions are fine,
+// i.e. /delay/0.5) before returning the request as JSON
+func delayHandler(w http.ResponseWriter, r *http.Request) {
+
+	seconds, err := strconv.ParseFloat(r.PathValue("seconds"), 64)
+
+	if err != nil || seconds < 0 || seconds > MAX_ECHO_DELAY.Seconds() {
+		writeError(w, r, badRequestError(fmt.Sprintf("The delay must be a number of seconds from 0 to %g.", MAX_ECHO_DELAY.Seconds())))
+		return
+	}
+
+	endSpan := startSpan(r.Context(), "delay")
+	select {
+	case <-time.After(time.Duration(seconds * float64(time.Second))):
+	case <-r.Context().Done():
+		endSpan()
+		return
+	}
+	endSpan()
+
+	echoHandler(w, r)
+
+}
+
+// This is our status handler, which responds with the given status code (and no body). As
+// with httpbin, redirects go to /echo.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+
+	code, err := strconv.Atoi(r.PathValue("code"))
+
+	// Informational (1xx) statuses aren't final responses, so we don't support them
+	if err != nil || code < 200 || code > 599 {
+		writeError(w, r, badRequestError("The status code must be a number from 200 to 599."))
+		return
+	}
+
+	if code >= 300 && code < 400 && code != http.StatusNotModified {
+		w.Header().Set("Location", urlFor("/echo"))
+	}
+
+	w.WriteHeader(code)
+
+}
+
+// Returns the given request in the form our inspection endpoints return it
+func echoRequest(r *http.Request) (*echoedRequest, error) {
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, MAX_ECHO_BODY_SIZE+1))
+
+	if err != nil {
+		return nil, badRequestError("The request body couldn't be read.").Wrap(err)
+	}
+
+	echoed := &echoedRequest{
+		Method:        r.Method,
+		URL:           r.URL.String(),
+		Path:          r.URL.Path,
+		Query:         r.URL.Query(),
+		Headers:       requestHeaders(r),
+		BodyTruncated: len(body) > MAX_ECHO_BODY_SIZE,
+		Origin:        clientAddress(r),
+	}
+	echoed.RequestID, _ = r.Context().Value(REQUEST_ID_KEY).(string)
+
+	body = body[:min(len(body), MAX_ECHO_BODY_SIZE)]
+
+	if utf8.Valid(body) {
+		echoed.Body = string(body)
+	} else {
+		echoed.Body = base64.StdEncoding.EncodeToString(body)
+		echoed.BodyEncoding = "base64"
+	}
+
+	return echoed, nil
+
+}
+
+// Returns the headers of the given request (including Host, which Go keeps separately), with
+// repeated headers joined by commas. The values of headers which carry credentials (see
+// credentialHeaders) are redacted, so that a script on a page of ours can't read cookies it
+// mustn't see, i.e. those which are HttpOnly.
+func requestHeaders(r *http.Request) map[string]string {
+
+	headers := map[string]string{"Host": r.Host}
+
+	for name, values := range r.Header {
+		headers[name] = strings.Join(values, ", ")
+		if isCredentialHeader(name) {
+			headers[name] = "[redacted]"
+		}
+	}
+
+	return headers
+
+}
+
+func writeInspectionJSON(w http.ResponseWriter, value interface{}) {
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	w.Header().Set("Cache-Control", "no-store")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeadersHandlerRedactsCredentials(t *testing.T) {
+
+	r := httptest.NewRequest(http.MethodGet, "/headers", nil)
+	r.Header.Set("Cookie", "session=secret")
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set(TOTP_CODE_HEADER, "123456")
+	r.Header.Set("User-Agent", "inspect-test")
+	w := httptest.NewRecorder()
+
+	headersHandler(w, r)
+
+	var response struct {
+		Headers map[string]string `json:"headers"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	headers := response.Headers
+
+	for _, name := range []string{"Cookie", "Authorization", TOTP_CODE_HEADER} {
+		if value := headers[http.CanonicalHeaderKey(name)]; value != "[redacted]" {
+			t.Errorf("got %s %q, want it redacted", name, value)
+		}
+	}
+	if headers["User-Agent"] != "inspect-test" {
+		t.Errorf("got User-Agent %q, want it echoed", headers["User-Agent"])
+	}
+
+}
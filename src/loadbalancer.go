@@ -0,0 +1,166 @@
+// Load balancing for our proxy mode. Requests are spread across our main upstreams (the -proxy
+// origins) using the -proxy-strategy strategy:
+//
+//   - round-robin: each upstream in turn (the default)
+//   - least-connections: the upstream with the fewest requests in flight
+//
+// Upstreams which are unhealthy (see upstreams.go) are skipped, as are upstreams which already
+// have -proxy-max-connections requests in flight. When every upstream is at its limit, the
+// visitor gets a 503 rather than piling more work onto them.
+//
+// With -proxy-sticky-cookie set, visitors are kept on the same upstream (i.e. for upstreams
+// which keep sessions in memory): we tell each visitor which upstream served them via the
+// cookie, and send them back to it for as long as it's available.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	LOAD_BALANCE_ROUND_ROBIN       = "round-robin"
+	LOAD_BALANCE_LEAST_CONNECTIONS = "least-connections"
+)
+
+// A pool of interchangeable upstreams which requests are spread across
+type proxyPool struct {
+	targets []*proxyTarget
+	next    atomic.Uint64 // Where our next round starts
+}
+
+// Create the targets of our main upstream pool from the given comma separated list of origins
+func newProxyPool(upstreams string) (*proxyPool, error) {
+
+	pool := &proxyPool{}
+
+	for _, upstream := range strings.Split(upstreams, ",") {
+
+		target, err := newProxyTarget("primary", strings.TrimSpace(upstream))
+
+		if err != nil {
+			return nil, err
+		}
+
+		pool.targets = append(pool.targets, target)
+
+	}
+
+	return pool, nil
+
+}
+
+// Returns the target of our pool the given request should go to, having reserved a connection
+// to it (which the caller must release), or nil if every target is at its connection limit
+func (pool *proxyPool) pick(r *http.Request) *proxyTarget {
+
+	// Visitors with a sticky session go back to the upstream which served them before
+	if proxyStickyCookie != "" {
+		if cookie, err := r.Cookie(proxyStickyCookie); err == nil {
+			for _, target := range pool.targets {
+				if target.id == cookie.Value && target.available() && target.acquire() {
+					return target
+				}
+			}
+		}
+	}
+
+	var candidates []*proxyTarget
+	for _, target := range pool.targets {
+		if target.available() {
+			candidates = append(candidates, target)
+		}
+	}
+
+	// It's better to keep trying our upstreams than to fail every request when none of them
+	// are healthy
+	if len(candidates) == 0 {
+		candidates = pool.targets
+	}
+
+	// Our candidates in the order we try them: round robin starts with the next one in turn,
+	// while least connections starts with the least busy one (taking turns on ties)
+	start := int(pool.next.Add(1) % uint64(len(candidates)))
+	candidates = append(slices.Clone(candidates[start:]), candidates[:start]...)
+
+	if proxyStrategy == LOAD_BALANCE_LEAST_CONNECTIONS {
+		slices.SortStableFunc(candidates, func(a, b *proxyTarget) int {
+			return int(a.active.Load() - b.active.Load())
+		})
+	}
+
+	for _, target := range candidates {
+		if target.acquire() {
+			return target
+		}
+	}
+
+	return nil
+
+}
+
+// Returns whether at least one of the targets of our pool is healthy
+func (pool *proxyPool) healthy() bool {
+	for _, target := range pool.targets {
+		if target.available() {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the ID our sticky session cookie uses for the given upstream. It's derived from the
+// upstream's URL, so that it stays the same across restarts without revealing the URL.
+func proxyTargetID(upstream string) string {
+	hash := sha256.Sum256([]byte(upstream))
+	return hex.EncodeToString(hash[:4])
+}
+
+// Reserve a connection to our target, if it isn't at its connection limit
+func (target *proxyTarget) acquire() bool {
+
+	active := target.active.Add(1)
+
+	if proxyMaxConnections > 0 && active > proxyMaxConnections {
+		target.active.Add(-1)
+		return false
+	}
+
+	setGauge("proxy_upstream_active_requests", float64(active), "upstream", target.name, "host", target.url.Host)
+
+	return true
+
+}
+
+// Release a connection reserved via acquire
+func (target *proxyTarget) release() {
+	active := target.active.Add(-1)
+	setGauge("proxy_upstream_active_requests", float64(active), "upstream", target.name, "host", target.url.Host)
+}
+
+// Point the visitor's sticky session cookie at the given target (if we use sticky sessions
+// and it doesn't already)
+func setStickyCookie(w http.ResponseWriter, r *http.Request, target *proxyTarget) {
+
+	if proxyStickyCookie == "" {
+		return
+	}
+
+	if cookie, err := r.Cookie(proxyStickyCookie); err == nil && cookie.Value == target.id {
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     proxyStickyCookie,
+		Value:    target.id,
+		Path:     urlFor("/"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+}
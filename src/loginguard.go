@@ -0,0 +1,188 @@
+// Brute-force protection for our admin logins. Every request which supplies admin credentials
+// (see admin.go) is a login attempt, and we track the failed ones per account (the basic auth
+// username or X-Admin-Account header, since any name goes with our token) and per client
+// address:
+//
+//   - after each failure, the account or address must wait before its next attempt is even
+//     checked, starting at LOGIN_BACKOFF and doubling with each failure
+//   - after -login-max-failures failures for an account (or -login-max-failures-ip for an
+//     address, which is higher, as an office or a carrier's NAT shares one) it's locked out for
+//     -login-lockout
+//
+// Attempts while an account or address must wait are refused without checking their
+// credentials (with a 429 and a Retry-After from admin endpoints), so that guessing is no
+// faster for the right token. A successful login clears the failures of its account and address,
+// and failures are forgotten once an account or address has been quiet for -login-lockout.
+//
+// Failures, lockouts and successful logins after failures are written to our log as AUDIT
+// entries (with the client's address as -privacy allows), and counted in the
+// admin_login_failures_total, admin_logins_throttled_total and admin_lockouts_total metrics.
+//
+// Lockouts per account can be used to lock a real admin out on purpose, which the higher
+// per-address limit for the admin's own address doesn't help with; -login-max-failures 0
+// turns the per-account limit off.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_LOGIN_MAX_FAILURES    = 5
+	DEFAULT_LOGIN_MAX_FAILURES_IP = 20
+	DEFAULT_LOGIN_LOCKOUT         = 15 * time.Minute
+	LOGIN_BACKOFF                 = time.Second
+	MAX_LOGIN_TRACKED             = 10000 // The most accounts and addresses we track failures for
+)
+
+// The failed logins of an account or address
+type loginFailures struct {
+	failures int
+	last     time.Time
+}
+
+// Failed logins, by "account:<name>" and "ip:<address>"
+type loginGuardState struct {
+	mutex    sync.Mutex
+	failures map[string]*loginFailures
+}
+
+// Our failed logins
+var loginGuard = &loginGuardState{failures: make(map[string]*loginFailures)}
+
+// Returns the account and address of a login attempt
+func loginIdentity(r *http.Request) (string, string) {
+	return adminAccount(r), clientAddress(r)
+}
+
+// Returns how long the given request's account or address must wait before its next login
+// attempt is checked (0 if it needn't)
+func loginWait(r *http.Request) time.Duration {
+
+	account, address := loginIdentity(r)
+
+	loginGuard.mutex.Lock()
+	defer loginGuard.mutex.Unlock()
+
+	now := time.Now()
+
+	return max(
+		loginGuard.waitFor("account:"+account, loginMaxFailures, now),
+		loginGuard.waitFor("ip:"+address, loginMaxFailuresIP, now),
+	)
+
+}
+
+// Returns how long the given account or address must wait. The caller must hold our mutex.
+func (guard *loginGuardState) waitFor(key string, maxFailures int, now time.Time) time.Duration {
+
+	entry, found := guard.failures[key]
+	if !found {
+		return 0
+	}
+
+	if now.Sub(entry.last) > loginLockout {
+		delete(guard.failures, key)
+		return 0
+	}
+
+	return entry.last.Add(loginDelay(entry.failures, maxFailures)).Sub(now)
+
+}
+
+// Returns how long to wait after the given number of failures: the lockout once we've reached
+// the limit, and a doubling delay (no longer than the lockout) before that
+func loginDelay(failures int, maxFailures int) time.Duration {
+	if maxFailures > 0 && failures >= maxFailures {
+		return loginLockout
+	}
+	return min(LOGIN_BACKOFF<<min(failures-1, 20), loginLockout)
+}
+
+// Note a failed login of the given request
+func recordLoginFailure(r *http.Request) {
+
+	account, address := loginIdentity(r)
+
+	loginGuard.mutex.Lock()
+	defer loginGuard.mutex.Unlock()
+
+	now := time.Now()
+
+	if len(loginGuard.failures) >= MAX_LOGIN_TRACKED {
+		loginGuard.forgetQuiet(now)
+	}
+
+	incrementCounter("admin_login_failures_total")
+
+	for _, tracked := range []struct {
+		scope       string
+		name        string // As we log it
+		key         string
+		maxFailures int
+	}{
+		{"account", account, "account:" + account, loginMaxFailures},
+		{"ip", anonymizeAddress(address), "ip:" + address, loginMaxFailuresIP},
+	} {
+		entry := loginGuard.failures[tracked.key]
+		if entry == nil {
+			entry = &loginFailures{}
+			loginGuard.failures[tracked.key] = entry
+		}
+		entry.failures++
+		entry.last = now
+		if entry.failures == tracked.maxFailures {
+			incrementCounter("admin_lockouts_total", "scope", tracked.scope)
+			logger.Printf("AUDIT admin login locked out %s %q for %v after %d failures", tracked.scope, tracked.name, loginLockout, entry.failures)
+		}
+	}
+
+	logger.Printf("AUDIT admin login failed for account %q from %s (%d failures)", account, anonymizeAddress(address),
+		loginGuard.failures["account:"+account].failures)
+
+}
+
+// Note a successful login of the given request, clearing the failures of its account and
+// address
+func recordLoginSuccess(r *http.Request) {
+
+	account, address := loginIdentity(r)
+
+	loginGuard.mutex.Lock()
+	defer loginGuard.mutex.Unlock()
+
+	failures := 0
+	for _, key := range []string{"account:" + account, "ip:" + address} {
+		if entry, found := loginGuard.failures[key]; found {
+			failures = max(failures, entry.failures)
+			delete(loginGuard.failures, key)
+		}
+	}
+
+	if failures > 0 {
+		logger.Printf("AUDIT admin login succeeded for account %q from %s after %d failures", account, anonymizeAddress(address), failures)
+	}
+
+}
+
+// Forget the accounts and addresses which have been quiet for our lockout. The caller must hold
+// our mutex.
+func (guard *loginGuardState) forgetQuiet(now time.Time) {
+	for key, entry := range guard.failures {
+		if now.Sub(entry.last) > loginLockout {
+			delete(guard.failures, key)
+		}
+	}
+}
+
+// Refuse a login attempt which must wait
+func writeLoginThrottled(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	incrementCounter("admin_logins_throttled_total")
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second).Seconds())+1))
+	writeError(w, r, newAppError(http.StatusTooManyRequests, "login_throttled",
+		"There have been too many failed sign in attempts. Please wait and try again."))
+}
@@ -0,0 +1,99 @@
+// Request logging exclusion / sampling rules. These let us keep noisy requests (i.e. load
+// balancer health checks) out of our access log. Excluded requests are still counted by our
+// metrics middleware.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A single exclusion rule. Requests matching the rule are only logged with the given sample
+// rate, which is a fraction between 0 (never logged) and 1 (always logged).
+type logExclusionRule struct {
+	field      string // One of "path" (path prefix), "status" (status class) or "ua" (user agent)
+	value      string
+	sampleRate float64
+}
+
+// The list of exclusion rules passed in via the -log-exclude flag. It implements flag.Value so
+// that the flag can be repeated, with each rule taking the form field:value[@rate], i.e.
+//
+//	-log-exclude path:/health -log-exclude status:3xx -log-exclude ua:kube-probe@0.01
+type logExclusionRules []logExclusionRule
+
+var logExclusions logExclusionRules
+
+func (rules *logExclusionRules) String() string {
+	var ruleStrings []string
+	for _, rule := range *rules {
+		ruleStrings = append(ruleStrings, fmt.Sprintf("%s:%s@%g", rule.field, rule.value, rule.sampleRate))
+	}
+	return strings.Join(ruleStrings, ",")
+}
+
+func (rules *logExclusionRules) Set(ruleString string) error {
+
+	rule := logExclusionRule{}
+
+	// Split off the optional sample rate
+	if at := strings.LastIndex(ruleString, "@"); at != -1 {
+		sampleRate, err := strconv.ParseFloat(ruleString[at+1:], 64)
+		if err != nil || sampleRate < 0 || sampleRate > 1 {
+			return fmt.Errorf("invalid sample rate in %q: must be between 0 and 1", ruleString)
+		}
+		rule.sampleRate = sampleRate
+		ruleString = ruleString[:at]
+	}
+
+	field, value, found := strings.Cut(ruleString, ":")
+	if !found || value == "" {
+		return fmt.Errorf("invalid log exclusion rule %q: expected field:value", ruleString)
+	}
+
+	switch field {
+	case "path", "ua":
+	case "status":
+		value = strings.ToLower(value)
+		if len(value) != 3 || value[1:] != "xx" || value[0] < '1' || value[0] > '5' {
+			return fmt.Errorf("invalid status class %q: expected 1xx to 5xx", value)
+		}
+	default:
+		return fmt.Errorf("invalid log exclusion field %q: expected path, status or ua", field)
+	}
+
+	rule.field = field
+	rule.value = value
+	*rules = append(*rules, rule)
+
+	return nil
+
+}
+
+// Check whether the given rule matches a request which was responded to with the given status
+func (rule logExclusionRule) matches(r *http.Request, status int) bool {
+	switch rule.field {
+	case "path":
+		return strings.HasPrefix(r.URL.Path, rule.value)
+	case "status":
+		return statusClass(status) == rule.value
+	case "ua":
+		return strings.Contains(r.UserAgent(), rule.value)
+	}
+	return false
+}
+
+// Decide whether or not a request should be written to our access log. The first matching
+// rule wins; requests which don't match any rule are always logged.
+func (rules logExclusionRules) shouldLog(r *http.Request, status int) bool {
+	for _, rule := range rules {
+		if rule.matches(r, status) {
+			return rule.sampleRate > 0 && rand.Float64() < rule.sampleRate
+		}
+	}
+	return true
+}
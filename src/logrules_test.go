@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLogExclusionRulesFirstMatchWins(t *testing.T) {
+
+	// Sample rates of 0 and 1 make our rules' decisions certain
+	tests := []struct {
+		name   string
+		rules  []string
+		path   string
+		status int
+		want   bool
+	}{
+		{"no rules", nil, "/health", http.StatusOK, true},
+		{"no matching rule", []string{"path:/health@0"}, "/excel", http.StatusOK, true},
+		{"an earlier exclusion wins", []string{"path:/health@0", "status:2xx@1"}, "/health", http.StatusOK, false},
+		{"an earlier inclusion wins", []string{"status:2xx@1", "path:/health@0"}, "/health", http.StatusOK, true},
+		{"a later rule applies when the earlier doesn't match", []string{"status:5xx@1", "path:/health@0"}, "/health", http.StatusOK, false},
+		{"the more specific rule only wins when it comes first", []string{"path:/@1", "path:/health@0"}, "/health", http.StatusOK, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var rules logExclusionRules
+			for _, rule := range test.rules {
+				if err := rules.Set(rule); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if got := rules.shouldLog(r, test.status); got != test.want {
+				t.Errorf("shouldLog = %v, want %v", got, test.want)
+			}
+
+		})
+	}
+
+}
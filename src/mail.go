@@ -0,0 +1,163 @@
+// Email sending. With -smtp-addr set (i.e. smtp.example.com:587), the server can send plain text
+// emails via that SMTP server, from -smtp-from. Connections are upgraded to TLS when the server
+// supports STARTTLS, and we authenticate with -smtp-username and -smtp-password (PLAIN auth) when
+// a username is given. We give up on SMTP servers which don't answer within SMTP_DIAL_TIMEOUT
+// or can't take an email within SMTP_TIMEOUT. Sent (and failed) emails are counted in
+// emails_sent_total.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+const (
+	SMTP_DIAL_TIMEOUT = 10 * time.Second
+	SMTP_TIMEOUT      = time.Minute // How long sending a single email may take in all
+)
+
+// Returns whether we're able to send emails
+func mailConfigured() bool {
+	return smtpAddr != "" && smtpFrom != ""
+}
+
+// Parse a comma separated list of email addresses, returning their bare addresses
+func parseMailAddresses(list string) ([]string, error) {
+
+	addresses, err := mail.ParseAddressList(list)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid email addresses %q: %w", list, err)
+	}
+
+	var bare []string
+	for _, address := range addresses {
+		bare = append(bare, address.Address)
+	}
+
+	return bare, nil
+
+}
+
+// Send a plain text email with the given subject and body to the given addresses. The kind
+// (i.e. report) is used to label our metrics.
+func sendMail(kind string, to []string, subject, body string) error {
+
+	err := deliverMail(to, subject, body)
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	incrementCounter("emails_sent_total", "kind", kind, "result", result)
+
+	return err
+
+}
+
+func deliverMail(to []string, subject, body string) error {
+
+	if !mailConfigured() {
+		return fmt.Errorf("email isn't configured on this server (see the -smtp-addr and -smtp-from flags)")
+	}
+
+	from, err := mail.ParseAddress(smtpFrom)
+
+	if err != nil {
+		return fmt.Errorf("invalid -smtp-from: %w", err)
+	}
+
+	// Line breaks in our headers would let their values add headers of their own
+	for _, value := range append([]string{subject}, to...) {
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("email headers can't contain line breaks")
+		}
+	}
+
+	var message bytes.Buffer
+
+	fmt.Fprintf(&message, "From: %s\r\n", from.String())
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&message, "\r\n%s", strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+
+	return sendSMTP(from.Address, to, message.Bytes())
+
+}
+
+// Send the given message via our SMTP server as smtp.SendMail does, but within our timeouts, so
+// that a server which stops answering can't hold up its caller for good
+func sendSMTP(from string, to []string, message []byte) error {
+
+	host, _, err := net.SplitHostPort(smtpAddr)
+
+	if err != nil {
+		return fmt.Errorf("invalid -smtp-addr: %w", err)
+	}
+
+	conn, err := net.DialTimeout("tcp", smtpAddr, SMTP_DIAL_TIMEOUT)
+
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(SMTP_TIMEOUT))
+
+	client, err := smtp.NewClient(conn, host)
+
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if supported, _ := client.Extension("STARTTLS"); supported {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	if smtpUsername != "" {
+		if err := client.Auth(smtp.PlainAuth("", smtpUsername, smtpPassword, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+
+	for _, address := range to {
+		if err := client.Rcpt(address); err != nil {
+			return err
+		}
+	}
+
+	writer, err := client.Data()
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+
+}
@@ -1,20 +1,29 @@
 // Simple golang webserver with logging, tracing, health check, graceful shutdown, as well
 // as demo applications
+//
+// Our routes use the patterns of Go 1.22's router (i.e. /{$} and /status/{code}). Builds
+// outside of our module (i.e. with GO111MODULE=off) default to the older router, which treats
+// those patterns as plain text, so we ask for the newer one whichever way we're built.
+
+//go:debug httpmuxgo121=0
 
 package main
 
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"log"
 	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -22,6 +31,11 @@ import (
 
 const (
 	REQUEST_ID_KEY         = 8888
+	TRACE_KEY              = 8889
+	EXPERIMENT_BUCKETS_KEY = 8890
+	CONNECTION_KEY         = 8891
+	USER_AGENT_KEY         = 8892
+	GRAPHQL_ADMIN_KEY      = 8893
 	READ_TIMEOUT           = 10
 	WRITE_TIMEOUT          = 10
 	IDLE_TIMEOUT           = 30
@@ -31,7 +45,212 @@ const (
 
 var (
 	listenAddr string
-	healthy    int32
+	siteURL    string
+	robotsFile string
+	basePath   string
+	devMode    bool
+	adminToken string
+
+	// File uploads (see uploads.go), and how long the signed links to them we show admins are
+	// valid for (see sharedlinks.go)
+	uploadDir        string
+	maxUploadSize    int64
+	maxUploadDirSize int64
+	shareLifetime    time.Duration
+
+	// Slow request detection (see slow.go)
+	slowThreshold  time.Duration
+	slowWebhookURL string
+
+	// Error alerting (see alerts.go)
+	alertWebhookURL string
+	alertFormat     string
+	alertThreshold  int
+	alertWindow     time.Duration
+	alertCooldown   time.Duration
+
+	// Request event publishing (see events.go)
+	eventsURL string
+
+	// Caching reverse proxy mode (see proxy.go)
+	proxyUpstream  string
+	proxyCacheSize int64
+
+	// How requests are spread across our upstreams in proxy mode (see loadbalancer.go)
+	proxyStrategy       string
+	proxyMaxConnections int64
+	proxyStickyCookie   string
+
+	// The active health checks of our upstreams in proxy mode (see upstreams.go)
+	proxyHealthInterval time.Duration
+	proxyHealthPath     string
+
+	// Our canary upstream in proxy mode (see canary.go)
+	canaryUpstream string
+	canaryPercent  float64
+	canaryMatch    string
+
+	// Static site mode (see site.go)
+	siteRoot string
+
+	// Our weather demo's upstream API (see weather.go)
+	weatherURL string
+	weatherKey string
+	weatherTTL time.Duration
+
+	// The filter of the requests we capture from startup (see capture.go)
+	captureFilterFlag string
+
+	// Whether our network diagnostics tools are enabled (see tools.go)
+	toolsEnabled bool
+
+	// Vendored copies of our CDN assets (see assets.go)
+	vendorDir string
+
+	// Extra file extension to content type mappings (see mimetypes.go)
+	mimeTypesFile string
+
+	// The file our mock routes are defined in (see mocks.go)
+	mocksFile string
+
+	// The file our redirect rules are defined in (see redirects.go)
+	redirectsFile string
+
+	// The file the access rules admins set are saved to (see accessrules.go)
+	accessRulesFile string
+
+	// Our API keys, their default quotas and the file their usage is saved to (see quotas.go)
+	apiKeysFile  string
+	quotaDaily   int
+	quotaMonthly int
+	quotaFile    string
+
+	// Our geo-IP database and the countries we serve or refuse (see geoip.go)
+	geoIPDatabase string
+	geoAllow      string
+	geoDeny       string
+
+	// Whether responses carry Server-Timing headers (see servertiming.go)
+	serverTimingEnabled bool
+
+	// Whether we minify our pages (see minify.go)
+	minifyHTML bool
+
+	// Whether crawlers are served the snapshots of our JavaScript demo pages (see useragents.go)
+	botSnapshots bool
+
+	// The features (demo apps and API groups) disabled at startup (see features.go)
+	disabledFeatures string
+
+	// Our config file, and whether we only check our configuration (see config.go)
+	configFile  string
+	checkConfig bool
+
+	// What we bucket visitors into our experiments by: cookie or ip (see experiments.go)
+	experimentKey string
+
+	// Per content type compression levels (see compression.go)
+	compressionLevelsFlag string
+
+	// Whether we ask visitors for consent before setting non-essential cookies, and the file
+	// their choices are saved in (see consent.go)
+	cookieConsentEnabled bool
+	consentFile          string
+
+	// The SMTP server we send emails through (see mail.go)
+	smtpAddr     string
+	smtpUsername string
+	smtpPassword string
+	smtpFrom     string
+
+	// Who the messages of our contact form are emailed to, and the file they're saved in (see
+	// contact.go)
+	contactTo   string
+	contactFile string
+
+	// The file our saved spreadsheets are kept in (see sheets.go)
+	sheetsFile string
+
+	// Who our daily report is emailed to, and when (see report.go)
+	reportTo   string
+	reportTime string
+
+	// How often we record our own uptime, and the file our uptime history is saved in (see
+	// uptime.go)
+	uptimeInterval time.Duration
+	uptimeFile     string
+
+	// How often we record our metrics (the resolution of their history) and how long we keep
+	// their history for (see timeseries.go)
+	metricsInterval  time.Duration
+	metricsRetention time.Duration
+
+	// How often our leak watchdog checks our goroutines and heap, over what window and how much
+	// growth it warns about (see watchdog.go)
+	watchdogInterval   time.Duration
+	watchdogWindow     time.Duration
+	watchdogGoroutines int
+	watchdogHeap       int64
+
+	// Where profiles are captured to when our latency or heap crosses these thresholds (see
+	// profiles.go)
+	profileDir     string
+	profileLatency time.Duration
+	profileHeap    int64
+
+	// Whether we warm up our slowest pages before reporting ready (see warmup.go)
+	warmUpEnabled bool
+
+	// The most connections we accept from each client address, and in total (see connlimit.go)
+	maxConnectionsPerIP int
+	maxConnections      int
+
+	// How long request headers may take to arrive, and how slowly a request body may arrive
+	// (see slowclients.go)
+	headerTimeout   time.Duration
+	bodyIdleTimeout time.Duration
+	minBodyRate     int
+
+	// Our certificate and key when we serve HTTPS, along with our session ticket keys, OCSP
+	// stapling and our outbound clients' session cache (see tls.go)
+	tlsCertFile           string
+	tlsKeyFile            string
+	tlsTicketKeysFile     string
+	tlsOCSPStapling       bool
+	tlsClientSessionCache int
+	tlsExpiryWarningDays  int
+
+	// How many failed admin logins an account or address may have before it's locked out, and
+	// for how long (see loginguard.go)
+	loginMaxFailures   int
+	loginMaxFailuresIP int
+	loginLockout       time.Duration
+
+	// Our signing keys (or how often we generate new ones, see signing.go)
+	signingKeysReference string
+	signingKeyRotation   time.Duration
+
+	// The file our admins' two-factor enrolments are kept in (see totp.go)
+	adminTOTPFile string
+
+	// The file of the HTML allowlist user supplied HTML is sanitised with (see sanitise.go)
+	htmlPolicyFile string
+
+	// Our runtime settings, which default to the runtime's own (and our container's limits, see
+	// tuning.go)
+	maxProcs    int
+	gcPercent   string
+	memoryLimit string
+
+	// How client addresses and user agents are anonymized in our logs (see privacy.go)
+	privacyFlag string
+	privacySalt string
+
+	// Our health state indicator (1 when healthy)
+	healthy int32
+
+	// Our server logger. It writes to standard error until main() points it at our log file.
+	logger = log.New(os.Stderr, "http: ", log.LstdFlags)
 )
 
 func main() {
@@ -39,8 +258,281 @@ func main() {
 	// Implement command line flag parsing, allowing the user to enter the http service address
 	// which defaults to 8888 (i.e. http://localhost:8888/)
 	flag.StringVar(&listenAddr, "address", ":"+DEFAULT_SERVER_ADDRESS, "http service address")
+	flag.StringVar(&siteURL, "site-url", "", "public base URL used in the sitemap (i.e. https://example.com)")
+	flag.StringVar(&robotsFile, "robots", "", "optional file whose contents are served as /robots.txt")
+	flag.Var(&logExclusions, "log-exclude", "exclude matching requests from the access log: path:<prefix>, status:<class> or ua:<substring>, with an optional @<sample rate> (repeatable)")
+	flag.StringVar(&basePath, "base-path", "", "serve the site under the given sub-path (i.e. /demo) when running behind a proxy")
+	flag.StringVar(&adminToken, "admin-token", "", "token required to access admin endpoints (admin endpoints are disabled when empty), or env:NAME, file:PATH or vault:PATH#KEY")
+	flag.StringVar(&uploadDir, "upload-dir", "uploads", "directory uploaded files are stored in")
+	flag.Int64Var(&maxUploadSize, "max-upload-size", 32<<20, "maximum size of an upload request in bytes")
+	flag.Int64Var(&maxUploadDirSize, "max-upload-dir-size", 1<<30, "maximum total size of the files in the upload directory in bytes (0 for no limit)")
+	flag.DurationVar(&shareLifetime, "share-lifetime", DEFAULT_SHARE_LIFETIME, "how long the signed links to uploaded files on the upload page are valid for (at most 168h)")
+	flag.DurationVar(&slowThreshold, "slow-threshold", 2*time.Second, "log requests taking longer than this as slow (0 disables slow request detection)")
+	flag.StringVar(&slowWebhookURL, "slow-webhook", "", "optional webhook URL which slow request alerts are POSTed to")
+	flag.StringVar(&alertWebhookURL, "alert-webhook", "", "optional Slack, Discord or generic webhook URL which server error alerts are sent to")
+	flag.StringVar(&alertFormat, "alert-format", "", "webhook payload format: slack, discord or generic (detected from the webhook URL by default)")
+	flag.IntVar(&alertThreshold, "alert-threshold", 5, "send an error alert once this many server errors occur within the alert window")
+	flag.DurationVar(&alertWindow, "alert-window", time.Minute, "the window over which server errors are counted for alerting")
+	flag.DurationVar(&alertCooldown, "alert-cooldown", 5*time.Minute, "the minimum time between two error alerts")
+	flag.StringVar(&eventsURL, "events-url", "", "optional nats:// or mqtt:// URL (with an optional subject / topic prefix path) which request events are published to")
+	flag.StringVar(&proxyUpstream, "proxy", "", "run as a caching reverse proxy in front of the given (comma separated) upstream origins (i.e. http://localhost:3000) instead of serving the demo site")
+	flag.Int64Var(&proxyCacheSize, "proxy-cache-size", 64<<20, "maximum size in bytes of the responses cached in proxy mode")
+	flag.StringVar(&proxyStrategy, "proxy-strategy", LOAD_BALANCE_ROUND_ROBIN, "how requests are spread across upstreams in proxy mode: round-robin or least-connections")
+	flag.Int64Var(&proxyMaxConnections, "proxy-max-connections", 0, "the most requests in flight to each upstream in proxy mode (0 for no limit)")
+	flag.StringVar(&proxyStickyCookie, "proxy-sticky-cookie", "", "in proxy mode, keep visitors on the same upstream via a cookie with the given name")
+	flag.DurationVar(&proxyHealthInterval, "proxy-health-interval", DEFAULT_PROXY_HEALTH_INTERVAL, "how often upstreams are actively health checked in proxy mode (0 disables active checks)")
+	flag.StringVar(&proxyHealthPath, "proxy-health-path", DEFAULT_PROXY_HEALTH_PATH, "the path upstreams are health checked at in proxy mode")
+	flag.StringVar(&canaryUpstream, "canary", "", "in proxy mode, a canary upstream origin which part of the traffic is sent to (see -canary-percent and -canary-match)")
+	flag.Float64Var(&canaryPercent, "canary-percent", 0, "the percentage of proxied requests sent to the -canary upstream")
+	flag.StringVar(&canaryMatch, "canary-match", "", "requests sent to the -canary upstream regardless of -canary-percent: header:<name>[=<value>] or cookie:<name>[=<value>]")
+	flag.StringVar(&siteRoot, "root", "", "serve the given directory as a static site (with directory listings and markdown rendering), moving the demo site under /demo")
+	flag.StringVar(&compressionLevelsFlag, "compression-levels", "", "comma separated content type (or type/*) compression levels from 1 to 11, 0 to disable compression (i.e. text/html=9,text/csv=0)")
+	flag.StringVar(&weatherURL, "weather-url", DEFAULT_WEATHER_URL, "the OpenWeatherMap compatible current weather API our weather demo fetches from")
+	flag.StringVar(&weatherKey, "weather-key", "", "the API key for the weather API (the weather demo is disabled without a key, unless -weather-url is set), or env:NAME, file:PATH or vault:PATH#KEY")
+	flag.DurationVar(&weatherTTL, "weather-ttl", 10*time.Minute, "how long weather reports are cached for each city")
+	flag.Var(&headerRuleList, "header-rule", "add, remove or rewrite request or response headers: <request|response> <path prefix> <set|add|remove|rewrite> <header name> [value] (repeatable)")
+	flag.Var(&chaosFlagRules, "chaos", "inject faults into responses: path:<prefix>,latency:<duration>,latency-rate:<p>,error-rate:<p>,error-status:<code>,drop-rate:<p> (repeatable)")
+	flag.StringVar(&captureFilterFlag, "capture", "", "capture the requests matching the given filter (i.e. path:/api,status:5xx) for admins to inspect and replay")
+	flag.StringVar(&replayTargets, "replay-targets", "", "comma separated origins (i.e. http://localhost:9000) captured requests can be replayed against, besides this server, its upstreams and -site-url")
+	flag.BoolVar(&toolsEnabled, "tools", false, "enable the /tools network diagnostics page (DNS lookups and TCP port checks run from the server)")
+	flag.StringVar(&vendorDir, "vendor-dir", "", "optional directory of vendored CDN assets (laid out by host and path) whose integrity hashes are added to our pages")
+	flag.StringVar(&mimeTypesFile, "mime-types", "", "optional mime.types style file of extra (or overriding) file extension to content type mappings")
+	flag.StringVar(&redirectsFile, "redirects", "", "optional JSON file of redirect rules (exact, prefix or regex matches) applied ahead of our routes")
+	flag.StringVar(&accessRulesFile, "access-rules-file", "", "optional JSON file the rate limits, allowed and denied addresses and redirect rules set via /debug/access-rules are saved to (and loaded from at startup)")
+	flag.StringVar(&apiKeysFile, "api-keys", "", "optional JSON file of API keys (by name and SHA-256 digest, with optional daily and monthly limits) whose requests are counted against a quota")
+	flag.IntVar(&quotaDaily, "quota-daily", DEFAULT_QUOTA_DAILY, "the requests an API key may make per day, unless it has its own limit (0 for unlimited)")
+	flag.IntVar(&quotaMonthly, "quota-monthly", DEFAULT_QUOTA_MONTHLY, "the requests an API key may make per month, unless it has its own limit (0 for unlimited)")
+	flag.StringVar(&quotaFile, "quota-file", "", "optional JSON file the usage of API keys is saved to, so that quotas survive restarts")
+	flag.StringVar(&geoIPDatabase, "geoip-db", "", "optional MaxMind format database (i.e. GeoLite2-Country.mmdb) used to log and count requests by country and region, reloaded when it changes")
+	flag.StringVar(&geoAllow, "geo-allow", "", "comma separated ISO country codes to serve, refusing other countries (needs -geoip-db)")
+	flag.StringVar(&geoDeny, "geo-deny", "", "comma separated ISO country codes to refuse (needs -geoip-db)")
+	flag.StringVar(&mocksFile, "mocks", "", "optional JSON file of mock routes (method, path, status, headers, body template and latency) to serve alongside our own")
+	flag.BoolVar(&minifyHTML, "minify-html", false, "minify our pages once they're rendered, removing comments and collapsing whitespace")
+	flag.BoolVar(&botSnapshots, "bot-snapshots", false, "serve search engine and link preview bots a static snapshot of the pages which are little more than a JavaScript demo (i.e. /excel and /sphere)")
+	flag.BoolVar(&serverTimingEnabled, "server-timing", false, "add Server-Timing headers with the middleware, handler and template render durations of each response")
+	flag.StringVar(&disabledFeatures, "disable-features", "", "comma separated demo apps and API groups to disable at startup (i.e. pdf,graphql), which admins can re-enable via /debug/features")
+	flag.Var(&experiments, "experiment", "an A/B experiment splitting visitors into buckets: name:bucket,bucket or name:bucket=weight,bucket=weight (repeatable)")
+	flag.StringVar(&experimentKey, "experiment-key", "cookie", "what visitors are bucketed into experiments by: cookie (a visitor ID cookie) or ip")
+	flag.StringVar(&privacyFlag, "privacy", "", "anonymize client IPs and user agents in our logs, events and captures: gdpr, or comma separated ip=keep|truncate|hash|drop and user-agent=keep|drop")
+	flag.StringVar(&privacySalt, "privacy-salt", "", "the key of the hashes of -privacy ip=hash (random at startup when empty), or env:NAME, file:PATH or vault:PATH#KEY")
+	flag.BoolVar(&cookieConsentEnabled, "cookie-consent", false, "show a cookie consent banner, and only set non-essential cookies (i.e. the experiment visitor ID) once visitors accept them")
+	flag.StringVar(&consentFile, "consent-file", "", "optional JSON file the cookie choices of visitors are saved in (they're kept in memory otherwise)")
+	flag.DurationVar(&uptimeInterval, "uptime-interval", DEFAULT_UPTIME_INTERVAL, "how often the server records its own health and error rate for the /uptime page (0 to disable)")
+	flag.DurationVar(&metricsInterval, "metrics-interval", DEFAULT_METRICS_INTERVAL, "how often the server records its metrics for /metrics/sparkline and /api/v1/metrics/query, which is the resolution of their history (0 to disable)")
+	flag.DurationVar(&metricsRetention, "metrics-retention", DEFAULT_METRICS_RETENTION, "how long the server keeps the history of its metrics")
+	flag.DurationVar(&watchdogInterval, "watchdog-interval", DEFAULT_WATCHDOG_INTERVAL, "how often the leak watchdog checks the server's goroutines and heap (0 to disable)")
+	flag.DurationVar(&watchdogWindow, "watchdog-window", DEFAULT_WATCHDOG_WINDOW, "the window over which the leak watchdog looks for sustained growth")
+	flag.IntVar(&watchdogGoroutines, "watchdog-goroutines", DEFAULT_WATCHDOG_GOROUTINES, "warn (and report the server as degraded) when goroutines grow by more than this over the watchdog window")
+	flag.Int64Var(&watchdogHeap, "watchdog-heap", DEFAULT_WATCHDOG_HEAP, "warn (and report the server as degraded) when the heap grows by more than this many bytes over the watchdog window")
+	flag.IntVar(&maxConnectionsPerIP, "max-conns-per-ip", DEFAULT_MAX_CONNECTIONS_PER_IP, "the most connections each client address may have open at once (0 for no limit, i.e. behind a load balancer)")
+	flag.IntVar(&maxConnections, "max-conns", DEFAULT_MAX_CONNECTIONS, "the most connections the server has open at once (0 for no limit)")
+	flag.DurationVar(&headerTimeout, "header-timeout", DEFAULT_HEADER_TIMEOUT, "how long a request's headers may take to arrive before the connection is closed (0 for the read timeout)")
+	flag.DurationVar(&bodyIdleTimeout, "body-idle-timeout", DEFAULT_BODY_IDLE_TIMEOUT, "how long a request body may go without sending anything before the connection is closed (0 to disable)")
+	flag.IntVar(&minBodyRate, "min-body-rate", DEFAULT_MIN_BODY_RATE, "the slowest rate in bytes a second a request body may arrive at on average after its first 10 seconds (0 to disable)")
+	flag.StringVar(&tlsCertFile, "tls-cert", "", "PEM certificate chain to serve HTTPS with (along with -tls-key)")
+	flag.StringVar(&tlsKeyFile, "tls-key", "", "PEM private key of the -tls-cert certificate")
+	flag.StringVar(&tlsTicketKeysFile, "tls-ticket-keys", "", "optional file of TLS session ticket keys (64 hex characters per line, newest first) shared by the server's instances, re-read every minute")
+	flag.BoolVar(&tlsOCSPStapling, "tls-ocsp", true, "staple OCSP responses from the certificate's issuer to TLS handshakes")
+	flag.IntVar(&tlsExpiryWarningDays, "tls-expiry-warning", DEFAULT_TLS_EXPIRY_WARNING_DAYS, "warn (and report the server as degraded) when the TLS certificate expires within this many days")
+	flag.IntVar(&tlsClientSessionCache, "tls-client-session-cache", DEFAULT_TLS_CLIENT_SESSION_CACHE, "how many TLS sessions outbound clients (the proxy, webhooks and so on) keep to resume (0 to disable)")
+	flag.IntVar(&loginMaxFailures, "login-max-failures", DEFAULT_LOGIN_MAX_FAILURES, "failed admin logins after which an account is locked out (0 for no limit)")
+	flag.IntVar(&loginMaxFailuresIP, "login-max-failures-ip", DEFAULT_LOGIN_MAX_FAILURES_IP, "failed admin logins after which a client address is locked out (0 for no limit)")
+	flag.DurationVar(&loginLockout, "login-lockout", DEFAULT_LOGIN_LOCKOUT, "how long accounts and addresses are locked out for after too many failed admin logins")
+	flag.StringVar(&signingKeysReference, "signing-keys", "", "the keys CSRF tokens are signed with, newest first and separated by newlines or commas, as env:NAME, file:PATH or vault:PATH#KEY (reloaded on SIGHUP, random at startup when empty)")
+	flag.StringVar(&htmlPolicyFile, "html-policy", "", "optional JSON file of the tags, attributes and URL schemes user supplied HTML (i.e. relaxed markdown) may contain, replacing the default allowlist")
+	flag.StringVar(&adminTOTPFile, "admin-totp-file", "", "optional JSON file the admins' two-factor authentication enrolments are kept in, which must only be readable by its owner (they're kept in memory otherwise)")
+	flag.DurationVar(&signingKeyRotation, "signing-key-rotation", 0, "how often a new random signing key is generated when -signing-keys isn't given (at least 84h, or 0 to keep the one generated at startup)")
+	flag.IntVar(&maxProcs, "gomaxprocs", 0, "the most CPUs to run Go code on at once (0 for the runtime's default, which follows the container's CPU quota)")
+	flag.StringVar(&gcPercent, "gogc", "", "the garbage collector's target percentage, or off (overrides GOGC)")
+	flag.StringVar(&memoryLimit, "gomemlimit", "auto", "the runtime's soft memory limit, i.e. 512MiB (overrides GOMEMLIMIT), or auto for 90% of the container's memory limit when GOMEMLIMIT isn't set")
+	flag.BoolVar(&warmUpEnabled, "warm-up", true, "render the slowest pages once at startup, before /readyz reports the server ready")
+	flag.StringVar(&profileDir, "profile-dir", "profiles", "directory CPU, heap and goroutine profiles are captured in when the server is slow or its heap is large (empty to disable)")
+	flag.DurationVar(&profileLatency, "profile-latency", DEFAULT_PROFILE_LATENCY, "capture profiles when the 95th percentile request latency over 10 seconds is above this (0 to disable)")
+	flag.Int64Var(&profileHeap, "profile-heap", DEFAULT_PROFILE_HEAP, "capture profiles when the heap is larger than this many bytes (0 to disable)")
+	flag.StringVar(&uptimeFile, "uptime-file", "", "optional JSON file the uptime history is saved in (it's kept in memory otherwise)")
+	flag.StringVar(&smtpAddr, "smtp-addr", "", "the host:port of the SMTP server emails are sent through (i.e. smtp.example.com:587)")
+	flag.StringVar(&smtpUsername, "smtp-username", "", "the username we authenticate to the SMTP server with (if any)")
+	flag.StringVar(&smtpPassword, "smtp-password", "", "the password we authenticate to the SMTP server with, or env:NAME, file:PATH or vault:PATH#KEY")
+	flag.StringVar(&smtpFrom, "smtp-from", "", "the address emails are sent from (i.e. \"Demo Server <server@example.com>\")")
+	flag.StringVar(&contactTo, "contact-to", "", "comma separated email addresses the messages of the /contact form are sent to (they're only stored otherwise)")
+	flag.StringVar(&contactFile, "contact-file", "", "optional JSON file the messages of the /contact form are saved in (they're kept in memory otherwise)")
+	flag.StringVar(&reportTo, "report-to", "", "comma separated email addresses the daily report (request counts, top routes, errors and slowest requests) is sent to")
+	flag.StringVar(&reportTime, "report-time", DEFAULT_REPORT_TIME, "the time of day (HH:MM, UTC) the daily report is sent at")
+	flag.StringVar(&sheetsFile, "sheets-file", "", "optional JSON file the spreadsheets saved by the Excel demo (and their revisions) are kept in (they're kept in memory otherwise)")
+	flag.StringVar(&configFile, "config", "", "optional JSON or YAML file of flag names and values, for the flags not given on the command line")
+	flag.BoolVar(&checkConfig, "check-config", false, "check the configuration (flags and -config file), report any problems and exit")
+	flag.BoolVar(&devMode, "dev", false, "development mode (i.e. enter maintenance mode instead of exiting when templates fail to load)")
 	flag.Parse()
 
+	// Our config file fills in the flags our command line didn't set, and then we check the flags
+	// which depend on each other (see config.go)
+	var configProblems []error
+	if configFile != "" {
+		configProblems = loadConfigFile(configFile)
+	}
+	configProblems = append(configProblems, validateConfig()...)
+
+	if checkConfig {
+		if len(configProblems) > 0 {
+			fmt.Fprint(os.Stderr, configErrorReport(configProblems))
+			os.Exit(1)
+		}
+		fmt.Println("The configuration is valid")
+		os.Exit(0)
+	}
+	if len(configProblems) > 0 {
+		log.Fatal(configErrorReport(configProblems))
+	}
+
+	// Our secret flags can refer to where their secrets are kept (see secrets.go)
+	if err := loadSecrets(); err != nil {
+		log.Fatal("Invalid secret: ", err)
+	}
+
+	if err := loadSigningKeys(signingKeysReference); err != nil {
+		log.Fatal("Invalid signing keys: ", err)
+	}
+	if signingKeyRotation > 0 {
+		startSigningKeyRotation(signingKeyRotation)
+	}
+	reloadSigningKeysOnHangup(signingKeysReference)
+
+	if htmlPolicyFile != "" {
+		if err := loadHTMLPolicy(htmlPolicyFile); err != nil {
+			log.Fatal("Invalid -html-policy: ", err)
+		}
+	}
+
+	if adminTOTPFile != "" {
+		if err := loadTOTPAccounts(adminTOTPFile); err != nil {
+			log.Fatal("Invalid -admin-totp-file: ", err)
+		}
+	}
+
+	// Make sure our base path is in the form we expect (i.e. /demo)
+	normalisedBasePath, err := normaliseBasePath(basePath)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	basePath = normalisedBasePath
+
+	if mimeTypesFile != "" {
+		if err := loadMimeTypes(mimeTypesFile); err != nil {
+			log.Fatal("Invalid -mime-types: ", err)
+		}
+	}
+
+	if redirectsFile != "" {
+		if err := loadRedirects(redirectsFile); err != nil {
+			log.Fatal("Invalid -redirects: ", err)
+		}
+	}
+
+	if apiKeysFile != "" {
+		if err := loadAPIKeys(apiKeysFile); err != nil {
+			log.Fatal("Invalid -api-keys: ", err)
+		}
+	}
+
+	if mocksFile != "" {
+		if err := loadMocks(mocksFile); err != nil {
+			log.Fatal("Invalid -mocks: ", err)
+		}
+	}
+
+	if err := disableFeatures(disabledFeatures); err != nil {
+		log.Fatal("Invalid -disable-features: ", err)
+	}
+
+	if err := parseCompressionLevels(compressionLevelsFlag); err != nil {
+		log.Fatal("Invalid -compression-levels: ", err)
+	}
+
+	// Our JSON file stores are loaded when our components start (see components.go)
+	if consentFile != "" {
+		registerComponent("consent-store", newStoreComponent("consent-file", func() error {
+			return loadConsents(consentFile)
+		}))
+	}
+
+	if uptimeFile != "" {
+		registerComponent("uptime-store", newStoreComponent("uptime-file", func() error {
+			return loadUptimeHistory(uptimeFile)
+		}))
+	}
+
+	if contactTo != "" {
+		if _, err := parseMailAddresses(contactTo); err != nil {
+			log.Fatal("Invalid -contact-to: ", err)
+		}
+	}
+
+	if contactFile != "" {
+		registerComponent("contact-store", newStoreComponent("contact-file", func() error {
+			return loadContactMessages(contactFile)
+		}))
+	}
+
+	// The access rules saved by admins apply over our built in rates and the -redirects file
+	if accessRulesFile != "" {
+		registerComponent("access-rules-store", newStoreComponent("access-rules-file", func() error {
+			return loadAccessRules(accessRulesFile)
+		}))
+	}
+
+	if quotaFile != "" {
+		registerComponent("quota-store", newQuotaStore(quotaFile))
+	}
+
+	if geoIPDatabase != "" {
+		registerComponent("geoip", newGeoIPComponent(geoIPDatabase, geoAllow, geoDeny))
+	}
+
+	registerComponent("csv-viewer-store", newStoreComponent("upload-dir", loadCSVViewerFiles))
+
+	if sheetsFile != "" {
+		registerComponent("sheets-store", newStoreComponent("sheets-file", func() error {
+			return loadSavedSheets(sheetsFile)
+		}))
+	}
+
+	if reportTo != "" {
+		if _, err := parseMailAddresses(reportTo); err != nil {
+			log.Fatal("Invalid -report-to: ", err)
+		}
+		at, err := parseTimeOfDay(reportTime)
+		if err != nil {
+			log.Fatal("Invalid -report-time: ", err)
+		}
+		registerComponent("report-job", newDailyJob("report", at, sendReport))
+	}
+
+	if err := parsePrivacy(privacyFlag, privacySalt); err != nil {
+		log.Fatal("Invalid -privacy: ", err)
+	}
+
+	// Chaos mode starts enabled when we're given chaos rules (see chaos.go)
+	chaos.rules = chaosFlagRules
+	chaos.enabled = len(chaosFlagRules) > 0
+	setGauge("chaos_enabled", map[bool]float64{false: 0, true: 1}[chaos.enabled])
+
+	if captureFilterFlag != "" {
+		filter, err := parseCaptureFilter(captureFilterFlag)
+		if err != nil {
+			log.Fatal("Invalid -capture: ", err)
+		}
+		captures.setFilter(filter)
+	}
+
+	// In static site mode our site is served from our base path, while the demo site moves
+	// under /demo (see site.go)
+	if siteRoot != "" {
+		sitePath = basePath
+		basePath += "/demo"
+	}
+
 	// Prepare our log file for writing / appending new logging info:
 	logFile, err := os.OpenFile(LOG_FILE_NAME, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 
@@ -52,7 +544,134 @@ func main() {
 
 	// We log the results to our file with the date and time in the local timezone included
 	// or prefixed to each entry.
-	logger := log.New(logFile, "http: ", log.LstdFlags)
+	logger = log.New(logFile, "http: ", log.LstdFlags)
+
+	if err := applyRuntimeTuning(maxProcs, gcPercent, memoryLimit); err != nil {
+		log.Fatal("Invalid runtime settings: ", err)
+	}
+
+	// We serve HTTPS when we're given a certificate (see tls.go)
+	var tlsConfig *tls.Config
+	if tlsCertFile != "" {
+		if tlsConfig, err = newTLSConfig(tlsCertFile, tlsKeyFile, tlsTicketKeysFile, tlsOCSPStapling); err != nil {
+			log.Fatal("Invalid TLS settings: ", err)
+		}
+	}
+	applyTLSClientSessionCache(tlsClientSessionCache)
+
+	// Hash the vendored copies of our CDN assets so that our pages can check the files
+	// browsers download from the CDNs (see assets.go)
+	if vendorDir != "" {
+		count, err := loadAssetIntegrity(vendorDir)
+		if err != nil {
+			log.Fatal("Invalid -vendor-dir: ", err)
+		}
+		logger.Printf("Computed the integrity hashes of %d vendored assets", count)
+	}
+
+	// In proxy mode we front the upstream origin rather than serving our own routes (see
+	// proxy.go)
+	var mainHandler http.Handler
+
+	if proxyUpstream != "" {
+		proxy, err := newCachingProxy(proxyUpstream, proxyCacheSize)
+		if err != nil {
+			log.Fatal("Invalid -proxy: ", err)
+		}
+		if canaryUpstream != "" {
+			proxy.canary, err = newCanaryRoute(canaryUpstream, canaryPercent, canaryMatch)
+			if err != nil {
+				log.Fatal("Invalid -canary: ", err)
+			}
+		}
+		if proxyHealthInterval > 0 {
+			registerComponent("health-checks", newHealthChecker(proxyTargets(proxy), proxyHealthInterval, proxyHealthPath))
+		}
+		mainHandler = basePathHandler(proxyRouteHandler(proxy))
+	} else if siteRoot != "" {
+		root, err := os.OpenRoot(siteRoot)
+		if err != nil {
+			log.Fatal("Invalid -root: ", err)
+		}
+		siteFiles = root
+		mainHandler = staticSiteHandler(root, basePathHandler(routeHandler()))
+	} else {
+		mainHandler = basePathHandler(routeHandler())
+	}
+
+	// Our uptime page is part of our own routes, so there's nothing to record in proxy mode
+	if proxyUpstream == "" && uptimeInterval > 0 {
+		registerComponent("uptime-recorder", newUptimeRecorder(uptimeInterval), "uptime-store")
+	}
+
+	if metricsInterval > 0 {
+		registerComponent("metrics-sampler", newMetricsSampler(metricsInterval, metricsRetention))
+	}
+
+	if watchdogInterval > 0 {
+		registerComponent("watchdog", newWatchdog(watchdogInterval))
+	}
+
+	if profileDir != "" && (profileLatency > 0 || profileHeap > 0) {
+		startProfileTrigger()
+	}
+
+	// Parse and validate all of our templates up front. If any of them are broken we refuse to
+	// start (or enter maintenance mode in development mode) with a report of what failed.
+
+	if templateErrors := loadTemplates(); len(templateErrors) > 0 {
+		report := templateErrorReport(templateErrors)
+		logger.Print(report)
+
+		if !devMode {
+			log.Fatal(report)
+		}
+
+		fmt.Fprint(os.Stderr, report)
+		fmt.Fprintln(os.Stderr, "Entering maintenance mode (-dev)")
+		mainHandler = maintenanceHandler(report)
+	}
+
+	// In development mode, flag the places our source trusts non-constant HTML (see
+	// templateaudit.go)
+	if devMode {
+		runTemplateAudit()
+	}
+
+	// Our background webhook notifiers for slow request and error alerts (see webhook.go)
+	if slowWebhookURL != "" {
+		slowRequestAlerts = newWebhookNotifier(slowWebhookURL, alertFormat)
+		registerComponent("slow-request-alerts", slowRequestAlerts)
+	}
+
+	if alertWebhookURL != "" {
+		errorAlerts = &errorAlerter{
+			notifier:  newWebhookNotifier(alertWebhookURL, alertFormat),
+			threshold: alertThreshold,
+			window:    alertWindow,
+			cooldown:  alertCooldown,
+		}
+		registerComponent("error-alerts", errorAlerts.notifier)
+	}
+
+	// Publishing request events to our event bus (see events.go)
+	if eventsURL != "" {
+		requestEvents, err = newEventPublisher(eventsURL)
+		if err != nil {
+			log.Fatal("Invalid -events-url: ", err)
+		}
+		registerComponent("events", requestEvents)
+	}
+
+	// Our demo apps may send alerts and events until they've shut down (see demoapps.go)
+	registerComponent("demo-apps", componentFuncs{stop: shutdownDemoApps}, "slow-request-alerts", "error-alerts", "events")
+
+	// Start everything we've registered, in dependency order
+	startupCtx, cancelStartup := context.WithTimeout(context.Background(), COMPONENT_START_TIMEOUT)
+	if err := startComponents(startupCtx); err != nil {
+		log.Fatal("Could not start the server: ", err)
+	}
+	cancelStartup()
 
 	// Create a new request ID based on the number of nanoseconds elapsed from January 1, 1970 UTC
 	// until today / now.
@@ -63,14 +682,31 @@ func main() {
 	// Create the custom HTTP server with the parameters we want to use along with our logging,
 	// tracing and route handlers
 	server := &http.Server{
-		Addr:         listenAddr,
-		Handler:      tracingHandler(nextRequestID)(loggingHandler(logger)(routeHandler())),
-		ErrorLog:     logger,
-		ReadTimeout:  READ_TIMEOUT * time.Second,
-		WriteTimeout: WRITE_TIMEOUT * time.Second,
-		IdleTimeout:  IDLE_TIMEOUT * time.Second,
+		Addr: listenAddr,
+		Handler: slowBodyHandler(tracingHandler(nextRequestID)(headerRulesHandler(
+			requestCaptureHandler(
+				traceStage("metrics")(metricsMiddleware(
+					slowRequestHandler(
+						traceStage("logging")(loggingHandler(logger)(
+							requestEventHandler(accessRulesHandler(geoIPHandler(quotaHandler(redirectHandler(
+								experimentHandler(
+									chaosHandler(
+										errorAlertHandler(
+											compressionHandler(
+												traceStage("routing")(mainHandler))))))))))))))))))),
+		ErrorLog:          logger,
+		ReadTimeout:       READ_TIMEOUT * time.Second,
+		ReadHeaderTimeout: headerTimeout,
+		WriteTimeout:      WRITE_TIMEOUT * time.Second,
+		IdleTimeout:       IDLE_TIMEOUT * time.Second,
+		ConnContext:       connectionContext,
+		ConnState:         policeConnState,
+		TLSConfig:         tlsConfig,
 	}
 
+	// Captured requests are replayed through our full handler stack (see capture.go)
+	localHandler = server.Handler
+
 	// Go signal notification works by sending os.Signal values on a channel. We’ll create a
 	// channel to receive these notifications (we’ll also make one to notify us when the
 	// program can exit).
@@ -109,17 +745,40 @@ func main() {
 			logger.Fatalf("Could not gracefully shutdown the server: %v\n", err)
 		}
 
+		// Stop our components, which delivers any alerts and request events which are still
+		// queued up (see components.go). Failures are logged as they happen.
+		stopComponents(ctx)
+
 		close(doneChannel)
 
 	}()
 
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		logger.Fatalf("Could not listen on %s: %v\n", listenAddr, err)
+	}
+
+	// Our listener resets the connections over our connection limits (see connlimit.go) and
+	// polices the rest for slow clients (see slowclients.go), beneath TLS when we serve HTTPS
+	var serving net.Listener = newPolicedListener(newLimitedListener(listener, maxConnectionsPerIP, maxConnections))
+	if tlsConfig != nil {
+		serving = tls.NewListener(serving, tlsConfig)
+	}
+
 	logger.Println("Server is ready to handle requests at ", listenAddr)
 
 	// Atomically update our health state indicator to 'healthy'
 	atomic.StoreInt32(&healthy, 1)
 
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		logger.Fatalf("Could not listen on %s: %v\n", listenAddr, err)
+	// We aren't ready until we've warmed up (see warmup.go)
+	if proxyUpstream == "" && warmUpEnabled {
+		go warmUp(mainHandler)
+	} else {
+		atomic.StoreInt32(&warmedUp, 1)
+	}
+
+	if err := server.Serve(serving); err != nil && err != http.ErrServerClosed {
+		logger.Fatalf("Could not serve on %s: %v\n", listenAddr, err)
 	}
 
 	// If we receive a signal via the done channel, we log the event:
@@ -134,171 +793,208 @@ func routeHandler() *http.ServeMux {
 	// Create a new multiplexer / router to route our requests to the correct handler
 	router := http.NewServeMux()
 
-	// Main web application handlers:
-	router.HandleFunc("/", indexHandler)
-	router.HandleFunc("/excel", excelHandler)
-	router.HandleFunc("/qr-code-generator", qrCodeHandler)
-	router.HandleFunc("/svg", svgHandler)
-	router.HandleFunc("/sphere", sphereHandler)
+	// Main web application handlers. These come from our page registry (see pages.go) so
+	// that new demo applications only need to be registered in one place. Routes are
+	// registered via handleRoute (see routes.go) which takes care of HEAD, OPTIONS and
+	// unsupported methods for us.
+	for _, page := range pageRegistry {
+		handleRoute(router, routePattern(page.Path), pageCacheHandler(page, botSnapshotHandler(page)), page.Methods...)
+	}
+
+	// The other routes of our self-contained demo apps (see demoapps.go)
+	registerDemoAppRoutes(router)
 
 	// Health and logging handlers for demoing extra functionality
-	router.HandleFunc("/health", healthHandler)
-	router.HandleFunc("/log", logHandler)
+	handleRoute(router, "/health", http.HandlerFunc(healthHandler))
+	handleRoute(router, "/readyz", readinessHandler(nil))
+	handleRoute(router, "/status", serverStatusHandler(nil))
+	handleRoute(router, "/log", writeDeadlineHandler(DOWNLOAD_WRITE_TIMEOUT, http.HandlerFunc(logHandler)))
+	handleRoute(router, "/metrics", http.HandlerFunc(metricsHandler))
+	handleRoute(router, "/metrics/sparkline", http.HandlerFunc(sparklineHandler))
 
-	return router
+	// Crawler related handlers
+	handleRoute(router, "/sitemap.xml", http.HandlerFunc(sitemapHandler))
+	handleRoute(router, "/robots.txt", http.HandlerFunc(robotsHandler))
 
-}
+	// Image thumbnailing / resizing (see images.go)
+	handleRoute(router, "/img/resize", http.HandlerFunc(imageResizeHandler))
 
-// HTML data element which is used to pass in the required data we want to include in our
-// applications / html templates.
-type HtmlData struct {
-	Title       string
-	Description string
-	Keywords    string
-	Author      string
-	CssFiles    []string
-	JsFiles     []string
-	CssScript   template.HTML
-	JsScript    template.HTML
-	BodyContent template.HTML
-}
+	// Server-side chart rendering (see charts.go)
+	handleRoute(router, "/chart", http.HandlerFunc(chartHandler), http.MethodGet, http.MethodPost)
 
-// This is our main CSS script. Currently, we pass this into our template each time we
-// construct one. Ideally, this should be a nested template or file which is included
-// as part of our main template. The only reason the raw data is included here is to
-// make the code more readable. You can find the raw CSS file (called style.css) in the
-// css folder.
-const MAIN_CSS_TEMPLATE = `
-<style>
+	// PDF exports of our demo pages (see pdf.go)
+	handleRoute(router, "/export/pdf", http.HandlerFunc(pdfExportHandler), http.MethodGet, http.MethodPost)
 
-	/* Horizontal NavBar */
+	// Server-side evaluation of our spreadsheet's formulas, and exports of its computed values
+	// (see spreadsheet.go)
+	handleRoute(router, "/api/v1/spreadsheet/evaluate", http.HandlerFunc(spreadsheetEvaluateHandler), http.MethodPost)
+	handleRoute(router, "/export/spreadsheet", http.HandlerFunc(spreadsheetExportHandler), http.MethodGet, http.MethodPost)
 
-	nav a {
-		text-decoration: none;
-		color: #fff;
-		font-size: 110%;
-		font-family: 'Open Sans', sans-serif;   
-	}
+	// Streaming CSV / JSON conversion (see convert.go)
+	handleRoute(router, "/api/v1/convert/csv-to-json", http.HandlerFunc(csvToJSONHandler), http.MethodPost)
+	handleRoute(router, "/api/v1/convert/json-to-csv", http.HandlerFunc(jsonToCSVHandler), http.MethodPost)
 
-	li {
-		text-decoration: none;
-		display: inline-block;
-		margin: 8% 4% -1% 4%;
-		padding: 1%;
-	}
+	// Rendering markdown for other tools (see markdown.go)
+	handleRoute(router, "/api/v1/markdown", http.HandlerFunc(markdownHandler), http.MethodPost)
 
-	/* Adding NavBar Background */
+	// Server-side syntax highlighting (see highlight.go)
+	handleRoute(router, "/api/v1/highlight", http.HandlerFunc(highlightHandler), http.MethodPost)
 
-	.main-nav {
-		background: #000000;
-		text-align: center;
-		position: fixed;
-		top: 0;
-		left: 0;
-		right: 0;
-		opacity: 0.6;
-		z-index: 9999;
-		margin: -10%;
-	}
+	// Formatting, validating and converting JSON and YAML documents (see format.go)
+	handleRoute(router, "/api/v1/format/{action}", http.HandlerFunc(formatAPIHandler), http.MethodPost)
 
-	/* Setting Hover States */
+	// Generating passwords and checking their strength (see password.go)
+	handleRoute(router, "/api/v1/password/generate", http.HandlerFunc(passwordGenerateHandler), http.MethodGet)
+	handleRoute(router, "/api/v1/password/strength", http.HandlerFunc(passwordStrengthHandler), http.MethodPost)
 
-	a:hover {
-		color: #a9a9a9;
-	}
+	// Colour palettes (see colors.go)
+	handleRoute(router, "/api/v1/colors", http.HandlerFunc(colorsAPIHandler), http.MethodGet)
 
-	a:active {
-		color: #a9a9a9;
-	}
+	// Fake data for test fixtures (see fake.go)
+	handleRoute(router, "/api/v1/fake", http.HandlerFunc(fakeDataHandler), http.MethodGet)
 
-	/* Body Styles */
+	// The quotas of API keys (see quotas.go)
+	handleRoute(router, QUOTA_STATUS_PATH, http.HandlerFunc(quotaStatusHandler), http.MethodGet)
 
-	body {
-		margin: 0;
-		font-family: 'Open Sans', sans-serif; 
-		font-weight: 100;
-	}
+	// The history of our metrics (see timeseries.go)
+	handleRoute(router, "/api/v1/metrics/query", http.HandlerFunc(metricsQueryHandler), http.MethodGet)
 
-	body, html
-	{
-		height: 100%;
-	}
+	// QR codes and barcodes as images (see barcode.go)
+	handleRoute(router, "/api/v1/codes/{type}", http.HandlerFunc(codeHandler))
 
-	#table-container
-	{
-		display:    table;
-		text-align: center;
-		width:      100%;
-		height:     100%;
-	}
+	// Browsing uploaded CSV files (see csvviewer.go)
+	handleRoute(router, "/csv-viewer/{id}", http.HandlerFunc(csvViewerTableHandler))
+
+	// Filling XLSX templates with data, i.e. for reports (see xlsxfill.go)
+	handleRoute(router, "/api/v1/xlsx/fill", http.HandlerFunc(xlsxFillHandler), http.MethodPost)
+
+	// Saved spreadsheets and their revision history (see sheets.go)
+	handleRoute(router, "/api/v1/sheets/{name}", http.HandlerFunc(sheetHandler), http.MethodGet, http.MethodPost)
+	handleRoute(router, "/api/v1/sheets/{name}/revisions", http.HandlerFunc(sheetRevisionsHandler))
+	handleRoute(router, "/sheets/{name}", http.HandlerFunc(sheetHistoryHandler), http.MethodGet, http.MethodPost)
+	handleRoute(router, "/sheets/{name}/diff", http.HandlerFunc(sheetDiffHandler))
 
-	#container
-	{
-		display:        table-cell;
-		vertical-align: middle;
+	// Our GraphQL API and its short URLs, along with a GraphiQL playground in development mode (see
+	// graphql.go and graphqldata.go)
+	handleRoute(router, "/api/graphql", http.HandlerFunc(graphQLHandler), http.MethodGet, http.MethodPost)
+	handleRoute(router, SHORT_URL_PATH_PREFIX+"{code}", http.HandlerFunc(shortURLHandler))
+	handleRoute(router, PASTE_PATH_PREFIX+"{id}", http.HandlerFunc(pasteHandler))
+	if devMode {
+		handleRoute(router, "/graphiql", http.HandlerFunc(graphiQLHandler))
 	}
 
-	#main
-	{
-		display: inline-block;
+	// Atom feeds of the items shared via our demos (see feed.go)
+	handleRoute(router, "/feeds/qr-codes.atom", http.HandlerFunc(qrCodeFeedHandler))
+	handleRoute(router, "/feeds/pastes.atom", http.HandlerFunc(pasteFeedHandler))
+	handleRoute(router, "/feeds/short-urls.atom", http.HandlerFunc(shortURLFeedHandler))
+
+	// Our search API, alongside the /search page (see search.go)
+	handleRoute(router, "/api/v1/search", http.HandlerFunc(searchAPIHandler))
+
+	// Our cookie consent preference endpoint (see consent.go)
+	if cookieConsentEnabled {
+		handleRoute(router, "/consent", http.HandlerFunc(consentHandler), http.MethodGet, http.MethodPost)
 	}
 
-	#spreadsheet
-	{
-		margin: 20px;
+	// httpbin style request inspection endpoints (see inspect.go)
+	registerInspectionRoutes(router)
+
+	// Favicon, apple touch icons and web app manifest (see static.go)
+	registerStaticFiles(router)
+
+	// Admin-only debugging handlers (see admin.go)
+	handleRoute(router, "/debug/trace/{id}", adminOnly(http.HandlerFunc(traceHandler)))
+	registerCaptureRoutes(router)
+	registerProfileRoutes(router)
+	handleRoute(router, "/debug/chaos", adminOnly(http.HandlerFunc(chaosAdminHandler)), http.MethodGet, http.MethodPut)
+	handleRoute(router, "/debug/access-rules", adminOnly(http.HandlerFunc(accessRulesAdminHandler)), http.MethodGet, http.MethodPut)
+	handleRoute(router, "/debug/features", adminOnly(http.HandlerFunc(featuresAdminHandler)), http.MethodGet, http.MethodPut)
+	handleRoute(router, "/debug/circuits", adminOnly(circuitsAdminHandler(nil)), http.MethodGet, http.MethodPost)
+	handleRoute(router, "/debug/config", adminOnly(http.HandlerFunc(configAdminHandler)))
+	handleRoute(router, "/debug/routes", adminOnly(http.HandlerFunc(routesAdminHandler)))
+	handleRoute(router, "/debug/report", adminOnly(http.HandlerFunc(reportAdminHandler)), http.MethodGet, http.MethodPost)
+	handleRoute(router, "/debug/contact", adminOnly(http.HandlerFunc(contactMessagesHandler)))
+	handleRoute(router, "/debug/totp", adminOnly(http.HandlerFunc(totpAdminHandler)), http.MethodGet, http.MethodPost)
+	if devMode {
+		handleRoute(router, "/debug/template-audit", adminOnly(http.HandlerFunc(templateAuditHandler)))
 	}
+	handleRoute(router, "/uploads/{name}", adminOnly(http.HandlerFunc(uploadedFileHandler)))
+	handleRoute(router, "/files/download-all", adminOnly(http.HandlerFunc(downloadAllHandler)))
+	handleRoute(router, "/debug/share", adminOnly(http.HandlerFunc(shareAdminHandler)), http.MethodGet, http.MethodPost)
 
-	.main-content {
+	// Signed links to uploaded files, which anyone holding one can download (see sharedlinks.go)
+	handleRoute(router, "/shared/{token}", http.HandlerFunc(sharedFileHandler))
 
-		position: absolute;
-		left: 50%;
-		top: 50%;
-		transform: translate(-50%, -50%);
-		
-		width: 70%;
-		height: 60%;
+	// Mock routes defined via -mocks (see mocks.go)
+	registerMockRoutes(router)
 
-		padding-top: 40px;  
-		padding-bottom: 20px;  
-		padding-left: 20px;  
-		padding-right: 20px;  
+	// Cleaner addresses for our demo pages (see rewrites.go)
+	registerRewrites(router)
 
-		color: black;
-		text-align: center;
+	// Anything else which doesn't match one of our routes
+	router.HandleFunc("/", notFoundHandler)
 
-	}
+	return router
 
-	/* Form elements for inputting / submitting QR Codes */
+}
 
-	form input {
-		float:center;
-		clear:both;
-	}
-	
-	form input {
-		margin:15px 0;
-		padding:15px 10px;
-		width:40%;
-		text-align: center;
-		outline:none;
-		border:1px solid #bbb;
-		border-radius:20px;
-		display:inline-block;
-		-webkit-box-sizing:border-box;
-		   -moz-box-sizing:border-box;
-				box-sizing:border-box;
-		-webkit-transition:0.2s ease all;
-		   -moz-transition:0.2s ease all;
-			-ms-transition:0.2s ease all;
-			 -o-transition:0.2s ease all;
-				transition:0.2s ease all;
-	}
-	
-	form input[type=text]:focus {
-		border-color:cornflowerblue;
-	}
+// HTML data element which is used to pass in the required data we want to include in our
+// applications / html templates.
+type HtmlData struct {
+	Title       string
+	Description string
+	Keywords    string
+	Author      string
+	CssFiles    []Asset // See assets.go
+	JsFiles     []Asset
+	CssScript   template.HTML // Any CSS the page needs on top of our main stylesheet
+	JsScript    template.HTML
+	BodyContent template.HTML
+	NavPages    []Page
+	Experiments map[string]string // The visitor's experiment buckets (see experiments.go)
+
+	// Our main stylesheet, which is inlined into every page (see styles.go)
+	MainStylesheet template.CSS
+
+	// The preview shown when the page is shared in chat apps and on social media, which is
+	// filled in from the page's title and description where it's left empty (see socialcards.go)
+	SocialCard SocialCard
 
-</style>
+	// Where the page sits within our site, shown as breadcrumbs (see pagemeta.go)
+	Metadata PageMetadata
+
+	// Whether to show our cookie consent banner, and the page it sends visitors back to (see
+	// consent.go)
+	ConsentBanner bool
+	ConsentReturn string
+
+	// The visitor's flash messages, which are shown once at the top of the page (see flash.go)
+	Flashes []Flash
+
+	// The status we respond with (200 if it's left unset). Pages set it here rather than writing
+	// it themselves, as rendering the page sets cookies (i.e. clearing the visitor's flashes).
+	Status int
+}
+
+// This is the body of our home page, which lists our pages by section. You can find the raw
+// template file in the templates sub-directory titled index.body.tmpl.
+const INDEX_BODY_TEMPLATE = `
+<div class = "main-content">
+	<h2>Simple Golang Web Server</h2>
+	<p>This is a simple golang web server example with built in logging, tracing, a health check, and graceful shutdown.</p>
+	<br>
+	<h4>It also includes a few demo web applications, including:</h4>
+	<p>An Excel / Spreadsheet application using <a href="https://bossanova.uk/jexcel/v2/">JExcel</a></p>
+	<p>A QR Code and barcode generator</p>
+	<p>An SVG drawing example (taken from <a href="https://github.com/adonovan/gopl.io/blob/master/ch3/surface/main.go">The Go Programming Language</a>)</p>
+	<p>A 3D sphere example using <a href="https://threejs.org/">THREE.JS</a></p>
+	{{ range . }}
+	<h4 id="{{ .Anchor }}">{{ .Name }}</h4>
+	<p class="page-section">
+		{{ range $index, $page := .Pages }}{{ if $index }} &middot; {{ end }}<a href="{{ url $page.Path }}">{{ $page.Title }}</a>{{ end }}
+	</p>
+	{{ end }}
+</div>
 `
 
 // This is our main HTML template which is used to construct our web applications. Ideally, this
@@ -315,36 +1011,42 @@ const MAIN_HTML_TEMPLATE = `
 	<meta name="keywords" content="{{ .Keywords }}">
 	<meta name="author" content="{{ .Author }}">
 
+	<link rel="icon" href="{{ assetPath "favicon.ico" }}">
+	<link rel="apple-touch-icon" href="{{ assetPath "apple-touch-icon.png" }}">
+	<link rel="manifest" href="{{ assetPath "site.webmanifest" }}">
+
 	<title>{{ .Title }}</title>
 
-	{{ range $index, $cssFileLocation := .CssFiles }}
-	<link rel="stylesheet" type="text/css" href="{{ $cssFileLocation }}">
+	{{ template "social" . }}
+	{{ template "linked-data" . }}
+
+	{{ range .CssFiles }}
+	{{ if .Critical }}
+	<link rel="stylesheet" type="text/css" href="{{ .URL }}"{{ if .Integrity }} integrity="{{ .Integrity }}"{{ end }}{{ if .CrossOrigin }} crossorigin="{{ .CrossOrigin }}"{{ end }}>
+	{{ else }}
+	<link rel="preload" as="style" href="{{ .URL }}"{{ if .Integrity }} integrity="{{ .Integrity }}"{{ end }}{{ if .CrossOrigin }} crossorigin="{{ .CrossOrigin }}"{{ end }} onload="this.onload = null; this.rel = 'stylesheet'">
+	<noscript><link rel="stylesheet" type="text/css" href="{{ .URL }}"{{ if .Integrity }} integrity="{{ .Integrity }}"{{ end }}{{ if .CrossOrigin }} crossorigin="{{ .CrossOrigin }}"{{ end }}></noscript>
+	{{ end }}
 	{{ end }}
 
-	{{ range $index, $jsFileLocation := .JsFiles }}
-	<script src="{{ $jsFileLocation }}"></script>
+	{{ range .JsFiles }}
+	<script src="{{ .URL }}"{{ if .Integrity }} integrity="{{ .Integrity }}"{{ end }}{{ if .CrossOrigin }} crossorigin="{{ .CrossOrigin }}"{{ end }}{{ if not .Critical }} defer{{ end }}></script>
 	{{ end }}
 
+	<style>{{ .MainStylesheet }}</style>
 	{{ .CssScript }}
 	
 </head>
 
 <header>
-    <div class="main-nav">
-        <nav>
-			<ul>
-				<li><a href="/"/>Home</a></li>
-				<li><a href="/excel"/>Excel App</a></li>
-				<li><a href="/qr-code-generator"/>QR Code Generator</a></li>
-				<li><a href="/svg">SVG Example</a></li>
-				<li><a href="/sphere"/>Sphere</a></li>
-			</ul>
-        </nav>
-    </div>
+	{{ template "nav" . }}
 </header>
 
-<body>
+<body{{ if .Experiments }} class="{{ range $name, $bucket := .Experiments }}experiment-{{ $name }}-{{ $bucket }} {{ end }}"{{ end }}>
+	{{ template "flashes" . }}
 	{{ .BodyContent }}
+	{{ template "breadcrumbs" . }}
+	{{ template "consent" . }}
 </body>
 
 {{ .JsScript }}
@@ -352,12 +1054,91 @@ const MAIN_HTML_TEMPLATE = `
 </html> 
 `
 
+// This is our navigation bar partial which is rendered as part of our main HTML template. The
+// links are generated from our page registry (see pages.go), so any newly registered page
+// automatically shows up here. You can find the raw file in the templates folder (nav.tmpl).
+const NAV_HTML_TEMPLATE = `
+{{ define "nav" }}
+    <div class="main-nav">
+        <nav>
+			<ul>
+				{{ range $index, $page := .NavPages }}
+				<li><a href="{{ url $page.Path }}">{{ $page.Title }}</a></li>
+				{{ end }}
+			</ul>
+        </nav>
+    </div>
+{{ end }}
+`
+
+// Executes our main HTML template (along with its partials) using the passed in
+// HTML data, writing the results to our response writer. The navigation bar pages are filled
+// in from our page registry.
+func renderMainTemplate(w http.ResponseWriter, r *http.Request, name string, htmlData HtmlData) {
+
+	htmlData.Experiments = experimentBuckets(r.Context())
+	htmlData.ConsentBanner = showConsentBanner(r)
+	htmlData.ConsentReturn = r.URL.RequestURI()
+	htmlData.Flashes = takeFlashes(w, r)
+	htmlData = withSocialCard(r, htmlData)
+	htmlData = withPageMetadata(r, htmlData)
+
+	endSpan := startSpan(r.Context(), "template: "+name)
+	page, err := executeMainTemplate(name, htmlData)
+	endSpan()
+
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("rendering the %s template", name))
+		return
+	}
+
+	setContentType(w, CONTENT_TYPE_HTML)
+	if htmlData.Status != 0 {
+		w.WriteHeader(htmlData.Status)
+	}
+	w.Write(page)
+
+}
+
+// Executes our main HTML template using the passed in HTML data and returns the results. We
+// render into memory first so that a failing template never leaves a half written page.
+func executeMainTemplate(name string, htmlData HtmlData) ([]byte, error) {
+
+	htmlData.NavPages = navPages()
+	htmlData.MainStylesheet = mainStylesheet
+
+	// Our main template is parsed once at startup (see templates.go)
+	if mainTemplate == nil {
+		return nil, fmt.Errorf("the main template failed to load")
+	}
+
+	// Execute the template / tpl passing in our HTML data elements
+	var tpl bytes.Buffer
+
+	if err := mainTemplate.Execute(&tpl, htmlData); err != nil {
+		return nil, err
+	}
+
+	// Our templates are indented for readability, which we needn't send (see minify.go)
+	return minifiedHTML(tpl.Bytes()), nil
+
+}
+
 // Our main index handler. This page displays basic intro text with a description of basic
 // functionality and the libraries we use to construct our demo applications.
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.URL.Path != "/" {
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		writeError(w, r, notFoundError())
+		return
+	}
+
+	// Our pages are listed by section (see pagemeta.go), which the breadcrumbs of each page link
+	// back to
+	body, err := renderFragment(indexBodyTemplate, pageSections())
+
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the index body template"))
 		return
 	}
 
@@ -367,60 +1148,42 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 		Description: "This is a simple golang webserver example with built in logging, tracing, a health check, and graceful shutdown.",
 		Keywords:    "golang web server",
 		Author:      "",
-		CssFiles: []string{
+		CssFiles: assets(
 			"https://fonts.googleapis.com/css?family=Open+Sans",
-		},
-		CssScript: template.HTML(MAIN_CSS_TEMPLATE),
-		BodyContent: template.HTML(
-			`<div class = "main-content">
-			 	<h2>Simple Golang Web Server</h2>
-				<p>This is a simple golang web server example with built in logging, tracing, a health check, and graceful shutdown.</p>
-				<br>
-				<h4>It also includes a few demo web applications, including:</h4>
-				<p>An Excel / Spreadsheet application using <a href="https://bossanova.uk/jexcel/v2/">JExcel</a></p>
-				<p>A QR Code Generator using <a href="https://developers.google.com/chart">Google Charts API</a></p>
-				<p>An SVG drawing example (taken from <a href="https://github.com/adonovan/gopl.io/blob/master/ch3/surface/main.go">The Go Programming Language</a>)</p>
-				<p>A 3D sphere example using <a href="https://threejs.org/">THREE.JS</a><p>
-			</div>
-		`),
-	}
-
-	// Create a new template using our main HTML string
-	indexTemplate, err := template.New("index").Parse(MAIN_HTML_TEMPLATE)
-
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		),
+		BodyContent: body,
 	}
 
-	// Execute the template / tpl passing in our HTML data elements and writing the results
-	// to our response writer
-	if err := indexTemplate.Execute(w, htmlData); err != nil {
-		fmt.Println(err)
-	}
+	// Render our main HTML template using the data elements above
+	renderMainTemplate(w, r, "index", htmlData)
 }
 
 // This is our handler for demoing simple excel editing functionality using JExcel. The source
 // for this functionality can be found here: https://github.com/paulhodel/jexcel
 func excelHandler(w http.ResponseWriter, r *http.Request) {
 
+	// Our save form carries a CSRF token, which must be created before we write anything
+	token := csrfToken(w, r)
+
 	// Data we pass into our template to construct our application / HTML page
 	htmlData := HtmlData{
 		Title:       "Golang Excel Web Editor",
 		Description: "Simple golang webserver example with JExcel.",
 		Keywords:    "golang web server jexcel spreadsheet",
 		Author:      "",
-		CssFiles: []string{
+		// The spreadsheet is built by the script within the page body as soon as it's parsed, so
+		// it needs JExcel (and its styles) up front
+		CssFiles: append(criticalAssets(
 			"https://cdnjs.cloudflare.com/ajax/libs/jexcel/3.5.0/jexcel.min.css",
 			"https://bossanova.uk/jsuites/v2/jsuites.css",
+		), assets(
 			"https://fonts.googleapis.com/css?family=Open+Sans",
-		},
-		JsFiles: []string{
+		)...),
+		JsFiles: criticalAssets(
 			"https://cdnjs.cloudflare.com/ajax/libs/jquery/3.4.1/jquery.min.js",
 			"https://cdnjs.cloudflare.com/ajax/libs/jexcel/3.5.0/jexcel.min.js",
 			"https://bossanova.uk/jsuites/v2/jsuites.js",
-		},
-		CssScript: template.HTML(MAIN_CSS_TEMPLATE),
+		),
 		BodyContent: template.HTML(`
 		<div id="table-container">
 			<div id="container">
@@ -437,105 +1200,231 @@ func excelHandler(w http.ResponseWriter, r *http.Request) {
 						$('#spreadsheet').jexcel(options); 	
 
 					</script>
+					<form action="` + template.HTMLEscapeString(urlFor("/export/pdf")) + `" method="POST"
+						onsubmit="this.data.value = JSON.stringify(document.getElementById('spreadsheet').jexcel.getData())">
+						<input type="hidden" name="page" value="spreadsheet">
+						<input type="hidden" name="data">
+						<input type="submit" value="Download as PDF">
+					</form>
+					<form action="` + template.HTMLEscapeString(urlFor("/export/spreadsheet")) + `" method="POST"
+						onsubmit="this.data.value = JSON.stringify(document.getElementById('spreadsheet').jexcel.getData())">
+						<input type="hidden" name="data">
+						<button type="submit" name="format" value="csv">Download as CSV</button>
+						<button type="submit" name="format" value="xlsx">Download as XLSX</button>
+					</form>
+					<form id="save-sheet" method="POST" onsubmit="saveSheet(this)">
+						<input type="hidden" name="csrf_token" value="` + template.HTMLEscapeString(token) + `">
+						<input type="hidden" name="data">
+						<input name="sheet" placeholder="Sheet name" pattern="[A-Za-z0-9_\-]{1,64}" required>
+						<input name="author" placeholder="Your name (optional)" maxLength=64>
+						<input type="submit" value="Save">
+					</form>
+					<script>
+
+						// Sheets are saved on the server, with every save kept as a revision (see
+						// sheets.go). The form is posted to the sheet's history page, which we're
+						// sent on to with a flash saying how it went.
+						var sheetsURL = '` + template.JSEscapeString(urlFor("/api/v1/sheets/")) + `';
+						var historyURL = '` + template.JSEscapeString(urlFor("/sheets/")) + `';
+
+						function saveSheet(form) {
+							form.action = historyURL + encodeURIComponent(form.sheet.value);
+							form.data.value = JSON.stringify(document.getElementById('spreadsheet').jexcel.getData());
+						}
+
+						// Open a saved sheet given as ?sheet=name (and optionally &revision=N)
+						var query = new URLSearchParams(location.search);
+						if (query.get('sheet')) {
+							var revision = query.get('revision') ? '?revision=' + encodeURIComponent(query.get('revision')) : '';
+							fetch(sheetsURL + encodeURIComponent(query.get('sheet')) + revision, {
+								headers: {'Accept': 'application/json'},
+							}).then(function (response) {
+								return response.json();
+							}).then(function (result) {
+								if (result.cells) {
+									document.getElementById('spreadsheet').jexcel.setData(result.cells);
+									document.getElementById('save-sheet').sheet.value = query.get('sheet');
+								}
+							});
+						}
+
+					</script>
 				</div>
 			</div>
 		</div>
 		`),
 	}
 
-	// Create a new template using our main HTML string
-	excelTemplate, err := template.New("excel").Parse(MAIN_HTML_TEMPLATE)
-
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Execute the template / tpl passing in our HTML data elements and writing the results
-	// to our response writer
-	if err := excelTemplate.Execute(w, htmlData); err != nil {
-		fmt.Println(err)
-	}
+	// Render our main HTML template using the data elements above
+	renderMainTemplate(w, r, "excel", htmlData)
 
 }
 
-// This is the handler used for constructing our QR Code generator. The generator prompts
-// the user to enter a QR code and uses the Google Chart API to fetch the QR code
-func qrCodeHandler(w http.ResponseWriter, r *http.Request) {
-
-	// This is a template string we use to construct our body content. We check to see if we have a
-	// defined QR code, and if so, we use the Google API for fetching the QR code image. If no
-	// QR code is input, we don't display anything. You can find the raw template file in the
-	// templates sub-directory titled qr.code.body.tmpl.
-	var bodyHtmlTemplate = `
+// This is a template string we use to construct our QR code body content. We check to see if we
+// have a defined QR code, and if so, we fetch its image from our own code API (see qrcode.go and
+// barcode.go). If no QR code is input, we don't display anything. You can find the raw template
+// file in the templates sub-directory titled qr.code.body.tmpl.
+const QR_CODE_BODY_TEMPLATE = `
 	 <div class = "main-content">
 		<h2>QR Code Generator</h2>	
-		<form action="/qr-code-generator" name="qr_code_form" method="GET">
-			<input maxLength=512 size=80 name="qr_code_text" value="" title="Text to QR Encode">
+		<form action="{{ url "/qr-code-generator" }}" name="qr_code_form" method="GET">
+			<input maxLength=512 size=80 name="qr_code_text" value="{{ .Text }}" title="Text to QR Encode">
+			<select name="code_type" title="Type of code">
+				{{ range .Types }}<option value="{{ .Name }}"{{ if eq .Name $.Type }} selected{{ end }}>{{ .Title }}</option>{{ end }}
+			</select>
+			<br>
+			<label><input type="checkbox" name="public"> Share publicly (in our <a href="{{ url "/feeds/qr-codes.atom" }}">QR code feed</a>)</label>
 			<br>
 			<input type=submit value="Show QR" name="qr_code_submission">
 			<br>
+			Presets:
+			{{ range .Presets }}<a href="{{ url "/qr/" }}{{ . }}">{{ . }}</a> {{ end }}
+			<br>
+			{{ range .Form.Problems }}
+			<p style="color: #b00020;">{{ . }}</p>
+			{{ end }}
 			{{if .QRCode}}
-			<img src="http://chart.apis.google.com/chart?chs=300x300&cht=qr&choe=UTF-8&chl={{.QRCode}}" />
+			<img src="{{ url "/api/v1/codes/" }}{{ .Type }}?text={{ .QRCode }}" alt="{{ .QRCode }}" />
 			<br>
 			{{.QRCode}}
 			<br>
+			{{if eq .Type "qr"}}
+			<a href="{{ url "/export/pdf" }}?page=qr&amp;qr_code_text={{.QRCode}}">Download as PDF</a>
+			{{else}}
+			<a href="{{ url "/api/v1/codes/" }}{{ .Type }}?format=png&amp;text={{ .QRCode }}" download>Download as PNG</a>
+			{{end}}
+			<br>
 			<br>
 			{{end}}				
 		</form>
 	</div>
-	`
+`
 
-	// Check to see if we have a QR code specified in our request
-	qrCode := r.URL.Query().Get("qr_code_text")
+// The data element we use to pass in the QR code to our body template
+type qrCodeBodyData struct {
+	QRCode  string
+	Text    string   // The text our form starts out with
+	Presets []string // The names of our presets, in the order we list them
+	Type    string   // The type of code to generate (see codeTypes)
+	Types   []codeType
+	Form    *Form // Why the text can't be encoded as the chosen type of code, if it can't
+}
 
-	// Construct the data element which we will use to pass in the QR code to our template
-	data := struct {
-		QRCode string
-	}{
-		QRCode: qrCode,
+// The fields of our QR code form. Shared codes are limited to MAX_SHARED_QR_TEXT characters, as
+// is the text our form takes.
+type qrCodeForm struct {
+	Text   string `form:"qr_code_text" label:"The text" validate:"max=512"`
+	Type   string `form:"code_type" label:"The type of code"`
+	Preset string `form:"preset"`
+	Public bool   `form:"public"`
+}
+
+// Check the type of code, and that the text can be encoded as it
+func (fields *qrCodeForm) checkForm(form *Form) {
+
+	if !isCodeType(fields.Type) {
+		form.AddProblem("code_type", "Unknown code_type %q.", fields.Type)
+		return
 	}
 
-	// Create a new template / tpl for our body template
-	bodyTemplate, err := template.New("qr.code.generator.body").Parse(bodyHtmlTemplate)
+	// Barcodes only hold certain text (i.e. EAN codes only hold digits), which we check here
+	// so that we can explain what's wrong rather than displaying a broken image
+	if fields.Text != "" && fields.Type != "qr" {
+		if _, err := generateCode(fields.Type, fields.Text); err != nil {
+			form.AddProblem("qr_code_text", "%s.", capitalise(err.Error()))
+		}
+	}
 
-	// Since we don't want to pass in our HTML to our response writer quite yet, we store
-	// the template file results in memory via a bytes buffer
-	var tpl bytes.Buffer
+}
+
+// Our QR code presets, which start the form out with the skeleton of a common kind of QR code
+// (i.e. /qr-code-generator?preset=wifi, or /qr/wifi via our rewrites)
+var qrCodePresets = map[string]string{
+	"wifi":  "WIFI:T:WPA;S:network name;P:password;;",
+	"url":   "https://",
+	"email": "mailto:someone@example.com?subject=Hello",
+	"phone": "tel:+1",
+	"sms":   "SMSTO:+1:message",
+}
 
-	if err := bodyTemplate.Execute(&tpl, data); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+var qrCodePresetNames = []string{"wifi", "url", "email", "phone", "sms"}
+
+// This is the handler used for constructing our QR Code generator. The generator prompts
+// the user to enter a QR code and uses our code API to draw it
+func qrCodeHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Our form is submitted via GET, so that codes can be linked to (see forms.go)
+	fields := qrCodeForm{Type: "qr"}
+	form := newForm(w, r)
+
+	if err := form.Decode(w, r, &fields); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	// Convert our encoded template data to a string which we will use to pass on to our
-	// main template
-	bodyHTML := tpl.String()
+	// Construct the data element which we will use to pass in the QR code to our template
+	data := qrCodeBodyData{
+		Text:    fields.Text,
+		Presets: qrCodePresetNames,
+		Type:    fields.Type,
+		Types:   codeTypes,
+		Form:    form,
+	}
 
-	// Let's create the data we'll use to pass to our main HTML template
-	htmlData := HtmlData{
-		Title:       "Golang QR Code Generator",
-		Description: "Simple Golang QR code generator using Google API.",
-		Keywords:    "golang web server qr code generator google api",
-		Author:      "",
-		CssScript:   template.HTML(MAIN_CSS_TEMPLATE),
-		BodyContent: template.HTML(bodyHTML),
+	status := http.StatusOK
+	if form.Valid() {
+		data.QRCode = fields.Text
+	} else {
+		status = http.StatusUnprocessableEntity
 	}
 
-	// Create a new template using our main HTML string
-	qrCodeTemplate, err := template.New("qr.code.generator").Parse(MAIN_HTML_TEMPLATE)
+	// Visitors can share their QR codes in our feed (see feed.go)
+	if data.QRCode != "" && data.Type == "qr" && fields.Public {
+		shareQRCode(data.QRCode)
+	}
+
+	// Without a QR code, a preset starts our form out with its text
+	if preset := fields.Preset; preset != "" && fields.Text == "" {
+		text, found := qrCodePresets[preset]
+		if !found {
+			writeError(w, r, notFoundError())
+			return
+		}
+		tagRequest(r.Context(), "qr_preset", preset)
+		data.Text = text
+	}
+
+	// Since we don't want to pass in our HTML to our response writer quite yet, we render
+	// our body template into memory first. It's parsed once at startup (see templates.go).
+	bodyHTML, err := renderFragment(qrCodeBodyTemplate, data)
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, internalError(err).WithDetail("executing the QR code body template"))
 		return
 	}
 
-	// Execute the template / tpl passing in our HTML data elements and writing the results
-	// to our response writer
-	if err := qrCodeTemplate.Execute(w, htmlData); err != nil {
-		fmt.Println(err)
+	// Let's create the data we'll use to pass to our main HTML template
+	htmlData := HtmlData{
+		Title:       "Golang QR Code Generator",
+		Description: "Simple Golang QR code and barcode generator.",
+		Keywords:    "golang web server qr code generator barcode",
+		Author:      "",
+		BodyContent: bodyHTML,
+		Status:      status,
+	}
+
+	// Shared links to a generated code preview the code itself (see socialcards.go)
+	if data.QRCode != "" {
+		htmlData.SocialCard = SocialCard{
+			Description: "A " + data.Type + " code generated by our Golang server.",
+			Image:       qrCodeImagePath(data.Type, data.QRCode),
+			ImageAlt:    "The generated " + data.Type + " code",
+		}
 	}
 
+	// Render our main HTML template using the data elements above
+	renderMainTemplate(w, r, "qr.code.generator", htmlData)
+
 }
 
 // Variables for handling our SVG drawing:
@@ -555,30 +1444,50 @@ var sin30, cos30 = math.Sin(angle), math.Cos(angle) // sin(30°), cos(30°)
 // function. In our case below, we show an SVG rendering of sin(r)/r, where r is sqrt(x*x+y*y)
 // The original example was taken from the book 'The Go Programming Langauge' and you can find it
 // here: https://github.com/adonovan/gopl.io/blob/master/ch3/surface/main.go
+//
+// The surface can be coloured by a palette of hex colours (see colors.go), which shades each
+// cell by its height: /svg?palette=3366cc,cc9933
 func svgHandler(w http.ResponseWriter, r *http.Request) {
 
+	palette, err := parsePalette(r.URL.Query().Get("palette"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Requests for the same drawing at the same time share it (see coalesce.go), so our key is
+	// everything that goes into the drawing: its colours
+	key := ""
+	for _, c := range palette {
+		key += c.Hex()
+	}
+
+	drawing, err := surfaceFlights.do(r.Context(), key, func() ([]byte, error) {
+		if palette == nil {
+			return defaultSurface(), nil
+		}
+		return drawSurface(palette), nil
+	})
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("drawing the SVG surface"))
+		return
+	}
+
 	// Since we don't want to pass in our HTML to our response writer quite yet, we store
 	// the generated SVG results in memory via a bytes buffer
 	var tpl bytes.Buffer
 
-	// Below, we use our data / functions to construct the SVG drawing via standard XML notation
-	fmt.Fprintf(&tpl, "<div class = \"main-content\">"+
-		"<svg xmlns='http://www.w3.org/2000/svg' "+
-		"style='stroke: grey; fill: white; stroke-width: 0.7' "+
-		"width='%d' height='%d'>", canvasWidth, canvasHeight)
+	tpl.WriteString("<div class = \"main-content\">")
+	tpl.Write(drawing)
 
-	for i := 0; i < numGridCells; i++ {
-		for j := 0; j < numGridCells; j++ {
-			ax, ay := corner(i+1, j)
-			bx, by := corner(i, j)
-			cx, cy := corner(i, j+1)
-			dx, dy := corner(i+1, j+1)
-			fmt.Fprintf(&tpl, "<polygon points='%g,%g %g,%g %g,%g %g,%g'/>\n",
-				ax, ay, bx, by, cx, cy, dx, dy)
-		}
+	// Our PDF export draws the surface in the same colours
+	exportURL := urlFor("/export/pdf") + "?page=svg"
+	if palette != nil {
+		exportURL += "&palette=" + url.QueryEscape(r.URL.Query().Get("palette"))
 	}
 
-	fmt.Fprintln(&tpl, "</svg></div>")
+	fmt.Fprintf(&tpl, "<p><a href=\"%s\">Download as PDF</a></p></div>\n",
+		template.HTMLEscapeString(exportURL))
 
 	// Convert our encoded template data to a string
 	bodyHTML := tpl.String()
@@ -589,30 +1498,53 @@ func svgHandler(w http.ResponseWriter, r *http.Request) {
 		Description: "Simple golang svg generation.",
 		Keywords:    "golang web server svg generation",
 		Author:      "",
-		CssFiles: []string{
+		CssFiles: assets(
 			"https://fonts.googleapis.com/css?family=Open+Sans",
-		},
-		CssScript:   template.HTML(MAIN_CSS_TEMPLATE),
-		BodyContent: template.HTML(bodyHTML),
+		),
+		BodyContent: template.HTML(bodyHTML), // template-audit: our generated SVG and an escaped link
 	}
 
-	// Create a new template we'll use to display our SVG results using our main HTML string
-	svgTemplate, err := template.New("svg").Parse(MAIN_HTML_TEMPLATE)
+	// Render our main HTML template using the data elements above
+	renderMainTemplate(w, r, "svg", htmlData)
 
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+}
+
+// Methods used to construct our SVG surface drawing:
+
+// Our surface without a palette never changes, so it's drawn once (when we warm up, see
+// warmup.go) and kept
+var defaultSurface = sync.OnceValue(func() []byte { return drawSurface(nil) })
+
+// Draw our surface as an SVG element, filling its cells by their height from the given palette
+// (or leaving them white without one)
+func drawSurface(palette []colour) []byte {
+
+	var output bytes.Buffer
 
-	// Execute the template / tpl passing in our HTML data elements and writing the results
-	// to our response writer
-	if err := svgTemplate.Execute(w, htmlData); err != nil {
-		fmt.Println(err)
+	// Below, we use our data / functions to construct the SVG drawing via standard XML notation
+	fmt.Fprintf(&output, "<svg xmlns='http://www.w3.org/2000/svg' "+
+		"style='stroke: grey; fill: white; stroke-width: 0.7' "+
+		"width='%d' height='%d'>", canvasWidth, canvasHeight)
+
+	for i := 0; i < numGridCells; i++ {
+		for j := 0; j < numGridCells; j++ {
+			ax, ay := corner(i+1, j)
+			bx, by := corner(i, j)
+			cx, cy := corner(i, j+1)
+			dx, dy := corner(i+1, j+1)
+			fill := ""
+			if palette != nil {
+				fill = paletteColourAt(palette, cellElevation(i, j)).Hex()
+			}
+			writeSVGPolygon(&output, []float64{ax, ay, bx, by, cx, cy, dx, dy}, fill)
+		}
 	}
 
-}
+	output.WriteString("</svg>")
 
-// Methods used to construct our SVG surface drawing:
+	return output.Bytes()
+
+}
 
 func corner(i, j int) (float64, float64) {
 
@@ -623,7 +1555,14 @@ func corner(i, j int) (float64, float64) {
 	// Compute the surface height z
 	z := surfaceHeight(x, y)
 
-	// Project (x,y,z) isometrically onto a 2-D SVG canvas (sx,sy).
+	return isometric(x, y, z)
+
+}
+
+// Project (x,y,z) isometrically onto a 2-D SVG canvas (sx,sy). Our other 3-D drawings (like the
+// terrain of maze.go) share the surface's canvas and projection.
+func isometric(x, y, z float64) (float64, float64) {
+
 	sx := canvasWidth/2 + (x-y)*cos30*xyScale
 	sy := canvasHeight/2 + (x+y)*sin30*xyScale - z*zScale
 
@@ -631,6 +1570,38 @@ func corner(i, j int) (float64, float64) {
 
 }
 
+// Write an SVG polygon through the given points (flattened x, y pairs), filled with the given
+// colour (or the drawing's fill if it's empty)
+func writeSVGPolygon(output *bytes.Buffer, points []float64, fill string) {
+
+	output.WriteString("<polygon points='")
+	for i := 0; i+1 < len(points); i += 2 {
+		if i > 0 {
+			output.WriteByte(' ')
+		}
+		fmt.Fprintf(output, "%g,%g", points[i], points[i+1])
+	}
+	output.WriteByte('\'')
+
+	if fill != "" {
+		fmt.Fprintf(output, " fill='%s'", fill)
+	}
+
+	output.WriteString("/>\n")
+
+}
+
+// The lowest point of our surface (sin(r)/r is lowest where r is about 4.49)
+const SURFACE_LOWEST = -0.2172
+
+// Returns the height of the centre of cell (i, j) as a fraction from 0 (the lowest point of the
+// surface) to 1 (its highest), which picks the cell's colour from a palette
+func cellElevation(i, j int) float64 {
+	x := xyAxisRange * ((float64(i)+0.5)/numGridCells - 0.5)
+	y := xyAxisRange * ((float64(j)+0.5)/numGridCells - 0.5)
+	return (surfaceHeight(x, y) - SURFACE_LOWEST) / (1 - SURFACE_LOWEST)
+}
+
 func surfaceHeight(x, y float64) float64 {
 	// Get the total distance from (0,0)
 	r := math.Hypot(x, y)
@@ -773,14 +1744,14 @@ func sphereHandler(w http.ResponseWriter, r *http.Request) {
 		Description: "Simple golang THREE.js rotating sphere.",
 		Keywords:    "golang web server THREE.js rotating sphere",
 		Author:      "",
-		CssFiles: []string{
+		CssFiles: assets(
 			"https://fonts.googleapis.com/css?family=Open+Sans",
-		},
-		JsFiles: []string{
+		),
+		// Our sphere script uses THREE as soon as it's parsed
+		JsFiles: criticalAssets(
 			"https://cdnjs.cloudflare.com/ajax/libs/three.js/103/three.min.js",
-		},
-		CssScript: template.HTML(MAIN_CSS_TEMPLATE),
-		JsScript:  template.HTML(THREE_JS_SPHERE_SCRIPT),
+		),
+		JsScript: template.HTML(THREE_JS_SPHERE_SCRIPT),
 		BodyContent: template.HTML(`
 		<div id="table-container">
 			<div id="container">
@@ -792,40 +1763,25 @@ func sphereHandler(w http.ResponseWriter, r *http.Request) {
 		`),
 	}
 
-	// Create a new template using our main HTML string and our raw THREE.js script
-	sphereTemplate, err := template.New("sphere").Parse(MAIN_HTML_TEMPLATE)
-
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Execute the template / tpl passing in our HTML data elements and writing the results
-	// to our response writer
-	if err := sphereTemplate.Execute(w, htmlData); err != nil {
-		fmt.Println(err)
-	}
+	// Render our main HTML template using the data elements above
+	renderMainTemplate(w, r, "sphere", htmlData)
 
 }
 
-// This is our log handler. It simply outputs our log file contents to the response writer
+// This is our log handler. It simply outputs our log file contents to the response writer. The
+// file is served with range support (see files.go) so that large log downloads can be resumed,
+// and passing ?download=1 asks the browser to save the file rather than display it.
 func logHandler(w http.ResponseWriter, r *http.Request) {
 
-	// The below header settings prevent "mime" based attacks.
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.WriteHeader(http.StatusOK)
-
-	// Read in our logging data file
-	logData, err := ioutil.ReadFile(LOG_FILE_NAME)
-
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	downloadName := ""
+	if r.URL.Query().Get("download") != "" {
+		downloadName = LOG_FILE_NAME
 	}
 
-	// Write the log file data out to the response writer
-	fmt.Fprintln(w, string(logData))
+	// The below header setting prevents "mime" based attacks.
+	setContentType(w, CONTENT_TYPE_TEXT)
+
+	serveFile(w, r, LOG_FILE_NAME, downloadName)
 
 }
 
@@ -844,22 +1800,40 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 func loggingHandler(logger *log.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Wrap our response writer so that we know which status we responded with
+			recorder := newStatusRecorder(w)
+
 			// Middleware layer we use to do our logging. In this instance, we defer
 			// its execution to perform logging only after our main handler finishes
 			// executing.
 			defer func() {
+				// Skip requests excluded by our logging rules (see logrules.go), counting
+				// them so that they're still reflected in our metrics
+				if !logExclusions.shouldLog(r, recorder.status) {
+					incrementCounter("http_log_excluded_total", "status", statusClass(recorder.status))
+					return
+				}
+
 				requestID, ok := r.Context().Value(REQUEST_ID_KEY).(string)
 				// Check to see if we know which request we're handling
 				if !ok {
 					requestID = "UNKNOWN"
 				}
-				// Log the request info / details
-				logger.Println(requestID, r.Method, r.URL.Path, r.RemoteAddr, r.UserAgent())
+				// Log the request info / details, along with any fields our handlers attached
+				// (see tags.go)
+				if fields := requestFields(r.Context()); len(fields) > 0 {
+					logger.Println(requestID, r.Method, r.URL.Path, recorder.status, loggedAddress(r), loggedUserAgent(r), formatLogFields(fields))
+				} else {
+					logger.Println(requestID, r.Method, r.URL.Path, recorder.status, loggedAddress(r), loggedUserAgent(r))
+				}
 
 			}()
 
+			// Parse the client's user agent for our metrics and handlers (see useragents.go)
+			r = withUserAgent(r)
+
 			// Transfer control to the next handler
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(recorder, r)
 		})
 	}
 }
@@ -874,12 +1848,32 @@ func tracingHandler(nextRequestID func() string) func(http.Handler) http.Handler
 			if requestID == "" {
 				requestID = nextRequestID()
 			}
-			// Create a new context with our request id value and key mapped to it
+			// Start recording the timing breakdown of our request (see trace.go)
+			trace := &requestTrace{
+				RequestID: requestID,
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Started:   time.Now(),
+			}
+			// Create a new context with our request id value and trace mapped to it
 			ctx := context.WithValue(r.Context(), REQUEST_ID_KEY, requestID)
+			ctx = context.WithValue(ctx, TRACE_KEY, trace)
 			// Add / set the header request id
 			w.Header().Set("X-Request-Id", requestID)
+			// Add our timing breakdown to the response headers (see servertiming.go)
+			if serverTimingEnabled {
+				w = newServerTimingWriter(w, trace)
+			}
 			// Transfer control to the next handler with our newly created context
-			next.ServeHTTP(w, r.WithContext(ctx))
+			recorder := newStatusRecorder(w)
+			next.ServeHTTP(recorder, r.WithContext(ctx))
+			// Store the finished trace so that it can be viewed at /debug/trace/{request-id}
+			trace.mutex.Lock()
+			trace.Status = recorder.status
+			trace.Duration = time.Since(trace.Started)
+			trace.mutex.Unlock()
+			traces.add(trace)
+			recordReportRequest(trace)
 		})
 	}
 }
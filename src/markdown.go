@@ -0,0 +1,633 @@
+// A small markdown to HTML renderer for the .md files served in static site mode (see site.go).
+// It covers the commonly used parts of CommonMark: ATX and setext headings, paragraphs, hard
+// line breaks, block quotes, ordered and unordered (nested) lists, fenced and indented code
+// blocks, thematic breaks, emphasis, strikethrough, code spans, links, images and autolinks.
+// Fenced code blocks which name their language (i.e. ```go) are syntax highlighted.
+//
+// How much raw HTML the rendered markdown may contain depends on a markdownPolicy. By default
+// (MARKDOWN_POLICY_STRICT, which our markdown pages use) raw HTML is escaped rather than passed
+// through, and links using anything other than a relative URL or one of the schemes our HTML
+// policy allows (see sanitise.go) are neutralised, so rendering a markdown file can never inject
+// scripts into our pages. The
+// renderer is also available to other tools via POST /api/v1/markdown (see markdownHandler).
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	atxHeadingPattern    = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	thematicBreakPattern = regexp.MustCompile(`^ {0,3}((\*[ \t]*){3,}|(-[ \t]*){3,}|(_[ \t]*){3,})$`)
+	setextPattern        = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	fencePattern         = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})[ \t]*([^`]*)$")
+	listItemPattern      = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])([ \t]+|$)`)
+	blockQuotePattern    = regexp.MustCompile(`^ {0,3}> ?`)
+)
+
+const (
+	MARKDOWN_RATE_LIMIT = 60 // How many documents a client may render per minute (via our API)
+	MARKDOWN_RATE_BURST = 10 // How many documents a client may render in quick succession
+)
+
+var markdownRateLimiter = newRateLimiter("markdown", MARKDOWN_RATE_LIMIT, MARKDOWN_RATE_BURST)
+
+// How much raw HTML (and which links) rendered markdown may contain
+type markdownPolicy string
+
+const (
+	// Raw HTML is escaped and links are limited to http(s), mailto and relative URLs
+	MARKDOWN_POLICY_STRICT markdownPolicy = "strict"
+	// Like strict, but raw HTML goes through our sanitiser (see sanitise.go), which passes the
+	// tags and attributes our HTML policy allows through. Comments are dropped.
+	MARKDOWN_POLICY_RELAXED markdownPolicy = "relaxed"
+	// Raw HTML and links are passed through untouched, so only trusted markdown should use it
+	MARKDOWN_POLICY_NONE markdownPolicy = "none"
+)
+
+// A line which starts a block of raw HTML (which runs until the next blank line)
+var htmlBlockPattern = regexp.MustCompile(`^ {0,3}(?:<!--|</?(?i:address|article|aside|blockquote|details|dialog|div|dl|fieldset|figcaption|figure|footer|form|h[1-6]|header|hr|main|nav|ol|p|pre|section|summary|table|tbody|td|tfoot|th|thead|tr|ul)(?:[\s/>]|$))`)
+
+// Render the given markdown source as HTML, escaping any raw HTML within it
+func renderMarkdown(source string) template.HTML {
+	return MARKDOWN_POLICY_STRICT.render(source)
+}
+
+// Render the given markdown source as HTML, with raw HTML handled according to our policy
+func (policy markdownPolicy) render(source string) template.HTML {
+	source = strings.ReplaceAll(source, "\r\n", "\n")
+	source = strings.ReplaceAll(source, "\t", "    ")
+	// template-audit: the renderer escapes text and sanitises raw HTML unless the policy is none
+	return template.HTML(policy.renderBlocks(strings.Split(source, "\n")))
+}
+
+// Returns the text of the first heading in the given markdown source (used as our page title)
+func markdownTitle(source string) string {
+	for _, line := range strings.Split(source, "\n") {
+		if match := atxHeadingPattern.FindStringSubmatch(strings.TrimRight(line, "\r")); match != nil && match[2] != "" {
+			return markdownPlainText(match[2])
+		}
+	}
+	return ""
+}
+
+// Render a sequence of markdown lines as HTML blocks
+func (policy markdownPolicy) renderBlocks(lines []string) string {
+
+	var output strings.Builder
+	var paragraph []string
+
+	// Write out the paragraph we've been collecting (if any)
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			output.WriteString("<p>" + policy.renderInline(strings.Join(paragraph, "\n")) + "</p>\n")
+			paragraph = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+
+		line := lines[i]
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			flushParagraph()
+
+		// A line of = or - underlines the paragraph above it as a heading
+		case len(paragraph) > 0 && setextPattern.MatchString(line):
+			level := 2
+			if strings.TrimSpace(line)[0] == '=' {
+				level = 1
+			}
+			policy.writeHeading(&output, level, strings.Join(paragraph, "\n"))
+			paragraph = nil
+
+		case thematicBreakPattern.MatchString(line):
+			flushParagraph()
+			output.WriteString("<hr>\n")
+
+		case atxHeadingPattern.MatchString(line):
+			flushParagraph()
+			match := atxHeadingPattern.FindStringSubmatch(line)
+			policy.writeHeading(&output, len(match[1]), match[2])
+
+		case fencePattern.MatchString(line):
+			flushParagraph()
+			match := fencePattern.FindStringSubmatch(line)
+			indent, fence, info := len(match[1]), match[2], strings.Fields(match[3])
+
+			var code []string
+			for i++; i < len(lines); i++ {
+				trimmed := strings.TrimSpace(lines[i])
+				if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+					break
+				}
+				code = append(code, trimLeadingSpaces(lines[i], indent))
+			}
+
+			// Code blocks which name their language are highlighted (see highlight.go)
+			language := ""
+			output.WriteString("<pre><code")
+			if len(info) > 0 {
+				language = info[0]
+				output.WriteString(` class="language-` + html.EscapeString(language) + `"`)
+			}
+			output.WriteString(">" + string(highlightCode(strings.Join(code, "\n"), language)))
+			if len(code) > 0 {
+				output.WriteString("\n")
+			}
+			output.WriteString("</code></pre>\n")
+
+		// Lines indented by four spaces are code, unless they continue a paragraph
+		case len(paragraph) == 0 && strings.HasPrefix(line, "    "):
+			var code []string
+			for ; i < len(lines); i++ {
+				if strings.TrimSpace(lines[i]) != "" && !strings.HasPrefix(lines[i], "    ") {
+					break
+				}
+				code = append(code, trimLeadingSpaces(lines[i], 4))
+			}
+			i--
+
+			// Trailing blank lines aren't part of the code block
+			for len(code) > 0 && strings.TrimSpace(code[len(code)-1]) == "" {
+				code = code[:len(code)-1]
+			}
+			output.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "\n</code></pre>\n")
+
+		// Blocks of raw HTML are passed through (or sanitised) as they are, without any markdown
+		// within them being rendered
+		case policy != MARKDOWN_POLICY_STRICT && len(paragraph) == 0 && htmlBlockPattern.MatchString(line):
+			var block []string
+			for ; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+				block = append(block, lines[i])
+			}
+			output.WriteString(policy.renderHTML(strings.Join(block, "\n")) + "\n")
+
+		case blockQuotePattern.MatchString(line):
+			flushParagraph()
+			var quoted []string
+			for ; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+				quoted = append(quoted, blockQuotePattern.ReplaceAllString(lines[i], ""))
+			}
+			output.WriteString("<blockquote>\n" + policy.renderBlocks(quoted) + "</blockquote>\n")
+
+		case listItemPattern.MatchString(line) && (len(paragraph) == 0 || interruptsParagraph(line)):
+			flushParagraph()
+			i = policy.renderList(&output, lines, i) - 1
+
+		default:
+			paragraph = append(paragraph, strings.TrimLeft(line, " "))
+		}
+
+	}
+
+	flushParagraph()
+
+	return output.String()
+
+}
+
+// Returns whether the given list item can start a list in the middle of a paragraph. Only
+// lists numbered from 1 can, so that a line starting with a number (i.e. "2020. What a
+// year") doesn't become a list.
+func interruptsParagraph(line string) bool {
+	marker := listItemPattern.FindStringSubmatch(line)[2]
+	return !unicode.IsDigit(rune(marker[0])) || marker[:len(marker)-1] == "1"
+}
+
+// Render the list starting at the given line, returning the index of the first line after it
+func (policy markdownPolicy) renderList(output *strings.Builder, lines []string, start int) int {
+
+	first := listItemPattern.FindStringSubmatch(lines[start])
+	ordered := first[2][0] >= '0' && first[2][0] <= '9'
+	marker := first[2][len(first[2])-1:]
+
+	if ordered {
+		number := strings.TrimLeft(first[2][:len(first[2])-1], "0")
+		if number != "" && number != "1" {
+			output.WriteString(`<ol start="` + number + `">` + "\n")
+		} else {
+			output.WriteString("<ol>\n")
+		}
+	} else {
+		output.WriteString("<ul>\n")
+	}
+
+	var items [][]string
+	loose := false
+	i := start
+
+	for i < len(lines) {
+
+		match := listItemPattern.FindStringSubmatch(lines[i])
+		if match == nil || match[2][len(match[2])-1:] != marker {
+			break
+		}
+
+		// The content of our item is indented to line up with the text after its marker
+		indent := len(match[0])
+		if match[3] == "" || len(match[3]) > 4 {
+			indent = len(match[1]) + len(match[2]) + 1
+		}
+
+		item := []string{lines[i][min(indent, len(lines[i])):]}
+		i++
+
+		for i < len(lines) {
+			line := lines[i]
+			if strings.TrimSpace(line) == "" {
+				// A blank line only continues our item if indented content follows it
+				next := i + 1
+				for next < len(lines) && strings.TrimSpace(lines[next]) == "" {
+					next++
+				}
+				if next < len(lines) && leadingSpaces(lines[next]) >= indent {
+					item = append(item, "")
+					i++
+					loose = true
+					continue
+				}
+				break
+			}
+			if leadingSpaces(line) >= indent {
+				item = append(item, line[indent:])
+			} else if listItemPattern.MatchString(line) || thematicBreakPattern.MatchString(line) ||
+				atxHeadingPattern.MatchString(line) || fencePattern.MatchString(line) || blockQuotePattern.MatchString(line) {
+				break
+			} else {
+				// A "lazy" continuation of the paragraph within our item
+				item = append(item, strings.TrimLeft(line, " "))
+			}
+			i++
+		}
+
+		items = append(items, item)
+
+		// A blank line between two items makes our list loose (with paragraphs in its items)
+		if i+1 < len(lines) && strings.TrimSpace(lines[i]) == "" {
+			if next := listItemPattern.FindStringSubmatch(lines[i+1]); next != nil && next[2][len(next[2])-1:] == marker {
+				loose = true
+				i++
+			}
+		}
+	}
+
+	for _, item := range items {
+		content := policy.renderBlocks(item)
+		if !loose {
+			// Tight lists don't wrap their items' text in paragraphs
+			content = strings.ReplaceAll(strings.ReplaceAll(content, "<p>", ""), "</p>\n", "\n")
+		}
+		output.WriteString("<li>" + strings.TrimSuffix(content, "\n") + "</li>\n")
+	}
+
+	if ordered {
+		output.WriteString("</ol>\n")
+	} else {
+		output.WriteString("</ul>\n")
+	}
+
+	return i
+
+}
+
+// Write out a heading with an id (i.e. "Getting Started" becomes #getting-started) so that
+// sections can be linked to
+func (policy markdownPolicy) writeHeading(output *strings.Builder, level int, text string) {
+	tag := string(rune('0' + level))
+	output.WriteString("<h" + tag + ` id="` + markdownSlug(text) + `">` + policy.renderInline(text) + "</h" + tag + ">\n")
+}
+
+func markdownSlug(text string) string {
+	var slug strings.Builder
+	for _, character := range strings.ToLower(text) {
+		switch {
+		case unicode.IsLetter(character) || unicode.IsDigit(character):
+			slug.WriteRune(character)
+		case character == ' ' || character == '-' || character == '_':
+			slug.WriteRune('-')
+		}
+	}
+	return html.EscapeString(slug.String())
+}
+
+// Render the inline content of a block (emphasis, code spans, links and so on). Everything
+// else is HTML escaped.
+func (policy markdownPolicy) renderInline(text string) string {
+
+	var output strings.Builder
+
+	for i := 0; i < len(text); {
+
+		character := text[i]
+
+		switch {
+
+		// Backslash escapes (i.e. \*) and hard line breaks (a backslash at the end of a line)
+		case character == '\\' && i+1 < len(text):
+			if text[i+1] == '\n' {
+				output.WriteString("<br>\n")
+			} else if strings.ContainsRune("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", rune(text[i+1])) {
+				output.WriteString(html.EscapeString(text[i+1 : i+2]))
+			} else {
+				output.WriteString("\\" + html.EscapeString(text[i+1:i+2]))
+			}
+			i += 2
+			continue
+
+		// Two or more spaces at the end of a line are also a hard line break
+		case character == ' ' && strings.HasPrefix(strings.TrimLeft(text[i:], " "), "\n") && strings.HasPrefix(text[i:], "  "):
+			output.WriteString("<br>")
+			i += len(text[i:]) - len(strings.TrimLeft(text[i:], " "))
+			continue
+
+		case character == '`':
+			run := len(text[i:]) - len(strings.TrimLeft(text[i:], "`"))
+			delimiter := text[i : i+run]
+			if end := strings.Index(text[i+run:], delimiter); end >= 0 {
+				code := strings.ReplaceAll(text[i+run:i+run+end], "\n", " ")
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.TrimSpace(code) != "" {
+					code = code[1 : len(code)-1]
+				}
+				output.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += run + end + run
+				continue
+			}
+			output.WriteString(delimiter)
+			i += run
+			continue
+
+		case character == '!' && strings.HasPrefix(text[i:], "!["):
+			if label, destination, title, length, ok := parseMarkdownLink(text[i+1:]); ok {
+				output.WriteString(`<img src="` + html.EscapeString(policy.safeURL(destination)) + `" alt="` +
+					html.EscapeString(markdownPlainText(label)) + `"`)
+				if title != "" {
+					output.WriteString(` title="` + html.EscapeString(title) + `"`)
+				}
+				output.WriteString(">")
+				i += 1 + length
+				continue
+			}
+
+		case character == '[':
+			if label, destination, title, length, ok := parseMarkdownLink(text[i:]); ok {
+				output.WriteString(`<a href="` + html.EscapeString(policy.safeURL(destination)) + `"`)
+				if title != "" {
+					output.WriteString(` title="` + html.EscapeString(title) + `"`)
+				}
+				output.WriteString(">" + policy.renderInline(label) + "</a>")
+				i += length
+				continue
+			}
+
+		// Autolinks (i.e. <https://example.com>) and raw HTML tags
+		case character == '<':
+			if end := strings.IndexByte(text[i:], '>'); end > 0 {
+				target := text[i+1 : i+end]
+				if !strings.ContainsAny(target, " \n<") && (strings.HasPrefix(target, "http://") ||
+					strings.HasPrefix(target, "https://") || strings.HasPrefix(target, "mailto:")) {
+					output.WriteString(`<a href="` + html.EscapeString(target) + `">` +
+						html.EscapeString(strings.TrimPrefix(target, "mailto:")) + "</a>")
+					i += end + 1
+					continue
+				}
+			}
+			if tag := htmlTagPattern.FindString(text[i:]); tag != "" && policy != MARKDOWN_POLICY_STRICT {
+				output.WriteString(policy.renderHTML(tag))
+				i += len(tag)
+				continue
+			}
+
+		case character == '*' || character == '_' || character == '~':
+			if rendered, length, ok := policy.renderEmphasis(text, i); ok {
+				output.WriteString(rendered)
+				i += length
+				continue
+			}
+		}
+
+		output.WriteString(html.EscapeString(text[i : i+1]))
+		i++
+
+	}
+
+	return output.String()
+
+}
+
+// Render the emphasis (*em*, **strong**, ~~strikethrough~~) starting at the given offset,
+// returning the HTML and the length of markdown consumed
+func (policy markdownPolicy) renderEmphasis(text string, start int) (string, int, bool) {
+
+	delimiter := text[start : start+1]
+	run := len(text[start:]) - len(strings.TrimLeft(text[start:], delimiter))
+
+	var tag string
+	switch {
+	case delimiter == "~" && run == 2:
+		tag = "del"
+	case delimiter != "~" && run == 2:
+		tag = "strong"
+	case delimiter != "~" && run == 1:
+		tag = "em"
+	default:
+		return "", 0, false
+	}
+
+	marker := strings.Repeat(delimiter, run)
+	contentStart := start + run
+
+	// An opening delimiter must be followed by text, and underscores can't open emphasis
+	// within a word (i.e. snake_case_names)
+	if contentStart >= len(text) || unicode.IsSpace(rune(text[contentStart])) {
+		return "", 0, false
+	}
+	if delimiter == "_" && start > 0 && isMarkdownWordCharacter(text[start-1]) {
+		return "", 0, false
+	}
+
+	for offset := contentStart + 1; offset <= len(text)-run; offset++ {
+		if text[offset:offset+run] != marker || unicode.IsSpace(rune(text[offset-1])) {
+			continue
+		}
+		// Skip over longer runs of the delimiter (i.e. the ** within *some **strong** text*)
+		if offset+run < len(text) && text[offset+run] == delimiter[0] {
+			offset += run
+			continue
+		}
+		if text[offset-1] == delimiter[0] {
+			continue
+		}
+		if delimiter == "_" && offset+run < len(text) && isMarkdownWordCharacter(text[offset+run]) {
+			continue
+		}
+		return "<" + tag + ">" + policy.renderInline(text[contentStart:offset]) + "</" + tag + ">", offset + run - start, true
+	}
+
+	return "", 0, false
+
+}
+
+func isMarkdownWordCharacter(character byte) bool {
+	return character == '_' || character >= '0' && character <= '9' ||
+		character >= 'a' && character <= 'z' || character >= 'A' && character <= 'Z' || character >= 0x80
+}
+
+// Parse an inline link (i.e. [label](destination "title")) at the start of the given text,
+// returning its parts along with the length of markdown it takes up
+func parseMarkdownLink(text string) (label, destination, title string, length int, ok bool) {
+
+	// Find the closing bracket of our label, allowing for nested brackets (i.e. images
+	// within links)
+	depth := 0
+	labelEnd := -1
+
+	for i := 0; i < len(text) && labelEnd < 0; i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				labelEnd = i
+			}
+		}
+	}
+
+	if labelEnd < 0 || labelEnd+1 >= len(text) || text[labelEnd+1] != '(' {
+		return "", "", "", 0, false
+	}
+
+	// Destinations may contain balanced parentheses (i.e. Wikipedia links)
+	closing := -1
+	depth = 0
+	for i := labelEnd + 2; i < len(text) && closing < 0; i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				closing = i - (labelEnd + 2)
+			}
+			depth--
+		}
+	}
+
+	if closing < 0 {
+		return "", "", "", 0, false
+	}
+
+	target := strings.TrimSpace(text[labelEnd+2 : labelEnd+2+closing])
+	destination, title, _ = strings.Cut(target, " ")
+	title = strings.TrimSpace(title)
+
+	if len(title) >= 2 && (title[0] == '"' || title[0] == '\'') && title[len(title)-1] == title[0] {
+		title = title[1 : len(title)-1]
+	} else if title != "" {
+		return "", "", "", 0, false
+	}
+
+	destination = strings.TrimSuffix(strings.TrimPrefix(destination, "<"), ">")
+
+	return text[1:labelEnd], destination, title, labelEnd + 2 + closing + 1, true
+
+}
+
+// Returns the given link destination if it's safe to include in our page (see
+// htmlPolicy.safeURL). Anything else (i.e. javascript: URLs) is replaced, unless our policy is
+// none.
+func (policy markdownPolicy) safeURL(destination string) string {
+	if policy == MARKDOWN_POLICY_NONE {
+		return destination
+	}
+	return currentHTMLPolicy().safeURL(destination)
+}
+
+// Render the given raw HTML according to our policy: untouched for none, and sanitised (see
+// sanitise.go) otherwise
+func (policy markdownPolicy) renderHTML(source string) string {
+	if policy == MARKDOWN_POLICY_NONE {
+		return source
+	}
+	return string(sanitiseHTML(source))
+}
+
+// Returns the text of the given inline markdown without any formatting (used for image alt
+// text)
+func markdownPlainText(text string) string {
+	return strings.NewReplacer("*", "", "_", "", "`", "", "[", "", "]", "", "~", "").Replace(text)
+}
+
+// Returns the number of spaces the given line starts with
+func leadingSpaces(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// Remove up to the given number of leading spaces from the given line
+func trimLeadingSpaces(line string, count int) string {
+	return line[min(count, leadingSpaces(line)):]
+}
+
+// This is our markdown API handler, which renders a JSON object's markdown with the given
+// policy (strict by default). Only admins are trusted with the none policy. Requests are
+// limited to the size of the markdown files we render (MAX_MARKDOWN_SIZE, see site.go).
+func markdownHandler(w http.ResponseWriter, r *http.Request) {
+
+	if wait := markdownRateLimiter.reserve(clientAddress(r)); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, r, newAppError(http.StatusTooManyRequests, "rate_limited",
+			"You're rendering markdown too quickly. Please wait a moment and try again."))
+		return
+	}
+
+	var request struct {
+		Markdown *string        `json:"markdown"`
+		Policy   markdownPolicy `json:"policy"`
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_MARKDOWN_SIZE))
+
+	if err := decoder.Decode(&request); err != nil || request.Markdown == nil {
+		writeError(w, r, badRequestError("The request must be a JSON object with the markdown to render.").Wrap(err))
+		return
+	}
+
+	switch request.Policy {
+	case "":
+		request.Policy = MARKDOWN_POLICY_STRICT
+	case MARKDOWN_POLICY_STRICT, MARKDOWN_POLICY_RELAXED:
+	case MARKDOWN_POLICY_NONE:
+		if !isAdminRequest(r) {
+			writeError(w, r, newAppError(http.StatusForbidden, "forbidden", "Only trusted callers (with the admin token) can render markdown without sanitisation."))
+			return
+		}
+	default:
+		writeError(w, r, badRequestError(fmt.Sprintf("Unknown policy %q, expected strict, relaxed or none.", request.Policy)))
+		return
+	}
+
+	endSpan := startSpan(r.Context(), "markdown: "+string(request.Policy))
+	rendered := request.Policy.render(*request.Markdown)
+	endSpan()
+
+	incrementCounter("markdown_rendered_total", "policy", string(request.Policy))
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	json.NewEncoder(w).Encode(map[string]string{"html": string(rendered), "title": markdownTitle(*request.Markdown), "policy": string(request.Policy)})
+
+}
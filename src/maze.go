@@ -0,0 +1,696 @@
+// Mazes and terrain. /maze generates a maze (by one of a few algorithms) or a heightmap of
+// terrain on the server and draws it as SVG, or returns it as JSON with format=json:
+//
+//	/maze?algorithm=kruskal&width=30&height=20&solve=true
+//	/maze?algorithm=diamond-square&size=64&seed=42&format=json
+//
+// The algorithms all draw their randomness from a generator seeded by the seed parameter, so
+// the same seed always gives the same maze or terrain. Requests without a seed get a random
+// one, which the page shows and the JSON includes.
+//
+// Terrain is drawn with the same isometric projection and canvas as our surface drawing (see
+// svgHandler) and coloured by height from a palette (see colors.go), which can be changed with
+// the palette parameter.
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	MAZE_SIZE         = 20 // The width and height of our mazes by default, in cells
+	MIN_MAZE_SIZE     = 2
+	MAX_MAZE_SIZE     = 100
+	TERRAIN_SIZE      = 64 // The width and depth of our terrain by default, in cells
+	MIN_TERRAIN_SIZE  = 8
+	MAX_TERRAIN_SIZE  = 128
+	TERRAIN_ROUGHNESS = 0.55 // How much each finer level of detail varies, compared to the last
+	TERRAIN_RELIEF    = 0.6  // How tall terrain is drawn, in the surface drawing's z units
+	WATER_LEVEL       = 0.35 // Terrain below this is drawn flat, as water
+	MAZE_MARGIN       = 10
+)
+
+// The colours of our terrain, from the deepest water to the highest peaks
+const TERRAIN_PALETTE = "1b3f78,2f6fba,4f95d9,e6d8a2,7cb356,4f8a3a,2f5e2a,7a6a55,9b8f80,ffffff"
+
+// The passages out of a maze cell, as bits
+const (
+	MAZE_NORTH = 1
+	MAZE_EAST  = 2
+	MAZE_SOUTH = 4
+	MAZE_WEST  = 8
+)
+
+var mazeDirections = []struct{ passage, dx, dy, opposite int }{
+	{MAZE_NORTH, 0, -1, MAZE_SOUTH},
+	{MAZE_EAST, 1, 0, MAZE_WEST},
+	{MAZE_SOUTH, 0, 1, MAZE_NORTH},
+	{MAZE_WEST, -1, 0, MAZE_EAST},
+}
+
+// A maze of cells, each of which holds the bits of the passages out of it. The entrance is
+// the top left cell's north wall and the exit is the bottom right cell's south wall.
+type maze struct {
+	width  int
+	height int
+	cells  [][]int // By row
+}
+
+// A square heightmap, with the heights of the corners of its cells from 0 to 1
+type terrain struct {
+	size    int
+	heights [][]float64 // size + 1 rows of size + 1 heights
+}
+
+type mazeAlgorithm struct {
+	Name     string
+	Title    string
+	generate func(random *rand.Rand, width int, height int) *maze
+}
+
+type terrainAlgorithm struct {
+	Name     string
+	Title    string
+	generate func(random *rand.Rand, size int) *terrain
+}
+
+var mazeAlgorithms = []mazeAlgorithm{
+	{Name: "backtracker", Title: "Recursive backtracker", generate: backtrackerMaze},
+	{Name: "prim", Title: "Prim's algorithm", generate: primMaze},
+	{Name: "kruskal", Title: "Kruskal's algorithm", generate: kruskalMaze},
+	{Name: "binary-tree", Title: "Binary tree", generate: binaryTreeMaze},
+}
+
+var terrainAlgorithms = []terrainAlgorithm{
+	{Name: "diamond-square", Title: "Diamond square", generate: diamondSquareTerrain},
+	{Name: "value-noise", Title: "Value noise", generate: valueNoiseTerrain},
+}
+
+type mazePageData struct {
+	Algorithm         string
+	MazeAlgorithms    []mazeAlgorithm
+	TerrainAlgorithms []terrainAlgorithm
+	Width             int
+	Height            int
+	Size              int
+	Seed              uint64
+	Solve             bool
+	Drawing           template.HTML
+	JSONURL           string
+}
+
+const MAZE_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>Mazes and terrain</h2>
+		<form action="{{ url "/maze" }}" method="GET">
+			<select name="algorithm">
+				{{ range .MazeAlgorithms }}<option value="{{ .Name }}"{{ if eq .Name $.Algorithm }} selected{{ end }}>{{ .Title }}</option>{{ end }}
+			</select>
+			<label>Width <input type="number" name="width" min=2 max=100 value="{{ .Width }}"></label>
+			<label>Height <input type="number" name="height" min=2 max=100 value="{{ .Height }}"></label>
+			<label><input type="checkbox" name="solve" value="true"{{ if .Solve }} checked{{ end }}> Show the way out</label>
+			<input type="submit" value="Generate maze">
+		</form>
+		<form action="{{ url "/maze" }}" method="GET">
+			<select name="algorithm">
+				{{ range .TerrainAlgorithms }}<option value="{{ .Name }}"{{ if eq .Name $.Algorithm }} selected{{ end }}>{{ .Title }}</option>{{ end }}
+			</select>
+			<label>Size <input type="number" name="size" min=8 max=128 value="{{ .Size }}"></label>
+			<input type="submit" value="Generate terrain">
+		</form>
+		{{ .Drawing }}
+		<p>Seed {{ .Seed }} (<a href="{{ .JSONURL }}">as JSON</a>)</p>
+	</div>
+`
+
+func init() {
+	registerPage(Page{Title: "Maze", Path: "/maze", Order: 45, Visible: true, Section: SECTION_DEMOS, Handler: mazeHandler})
+}
+
+func newMaze(width int, height int) *maze {
+	m := &maze{width: width, height: height, cells: make([][]int, height)}
+	for y := range m.cells {
+		m.cells[y] = make([]int, width)
+	}
+	return m
+}
+
+func (m *maze) contains(x, y int) bool {
+	return x >= 0 && y >= 0 && x < m.width && y < m.height
+}
+
+// Knock down the wall between a cell and its neighbour in the given direction
+func (m *maze) carve(x, y int, direction int) {
+	d := mazeDirections[direction]
+	m.cells[y][x] |= d.passage
+	m.cells[y+d.dy][x+d.dx] |= d.opposite
+}
+
+// Walks from cell to random unvisited neighbouring cell, backing up when it gets stuck. This
+// gives long winding passages with few dead ends.
+func backtrackerMaze(random *rand.Rand, width int, height int) *maze {
+
+	m := newMaze(width, height)
+	visited := map[[2]int]bool{{0, 0}: true}
+	stack := [][2]int{{0, 0}}
+
+	for len(stack) > 0 {
+
+		x, y := stack[len(stack)-1][0], stack[len(stack)-1][1]
+
+		var unvisited []int
+		for direction, d := range mazeDirections {
+			if m.contains(x+d.dx, y+d.dy) && !visited[[2]int{x + d.dx, y + d.dy}] {
+				unvisited = append(unvisited, direction)
+			}
+		}
+
+		if len(unvisited) == 0 {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		direction := unvisited[random.IntN(len(unvisited))]
+		m.carve(x, y, direction)
+		next := [2]int{x + mazeDirections[direction].dx, y + mazeDirections[direction].dy}
+		visited[next] = true
+		stack = append(stack, next)
+
+	}
+
+	return m
+
+}
+
+// Grows the maze from a random cell, adding a random wall on its edge at a time. This gives
+// lots of short dead ends.
+func primMaze(random *rand.Rand, width int, height int) *maze {
+
+	m := newMaze(width, height)
+	visited := map[[2]int]bool{}
+
+	type wall struct{ x, y, direction int }
+	var walls []wall
+
+	visit := func(x, y int) {
+		visited[[2]int{x, y}] = true
+		for direction, d := range mazeDirections {
+			if m.contains(x+d.dx, y+d.dy) && !visited[[2]int{x + d.dx, y + d.dy}] {
+				walls = append(walls, wall{x, y, direction})
+			}
+		}
+	}
+
+	visit(random.IntN(width), random.IntN(height))
+
+	for len(walls) > 0 {
+		i := random.IntN(len(walls))
+		w := walls[i]
+		walls[i] = walls[len(walls)-1]
+		walls = walls[:len(walls)-1]
+		x, y := w.x+mazeDirections[w.direction].dx, w.y+mazeDirections[w.direction].dy
+		if !visited[[2]int{x, y}] {
+			m.carve(w.x, w.y, w.direction)
+			visit(x, y)
+		}
+	}
+
+	return m
+
+}
+
+// Knocks down every wall in a random order unless the cells either side of it are already
+// connected (which we track with a union find)
+func kruskalMaze(random *rand.Rand, width int, height int) *maze {
+
+	m := newMaze(width, height)
+
+	parents := make([]int, width*height)
+	for i := range parents {
+		parents[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parents[i] != i {
+			parents[i] = find(parents[i])
+		}
+		return parents[i]
+	}
+
+	type wall struct{ x, y, direction int }
+	var walls []wall
+	for y := range height {
+		for x := range width {
+			if x+1 < width {
+				walls = append(walls, wall{x, y, 1})
+			}
+			if y+1 < height {
+				walls = append(walls, wall{x, y, 2})
+			}
+		}
+	}
+
+	random.Shuffle(len(walls), func(i, j int) { walls[i], walls[j] = walls[j], walls[i] })
+
+	for _, w := range walls {
+		d := mazeDirections[w.direction]
+		a, b := find(w.y*width+w.x), find((w.y+d.dy)*width+w.x+d.dx)
+		if a != b {
+			parents[a] = b
+			m.carve(w.x, w.y, w.direction)
+		}
+	}
+
+	return m
+
+}
+
+// Opens each cell to the north or the west at random. This is the simplest algorithm there is,
+// though it leaves the top row and left column as long straight corridors.
+func binaryTreeMaze(random *rand.Rand, width int, height int) *maze {
+
+	m := newMaze(width, height)
+
+	for y := range height {
+		for x := range width {
+			var directions []int
+			if y > 0 {
+				directions = append(directions, 0)
+			}
+			if x > 0 {
+				directions = append(directions, 3)
+			}
+			if len(directions) > 0 {
+				m.carve(x, y, directions[random.IntN(len(directions))])
+			}
+		}
+	}
+
+	return m
+
+}
+
+// Returns the cells on the way from the entrance to the exit, found by a breadth first search
+func (m *maze) solve() [][2]int {
+
+	start, end := [2]int{0, 0}, [2]int{m.width - 1, m.height - 1}
+	previous := map[[2]int][2]int{start: start}
+	queue := [][2]int{start}
+
+	for len(queue) > 0 {
+		cell := queue[0]
+		queue = queue[1:]
+		if cell == end {
+			break
+		}
+		for _, d := range mazeDirections {
+			next := [2]int{cell[0] + d.dx, cell[1] + d.dy}
+			if _, seen := previous[next]; m.cells[cell[1]][cell[0]]&d.passage != 0 && !seen {
+				previous[next] = cell
+				queue = append(queue, next)
+			}
+		}
+	}
+
+	path := [][2]int{end}
+	for cell := end; cell != start; {
+		cell = previous[cell]
+		path = append(path, cell)
+	}
+
+	slices.Reverse(path)
+	return path
+
+}
+
+func newTerrain(size int) *terrain {
+	t := &terrain{size: size, heights: make([][]float64, size+1)}
+	for y := range t.heights {
+		t.heights[y] = make([]float64, size+1)
+	}
+	return t
+}
+
+// Stretch our heights to run from 0 to 1
+func (t *terrain) normalise() {
+
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, row := range t.heights {
+		low, high = min(low, slices.Min(row)), max(high, slices.Max(row))
+	}
+
+	for _, row := range t.heights {
+		for x := range row {
+			if high > low {
+				row[x] = (row[x] - low) / (high - low)
+			} else {
+				row[x] = 0
+			}
+		}
+	}
+
+}
+
+// The diamond square algorithm. Starting from random corners, each square's centre is set to
+// the average of its corners plus some noise (the diamond step), then the middle of each edge
+// to the average of its neighbours plus noise (the square step), with less noise each time the
+// squares halve. It works on grids of a power of two plus one, so we crop it to our size.
+func diamondSquareTerrain(random *rand.Rand, size int) *terrain {
+
+	n := 1
+	for n < size {
+		n *= 2
+	}
+
+	grid := newTerrain(n)
+	h := grid.heights
+	noise := func(scale float64) float64 { return (random.Float64()*2 - 1) * scale }
+
+	for _, corner := range [][2]int{{0, 0}, {0, n}, {n, 0}, {n, n}} {
+		h[corner[1]][corner[0]] = random.Float64()
+	}
+
+	scale := 1.0
+
+	for step := n; step > 1; step /= 2 {
+
+		half := step / 2
+
+		for y := half; y < n; y += step {
+			for x := half; x < n; x += step {
+				h[y][x] = (h[y-half][x-half]+h[y-half][x+half]+h[y+half][x-half]+h[y+half][x+half])/4 + noise(scale)
+			}
+		}
+
+		for y := 0; y <= n; y += half {
+			for x := (y/half + 1) % 2 * half; x <= n; x += step {
+				sum, count := 0.0, 0
+				for _, d := range [][2]int{{0, -half}, {half, 0}, {0, half}, {-half, 0}} {
+					if nx, ny := x+d[0], y+d[1]; nx >= 0 && ny >= 0 && nx <= n && ny <= n {
+						sum, count = sum+h[ny][nx], count+1
+					}
+				}
+				h[y][x] = sum/float64(count) + noise(scale)
+			}
+		}
+
+		scale *= TERRAIN_ROUGHNESS
+
+	}
+
+	t := newTerrain(size)
+	for y := range t.heights {
+		copy(t.heights[y], h[y])
+	}
+
+	t.normalise()
+	return t
+
+}
+
+// Fractal value noise. Random heights on a coarse lattice are smoothly interpolated between,
+// and finer lattices with smaller heights are added on top (five octaves in all).
+func valueNoiseTerrain(random *rand.Rand, size int) *terrain {
+
+	t := newTerrain(size)
+	amplitude, cells := 1.0, 4
+
+	for range 5 {
+
+		lattice := make([][]float64, cells+1)
+		for i := range lattice {
+			lattice[i] = make([]float64, cells+1)
+			for j := range lattice[i] {
+				lattice[i][j] = random.Float64()
+			}
+		}
+
+		smooth := func(t float64) float64 { return t * t * (3 - 2*t) }
+
+		for y, row := range t.heights {
+			for x := range row {
+				lx, ly := float64(x)*float64(cells)/float64(size), float64(y)*float64(cells)/float64(size)
+				x0, y0 := min(int(lx), cells-1), min(int(ly), cells-1)
+				fx, fy := smooth(lx-float64(x0)), smooth(ly-float64(y0))
+				top := lattice[y0][x0] + (lattice[y0][x0+1]-lattice[y0][x0])*fx
+				bottom := lattice[y0+1][x0] + (lattice[y0+1][x0+1]-lattice[y0+1][x0])*fx
+				row[x] += (top + (bottom-top)*fy) * amplitude
+			}
+		}
+
+		amplitude *= TERRAIN_ROUGHNESS
+		cells = min(cells*2, size)
+
+	}
+
+	t.normalise()
+	return t
+
+}
+
+// Draw a maze as SVG, with the way out if it's given
+func (m *maze) svg(solution [][2]int) string {
+
+	cell := math.Floor(min(float64(canvasWidth-2*MAZE_MARGIN)/float64(m.width), float64(canvasHeight-2*MAZE_MARGIN)/float64(m.height)))
+	width, height := cell*float64(m.width)+2*MAZE_MARGIN, cell*float64(m.height)+2*MAZE_MARGIN
+
+	var output bytes.Buffer
+
+	fmt.Fprintf(&output, "<svg xmlns='http://www.w3.org/2000/svg' width='%g' height='%g' "+
+		"style='stroke: black; stroke-width: 2; stroke-linecap: square; fill: none'>", width, height)
+
+	// The outer walls, leaving gaps for the entrance and exit
+	fmt.Fprintf(&output, "<path d='M%g,%g H%g V%g M%g,%g H%g V%g'/>\n",
+		MAZE_MARGIN+cell, float64(MAZE_MARGIN), width-MAZE_MARGIN, height-MAZE_MARGIN,
+		width-MAZE_MARGIN-cell, height-MAZE_MARGIN, float64(MAZE_MARGIN), float64(MAZE_MARGIN))
+
+	// Then the east and south walls of each cell
+	output.WriteString("<path d='")
+	for y, row := range m.cells {
+		for x, passages := range row {
+			left, top := MAZE_MARGIN+float64(x)*cell, MAZE_MARGIN+float64(y)*cell
+			if x+1 < m.width && passages&MAZE_EAST == 0 {
+				fmt.Fprintf(&output, "M%g,%g v%g ", left+cell, top, cell)
+			}
+			if y+1 < m.height && passages&MAZE_SOUTH == 0 {
+				fmt.Fprintf(&output, "M%g,%g h%g ", left, top+cell, cell)
+			}
+		}
+	}
+	output.WriteString("'/>\n")
+
+	if solution != nil {
+		output.WriteString("<polyline style='stroke: crimson; stroke-width: 3' points='")
+		for _, c := range solution {
+			fmt.Fprintf(&output, "%g,%g ", MAZE_MARGIN+(float64(c[0])+0.5)*cell, MAZE_MARGIN+(float64(c[1])+0.5)*cell)
+		}
+		output.WriteString("'/>\n")
+	}
+
+	output.WriteString("</svg>")
+	return output.String()
+
+}
+
+// Draw terrain as SVG, projected like our surface drawing and coloured by height. Cells are
+// drawn from the back to the front, so that nearer hills hide what's behind them.
+func (t *terrain) svg(palette []colour) string {
+
+	var output bytes.Buffer
+
+	fmt.Fprintf(&output, "<svg xmlns='http://www.w3.org/2000/svg' "+
+		"style='stroke: rgba(0, 0, 0, 0.15); stroke-width: 0.5' "+
+		"width='%d' height='%d'>", canvasWidth, canvasHeight)
+
+	corner := func(i, j int) (float64, float64) {
+		x := xyAxisRange * (float64(i)/float64(t.size) - 0.5)
+		y := xyAxisRange * (float64(j)/float64(t.size) - 0.5)
+		return isometric(x, y, (max(t.heights[j][i], WATER_LEVEL)-0.5)*TERRAIN_RELIEF)
+	}
+
+	for depth := 0; depth <= 2*(t.size-1); depth++ {
+		for i := max(0, depth-t.size+1); i <= min(depth, t.size-1); i++ {
+			j := depth - i
+			ax, ay := corner(i+1, j)
+			bx, by := corner(i, j)
+			cx, cy := corner(i, j+1)
+			dx, dy := corner(i+1, j+1)
+			height := (t.heights[j][i] + t.heights[j][i+1] + t.heights[j+1][i] + t.heights[j+1][i+1]) / 4
+			writeSVGPolygon(&output, []float64{ax, ay, bx, by, cx, cy, dx, dy}, paletteColourAt(palette, height).Hex())
+		}
+	}
+
+	output.WriteString("</svg>")
+	return output.String()
+
+}
+
+// Parse a whole number parameter within the given range, or return its default if it's missing
+func mazeParameter(query url.Values, name string, fallback int, low int, high int) (int, error) {
+
+	value := query.Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number < low || number > high {
+		return 0, badRequestError(fmt.Sprintf("The %s must be a number from %d to %d.", name, low, high))
+	}
+
+	return number, nil
+
+}
+
+// This is our maze page, which draws a maze or terrain (or returns it as JSON)
+func mazeHandler(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	data := mazePageData{Algorithm: cmp.Or(query.Get("algorithm"), mazeAlgorithms[0].Name),
+		MazeAlgorithms: mazeAlgorithms, TerrainAlgorithms: terrainAlgorithms, Solve: query.Get("solve") == "true"}
+
+	var err error
+
+	if data.Width, err = mazeParameter(query, "width", MAZE_SIZE, MIN_MAZE_SIZE, MAX_MAZE_SIZE); err == nil {
+		if data.Height, err = mazeParameter(query, "height", MAZE_SIZE, MIN_MAZE_SIZE, MAX_MAZE_SIZE); err == nil {
+			data.Size, err = mazeParameter(query, "size", TERRAIN_SIZE, MIN_TERRAIN_SIZE, MAX_TERRAIN_SIZE)
+		}
+	}
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Our random seeds fit in 53 bits, so that JavaScript can read them from the JSON
+	data.Seed = rand.Uint64() >> 11
+	if value := query.Get("seed"); value != "" {
+		if data.Seed, err = strconv.ParseUint(value, 10, 64); err != nil {
+			writeError(w, r, badRequestError("The seed must be a positive whole number."))
+			return
+		}
+	}
+
+	palette, err := parsePalette(cmp.Or(query.Get("palette"), TERRAIN_PALETTE))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	format := query.Get("format")
+	if format != "" && format != "html" && format != "json" {
+		writeError(w, r, badRequestError("The format must be html or json."))
+		return
+	}
+
+	random := rand.New(rand.NewPCG(data.Seed, 0))
+	var response any
+	var drawing string
+
+	endSpan := startSpan(r.Context(), "maze: "+data.Algorithm)
+
+	if i := slices.IndexFunc(mazeAlgorithms, func(a mazeAlgorithm) bool { return a.Name == data.Algorithm }); i >= 0 {
+
+		m := mazeAlgorithms[i].generate(random, data.Width, data.Height)
+
+		var solution [][2]int
+		if data.Solve {
+			solution = m.solve()
+		}
+
+		response = struct {
+			Algorithm string   `json:"algorithm"`
+			Seed      uint64   `json:"seed"`
+			Width     int      `json:"width"`
+			Height    int      `json:"height"`
+			Cells     [][]int  `json:"cells"`
+			Solution  [][2]int `json:"solution,omitempty"`
+		}{data.Algorithm, data.Seed, data.Width, data.Height, m.cells, solution}
+
+		if format != "json" {
+			drawing = m.svg(solution)
+		}
+
+	} else if i := slices.IndexFunc(terrainAlgorithms, func(a terrainAlgorithm) bool { return a.Name == data.Algorithm }); i >= 0 {
+
+		t := terrainAlgorithms[i].generate(random, data.Size)
+
+		heights := make([][]float64, len(t.heights))
+		for y, row := range t.heights {
+			heights[y] = make([]float64, len(row))
+			for x, height := range row {
+				heights[y][x] = math.Round(height*10000) / 10000
+			}
+		}
+
+		response = struct {
+			Algorithm string      `json:"algorithm"`
+			Seed      uint64      `json:"seed"`
+			Size      int         `json:"size"`
+			Heights   [][]float64 `json:"heights"`
+		}{data.Algorithm, data.Seed, data.Size, heights}
+
+		if format != "json" {
+			drawing = t.svg(palette)
+		}
+
+	} else {
+
+		endSpan()
+
+		names := []string{}
+		for _, algorithm := range mazeAlgorithms {
+			names = append(names, algorithm.Name)
+		}
+		for _, algorithm := range terrainAlgorithms {
+			names = append(names, algorithm.Name)
+		}
+
+		writeError(w, r, badRequestError("Unknown algorithm. Choose one of "+strings.Join(names, ", ")+"."))
+		return
+
+	}
+
+	endSpan()
+	incrementCounter("mazes_generated_total", "algorithm", data.Algorithm)
+
+	if format == "json" {
+		setContentType(w, CONTENT_TYPE_JSON)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Our JSON link gives the same maze or terrain, so it includes the seed
+	query.Set("seed", strconv.FormatUint(data.Seed, 10))
+	query.Set("format", "json")
+	data.JSONURL = urlFor("/maze") + "?" + query.Encode()
+	// template-audit: the drawing is an SVG we generate, which only carries numbers and colours
+	data.Drawing = template.HTML(drawing)
+
+	body, err := renderFragment(mazeBodyTemplate, data)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the maze body template"))
+		return
+	}
+
+	renderMainTemplate(w, r, "maze", HtmlData{
+		Title:       "Golang Maze and Terrain Generation",
+		Description: "Mazes and heightmap terrain generated on the server and drawn as SVG.",
+		Keywords:    "golang web server maze terrain heightmap procedural generation svg",
+		CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+		BodyContent: body,
+	})
+
+}
@@ -0,0 +1,172 @@
+// Simple in-memory metrics (counters and gauges) which are exposed in the Prometheus text
+// format at /metrics, along with the middleware we use to record request metrics.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A metric series is identified by its name along with its (sorted) label pairs
+type metricSeries struct {
+	name   string
+	labels string
+}
+
+// Our registry of metrics. Counters only ever increase, while gauges can be set to any value.
+type metricsRegistry struct {
+	mutex    sync.Mutex
+	counters map[metricSeries]float64
+	gauges   map[metricSeries]float64
+}
+
+var metrics = &metricsRegistry{
+	counters: make(map[metricSeries]float64),
+	gauges:   make(map[metricSeries]float64),
+}
+
+// Construct our metric series from a name and a list of label key / value pairs (i.e.
+// "method", "GET", "status", "2xx").
+func newMetricSeries(name string, labelPairs []string) metricSeries {
+
+	var labels []string
+	for i := 0; i+1 < len(labelPairs); i += 2 {
+		labels = append(labels, fmt.Sprintf("%s=%q", labelPairs[i], labelPairs[i+1]))
+	}
+	sort.Strings(labels)
+
+	return metricSeries{name: name, labels: strings.Join(labels, ",")}
+
+}
+
+// Increment the counter with the given name and label pairs by one
+func incrementCounter(name string, labelPairs ...string) {
+	addCounter(name, 1, labelPairs...)
+}
+
+// Increase the counter with the given name and label pairs by the given value
+func addCounter(name string, value float64, labelPairs ...string) {
+	series := newMetricSeries(name, labelPairs)
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.counters[series] += value
+}
+
+// Returns the sum of the counters with the given name which have all of the given label pairs
+func sumCounters(name string, labelPairs ...string) float64 {
+
+	var labels []string
+	for i := 0; i+1 < len(labelPairs); i += 2 {
+		labels = append(labels, fmt.Sprintf("%s=%q", labelPairs[i], labelPairs[i+1]))
+	}
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	var sum float64
+
+	for series, value := range metrics.counters {
+
+		if series.name != name {
+			continue
+		}
+
+		matches := true
+		for _, label := range labels {
+			if !slices.Contains(strings.Split(series.labels, ","), label) {
+				matches = false
+			}
+		}
+
+		if matches {
+			sum += value
+		}
+
+	}
+
+	return sum
+
+}
+
+// Set the gauge with the given name and label pairs to the given value
+func setGauge(name string, value float64, labelPairs ...string) {
+	series := newMetricSeries(name, labelPairs)
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.gauges[series] = value
+}
+
+// This is our metrics handler. It writes out all of our metrics in the Prometheus text
+// exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+
+	setContentType(w, "text/plain; version=0.0.4; charset=utf-8")
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	writeMetricSeries(w, "counter", metrics.counters)
+	writeMetricSeries(w, "gauge", metrics.gauges)
+
+}
+
+// Write out the given metric series grouped and sorted by name
+func writeMetricSeries(w http.ResponseWriter, metricType string, values map[metricSeries]float64) {
+
+	var allSeries []metricSeries
+	for series := range values {
+		allSeries = append(allSeries, series)
+	}
+
+	sort.Slice(allSeries, func(i, j int) bool {
+		if allSeries[i].name != allSeries[j].name {
+			return allSeries[i].name < allSeries[j].name
+		}
+		return allSeries[i].labels < allSeries[j].labels
+	})
+
+	previousName := ""
+	for _, series := range allSeries {
+		if series.name != previousName {
+			fmt.Fprintf(w, "# TYPE %s %s\n", series.name, metricType)
+			previousName = series.name
+		}
+		if series.labels == "" {
+			fmt.Fprintf(w, "%s %g\n", series.name, values[series])
+		} else {
+			fmt.Fprintf(w, "%s{%s} %g\n", series.name, series.labels, values[series])
+		}
+	}
+
+}
+
+// Returns a handler which records the number of requests we serve, broken down by method and
+// response status class (i.e. 2xx, 4xx), along with how long they take.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := newStatusRecorder(w)
+
+		// Transfer control to the next handler, recording the status it responds with
+		next.ServeHTTP(recorder, r)
+
+		// Our latency is watched for slow spells to profile (see profiles.go)
+		observeLatency(time.Since(started))
+
+		incrementCounter("http_requests_total", "method", r.Method, "status", statusClass(recorder.status))
+		timeSeriesHistory.add("http_requests_total", time.Now(), 1)
+
+		// Along with the tags our handlers attached (see tags.go)
+		countRequestTags(requestFields(r.Context()), recorder.status)
+	})
+}
@@ -0,0 +1,159 @@
+// Content types. All of our handlers set an explicit Content-Type (with a charset for textual
+// types) via setContentType rather than leaving browsers to sniff one, and the content types
+// of the files we serve come from our extension to content type registry. The registry starts
+// out with Go's built in types plus the defaults below, and can be extended or overridden with
+// a mime.types style file passed in via the -mime-types flag:
+//
+//	# type                  extensions
+//	text/markdown           md markdown
+//	application/x-ndjson    ndjson
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The content types of the responses we generate ourselves
+const (
+	CONTENT_TYPE_HTML = "text/html; charset=utf-8"
+	CONTENT_TYPE_TEXT = "text/plain; charset=utf-8"
+	CONTENT_TYPE_JSON = "application/json; charset=utf-8"
+	CONTENT_TYPE_XML  = "application/xml; charset=utf-8"
+)
+
+// The content type we serve files of an unknown type with. Browsers will offer to download
+// these rather than trying to display them.
+const DEFAULT_CONTENT_TYPE = "application/octet-stream"
+
+// The content types we register on top of Go's built in types. Some of these are missing from
+// Go's table, while others are only known to Go on systems with a suitable mime.types file
+// (which would otherwise make our responses depend on the machine we run on).
+var defaultContentTypes = map[string]string{
+	".ico":         "image/x-icon",
+	".webmanifest": "application/manifest+json",
+	".md":          "text/markdown",
+	".markdown":    "text/markdown",
+	".txt":         "text/plain",
+	".csv":         "text/csv",
+	".mjs":         "text/javascript",
+	".map":         "application/json",
+	".wasm":        "application/wasm",
+	".webp":        "image/webp",
+	".avif":        "image/avif",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".mp4":         "video/mp4",
+	".webm":        "video/webm",
+	".mp3":         "audio/mpeg",
+	".yaml":        "application/yaml",
+	".yml":         "application/yaml",
+}
+
+// Textual types outside of text/* which we also serve with a charset
+var textualContentTypes = map[string]bool{
+	"application/json":          true,
+	"application/javascript":    true,
+	"application/xml":           true,
+	"application/manifest+json": true,
+	"application/yaml":          true,
+	"image/svg+xml":             true,
+}
+
+// Register our default content types
+func init() {
+	for extension, contentType := range defaultContentTypes {
+		if err := registerContentType(extension, contentType); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Register (or override) the content type for the given extension (i.e. ".md")
+func registerContentType(extension string, contentType string) error {
+
+	if !strings.HasPrefix(extension, ".") {
+		extension = "." + extension
+	}
+
+	return mime.AddExtensionType(strings.ToLower(extension), withCharset(contentType))
+
+}
+
+// Load the extension to content type mappings from the given mime.types style file, where each
+// line holds a content type followed by its extensions
+func loadMimeTypes(path string) error {
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) == 1 {
+			return fmt.Errorf("%s:%d: %s has no extensions", path, lineNumber, fields[0])
+		}
+
+		for _, extension := range fields[1:] {
+			if err := registerContentType(extension, fields[0]); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+			}
+		}
+
+	}
+
+	return scanner.Err()
+
+}
+
+// Returns the content type we serve the file with the given name as
+func contentTypeFor(name string) string {
+
+	if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+		return withCharset(contentType)
+	}
+
+	return DEFAULT_CONTENT_TYPE
+
+}
+
+// Adds a UTF-8 charset to the given content type if it's textual and doesn't have one
+func withCharset(contentType string) string {
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+
+	if err != nil || params["charset"] != "" {
+		return contentType
+	}
+
+	if strings.HasPrefix(mediaType, "text/") || textualContentTypes[mediaType] {
+		params["charset"] = "utf-8"
+		return mime.FormatMediaType(mediaType, params)
+	}
+
+	return contentType
+
+}
+
+// Set the content type of our response, making sure that browsers don't second guess it
+func setContentType(w http.ResponseWriter, contentType string) {
+	w.Header().Set("Content-Type", withCharset(contentType))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+}
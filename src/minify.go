@@ -0,0 +1,223 @@
+// HTML minification. Our templates are indented for readability and carry comments (and our
+// main CSS is inlined into every page), all of which is sent with every request. With
+// -minify-html, each page is minified once our main template has rendered it:
+//
+//   - comments are removed (apart from conditional comments, <!--[if ...]>)
+//   - runs of whitespace between and within text are collapsed into a single space, or a single
+//     newline when the run contains one, which browsers render the same way
+//   - whitespace between attributes is collapsed, while attribute values are kept exactly as
+//     they are, along with the quotes around them
+//   - the contents of <pre> and <textarea> elements are kept exactly as they are, as are those
+//     of <script> elements (whose whitespace may be significant); <style> elements have their
+//     comments removed and their whitespace collapsed (outside of strings)
+//
+// The bytes minification saves are counted in the html_minified_bytes_saved_total metric.
+
+package main
+
+import (
+	"bytes"
+	"slices"
+)
+
+// The elements whose contents we keep exactly as they are
+var rawTextElements = []string{"pre", "textarea", "script"}
+
+// Returns the given page minified if -minify-html is set (and as it is otherwise)
+func minifiedHTML(page []byte) []byte {
+
+	if !minifyHTML {
+		return page
+	}
+
+	minified := minifyHTMLDocument(page)
+
+	addCounter("html_minified_bytes_saved_total", float64(len(page)-len(minified)))
+	return minified
+
+}
+
+// Minify the given HTML document
+func minifyHTMLDocument(page []byte) []byte {
+
+	output := make([]byte, 0, len(page))
+
+	for i := 0; i < len(page); {
+
+		switch {
+		// Comments, apart from conditional comments
+		case bytes.HasPrefix(page[i:], []byte("<!--")):
+			end := bytes.Index(page[i+4:], []byte("-->"))
+			if end < 0 {
+				return append(output, page[i:]...)
+			}
+			end += i + 4 + 3
+			if bytes.HasPrefix(page[i:], []byte("<!--[if")) {
+				output = append(output, page[i:end]...)
+			}
+			i = end
+
+		// Tags, whose attributes we keep as they are
+		case page[i] == '<':
+			end := htmlTagEnd(page, i)
+			output = appendMinifiedTag(output, page[i:end])
+			name := htmlTagName(page[i:end])
+			i = end
+
+			// Elements whose contents we keep (or only lightly touch)
+			if name == "style" || slices.Contains(rawTextElements, name) {
+				closing := indexFold(page[i:], []byte("</"+name))
+				if closing < 0 {
+					closing = len(page) - i
+				}
+				if name == "style" {
+					output = appendMinifiedCSS(output, page[i:i+closing])
+				} else {
+					output = append(output, page[i:i+closing]...)
+				}
+				i += closing
+			}
+
+		// Whitespace, which we collapse
+		case isHTMLSpace(page[i]):
+			start := i
+			for i < len(page) && isHTMLSpace(page[i]) {
+				i++
+			}
+			space := byte(' ')
+			if bytes.IndexByte(page[start:i], '\n') >= 0 {
+				space = '\n'
+			}
+			// The whitespace either side of a comment we removed is one run
+			if last := len(output) - 1; last >= 0 && isHTMLSpace(output[last]) {
+				if space == '\n' {
+					output[last] = space
+				}
+				continue
+			}
+			output = append(output, space)
+
+		default:
+			output = append(output, page[i])
+			i++
+		}
+
+	}
+
+	return bytes.TrimSpace(output)
+
+}
+
+// Returns the index just after the end of the tag starting at the given index (skipping over
+// quoted attribute values, which may contain a >)
+func htmlTagEnd(page []byte, start int) int {
+	quote := byte(0)
+	for i := start + 1; i < len(page); i++ {
+		switch {
+		case quote != 0:
+			if page[i] == quote {
+				quote = 0
+			}
+		case page[i] == '"' || page[i] == '\'':
+			quote = page[i]
+		case page[i] == '>':
+			return i + 1
+		}
+	}
+	return len(page)
+}
+
+// Returns the lower case name of the given opening tag ("" for closing tags and the like)
+func htmlTagName(tag []byte) string {
+	end := 1
+	for end < len(tag) && (tag[end] >= 'a' && tag[end] <= 'z' || tag[end] >= 'A' && tag[end] <= 'Z' || tag[end] >= '0' && tag[end] <= '9') {
+		end++
+	}
+	return string(bytes.ToLower(tag[1:end]))
+}
+
+// Append the given tag with the whitespace between its attributes collapsed
+func appendMinifiedTag(output []byte, tag []byte) []byte {
+
+	quote := byte(0)
+	for i := 0; i < len(tag); i++ {
+		c := tag[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case isHTMLSpace(c):
+			for i+1 < len(tag) && isHTMLSpace(tag[i+1]) {
+				i++
+			}
+			// Whitespace before the end of the tag isn't needed
+			if next := tag[i+1:]; bytes.Equal(next, []byte(">")) || bytes.Equal(next, []byte("/>")) {
+				continue
+			}
+			c = ' '
+		}
+		output = append(output, c)
+	}
+
+	return output
+
+}
+
+// Append the given style sheet with its comments removed and its whitespace collapsed (outside
+// of strings)
+func appendMinifiedCSS(output []byte, css []byte) []byte {
+
+	quote := byte(0)
+	for i := 0; i < len(css); i++ {
+		c := css[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && i+1 < len(css) {
+				output = append(output, c)
+				i++
+				c = css[i]
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '/' && i+1 < len(css) && css[i+1] == '*':
+			end := bytes.Index(css[i+2:], []byte("*/"))
+			if end < 0 {
+				return output
+			}
+			i += end + 3
+			continue
+		case isHTMLSpace(c):
+			for i+1 < len(css) && isHTMLSpace(css[i+1]) {
+				i++
+			}
+			if len(output) > 0 && output[len(output)-1] == ' ' {
+				continue
+			}
+			c = ' '
+		}
+		output = append(output, c)
+	}
+
+	return output
+
+}
+
+// Returns whether the given byte is HTML whitespace
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// Returns the index of the first case insensitive match of the given (lower case) needle
+func indexFold(haystack []byte, needle []byte) int {
+	for i := 0; i+len(needle) <= len(haystack); i++ {
+		if bytes.EqualFold(haystack[i:i+len(needle)], needle) {
+			return i
+		}
+	}
+	return -1
+}
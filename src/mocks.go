@@ -0,0 +1,267 @@
+// Mock routes. Alongside our demos, the server can stand in for an API which doesn't exist yet
+// (or which a test shouldn't depend on): mock routes are defined in a JSON file passed in via
+// the -mocks flag, and registered with our router at startup.
+//
+//	{
+//		"mocks": [
+//			{
+//				"method": "GET",
+//				"path": "/api/users/{id}",
+//				"status": 200,
+//				"headers": {"Cache-Control": "no-store"},
+//				"body": "{\"id\": \"{{ .PathValues.id }}\", \"name\": \"User {{ .PathValues.id }}\"}",
+//				"latency": "150ms"
+//			}
+//		]
+//	}
+//
+// Paths use the same patterns as our router (i.e. {id} wildcards), and bodies are Go text
+// templates which can use the details of the request (see mockRequestData). Mocks default to
+// GET and a 200 status, and bodies which are valid JSON are served as JSON (unless a
+// Content-Type header is given).
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// The largest request body we make available to mock body templates
+const MAX_MOCK_REQUEST_BODY = 1 << 20
+
+// A mock route as defined in our mocks file
+type mockDefinition struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	Latency string            `json:"latency"`
+}
+
+// A mock route ready to be served
+type mockRoute struct {
+	method  string
+	status  int
+	headers map[string]string
+	body    *template.Template
+	latency time.Duration
+}
+
+// The details of a request which mock body templates can use, i.e. {{ .Query.Get "page" }}
+type mockRequestData struct {
+	Method     string
+	Path       string
+	PathValues map[string]string
+	Query      url.Values
+	Header     http.Header
+	Body       string
+	RequestID  string
+}
+
+// Our mock routes, grouped by path (so that one path can have mocks for several methods).
+// These are loaded from our mocks file before our routes are registered.
+var (
+	mockRoutes    = map[string][]*mockRoute{}
+	mockRouteKeys []string // The paths of our mock routes in the order they were defined
+)
+
+// Load our mock routes from the given JSON file, checking each of them
+func loadMocks(path string) error {
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	var file struct {
+		Mocks []mockDefinition `json:"mocks"`
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&file); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for index, definition := range file.Mocks {
+
+		route, err := newMockRoute(definition)
+
+		if err != nil {
+			return fmt.Errorf("%s: mock %d (%s %s): %w", path, index+1, definition.Method, definition.Path, err)
+		}
+
+		for _, existing := range mockRoutes[definition.Path] {
+			if existing.method == route.method {
+				return fmt.Errorf("%s: mock %d: %s %s is defined more than once", path, index+1, route.method, definition.Path)
+			}
+		}
+
+		if _, exists := mockRoutes[definition.Path]; !exists {
+			mockRouteKeys = append(mockRouteKeys, definition.Path)
+		}
+		mockRoutes[definition.Path] = append(mockRoutes[definition.Path], route)
+
+	}
+
+	return nil
+
+}
+
+// Check and prepare the given mock definition
+func newMockRoute(definition mockDefinition) (*mockRoute, error) {
+
+	if !strings.HasPrefix(definition.Path, "/") {
+		return nil, fmt.Errorf("the path must start with a /")
+	}
+
+	route := &mockRoute{
+		method:  strings.ToUpper(definition.Method),
+		status:  definition.Status,
+		headers: definition.Headers,
+	}
+
+	if route.method == "" {
+		route.method = http.MethodGet
+	}
+
+	if route.status == 0 {
+		route.status = http.StatusOK
+	}
+
+	if route.status < 100 || route.status > 599 {
+		return nil, fmt.Errorf("invalid status %d", route.status)
+	}
+
+	if definition.Latency != "" {
+		latency, err := time.ParseDuration(definition.Latency)
+		if err != nil || latency < 0 {
+			return nil, fmt.Errorf("invalid latency %q", definition.Latency)
+		}
+		route.latency = latency
+	}
+
+	body, err := template.New(definition.Path).Option("missingkey=zero").Parse(definition.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	route.body = body
+
+	return route, nil
+
+}
+
+// Register our mock routes with the given router. Mocks can't replace our own routes, so a
+// mock whose path conflicts with one of them stops the server from starting.
+func registerMockRoutes(router *http.ServeMux) {
+
+	for _, path := range mockRouteKeys {
+
+		routes := mockRoutes[path]
+		var methods []string
+		for _, route := range routes {
+			methods = append(methods, route.method)
+		}
+
+		func() {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					log.Fatalf("Invalid -mocks: the mock route %s conflicts with one of our routes: %v", path, recovered)
+				}
+			}()
+			handleRoute(router, path, mockHandler(routes), methods...)
+		}()
+
+	}
+
+}
+
+// Returns a handler which serves the given mocks of a single path
+func mockHandler(routes []*mockRoute) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// Our method handler only lets through the methods we have mocks for, and HEAD
+		// requests are served as GET requests
+		var route *mockRoute
+		for _, candidate := range routes {
+			if candidate.method == r.Method || candidate.method == http.MethodGet && r.Method == http.MethodHead {
+				route = candidate
+			}
+		}
+
+		if route == nil {
+			writeError(w, r, notFoundError())
+			return
+		}
+
+		if route.latency > 0 {
+			select {
+			case <-time.After(route.latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		requestBody, err := io.ReadAll(io.LimitReader(r.Body, MAX_MOCK_REQUEST_BODY))
+
+		if err != nil {
+			writeError(w, r, badRequestError("The request body couldn't be read.").Wrap(err))
+			return
+		}
+
+		data := mockRequestData{
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			PathValues: map[string]string{},
+			Query:      r.URL.Query(),
+			Header:     r.Header,
+			Body:       string(requestBody),
+		}
+		data.RequestID, _ = r.Context().Value(REQUEST_ID_KEY).(string)
+
+		for _, segment := range strings.Split(r.Pattern, "/") {
+			if name, found := strings.CutPrefix(segment, "{"); found {
+				name = strings.TrimSuffix(strings.TrimSuffix(name, "}"), "...")
+				data.PathValues[name] = r.PathValue(name)
+			}
+		}
+
+		var body bytes.Buffer
+
+		if err := route.body.Execute(&body, data); err != nil {
+			writeError(w, r, internalError(err).WithDetail("executing the mock body template for %s", r.Pattern))
+			return
+		}
+
+		if json.Valid(body.Bytes()) {
+			setContentType(w, CONTENT_TYPE_JSON)
+		} else if body.Len() > 0 {
+			setContentType(w, CONTENT_TYPE_TEXT)
+		}
+
+		for name, value := range route.headers {
+			w.Header().Set(name, value)
+		}
+
+		incrementCounter("mock_responses_total", "route", r.Pattern)
+
+		w.WriteHeader(route.status)
+		w.Write(body.Bytes())
+
+	}
+}
@@ -0,0 +1,391 @@
+// Our shared client for outbound HTTP calls (i.e. webhooks and the external APIs our pages
+// fetch from). Every call goes through outboundClient.Do, which adds:
+//
+//   - a timeout for each attempt, on top of any deadline of the caller's context
+//   - retries with exponential backoff (and jitter) for network errors and 429 / 502 / 503 /
+//     504 responses, honouring Retry-After. Only requests which are safe to repeat are retried:
+//     idempotent methods, or requests carrying an Idempotency-Key header.
+//   - a circuit breaker for each host, so that we stop calling (and waiting on) a host which
+//     keeps failing, and try it again after a cool down
+//   - per host metrics (outbound_requests_total, outbound_retries_total and so on) and a trace
+//     span for each call
+//   - the ID of the request being served (if any) as an X-Request-Id header, so that calls
+//     can be matched up with our logs by the services we call
+//   - a line in our log for each attempt, with the ID of the request being served, the status
+//     (or error) and how long it took, and the outbound_errors_total metric, counting failed
+//     attempts by host and reason (network, timeout, 5xx or circuit_open)
+//
+// Calls made with clients of their own (i.e. Vault, see secrets.go, and OCSP, see tls.go) are
+// logged and counted the same way with logOutboundCall. Only the scheme, host and first path
+// segment of a URL are logged, as webhook URLs often carry their secret in the path and API
+// keys go in the query.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OUTBOUND_TIMEOUT           = 10 * time.Second       // How long we wait for each attempt
+	OUTBOUND_MAX_RETRIES       = 2                      // How many times we retry a failed call
+	OUTBOUND_RETRY_BACKOFF     = 250 * time.Millisecond // How long we wait before our first retry
+	OUTBOUND_MAX_RETRY_BACKOFF = 5 * time.Second        // The longest we wait before a retry
+	CIRCUIT_FAILURE_THRESHOLD  = 5                      // Consecutive failures which open a circuit
+	CIRCUIT_OPEN_DURATION      = 30 * time.Second       // How long an open circuit rejects calls
+)
+
+// The states of our circuit breakers (these are the values of our outbound_circuit_state gauge)
+const (
+	CIRCUIT_CLOSED    = 0 // Calls go through as normal
+	CIRCUIT_OPEN      = 1 // Calls fail straight away
+	CIRCUIT_HALF_OPEN = 2 // A single trial call goes through to test the host
+)
+
+// The error returned for calls to a host whose circuit is open
+var errCircuitOpen = errors.New("circuit open: the host has been failing, not calling it for now")
+
+// An outboundClient makes outbound HTTP calls with timeouts, retries and circuit breaking
+type outboundClient struct {
+	client     *http.Client
+	timeout    time.Duration
+	maxRetries int
+	mutex      sync.Mutex
+	breakers   map[string]*circuitBreaker
+}
+
+// The circuit breaker for a single host
+type circuitBreaker struct {
+	state     int
+	failures  int       // Consecutive failures while closed
+	openUntil time.Time // When an open circuit lets a trial call through
+	trial     bool      // Whether a trial call is in flight while half open
+	tripped   bool      // Whether an admin opened the circuit, which stays open until reset
+}
+
+// The client all of our outbound calls share
+var outbound = newOutboundClient(OUTBOUND_TIMEOUT, OUTBOUND_MAX_RETRIES)
+
+// Create a new client with the given timeout per attempt and number of retries
+func newOutboundClient(timeout time.Duration, maxRetries int) *outboundClient {
+	return &outboundClient{
+		client:     &http.Client{},
+		timeout:    timeout,
+		maxRetries: maxRetries,
+		breakers:   make(map[string]*circuitBreaker),
+	}
+}
+
+// Make the given request, retrying it when it fails (and it's safe to do so). The request's
+// context should be the context of the request we're serving (if any) so that the call is
+// cancelled along with it. As with http.Client, the caller must close the response body.
+func (outbound *outboundClient) Do(request *http.Request) (*http.Response, error) {
+
+	host := request.URL.Host
+	ctx := request.Context()
+
+	endSpan := startSpan(ctx, "outbound: "+request.Method+" "+host)
+	defer endSpan()
+
+	if requestID, ok := ctx.Value(REQUEST_ID_KEY).(string); ok && request.Header.Get("X-Request-Id") == "" {
+		request.Header.Set("X-Request-Id", requestID)
+	}
+
+	for attempt := 0; ; attempt++ {
+
+		if !outbound.allow(host) {
+			incrementCounter("outbound_requests_total", "host", host, "outcome", "circuit_open")
+			logOutboundCall(request, attempt, nil, errCircuitOpen, 0)
+			return nil, errCircuitOpen
+		}
+
+		started := time.Now()
+		response, err := outbound.attempt(request)
+		addCounter("outbound_request_seconds_total", time.Since(started).Seconds(), "host", host)
+		logOutboundCall(request, attempt, response, err, time.Since(started))
+
+		failed := err != nil || response.StatusCode >= 500
+		outbound.record(host, !failed)
+
+		if err != nil {
+			incrementCounter("outbound_requests_total", "host", host, "outcome", "error")
+		} else {
+			incrementCounter("outbound_requests_total", "host", host, "outcome", statusClass(response.StatusCode))
+		}
+
+		if attempt >= outbound.maxRetries || !shouldRetry(request, response, err) {
+			return response, err
+		}
+
+		delay := retryDelay(attempt, response)
+
+		// Let the connection be reused for our retry
+		if response != nil {
+			io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+			response.Body.Close()
+		}
+
+		// Our next attempt needs a fresh copy of the request body
+		if request.Body != nil && request.Body != http.NoBody {
+			body, err := request.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			request.Body = body
+		}
+
+		incrementCounter("outbound_retries_total", "host", host)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+	}
+
+}
+
+// Log a (zero based) attempt at the given outbound request, counting it in outbound_errors_total
+// if it failed
+func logOutboundCall(request *http.Request, attempt int, response *http.Response, err error, elapsed time.Duration) {
+
+	requestID, ok := request.Context().Value(REQUEST_ID_KEY).(string)
+	// Calls made in the background (i.e. while refreshing secrets) aren't for any request
+	if !ok {
+		requestID = "UNKNOWN"
+	}
+
+	var reason, result string
+
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		reason, result = "circuit_open", "circuit open"
+	case err != nil:
+		reason = "network"
+		var netErr interface{ Timeout() bool }
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			reason = "timeout"
+		}
+		// The URL in a *url.Error may carry secrets (i.e. an API key in its query), so we log
+		// only what went wrong, as we log the URL ourselves
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		result = reason + " error: " + err.Error()
+	default:
+		result = strconv.Itoa(response.StatusCode)
+		if response.StatusCode >= 500 {
+			reason = "5xx"
+		}
+	}
+
+	if reason != "" {
+		incrementCounter("outbound_errors_total", "host", request.URL.Host, "reason", reason)
+	}
+
+	line := fmt.Sprint(requestID, " OUTBOUND ", request.Method, " ", loggedOutboundURL(request.URL), " ", result,
+		" ", elapsed.Round(time.Millisecond), " attempt ", attempt+1)
+	if reason != "" {
+		line = "WARN " + line
+	}
+	logger.Println(line)
+
+}
+
+// Returns the given URL as we log it: its scheme, host and first path segment
+func loggedOutboundURL(target *url.URL) string {
+	path := strings.TrimPrefix(target.EscapedPath(), "/")
+	if segment, _, more := strings.Cut(path, "/"); more {
+		path = segment + "/..."
+	}
+	return target.Scheme + "://" + target.Host + "/" + path
+}
+
+// Make a single attempt at the given request, with our per attempt timeout. The timeout
+// covers reading the response body too, so it's only cancelled once the body is closed.
+func (outbound *outboundClient) attempt(request *http.Request) (*http.Response, error) {
+
+	ctx, cancel := context.WithTimeout(request.Context(), outbound.timeout)
+
+	response, err := outbound.client.Do(request.WithContext(ctx))
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	response.Body = &cancelOnClose{ReadCloser: response.Body, cancel: cancel}
+
+	return response, nil
+
+}
+
+// A response body which cancels the context of its request when it's closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnClose) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+// Returns whether a failed attempt at the given request should be retried
+func shouldRetry(request *http.Request, response *http.Response, err error) bool {
+
+	// There's no point retrying once our caller has given up
+	if request.Context().Err() != nil {
+		return false
+	}
+
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	default:
+		if request.Header.Get("Idempotency-Key") == "" {
+			return false
+		}
+	}
+
+	// We can only send a body again if we're able to get a fresh copy of it
+	if request.Body != nil && request.Body != http.NoBody && request.GetBody == nil {
+		return false
+	}
+
+	if err != nil {
+		return true
+	}
+
+	switch response.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+
+}
+
+// Returns how long to wait before the retry following the given (zero based) attempt. We back
+// off exponentially with some jitter, unless the host tells us how long to wait.
+func retryDelay(attempt int, response *http.Response) time.Duration {
+
+	if response != nil {
+		if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			return min(time.Duration(seconds)*time.Second, OUTBOUND_MAX_RETRY_BACKOFF)
+		}
+	}
+
+	backoff := min(OUTBOUND_RETRY_BACKOFF<<attempt, OUTBOUND_MAX_RETRY_BACKOFF)
+
+	return backoff/2 + rand.N(backoff/2+1)
+
+}
+
+// Returns whether a call to the given host may go ahead according to its circuit breaker
+func (outbound *outboundClient) allow(host string) bool {
+
+	outbound.mutex.Lock()
+	defer outbound.mutex.Unlock()
+
+	breaker := outbound.breakers[host]
+
+	if breaker == nil {
+		return true
+	}
+
+	switch breaker.state {
+	case CIRCUIT_OPEN:
+		if breaker.tripped || time.Now().Before(breaker.openUntil) {
+			return false
+		}
+		outbound.setState(host, breaker, CIRCUIT_HALF_OPEN)
+		breaker.trial = true
+		return true
+
+	case CIRCUIT_HALF_OPEN:
+		// Only a single trial call goes through until we know how it went
+		if breaker.trial {
+			return false
+		}
+		breaker.trial = true
+		return true
+	}
+
+	return true
+
+}
+
+// Record the outcome of a call to the given host with its circuit breaker
+func (outbound *outboundClient) record(host string, succeeded bool) {
+
+	outbound.mutex.Lock()
+	defer outbound.mutex.Unlock()
+
+	breaker := outbound.breakers[host]
+
+	if breaker == nil {
+		if succeeded {
+			return
+		}
+		breaker = &circuitBreaker{}
+		outbound.breakers[host] = breaker
+	}
+
+	breaker.trial = false
+
+	// A call which was in flight when an admin tripped the circuit doesn't close it again
+	if breaker.tripped {
+		return
+	}
+
+	switch {
+	case succeeded:
+		breaker.failures = 0
+		outbound.setState(host, breaker, CIRCUIT_CLOSED)
+
+	case breaker.state == CIRCUIT_HALF_OPEN:
+		// Our trial call failed, so we wait again before the next one
+		breaker.openUntil = time.Now().Add(CIRCUIT_OPEN_DURATION)
+		outbound.setState(host, breaker, CIRCUIT_OPEN)
+
+	default:
+		breaker.failures++
+		if breaker.failures >= CIRCUIT_FAILURE_THRESHOLD {
+			breaker.failures = 0
+			breaker.openUntil = time.Now().Add(CIRCUIT_OPEN_DURATION)
+			outbound.setState(host, breaker, CIRCUIT_OPEN)
+		}
+	}
+
+}
+
+// Move the given circuit breaker into a new state. Our mutex must be held.
+func (outbound *outboundClient) setState(host string, breaker *circuitBreaker, state int) {
+
+	if breaker.state == state {
+		return
+	}
+
+	logger.Printf("AUDIT circuit for %s changed from %s to %s", host, circuitStateName(breaker.state), circuitStateName(state))
+
+	breaker.state = state
+	setGauge("outbound_circuit_state", float64(state), "host", host)
+
+	if state == CIRCUIT_OPEN {
+		incrementCounter("outbound_circuit_opened_total", "host", host)
+	}
+
+}
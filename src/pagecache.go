@@ -0,0 +1,218 @@
+// Our page cache. Pages registered with Cached set (our home page, the SVG surface and the sphere,
+// which our warm-up renders before /readyz reports us ready, see warmup.go) are kept here once
+// they're rendered, and served from here from then on, with an X-Cache header of HIT or MISS.
+//
+// Our pages aren't quite the same for every visitor, so a cached page is kept for each of the
+// things which can change it: whether the visitor is a crawler (who may be shown a bot
+// snapshot), whether they're shown our cookie consent banner and their experiment buckets.
+// Without -site-url our pages' absolute URLs (i.e. in their social cards) come from the Host
+// header, so a page which renders the host it was requested from is kept for each host (and
+// scheme) too. Pages which don't are kept once for every host, as they are whenever -site-url is
+// set. Everything else which goes into a cacheable page must stay the same between requests.
+//
+// We only cache successful GET and HEAD requests without a query string (i.e. /svg, but not
+// /svg?palette=...), and never pages which set a cookie or requests with flashes to show. We
+// keep the MAX_PAGE_CACHE_ENTRIES most recently used pages, so pages cached for hosts nobody
+// else uses are soon evicted. Our cache is cleared whenever a feature is switched on or off at
+// runtime (see features.go), since our pages link to the enabled features in the navigation bar.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// How many rendered pages we keep. Pages which render their host are kept for each host, which is
+// up to the client, so once we're full we evict our least recently used pages.
+const MAX_PAGE_CACHE_ENTRIES = 256
+
+// A rendered page, as it was written by its handler. Pages which render their host are kept under
+// their key (see pageCacheKey) as a page with perHost set, which says to look for the page under
+// its key for the request's host instead (see pageHostCacheKey).
+type cachedPage struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	perHost bool
+}
+
+// Our cached pages, most recently used first, along with their elements by cache key
+var pageCache = struct {
+	mutex sync.Mutex
+	order *list.List
+	pages map[string]*list.Element
+}{order: list.New(), pages: map[string]*list.Element{}}
+
+// Returns a handler serving the given page from our page cache, if it's cacheable
+func pageCacheHandler(page Page, next http.HandlerFunc) http.HandlerFunc {
+
+	if !page.Cached {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if !pageCacheable(r) {
+			next(w, r)
+			return
+		}
+
+		key := pageCacheKey(r)
+
+		cached, found := cachedPageFor(key)
+		if found && cached.perHost {
+			cached, found = cachedPageFor(pageHostCacheKey(key, r))
+		}
+
+		if found {
+			incrementCounter("page_cache_hits_total", "page", page.Path)
+			w.Header().Set("X-Cache", "HIT")
+			cached.write(w)
+			return
+		}
+
+		incrementCounter("page_cache_misses_total", "page", page.Path)
+
+		// We render the page into memory first, so that we can keep it (rendering our pages
+		// does the same, see executeMainTemplate)
+		recorder := httptest.NewRecorder()
+		next(recorder, r)
+
+		rendered := cachedPage{key: key, status: recorder.Code, header: recorder.Header().Clone(), body: recorder.Body.Bytes()}
+		if rendered.status == http.StatusOK && len(rendered.header.Values("Set-Cookie")) == 0 {
+			if pageRendersHost(rendered.body, r) {
+				addCachedPage(cachedPage{key: key, perHost: true})
+				rendered.key = pageHostCacheKey(key, r)
+			}
+			addCachedPage(rendered)
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		rendered.write(w)
+
+	}
+
+}
+
+// Returns whether the given request can be served from (and stored in) our page cache
+func pageCacheable(r *http.Request) bool {
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead || r.URL.RawQuery != "" {
+		return false
+	}
+
+	// Rendering the page would show (and clear) the visitor's flashes
+	_, err := r.Cookie(FLASH_COOKIE_NAME)
+
+	return err != nil
+
+}
+
+// Returns the key a request's page is cached under: everything besides the page itself and its
+// host which changes how it's rendered
+func pageCacheKey(r *http.Request) string {
+
+	parts := []string{
+		r.URL.Path,
+		strconv.FormatBool(requestUserAgent(r).Crawler()),
+		strconv.FormatBool(showConsentBanner(r)),
+	}
+
+	buckets := experimentBuckets(r.Context())
+	for _, name := range slices.Sorted(maps.Keys(buckets)) {
+		parts = append(parts, name+"="+buckets[name])
+	}
+
+	return strings.Join(parts, "\n")
+
+}
+
+// Returns the key a request's page is cached under when the page renders its host
+func pageHostCacheKey(key string, r *http.Request) string {
+	return key + "\n" + siteBaseURL(r)
+}
+
+// Returns whether the given rendered page shows the host it was requested from (as it is, or
+// escaped in a URL's query string). With -site-url our pages never do, since their absolute URLs
+// use it instead.
+func pageRendersHost(body []byte, r *http.Request) bool {
+	return siteURL == "" && r.Host != "" &&
+		(bytes.Contains(body, []byte(r.Host)) || bytes.Contains(body, []byte(url.QueryEscape(r.Host))))
+}
+
+// Returns the page cached under the given key (and whether there is one), marking it as
+// recently used
+func cachedPageFor(key string) (cachedPage, bool) {
+
+	pageCache.mutex.Lock()
+	defer pageCache.mutex.Unlock()
+
+	element, ok := pageCache.pages[key]
+	if !ok {
+		return cachedPage{}, false
+	}
+
+	pageCache.order.MoveToFront(element)
+	return element.Value.(cachedPage), true
+
+}
+
+// Keep a rendered page, evicting our least recently used pages if we're full
+func addCachedPage(page cachedPage) {
+
+	pageCache.mutex.Lock()
+	defer pageCache.mutex.Unlock()
+
+	if element, ok := pageCache.pages[page.key]; ok {
+		element.Value = page
+		pageCache.order.MoveToFront(element)
+	} else {
+		pageCache.pages[page.key] = pageCache.order.PushFront(page)
+	}
+
+	for pageCache.order.Len() > MAX_PAGE_CACHE_ENTRIES {
+		oldest := pageCache.order.Back()
+		pageCache.order.Remove(oldest)
+		delete(pageCache.pages, oldest.Value.(cachedPage).key)
+		incrementCounter("page_cache_evictions_total")
+	}
+
+	setGauge("page_cache_entries", float64(len(pageCache.pages)))
+
+}
+
+// Drop all of our cached pages, so that they're rendered again
+func clearPageCache() {
+
+	pageCache.mutex.Lock()
+	defer pageCache.mutex.Unlock()
+
+	pageCache.order.Init()
+	clear(pageCache.pages)
+	setGauge("page_cache_entries", 0)
+
+}
+
+// Write a rendered page to the given response
+func (page cachedPage) write(w http.ResponseWriter) {
+
+	for name, values := range page.header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+
+	w.WriteHeader(page.status)
+	w.Write(page.body)
+
+}
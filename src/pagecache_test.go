@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPageCacheServesRenderedPages(t *testing.T) {
+
+	defer clearPageCache()
+
+	renders := 0
+	handler := pageCacheHandler(Page{Path: "/cached", Cached: true}, func(w http.ResponseWriter, r *http.Request) {
+		renders++
+		w.Write([]byte("page"))
+	})
+
+	request := func(target string, cookies ...*http.Cookie) string {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Body.String() != "page" {
+			t.Fatalf("got %q for %s, want our page", w.Body, target)
+		}
+		return w.Header().Get("X-Cache")
+	}
+
+	tests := []struct {
+		name    string
+		target  string
+		cookies []*http.Cookie
+		want    string // Our X-Cache header ("" when the cache isn't used)
+		renders int    // How many times the page has been rendered once we've requested it
+	}{
+		{"the first request renders the page", "/cached", nil, "MISS", 1},
+		{"the next is served from our cache", "/cached", nil, "HIT", 1},
+		{"requests with a query string are rendered", "/cached?palette=red", nil, "", 2},
+		{"requests with flashes to show are rendered", "/cached", []*http.Cookie{{Name: FLASH_COOKIE_NAME, Value: "x"}}, "", 3},
+		{"pages which don't render their host are shared by every host", "http://other.example/cached", nil, "HIT", 3},
+	}
+
+	for _, test := range tests {
+		if got := request(test.target, test.cookies...); got != test.want || renders != test.renders {
+			t.Errorf("%s: got X-Cache %q after %d renders, want %q after %d", test.name, got, renders, test.want, test.renders)
+		}
+	}
+
+	// Our navigation bar changes when features are switched on or off
+	enabled := routeEnabled("/svg")
+	t.Cleanup(func() { setFeatures(map[string]bool{"svg": enabled}) })
+	if err := setFeatures(map[string]bool{"svg": true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := request("/cached"); got != "MISS" {
+		t.Errorf("got X-Cache %q once our features changed, want MISS", got)
+	}
+
+	// Pages which set cookies are never cached
+	clearPageCache()
+	handler = pageCacheHandler(Page{Path: "/cached", Cached: true}, func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "test", Value: "test"})
+		w.Write([]byte("page"))
+	})
+	request("/cached")
+	if got := request("/cached"); got != "MISS" {
+		t.Errorf("got X-Cache %q for a page setting a cookie, want MISS", got)
+	}
+
+}
+
+func TestPageCacheKeepsPagesRenderingTheirHostPerHost(t *testing.T) {
+
+	defer func(url string) { siteURL = url }(siteURL)
+	defer clearPageCache()
+
+	handler := pageCacheHandler(Page{Path: "/cached", Cached: true}, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<a href=\"%s/cached\">", siteBaseURL(r))
+	})
+
+	request := func(host string) (string, string) {
+		r := httptest.NewRequest(http.MethodGet, "/cached", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Header().Get("X-Cache"), w.Body.String()
+	}
+
+	siteURL = ""
+	tests := []struct {
+		host  string
+		cache string
+		body  string
+	}{
+		{"example.com", "MISS", `<a href="http://example.com/cached">`},
+		{"example.com", "HIT", `<a href="http://example.com/cached">`},
+		{"other.example", "MISS", `<a href="http://other.example/cached">`},
+		{"example.com", "HIT", `<a href="http://example.com/cached">`},
+	}
+	for _, test := range tests {
+		if cache, body := request(test.host); cache != test.cache || body != test.body {
+			t.Errorf("%s: got X-Cache %q and %q, want %q and %q", test.host, cache, body, test.cache, test.body)
+		}
+	}
+
+	// With -site-url, our pages are the same whichever host they're requested from
+	clearPageCache()
+	siteURL = "https://example.com"
+	request("example.com")
+	if cache, _ := request("junk.example"); cache != "HIT" {
+		t.Errorf("got X-Cache %q for another host with -site-url, want HIT", cache)
+	}
+
+}
+
+func TestPageCacheEvictsLeastRecentlyUsedPages(t *testing.T) {
+
+	defer func(url string) { siteURL = url }(siteURL)
+	defer clearPageCache()
+
+	siteURL = ""
+	handler := pageCacheHandler(Page{Path: "/cached", Cached: true}, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	})
+
+	request := func(host string) string {
+		r := httptest.NewRequest(http.MethodGet, "/cached", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Header().Get("X-Cache")
+	}
+
+	request("example.com")
+
+	// Clients sending junk hosts can't fill our cache for good
+	for i := range MAX_PAGE_CACHE_ENTRIES {
+		request(fmt.Sprintf("junk-%d.example", i))
+	}
+	if cache := request("example.com"); cache != "MISS" {
+		t.Errorf("got X-Cache %q for a page pushed out of our cache, want MISS", cache)
+	}
+	if cache := request("example.com"); cache != "HIT" {
+		t.Errorf("got X-Cache %q once our cache was full, want HIT", cache)
+	}
+
+	pageCache.mutex.Lock()
+	entries := len(pageCache.pages)
+	pageCache.mutex.Unlock()
+	if entries > MAX_PAGE_CACHE_ENTRIES {
+		t.Errorf("got %d cached pages, want at most %d", entries, MAX_PAGE_CACHE_ENTRIES)
+	}
+
+}
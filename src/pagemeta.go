@@ -0,0 +1,218 @@
+// Page metadata: sections, breadcrumbs and last modified dates. Each page in our registry (see
+// pages.go) belongs to a section (i.e. Utilities), which our home page lists its pages under, and
+// has a last modified date (the date the server was built, unless the page gives its own). When a
+// page is rendered, our main template shows where it sits in the site as breadcrumbs along with
+// when it last changed:
+//
+//	Home › Utilities › Password · Updated 2026-10-16
+//
+// and describes the same to search engines as JSON-LD (a schema.org WebPage with a
+// BreadcrumbList), which they can show in place of the page's URL in their results. Pages which
+// aren't in our registry (i.e. the history of a spreadsheet) can name the registered page they
+// belong under as their Parent, while pages with neither (i.e. error pages) have no breadcrumbs.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Our sections, in the order our home page lists them
+const (
+	SECTION_DEMOS     = "Demos"
+	SECTION_UTILITIES = "Utilities"
+	SECTION_SITE      = "Site"
+)
+
+var pageSectionNames = []string{SECTION_DEMOS, SECTION_UTILITIES, SECTION_SITE}
+
+// The date our server was built (i.e. 2026-10-16), which pages without a last modified date of
+// their own default to. It's the time of the commit we were built from, which Go records when
+// building from a repository, and is empty otherwise.
+var buildDate = func() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.time" {
+				if built, err := time.Parse(time.RFC3339, setting.Value); err == nil {
+					return built.UTC().Format(time.DateOnly)
+				}
+			}
+		}
+	}
+	return ""
+}()
+
+// Returns the given page's last modified date (i.e. 2026-10-16), if we know it
+func (page Page) Modified() string {
+	if page.LastModified != "" {
+		return page.LastModified
+	}
+	return buildDate
+}
+
+// Check the metadata of a page as it's registered. Pages are registered at startup, so a bad date
+// or section is a mistake in our code.
+func checkPageMetadata(page Page) {
+	if page.LastModified != "" {
+		if _, err := time.Parse(time.DateOnly, page.LastModified); err != nil {
+			panic(fmt.Errorf("page %s: LastModified must be a date (i.e. 2026-10-16): %w", page.Path, err))
+		}
+	}
+	if page.Section != "" && !slices.Contains(pageSectionNames, page.Section) {
+		panic(fmt.Errorf("page %s: unknown section %q", page.Path, page.Section))
+	}
+}
+
+// A step on the way to a page
+type Breadcrumb struct {
+	Name string
+	Path string // The route of the step (i.e. /tools), without our base path
+}
+
+// Where a page sits within our site, as shown by our main template
+type PageMetadata struct {
+	// The route of the registered page a page which isn't registered belongs under (i.e. /excel
+	// for a spreadsheet's history)
+	Parent string
+
+	// Filled in by withPageMetadata
+	Breadcrumbs  []Breadcrumb
+	LastModified string
+	LinkedData   map[string]interface{} // Our JSON-LD description of the page
+}
+
+// Returns the page in our registry served from the given route, if there is one
+func registeredPage(path string) (Page, bool) {
+	for _, page := range pageRegistry {
+		if page.Path == path {
+			return page, true
+		}
+	}
+	return Page{}, false
+}
+
+// Returns the route of the anchor on our home page which lists the pages of the given section
+func sectionPath(section string) string {
+	return "/#section-" + strings.ToLower(section)
+}
+
+// Returns the given page data with its metadata filled in for the given request
+func withPageMetadata(r *http.Request, htmlData HtmlData) HtmlData {
+
+	metadata := &htmlData.Metadata
+
+	page, found := registeredPage(r.URL.Path)
+	if !found && metadata.Parent != "" {
+		page, found = registeredPage(metadata.Parent)
+	}
+	if !found {
+		return htmlData
+	}
+
+	// Home › Section › Page (› the page within it)
+	crumbs := []Breadcrumb{{Name: "Home", Path: "/"}}
+	if page.Section != "" {
+		crumbs = append(crumbs, Breadcrumb{Name: page.Section, Path: sectionPath(page.Section)})
+	}
+	if page.Path != "/" {
+		crumbs = append(crumbs, Breadcrumb{Name: page.Title, Path: page.Path})
+	}
+	if page.Path != r.URL.Path {
+		crumbs = append(crumbs, Breadcrumb{Name: strings.TrimPrefix(htmlData.Title, "Golang "), Path: r.URL.Path})
+	}
+
+	metadata.Breadcrumbs = crumbs
+	metadata.LastModified = page.Modified()
+	metadata.LinkedData = pageLinkedData(siteBaseURL(r), htmlData, crumbs)
+
+	return htmlData
+
+}
+
+// Returns our JSON-LD description of the page with the given data and breadcrumbs
+func pageLinkedData(baseURL string, htmlData HtmlData, crumbs []Breadcrumb) map[string]interface{} {
+
+	items := make([]map[string]interface{}, len(crumbs))
+	for i, crumb := range crumbs {
+		items[i] = map[string]interface{}{
+			"@type":    "ListItem",
+			"position": i + 1,
+			"name":     crumb.Name,
+			"item":     baseURL + urlFor(crumb.Path),
+		}
+	}
+
+	last := crumbs[len(crumbs)-1]
+
+	page := map[string]interface{}{
+		"@context":    "https://schema.org",
+		"@type":       "WebPage",
+		"name":        htmlData.Title,
+		"description": htmlData.Description,
+		"url":         baseURL + urlFor(last.Path),
+		"isPartOf":    map[string]interface{}{"@type": "WebSite", "name": SOCIAL_SITE_NAME, "url": baseURL + urlFor("/")},
+		"breadcrumb":  map[string]interface{}{"@type": "BreadcrumbList", "itemListElement": items},
+	}
+
+	if htmlData.Metadata.LastModified != "" {
+		page["dateModified"] = htmlData.Metadata.LastModified
+	}
+
+	return page
+
+}
+
+// A section of our site along with its (enabled) pages, as listed on our home page
+type pageSection struct {
+	Name   string
+	Anchor string
+	Pages  []Page
+}
+
+// Returns our sections along with the pages in each (sections without pages are left out)
+func pageSections() []pageSection {
+
+	var sections []pageSection
+
+	for _, name := range pageSectionNames {
+		section := pageSection{Name: name, Anchor: strings.TrimPrefix(sectionPath(name), "/#")}
+		for _, page := range navPages() {
+			if page.Section == name {
+				section.Pages = append(section.Pages, page)
+			}
+		}
+		if len(section.Pages) > 0 {
+			sections = append(sections, section)
+		}
+	}
+
+	return sections
+
+}
+
+// This is our page metadata partial, which is rendered as part of our main HTML template: the
+// "linked-data" template within our <head> and the "breadcrumbs" template at the end of our
+// <body>. You can find the raw file in the templates folder (pagemeta.tmpl).
+const PAGE_METADATA_HTML_TEMPLATE = `
+{{ define "linked-data" }}
+	{{ with .Metadata.LinkedData }}
+	<script type="application/ld+json">{{ . }}</script>
+	{{ end }}
+{{ end }}
+
+{{ define "breadcrumbs" }}
+	{{ if .Metadata.Breadcrumbs }}
+	<footer class="page-footer">
+		<nav class="breadcrumbs" aria-label="Breadcrumbs">
+			{{ range $index, $crumb := .Metadata.Breadcrumbs }}{{ if $index }} &rsaquo; {{ end }}<a href="{{ url $crumb.Path }}">{{ $crumb.Name }}</a>{{ end }}
+		</nav>
+		{{ with .Metadata.LastModified }} &middot; <time datetime="{{ . }}">Updated {{ . }}</time>{{ end }}
+	</footer>
+	{{ end }}
+{{ end }}
+`
@@ -0,0 +1,81 @@
+// Page registry used for both route registration and for rendering our navigation bar, so
+// that new demo applications automatically show up in the navbar once they're registered.
+
+package main
+
+import (
+	"net/http"
+	"sort"
+)
+
+// A Page describes a single demo application / page served by our web server.
+type Page struct {
+	Title   string           // The title displayed in the navigation bar
+	Path    string           // The route the page is served from (i.e. /excel)
+	Order   int              // Pages are displayed in ascending order within the navbar
+	Visible bool             // Whether or not the page is displayed in the navbar
+	Handler http.HandlerFunc // The handler used to serve the page
+	Methods []string         // The methods the page accepts (defaults to GET)
+
+	// A description of the page served to search engine and link preview bots instead of the
+	// page itself, for pages which are little more than a JavaScript demo (see useragents.go)
+	BotSnapshot string
+
+	// Whether the page is kept in our page cache once it's rendered, for pages which are the
+	// same on every request (see pagecache.go)
+	Cached bool
+
+	// The section of our site the page belongs to (i.e. Utilities), and the date it last changed
+	// (i.e. 2026-10-16, defaulting to the date the server was built), see pagemeta.go
+	Section      string
+	LastModified string
+}
+
+// This is our page registry. Pages are added to it via registerPage and it should be
+// treated as read-only once the server starts handling requests.
+var pageRegistry []Page
+
+// Register our main demo applications. New demo pages only need to be added here (or via
+// their own call to registerPage) in order to be routed to and displayed in the navbar.
+func init() {
+	registerPage(Page{Title: "Home", Path: "/", Order: 0, Visible: true, Handler: indexHandler, Cached: true})
+	registerPage(Page{Title: "Excel App", Path: "/excel", Order: 10, Visible: true, Section: SECTION_DEMOS, Handler: excelHandler,
+		BotSnapshot: "A spreadsheet editor in the browser, whose sheets can be exported to Excel, PDF and CSV."})
+	registerPage(Page{Title: "QR Code Generator", Path: "/qr-code-generator", Order: 20, Visible: true, Section: SECTION_DEMOS, Handler: qrCodeHandler})
+	registerPage(Page{Title: "SVG Example", Path: "/svg", Order: 30, Visible: true, Section: SECTION_DEMOS, Handler: svgHandler, Cached: true})
+	registerPage(Page{Title: "Sphere", Path: "/sphere", Order: 40, Visible: true, Section: SECTION_DEMOS, Handler: sphereHandler,
+		BotSnapshot: "A rotating sphere drawn in the browser with THREE.js.", Cached: true})
+}
+
+// Add a new page to our registry, keeping the registry sorted by display order
+func registerPage(page Page) {
+	checkPageMetadata(page)
+	pageRegistry = append(pageRegistry, page)
+
+	// We use a stable sort so that pages sharing the same order are displayed in the
+	// order in which they were registered
+	sort.SliceStable(pageRegistry, func(i, j int) bool {
+		return pageRegistry[i].Order < pageRegistry[j].Order
+	})
+}
+
+// Returns the router pattern for the given page path. The root path is matched exactly (rather
+// than matching every request) so that unknown paths fall through to our not found handler.
+func routePattern(path string) string {
+	if path == "/" {
+		return "/{$}"
+	}
+	return path
+}
+
+// Returns the pages which should be displayed within our navigation bar (pages whose feature
+// is disabled are left out, see features.go)
+func navPages() []Page {
+	var visiblePages []Page
+	for _, page := range pageRegistry {
+		if page.Visible && pageEnabled(page) {
+			visiblePages = append(visiblePages, page)
+		}
+	}
+	return visiblePages
+}
@@ -0,0 +1,426 @@
+// Our password generator and strength checker. /password generates passwords and diceware
+// passphrases on the server with crypto/rand, and estimates how guessable a password is (see
+// strength.go). Scripts can use GET /api/v1/password/generate and POST
+// /api/v1/password/strength.
+//
+// Passphrases are made of words from the EFF's long wordlist (7776 words, so each word adds
+// about 12.9 bits of entropy), which is embedded from the wordlists sub-directory and also
+// serves as the dictionary of our strength estimates.
+//
+// Passwords are secrets, so they never appear in URLs, logs or traces: generated passwords are
+// only sent in responses (which browsers and proxies are told not to store), passwords to check
+// are sent in request bodies, and these requests are never captured (see capture.go).
+
+package main
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	PASSWORD_LENGTH         = 20
+	MIN_PASSWORD_LENGTH     = 8
+	MAX_PASSWORD_LENGTH     = 128
+	PASSPHRASE_WORDS        = 6
+	MIN_PASSPHRASE_WORDS    = 3
+	MAX_PASSPHRASE_WORDS    = 20
+	MAX_GENERATED_PASSWORDS = 20
+	MAX_SEPARATOR_LENGTH    = 5
+	MAX_STRENGTH_REQUEST    = 16 << 10 // The largest strength check request we'll read
+	AMBIGUOUS_CHARACTERS    = "Il1|O0o`'\""
+)
+
+// A set of characters passwords can be made from
+type passwordCharset struct {
+	Name       string
+	Title      string
+	Characters string
+}
+
+// Our character sets, all of which are used by default
+var passwordCharsets = []passwordCharset{
+	{Name: "lower", Title: "Lowercase letters", Characters: "abcdefghijklmnopqrstuvwxyz"},
+	{Name: "upper", Title: "Uppercase letters", Characters: "ABCDEFGHIJKLMNOPQRSTUVWXYZ"},
+	{Name: "digits", Title: "Digits", Characters: "0123456789"},
+	{Name: "symbols", Title: "Symbols", Characters: "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"},
+}
+
+// The EFF's long wordlist, with lines of five dice rolls and a word. See
+// https://www.eff.org/deeplinks/2016/07/new-wordlists-random-passphrases.
+//
+//go:embed wordlists/eff_large_wordlist.txt
+var effWordlist string
+
+// The words of our passphrases
+var passphraseWords []string
+
+// How to generate passwords
+type passwordOptions struct {
+	Kind             string // password or passphrase
+	Length           int
+	Charsets         map[string]bool
+	ExcludeAmbiguous bool
+	Words            int
+	Separator        string
+	Capitalise       bool
+	Count            int
+}
+
+// The data we pass into our password body template
+type passwordPageData struct {
+	Options     passwordOptions
+	Charsets    []passwordCharset
+	Passwords   []string
+	EntropyBits int
+	Estimate    *strengthEstimate
+}
+
+// The body content of our password page. The values are escaped by html/template.
+const PASSWORD_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>Password Generator</h2>
+		<form action="{{ url "/password" }}" method="GET">
+			<input type="hidden" name="generate" value="1">
+			<p>
+				<label><input type="radio" name="kind" value="password"{{ if eq .Options.Kind "password" }} checked{{ end }}> Password</label>
+				of <input type="number" name="length" min=8 max=128 value="{{ .Options.Length }}"> characters from
+				{{ range .Charsets }}
+				<label><input type="checkbox" name="charset" value="{{ .Name }}"{{ if index $.Options.Charsets .Name }} checked{{ end }}> {{ .Title }}</label>
+				{{ end }}
+				<label><input type="checkbox" name="exclude_ambiguous" value="true"{{ if .Options.ExcludeAmbiguous }} checked{{ end }}> Without look-alikes (like l, 1 and I)</label>
+			</p>
+			<p>
+				<label><input type="radio" name="kind" value="passphrase"{{ if eq .Options.Kind "passphrase" }} checked{{ end }}> Passphrase</label>
+				of <input type="number" name="words" min=3 max=20 value="{{ .Options.Words }}"> words separated by
+				<input size=3 maxLength=5 name="separator" value="{{ .Options.Separator }}">
+				<label><input type="checkbox" name="capitalise" value="true"{{ if .Options.Capitalise }} checked{{ end }}> Capitalised</label>
+			</p>
+			<p>
+				<input type="number" name="count" min=1 max=20 value="{{ .Options.Count }}">
+				<input type="submit" value="Generate">
+			</p>
+		</form>
+		{{ if .Passwords }}
+		<pre>{{ range .Passwords }}{{ . }}
+{{ end }}</pre>
+		<p><small>About {{ .EntropyBits }} bits of entropy each</small></p>
+		{{ end }}
+		<h2>Strength Checker</h2>
+		<form action="{{ url "/password" }}" method="POST">
+			<input type="password" name="password" size=40 maxLength=1024 autocomplete="off" placeholder="Password to check">
+			<input type="submit" value="Check">
+		</form>
+		{{ with .Estimate }}
+		<h4>Score: {{ .Score }} / 4</h4>
+		<meter min=0 max=4 low=2 high=3 optimum=4 value="{{ .Score }}"></meter>
+		<p>It would take about 10<sup>{{ printf "%.1f" .GuessesLog10 }}</sup> guesses to find.</p>
+		{{ with .Feedback.Warning }}<p><strong>{{ . }}</strong></p>{{ end }}
+		{{ range .Feedback.Suggestions }}<p>{{ . }}</p>{{ end }}
+		<table style="margin: auto; text-align: left;">
+			<tr><th>Online, with throttling</th><td>{{ index .CrackTimes "online_throttling" }}</td></tr>
+			<tr><th>Online, without throttling</th><td>{{ index .CrackTimes "online_no_throttling" }}</td></tr>
+			<tr><th>Offline, slow hashing</th><td>{{ index .CrackTimes "offline_slow_hashing" }}</td></tr>
+			<tr><th>Offline, fast hashing</th><td>{{ index .CrackTimes "offline_fast_hashing" }}</td></tr>
+		</table>
+		<p><small>Patterns found: {{ range $index, $match := .Sequence }}{{ if $index }}, {{ end }}{{ $match.Pattern }}{{ with $match.Dictionary }} ({{ . }}){{ end }}{{ end }}</small></p>
+		{{ end }}
+	</div>
+`
+
+func init() {
+
+	for _, line := range strings.Split(strings.TrimSpace(effWordlist), "\n") {
+		if _, word, found := strings.Cut(line, "\t"); found {
+			passphraseWords = append(passphraseWords, word)
+			englishWords[word] = len(passphraseWords)
+		}
+	}
+
+	registerPage(Page{Title: "Password", Path: "/password", Order: 79, Visible: true, Section: SECTION_UTILITIES, Handler: passwordHandler,
+		Methods: []string{http.MethodGet, http.MethodPost}})
+
+}
+
+// Returns true if the given path is one of our password pages or endpoints, whose requests
+// hold passwords
+func isPasswordPath(path string) bool {
+	return path == urlFor("/password") || strings.HasPrefix(path, urlFor("/api/v1/password/"))
+}
+
+// Returns the default options for generating passwords
+func defaultPasswordOptions() passwordOptions {
+	options := passwordOptions{Kind: "password", Length: PASSWORD_LENGTH, Charsets: map[string]bool{},
+		Words: PASSPHRASE_WORDS, Separator: "-", Count: 1}
+	for _, charset := range passwordCharsets {
+		options.Charsets[charset.Name] = true
+	}
+	return options
+}
+
+// Parse our options from the given query. Character sets are given by repeated (or comma
+// separated) charset parameters, and all are used if there's no charset parameter at all.
+func parsePasswordOptions(query url.Values) (passwordOptions, error) {
+
+	options := defaultPasswordOptions()
+
+	number := func(name string, value *int, lowest, highest int) error {
+		if text := query.Get(name); text != "" {
+			n, err := strconv.Atoi(text)
+			if err != nil || n < lowest || n > highest {
+				return badRequestError(fmt.Sprintf("The %s must be a number from %d to %d.", name, lowest, highest))
+			}
+			*value = n
+		}
+		return nil
+	}
+
+	for _, err := range []error{
+		number("length", &options.Length, MIN_PASSWORD_LENGTH, MAX_PASSWORD_LENGTH),
+		number("words", &options.Words, MIN_PASSPHRASE_WORDS, MAX_PASSPHRASE_WORDS),
+		number("count", &options.Count, 1, MAX_GENERATED_PASSWORDS),
+	} {
+		if err != nil {
+			return options, err
+		}
+	}
+
+	switch options.Kind = query.Get("kind"); options.Kind {
+	case "":
+		options.Kind = "password"
+	case "password", "passphrase":
+	default:
+		return options, badRequestError("The kind must be password or passphrase.")
+	}
+
+	if charsets, given := query["charset"]; given {
+		options.Charsets = map[string]bool{}
+		for _, name := range strings.Split(strings.Join(charsets, ","), ",") {
+			if name == "" {
+				continue
+			}
+			if !slices.ContainsFunc(passwordCharsets, func(charset passwordCharset) bool { return charset.Name == name }) {
+				return options, badRequestError(fmt.Sprintf("Unknown character set %q, expected lower, upper, digits or symbols.", name))
+			}
+			options.Charsets[name] = true
+		}
+	}
+
+	if query.Has("separator") {
+		options.Separator = query.Get("separator")
+		if len(options.Separator) > MAX_SEPARATOR_LENGTH {
+			return options, badRequestError(fmt.Sprintf("The separator may be at most %d characters.", MAX_SEPARATOR_LENGTH))
+		}
+	}
+
+	options.ExcludeAmbiguous = query.Get("exclude_ambiguous") == "true"
+	options.Capitalise = query.Get("capitalise") == "true"
+
+	return options, nil
+
+}
+
+// Returns a uniformly random number from 0 to n - 1
+func randomIndex(n int) int {
+	index, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(err) // crypto/rand never fails on the platforms we support
+	}
+	return int(index.Int64())
+}
+
+// Generate passwords with the given options, returning them along with their entropy in bits
+func generatePasswords(options passwordOptions) ([]string, float64) {
+
+	passwords := make([]string, options.Count)
+
+	if options.Kind == "passphrase" {
+		for i := range passwords {
+			words := make([]string, options.Words)
+			for j := range words {
+				words[j] = passphraseWords[randomIndex(len(passphraseWords))]
+				if options.Capitalise {
+					words[j] = capitalise(words[j])
+				}
+			}
+			passwords[i] = strings.Join(words, options.Separator)
+		}
+		return passwords, float64(options.Words) * math.Log2(float64(len(passphraseWords)))
+	}
+
+	// Each of our character sets is used at least once, which we make sure of by generating
+	// passwords until one has them all (which rarely takes more than a couple of tries)
+	var sets []string
+	var pool []rune
+	for _, charset := range passwordCharsets {
+		if !options.Charsets[charset.Name] {
+			continue
+		}
+		characters := charset.Characters
+		if options.ExcludeAmbiguous {
+			characters = strings.Map(func(r rune) rune {
+				if strings.ContainsRune(AMBIGUOUS_CHARACTERS, r) {
+					return -1
+				}
+				return r
+			}, characters)
+		}
+		sets = append(sets, characters)
+		pool = append(pool, []rune(characters)...)
+	}
+
+	for i := range passwords {
+		password := make([]rune, options.Length)
+		for {
+			for j := range password {
+				password[j] = pool[randomIndex(len(pool))]
+			}
+			if !slices.ContainsFunc(sets, func(set string) bool { return !strings.ContainsAny(string(password), set) }) {
+				break
+			}
+		}
+		passwords[i] = string(password)
+	}
+
+	return passwords, float64(options.Length) * math.Log2(float64(len(pool)))
+
+}
+
+// Returns an error if the given options can't generate a password
+func (options passwordOptions) validate() error {
+	if options.Kind == "password" && len(options.Charsets) == 0 {
+		return badRequestError("Choose at least one character set.")
+	}
+	return nil
+}
+
+// This is our password handler. GET requests with a generate parameter generate passwords,
+// while POST requests check the strength of the submitted password. The results are displayed
+// below our forms.
+func passwordHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	data := passwordPageData{Options: defaultPasswordOptions(), Charsets: passwordCharsets}
+
+	if r.Method == http.MethodPost {
+
+		r.Body = http.MaxBytesReader(w, r.Body, MAX_STRENGTH_REQUEST)
+
+		if err := r.ParseForm(); err != nil {
+			writeError(w, r, badRequestError("The password is too long to check.").Wrap(err))
+			return
+		}
+
+		estimate := checkPasswordStrength(r, r.PostForm.Get("password"), nil)
+		data.Estimate = &estimate
+
+	} else if r.URL.Query().Has("generate") {
+
+		query := r.URL.Query()
+		if !query.Has("charset") {
+			query["charset"] = nil // Our form leaves every character set unticked
+		}
+
+		options, err := parsePasswordOptions(query)
+		if err == nil {
+			err = options.validate()
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		passwords, entropy := generatePasswords(options)
+		incrementCounter("passwords_generated_total", "kind", options.Kind)
+
+		data.Options, data.Passwords, data.EntropyBits = options, passwords, int(entropy)
+
+	}
+
+	body, err := renderFragment(passwordBodyTemplate, data)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the password body template"))
+		return
+	}
+
+	renderMainTemplate(w, r, "password", HtmlData{
+		Title:       "Golang Password Generator",
+		Description: "Generate secure passwords and passphrases, and check how guessable a password is.",
+		Keywords:    "golang web server password generator passphrase diceware strength checker",
+		CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+		BodyContent: body,
+	})
+
+}
+
+// Estimate the strength of the given password
+func checkPasswordStrength(r *http.Request, password string, userInputs []string) strengthEstimate {
+
+	endSpan := startSpan(r.Context(), "password strength")
+	estimate := estimateStrength(password, userInputs)
+	endSpan()
+
+	incrementCounter("password_strength_checks_total", "score", strconv.Itoa(estimate.Score))
+
+	return estimate
+
+}
+
+// This is our password generator API, which takes the same options as our page (see
+// parsePasswordOptions)
+func passwordGenerateHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	options, err := parsePasswordOptions(r.URL.Query())
+	if err == nil {
+		err = options.validate()
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	passwords, entropy := generatePasswords(options)
+	incrementCounter("passwords_generated_total", "kind", options.Kind)
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	json.NewEncoder(w).Encode(map[string]any{"passwords": passwords, "entropy_bits": math.Round(entropy*10) / 10})
+
+}
+
+// This is our password strength API. It takes a JSON object with the password and optionally
+// the user's details (i.e. their name and email address), which make passwords weaker.
+func passwordStrengthHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	var request struct {
+		Password   *string  `json:"password"`
+		UserInputs []string `json:"user_inputs"`
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_STRENGTH_REQUEST))
+
+	if err := decoder.Decode(&request); err != nil || request.Password == nil {
+		// The decoder's errors can quote the request, so we don't wrap them
+		writeError(w, r, badRequestError("The request must be a JSON object with the password to check."))
+		return
+	}
+
+	estimate := checkPasswordStrength(r, *request.Password, request.UserInputs)
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	json.NewEncoder(w).Encode(estimate)
+
+}
@@ -0,0 +1,427 @@
+// PDF export of our demo pages. /export/pdf?page=... renders a printable version of the QR code
+// generator (a sheet of QR codes), the spreadsheet and the SVG surface drawing on the server.
+// We only need lines, filled shapes and text, so rather than pulling in a PDF library we write
+// the handful of PDF objects we need ourselves, using the built in Helvetica font so that no
+// fonts have to be embedded.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// The size of an A4 page in PDF points (1/72 inch)
+const (
+	A4_WIDTH  = 595.0
+	A4_HEIGHT = 842.0
+)
+
+// The margin we leave around the edges of our pages
+const PDF_PAGE_MARGIN = 36.0
+
+// The most QR codes per export (the largest spreadsheet is limited by MAX_SPREADSHEET_CELLS)
+const MAX_PDF_QR_CODES = 48
+
+// The file names our exports are downloaded as
+var pdfExportNames = map[string]string{
+	"qr":          "qr-codes.pdf",
+	"spreadsheet": "spreadsheet.pdf",
+	"svg":         "surface.pdf",
+}
+
+// A PDF document made up of pages of drawing operations
+type pdfDocument struct {
+	pages []*pdfPage
+}
+
+// A single page. Our drawing methods take coordinates from the top left of the page (like
+// SVG and HTML) and flip them, since PDF coordinates start at the bottom left.
+type pdfPage struct {
+	width    float64
+	height   float64
+	contents bytes.Buffer
+}
+
+// Add a new page of the given size to our document
+func (document *pdfDocument) addPage(width float64, height float64) *pdfPage {
+	page := &pdfPage{width: width, height: height}
+	document.pages = append(document.pages, page)
+	return page
+}
+
+// Set the fill and stroke colours (as greys, where 0 is black and 1 is white)
+func (page *pdfPage) setGrey(fill float64, stroke float64) {
+	fmt.Fprintf(&page.contents, "%.3f g %.3f G\n", fill, stroke)
+}
+
+// Set the fill colour (leaving the stroke colour as it was)
+func (page *pdfPage) setFillColour(fill colour) {
+	fmt.Fprintf(&page.contents, "%.3f %.3f %.3f rg\n", float64(fill.R)/255, float64(fill.G)/255, float64(fill.B)/255)
+}
+
+func (page *pdfPage) setLineWidth(width float64) {
+	fmt.Fprintf(&page.contents, "%.2f w\n", width)
+}
+
+// Add a rectangle to the page, either filled or outlined
+func (page *pdfPage) rect(x, y, width, height float64, fill bool) {
+	operator := "S"
+	if fill {
+		operator = "f"
+	}
+	fmt.Fprintf(&page.contents, "%.2f %.2f %.2f %.2f re %s\n", x, page.height-y-height, width, height, operator)
+}
+
+// Add a closed polygon (flattened x, y pairs) which is filled and outlined
+func (page *pdfPage) polygon(points []float64) {
+	for i := 0; i+1 < len(points); i += 2 {
+		operator := "l"
+		if i == 0 {
+			operator = "m"
+		}
+		fmt.Fprintf(&page.contents, "%.2f %.2f %s ", points[i], page.height-points[i+1], operator)
+	}
+	page.contents.WriteString("b\n")
+}
+
+// Add a line of text with its baseline at the given position
+func (page *pdfPage) text(x, y float64, size float64, text string) {
+	fmt.Fprintf(&page.contents, "BT /F1 %.1f Tf %.2f %.2f Td (%s) Tj ET\n", size, x, page.height-y, pdfString(text))
+}
+
+// Escape text for use in a PDF string. Helvetica only covers Latin-1 (via WinAnsiEncoding), so
+// anything else is replaced with a question mark.
+func pdfString(text string) string {
+
+	var escaped strings.Builder
+
+	for _, r := range text {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			escaped.WriteRune('\\')
+			escaped.WriteRune(r)
+		case r < 32 || r > 255:
+			escaped.WriteByte('?')
+		case r > 126:
+			fmt.Fprintf(&escaped, "\\%03o", r)
+		default:
+			escaped.WriteRune(r)
+		}
+	}
+
+	return escaped.String()
+
+}
+
+// Roughly how wide the given text is in Helvetica at the given size, used to keep text within
+// table cells. Helvetica's average character is about half as wide as its size.
+func pdfTextWidth(text string, size float64) float64 {
+	return float64(len([]rune(text))) * size * 0.5
+}
+
+// Write out our document. Objects 1 - 3 are the catalog, page tree and font, followed by a
+// page and content stream object for each page. The cross reference table at the end lists
+// the byte offset of each object.
+func (document *pdfDocument) write(w io.Writer) error {
+
+	var output bytes.Buffer
+	var offsets []int
+
+	object := func(body string, stream []byte) {
+		offsets = append(offsets, output.Len())
+		fmt.Fprintf(&output, "%d 0 obj\n%s\n", len(offsets), body)
+		if stream != nil {
+			output.WriteString("stream\n")
+			output.Write(stream)
+			output.WriteString("\nendstream\n")
+		}
+		output.WriteString("endobj\n")
+	}
+
+	output.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	var kids []string
+	for i := range document.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 4+i*2))
+	}
+
+	object("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)), nil)
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>", nil)
+
+	for i, page := range document.pages {
+
+		var compressed bytes.Buffer
+		writer := zlib.NewWriter(&compressed)
+		if _, err := writer.Write(page.contents.Bytes()); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] "+
+			"/Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", page.width, page.height, 5+i*2), nil)
+		object(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>", compressed.Len()), compressed.Bytes())
+	}
+
+	xref := output.Len()
+	fmt.Fprintf(&output, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&output, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&output, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := w.Write(output.Bytes())
+	return err
+
+}
+
+// This is our PDF export handler. The page parameter selects what we export: qr (the
+// qr_code_text parameters, one code per value), spreadsheet (a data parameter holding the
+// sheet's cells as a JSON array of rows) or svg (our surface drawing).
+func pdfExportHandler(w http.ResponseWriter, r *http.Request) {
+
+	var document *pdfDocument
+	var err error
+
+	page := r.FormValue("page")
+
+	endSpan := startSpan(r.Context(), "pdf: "+page)
+
+	switch page {
+	case "qr":
+		document, err = qrCodeSheetPDF(r.Form["qr_code_text"])
+	case "spreadsheet":
+		document, err = spreadsheetPDF(r.FormValue("data"))
+	case "svg":
+		var palette []colour
+		if palette, err = parsePalette(r.FormValue("palette")); err == nil {
+			document = surfacePDF(palette)
+		}
+	default:
+		err = badRequestError("The page parameter must be qr, spreadsheet or svg.")
+	}
+
+	endSpan()
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var output bytes.Buffer
+
+	if err := document.write(&output); err != nil {
+		writeError(w, r, internalError(err).WithDetail("writing the %s PDF", page))
+		return
+	}
+
+	incrementCounter("pdf_exports_total", "page", page)
+
+	setContentType(w, "application/pdf")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": pdfExportNames[page],
+	}))
+	w.Write(output.Bytes())
+
+}
+
+// A sheet of QR codes. A single code is drawn across the width of the page, while several
+// codes are laid out in a grid (i.e. for printing labels).
+func qrCodeSheetPDF(texts []string) (*pdfDocument, error) {
+
+	if len(texts) == 0 || len(texts) > MAX_PDF_QR_CODES {
+		return nil, badRequestError(fmt.Sprintf("Between 1 and %d qr_code_text values are required.", MAX_PDF_QR_CODES))
+	}
+
+	columns, rows := 3, 4
+	if len(texts) == 1 {
+		columns, rows = 1, 1
+	}
+
+	cellWidth := (A4_WIDTH - 2*PDF_PAGE_MARGIN) / float64(columns)
+	cellHeight := (A4_HEIGHT - 2*PDF_PAGE_MARGIN) / float64(rows)
+
+	document := &pdfDocument{}
+	var page *pdfPage
+
+	for i, text := range texts {
+
+		code, err := encodeQRCode([]byte(text))
+
+		if err != nil {
+			return nil, badRequestError(fmt.Sprintf("%q is too long to encode as a QR code.", text)).Wrap(err)
+		}
+
+		if i%(columns*rows) == 0 {
+			page = document.addPage(A4_WIDTH, A4_HEIGHT)
+			page.setGrey(0, 0)
+		}
+
+		column, row := i%columns, i/columns%rows
+		x := PDF_PAGE_MARGIN + float64(column)*cellWidth
+		y := PDF_PAGE_MARGIN + float64(row)*cellHeight
+
+		// Our code plus a four module quiet zone, leaving room for the caption below it
+		side := math.Min(cellWidth, cellHeight-24) * 0.9
+		moduleSize := side / float64(code.size+8)
+		left := x + (cellWidth-side)/2 + 4*moduleSize
+		top := y + 4*moduleSize
+
+		for moduleY, moduleRow := range code.modules {
+			for moduleX, dark := range moduleRow {
+				if dark {
+					page.rect(left+float64(moduleX)*moduleSize, top+float64(moduleY)*moduleSize, moduleSize, moduleSize, true)
+				}
+			}
+		}
+
+		caption := text
+		if limit := int(cellWidth / 5); len([]rune(caption)) > limit {
+			caption = string([]rune(caption)[:limit-3]) + "..."
+		}
+		page.text(x+(cellWidth-pdfTextWidth(caption, 10))/2, y+side+16, 10, caption)
+	}
+
+	return document, nil
+
+}
+
+// A printable copy of the spreadsheet. Our spreadsheet lives in the browser, so the cells are
+// sent to us as a JSON array of rows (an empty sheet is printed if none are sent), and we print
+// the computed values of their formulas (see spreadsheet.go).
+func spreadsheetPDF(data string) (*pdfDocument, error) {
+
+	result, err := evaluatedSpreadsheet(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cells := result.Values
+
+	columns := 0
+	for _, row := range cells {
+		columns = max(columns, len(row))
+	}
+
+	// The same size as our spreadsheet demo when it's empty
+	if len(cells) == 0 {
+		cells = make([][]string, 15)
+		columns = 20
+	}
+
+	// Landscape pages, with a header column / row for the row numbers and column letters
+	pageWidth, pageHeight := A4_HEIGHT, A4_WIDTH
+	const rowHeight, fontSize = 16.0, 7.0
+	cellWidth := math.Min(100, (pageWidth-2*PDF_PAGE_MARGIN)/float64(columns+1))
+	rowsPerPage := int((pageHeight-2*PDF_PAGE_MARGIN)/rowHeight) - 1
+
+	document := &pdfDocument{}
+
+	for first := 0; first < len(cells); first += rowsPerPage {
+
+		page := document.addPage(pageWidth, pageHeight)
+		page.setLineWidth(0.5)
+
+		cell := func(column int, row int, text string, header bool) {
+			x := PDF_PAGE_MARGIN + float64(column)*cellWidth
+			y := PDF_PAGE_MARGIN + float64(row)*rowHeight
+			if header {
+				page.setGrey(0.9, 0.6)
+				page.rect(x, y, cellWidth, rowHeight, true)
+			}
+			page.setGrey(0, 0.6)
+			page.rect(x, y, cellWidth, rowHeight, false)
+			for text != "" && pdfTextWidth(text, fontSize) > cellWidth-4 {
+				text = string([]rune(text)[:len([]rune(text))-1])
+			}
+			page.text(x+2, y+rowHeight-5, fontSize, text)
+		}
+
+		cell(0, 0, "", true)
+		for column := 0; column < columns; column++ {
+			cell(column+1, 0, spreadsheetColumnName(column), true)
+		}
+
+		for row := first; row < len(cells) && row < first+rowsPerPage; row++ {
+			cell(0, row-first+1, fmt.Sprint(row+1), true)
+			for column := 0; column < columns; column++ {
+				text := ""
+				if column < len(cells[row]) {
+					text = cells[row][column]
+				}
+				cell(column+1, row-first+1, text, false)
+			}
+		}
+	}
+
+	return document, nil
+
+}
+
+// Returns the spreadsheet name of the given (zero based) column, i.e. A, B, ... Z, AA, AB
+func spreadsheetColumnName(column int) string {
+
+	name := ""
+	for column++; column > 0; column = (column - 1) / 26 {
+		name = string(rune('A'+(column-1)%26)) + name
+	}
+
+	return name
+
+}
+
+// Our SVG surface drawing (see svgHandler), drawn as vector polygons on a landscape page and
+// coloured by the given palette (if any)
+func surfacePDF(palette []colour) *pdfDocument {
+
+	document := &pdfDocument{}
+	page := document.addPage(A4_HEIGHT, A4_WIDTH)
+
+	scale := math.Min((page.width-2*PDF_PAGE_MARGIN)/canvasWidth, (page.height-2*PDF_PAGE_MARGIN)/canvasHeight)
+	offsetX := (page.width - canvasWidth*scale) / 2
+	offsetY := (page.height - canvasHeight*scale) / 2
+
+	page.setGrey(1, 0.5)
+	page.setLineWidth(0.7 * scale)
+
+	for i := 0; i < numGridCells; i++ {
+		for j := 0; j < numGridCells; j++ {
+			var points []float64
+			for _, cell := range [][2]int{{i + 1, j}, {i, j}, {i, j + 1}, {i + 1, j + 1}} {
+				x, y := corner(cell[0], cell[1])
+				points = append(points, offsetX+x*scale, offsetY+y*scale)
+			}
+			// The surface is undefined at its centre (sin(r)/r where r is 0), so we skip the
+			// cells which touch it rather than writing NaNs into our PDF
+			if !finitePoints(points) {
+				continue
+			}
+			if palette != nil {
+				page.setFillColour(paletteColourAt(palette, cellElevation(i, j)))
+			}
+			page.polygon(points)
+		}
+	}
+
+	return document
+
+}
+
+func finitePoints(points []float64) bool {
+	for _, point := range points {
+		if math.IsNaN(point) || math.IsInf(point, 0) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+// Privacy mode, for deployments in jurisdictions with data-protection requirements (i.e. the
+// GDPR). The -privacy flag anonymizes client IP addresses and user agents before they reach our
+// access log, slow request log, request events and captured requests. It takes comma separated
+// field settings:
+//
+//   - ip=keep|truncate|hash|drop: truncate zeroes the host part of addresses (keeping the /24 of
+//     IPv4 addresses and the /48 of IPv6 addresses), hash replaces them with a keyed hash (so
+//     that the requests of a client can still be told apart without revealing its address), and
+//     drop leaves them out altogether
+//   - user-agent=keep|drop
+//
+// or gdpr as a shorthand for ip=hash,user-agent=drop. For example:
+//
+//	-privacy gdpr
+//	-privacy ip=truncate
+//
+// Hashes are keyed with -privacy-salt. Without a salt, we pick a random one at startup, so that
+// hashes can't be linked across restarts (or reversed by hashing every possible address).
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	PRIVACY_KEEP     = "keep"
+	PRIVACY_TRUNCATE = "truncate"
+	PRIVACY_HASH     = "hash"
+	PRIVACY_DROP     = "drop"
+)
+
+// How each of our privacy sensitive fields is treated
+type privacySettings struct {
+	ip        string
+	userAgent string
+	salt      []byte
+}
+
+var privacy = privacySettings{ip: PRIVACY_KEEP, userAgent: PRIVACY_KEEP}
+
+// Parse our -privacy and -privacy-salt flags
+func parsePrivacy(settings, salt string) error {
+
+	if settings == "gdpr" {
+		settings = "ip=hash,user-agent=drop"
+	}
+
+	for _, setting := range strings.Split(settings, ",") {
+
+		if setting = strings.TrimSpace(setting); setting == "" {
+			continue
+		}
+
+		field, mode, _ := strings.Cut(setting, "=")
+
+		switch {
+		case field == "ip" && (mode == PRIVACY_KEEP || mode == PRIVACY_TRUNCATE || mode == PRIVACY_HASH || mode == PRIVACY_DROP):
+			privacy.ip = mode
+		case field == "user-agent" && (mode == PRIVACY_KEEP || mode == PRIVACY_DROP):
+			privacy.userAgent = mode
+		default:
+			return fmt.Errorf("invalid setting %q: expected ip=keep|truncate|hash|drop, user-agent=keep|drop or gdpr", setting)
+		}
+
+	}
+
+	privacy.salt = []byte(salt)
+
+	if salt == "" && privacy.ip == PRIVACY_HASH {
+		privacy.salt = make([]byte, 32)
+		rand.Read(privacy.salt)
+	}
+
+	return nil
+
+}
+
+// Returns the client address of the given request (i.e. its RemoteAddr) as it may be recorded
+func loggedAddress(r *http.Request) string {
+	return anonymizeAddress(r.RemoteAddr)
+}
+
+// Returns the given client address (with or without a port) as it may be recorded
+func anonymizeAddress(address string) string {
+
+	if privacy.ip == PRIVACY_KEEP || address == "" {
+		return address
+	}
+
+	// The port of a client's connection says little, and could help to identify the client
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	switch privacy.ip {
+	case PRIVACY_TRUNCATE:
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return "-"
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+
+	case PRIVACY_HASH:
+		mac := hmac.New(sha256.New, privacy.salt)
+		mac.Write([]byte(host))
+		return "ip-" + hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+
+	return "-"
+
+}
+
+// Returns the user agent of the given request as it may be recorded
+func loggedUserAgent(r *http.Request) string {
+	if privacy.userAgent == PRIVACY_DROP {
+		return ""
+	}
+	return r.UserAgent()
+}
+
+// Anonymize the privacy sensitive headers of the given (recorded copy of the) headers. The
+// forwarding headers carry client addresses too, so they're treated like the client's address.
+func anonymizeHeaders(header http.Header) {
+
+	if privacy.userAgent == PRIVACY_DROP {
+		header.Del("User-Agent")
+	}
+
+	if privacy.ip == PRIVACY_KEEP {
+		return
+	}
+
+	for _, name := range []string{"X-Forwarded-For", "X-Real-Ip"} {
+		for index, value := range header[name] {
+			addresses := strings.Split(value, ",")
+			for position, address := range addresses {
+				addresses[position] = anonymizeAddress(strings.TrimSpace(address))
+			}
+			header[name][index] = strings.Join(addresses, ", ")
+		}
+	}
+
+	// The Forwarded header's addresses are mixed in with other parameters, so we don't try to
+	// anonymize them
+	header.Del("Forwarded")
+
+}
@@ -0,0 +1,324 @@
+// Automatic profile capture. Every PROFILE_CHECK_INTERVAL we check how slow our requests have
+// been (their 95th percentile latency over the interval) and how big our heap is, and when
+// either crosses its threshold (-profile-latency, -profile-heap) we capture pprof profiles of
+// our CPU, heap and goroutines into -profile-dir, so that a slow or bloated spell can be
+// diagnosed after it has passed. We keep the latest PROFILE_CAPTURES captures, and capture at
+// most once every PROFILE_COOLDOWN.
+//
+// Captures are named after when and why they were taken (i.e. 20261016T191634Z-latency-cpu.pprof)
+// and are listed and downloaded via our admin API:
+//
+//	GET  /debug/profiles           lists our captured profiles
+//	POST /debug/profiles           captures profiles now (with a CSRF token or an X-Requested-With header)
+//	GET  /debug/profiles/{name}    downloads a profile (for go tool pprof)
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	PROFILE_CHECK_INTERVAL  = 10 * time.Second
+	PROFILE_COOLDOWN        = 10 * time.Minute
+	PROFILE_CPU_DURATION    = 10 * time.Second
+	PROFILE_CAPTURES        = 10
+	PROFILE_MIN_REQUESTS    = 20    // The fewest requests in an interval we judge our latency by
+	MAX_PROFILE_LATENCIES   = 10000 // The most request latencies we keep per interval
+	DEFAULT_PROFILE_LATENCY = 2 * time.Second
+	DEFAULT_PROFILE_HEAP    = 1 << 30
+)
+
+// The names of our profile files: when they were captured, why and what they're of
+var profileFileName = regexp.MustCompile(`^(\d{8}T\d{6}Z)-(latency|heap|manual)-(cpu|heap|goroutine)\.pprof$`)
+
+// The timestamp format of our profile file names
+const PROFILE_TIME_FORMAT = "20060102T150405Z"
+
+// The latencies of the requests we've served this interval, and whether (and when) we last
+// captured profiles
+var profiling = struct {
+	mutex     sync.Mutex
+	latencies []time.Duration
+	capturing bool
+	captured  time.Time
+}{}
+
+// A captured profile, as listed by our admin API
+type profileFile struct {
+	Name     string    `json:"name"`
+	Captured time.Time `json:"captured"`
+	Reason   string    `json:"reason"`
+	Kind     string    `json:"kind"`
+	Size     int64     `json:"size"`
+	URL      string    `json:"url"`
+}
+
+// Note how long a request took, for our latency threshold
+func observeLatency(duration time.Duration) {
+
+	if profileDir == "" || profileLatency <= 0 {
+		return
+	}
+
+	profiling.mutex.Lock()
+	defer profiling.mutex.Unlock()
+
+	if len(profiling.latencies) < MAX_PROFILE_LATENCIES {
+		profiling.latencies = append(profiling.latencies, duration)
+	}
+
+}
+
+// Check our latency and heap every PROFILE_CHECK_INTERVAL, capturing profiles when either
+// crosses its threshold, until the server exits
+func startProfileTrigger() {
+	go func() {
+		for range time.Tick(PROFILE_CHECK_INTERVAL) {
+			reason, detail := profileTriggered()
+			if reason == "" {
+				continue
+			}
+			if _, capturing := captureProfiles(reason, true); capturing {
+				logger.Printf("WARN %s, capturing profiles into %s", detail, profileDir)
+			}
+		}
+	}()
+}
+
+// Returns why we should capture profiles (along with a description for our log), or nothing if
+// we're fine. Each call starts a new interval of latencies.
+func profileTriggered() (string, string) {
+
+	profiling.mutex.Lock()
+	latencies := profiling.latencies
+	profiling.latencies = nil
+	profiling.mutex.Unlock()
+
+	if profileLatency > 0 && len(latencies) >= PROFILE_MIN_REQUESTS {
+		slices.Sort(latencies)
+		if p95 := latencies[len(latencies)*95/100]; p95 > profileLatency {
+			return "latency", fmt.Sprintf("the 95th percentile latency was %v (threshold %v)", p95, profileLatency)
+		}
+	}
+
+	if profileHeap > 0 {
+		var memory runtime.MemStats
+		runtime.ReadMemStats(&memory)
+		if int64(memory.HeapAlloc) > profileHeap {
+			return "heap", fmt.Sprintf("the heap is %s (threshold %s)", formatFileSize(int64(memory.HeapAlloc)), formatFileSize(profileHeap))
+		}
+	}
+
+	return "", ""
+
+}
+
+// Capture profiles for the given reason in the background, unless we're already capturing (or,
+// if we're to respect our cooldown, have captured recently). Returns the time the profiles are
+// named after, or false if we aren't capturing them.
+func captureProfiles(reason string, cooldown bool) (time.Time, bool) {
+
+	profiling.mutex.Lock()
+	defer profiling.mutex.Unlock()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	if profiling.capturing || (cooldown && now.Sub(profiling.captured) < PROFILE_COOLDOWN) || !now.After(profiling.captured) {
+		return time.Time{}, false
+	}
+
+	profiling.capturing, profiling.captured = true, now
+	incrementCounter("profiles_captured_total", "reason", reason)
+
+	go func() {
+
+		defer func() {
+			profiling.mutex.Lock()
+			profiling.capturing = false
+			profiling.mutex.Unlock()
+		}()
+
+		if err := os.MkdirAll(profileDir, 0o755); err != nil {
+			logger.Println("Failed to create the profile directory:", err)
+			return
+		}
+
+		prefix := filepath.Join(profileDir, now.Format(PROFILE_TIME_FORMAT)+"-"+reason+"-")
+
+		// The heap and goroutines are captured first, as they are when we were triggered
+		for _, kind := range []string{"heap", "goroutine"} {
+			if err := writeProfile(prefix+kind+".pprof", func(file *os.File) error {
+				return pprof.Lookup(kind).WriteTo(file, 0)
+			}); err != nil {
+				logger.Printf("Failed to capture a %s profile: %v", kind, err)
+			}
+		}
+
+		// Only one CPU profile can be taken at a time, so this fails if someone is already
+		// taking one (i.e. via go tool pprof)
+		if err := writeProfile(prefix+"cpu.pprof", func(file *os.File) error {
+			if err := pprof.StartCPUProfile(file); err != nil {
+				return err
+			}
+			time.Sleep(PROFILE_CPU_DURATION)
+			pprof.StopCPUProfile()
+			return nil
+		}); err != nil {
+			logger.Println("Failed to capture a CPU profile:", err)
+		}
+
+		pruneProfiles()
+
+	}()
+
+	return now, true
+
+}
+
+// Write a profile to the given file, removing the file if it couldn't be written
+func writeProfile(path string, write func(*os.File) error) error {
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+
+	return err
+
+}
+
+// Returns our captured profiles, latest first
+func listProfiles() ([]profileFile, error) {
+
+	entries, err := os.ReadDir(profileDir)
+	if os.IsNotExist(err) {
+		return []profileFile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := []profileFile{}
+
+	for _, entry := range entries {
+		match := profileFileName.FindStringSubmatch(entry.Name())
+		info, err := entry.Info()
+		if match == nil || err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		captured, _ := time.Parse(PROFILE_TIME_FORMAT, match[1])
+		profiles = append(profiles, profileFile{
+			Name:     entry.Name(),
+			Captured: captured,
+			Reason:   match[2],
+			Kind:     match[3],
+			Size:     info.Size(),
+			URL:      urlFor("/debug/profiles/" + entry.Name()),
+		})
+	}
+
+	slices.SortStableFunc(profiles, func(a, b profileFile) int { return b.Captured.Compare(a.Captured) })
+
+	return profiles, nil
+
+}
+
+// Remove all but our latest PROFILE_CAPTURES captures
+func pruneProfiles() {
+
+	profiles, err := listProfiles()
+	if err != nil {
+		logger.Println("Failed to list our profiles:", err)
+		return
+	}
+
+	var captures []time.Time
+	for _, profile := range profiles {
+		if !slices.Contains(captures, profile.Captured) {
+			captures = append(captures, profile.Captured)
+		}
+		if len(captures) > PROFILE_CAPTURES {
+			os.Remove(filepath.Join(profileDir, profile.Name))
+		}
+	}
+
+}
+
+// Register the admin routes of our profiles
+func registerProfileRoutes(router *http.ServeMux) {
+	handleRoute(router, "/debug/profiles", adminOnly(http.HandlerFunc(profilesHandler)), http.MethodGet, http.MethodPost)
+	handleRoute(router, "/debug/profiles/{name}", adminOnly(http.HandlerFunc(profileDownloadHandler)))
+}
+
+// This is our profiles admin handler, which lists our captured profiles (GET) or captures them
+// now (POST)
+func profilesHandler(w http.ResponseWriter, r *http.Request) {
+
+	if profileDir == "" {
+		writeError(w, r, notFoundError().WithDetail("profile capture is disabled"))
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		captured, ok := captureProfiles("manual", false)
+		if !ok {
+			writeError(w, r, newAppError(http.StatusConflict, "profiling", "We're already capturing profiles. Try again shortly."))
+			return
+		}
+		setContentType(w, CONTENT_TYPE_JSON)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"captured": captured,
+			"ready_in": PROFILE_CPU_DURATION.String(),
+		})
+		return
+	}
+
+	profiles, err := listProfiles()
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("listing our profiles"))
+		return
+	}
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"directory": profileDir,
+		"profiles":  profiles,
+	})
+
+}
+
+// This is our profile download handler
+func profileDownloadHandler(w http.ResponseWriter, r *http.Request) {
+
+	name := r.PathValue("name")
+
+	// Only our own profiles can be downloaded, which also keeps the name within our directory
+	if profileDir == "" || !profileFileName.MatchString(name) {
+		writeError(w, r, notFoundError())
+		return
+	}
+
+	setContentType(w, "application/octet-stream")
+	serveFile(w, r, filepath.Join(profileDir, name), name)
+
+}
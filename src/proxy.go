@@ -0,0 +1,673 @@
+// Caching reverse proxy mode. When the -proxy flag is set to an upstream origin (i.e.
+// -proxy http://localhost:3000), we stop serving our demo site and instead front the origin:
+// requests are passed through our usual tracing, logging and metrics middleware and proxied to
+// it, and cacheable GET responses are kept in an in-memory LRU cache following the rules of
+// RFC 9111 (explicit freshness via Cache-Control / Expires, heuristic freshness via
+// Last-Modified, Vary and conditional revalidation of stale responses). When the origin is
+// down, visitors receive our templated error page rather than a bare 502.
+//
+// Our /health, /readyz, /status and /metrics endpoints (and the admin endpoints) remain
+// available in proxy mode, everything else goes to the origin. See upstreams.go for spreading
+// requests across several origins (and their health checks), and canary.go for canary routing.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The largest single response we'll cache
+const MAX_PROXY_CACHE_ENTRY_SIZE = 2 << 20
+
+// The longest heuristic freshness lifetime we'll give a response without explicit freshness
+const MAX_HEURISTIC_FRESHNESS = 24 * time.Hour
+
+// The status codes which are cacheable by default (RFC 9110 section 15.1). Responses with
+// these statuses may be given a heuristic freshness lifetime, while any other status is
+// only cached when the origin gives it an explicit lifetime. We don't cache partial (206)
+// responses at all.
+var heuristicallyCacheable = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// Headers which describe a single connection and are never stored with a cached response
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer",
+	"Transfer-Encoding", "Upgrade",
+}
+
+// A cached upstream response
+type proxyCacheEntry struct {
+	key        string
+	status     int
+	header     http.Header
+	body       []byte
+	varyValues map[string]string // The request header values our response varies on
+	storedAt   time.Time         // When we received the response
+	initialAge time.Duration     // The age of the response when we received it
+	lifetime   time.Duration     // How long the response is fresh for
+}
+
+// The current age of our cached response (RFC 9111 section 4.2.3)
+func (entry *proxyCacheEntry) age() time.Duration {
+	return entry.initialAge + time.Since(entry.storedAt)
+}
+
+func (entry *proxyCacheEntry) fresh() bool {
+	return entry.age() < entry.lifetime
+}
+
+// Returns whether our cached response can be used for the given request (i.e. the headers
+// it varies on match)
+func (entry *proxyCacheEntry) matches(r *http.Request) bool {
+	for name, value := range entry.varyValues {
+		if strings.Join(r.Header.Values(name), ", ") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// A least recently used cache of upstream responses, bounded by the total size of the
+// response bodies it holds
+type proxyCache struct {
+	mutex    sync.Mutex
+	capacity int64
+	size     int64
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+func newProxyCache(capacity int64) *proxyCache {
+	return &proxyCache{capacity: capacity, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// Returns the cached response with the given key (marking it as recently used)
+func (cache *proxyCache) get(key string) (*proxyCacheEntry, bool) {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	cache.order.MoveToFront(element)
+	return element.Value.(*proxyCacheEntry), true
+
+}
+
+// Add a response to our cache, evicting the least recently used responses if we're full
+func (cache *proxyCache) add(entry *proxyCacheEntry) {
+
+	// Responses which would push everything else out of our cache aren't worth keeping
+	if int64(len(entry.body)) > cache.capacity/4 {
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if element, ok := cache.entries[entry.key]; ok {
+		cache.size -= int64(len(element.Value.(*proxyCacheEntry).body))
+		element.Value = entry
+		cache.order.MoveToFront(element)
+	} else {
+		cache.entries[entry.key] = cache.order.PushFront(entry)
+	}
+
+	cache.size += int64(len(entry.body))
+
+	for cache.size > cache.capacity && cache.order.Len() > 0 {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*proxyCacheEntry).key)
+		cache.size -= int64(len(oldest.Value.(*proxyCacheEntry).body))
+		incrementCounter("proxy_cache_evictions_total")
+	}
+
+	setGauge("proxy_cache_entries", float64(cache.order.Len()))
+	setGauge("proxy_cache_bytes", float64(cache.size))
+
+}
+
+// Remove the response with the given key from our cache
+func (cache *proxyCache) remove(key string) {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if element, ok := cache.entries[key]; ok {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		cache.size -= int64(len(element.Value.(*proxyCacheEntry).body))
+	}
+
+}
+
+// What we know about a request we're passing on to the origin. It's kept in the request
+// context so that we still have it when the response comes back.
+type proxyRequestState struct {
+	key    string           // Our cache key (the upstream and request URI before it was rewritten)
+	target *proxyTarget     // The upstream we're passing the request on to (see canary.go)
+	stale  *proxyCacheEntry // The stale cached response we're revalidating (if any)
+}
+
+type proxyRequestStateKey struct{}
+
+// Our caching reverse proxy
+type cachingProxy struct {
+	primaries *proxyPool   // Our main upstreams (see upstreams.go)
+	canary    *canaryRoute // Our canary upstream, if any (see canary.go)
+	cache     *proxyCache
+	proxy     *httputil.ReverseProxy
+}
+
+// Create a new caching proxy for the given (comma separated) upstream origins (i.e.
+// http://localhost:3000)
+func newCachingProxy(upstreams string, cacheSize int64) (*cachingProxy, error) {
+
+	primaries, err := newProxyPool(upstreams)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cachingProxy := &cachingProxy{primaries: primaries, cache: newProxyCache(cacheSize)}
+
+	cachingProxy.proxy = &httputil.ReverseProxy{
+		Rewrite: func(proxyRequest *httputil.ProxyRequest) {
+			state := proxyRequest.In.Context().Value(proxyRequestStateKey{}).(*proxyRequestState)
+			proxyRequest.SetURL(state.target.url)
+			proxyRequest.SetXForwarded()
+
+			// Let the origin tie its logs back to ours
+			if requestID, ok := proxyRequest.In.Context().Value(REQUEST_ID_KEY).(string); ok {
+				proxyRequest.Out.Header.Set("X-Request-Id", requestID)
+			}
+		},
+		ModifyResponse: cachingProxy.modifyResponse,
+		ErrorHandler:   cachingProxy.errorHandler,
+		ErrorLog:       logger,
+	}
+
+	return cachingProxy, nil
+
+}
+
+// This is our proxy handler
+func (cachingProxy *cachingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	defer startSpan(r.Context(), "proxy")()
+
+	// Responses from our canary are cached separately, so that they're only ever served to the
+	// requests we route to it. Our main upstreams share a cache, as they serve the same site.
+	canary := cachingProxy.canary != nil && cachingProxy.canary.target.available() && cachingProxy.canary.matches(r)
+
+	state := &proxyRequestState{key: "primary " + r.URL.RequestURI()}
+	if canary {
+		state.key = "canary " + r.URL.RequestURI()
+	}
+
+	// Only GET and HEAD requests can be answered from our cache. Any other (unsafe) request
+	// invalidates what we have cached for its URL (RFC 9111 section 4.4).
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		cachingProxy.cache.remove("primary " + r.URL.RequestURI())
+		cachingProxy.cache.remove("canary " + r.URL.RequestURI())
+		incrementCounter("proxy_cache_requests_total", "result", "bypass")
+		cachingProxy.forward(w, r, state, canary)
+		return
+	}
+
+	requestDirectives := parseCacheControl(r.Header.Get("Cache-Control"))
+	entry, cached := cachingProxy.cache.get(state.key)
+	cached = cached && entry.matches(r)
+
+	_, noCache := requestDirectives["no-cache"]
+	if cached && !noCache && entry.fresh() {
+		incrementCounter("proxy_cache_requests_total", "result", "hit")
+		serveCachedResponse(w, r, entry, "HIT")
+		return
+	}
+
+	// Revalidate our stale response with the origin if we can (and the client isn't making a
+	// conditional request of its own)
+	if cached && r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == "" {
+		eTag := entry.header.Get("ETag")
+		lastModified := entry.header.Get("Last-Modified")
+
+		if eTag != "" || lastModified != "" {
+			state.stale = entry
+			r = r.Clone(r.Context())
+			if eTag != "" {
+				r.Header.Set("If-None-Match", eTag)
+			}
+			if lastModified != "" {
+				r.Header.Set("If-Modified-Since", lastModified)
+			}
+		}
+	}
+
+	if state.stale == nil {
+		incrementCounter("proxy_cache_requests_total", "result", "miss")
+	}
+
+	cachingProxy.forward(w, r, state, canary)
+
+}
+
+// Pass the given request on to our canary or one of our main upstreams (see loadbalancer.go)
+func (cachingProxy *cachingProxy) forward(w http.ResponseWriter, r *http.Request, state *proxyRequestState, canary bool) {
+
+	if canary {
+		if cachingProxy.canary.target.acquire() {
+			state.target = cachingProxy.canary.target
+		}
+	} else if state.target = cachingProxy.primaries.pick(r); state.target != nil {
+		setStickyCookie(w, r, state.target)
+	}
+
+	if state.target == nil {
+		incrementCounter("proxy_upstream_busy_total")
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, newAppError(http.StatusServiceUnavailable, "upstream_busy",
+			"The site is busy right now. Please try again in a few moments."))
+		return
+	}
+	defer state.target.release()
+
+	cachingProxy.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyRequestStateKey{}, state)))
+
+}
+
+// Called with each response from the origin. Cacheable responses are stored as they're
+// streamed back to the client, while a 304 in answer to our revalidation request refreshes
+// our cached response and is turned back into the full response.
+func (cachingProxy *cachingProxy) modifyResponse(response *http.Response) error {
+
+	r := response.Request
+	state := r.Context().Value(proxyRequestStateKey{}).(*proxyRequestState)
+	stale := state.stale
+
+	incrementCounter("proxy_upstream_requests_total", "upstream", state.target.name,
+		"host", state.target.url.Host, "class", statusClass(response.StatusCode))
+	state.target.recordResponse(response.StatusCode)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		response.Header.Set("X-Cache", "BYPASS")
+		return nil
+	}
+
+	if stale != nil && response.StatusCode == http.StatusNotModified {
+		incrementCounter("proxy_cache_requests_total", "result", "revalidated")
+
+		// Update our stored headers with the ones sent with the 304 (RFC 9111 section 4.3.4)
+		refreshed := *stale
+		refreshed.header = stale.header.Clone()
+		for name, values := range response.Header {
+			refreshed.header[name] = values
+		}
+		refreshed.storedAt = time.Now()
+		refreshed.initialAge = correctedInitialAge(response.Header, time.Now())
+		refreshed.lifetime = freshnessLifetime(refreshed.status, refreshed.header, time.Now())
+		cachingProxy.cache.add(&refreshed)
+
+		response.Body.Close()
+		response.StatusCode = refreshed.status
+		response.Status = fmt.Sprintf("%d %s", refreshed.status, http.StatusText(refreshed.status))
+		response.Header = refreshed.header.Clone()
+		response.Header.Set("Age", strconv.Itoa(int(refreshed.age().Seconds())))
+		response.Header.Set("X-Cache", "REVALIDATED")
+		response.Body = io.NopCloser(bytes.NewReader(refreshed.body))
+		response.ContentLength = int64(len(refreshed.body))
+		response.Header.Set("Content-Length", strconv.Itoa(len(refreshed.body)))
+		return nil
+	}
+
+	response.Header.Set("X-Cache", "MISS")
+
+	if stale != nil {
+		incrementCounter("proxy_cache_requests_total", "result", "miss")
+	}
+
+	if r.Method != http.MethodGet || !cacheable(r, response) {
+		return nil
+	}
+
+	// Vary: * means the response can never be reused
+	varyValues := map[string]string{}
+	for _, vary := range response.Header.Values("Vary") {
+		for _, name := range strings.Split(vary, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil
+			}
+			if name != "" {
+				varyValues[name] = strings.Join(r.Header.Values(name), ", ")
+			}
+		}
+	}
+
+	now := time.Now()
+	entry := &proxyCacheEntry{
+		key:        state.key,
+		status:     response.StatusCode,
+		header:     response.Header.Clone(),
+		varyValues: varyValues,
+		storedAt:   now,
+		initialAge: correctedInitialAge(response.Header, now),
+		lifetime:   freshnessLifetime(response.StatusCode, response.Header, now),
+	}
+
+	if entry.lifetime <= entry.initialAge {
+		return nil
+	}
+
+	for _, name := range append(hopByHopHeaders, "X-Cache") {
+		entry.header.Del(name)
+	}
+
+	// Store the body once it has been fully (and successfully) streamed to the client
+	response.Body = &cachingBody{
+		body: response.Body,
+		done: func(body []byte) {
+			entry.body = body
+			cachingProxy.cache.add(entry)
+		},
+	}
+
+	return nil
+
+}
+
+// Called when the origin can't be reached (or the client went away)
+func (cachingProxy *cachingProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+
+	// There's nobody left to respond to if our client cancelled the request
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	state := r.Context().Value(proxyRequestStateKey{}).(*proxyRequestState)
+	incrementCounter("proxy_upstream_errors_total", "upstream", state.target.name)
+	state.target.recordFailure(err.Error())
+
+	// An origin which timed out gets a 504, anything else (i.e. a refused connection) a 502
+	status := http.StatusBadGateway
+	var netError net.Error
+	if errors.As(err, &netError) && netError.Timeout() {
+		status = http.StatusGatewayTimeout
+	}
+
+	writeError(w, r, newAppError(status, "upstream_unavailable",
+		"The site is temporarily unavailable. Please try again in a few moments.").
+		WithDetail("proxying to %s", state.target.url.Host).Wrap(err))
+
+}
+
+// Write out a response from our cache
+func serveCachedResponse(w http.ResponseWriter, r *http.Request, entry *proxyCacheEntry, result string) {
+
+	for name, values := range entry.header {
+		w.Header()[name] = values
+	}
+
+	w.Header().Set("Age", strconv.Itoa(int(entry.age().Seconds())))
+	w.Header().Set("X-Cache", result)
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry.body)))
+
+	// Let the client revalidate its own copy against ours
+	if entry.status == http.StatusOK && notModified(r, entry.header) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(entry.status)
+
+	if r.Method != http.MethodHead {
+		w.Write(entry.body)
+	}
+
+}
+
+// Returns whether the client's copy of our cached response is still current
+func notModified(r *http.Request, header http.Header) bool {
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		eTag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || eTag != "" && candidate == eTag {
+				return true
+			}
+		}
+		return false
+	}
+
+	ifModifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ifModifiedSince)
+
+}
+
+// Returns whether the given response to the given request may be stored in a shared cache
+// (RFC 9111 section 3)
+func cacheable(r *http.Request, response *http.Response) bool {
+
+	if response.StatusCode == http.StatusPartialContent || response.StatusCode == http.StatusNotModified {
+		return false
+	}
+
+	requestDirectives := parseCacheControl(r.Header.Get("Cache-Control"))
+	responseDirectives := parseCacheControl(response.Header.Get("Cache-Control"))
+
+	for _, directive := range []string{"no-store", "private", "no-cache"} {
+		if _, ok := responseDirectives[directive]; ok {
+			return false
+		}
+	}
+
+	if _, ok := requestDirectives["no-store"]; ok {
+		return false
+	}
+
+	// Responses to authenticated requests are only shared when the origin explicitly says so
+	if r.Header.Get("Authorization") != "" {
+		_, public := responseDirectives["public"]
+		_, sMaxAge := responseDirectives["s-maxage"]
+		_, mustRevalidate := responseDirectives["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return false
+		}
+	}
+
+	// Responses setting cookies are (almost always) specific to a single visitor
+	if response.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+
+	// Without explicit freshness, only responses with a heuristically cacheable status code
+	// are stored
+	_, public := responseDirectives["public"]
+	return heuristicallyCacheable[response.StatusCode] || public ||
+		hasExplicitFreshness(responseDirectives, response.Header)
+
+}
+
+func hasExplicitFreshness(directives map[string]string, header http.Header) bool {
+	_, maxAge := directives["max-age"]
+	_, sMaxAge := directives["s-maxage"]
+	return maxAge || sMaxAge || header.Get("Expires") != ""
+}
+
+// Returns how long the given response is fresh for (RFC 9111 section 4.2.1). We're a shared
+// cache, so s-maxage takes precedence over max-age.
+func freshnessLifetime(status int, header http.Header, now time.Time) time.Duration {
+
+	directives := parseCacheControl(header.Get("Cache-Control"))
+
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[directive]; ok {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds < 0 {
+				return 0
+			}
+			return time.Duration(min(seconds, int64(1<<31))) * time.Second
+		}
+	}
+
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		date = now
+	}
+
+	if expiresHeader := header.Get("Expires"); expiresHeader != "" {
+		// An invalid Expires (i.e. "0") means the response has already expired
+		expires, err := http.ParseTime(expiresHeader)
+		if err != nil {
+			return 0
+		}
+		return max(expires.Sub(date), 0)
+	}
+
+	// Our heuristic: 10% of the time since the response was last modified (RFC 9111 section
+	// 4.2.2), up to a day
+	if !heuristicallyCacheable[status] {
+		return 0
+	}
+
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil || lastModified.After(date) {
+		return 0
+	}
+
+	return min(date.Sub(lastModified)/10, MAX_HEURISTIC_FRESHNESS)
+
+}
+
+// Returns the age of the given response when we received it, taking the origin's Age header
+// and any clock difference into account (RFC 9111 section 4.2.3)
+func correctedInitialAge(header http.Header, now time.Time) time.Duration {
+
+	var apparentAge time.Duration
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		apparentAge = max(now.Sub(date), 0)
+	}
+
+	var ageValue time.Duration
+	if seconds, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+
+	return max(apparentAge, ageValue)
+
+}
+
+// Parse a Cache-Control header into its directives (i.e. "max-age=60, public" gives
+// {"max-age": "60", "public": ""})
+func parseCacheControl(header string) map[string]string {
+
+	directives := map[string]string{}
+
+	for _, directive := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if name != "" {
+			directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+
+	return directives
+
+}
+
+// A response body which collects what's read through it, handing the full body over once it
+// has been read to the end. Bodies which turn out to be too large to cache are let go.
+type cachingBody struct {
+	body     io.ReadCloser
+	buffer   bytes.Buffer
+	tooLarge bool
+	done     func(body []byte)
+}
+
+func (cachingBody *cachingBody) Read(p []byte) (int, error) {
+
+	n, err := cachingBody.body.Read(p)
+
+	if !cachingBody.tooLarge {
+		if cachingBody.buffer.Len()+n > MAX_PROXY_CACHE_ENTRY_SIZE {
+			cachingBody.tooLarge = true
+			cachingBody.buffer = bytes.Buffer{}
+		} else {
+			cachingBody.buffer.Write(p[:n])
+		}
+	}
+
+	if err == io.EOF && !cachingBody.tooLarge && cachingBody.done != nil {
+		cachingBody.done(cachingBody.buffer.Bytes())
+		cachingBody.done = nil
+	}
+
+	return n, err
+
+}
+
+func (cachingBody *cachingBody) Close() error {
+	return cachingBody.body.Close()
+}
+
+// Our router in proxy mode: our own health, metrics and admin endpoints, with everything
+// else going to the origin
+func proxyRouteHandler(proxy *cachingProxy) *http.ServeMux {
+
+	router := http.NewServeMux()
+
+	handleRoute(router, "/health", http.HandlerFunc(healthHandler))
+	handleRoute(router, "/readyz", readinessHandler(proxy))
+	handleRoute(router, "/status", serverStatusHandler(proxy))
+	handleRoute(router, "/metrics", http.HandlerFunc(metricsHandler))
+	handleRoute(router, "/metrics/sparkline", http.HandlerFunc(sparklineHandler))
+	handleRoute(router, "/api/v1/metrics/query", http.HandlerFunc(metricsQueryHandler), http.MethodGet)
+	handleRoute(router, "/debug/trace/{id}", adminOnly(http.HandlerFunc(traceHandler)))
+	registerCaptureRoutes(router)
+	registerProfileRoutes(router)
+	handleRoute(router, "/debug/chaos", adminOnly(http.HandlerFunc(chaosAdminHandler)), http.MethodGet, http.MethodPut)
+	handleRoute(router, QUOTA_STATUS_PATH, http.HandlerFunc(quotaStatusHandler), http.MethodGet)
+	handleRoute(router, "/debug/access-rules", adminOnly(http.HandlerFunc(accessRulesAdminHandler)), http.MethodGet, http.MethodPut)
+	handleRoute(router, "/debug/circuits", adminOnly(circuitsAdminHandler(proxy)), http.MethodGet, http.MethodPost)
+	handleRoute(router, "/debug/config", adminOnly(http.HandlerFunc(configAdminHandler)))
+	handleRoute(router, "/debug/routes", adminOnly(http.HandlerFunc(routesAdminHandler)))
+	handleRoute(router, "/debug/report", adminOnly(http.HandlerFunc(reportAdminHandler)), http.MethodGet, http.MethodPost)
+	registerMockRoutes(router)
+
+	router.Handle("/", traceStage("handler: proxy")(proxy))
+
+	return router
+
+}
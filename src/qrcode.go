@@ -0,0 +1,495 @@
+// QR code generation. Text is encoded in byte mode with medium (M) error correction, using the
+// smallest QR code version (1 - 40) which fits it. The encoder follows the structure of the QR
+// code specification (ISO/IEC 18004): we build our data bit stream, add Reed-Solomon error
+// correction, draw the function patterns, place our codewords and pick the mask pattern with
+// the lowest penalty score. You can find a good walkthrough of the process here:
+// https://www.nayuki.io/page/creating-a-qr-code-step-by-step
+
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// The Reed-Solomon error correction codewords per block and number of blocks for each
+// version at error correction level M (indexed by version, so index 0 is unused)
+var (
+	qrErrorCorrectionCodewords = [...]int{-1,
+		10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26,
+		26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+	qrErrorCorrectionBlocks = [...]int{-1,
+		1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16,
+		17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+)
+
+// The error returned when text is too long to fit in even the largest QR code
+var errQRCodeTooLong = errors.New("the text is too long to encode as a QR code")
+
+// A QR code. Modules (the black and white squares) are indexed as modules[y][x] and are true
+// for dark modules.
+type qrCode struct {
+	version  int
+	size     int
+	modules  [][]bool
+	function [][]bool // Marks the modules which belong to function patterns
+}
+
+// Encode the given data as a QR code
+func encodeQRCode(data []byte) (*qrCode, error) {
+
+	// Find the smallest version which fits our data
+	version := 1
+	for ; version <= 40; version++ {
+		if 4+qrCharacterCountBits(version)+len(data)*8 <= qrDataCodewords(version)*8 {
+			break
+		}
+	}
+
+	if version > 40 {
+		return nil, errQRCodeTooLong
+	}
+
+	// Our bit stream: the byte mode indicator, the character count and then our data
+	var bits []bool
+	appendBits := func(value int, length int) {
+		for i := length - 1; i >= 0; i-- {
+			bits = append(bits, (value>>i)&1 != 0)
+		}
+	}
+
+	appendBits(0x4, 4)
+	appendBits(len(data), qrCharacterCountBits(version))
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+
+	// The terminator, padding to a whole byte and then alternating pad bytes
+	capacity := qrDataCodewords(version) * 8
+	appendBits(0, min(4, capacity-len(bits)))
+	appendBits(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		appendBits(pad, 8)
+	}
+
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i/8] |= 1 << (7 - i%8)
+		}
+	}
+
+	code := &qrCode{version: version, size: version*4 + 17}
+	code.modules = make([][]bool, code.size)
+	code.function = make([][]bool, code.size)
+	for y := range code.modules {
+		code.modules[y] = make([]bool, code.size)
+		code.function[y] = make([]bool, code.size)
+	}
+
+	code.drawFunctionPatterns()
+	code.drawCodewords(qrAddErrorCorrection(codewords, version))
+
+	// Try each of our mask patterns, keeping the one with the lowest penalty
+	bestMask, bestPenalty := 0, math.MaxInt
+	for mask := 0; mask < 8; mask++ {
+		code.applyMask(mask)
+		code.drawFormatBits(mask)
+		if penalty := code.penalty(); penalty < bestPenalty {
+			bestMask, bestPenalty = mask, penalty
+		}
+		code.applyMask(mask) // Masks are XORs, so applying them again undoes them
+	}
+
+	code.applyMask(bestMask)
+	code.drawFormatBits(bestMask)
+
+	return code, nil
+
+}
+
+// The number of bits used for the character count in byte mode
+func qrCharacterCountBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// The number of modules available for data and error correction codewords in the given version
+// (i.e. everything except the function patterns and format / version information)
+func qrRawDataModules(version int) int {
+
+	result := (16*version+128)*version + 64
+
+	if version >= 2 {
+		alignments := version/7 + 2
+		result -= (25*alignments-10)*alignments - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+
+	return result
+
+}
+
+// The number of data codewords (bytes) which fit in the given version
+func qrDataCodewords(version int) int {
+	return qrRawDataModules(version)/8 -
+		qrErrorCorrectionCodewords[version]*qrErrorCorrectionBlocks[version]
+}
+
+// Split our data codewords into blocks, add the error correction codewords for each block and
+// interleave the results
+func qrAddErrorCorrection(data []byte, version int) []byte {
+
+	blockCount := qrErrorCorrectionBlocks[version]
+	eccLength := qrErrorCorrectionCodewords[version]
+	rawCodewords := qrRawDataModules(version) / 8
+
+	// Some versions have two block lengths, with the longer blocks holding one extra byte
+	shortBlocks := blockCount - rawCodewords%blockCount
+	shortBlockLength := rawCodewords / blockCount
+
+	divisor := reedSolomonDivisor(eccLength)
+
+	var blocks [][]byte
+	for i, offset := 0, 0; i < blockCount; i++ {
+		length := shortBlockLength - eccLength
+		if i >= shortBlocks {
+			length++
+		}
+		block := append([]byte{}, data[offset:offset+length]...)
+		offset += length
+		ecc := reedSolomonRemainder(block, divisor)
+		if i < shortBlocks {
+			block = append(block, 0) // Padding so all blocks line up, skipped below
+		}
+		blocks = append(blocks, append(block, ecc...))
+	}
+
+	var result []byte
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			if i != shortBlockLength-eccLength || j >= shortBlocks {
+				result = append(result, block[i])
+			}
+		}
+	}
+
+	return result
+
+}
+
+// Returns the Reed-Solomon generator polynomial of the given degree (without its leading term)
+func reedSolomonDivisor(degree int) []byte {
+
+	result := make([]byte, degree)
+	result[degree-1] = 1
+
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = galoisMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = galoisMultiply(root, 0x02)
+	}
+
+	return result
+
+}
+
+// Returns the Reed-Solomon error correction codewords for the given data
+func reedSolomonRemainder(data []byte, divisor []byte) []byte {
+
+	result := make([]byte, len(divisor))
+
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range divisor {
+			result[i] ^= galoisMultiply(coefficient, factor)
+		}
+	}
+
+	return result
+
+}
+
+// Multiply two numbers in GF(2^8) modulo the QR code polynomial x^8 + x^4 + x^3 + x^2 + 1
+func galoisMultiply(x byte, y byte) byte {
+
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+
+	return byte(z)
+
+}
+
+// Set a function pattern module
+func (code *qrCode) setFunction(x int, y int, dark bool) {
+	code.modules[y][x] = dark
+	code.function[y][x] = true
+}
+
+// Draw our finder, timing and alignment patterns along with the version information. The
+// format bits are reserved here and drawn once we've chosen our mask.
+func (code *qrCode) drawFunctionPatterns() {
+
+	for i := 0; i < code.size; i++ {
+		code.setFunction(6, i, i%2 == 0)
+		code.setFunction(i, 6, i%2 == 0)
+	}
+
+	for _, corner := range [][2]int{{3, 3}, {code.size - 4, 3}, {3, code.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := corner[0]+dx, corner[1]+dy
+				if x >= 0 && x < code.size && y >= 0 && y < code.size {
+					distance := max(abs(dx), abs(dy))
+					code.setFunction(x, y, distance != 2 && distance != 4)
+				}
+			}
+		}
+	}
+
+	positions := code.alignmentPositions()
+	last := len(positions) - 1
+	for i, y := range positions {
+		for j, x := range positions {
+			// Alignment patterns never overlap our finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					code.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	code.drawFormatBits(0)
+
+	if code.version >= 7 {
+		remainder := code.version
+		for i := 0; i < 12; i++ {
+			remainder = (remainder << 1) ^ ((remainder >> 11) * 0x1F25)
+		}
+		bits := code.version<<12 | remainder
+		for i := 0; i < 18; i++ {
+			dark := (bits>>i)&1 != 0
+			a, b := code.size-11+i%3, i/3
+			code.setFunction(a, b, dark)
+			code.setFunction(b, a, dark)
+		}
+	}
+
+}
+
+// Returns the centre positions of the alignment patterns (along both axes)
+func (code *qrCode) alignmentPositions() []int {
+
+	if code.version == 1 {
+		return nil
+	}
+
+	count := code.version/7 + 2
+	step := (code.version*4 + count*2 + 1) / (count*2 - 2) * 2
+	if code.version == 32 {
+		step = 26
+	}
+
+	positions := make([]int, count)
+	positions[0] = 6
+	for i, position := count-1, code.size-7; i >= 1; i, position = i-1, position-step {
+		positions[i] = position
+	}
+
+	return positions
+
+}
+
+// Draw both copies of our format bits (error correction level M and the given mask)
+func (code *qrCode) drawFormatBits(mask int) {
+
+	data := 0<<3 | mask // Level M is encoded as 00
+	remainder := data
+	for i := 0; i < 10; i++ {
+		remainder = (remainder << 1) ^ ((remainder >> 9) * 0x537)
+	}
+	bits := (data<<10 | remainder) ^ 0x5412
+
+	bit := func(i int) bool { return (bits>>i)&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		code.setFunction(8, i, bit(i))
+	}
+	code.setFunction(8, 7, bit(6))
+	code.setFunction(8, 8, bit(7))
+	code.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		code.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		code.setFunction(code.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		code.setFunction(8, code.size-15+i, bit(i))
+	}
+	code.setFunction(8, code.size-8, true) // The dark module
+
+}
+
+// Place our codewords in a zigzag, two columns at a time from the bottom right corner,
+// skipping over the function patterns
+func (code *qrCode) drawCodewords(codewords []byte) {
+
+	i := 0
+	for right := code.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // Skip the vertical timing pattern
+		}
+		for vertical := 0; vertical < code.size; vertical++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vertical
+				if (right+1)&2 == 0 {
+					y = code.size - 1 - vertical // Moving upwards
+				}
+				if !code.function[y][x] && i < len(codewords)*8 {
+					code.modules[y][x] = (codewords[i/8]>>(7-i%8))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+
+}
+
+// XOR the given mask pattern over our data modules
+func (code *qrCode) applyMask(mask int) {
+
+	for y := 0; y < code.size; y++ {
+		for x := 0; x < code.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !code.function[y][x] {
+				code.modules[y][x] = !code.modules[y][x]
+			}
+		}
+	}
+
+}
+
+// Score our QR code using the specification's penalty rules. Lower scores are easier to scan.
+func (code *qrCode) penalty() int {
+
+	penalty := 0
+	dark := 0
+
+	// The finder-like pattern 1011101 with four light modules on either side
+	finderLike := []bool{true, false, true, true, true, false, true}
+
+	for a := 0; a < code.size; a++ {
+
+		// Runs of five or more modules of the same colour, in rows and columns
+		for _, vertical := range []bool{false, true} {
+			at := func(b int) bool {
+				if vertical {
+					return code.modules[b][a]
+				}
+				return code.modules[a][b]
+			}
+
+			run := 1
+			for b := 1; b <= code.size; b++ {
+				if b < code.size && at(b) == at(b-1) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += 3 + run - 5
+				}
+				run = 1
+			}
+
+			for b := 0; b+len(finderLike) <= code.size; b++ {
+				matches := true
+				for i, module := range finderLike {
+					if at(b+i) != module {
+						matches = false
+						break
+					}
+				}
+				if matches && (code.lightRun(at, b-4, b) || code.lightRun(at, b+7, b+11)) {
+					penalty += 40
+				}
+			}
+		}
+
+		for b := 0; b < code.size; b++ {
+			if code.modules[a][b] {
+				dark++
+			}
+			// 2x2 blocks of the same colour
+			if a+1 < code.size && b+1 < code.size {
+				module := code.modules[a][b]
+				if module == code.modules[a][b+1] && module == code.modules[a+1][b] && module == code.modules[a+1][b+1] {
+					penalty += 3
+				}
+			}
+		}
+	}
+
+	// How far the proportion of dark modules is from 50%
+	total := code.size * code.size
+	penalty += int(math.Abs(float64(dark*100)/float64(total)-50)) / 5 * 10
+
+	return penalty
+
+}
+
+// Returns true if the modules from start up to end are all light (modules outside of our
+// code count as light, since they're part of the quiet zone)
+func (code *qrCode) lightRun(at func(int) bool, start int, end int) bool {
+	for i := start; i < end; i++ {
+		if i >= 0 && i < code.size && at(i) {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
@@ -0,0 +1,371 @@
+// API keys and quotas. Our rate limiters (see tools.go) slow down bursts from each address, but
+// don't limit how much a client uses us over a day or a month. Given an -api-keys file:
+//
+//	{
+//		"keys": [
+//			{"name": "acme", "key_sha256": "9f86d081...", "daily": 5000, "monthly": 100000},
+//			{"name": "hobbyist", "key_sha256": "60303ae2..."}
+//		]
+//	}
+//
+// clients can send one of the keys with their requests, as Authorization: Bearer <key> or as an
+// X-Api-Key header, and each key is allowed a number of requests per (UTC) day and per month. Keys
+// without limits of their own get those of -quota-daily and -quota-monthly (0 meaning unlimited).
+// Only the SHA-256 digests of the keys are kept in the file, so that reading it doesn't give the
+// keys away. The server has no user accounts besides its admins (who aren't limited, and whose
+// bearer token isn't taken for an API key), so a key stands in for a user.
+//
+// Requests with an unknown key are refused (rather than served as anonymous requests), and once
+// a key has used up its quota its requests are refused with a 429 until the quota resets. Every
+// response to a request with a key carries its quota in X-Quota-Limit, X-Quota-Remaining and
+// X-Quota-Reset headers (for whichever of the daily and monthly quotas has least left), and
+// /api/v1/quota returns the state of both without using them up.
+//
+// Usage is kept in memory and, given -quota-file, saved to it every minute and when we shut
+// down, so that it survives restarts.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_QUOTA_DAILY   = 1000  // The requests a key may make a day, unless it has its own limit
+	DEFAULT_QUOTA_MONTHLY = 20000 // The requests a key may make a month, unless it has its own limit
+	QUOTA_SAVE_INTERVAL   = time.Minute
+	QUOTA_STATUS_PATH     = "/api/v1/quota"
+)
+
+// An API key as defined in our API keys file
+type apiKeyDefinition struct {
+	Name      string `json:"name"`
+	KeySHA256 string `json:"key_sha256"`
+	Daily     int    `json:"daily"`
+	Monthly   int    `json:"monthly"`
+}
+
+// The requests a key has made in the current day and month
+type quotaUsage struct {
+	Day     string `json:"day"` // i.e. 2026-10-16
+	Daily   int    `json:"daily"`
+	Month   string `json:"month"` // i.e. 2026-10
+	Monthly int    `json:"monthly"`
+}
+
+// The state of one of a key's quotas, as returned by /api/v1/quota
+type quotaPeriodStatus struct {
+	Limit     int       `json:"limit"` // 0 when the quota is unlimited
+	Used      int       `json:"used"`
+	Remaining int       `json:"remaining"`
+	Resets    time.Time `json:"resets"`
+}
+
+// Our API keys (by the hex SHA-256 digest of the key) and the usage of each (by name)
+var quotas = struct {
+	mutex sync.Mutex
+	keys  map[string]apiKeyDefinition
+	usage map[string]*quotaUsage
+	file  string
+	dirty bool // Whether our usage has changed since it was last saved
+}{keys: map[string]apiKeyDefinition{}, usage: map[string]*quotaUsage{}}
+
+// Load our API keys from the given JSON file, checking each of them
+func loadAPIKeys(path string) error {
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	var file struct {
+		Keys []apiKeyDefinition `json:"keys"`
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&file); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	keys := map[string]apiKeyDefinition{}
+	names := map[string]bool{}
+
+	for index, key := range file.Keys {
+
+		key.KeySHA256 = strings.ToLower(key.KeySHA256)
+
+		switch digest, err := hex.DecodeString(key.KeySHA256); {
+		case key.Name == "":
+			return fmt.Errorf("%s: key %d has no name", path, index+1)
+		case names[key.Name]:
+			return fmt.Errorf("%s: there are two keys named %s", path, key.Name)
+		case err != nil || len(digest) != sha256.Size:
+			return fmt.Errorf("%s: key %s: key_sha256 must be the hex SHA-256 digest of the key", path, key.Name)
+		case keys[key.KeySHA256].Name != "":
+			return fmt.Errorf("%s: keys %s and %s are the same key", path, keys[key.KeySHA256].Name, key.Name)
+		case key.Daily < 0 || key.Monthly < 0:
+			return fmt.Errorf("%s: key %s: the daily and monthly limits can't be negative", path, key.Name)
+		}
+
+		names[key.Name] = true
+		keys[key.KeySHA256] = key
+
+	}
+
+	quotas.mutex.Lock()
+	quotas.keys = keys
+	quotas.mutex.Unlock()
+
+	return nil
+
+}
+
+// Returns a component which loads our usage from the given file, saving it every
+// QUOTA_SAVE_INTERVAL and when it's stopped (see components.go)
+func newQuotaStore(path string) Component {
+
+	saver := newTickerComponent(QUOTA_SAVE_INTERVAL, func(now time.Time) {
+		if err := saveQuotaUsage(); err != nil {
+			logger.Println("Failed to save the quota usage:", err)
+		}
+	})
+
+	return componentFuncs{
+		start: func(ctx context.Context) error {
+			quotas.mutex.Lock()
+			quotas.file = path
+			err := loadJSONFile(path, &quotas.usage)
+			quotas.mutex.Unlock()
+			if err != nil {
+				return fmt.Errorf("invalid -quota-file: %w", err)
+			}
+			return saver.Start(ctx)
+		},
+		stop: func(ctx context.Context) error {
+			if err := saver.Stop(ctx); err != nil {
+				return err
+			}
+			return saveQuotaUsage()
+		},
+	}
+
+}
+
+// Save our usage to our quota file, if it's changed
+func saveQuotaUsage() error {
+
+	quotas.mutex.Lock()
+	defer quotas.mutex.Unlock()
+
+	if quotas.file == "" || !quotas.dirty {
+		return nil
+	}
+
+	if err := saveJSONFile(quotas.file, quotas.usage); err != nil {
+		return err
+	}
+
+	quotas.dirty = false
+	return nil
+
+}
+
+// Returns the API key the given request was sent with (or "" if it has none)
+func requestAPIKey(r *http.Request) string {
+	if key, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		return strings.TrimSpace(key)
+	}
+	return strings.TrimSpace(r.Header.Get("X-Api-Key"))
+}
+
+// Returns the definition of the given API key, if it's one of ours
+func lookupAPIKey(key string) (apiKeyDefinition, bool) {
+
+	digest := sha256.Sum256([]byte(key))
+
+	quotas.mutex.Lock()
+	defer quotas.mutex.Unlock()
+
+	definition, found := quotas.keys[hex.EncodeToString(digest[:])]
+	return definition, found
+
+}
+
+// Returns the daily and monthly limits of the given key
+func (key apiKeyDefinition) limits() (int, int) {
+	daily, monthly := key.Daily, key.Monthly
+	if daily == 0 {
+		daily = quotaDaily
+	}
+	if monthly == 0 {
+		monthly = quotaMonthly
+	}
+	return daily, monthly
+}
+
+// Returns the usage of the given key at the given time (starting a new day or month when the
+// last one has passed). The caller must hold our quotas mutex.
+func currentQuotaUsage(name string, now time.Time) *quotaUsage {
+
+	day, month := now.UTC().Format(time.DateOnly), now.UTC().Format("2006-01")
+
+	usage := quotas.usage[name]
+	if usage == nil {
+		usage = &quotaUsage{}
+		quotas.usage[name] = usage
+	}
+
+	if usage.Day != day {
+		usage.Day, usage.Daily = day, 0
+	}
+	if usage.Month != month {
+		usage.Month, usage.Monthly = month, 0
+	}
+
+	return usage
+
+}
+
+// Returns the state of the given key's daily and monthly quotas at the given time, optionally
+// using up a request of each. Returns whether the request is within the key's quotas (requests
+// beyond them aren't counted).
+func checkQuota(key apiKeyDefinition, now time.Time, use bool) (quotaPeriodStatus, quotaPeriodStatus, bool) {
+
+	dailyLimit, monthlyLimit := key.limits()
+
+	quotas.mutex.Lock()
+	defer quotas.mutex.Unlock()
+
+	usage := currentQuotaUsage(key.Name, now)
+
+	allowed := (dailyLimit == 0 || usage.Daily < dailyLimit) && (monthlyLimit == 0 || usage.Monthly < monthlyLimit)
+
+	if use && allowed {
+		usage.Daily++
+		usage.Monthly++
+		quotas.dirty = true
+	}
+
+	today := now.UTC().Truncate(24 * time.Hour)
+	thisMonth := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	return newQuotaPeriodStatus(dailyLimit, usage.Daily, today.AddDate(0, 0, 1)),
+		newQuotaPeriodStatus(monthlyLimit, usage.Monthly, thisMonth.AddDate(0, 1, 0)),
+		allowed
+
+}
+
+func newQuotaPeriodStatus(limit int, used int, resets time.Time) quotaPeriodStatus {
+	status := quotaPeriodStatus{Limit: limit, Used: used, Resets: resets}
+	if limit > 0 {
+		status.Remaining = max(0, limit-used)
+	}
+	return status
+}
+
+// Add the quota headers for the tighter of the given quotas to our response
+func setQuotaHeaders(w http.ResponseWriter, daily quotaPeriodStatus, monthly quotaPeriodStatus) {
+
+	tightest := daily
+	if daily.Limit == 0 || monthly.Limit > 0 && monthly.Remaining < daily.Remaining {
+		tightest = monthly
+	}
+
+	if tightest.Limit == 0 {
+		return
+	}
+
+	w.Header().Set("X-Quota-Limit", strconv.Itoa(tightest.Limit))
+	w.Header().Set("X-Quota-Remaining", strconv.Itoa(tightest.Remaining))
+	w.Header().Set("X-Quota-Reset", strconv.FormatInt(tightest.Resets.Unix(), 10))
+
+}
+
+// Returns a handler which applies the quotas of the API keys requests are sent with
+func quotaHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// Admins send their token as a bearer token too, which isn't one of our API keys
+		if apiKeysFile == "" || suppliesAdminToken(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		presented := requestAPIKey(r)
+
+		if presented == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, found := lookupAPIKey(presented)
+
+		if !found {
+			incrementCounter("quota_requests_total", "key", "unknown", "result", "invalid_key")
+			writeError(w, r, newAppError(http.StatusUnauthorized, "invalid_api_key", "The API key isn't valid."))
+			return
+		}
+
+		addLogField(r.Context(), "api_key", key.Name)
+
+		// Checking our quota doesn't use it up (and works once it's used up)
+		now := time.Now()
+		checking := strings.HasSuffix(r.URL.Path, QUOTA_STATUS_PATH)
+		daily, monthly, allowed := checkQuota(key, now, !checking)
+		setQuotaHeaders(w, daily, monthly)
+
+		if !allowed && !checking {
+			period, resets := "daily", daily.Resets
+			if daily.Limit == 0 || daily.Remaining > 0 {
+				period, resets = "monthly", monthly.Resets
+			}
+			incrementCounter("quota_requests_total", "key", key.Name, "result", "exceeded_"+period)
+			w.Header().Set("Retry-After", strconv.Itoa(int(resets.Sub(now).Seconds())+1))
+			writeError(w, r, newAppError(http.StatusTooManyRequests, "quota_exceeded",
+				fmt.Sprintf("The API key %s has used up its %s quota, which resets at %s.", key.Name, period, resets.Format(time.RFC3339))))
+			return
+		}
+
+		incrementCounter("quota_requests_total", "key", key.Name, "result", "allowed")
+		next.ServeHTTP(w, r)
+
+	})
+}
+
+// This is our quota status handler, which returns the state of the quotas of the API key it's
+// called with as JSON
+func quotaStatusHandler(w http.ResponseWriter, r *http.Request) {
+
+	key, found := lookupAPIKey(requestAPIKey(r))
+
+	if !found {
+		writeError(w, r, newAppError(http.StatusUnauthorized, "invalid_api_key",
+			"Send your API key as Authorization: Bearer <key> or X-Api-Key: <key> to see its quota."))
+		return
+	}
+
+	daily, monthly, _ := checkQuota(key, time.Now(), false)
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":     key.Name,
+		"daily":   daily,
+		"monthly": monthly,
+	})
+
+}
@@ -0,0 +1,56 @@
+// Response writer wrapper used by our middleware to find out how a handler responded.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// A statusRecorder wraps a response writer and records the status code (and the number of
+// body bytes) written by the handlers further down our middleware chain.
+type statusRecorder struct {
+	http.ResponseWriter
+	status       int
+	bytesWritten int64
+	wroteHeader  bool
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	// Handlers which never call WriteHeader implicitly respond with a 200 OK
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if !recorder.wroteHeader {
+		recorder.status = status
+		recorder.wroteHeader = true
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	recorder.wroteHeader = true
+	bytesWritten, err := recorder.ResponseWriter.Write(data)
+	recorder.bytesWritten += int64(bytesWritten)
+	return bytesWritten, err
+}
+
+// Flush passes flushes through to the underlying writer (if it supports them) so that
+// streaming handlers keep working when they're wrapped by our middleware.
+func (recorder *statusRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		recorder.wroteHeader = true
+		flusher.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying response writer
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// Returns the class of the given status code (i.e. 404 becomes "4xx")
+func statusClass(status int) string {
+	return fmt.Sprintf("%dxx", status/100)
+}
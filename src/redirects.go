@@ -0,0 +1,250 @@
+// Redirect rules. Legacy URLs can be redirected without code changes via a JSON file passed in
+// via the -redirects flag:
+//
+//	{
+//		"redirects": [
+//			{"match": "exact", "from": "/qr", "to": "/qr-code-generator"},
+//			{"match": "prefix", "from": "/blog/", "to": "https://blog.example.com/", "status": 302},
+//			{"match": "regex", "from": "^/users/([0-9]+)/profile$", "to": "/profiles/$1", "status": 308}
+//		]
+//	}
+//
+// Exact rules match a single path, prefix rules match every path under a prefix (with the rest
+// of the path appended to the target), and regex rules match a regular expression (whose groups
+// can be used in the target as $1, $2 and so on). Redirects are permanent (301) by default, and
+// the request's query string is kept unless preserve_query is false. The first matching rule
+// applies, and our redirect middleware runs ahead of our routes, so redirects take priority
+// over any page. Admins can replace the rules while we run (see accessrules.go).
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// A redirect rule as defined in our redirects file
+type redirectDefinition struct {
+	Match         string `json:"match"`
+	From          string `json:"from"`
+	To            string `json:"to"`
+	Status        int    `json:"status"`
+	PreserveQuery *bool  `json:"preserve_query"`
+}
+
+// A redirect rule ready to be applied
+type redirectRule struct {
+	match         string
+	from          string
+	to            string
+	pattern       *regexp.Regexp // The expression of regex rules
+	status        int
+	preserveQuery bool
+}
+
+// The redirect statuses we allow. 307 and 308 redirects keep the method (and body) of the
+// request, while 301 and 302 redirects turn it into a GET in most clients.
+var redirectStatuses = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusSeeOther:          true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+// Our redirect rules, in the order they're applied, along with the definitions they came from
+var redirects = struct {
+	mutex       sync.RWMutex
+	rules       []redirectRule
+	definitions []redirectDefinition
+}{}
+
+// Load our redirect rules from the given JSON file, checking each of them
+func loadRedirects(path string) error {
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	var file struct {
+		Redirects []redirectDefinition `json:"redirects"`
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&file); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	rules, err := newRedirectRules(file.Redirects)
+
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	setRedirectRules(rules, file.Redirects)
+
+	return nil
+
+}
+
+// Check and prepare the given redirect definitions
+func newRedirectRules(definitions []redirectDefinition) ([]redirectRule, error) {
+
+	rules := make([]redirectRule, 0, len(definitions))
+
+	for index, definition := range definitions {
+
+		rule, err := newRedirectRule(definition)
+
+		if err != nil {
+			return nil, fmt.Errorf("redirect %d (%s %s): %w", index+1, definition.Match, definition.From, err)
+		}
+
+		rules = append(rules, rule)
+
+	}
+
+	return rules, nil
+
+}
+
+// Replace our redirect rules
+func setRedirectRules(rules []redirectRule, definitions []redirectDefinition) {
+	redirects.mutex.Lock()
+	defer redirects.mutex.Unlock()
+	redirects.rules, redirects.definitions = rules, definitions
+}
+
+// Check and prepare the given redirect definition
+func newRedirectRule(definition redirectDefinition) (redirectRule, error) {
+
+	rule := redirectRule{
+		match:         definition.Match,
+		from:          definition.From,
+		to:            definition.To,
+		status:        definition.Status,
+		preserveQuery: definition.PreserveQuery == nil || *definition.PreserveQuery,
+	}
+
+	if rule.to == "" {
+		return rule, fmt.Errorf("the redirect needs a target (to)")
+	}
+
+	if rule.status == 0 {
+		rule.status = http.StatusMovedPermanently
+	}
+
+	if !redirectStatuses[rule.status] {
+		return rule, fmt.Errorf("invalid status %d: expected 301, 302, 303, 307 or 308", rule.status)
+	}
+
+	switch rule.match {
+	case "exact", "prefix":
+		if !strings.HasPrefix(rule.from, "/") {
+			return rule, fmt.Errorf("the path must start with a /")
+		}
+
+	case "regex":
+		pattern, err := regexp.Compile(rule.from)
+		if err != nil {
+			return rule, err
+		}
+		rule.pattern = pattern
+
+	default:
+		return rule, fmt.Errorf("invalid match %q: expected exact, prefix or regex", rule.match)
+	}
+
+	return rule, nil
+
+}
+
+// Returns where our rule redirects the given path to, if it matches the path. Targets starting
+// with // or /\ are refused, as browsers would take them to another host.
+func (rule redirectRule) target(path string) (string, bool) {
+
+	target, matched := rule.expand(path)
+
+	if matched && (strings.HasPrefix(target, "//") || strings.HasPrefix(target, `/\`)) {
+		return "", false
+	}
+
+	return target, matched
+
+}
+
+// Returns the target of our rule for the given path, if it matches the path
+func (rule redirectRule) expand(path string) (string, bool) {
+
+	switch rule.match {
+	case "exact":
+		return rule.to, path == rule.from
+
+	case "prefix":
+		if rest, found := strings.CutPrefix(path, rule.from); found {
+			// A path like /blog//evil.example mustn't turn a target of / into //evil.example
+			if strings.HasSuffix(rule.to, "/") {
+				rest = strings.TrimLeft(rest, `/\`)
+			}
+			return rule.to + rest, true
+		}
+
+	case "regex":
+		if match := rule.pattern.FindStringSubmatchIndex(path); match != nil {
+			return string(rule.pattern.ExpandString(nil, rule.to, path, match)), true
+		}
+	}
+
+	return "", false
+
+}
+
+// Returns a handler which redirects the requests matching our redirect rules
+func redirectHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		redirects.mutex.RLock()
+		rules := redirects.rules
+		redirects.mutex.RUnlock()
+
+		for _, rule := range rules {
+
+			target, matched := rule.target(r.URL.Path)
+
+			if !matched {
+				continue
+			}
+
+			if rule.preserveQuery && r.URL.RawQuery != "" {
+				if strings.Contains(target, "?") {
+					target += "&" + r.URL.RawQuery
+				} else {
+					target += "?" + r.URL.RawQuery
+				}
+			}
+
+			// Make sure a rule can't redirect a page to itself
+			if target == r.URL.RequestURI() {
+				break
+			}
+
+			incrementCounter("redirects_total", "match", rule.match, "from", rule.from)
+			http.Redirect(w, r, target, rule.status)
+			return
+
+		}
+
+		next.ServeHTTP(w, r)
+
+	})
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestRedirectRuleTargets(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		definition redirectDefinition
+		path       string
+		target     string // "" when the rule mustn't redirect
+	}{
+		{"exact", redirectDefinition{Match: "exact", From: "/qr", To: "/qr-code-generator"}, "/qr", "/qr-code-generator"},
+		{"prefix", redirectDefinition{Match: "prefix", From: "/blog/", To: "https://blog.example.com/"}, "/blog/post", "https://blog.example.com/post"},
+		{"prefix to a sub-path", redirectDefinition{Match: "prefix", From: "/old/", To: "/new/"}, "/old/a/b", "/new/a/b"},
+		{"prefix with a doubled slash", redirectDefinition{Match: "prefix", From: "/old/", To: "/"}, "/old//evil.example", "/evil.example"},
+		{"prefix with a backslash", redirectDefinition{Match: "prefix", From: "/old/", To: "/"}, `/old/\evil.example`, "/evil.example"},
+		{"prefix without a trailing slash", redirectDefinition{Match: "prefix", From: "/old", To: "/new"}, "/old/page", "/new/page"},
+		{"regex", redirectDefinition{Match: "regex", From: "^/users/([0-9]+)$", To: "/profiles/$1"}, "/users/42", "/profiles/42"},
+		{"regex to another host", redirectDefinition{Match: "regex", From: "^/go/(.*)$", To: "/$1"}, "/go//evil.example", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			rule, err := newRedirectRule(test.definition)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			target, matched := rule.target(test.path)
+
+			if matched != (test.target != "") || target != test.target {
+				t.Errorf("got %q (matched %t), want %q", target, matched, test.target)
+			}
+
+		})
+	}
+
+}
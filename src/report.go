@@ -0,0 +1,263 @@
+// Scheduled report emails. With -report-to set (and email configured, see mail.go), we email a
+// daily summary of the requests we served to the given addresses at -report-time (UTC): request
+// counts by status class, our busiest routes, error counts and our slowest requests. The
+// summary is rendered from REPORT_EMAIL_TEMPLATE, and covers the requests since the previous
+// report (or since the server started).
+//
+// Admins can preview the report (without sending it or resetting it) at /debug/report, and
+// send it straight away with a POST to the same endpoint (which, like our other admin forms,
+// needs a CSRF token or an X-Requested-With header, see adminOnly).
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	REPORT_TOP_ROUTES       = 10 // The number of routes listed in our reports
+	REPORT_SLOWEST_REQUESTS = 5  // The number of slow requests listed in our reports
+	DEFAULT_REPORT_TIME     = "08:00"
+)
+
+// A request as listed in our reports
+type reportRequest struct {
+	RequestID string
+	Method    string
+	Path      string
+	Status    int
+	Duration  time.Duration
+}
+
+// A route and the number of requests it served
+type reportRoute struct {
+	Route    string
+	Requests int
+}
+
+// The requests we've served since our last report
+var reportStats = struct {
+	mutex    sync.Mutex
+	since    time.Time
+	byClass  map[string]int
+	byRoute  map[string]int
+	errors   map[string]int // Server errors by route
+	slowest  []reportRequest
+	requests int
+}{since: time.Now(), byClass: map[string]int{}, byRoute: map[string]int{}, errors: map[string]int{}}
+
+// Record a finished request in our report statistics
+func recordReportRequest(trace *requestTrace) {
+
+	trace.mutex.Lock()
+	request := reportRequest{
+		RequestID: trace.RequestID,
+		Method:    trace.Method,
+		Path:      trace.Path,
+		Status:    trace.Status,
+		Duration:  trace.Duration,
+	}
+	route := trace.Route
+	trace.mutex.Unlock()
+
+	// Requests which didn't match any of our routes are grouped together
+	if route == "" {
+		route = "(other)"
+	}
+
+	reportStats.mutex.Lock()
+	defer reportStats.mutex.Unlock()
+
+	reportStats.requests++
+	reportStats.byClass[statusClass(request.Status)]++
+	reportStats.byRoute[route]++
+
+	if request.Status >= http.StatusInternalServerError {
+		reportStats.errors[route]++
+	}
+
+	// Keep our slowest requests, slowest first
+	position, _ := slices.BinarySearchFunc(reportStats.slowest, request, func(a, b reportRequest) int {
+		return cmp.Compare(b.Duration, a.Duration)
+	})
+	if position < REPORT_SLOWEST_REQUESTS {
+		reportStats.slowest = slices.Insert(reportStats.slowest, position, request)
+		reportStats.slowest = reportStats.slowest[:min(len(reportStats.slowest), REPORT_SLOWEST_REQUESTS)]
+	}
+
+}
+
+// The data we pass into our report template
+type reportData struct {
+	Server    string
+	Since     time.Time
+	Until     time.Time
+	Requests  int
+	ByClass   map[string]int
+	TopRoutes []reportRoute
+	Errors    []reportRoute
+	Slowest   []reportRequest
+}
+
+// Returns our report of the requests since our last report
+func currentReport() reportData {
+
+	reportStats.mutex.Lock()
+	defer reportStats.mutex.Unlock()
+
+	server, _ := os.Hostname()
+
+	data := reportData{
+		Server:    server,
+		Since:     reportStats.since.UTC(),
+		Until:     time.Now().UTC(),
+		Requests:  reportStats.requests,
+		ByClass:   maps.Clone(reportStats.byClass),
+		TopRoutes: topReportRoutes(reportStats.byRoute),
+		Errors:    topReportRoutes(reportStats.errors),
+		Slowest:   slices.Clone(reportStats.slowest),
+	}
+
+	return data
+
+}
+
+// Start a new report
+func resetReport() {
+
+	reportStats.mutex.Lock()
+	defer reportStats.mutex.Unlock()
+
+	reportStats.since = time.Now()
+	reportStats.byClass = map[string]int{}
+	reportStats.byRoute = map[string]int{}
+	reportStats.errors = map[string]int{}
+	reportStats.slowest = nil
+	reportStats.requests = 0
+
+}
+
+// Returns the routes with the most requests, busiest first
+func topReportRoutes(counts map[string]int) []reportRoute {
+
+	var routes []reportRoute
+	for route, requests := range counts {
+		routes = append(routes, reportRoute{Route: route, Requests: requests})
+	}
+
+	slices.SortFunc(routes, func(a, b reportRoute) int {
+		if a.Requests != b.Requests {
+			return b.Requests - a.Requests
+		}
+		return strings.Compare(a.Route, b.Route)
+	})
+
+	return routes[:min(len(routes), REPORT_TOP_ROUTES)]
+
+}
+
+// This is the template of our report emails (as plain text)
+const REPORT_EMAIL_TEMPLATE = `Daily report for {{ .Server }}
+{{ .Since.Format "2 Jan 2006 15:04" }} to {{ .Until.Format "2 Jan 2006 15:04" }} UTC
+
+Requests: {{ .Requests }}
+{{ range $class, $count := .ByClass }}  {{ $class }}: {{ $count }}
+{{ end }}
+Top routes:
+{{ range .TopRoutes }}  {{ .Route }}: {{ .Requests }}
+{{ else }}  (none)
+{{ end }}
+Server errors:
+{{ range .Errors }}  {{ .Route }}: {{ .Requests }}
+{{ else }}  (none)
+{{ end }}
+Slowest requests:
+{{ range .Slowest }}  {{ .Duration }} {{ .Method }} {{ .Path }} {{ .Status }} (request ID {{ .RequestID }})
+{{ else }}  (none)
+{{ end }}`
+
+var reportEmailTemplate = template.Must(template.New("report.email").Parse(REPORT_EMAIL_TEMPLATE))
+
+// Render the given report as the body of an email
+func renderReport(data reportData) (string, error) {
+
+	var body bytes.Buffer
+
+	if err := reportEmailTemplate.Execute(&body, data); err != nil {
+		return "", err
+	}
+
+	return body.String(), nil
+
+}
+
+// Email our report to our report recipients, starting a new report once it's sent
+func sendReport() error {
+
+	to, err := parseMailAddresses(reportTo)
+
+	if err != nil {
+		return err
+	}
+
+	data := currentReport()
+	body, err := renderReport(data)
+
+	if err != nil {
+		return err
+	}
+
+	if err := sendMail("report", to, fmt.Sprintf("Daily report for %s", data.Server), body); err != nil {
+		return err
+	}
+
+	resetReport()
+
+	return nil
+
+}
+
+// This is our admin-only report handler. GET previews our next report, while POST emails it
+// straight away.
+func reportAdminHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method == http.MethodPost {
+
+		if reportTo == "" {
+			writeError(w, r, badRequestError("There are no report recipients (see the -report-to flag)."))
+			return
+		}
+
+		if err := sendReport(); err != nil {
+			writeError(w, r, newAppError(http.StatusBadGateway, "email_failed", "The report couldn't be sent.").Wrap(err))
+			return
+		}
+
+		setContentType(w, CONTENT_TYPE_TEXT)
+		fmt.Fprintln(w, "sent")
+		return
+
+	}
+
+	body, err := renderReport(currentReport())
+
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("rendering the report"))
+		return
+	}
+
+	setContentType(w, CONTENT_TYPE_TEXT)
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprint(w, body)
+
+}
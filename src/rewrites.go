@@ -0,0 +1,124 @@
+// Internal URL rewrites. A rewrite gives one of our pages a cleaner address without a redirect:
+// the request is served as if it had been made to the rewritten URL, while the visitor's address
+// bar keeps the pretty one. For example /qr/wifi is served by /qr-code-generator?preset=wifi,
+// and the old addresses keep working as before.
+//
+// Rewrites map a route pattern (whose {wildcards} can be used in the target) to a target path
+// and query string. The query string of the request is added to the target's, so that i.e.
+// /weather/London?units=imperial becomes /weather?city=London&units=imperial. Rewrites are
+// listed (along with every route) on the admin-only /debug/routes endpoint.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// A Rewrite serves the requests matching a route pattern from another URL
+type Rewrite struct {
+	From string `json:"from"` // The route pattern, i.e. /qr/{preset}
+	To   string `json:"to"`   // The target, i.e. /qr-code-generator?preset={preset}
+}
+
+// All of our rewrites (see registerRewrite), and those registered with our router (none in
+// proxy mode, where every other request goes to the origin)
+var rewriteRegistry, activeRewrites []Rewrite
+
+// Matches the {wildcards} used within a rewrite's target
+var rewriteWildcardPattern = regexp.MustCompile(`\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+func init() {
+	registerRewrite("/qr/{preset}", "/qr-code-generator?preset={preset}")
+	registerRewrite("/weather/{city}", "/weather?city={city}")
+	registerRewrite("/tools/dns/{name}", "/tools?tool=dns&name={name}")
+	registerRewrite("/tools/rdns/{ip}", "/tools?tool=rdns&ip={ip}")
+}
+
+// Register a rewrite from the given route pattern to the given target
+func registerRewrite(from, to string) {
+	rewriteRegistry = append(rewriteRegistry, Rewrite{From: from, To: to})
+}
+
+// Register the routes of our rewrites with the given router, which also serves the rewritten
+// requests
+func registerRewrites(router *http.ServeMux) {
+	for _, rewrite := range rewriteRegistry {
+		// The methods are up to the route we rewrite to, so we don't use handleRoute here
+		router.Handle(rewrite.From, traceStage("rewrite: "+rewrite.From)(rewriteHandler(router, rewrite)))
+		activeRewrites = append(activeRewrites, rewrite)
+	}
+}
+
+// Returns the target of our rewrite for the given (matching) request, with its wildcards
+// filled in from the request's path and its query string merged with the request's
+func (rewrite Rewrite) target(r *http.Request) (path, rawQuery string) {
+
+	path, rawQuery, _ = strings.Cut(rewrite.To, "?")
+
+	path = rewriteWildcardPattern.ReplaceAllStringFunc(path, func(wildcard string) string {
+		return url.PathEscape(r.PathValue(strings.Trim(wildcard, "{}")))
+	})
+	rawQuery = rewriteWildcardPattern.ReplaceAllStringFunc(rawQuery, func(wildcard string) string {
+		return url.QueryEscape(r.PathValue(strings.Trim(wildcard, "{}")))
+	})
+
+	if r.URL.RawQuery != "" {
+		if rawQuery != "" {
+			rawQuery += "&"
+		}
+		rawQuery += r.URL.RawQuery
+	}
+
+	return path, rawQuery
+
+}
+
+// Returns a handler which serves the requests matching our rewrite from its target
+func rewriteHandler(router *http.ServeMux, rewrite Rewrite) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// Shallow copy our request and URL so that we don't modify the original request
+		// (which our logging middleware uses)
+		rewrittenRequest := new(http.Request)
+		*rewrittenRequest = *r
+		rewrittenURL := *r.URL
+		rewrittenRequest.URL = &rewrittenURL
+
+		path, rawQuery := rewrite.target(r)
+
+		if unescapedPath, err := url.PathUnescape(path); err == nil {
+			rewrittenRequest.URL.Path, rewrittenRequest.URL.RawPath = unescapedPath, path
+		} else {
+			rewrittenRequest.URL.Path, rewrittenRequest.URL.RawPath = path, ""
+		}
+		rewrittenRequest.URL.RawQuery = rawQuery
+
+		// Make sure a rewrite can't rewrite a page to itself
+		if _, pattern := router.Handler(rewrittenRequest); pattern == rewrite.From {
+			writeError(w, r, notFoundError())
+			return
+		}
+
+		incrementCounter("rewrites_total", "from", rewrite.From)
+		router.ServeHTTP(w, rewrittenRequest)
+
+	})
+}
+
+// This is our admin-only routes handler, which lists every route registered with our router
+// along with the methods it accepts, and our rewrites
+func routesAdminHandler(w http.ResponseWriter, r *http.Request) {
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	w.Header().Set("Cache-Control", "no-store")
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"routes":   routeRegistry,
+		"rewrites": activeRewrites,
+	})
+
+}
@@ -0,0 +1,147 @@
+// Route registry and HTTP method handling. Every route records the methods it accepts so
+// that we can automatically answer HEAD requests, respond to OPTIONS requests with an accurate
+// Allow header, and reject unsupported methods with a 405.
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Route is a pattern registered with our router along with the methods it accepts
+type Route struct {
+	Pattern string   `json:"pattern"`
+	Methods []string `json:"methods"`
+}
+
+// All of the routes registered with our router (see handleRoute)
+var routeRegistry []Route
+
+// Register the given handler for the given pattern, only allowing it to be called with the
+// given methods. If no methods are passed in, the route only accepts GET requests. HEAD and
+// OPTIONS requests are handled automatically, and routes which are part of a feature respond
+// with a 404 while the feature is disabled (see features.go).
+func handleRoute(router *http.ServeMux, pattern string, handler http.Handler, methods ...string) {
+
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet}
+	}
+
+	routeRegistry = append(routeRegistry, Route{Pattern: pattern, Methods: methods})
+
+	handler = featureHandler(pattern, methodHandler(methods, traceStage("handler: "+pattern)(handler)))
+
+	router.Handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setTraceRoute(r.Context(), pattern)
+		handler.ServeHTTP(w, r)
+	}))
+
+}
+
+// Returns the value of the Allow header for a route accepting the given methods
+func allowHeader(methods []string) string {
+
+	allowed := map[string]bool{http.MethodOptions: true}
+	for _, method := range methods {
+		allowed[method] = true
+		if method == http.MethodGet {
+			allowed[http.MethodHead] = true
+		}
+	}
+
+	var allowedMethods []string
+	for method := range allowed {
+		allowedMethods = append(allowedMethods, method)
+	}
+	sort.Strings(allowedMethods)
+
+	return strings.Join(allowedMethods, ", ")
+
+}
+
+// Returns a handler which only passes on requests using one of the given methods
+func methodHandler(methods []string, next http.Handler) http.Handler {
+
+	allow := allowHeader(methods)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		for _, method := range methods {
+			if r.Method == method {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		switch {
+		case r.Method == http.MethodOptions:
+			w.Header().Set("Allow", allow)
+			w.WriteHeader(http.StatusNoContent)
+
+		case r.Method == http.MethodHead && strings.Contains(allow, http.MethodGet):
+			serveHead(w, r, next)
+
+		default:
+			w.Header().Set("Allow", allow)
+			writeError(w, r, newAppError(http.StatusMethodNotAllowed, "method_not_allowed",
+				"The "+r.Method+" method is not allowed for this page."))
+		}
+
+	})
+
+}
+
+// Answer a HEAD request by running the GET handler against a writer which discards the body,
+// so that the client receives exactly the headers (including the content length) which a GET
+// request would have produced.
+func serveHead(w http.ResponseWriter, r *http.Request, next http.Handler) {
+
+	headWriter := &headResponseWriter{header: make(http.Header), status: http.StatusOK}
+	next.ServeHTTP(headWriter, r)
+
+	for key, values := range headWriter.header {
+		w.Header()[key] = values
+	}
+
+	if w.Header().Get("Content-Length") == "" && headWriter.status >= 200 &&
+		headWriter.status != http.StatusNoContent && headWriter.status != http.StatusNotModified {
+		w.Header().Set("Content-Length", strconv.FormatInt(headWriter.bytesWritten, 10))
+	}
+
+	w.WriteHeader(headWriter.status)
+
+}
+
+// A response writer which records the headers and status of a response and counts (but
+// otherwise discards) its body
+type headResponseWriter struct {
+	header       http.Header
+	status       int
+	bytesWritten int64
+	wroteHeader  bool
+}
+
+func (headWriter *headResponseWriter) Header() http.Header {
+	return headWriter.header
+}
+
+func (headWriter *headResponseWriter) WriteHeader(status int) {
+	if !headWriter.wroteHeader {
+		headWriter.status = status
+		headWriter.wroteHeader = true
+	}
+}
+
+func (headWriter *headResponseWriter) Write(data []byte) (int, error) {
+	headWriter.wroteHeader = true
+	headWriter.bytesWritten += int64(len(data))
+	return len(data), nil
+}
+
+// Our catch-all handler for requests which don't match any of our routes
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, notFoundError())
+}
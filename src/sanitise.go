@@ -0,0 +1,218 @@
+// HTML sanitisation. User supplied HTML must never be wrapped in template.HTML as it is, as it
+// could carry scripts into our pages, so it goes through sanitiseHTML first (as does the raw
+// HTML in markdown rendered with the relaxed policy, see markdown.go). The sanitiser works from
+// an allowlist: each allowed tag is rebuilt from its allowed attributes, the URLs of links and
+// images are limited to relative URLs and allowed schemes, and everything else (other tags,
+// comments, and the text between tags, which could hide broken markup) is escaped.
+//
+// The allowlist is defaultHTMLPolicy, which can be replaced with a JSON file given by
+// -html-policy, i.e. {"tags": ["b", "i", "a"], "attributes": ["href"], "url_schemes": ["https"]}.
+// Tags and attributes which can run scripts, load other documents or submit forms (see
+// forbiddenHTMLTags and forbiddenHTMLAttributes) are refused even if a policy allows them, so a
+// careless policy can't reopen the holes the sanitiser closes.
+//
+// The html_sanitised_total metric counts what the sanitiser removed by kind (tag, attribute or
+// url), which shows when a policy is stricter than the content it's used for.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Which HTML the sanitiser lets through
+type htmlPolicy struct {
+	Tags       []string `json:"tags"`
+	Attributes []string `json:"attributes"`
+	URLSchemes []string `json:"url_schemes"` // Allowed in href, src and cite, besides relative URLs
+}
+
+// Our allowlist of formatting tags and harmless attributes
+var defaultHTMLPolicy = htmlPolicy{
+	Tags: []string{"a", "abbr", "b", "blockquote", "br", "caption", "cite", "code", "dd", "del",
+		"details", "div", "dl", "dt", "em", "h1", "h2", "h3", "h4", "h5", "h6", "hr", "i", "img",
+		"ins", "kbd", "li", "mark", "ol", "p", "pre", "q", "s", "samp", "small", "span", "strong",
+		"sub", "summary", "sup", "table", "tbody", "td", "tfoot", "th", "thead", "tr", "u", "ul"},
+	Attributes: []string{"alt", "align", "colspan", "height", "href", "open", "rowspan", "src",
+		"title", "width"},
+	URLSchemes: []string{"http", "https", "mailto"},
+}
+
+// Tags and attributes no policy may allow, as they can run scripts, load other documents, submit
+// forms or restyle our page. Event handler attributes (on...) are refused too.
+var (
+	forbiddenHTMLTags = []string{"applet", "base", "button", "embed", "form", "frame", "frameset",
+		"iframe", "input", "link", "math", "meta", "noembed", "noframes", "noscript", "object",
+		"plaintext", "script", "select", "style", "svg", "template", "textarea", "title", "xmp"}
+	forbiddenHTMLAttributes = []string{"action", "background", "class", "data", "dynsrc",
+		"formaction", "id", "longdesc", "lowsrc", "poster", "srcdoc", "srcset", "style", "xmlns",
+		"xlink:href"}
+	forbiddenURLSchemes = []string{"data", "file", "javascript", "vbscript"}
+)
+
+// The attributes which hold URLs, whose schemes we check
+var htmlURLAttributes = []string{"cite", "href", "src"}
+
+var (
+	// An HTML start or end tag (i.e. <a href="/">) or comment
+	htmlTagPattern       = regexp.MustCompile(`^(?:<(/?)([A-Za-z][A-Za-z0-9-]*)((?:\s+[^\s"'>/=]+(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'=<>` + "`" + `]+))?)*)\s*(/?)>|<!--[\s\S]*?-->)`)
+	htmlAttributePattern = regexp.MustCompile(`([^\s"'>/=]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'=<>` + "`" + `]+)))?`)
+	htmlNamePattern      = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+)
+
+// The policy the sanitiser uses, which is our default unless -html-policy replaces it
+var activeHTMLPolicy = struct {
+	mutex  sync.RWMutex
+	policy htmlPolicy
+}{policy: defaultHTMLPolicy}
+
+// Replace our policy with the one in the given JSON file
+func loadHTMLPolicy(path string) error {
+
+	var policy htmlPolicy
+	if err := loadJSONFile(path, &policy); err != nil {
+		return err
+	}
+	if policy.Tags == nil {
+		return fmt.Errorf("%s doesn't exist or doesn't list any tags", path)
+	}
+
+	for _, list := range []struct {
+		kind      string
+		names     []string
+		forbidden []string
+	}{
+		{"tag", policy.Tags, forbiddenHTMLTags},
+		{"attribute", policy.Attributes, forbiddenHTMLAttributes},
+		{"URL scheme", policy.URLSchemes, forbiddenURLSchemes},
+	} {
+		for i, name := range list.names {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if !htmlNamePattern.MatchString(name) {
+				return fmt.Errorf("%q isn't a valid %s name", name, list.kind)
+			}
+			if slices.Contains(list.forbidden, name) || (list.kind == "attribute" && strings.HasPrefix(name, "on")) {
+				return fmt.Errorf("the %s %q isn't safe to allow", list.kind, name)
+			}
+			list.names[i] = name
+		}
+	}
+
+	activeHTMLPolicy.mutex.Lock()
+	activeHTMLPolicy.policy = policy
+	activeHTMLPolicy.mutex.Unlock()
+
+	return nil
+
+}
+
+// Returns the policy the sanitiser uses
+func currentHTMLPolicy() htmlPolicy {
+	activeHTMLPolicy.mutex.RLock()
+	defer activeHTMLPolicy.mutex.RUnlock()
+	return activeHTMLPolicy.policy
+}
+
+// Returns the given user supplied HTML with everything our policy doesn't allow removed or
+// escaped, ready to be included in our pages
+func sanitiseHTML(source string) template.HTML {
+	policy := currentHTMLPolicy()
+	// template-audit: this is our sanitiser
+	return template.HTML(policy.sanitise(source))
+}
+
+// Returns the given HTML with each tag our policy allows rebuilt from its allowed attributes,
+// and everything else escaped
+func (policy htmlPolicy) sanitise(source string) string {
+
+	var output strings.Builder
+
+	for i := 0; i < len(source); {
+
+		match := htmlTagPattern.FindStringSubmatch(source[i:])
+
+		if source[i] != '<' || match == nil {
+			end := len(source)
+			if next := strings.IndexByte(source[i+1:], '<'); next >= 0 {
+				end = i + 1 + next
+			}
+			output.WriteString(html.EscapeString(source[i:end]))
+			i = end
+			continue
+		}
+
+		i += len(match[0])
+		closing, name, attributes := match[1] == "/", strings.ToLower(match[2]), match[3]
+
+		// Comments are dropped, and tags we don't allow are shown as text
+		if name == "" || !slices.Contains(policy.Tags, name) || slices.Contains(forbiddenHTMLTags, name) {
+			incrementCounter("html_sanitised_total", "kind", "tag")
+			if name != "" {
+				output.WriteString(html.EscapeString(match[0]))
+			}
+			continue
+		}
+
+		if closing {
+			output.WriteString("</" + name + ">")
+			continue
+		}
+
+		output.WriteString("<" + name)
+		for _, attribute := range htmlAttributePattern.FindAllStringSubmatch(attributes, -1) {
+			attributeName := strings.ToLower(attribute[1])
+			if !policy.allowsAttribute(attributeName) {
+				incrementCounter("html_sanitised_total", "kind", "attribute")
+				continue
+			}
+			value := html.UnescapeString(attribute[2] + attribute[3] + attribute[4])
+			if slices.Contains(htmlURLAttributes, attributeName) {
+				value = policy.safeURL(value)
+			}
+			output.WriteString(" " + attributeName + `="` + html.EscapeString(value) + `"`)
+		}
+		output.WriteString(">")
+	}
+
+	return output.String()
+
+}
+
+// Returns whether our policy allows the given (lower case) attribute
+func (policy htmlPolicy) allowsAttribute(name string) bool {
+	return slices.Contains(policy.Attributes, name) && !slices.Contains(forbiddenHTMLAttributes, name) &&
+		!strings.HasPrefix(name, "on")
+}
+
+// Returns the given URL if it's relative or uses one of our policy's schemes, or "#" otherwise
+// (i.e. for javascript: URLs)
+func (policy htmlPolicy) safeURL(destination string) string {
+
+	// Browsers ignore control characters and whitespace within a scheme (i.e. java\tscript:)
+	scheme, _, found := strings.Cut(strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, destination), ":")
+
+	if !found || strings.ContainsAny(scheme, "/?#") {
+		return destination
+	}
+
+	scheme = strings.ToLower(scheme)
+	if slices.Contains(policy.URLSchemes, scheme) && !slices.Contains(forbiddenURLSchemes, scheme) {
+		return destination
+	}
+
+	incrementCounter("html_sanitised_total", "kind", "url")
+
+	return "#"
+
+}
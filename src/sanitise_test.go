@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSanitiseHTMLRemovesScripts(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		// Script tags are shown as text, whatever their case
+		{"script", `<script>alert(1)</script>`, `&lt;script&gt;alert(1)&lt;/script&gt;`},
+		{"upper case script", `<SCRIPT SRC="https://evil.example/x.js"></SCRIPT>`, `&lt;SCRIPT SRC=&#34;https://evil.example/x.js&#34;&gt;&lt;/SCRIPT&gt;`},
+		{"mixed case script", `<ScRiPt>alert(1)</sCrIpT>`, `&lt;ScRiPt&gt;alert(1)&lt;/sCrIpT&gt;`},
+		{"script in a comment", `<!-- <script>alert(1)</script> -->`, ``},
+		{"unclosed tag", `<img src=x onerror=alert(1)//`, `&lt;img src=x onerror=alert(1)//`},
+
+		// Event handler attributes are dropped from the tags we allow
+		{"onerror", `<img src="/a.png" onerror="alert(1)">`, `<img src="/a.png">`},
+		{"mixed case onerror", `<IMG SRC="/a.png" OnError="alert(1)">`, `<img src="/a.png">`},
+		{"unquoted onclick", `<p onclick=alert(1)>hi</p>`, `<p>hi</p>`},
+
+		// Script and data URLs are replaced, however they're written
+		{"javascript URL", `<a href="javascript:alert(1)">x</a>`, `<a href="#">x</a>`},
+		{"mixed case javascript URL", `<a href="JaVaScRiPt:alert(1)">x</a>`, `<a href="#">x</a>`},
+		{"javascript URL with a leading space", `<a href=" javascript:alert(1)">x</a>`, `<a href="#">x</a>`},
+		{"javascript URL with an encoded tab", `<a href="java&#x09;script:alert(1)">x</a>`, `<a href="#">x</a>`},
+		{"javascript URL with a decimal entity", `<a href="&#106;avascript:alert(1)">x</a>`, `<a href="#">x</a>`},
+		{"javascript URL with named and hex entities", `<a href="jav&#x61;script&colon;alert(1)">x</a>`, `<a href="#">x</a>`},
+		{"vbscript URL", `<a href="vbscript:msgbox(1)">x</a>`, `<a href="#">x</a>`},
+		{"data URL image", `<img src="data:image/svg+xml;base64,PHN2Zz4=">`, `<img src="#">`},
+		{"upper case data URL", `<a href="DATA:text/html,<script>alert(1)</script>">x</a>`, `<a href="#">x</a>`},
+
+		// SVG can run scripts of its own, so it's never allowed
+		{"svg onload", `<svg onload="alert(1)"><circle/></svg>`, `&lt;svg onload=&#34;alert(1)&#34;&gt;&lt;circle/&gt;&lt;/svg&gt;`},
+		{"upper case svg onload without spaces", `<SVG/onload=alert(1)>`, `&lt;SVG/onload=alert(1)&gt;`},
+		{"script in svg", `<svg><script>alert(1)</script></svg>`, `&lt;svg&gt;&lt;script&gt;alert(1)&lt;/script&gt;&lt;/svg&gt;`},
+
+		// Escaped markup stays escaped
+		{"entity encoded script", `&lt;script&gt;alert(1)&lt;/script&gt;`, `&amp;lt;script&amp;gt;alert(1)&amp;lt;/script&amp;gt;`},
+
+		// While the markup we allow is kept
+		{"allowed markup", `<a href="https://example.com/" title="ok">link</a> <b>bold</b>`, `<a href="https://example.com/" title="ok">link</a> <b>bold</b>`},
+		{"relative URL", `<a href="/relative?q=1">x</a>`, `<a href="/relative?q=1">x</a>`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := string(sanitiseHTML(test.source)); got != test.want {
+				t.Errorf("sanitiseHTML(%q) = %q, want %q", test.source, got, test.want)
+			}
+		})
+	}
+
+}
+
+func TestSanitiseHTMLRefusesForbiddenMarkupWhicheverPolicy(t *testing.T) {
+
+	// A careless policy allowing everything we refuse
+	policy := htmlPolicy{
+		Tags:       []string{"a", "img", "script", "svg"},
+		Attributes: []string{"href", "src", "onload", "onerror", "style"},
+		URLSchemes: []string{"https", "javascript", "data"},
+	}
+
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{`<script>alert(1)</script>`, `&lt;script&gt;alert(1)&lt;/script&gt;`},
+		{`<svg onload="alert(1)">`, `&lt;svg onload=&#34;alert(1)&#34;&gt;`},
+		{`<img src="/a.png" onerror="alert(1)" style="color: red">`, `<img src="/a.png">`},
+		{`<a href="javascript:alert(1)">x</a>`, `<a href="#">x</a>`},
+		{`<img src="data:image/png;base64,AAAA">`, `<img src="#">`},
+	}
+
+	for _, test := range tests {
+		if got := policy.sanitise(test.source); got != test.want {
+			t.Errorf("sanitise(%q) = %q, want %q", test.source, got, test.want)
+		}
+	}
+
+}
@@ -0,0 +1,103 @@
+// A tiny job scheduler. Jobs run every day at a set time of day (in UTC), each in its own
+// goroutine, with their runs (and failures) logged and counted in scheduled_jobs_total. Each
+// job is a component (see components.go), so it stops with the server rather than being cut off
+// part way through a run.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Parse a time of day in the form HH:MM (i.e. 08:30) into its offset from midnight
+func parseTimeOfDay(value string) (time.Duration, error) {
+
+	parsed, err := time.Parse("15:04", value)
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: expected HH:MM", value)
+	}
+
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+
+}
+
+// Returns the next time after now which is the given offset from midnight (UTC)
+func nextDailyRun(now time.Time, at time.Duration) time.Time {
+
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Add(at)
+
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+
+	return next
+
+}
+
+// A job which runs every day at a set time, until it's stopped
+type dailyJob struct {
+	name   string
+	at     time.Duration // The offset from midnight (UTC)
+	job    func() error
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Returns a component which runs the named job every day at the given offset from midnight (UTC)
+func newDailyJob(name string, at time.Duration, job func() error) *dailyJob {
+	return &dailyJob{name: name, at: at, job: job}
+}
+
+func (daily *dailyJob) Start(ctx context.Context) error {
+
+	logger.Printf("Scheduled the %s job to run daily at %02d:%02d UTC", daily.name, int(daily.at.Hours()), int(daily.at.Minutes())%60)
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	daily.cancel, daily.done = cancel, make(chan struct{})
+
+	go func() {
+		defer close(daily.done)
+		for {
+
+			timer := time.NewTimer(time.Until(nextDailyRun(time.Now(), daily.at)))
+			select {
+			case <-timer.C:
+			case <-runCtx.Done():
+				timer.Stop()
+				return
+			}
+
+			if err := daily.job(); err != nil {
+				incrementCounter("scheduled_jobs_total", "job", daily.name, "result", "failure")
+				logger.Printf("The scheduled %s job failed: %v", daily.name, err)
+				continue
+			}
+
+			incrementCounter("scheduled_jobs_total", "job", daily.name, "result", "success")
+			logger.Printf("The scheduled %s job ran", daily.name)
+
+		}
+	}()
+
+	return nil
+
+}
+
+// Stop scheduling our job, waiting (until the given context is done) for a run in progress to
+// finish
+func (daily *dailyJob) Stop(ctx context.Context) error {
+
+	daily.cancel()
+
+	select {
+	case <-daily.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("the %s job is still running: %w", daily.name, ctx.Err())
+	}
+
+}
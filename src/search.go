@@ -0,0 +1,489 @@
+// Full-text search across our demo content: our pages, the markdown documents of our site (in
+// static site mode, see site.go), the QR codes visitors have shared (see feed.go), the todo items
+// and pastes of our GraphQL API (see graphqldata.go) and, for admins, the names of uploaded files
+// (see uploads.go).
+//
+// Content is kept in a small in-memory inverted index (term -> document -> term frequency),
+// which is rebuilt on a search once it's older than SEARCH_INDEX_MAX_AGE, so new content shows
+// up within a few seconds. Results are ranked by TF-IDF (with title matches counting extra) and
+// come with a snippet of the text around the first match. /search is the search page, while
+// /api/v1/search?q=...&limit=... returns the results as JSON.
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	SEARCH_INDEX_MAX_AGE      = 10 * time.Second
+	SEARCH_TITLE_WEIGHT       = 3 // How much more a term in a title counts than one in the text
+	SEARCH_SNIPPET_LENGTH     = 160
+	DEFAULT_SEARCH_LIMIT      = 20
+	MAX_SEARCH_LIMIT          = 100
+	MAX_SEARCH_QUERY_LENGTH   = 200
+	MAX_SEARCH_SITE_DOCUMENTS = 1000    // The most markdown documents we index
+	MAX_SEARCH_DOCUMENT_SIZE  = 1 << 20 // The largest markdown document we index
+)
+
+// A piece of content in our search index
+type searchDocument struct {
+	Kind      string // page, markdown, qr-code, todo, paste or upload
+	Title     string
+	URL       string
+	Text      string
+	AdminOnly bool // Whether only admins may find the document
+	length    int  // The number of terms in the document
+}
+
+// Our inverted index
+type searchIndex struct {
+	built     time.Time
+	documents []searchDocument
+	postings  map[string]map[int]int // Term -> document index -> (weighted) term frequency
+}
+
+var search = struct {
+	mutex sync.Mutex
+	index *searchIndex
+}{}
+
+// A search result
+type searchResult struct {
+	Kind    string  `json:"kind"`
+	Title   string  `json:"title"`
+	URL     string  `json:"url"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+	matches []string
+}
+
+// Split the given text into lower case search terms
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Returns our search index, rebuilding it if it's out of date
+func currentSearchIndex() *searchIndex {
+
+	search.mutex.Lock()
+	defer search.mutex.Unlock()
+
+	if search.index == nil || time.Since(search.index.built) > SEARCH_INDEX_MAX_AGE {
+		search.index = buildSearchIndex(collectSearchDocuments())
+		incrementCounter("search_index_builds_total")
+	}
+
+	return search.index
+
+}
+
+// Gather all of the content we search across
+func collectSearchDocuments() []searchDocument {
+
+	var documents []searchDocument
+
+	for _, page := range navPages() {
+		documents = append(documents, searchDocument{Kind: "page", Title: page.Title, URL: urlFor(page.Path), Text: page.Title})
+	}
+
+	sharedQRCodes.mutex.Lock()
+	for _, code := range sharedQRCodes.codes {
+		documents = append(documents, searchDocument{Kind: "qr-code", Title: code.Text,
+			URL: urlFor("/qr-code-generator?qr_code_text=" + url.QueryEscape(code.Text)), Text: code.Text})
+	}
+	sharedQRCodes.mutex.Unlock()
+
+	// Todo items have no page of their own, so they link to the query listing them
+	todosURL := urlFor("/api/graphql?query=" + url.QueryEscape("{ todos { id title done } }"))
+
+	graphQLData.mutex.Lock()
+	for _, todo := range graphQLData.todos {
+		documents = append(documents, searchDocument{Kind: "todo", Title: todo.Title, URL: todosURL, Text: todo.Title})
+	}
+	for _, paste := range graphQLData.pastes {
+		documents = append(documents, searchDocument{Kind: "paste", Title: cmp.Or(paste.Title, "Untitled paste"),
+			URL: urlFor(PASTE_PATH_PREFIX + paste.ID), Text: paste.Content})
+	}
+	graphQLData.mutex.Unlock()
+
+	if uploads, err := listUploads(); err == nil {
+		for _, upload := range uploads {
+			documents = append(documents, searchDocument{Kind: "upload", Title: upload.Name,
+				URL: urlFor("/uploads/" + url.PathEscape(upload.Name)), Text: upload.Name, AdminOnly: true})
+		}
+	}
+
+	if siteFiles != nil {
+		documents = append(documents, siteSearchDocuments(siteFiles.FS())...)
+	}
+
+	return documents
+
+}
+
+// Returns the markdown documents of our site
+func siteSearchDocuments(files fs.FS) []searchDocument {
+
+	var documents []searchDocument
+
+	fs.WalkDir(files, ".", func(name string, entry fs.DirEntry, err error) error {
+
+		if err != nil || len(documents) >= MAX_SEARCH_SITE_DOCUMENTS {
+			return fs.SkipDir
+		}
+
+		// Hidden files and directories are never served, so they're never found either
+		if strings.HasPrefix(entry.Name(), ".") && name != "." {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if entry.IsDir() || path.Ext(name) != ".md" {
+			return nil
+		}
+
+		file, err := files.Open(name)
+		if err != nil {
+			return nil
+		}
+		source, err := io.ReadAll(io.LimitReader(file, MAX_SEARCH_DOCUMENT_SIZE))
+		file.Close()
+		if err != nil {
+			return nil
+		}
+
+		title := markdownTitle(string(source))
+		if title == "" {
+			title = path.Base(name)
+		}
+
+		// Our snippets are plain text, so we drop the formatting characters (and heading
+		// markers) of the markdown
+		text := markdownPlainText(strings.ReplaceAll(string(source), "#", ""))
+
+		documents = append(documents, searchDocument{Kind: "markdown", Title: title,
+			URL: (&url.URL{Path: sitePath + "/" + name}).EscapedPath(), Text: text})
+
+		return nil
+
+	})
+
+	return documents
+
+}
+
+// Build an inverted index of the given documents
+func buildSearchIndex(documents []searchDocument) *searchIndex {
+
+	index := &searchIndex{built: time.Now(), documents: documents, postings: make(map[string]map[int]int)}
+
+	add := func(document int, text string, weight int) {
+		for _, term := range searchTerms(text) {
+			if index.postings[term] == nil {
+				index.postings[term] = make(map[int]int)
+			}
+			index.postings[term][document] += weight
+			index.documents[document].length++
+		}
+	}
+
+	for document := range index.documents {
+		add(document, index.documents[document].Title, SEARCH_TITLE_WEIGHT)
+		add(document, index.documents[document].Text, 1)
+	}
+
+	return index
+
+}
+
+// Search our index for the documents matching every term of the given query, best first.
+// Admin-only documents are only found by admins.
+func (index *searchIndex) search(query string, admin bool) []searchResult {
+
+	terms := searchTerms(query)
+	slices.Sort(terms)
+	terms = slices.Compact(terms)
+
+	if len(terms) == 0 {
+		return nil
+	}
+
+	scores := map[int]float64{}
+
+	for position, term := range terms {
+
+		postings := index.postings[term]
+
+		// Rarer terms count for more
+		inverseFrequency := math.Log(1 + float64(len(index.documents))/float64(1+len(postings)))
+
+		for document, frequency := range postings {
+			// Every term must match, so only documents which matched all of the earlier
+			// terms are kept
+			if _, found := scores[document]; !found && position > 0 {
+				continue
+			}
+			termFrequency := float64(frequency) / float64(index.documents[document].length)
+			scores[document] += termFrequency * inverseFrequency
+		}
+
+		for document := range scores {
+			if _, found := postings[document]; !found {
+				delete(scores, document)
+			}
+		}
+
+	}
+
+	var results []searchResult
+
+	for document, score := range scores {
+		if index.documents[document].AdminOnly && !admin {
+			continue
+		}
+		results = append(results, searchResult{
+			Kind:    index.documents[document].Kind,
+			Title:   index.documents[document].Title,
+			URL:     index.documents[document].URL,
+			Score:   math.Round(score*10000) / 10000,
+			Snippet: searchSnippet(index.documents[document].Text, terms),
+			matches: terms,
+		})
+	}
+
+	slices.SortFunc(results, func(a, b searchResult) int {
+		if a.Score != b.Score {
+			if a.Score > b.Score {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Title, b.Title)
+	})
+
+	return results
+
+}
+
+// Returns the part of the given text around the first match of one of the given terms
+func searchSnippet(text string, terms []string) string {
+
+	text = strings.Join(strings.Fields(text), " ")
+	lower := strings.ToLower(text)
+
+	first := -1
+	for _, term := range terms {
+		if position := strings.Index(lower, term); position >= 0 && (first < 0 || position < first) {
+			first = position
+		}
+	}
+
+	// Lower casing can change the length of some characters, in which case we start from the
+	// beginning rather than risk splitting a character
+	if len(lower) != len(text) || first < 0 {
+		first = 0
+	}
+
+	start := max(0, first-SEARCH_SNIPPET_LENGTH/4)
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	end := min(len(text), start+SEARCH_SNIPPET_LENGTH)
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	snippet := text[start:end]
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(text) {
+		snippet += "…"
+	}
+
+	return snippet
+
+}
+
+// A part of a snippet, which is either a match of our query or not
+type snippetPart struct {
+	Text  string
+	Match bool
+}
+
+// Returns the parts of our result's snippet, so that our template can highlight the matches
+func (result searchResult) SnippetParts() []snippetPart {
+
+	var parts []snippetPart
+	var current strings.Builder
+	currentMatch := false
+
+	flush := func() {
+		if current.Len() > 0 {
+			parts = append(parts, snippetPart{Text: current.String(), Match: currentMatch})
+			current.Reset()
+		}
+	}
+
+	// Walk the snippet word by word, keeping the characters between words as they are
+	word := strings.Builder{}
+	emitWord := func() {
+		if word.Len() == 0 {
+			return
+		}
+		match := slices.Contains(result.matches, strings.ToLower(word.String()))
+		if match != currentMatch {
+			flush()
+			currentMatch = match
+		}
+		current.WriteString(word.String())
+		word.Reset()
+	}
+
+	for _, r := range result.Snippet {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			word.WriteRune(r)
+			continue
+		}
+		emitWord()
+		if currentMatch {
+			flush()
+			currentMatch = false
+		}
+		current.WriteRune(r)
+	}
+	emitWord()
+	flush()
+
+	return parts
+
+}
+
+// Run the search of the given request (the q parameter), returning the query and its results
+func runSearch(r *http.Request) (string, []searchResult, error) {
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	if len(query) > MAX_SEARCH_QUERY_LENGTH {
+		return query, nil, badRequestError("The search query can be at most 200 characters long.")
+	}
+
+	limit := DEFAULT_SEARCH_LIMIT
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > MAX_SEARCH_LIMIT {
+			return query, nil, badRequestError("The limit must be a number between 1 and 100.")
+		}
+		limit = parsed
+	}
+
+	if query == "" {
+		return query, nil, nil
+	}
+
+	defer startSpan(r.Context(), "search")()
+
+	results := currentSearchIndex().search(query, isAdminRequest(r))
+	if len(results) == 0 {
+		incrementCounter("search_queries_total", "results", "none")
+	} else {
+		incrementCounter("search_queries_total", "results", "some")
+	}
+
+	return query, results[:min(len(results), limit)], nil
+
+}
+
+// This is our search API handler, which returns the results of a search as JSON
+func searchAPIHandler(w http.ResponseWriter, r *http.Request) {
+
+	query, results, err := runSearch(r)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if results == nil {
+		results = []searchResult{}
+	}
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	json.NewEncoder(w).Encode(map[string]interface{}{"query": query, "results": results})
+
+}
+
+// This is a template string we use to construct the body of our search page
+const SEARCH_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>Search</h2>
+		<form action="{{ url "/search" }}" method="GET">
+			<input maxLength=200 size=40 name="q" value="{{ .Query }}" placeholder="Search pages, documents and QR codes">
+			<input type="submit" value="Search">
+		</form>
+		{{ if .Query }}
+		{{ range .Results }}
+		<h4><a href="{{ .URL }}">{{ .Title }}</a> <small>({{ .Kind }})</small></h4>
+		<p>{{ range .SnippetParts }}{{ if .Match }}<mark>{{ .Text }}</mark>{{ else }}{{ .Text }}{{ end }}{{ end }}</p>
+		{{ else }}
+		<p>Nothing matched your search.</p>
+		{{ end }}
+		{{ end }}
+	</div>
+`
+
+func init() {
+	registerPage(Page{Title: "Search", Path: "/search", Order: 100, Visible: true, Section: SECTION_SITE, Handler: searchHandler})
+}
+
+// The data we pass into our search body template
+type searchPageData struct {
+	Query   string
+	Results []searchResult
+}
+
+// This is our search page handler
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+
+	query, results, err := runSearch(r)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	body, err := renderFragment(searchBodyTemplate, searchPageData{Query: query, Results: results})
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the search body template"))
+		return
+	}
+
+	renderMainTemplate(w, r, "search", HtmlData{
+		Title:       "Golang Search",
+		Description: "Full-text search across the demo content with an inverted index.",
+		Keywords:    "golang web server search inverted index tf-idf",
+		CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+		BodyContent: body,
+	})
+
+}
@@ -0,0 +1,219 @@
+// Secrets. Our secret flags (-admin-token, -smtp-password, -weather-key, -privacy-salt and
+// -signing-keys) take either the secret itself or a reference to where it's kept, so that secrets
+// needn't be written on our command line (where anyone who can list processes can read them):
+//
+//	env:NAME              the environment variable NAME
+//	file:/path/to/secret  the contents of a file (without a trailing newline), which must only
+//	                      be readable by its owner (i.e. chmod 600)
+//	vault:path#key        the key of a secret in HashiCorp Vault (KV version 1 or 2), read from
+//	                      $VAULT_ADDR with $VAULT_TOKEN, i.e. vault:secret/data/web#smtp_password
+//
+// Anything else is taken as the secret itself. References are resolved once at startup (apart
+// from those of -signing-keys, which are reloaded on SIGHUP, see signing.go), and other managers
+// can be added by implementing secretProvider and adding it to secretProviders.
+//
+// Secret values are never logged or shown on /status (which only lists where each secret came
+// from), and our errors name the reference rather than the value.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const VAULT_TIMEOUT = 10 * time.Second
+
+// Somewhere secrets are kept, which looks them up by the name a reference gives (the part after
+// the provider's prefix)
+type secretProvider interface {
+	secret(name string) (string, error)
+}
+
+// Our providers, by the prefix of their references
+var secretProviders = map[string]secretProvider{
+	"env":   envSecrets{},
+	"file":  fileSecrets{},
+	"vault": vaultSecrets{},
+}
+
+// Where each of our secrets came from (the flag itself or a provider's prefix), for /status
+var secretSources = struct {
+	mutex   sync.Mutex
+	sources map[string]string
+}{sources: make(map[string]string)}
+
+type envSecrets struct{}
+
+type fileSecrets struct{}
+
+type vaultSecrets struct{}
+
+// A secret flag, along with the variable it sets
+type secretFlag struct {
+	flag     string
+	value    *string
+	reloaded bool // Whether its reference is kept and resolved (and reloaded) by its own feature
+}
+
+// Our secret flags, which are also redacted on /debug/config (see config.go)
+var secretFlags = []secretFlag{
+	{"admin-token", &adminToken, false},
+	{"smtp-password", &smtpPassword, false},
+	{"weather-key", &weatherKey, false},
+	{"privacy-salt", &privacySalt, false},
+	{"signing-keys", &signingKeysReference, true}, // See signing.go
+}
+
+// Resolve the references of our secret flags into their values
+func loadSecrets() error {
+
+	for _, secret := range secretFlags {
+		if secret.reloaded {
+			continue
+		}
+		value, err := resolveSecret(secret.flag, *secret.value)
+		if err != nil {
+			return err
+		}
+		*secret.value = value
+	}
+
+	return nil
+
+}
+
+// Returns the secret the given flag's value refers to (or the value itself, if it isn't a
+// reference)
+func resolveSecret(flagName string, reference string) (string, error) {
+
+	if reference == "" {
+		return "", nil
+	}
+
+	source := "flag"
+	value := reference
+
+	if prefix, name, found := strings.Cut(reference, ":"); found {
+		if provider, known := secretProviders[prefix]; known {
+			var err error
+			if value, err = provider.secret(name); err != nil {
+				return "", fmt.Errorf("-%s %s: %w", flagName, reference, err)
+			}
+			if value == "" {
+				return "", fmt.Errorf("-%s %s is empty", flagName, reference)
+			}
+			source = prefix
+		}
+	}
+
+	secretSources.mutex.Lock()
+	secretSources.sources[flagName] = source
+	secretSources.mutex.Unlock()
+
+	return value, nil
+
+}
+
+// Returns where each of our secrets came from, for /status
+func currentSecretSources() map[string]string {
+	secretSources.mutex.Lock()
+	defer secretSources.mutex.Unlock()
+	return maps.Clone(secretSources.sources)
+}
+
+func (envSecrets) secret(name string) (string, error) {
+	value, found := os.LookupEnv(name)
+	if !found {
+		return "", errors.New("isn't set")
+	}
+	return value, nil
+}
+
+func (fileSecrets) secret(path string) (string, error) {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	// A secret anyone else on the machine can read isn't much of a secret
+	if info.Mode().Perm()&0o077 != 0 {
+		return "", fmt.Errorf("can be read by others (its permissions are %v), it should only be readable by its owner (chmod 600)", info.Mode().Perm())
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(contents), "\r\n"), nil
+
+}
+
+func (vaultSecrets) secret(name string) (string, error) {
+
+	path, key, found := strings.Cut(name, "#")
+	if !found || path == "" || key == "" {
+		return "", errors.New("should be in the form vault:path#key")
+	}
+
+	address, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if address == "" || token == "" {
+		return "", errors.New("needs VAULT_ADDR and VAULT_TOKEN to be set")
+	}
+
+	request, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(address, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("X-Vault-Token", token)
+
+	client := &http.Client{Timeout: VAULT_TIMEOUT}
+	started := time.Now()
+	response, err := client.Do(request)
+	logOutboundCall(request, 0, response, err, time.Since(started))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	// Vault's error bodies can echo what we sent, so we only go by the status
+	if response.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, response.Body)
+		return "", fmt.Errorf("vault answered with a %d", response.StatusCode)
+	}
+
+	// Version 2 of the KV engine nests the secret's data (and its metadata) in data.data
+	var secret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("reading vault's answer: %w", err)
+	}
+	data := secret.Data
+	if nested, ok := data["data"]; ok {
+		if _, versioned := data["metadata"]; versioned {
+			data = nil
+			if err := json.Unmarshal(nested, &data); err != nil {
+				return "", fmt.Errorf("reading vault's answer: %w", err)
+			}
+		}
+	}
+
+	var value string
+	if err := json.Unmarshal(data[key], &value); err != nil {
+		return "", fmt.Errorf("the secret doesn't have a %s string", key)
+	}
+
+	return value, nil
+
+}
@@ -0,0 +1,118 @@
+// Server-Timing headers. With the -server-timing flag set, each response carries a
+// Server-Timing header built from its request trace (see trace.go), so that the network panel
+// of the browser's developer tools shows where the server's time went, i.e.
+//
+//	Server-Timing: metrics;dur=1.92, logging;dur=1.85, routing;dur=1.62,
+//		handler;desc="handler: /svg";dur=1.58, template;desc="template: svg";dur=0.41, total;dur=1.95
+//
+// Headers are written before the body, so the header holds the stages up to that point:
+// stages which are still running (i.e. our middleware and the handler itself) show the time
+// spent in them until the response started, and total is the time to the first byte. Stages
+// nest, so the time spent in a middleware stage itself is its duration minus the next one's.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Returns the Server-Timing header value for the given trace so far
+func serverTiming(trace *requestTrace) string {
+
+	now := time.Now()
+
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+
+	var metrics []string
+
+	for _, span := range trace.Spans {
+
+		duration := span.Duration
+		if duration == SPAN_IN_PROGRESS {
+			duration = now.Sub(trace.Started) - span.Start
+		}
+
+		// Metric names are tokens, so spans named after what they handle (i.e. "template: svg")
+		// are named after their kind, with the full span name as the description
+		name, _, detailed := strings.Cut(span.Name, ":")
+		name = serverTimingToken(name)
+
+		metric := name
+		if detailed {
+			metric += fmt.Sprintf(";desc=%q", span.Name)
+		}
+
+		metrics = append(metrics, metric+";dur="+serverTimingDuration(duration))
+
+	}
+
+	metrics = append(metrics, "total;dur="+serverTimingDuration(now.Sub(trace.Started)))
+
+	return strings.Join(metrics, ", ")
+
+}
+
+// Returns the given name with any characters which aren't allowed in Server-Timing metric names
+// replaced by dashes
+func serverTimingToken(name string) string {
+	return strings.Map(func(character rune) rune {
+		if character >= 'a' && character <= 'z' || character >= 'A' && character <= 'Z' ||
+			character >= '0' && character <= '9' || character == '_' || character == '-' {
+			return character
+		}
+		return '-'
+	}, strings.TrimSpace(name))
+}
+
+// Server-Timing durations are in (fractional) milliseconds
+func serverTimingDuration(duration time.Duration) string {
+	return fmt.Sprintf("%.2f", float64(duration)/float64(time.Millisecond))
+}
+
+// A serverTimingWriter adds our Server-Timing header to a response just before its headers
+// are written
+type serverTimingWriter struct {
+	http.ResponseWriter
+	trace       *requestTrace
+	wroteHeader bool
+}
+
+func newServerTimingWriter(w http.ResponseWriter, trace *requestTrace) *serverTimingWriter {
+	return &serverTimingWriter{ResponseWriter: w, trace: trace}
+}
+
+func (writer *serverTimingWriter) addHeader() {
+	if !writer.wroteHeader {
+		writer.wroteHeader = true
+		writer.Header().Set("Server-Timing", serverTiming(writer.trace))
+	}
+}
+
+func (writer *serverTimingWriter) WriteHeader(status int) {
+	// Informational responses (i.e. 103 Early Hints) come before the real headers
+	if status >= 200 {
+		writer.addHeader()
+	}
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *serverTimingWriter) Write(data []byte) (int, error) {
+	writer.addHeader()
+	return writer.ResponseWriter.Write(data)
+}
+
+func (writer *serverTimingWriter) Flush() {
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		writer.addHeader()
+		flusher.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying response writer
+func (writer *serverTimingWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
@@ -0,0 +1,102 @@
+// Signed download links for uploaded files. Uploaded files are private (see uploads.go), but an
+// admin can share one for a while by handing out a link which carries the file's name and an
+// expiry, signed with our signing keys (see signing.go). /shared/{token} serves the file to
+// anyone holding an unexpired link, without them signing in and without the upload directory
+// being listed. Links are checked rather than stored, so they can't be revoked one by one:
+// renaming the file or rotating our signing keys revokes them.
+//
+// Admins see a link for each file on the upload page, valid for -share-lifetime, and can ask for
+// links with other lifetimes (up to MAX_SHARE_LIFETIME) from /debug/share?name=...&lifetime=2h.
+// Shared files are always served as downloads, so that an uploaded HTML file can't run as one of
+// our pages.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_SHARE_LIFETIME = 24 * time.Hour
+	MAX_SHARE_LIFETIME     = 7 * 24 * time.Hour
+)
+
+// Returns a signed link to the given uploaded file which expires after the given lifetime, along
+// with when it expires
+func signedUploadURL(name string, lifetime time.Duration) (string, time.Time) {
+	expires := time.Now().Add(lifetime).Truncate(time.Second)
+	token := signValue("upload:" + strconv.FormatInt(expires.Unix(), 10) + ":" + name)
+	return urlFor("/shared/" + token), expires
+}
+
+// This is our shared file handler, which serves the uploaded file a signed link refers to until
+// the link expires
+func sharedFileHandler(w http.ResponseWriter, r *http.Request) {
+
+	value, ok := verifySignedValue(r.PathValue("token"))
+	fields := strings.SplitN(value, ":", 3)
+	if !ok || len(fields) != 3 || fields[0] != "upload" || sanitiseFileName(fields[2]) != fields[2] {
+		incrementCounter("shared_downloads_total", "result", "invalid")
+		writeError(w, r, notFoundError())
+		return
+	}
+
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		incrementCounter("shared_downloads_total", "result", "expired")
+		writeError(w, r, newAppError(http.StatusGone, "link_expired", "This link has expired. Please ask for a new one."))
+		return
+	}
+
+	// Links are for whoever they're sent to, so they shouldn't be indexed or cached by proxies
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Cache-Control", "private, no-store")
+
+	incrementCounter("shared_downloads_total", "result", "served")
+	extendWriteDeadline(w, r, DOWNLOAD_WRITE_TIMEOUT)
+	serveFile(w, r, filepath.Join(uploadDir, fields[2]), fields[2])
+
+}
+
+// This is our admin-only share handler, which returns a signed link to the uploaded file given by
+// its name parameter, valid for its lifetime parameter (-share-lifetime by default)
+func shareAdminHandler(w http.ResponseWriter, r *http.Request) {
+
+	name := r.FormValue("name")
+	if name == "" || sanitiseFileName(name) != name {
+		writeError(w, r, badRequestError(fmt.Sprintf("%q isn't the name of an uploaded file.", name)))
+		return
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, name)); err != nil {
+		writeError(w, r, newAppError(http.StatusNotFound, "not_found", fmt.Sprintf("%s hasn't been uploaded.", name)).Wrap(err))
+		return
+	}
+
+	lifetime := shareLifetime
+	if value := r.FormValue("lifetime"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 || parsed > MAX_SHARE_LIFETIME {
+			writeError(w, r, badRequestError(fmt.Sprintf("The lifetime must be a duration (i.e. 2h) of at most %v.", MAX_SHARE_LIFETIME)))
+			return
+		}
+		lifetime = parsed
+	}
+
+	link, expires := signedUploadURL(name, lifetime)
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":    name,
+		"url":     siteBaseURL(r) + link,
+		"expires": expires.UTC(),
+	})
+
+}
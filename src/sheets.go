@@ -0,0 +1,698 @@
+// Saved spreadsheets. The Excel demo can save its sheet on the server under a name, and every
+// save becomes a new revision (recording when it was saved and by whom), so that earlier versions
+// can be loaded again and compared. We keep the MAX_SHEET_REVISIONS most recent revisions of up
+// to MAX_SAVED_SHEETS sheets, saved to -sheets-file (if given) so that they survive restarts.
+//
+// The server has no user accounts or sessions, so a revision's author is the name given when it
+// was saved (or "anonymous").
+//
+//   - GET /api/v1/sheets/{name}: the sheet's latest revision (or ?revision=N)
+//   - POST /api/v1/sheets/{name}: save a new revision from {"data": [[...], ...], "author": "..."}
+//   - GET /api/v1/sheets/{name}/revisions: the sheet's revisions, newest first
+//   - /sheets/{name}: the sheet's history page, which the Excel demo's save form POSTs to (with
+//     data and author fields), sending the browser on to the history with a flash (see flash.go)
+//   - /sheets/{name}/diff?from=N&to=M: the cells which changed between two revisions (as JSON
+//     for JSON clients)
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	MAX_SAVED_SHEETS       = 100
+	MAX_SHEET_REVISIONS    = 50 // The revisions we keep of each sheet
+	MAX_SHEET_AUTHOR       = 64
+	SHEET_SAVE_RATE_LIMIT  = 30 // How many saves a client may make per minute
+	SHEET_SAVE_RATE_BURST  = 10
+	MAX_SHEET_DIFF_ROWS    = 100 // The most rows and columns of a diff we display
+	MAX_SHEET_DIFF_COLUMNS = 26
+)
+
+// The names sheets may be saved under
+var sheetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// A saved version of a sheet
+type sheetRevision struct {
+	Revision int        `json:"revision"`
+	Saved    time.Time  `json:"saved"`
+	Author   string     `json:"author"`
+	Cells    [][]string `json:"cells,omitempty"`
+}
+
+// A saved sheet, with its revisions oldest first
+type savedSheet struct {
+	Revisions []sheetRevision `json:"revisions"`
+}
+
+// Our saved sheets by name
+var savedSheets = struct {
+	mutex  sync.Mutex
+	file   string // Where our sheets are saved ("" to keep them in memory only)
+	sheets map[string]*savedSheet
+}{sheets: map[string]*savedSheet{}}
+
+// The rate limiter for saving sheets
+var sheetSaveRateLimiter = newRateLimiter("sheet-save", SHEET_SAVE_RATE_LIMIT, SHEET_SAVE_RATE_BURST)
+
+// Load our saved sheets from the given JSON file (if it exists), saving our sheets to it from
+// now on
+func loadSavedSheets(path string) error {
+
+	savedSheets.mutex.Lock()
+	defer savedSheets.mutex.Unlock()
+
+	savedSheets.file = path
+
+	if err := loadJSONFile(path, &savedSheets.sheets); err != nil {
+		return err
+	}
+
+	if savedSheets.sheets == nil {
+		savedSheets.sheets = map[string]*savedSheet{}
+	}
+
+	return nil
+
+}
+
+// Save a new revision of the named sheet, returning it along with whether it was created (an
+// unchanged sheet isn't saved again, returning its latest revision instead)
+func saveSheetRevision(name string, author string, cells [][]string) (sheetRevision, bool, error) {
+
+	savedSheets.mutex.Lock()
+	defer savedSheets.mutex.Unlock()
+
+	sheet := savedSheets.sheets[name]
+
+	if sheet == nil {
+		if len(savedSheets.sheets) >= MAX_SAVED_SHEETS {
+			return sheetRevision{}, false, newAppError(http.StatusInsufficientStorage, "too_many_sheets",
+				fmt.Sprintf("There are already %d saved sheets.", MAX_SAVED_SHEETS))
+		}
+		sheet = &savedSheet{}
+		savedSheets.sheets[name] = sheet
+	}
+
+	number := 1
+
+	if len(sheet.Revisions) > 0 {
+		latest := sheet.Revisions[len(sheet.Revisions)-1]
+		if slices.EqualFunc(latest.Cells, cells, slices.Equal) {
+			return latest, false, nil
+		}
+		number = latest.Revision + 1
+	}
+
+	revision := sheetRevision{Revision: number, Saved: time.Now().UTC(), Author: author, Cells: cells}
+
+	sheet.Revisions = append(sheet.Revisions, revision)
+
+	if excess := len(sheet.Revisions) - MAX_SHEET_REVISIONS; excess > 0 {
+		sheet.Revisions = sheet.Revisions[excess:]
+	}
+
+	if savedSheets.file != "" {
+		if err := saveJSONFile(savedSheets.file, savedSheets.sheets); err != nil {
+			logger.Println("Failed to save the spreadsheets:", err)
+		}
+	}
+
+	return revision, true, nil
+
+}
+
+// Returns the given revision of the named sheet (its latest revision for 0)
+func sheetRevisionByNumber(name string, number int) (sheetRevision, bool) {
+
+	savedSheets.mutex.Lock()
+	defer savedSheets.mutex.Unlock()
+
+	sheet := savedSheets.sheets[name]
+
+	if sheet == nil || len(sheet.Revisions) == 0 {
+		return sheetRevision{}, false
+	}
+
+	if number == 0 {
+		return sheet.Revisions[len(sheet.Revisions)-1], true
+	}
+
+	for _, revision := range sheet.Revisions {
+		if revision.Revision == number {
+			return revision, true
+		}
+	}
+
+	return sheetRevision{}, false
+
+}
+
+// Returns the revisions of the named sheet (without their cells), newest first
+func sheetHistory(name string) []sheetRevision {
+
+	savedSheets.mutex.Lock()
+	defer savedSheets.mutex.Unlock()
+
+	sheet := savedSheets.sheets[name]
+
+	if sheet == nil {
+		return nil
+	}
+
+	history := make([]sheetRevision, 0, len(sheet.Revisions))
+	for index := len(sheet.Revisions) - 1; index >= 0; index-- {
+		revision := sheet.Revisions[index]
+		revision.Cells = nil
+		history = append(history, revision)
+	}
+
+	return history
+
+}
+
+// Returns the sheet name of the given request, or an error if it isn't a valid name
+func sheetName(r *http.Request) (string, error) {
+
+	name := r.PathValue("name")
+
+	if !sheetNamePattern.MatchString(name) {
+		return "", badRequestError("Sheet names are 1 to 64 letters, digits, dashes or underscores.")
+	}
+
+	return name, nil
+
+}
+
+// Parse the revision number in the given query parameter (0 if it's missing)
+func revisionParameter(r *http.Request, parameter string) (int, error) {
+
+	value := r.URL.Query().Get(parameter)
+
+	if value == "" {
+		return 0, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 1 {
+		return 0, badRequestError(fmt.Sprintf("The %s parameter must be a revision number.", parameter))
+	}
+
+	return number, nil
+
+}
+
+// This is our sheet API handler. GET returns a revision of the sheet, while POST saves a new one.
+func sheetHandler(w http.ResponseWriter, r *http.Request) {
+
+	name, err := sheetName(r)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	addLogField(r.Context(), "sheet", name)
+
+	if r.Method == http.MethodPost {
+		saveSheetHandler(w, r, name)
+		return
+	}
+
+	number, err := revisionParameter(r, "revision")
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	revision, found := sheetRevisionByNumber(name, number)
+
+	if !found {
+		writeError(w, r, notFoundError())
+		return
+	}
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(revision)
+
+}
+
+// Save a new revision of the named sheet from the JSON body of the given request
+func saveSheetHandler(w http.ResponseWriter, r *http.Request, name string) {
+
+	if wait := sheetSaveRateLimiter.reserve(clientAddress(r)); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, r, newAppError(http.StatusTooManyRequests, "rate_limited",
+			"You're saving too quickly. Please wait a moment and try again."))
+		return
+	}
+
+	var request struct {
+		Data   json.RawMessage `json:"data"`
+		Author string          `json:"author"`
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_SPREADSHEET_REQUEST_SIZE))
+
+	if err := decoder.Decode(&request); err != nil || request.Data == nil {
+		writeError(w, r, badRequestError("The request must be a JSON object with a data array of rows.").Wrap(err))
+		return
+	}
+
+	revision, created, err := saveSheet(name, request.Data, request.Author)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	revision.Cells = nil
+
+	setContentType(w, CONTENT_TYPE_JSON)
+
+	if created {
+		incrementCounter("sheet_revisions_saved_total")
+		w.WriteHeader(http.StatusCreated)
+	}
+
+	json.NewEncoder(w).Encode(revision)
+
+}
+
+// Save a new revision of the named sheet from the given rows and author (see saveSheetRevision)
+func saveSheet(name string, data json.RawMessage, author string) (sheetRevision, bool, error) {
+
+	cells, err := parseSpreadsheetData(data)
+
+	if err != nil {
+		return sheetRevision{}, false, err
+	}
+
+	author = strings.TrimSpace(author)
+
+	if utf8.RuneCountInString(author) > MAX_SHEET_AUTHOR || strings.ContainsAny(author, "\r\n") {
+		return sheetRevision{}, false, badRequestError(fmt.Sprintf("The author can be at most %d characters long, on one line.", MAX_SHEET_AUTHOR))
+	} else if author == "" {
+		author = "anonymous"
+	}
+
+	return saveSheetRevision(name, author, cells)
+
+}
+
+// The save form of our Excel demo, whose data field holds the sheet's rows as JSON
+type sheetSaveForm struct {
+	Data   string `form:"data" label:"The sheet's rows" validate:"required"`
+	Author string `form:"author"`
+}
+
+// Save a new revision of the named sheet from the save form of our Excel demo, sending the
+// browser on to the sheet's history with a flash saying how it went. The Excel demo has no
+// form to show problems beside, so they're flashed as errors on the way back to it (with the
+// sheet's latest revision, if it has one).
+func saveSheetFormHandler(w http.ResponseWriter, r *http.Request, name string) {
+
+	var fields sheetSaveForm
+	form := &Form{Problems: map[string]string{}}
+
+	if err := form.Decode(w, r, &fields); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := form.CheckCSRF(r); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	back := urlFor("/excel") + "?sheet=" + url.QueryEscape(name)
+
+	if wait := sheetSaveRateLimiter.reserve(clientAddress(r)); wait > 0 {
+		addFlash(w, r, FLASH_ERROR, "You're saving too quickly. Please wait a moment and try again.")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	if !form.Valid() {
+		addFlash(w, r, FLASH_ERROR, "%s wasn't saved: %s", name, form.Problem("data"))
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	revision, created, err := saveSheet(name, json.RawMessage(fields.Data), fields.Author)
+
+	var appError *AppError
+	if errors.As(err, &appError) && appError.Status < http.StatusInternalServerError {
+		addFlash(w, r, FLASH_ERROR, "%s wasn't saved: %s", name, appError.Message)
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	} else if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if created {
+		incrementCounter("sheet_revisions_saved_total")
+		addFlash(w, r, FLASH_SUCCESS, "Saved %s as revision %d.", name, revision.Revision)
+	} else {
+		addFlash(w, r, FLASH_INFO, "Nothing has changed since revision %d, so it wasn't saved again.", revision.Revision)
+	}
+
+	http.Redirect(w, r, urlFor("/sheets/"+name), http.StatusSeeOther)
+
+}
+
+// This is our sheet revisions API handler, which lists the revisions of a sheet newest first
+func sheetRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+
+	name, err := sheetName(r)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	history := sheetHistory(name)
+
+	if history == nil {
+		writeError(w, r, notFoundError())
+		return
+	}
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "revisions": history})
+
+}
+
+// A cell which differs between two revisions
+type cellChange struct {
+	Cell   string `json:"cell"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	row    int
+	column int
+}
+
+// Returns the cells which differ between the given revisions, row by row
+func diffSheetCells(from, to [][]string) []cellChange {
+
+	cell := func(cells [][]string, row, column int) string {
+		if row < len(cells) && column < len(cells[row]) {
+			return cells[row][column]
+		}
+		return ""
+	}
+
+	var changes []cellChange
+
+	for row := range max(len(from), len(to)) {
+		columns := 0
+		if row < len(from) {
+			columns = len(from[row])
+		}
+		if row < len(to) {
+			columns = max(columns, len(to[row]))
+		}
+		for column := range columns {
+			before, after := cell(from, row, column), cell(to, row, column)
+			if before != after {
+				changes = append(changes, cellChange{
+					Cell:   cellPosition{row: row, column: column}.String(),
+					From:   before,
+					To:     after,
+					row:    row,
+					column: column,
+				})
+			}
+		}
+	}
+
+	return changes
+
+}
+
+// This is a template string we use to construct the body of our sheet history page
+const SHEET_HISTORY_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>{{ .Name }}</h2>
+		<p><a href="{{ url "/excel" }}?sheet={{ .Name }}">Open the latest revision</a></p>
+		<table style="margin: auto;">
+			<tr><th>Revision</th><th>Saved</th><th>Author</th><th></th></tr>
+			{{ range $index, $revision := .Revisions }}
+			<tr>
+				<td>{{ .Revision }}</td>
+				<td>{{ .Saved.Format "2 Jan 2006 15:04:05 MST" }}</td>
+				<td>{{ .Author }}</td>
+				<td>
+					<a href="{{ url "/excel" }}?sheet={{ $.Name }}&revision={{ .Revision }}">Open</a>
+					{{ with index $.Previous $index }}<a href="{{ url "/sheets/" }}{{ $.Name }}/diff?from={{ . }}&to={{ $revision.Revision }}">Changes</a>{{ end }}
+				</td>
+			</tr>
+			{{ end }}
+		</table>
+	</div>
+`
+
+// The data we pass into our sheet history body template
+type sheetHistoryData struct {
+	Name      string
+	Revisions []sheetRevision
+	Previous  []int // The revision before each of our revisions (0 for the first)
+}
+
+// This is our sheet history page handler. POST saves a new revision from our Excel demo's form.
+func sheetHistoryHandler(w http.ResponseWriter, r *http.Request) {
+
+	name, err := sheetName(r)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		addLogField(r.Context(), "sheet", name)
+		saveSheetFormHandler(w, r, name)
+		return
+	}
+
+	data := sheetHistoryData{Name: name, Revisions: sheetHistory(name)}
+
+	if data.Revisions == nil {
+		writeError(w, r, notFoundError())
+		return
+	}
+
+	for index := range data.Revisions {
+		previous := 0
+		if index+1 < len(data.Revisions) {
+			previous = data.Revisions[index+1].Revision
+		}
+		data.Previous = append(data.Previous, previous)
+	}
+
+	body, err := renderFragment(sheetHistoryTemplate, data)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the sheet history body template"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	renderMainTemplate(w, r, "sheet-history", HtmlData{
+		Title:       "Golang Spreadsheet History",
+		Description: "The saved revisions of a spreadsheet.",
+		Keywords:    "golang web server spreadsheet revisions history",
+		CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+		BodyContent: body,
+		Metadata:    PageMetadata{Parent: "/excel"},
+	})
+
+}
+
+// This is a template string we use to construct the body of our sheet diff page. Changed cells
+// show their old value struck through, followed by their new value.
+const SHEET_DIFF_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>{{ .Name }}: revision {{ .From.Revision }} to {{ .To.Revision }}</h2>
+		<p>
+			<small>{{ len .Changes }} changed cells. Revision {{ .To.Revision }} was saved by {{ .To.Author }} at {{ .To.Saved.Format "2 Jan 2006 15:04:05 MST" }}.</small>
+			<a href="{{ url "/sheets/" }}{{ .Name }}">History</a>
+		</p>
+		{{ if .Rows }}
+		<table style="margin: auto; border-collapse: collapse;">
+			<tr><th></th>{{ range .Columns }}<th>{{ . }}</th>{{ end }}</tr>
+			{{ range .Rows }}
+			<tr>
+				<th>{{ .Number }}</th>
+				{{ range .Cells }}
+				<td style="border: 1px solid #ccc; padding: 2px 6px;{{ if .Changed }} background: #fff3b0;{{ end }}">
+					{{ if .Changed }}{{ if .From }}<del>{{ .From }}</del> {{ end }}<ins>{{ .To }}</ins>{{ else }}{{ .To }}{{ end }}
+				</td>
+				{{ end }}
+			</tr>
+			{{ end }}
+		</table>
+		{{ if .Truncated }}<p><small>Only the first {{ len .Rows }} rows and {{ len .Columns }} columns of the changes are shown.</small></p>{{ end }}
+		{{ else }}
+		<p>Nothing changed.</p>
+		{{ end }}
+	</div>
+`
+
+// A cell of our diff grid
+type sheetDiffCell struct {
+	From    string
+	To      string
+	Changed bool
+}
+
+// A row of our diff grid
+type sheetDiffRow struct {
+	Number int
+	Cells  []sheetDiffCell
+}
+
+// The data we pass into our sheet diff body template. The grid covers the rows and columns
+// containing changes.
+type sheetDiffData struct {
+	Name      string
+	From      sheetRevision
+	To        sheetRevision
+	Changes   []cellChange
+	Columns   []string
+	Rows      []sheetDiffRow
+	Truncated bool
+}
+
+// Lay out the grid of cells covering the changes of our diff
+func (data *sheetDiffData) layoutGrid() {
+
+	if len(data.Changes) == 0 {
+		return
+	}
+
+	top, bottom := data.Changes[0].row, data.Changes[len(data.Changes)-1].row
+	left, right := data.Changes[0].column, data.Changes[0].column
+	for _, change := range data.Changes {
+		left, right = min(left, change.column), max(right, change.column)
+	}
+
+	if bottom-top >= MAX_SHEET_DIFF_ROWS || right-left >= MAX_SHEET_DIFF_COLUMNS {
+		bottom = min(bottom, top+MAX_SHEET_DIFF_ROWS-1)
+		right = min(right, left+MAX_SHEET_DIFF_COLUMNS-1)
+		data.Truncated = true
+	}
+
+	changed := map[cellPosition]cellChange{}
+	for _, change := range data.Changes {
+		changed[cellPosition{row: change.row, column: change.column}] = change
+	}
+
+	for column := left; column <= right; column++ {
+		data.Columns = append(data.Columns, spreadsheetColumnName(column))
+	}
+
+	for row := top; row <= bottom; row++ {
+		gridRow := sheetDiffRow{Number: row + 1}
+		for column := left; column <= right; column++ {
+			if change, found := changed[cellPosition{row: row, column: column}]; found {
+				gridRow.Cells = append(gridRow.Cells, sheetDiffCell{From: change.From, To: change.To, Changed: true})
+			} else {
+				value := ""
+				if row < len(data.To.Cells) && column < len(data.To.Cells[row]) {
+					value = data.To.Cells[row][column]
+				}
+				gridRow.Cells = append(gridRow.Cells, sheetDiffCell{To: value})
+			}
+		}
+		data.Rows = append(data.Rows, gridRow)
+	}
+
+}
+
+// This is our sheet diff handler, which compares two revisions of a sheet cell by cell
+func sheetDiffHandler(w http.ResponseWriter, r *http.Request) {
+
+	name, err := sheetName(r)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	fromNumber, err := revisionParameter(r, "from")
+	if err == nil && fromNumber == 0 {
+		err = badRequestError("The from parameter must be a revision number.")
+	}
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	toNumber, err := revisionParameter(r, "to")
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	from, fromFound := sheetRevisionByNumber(name, fromNumber)
+	to, toFound := sheetRevisionByNumber(name, toNumber)
+
+	if !fromFound || !toFound {
+		writeError(w, r, notFoundError())
+		return
+	}
+
+	data := sheetDiffData{Name: name, From: from, To: to, Changes: diffSheetCells(from.Cells, to.Cells)}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if wantsJSON(r) {
+		changes := data.Changes
+		if changes == nil {
+			changes = []cellChange{}
+		}
+		setContentType(w, CONTENT_TYPE_JSON)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name": name, "from": from.Revision, "to": to.Revision, "changes": changes,
+		})
+		return
+	}
+
+	data.layoutGrid()
+
+	body, err := renderFragment(sheetDiffTemplate, data)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the sheet diff body template"))
+		return
+	}
+
+	renderMainTemplate(w, r, "sheet-diff", HtmlData{
+		Title:       "Golang Spreadsheet Changes",
+		Description: "The cells which changed between two revisions of a spreadsheet.",
+		Keywords:    "golang web server spreadsheet revisions diff",
+		CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+		BodyContent: body,
+		Metadata:    PageMetadata{Parent: "/excel"},
+	})
+
+}
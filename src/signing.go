@@ -0,0 +1,220 @@
+// Signing keys. Values we hand to clients and expect back unchanged (our CSRF tokens, see
+// csrf.go, our admin session cookies, see totp.go, and our shared file links, see
+// sharedlinks.go) are signed with an HMAC-SHA256 of our newest signing key and verified against all of
+// our keys, so that keys can be rotated without invalidating everything signed with the last
+// one: a new key is added at the front, and the old one is dropped once what was signed with it
+// has expired.
+//
+// Our keys come from -signing-keys, which is a secret (see secrets.go) holding keys separated
+// by newlines or commas, newest first, each of at least SIGNING_KEY_MIN_LENGTH characters. It's
+// loaded again when we're sent SIGHUP, so keys are rotated by updating it (i.e. the file it
+// refers to) and reloading us, and every instance sharing it accepts what the others signed.
+// Without -signing-keys we generate a random key at startup (which only this instance knows,
+// and which is lost when it restarts), and -signing-key-rotation generates a new one on a
+// schedule, keeping our last SIGNING_KEYS_KEPT generated keys. Generated keys are kept apart
+// from the keys loaded from -signing-keys, so rotating never drops a configured key. The keys we
+// keep must outlive what they signed, so the rotation interval can't be shorter than
+// SIGNED_VALUE_MAX_LIFETIME / (SIGNING_KEYS_KEPT - 1) (see validateConfig).
+//
+// The signed_values_verified_total metric counts the values we've verified by whether our
+// newest key or an older one signed them, which shows when an old key is no longer needed.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	SIGNING_KEY_MIN_LENGTH = 32
+	SIGNING_KEYS_KEPT      = 3 // How many generated keys we keep when rotating on a schedule
+
+	// The longest any value we sign stays valid for (our shared file links, see sharedlinks.go)
+	SIGNED_VALUE_MAX_LIFETIME = max(CSRF_TOKEN_LIFETIME, FLASH_LIFETIME, ADMIN_SESSION_LIFETIME,
+		TOTP_ENROLMENT_LIFETIME, MAX_SHARE_LIFETIME)
+)
+
+// Our signing keys, newest first, and when and where they were last loaded from. The keys we
+// sign and verify with are those we generated followed by those from -signing-keys.
+var signingKeys = struct {
+	mutex      sync.RWMutex
+	keys       [][]byte
+	generated  [][]byte
+	configured [][]byte
+	source     string
+	loaded     time.Time
+}{}
+
+// Our signing keys as shown on /status (never the keys themselves)
+type signingKeysStatus struct {
+	Keys   int       `json:"keys"`
+	Source string    `json:"source"` // generated, or where -signing-keys came from
+	Loaded time.Time `json:"loaded"`
+}
+
+// Load our signing keys from the given reference (or generate one without it)
+func loadSigningKeys(reference string) error {
+
+	if reference == "" {
+		signingKeys.mutex.Lock()
+		signingKeys.generated, signingKeys.source, signingKeys.loaded = [][]byte{newSigningKey()}, "generated", time.Now().UTC()
+		updateSigningKeys()
+		signingKeys.mutex.Unlock()
+		return nil
+	}
+
+	value, err := resolveSecret("signing-keys", reference)
+	if err != nil {
+		return err
+	}
+
+	var keys [][]byte
+	for i, key := range strings.FieldsFunc(value, func(r rune) bool { return r == '\n' || r == '\r' || r == ',' }) {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if len(key) < SIGNING_KEY_MIN_LENGTH {
+			return fmt.Errorf("-signing-keys: key %d is shorter than %d characters", i+1, SIGNING_KEY_MIN_LENGTH)
+		}
+		keys = append(keys, []byte(key))
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("-signing-keys %s doesn't hold any keys", reference)
+	}
+
+	signingKeys.mutex.Lock()
+	signingKeys.configured, signingKeys.source, signingKeys.loaded = keys, currentSecretSources()["signing-keys"], time.Now().UTC()
+	updateSigningKeys()
+	signingKeys.mutex.Unlock()
+
+	return nil
+
+}
+
+// Gather the keys we sign and verify with: those we generated, then those from -signing-keys.
+// The caller must hold our signing keys' mutex.
+func updateSigningKeys() {
+	signingKeys.keys = slices.Concat(signingKeys.generated, signingKeys.configured)
+}
+
+// Returns a new random signing key
+func newSigningKey() []byte {
+	key := make([]byte, SIGNING_KEY_MIN_LENGTH)
+	rand.Read(key)
+	return key
+}
+
+// Load our signing keys again whenever we're sent SIGHUP, until the server exits. A reload which
+// fails leaves our keys as they are.
+func reloadSigningKeysOnHangup(reference string) {
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	go func() {
+		for range hangups {
+			if reference == "" {
+				logger.Println("Ignoring SIGHUP, as our signing keys are generated rather than loaded from -signing-keys")
+				continue
+			}
+			if err := loadSigningKeys(reference); err != nil {
+				logger.Println("ERROR keeping our signing keys:", err)
+				continue
+			}
+			logger.Printf("Reloaded %d signing keys", currentSigningKeysStatus().Keys)
+		}
+	}()
+
+}
+
+// Generate a new signing key every interval until the server exits (see rotateSigningKeys)
+func startSigningKeyRotation(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			rotateSigningKeys()
+		}
+	}()
+}
+
+// Generate a new signing key, keeping our last SIGNING_KEYS_KEPT generated keys along with every
+// key from -signing-keys
+func rotateSigningKeys() {
+	signingKeys.mutex.Lock()
+	defer signingKeys.mutex.Unlock()
+	kept := signingKeys.generated[:min(len(signingKeys.generated), SIGNING_KEYS_KEPT-1)]
+	signingKeys.generated = append([][]byte{newSigningKey()}, kept...)
+	signingKeys.loaded = time.Now().UTC()
+	updateSigningKeys()
+}
+
+// Returns the state of our signing keys, for /status
+func currentSigningKeysStatus() signingKeysStatus {
+	signingKeys.mutex.RLock()
+	defer signingKeys.mutex.RUnlock()
+	return signingKeysStatus{Keys: len(signingKeys.keys), Source: signingKeys.source, Loaded: signingKeys.loaded}
+}
+
+// Returns the given value signed with our newest key, in a form which is safe in URLs, cookies
+// and form fields. The value itself is only encoded, not encrypted.
+func signValue(value string) string {
+
+	signingKeys.mutex.RLock()
+	key := signingKeys.keys[0]
+	signingKeys.mutex.RUnlock()
+
+	return base64.RawURLEncoding.EncodeToString([]byte(value)) + "." + base64.RawURLEncoding.EncodeToString(signature(key, value))
+}
+
+// Returns the value of a signed value, if any of our keys signed it
+func verifySignedValue(signed string) (string, bool) {
+
+	encodedValue, encodedSignature, found := strings.Cut(signed, ".")
+	if !found {
+		return "", false
+	}
+	value, err := base64.RawURLEncoding.DecodeString(encodedValue)
+	if err != nil {
+		return "", false
+	}
+	supplied, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return "", false
+	}
+
+	signingKeys.mutex.RLock()
+	keys := signingKeys.keys
+	signingKeys.mutex.RUnlock()
+
+	for i, key := range keys {
+		if hmac.Equal(supplied, signature(key, string(value))) {
+			signedBy := "newest"
+			if i > 0 {
+				signedBy = "older"
+			}
+			incrementCounter("signed_values_verified_total", "key", signedBy)
+			return string(value), true
+		}
+	}
+
+	return "", false
+
+}
+
+// Returns the HMAC-SHA256 of the given value with the given key
+func signature(key []byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigningKeyRotationKeepsConfiguredKeys(t *testing.T) {
+
+	signingKeys.mutex.Lock()
+	generated, configured := signingKeys.generated, signingKeys.configured
+	signingKeys.generated, signingKeys.configured = [][]byte{newSigningKey()}, [][]byte{[]byte(strings.Repeat("k", SIGNING_KEY_MIN_LENGTH))}
+	updateSigningKeys()
+	signingKeys.mutex.Unlock()
+
+	t.Cleanup(func() {
+		signingKeys.mutex.Lock()
+		signingKeys.generated, signingKeys.configured = generated, configured
+		updateSigningKeys()
+		signingKeys.mutex.Unlock()
+	})
+
+	signedFirst := signValue("first")
+
+	for range SIGNING_KEYS_KEPT - 1 {
+		rotateSigningKeys()
+	}
+	if _, ok := verifySignedValue(signedFirst); !ok {
+		t.Errorf("a value signed %d rotations ago didn't verify, want it to", SIGNING_KEYS_KEPT-1)
+	}
+
+	rotateSigningKeys()
+	if _, ok := verifySignedValue(signedFirst); ok {
+		t.Errorf("a value signed %d rotations ago verified, want its key dropped", SIGNING_KEYS_KEPT)
+	}
+
+	signingKeys.mutex.RLock()
+	keys, last := len(signingKeys.keys), string(signingKeys.keys[len(signingKeys.keys)-1])
+	signingKeys.mutex.RUnlock()
+	if keys != SIGNING_KEYS_KEPT+1 || last != strings.Repeat("k", SIGNING_KEY_MIN_LENGTH) {
+		t.Errorf("got %d keys, want our %d generated keys followed by our configured key", keys, SIGNING_KEYS_KEPT)
+	}
+
+}
+
+func TestSigningKeyRotationMustOutliveSignedValues(t *testing.T) {
+
+	defer func(rotation time.Duration) { signingKeyRotation = rotation }(signingKeyRotation)
+
+	tests := []struct {
+		rotation time.Duration
+		valid    bool
+	}{
+		{0, true},
+		{24 * time.Hour, false},
+		{SIGNED_VALUE_MAX_LIFETIME/(SIGNING_KEYS_KEPT-1) - time.Second, false},
+		{SIGNED_VALUE_MAX_LIFETIME / (SIGNING_KEYS_KEPT - 1), true},
+		{SIGNED_VALUE_MAX_LIFETIME, true},
+	}
+
+	for _, test := range tests {
+		signingKeyRotation = test.rotation
+		invalid := false
+		for _, problem := range validateConfig() {
+			invalid = invalid || strings.Contains(problem.Error(), "-signing-key-rotation must be at least")
+		}
+		if invalid == test.valid {
+			t.Errorf("got -signing-key-rotation %v valid %t, want %t", test.rotation, !invalid, test.valid)
+		}
+	}
+
+}
+
+func TestSigningKeysAreRedacted(t *testing.T) {
+
+	value := redactedConfigValue(&flag.Flag{Name: "signing-keys"}, strings.Repeat("k", SIGNING_KEY_MIN_LENGTH))
+
+	if value != "[redacted]" {
+		t.Errorf("got -signing-keys %q on /debug/config, want it redacted", value)
+	}
+
+}
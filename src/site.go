@@ -0,0 +1,374 @@
+// Static site mode. When the -root flag is set, the server becomes a general purpose static
+// file server for the given directory: files are served with caching headers (and support
+// for conditional and range requests), directories get a listing rendered within our main
+// template (unless they contain an index.html or index.md) and markdown files are rendered as
+// HTML pages on the fly (append ?raw=1 for the markdown source). Our demo applications move
+// under /demo so that they don't clash with the site.
+//
+// Files are opened through an os.Root, so neither ../ paths nor symlinks can reach anything
+// outside of the root directory. Hidden files and directories (i.e. .git) are never served.
+//
+// Precompressed copies of files (i.e. app.js.br and app.js.gz alongside app.js, created by a
+// build step at the highest compression levels) are served in place of the original file to
+// clients which accept their encoding.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How long browsers may use the files of our site before revalidating them
+const SITE_FILE_MAX_AGE = 5 * time.Minute
+
+// The largest markdown file we'll render (larger files are served as they are)
+const MAX_MARKDOWN_SIZE = 4 << 20
+
+// The extensions of the precompressed copies of our files for each encoding
+var precompressedExtensions = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+}
+
+// The path our site is served from in static site mode (our base path, while the demo site
+// moves to our base path + /demo)
+var sitePath string
+
+// The files of our site in static site mode (which our search indexes, see search.go)
+var siteFiles *os.Root
+
+// The body content of our directory listings. The values are escaped by html/template.
+const SITE_LISTING_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>Index of {{ .Path }}</h2>
+		<table>
+			{{ if .HasParent }}
+			<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+			{{ end }}
+			{{ range .Entries }}
+			<tr>
+				<td><a href="{{ .Href }}">{{ .Name }}</a></td>
+				<td>{{ .Size }}</td>
+				<td>{{ .Modified }}</td>
+			</tr>
+			{{ else }}
+			<tr><td>This directory is empty.</td></tr>
+			{{ end }}
+		</table>
+	</div>
+`
+
+// The data we pass into our directory listing template
+type siteListingData struct {
+	Path      string
+	HasParent bool
+	Entries   []siteListingEntry
+}
+
+type siteListingEntry struct {
+	Name     string
+	Href     string
+	Size     string
+	Modified string
+}
+
+// Returns a handler which serves the files within the given root directory, passing requests
+// for our demo site (under our base path) on to the given demo handler
+func staticSiteHandler(root *os.Root, demo http.Handler) http.Handler {
+
+	site := methodHandler([]string{http.MethodGet}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveSitePath(w, r, root)
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		switch {
+		case r.URL.Path == basePath || strings.HasPrefix(r.URL.Path, basePath+"/"):
+			demo.ServeHTTP(w, r)
+
+		case strings.HasPrefix(r.URL.Path, sitePath+"/"):
+			site.ServeHTTP(w, r)
+
+		case r.URL.Path == sitePath:
+			http.Redirect(w, r, sitePath+"/", http.StatusMovedPermanently)
+
+		default:
+			writeError(w, r, notFoundError())
+		}
+
+	})
+
+}
+
+// Serve the file or directory at the requested path
+func serveSitePath(w http.ResponseWriter, r *http.Request, root *os.Root) {
+
+	requestPath := path.Clean("/" + strings.TrimPrefix(r.URL.Path, sitePath))
+	name := strings.TrimPrefix(requestPath, "/")
+	if name == "" {
+		name = "."
+	}
+
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") && segment != "." {
+			writeError(w, r, notFoundError())
+			return
+		}
+	}
+
+	file, info, err := openSiteFile(root, name)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer file.Close()
+
+	if info.IsDir() {
+		// Relative links within our directory only work with a trailing slash
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			target := r.URL.Path + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+
+		for _, index := range []string{"index.html", "index.md"} {
+			indexName := path.Join(name, index)
+			if indexFile, indexInfo, err := openSiteFile(root, indexName); err == nil {
+				defer indexFile.Close()
+				serveSiteFile(w, r, root, indexName, indexFile, indexInfo)
+				return
+			}
+		}
+
+		serveSiteListing(w, r, file, requestPath)
+		return
+	}
+
+	serveSiteFile(w, r, root, name, file, info)
+
+}
+
+// Open the file with the given name within our root, mapping failures onto our errors
+func openSiteFile(root *os.Root, name string) (*os.File, os.FileInfo, error) {
+
+	file, err := root.Open(name)
+
+	if err == nil {
+		info, statErr := file.Stat()
+		if statErr == nil {
+			return file, info, nil
+		}
+		file.Close()
+		err = statErr
+	}
+
+	if errors.Is(err, fs.ErrPermission) {
+		return nil, nil, newAppError(http.StatusForbidden, "forbidden",
+			"You don't have permission to access this page.").Wrap(err)
+	}
+
+	// This includes paths which would escape our root
+	return nil, nil, notFoundError().Wrap(err)
+
+}
+
+// Serve a single file, rendering markdown files as HTML
+func serveSiteFile(w http.ResponseWriter, r *http.Request, root *os.Root, name string, file *os.File, info os.FileInfo) {
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(SITE_FILE_MAX_AGE.Seconds())))
+
+	if path.Ext(info.Name()) == ".md" && r.URL.Query().Get("raw") == "" && info.Size() <= MAX_MARKDOWN_SIZE {
+		serveMarkdown(w, r, file, info)
+		return
+	}
+
+	// ServeContent takes care of conditional (If-None-Match and If-Modified-Since) and range
+	// requests for us
+	setContentType(w, contentTypeFor(info.Name()))
+
+	if sidecar, sidecarInfo, encoding := openPrecompressedFile(root, name, info, r); sidecar != nil {
+		defer sidecar.Close()
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Add("Vary", "Accept-Encoding")
+		w.Header().Set("ETag", fmt.Sprintf("\"%s-%x-%x\"", encoding, sidecarInfo.ModTime().UnixNano(), sidecarInfo.Size()))
+		http.ServeContent(w, r, info.Name(), info.ModTime(), sidecar)
+		return
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size()))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+
+}
+
+// Returns a precompressed copy of the file with the given name (i.e. style.css.br or
+// style.css.gz alongside style.css) in an encoding the client accepts, along with the encoding.
+// Copies older than the file itself are out of date, so we ignore them.
+func openPrecompressedFile(root *os.Root, name string, info os.FileInfo, r *http.Request) (*os.File, os.FileInfo, string) {
+
+	for _, encoding := range acceptedEncodings(r.Header.Get("Accept-Encoding")) {
+
+		sidecar, sidecarInfo, err := openSiteFile(root, name+precompressedExtensions[encoding])
+
+		if err != nil {
+			continue
+		}
+
+		if sidecarInfo.Mode().IsRegular() && !sidecarInfo.ModTime().Before(info.ModTime()) {
+			incrementCounter("site_precompressed_responses_total", "encoding", encoding)
+			return sidecar, sidecarInfo, encoding
+		}
+
+		sidecar.Close()
+
+	}
+
+	return nil, nil, ""
+
+}
+
+// Render a markdown file as an HTML page within our main template
+func serveMarkdown(w http.ResponseWriter, r *http.Request, file *os.File, info os.FileInfo) {
+
+	source, err := io.ReadAll(file)
+
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("reading %s", info.Name()))
+		return
+	}
+
+	title := markdownTitle(string(source))
+	if title == "" {
+		title = strings.TrimSuffix(info.Name(), ".md")
+	}
+
+	endSpan := startSpan(r.Context(), "markdown: "+info.Name())
+	page, err := executeMainTemplate("markdown", withSocialCard(r, HtmlData{
+		Title:       title,
+		Description: title,
+		CssFiles: assets(
+			"https://fonts.googleapis.com/css?family=Open+Sans",
+		),
+		CssScript:   template.HTML(HIGHLIGHT_CSS_TEMPLATE),
+		BodyContent: `<div class = "main-content">` + renderMarkdown(string(source)) + `</div>`, // template-audit: renderMarkdown uses our strict policy
+	}))
+	endSpan()
+
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("rendering %s", info.Name()))
+		return
+	}
+
+	// Our rendered page changes whenever the markdown file does, so we can still answer
+	// conditional requests
+	setContentType(w, CONTENT_TYPE_HTML)
+	w.Header().Set("ETag", fmt.Sprintf("\"md-%x-%x\"", info.ModTime().UnixNano(), info.Size()))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), bytes.NewReader(page))
+
+}
+
+// Render a listing of the given directory within our main template
+func serveSiteListing(w http.ResponseWriter, r *http.Request, directory *os.File, requestPath string) {
+
+	entries, err := directory.ReadDir(-1)
+
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("listing %s", requestPath))
+		return
+	}
+
+	// Directories first, then files, each in alphabetical order
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir() != entries[j].IsDir() {
+			return entries[i].IsDir()
+		}
+		return strings.ToLower(entries[i].Name()) < strings.ToLower(entries[j].Name())
+	})
+
+	data := siteListingData{Path: requestPath, HasParent: requestPath != "/"}
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		listingEntry := siteListingEntry{
+			Name:     entry.Name(),
+			Href:     (&url.URL{Path: entry.Name()}).EscapedPath(),
+			Modified: info.ModTime().Format("2006-01-02 15:04"),
+		}
+
+		if entry.IsDir() {
+			listingEntry.Name += "/"
+			listingEntry.Href += "/"
+		} else {
+			listingEntry.Size = formatFileSize(info.Size())
+		}
+
+		// Make sure names containing a colon (i.e. a:b.txt) aren't taken to be a URL scheme
+		if strings.Contains(listingEntry.Href, ":") {
+			listingEntry.Href = "./" + listingEntry.Href
+		}
+
+		data.Entries = append(data.Entries, listingEntry)
+	}
+
+	body, err := renderFragment(siteListingTemplate, data)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the site listing template"))
+		return
+	}
+
+	// Listings change whenever a file is added or removed, so browsers should always check
+	// back with us
+	w.Header().Set("Cache-Control", "no-cache")
+
+	renderMainTemplate(w, r, "site.listing", HtmlData{
+		Title:       "Index of " + requestPath,
+		Description: "Index of " + requestPath,
+		CssFiles: assets(
+			"https://fonts.googleapis.com/css?family=Open+Sans",
+		),
+		BodyContent: body,
+	})
+
+}
+
+// Format a file size for display (i.e. 1536 becomes 1.5 KB)
+func formatFileSize(size int64) string {
+
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value := float64(size)
+	for _, unit := range []string{"KB", "MB", "GB"} {
+		value /= 1024
+		if value < 1024 {
+			return fmt.Sprintf("%.1f %s", value, unit)
+		}
+	}
+
+	return fmt.Sprintf("%.1f TB", value/1024)
+
+}
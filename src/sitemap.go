@@ -0,0 +1,92 @@
+// Sitemap and robots.txt handlers, so that anyone hosting this demo publicly gets sensible
+// crawler behavior without having to add static files by hand.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// XML elements used to construct our sitemap. See https://www.sitemaps.org/protocol.html
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Location string `xml:"loc"`
+}
+
+// Returns the absolute base URL of our site (without a trailing slash or our base path). If the
+// user has specified one via the -site-url flag we use that, otherwise we construct it from the
+// incoming request.
+func siteBaseURL(r *http.Request) string {
+
+	if siteURL != "" {
+		return strings.TrimSuffix(siteURL, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host
+
+}
+
+// This is our sitemap handler. It generates a sitemap listing every page in our page registry
+// which is displayed within the navigation bar.
+func sitemapHandler(w http.ResponseWriter, r *http.Request) {
+
+	baseURL := siteBaseURL(r)
+
+	urlSet := sitemapURLSet{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+
+	for _, page := range navPages() {
+		urlSet.URLs = append(urlSet.URLs, sitemapURL{Location: baseURL + urlFor(page.Path)})
+	}
+
+	sitemapXML, err := xml.MarshalIndent(urlSet, "", "  ")
+
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("marshalling the sitemap"))
+		return
+	}
+
+	setContentType(w, CONTENT_TYPE_XML)
+	fmt.Fprint(w, xml.Header)
+	w.Write(sitemapXML)
+
+}
+
+// This is our robots.txt handler. If the user has specified a robots file via the -robots flag,
+// we serve its contents. Otherwise, we allow all crawlers and point them to our sitemap.
+func robotsHandler(w http.ResponseWriter, r *http.Request) {
+
+	if robotsFile != "" {
+		robotsData, err := ioutil.ReadFile(robotsFile)
+
+		if err != nil {
+			writeError(w, r, internalError(err).WithDetail("reading the robots file %s", robotsFile))
+			return
+		}
+
+		setContentType(w, CONTENT_TYPE_TEXT)
+		w.Write(robotsData)
+		return
+	}
+
+	setContentType(w, CONTENT_TYPE_TEXT)
+
+	fmt.Fprintln(w, "User-agent: *")
+	fmt.Fprintln(w, "Allow: /")
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Sitemap: %s%s\n", siteBaseURL(r), urlFor("/sitemap.xml"))
+
+}
@@ -0,0 +1,87 @@
+// Slow request detection. Requests which take longer than the -slow-threshold duration are
+// logged as warnings (along with their timing breakdown), counted in our metrics, and can
+// optionally be reported to a webhook via the -slow-webhook flag.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The notifier used to deliver our slow request alerts (see webhook.go). It's nil unless a
+// slow request webhook is set.
+var slowRequestAlerts *webhookNotifier
+
+// Returns a handler which flags requests taking longer than our slow request threshold
+func slowRequestHandler(next http.Handler) http.Handler {
+
+	// Slow request detection is disabled without a threshold
+	if slowThreshold <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		started := time.Now()
+		recorder := newStatusRecorder(w)
+
+		next.ServeHTTP(recorder, r)
+
+		duration := time.Since(started)
+
+		if duration < slowThreshold {
+			return
+		}
+
+		incrementCounter("http_slow_requests_total", "method", r.Method)
+
+		requestID, ok := r.Context().Value(REQUEST_ID_KEY).(string)
+		if !ok {
+			requestID = "UNKNOWN"
+		}
+
+		logger.Printf("WARN slow request %s %s %s %d took %v (threshold %v) %s %q %s",
+			requestID, r.Method, r.URL.Path, recorder.status, duration, slowThreshold,
+			loggedAddress(r), loggedUserAgent(r), traceSummary(traceFromContext(r.Context())))
+
+		if slowRequestAlerts != nil {
+			slowRequestAlerts.notify(webhookMessage{
+				Text: fmt.Sprintf("Slow request %s %s took %v (threshold %v), request ID %s",
+					r.Method, r.URL.Path, duration.Round(time.Millisecond), slowThreshold, requestID),
+				Fields: map[string]interface{}{
+					"request_id":  requestID,
+					"method":      r.Method,
+					"path":        r.URL.Path,
+					"status":      recorder.status,
+					"duration_ms": float64(duration) / float64(time.Millisecond),
+				},
+				RequestID: requestID,
+			})
+		}
+
+	})
+
+}
+
+// Returns a one line summary of the stages recorded so far for the given request trace,
+// i.e. "[logging=1.2s handler: /svg=1.19s]"
+func traceSummary(trace *requestTrace) string {
+
+	if trace == nil {
+		return "[]"
+	}
+
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+
+	var stages []string
+	for i := len(trace.Spans) - 1; i >= 0; i-- {
+		stages = append(stages, fmt.Sprintf("%s=%v", trace.Spans[i].Name, trace.Spans[i].Duration))
+	}
+
+	return "[" + strings.Join(stages, " ") + "]"
+
+}
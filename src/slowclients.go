@@ -0,0 +1,240 @@
+// Slow client protection. A slowloris attack ties up our connections by sending requests a
+// trickle at a time: a header every few seconds, or an upload a byte at a time. Our ReadTimeout
+// bounds how long a whole request may take, but uploads extend their read deadline (to
+// UPLOAD_READ_TIMEOUT) and streams extend theirs as they go, so on top of it:
+//
+//   - request headers must arrive within -header-timeout (our server's ReadHeaderTimeout)
+//   - while a handler reads a request body, the client must send some of it within
+//     -body-idle-timeout of each read, however far away the handler's read deadline is
+//   - once a body has been read for SLOW_BODY_GRACE, it must have arrived at -min-body-rate
+//     bytes a second on average
+//
+// We police this per connection, so our listener wraps each connection it accepts with the
+// bookkeeping (see policedConn) and our slowBodyHandler tells the connection when a handler is
+// reading a body. Connections closed for being too slow are counted in the
+// connections_killed_total metric by reason: slow_headers, slow_body or idle_body.
+//
+// Bodies are only policed over HTTP/1, where a connection carries one request at a time.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_HEADER_TIMEOUT    = 5 * time.Second
+	DEFAULT_BODY_IDLE_TIMEOUT = 30 * time.Second
+	DEFAULT_MIN_BODY_RATE     = 1024
+	SLOW_BODY_GRACE           = 10 * time.Second // How long a body may take before we judge its rate
+)
+
+// The error body reads fail with when we close a connection for sending its body too slowly
+var errSlowBody = errors.New("the request body arrived too slowly")
+
+// A listener whose connections are policed for slow clients
+type policedListener struct {
+	net.Listener
+}
+
+// A connection we police for slow clients. We keep track of the read deadline our server (or a
+// handler) set, so that we can tighten it while a body is read and put it back afterwards.
+type policedConn struct {
+	net.Conn
+	mutex       sync.Mutex
+	state       http.ConnState
+	read        int64     // How much we've read since our state last changed
+	timedOut    bool      // Whether a read has hit our server's deadline since then
+	deadline    time.Time // The read deadline our server (or a handler) set
+	tightened   bool      // Whether the read deadline is tighter than that
+	readingBody bool
+	bodyStarted time.Time // When the current request's body was first read
+	bodyRead    int64
+	killed      bool
+}
+
+// A request body which tells its connection while it's being read
+type policedBody struct {
+	io.ReadCloser
+	conn *policedConn
+}
+
+func newPolicedListener(listener net.Listener) *policedListener {
+	return &policedListener{Listener: listener}
+}
+
+func (listener *policedListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &policedConn{Conn: conn}, nil
+}
+
+// Our server's ConnContext, which makes each request's connection available to
+// slowBodyHandler
+func connectionContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, CONNECTION_KEY, conn)
+}
+
+// Returns our policed connection behind the given one (which may wrap it, i.e. with TLS)
+func policedConnOf(conn net.Conn) (*policedConn, bool) {
+	for {
+		switch current := conn.(type) {
+		case *policedConn:
+			return current, true
+		case interface{ NetConn() net.Conn }:
+			conn = current.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// Our server's ConnState hook. Header timeouts are only noticed here: our server closes a
+// connection quietly when its headers don't arrive in time, so a connection which closes after
+// timing out while we were waiting for its headers (before it sent its first request, or after
+// it started sending another) was too slow with them.
+func policeConnState(c net.Conn, state http.ConnState) {
+
+	conn, ok := policedConnOf(c)
+	if !ok {
+		return
+	}
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	switch state {
+	case http.StateClosed:
+		waitingForHeaders := conn.state == http.StateNew || (conn.state == http.StateIdle && conn.read > 0)
+		if conn.timedOut && waitingForHeaders && !conn.killed {
+			conn.killed = true
+			incrementCounter("connections_killed_total", "reason", "slow_headers")
+		}
+	case http.StateHijacked:
+		// The handler has the connection to itself now, so we leave it alone
+		conn.readingBody = false
+	default:
+		conn.read, conn.timedOut = 0, false
+		conn.bodyStarted, conn.bodyRead = time.Time{}, 0
+	}
+
+	conn.state = state
+
+}
+
+func (conn *policedConn) SetDeadline(deadline time.Time) error {
+	conn.mutex.Lock()
+	conn.deadline, conn.tightened = deadline, false
+	conn.mutex.Unlock()
+	return conn.Conn.SetDeadline(deadline)
+}
+
+func (conn *policedConn) SetReadDeadline(deadline time.Time) error {
+	conn.mutex.Lock()
+	conn.deadline, conn.tightened = deadline, false
+	conn.mutex.Unlock()
+	return conn.Conn.SetReadDeadline(deadline)
+}
+
+// Read from the connection, tightening its read deadline to -body-idle-timeout while a body is
+// being read, and closing it if the body is too slow
+func (conn *policedConn) Read(p []byte) (int, error) {
+
+	conn.mutex.Lock()
+
+	readingBody := conn.readingBody
+	if readingBody && conn.bodyStarted.IsZero() {
+		conn.bodyStarted = time.Now()
+	}
+
+	// Each read gets a fresh idle deadline, unless the deadline we were given comes sooner
+	idleDeadline := time.Now().Add(bodyIdleTimeout)
+	tighten := readingBody && bodyIdleTimeout > 0 && (conn.deadline.IsZero() || idleDeadline.Before(conn.deadline))
+	switch {
+	case tighten:
+		conn.Conn.SetReadDeadline(idleDeadline)
+	case conn.tightened:
+		conn.Conn.SetReadDeadline(conn.deadline)
+	}
+	conn.tightened = tighten
+
+	conn.mutex.Unlock()
+
+	n, err := conn.Conn.Read(p)
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.read += int64(n)
+
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		switch {
+		case readingBody && tighten:
+			conn.kill("idle_body")
+		case readingBody:
+			conn.kill("slow_body")
+		default:
+			conn.timedOut = true
+		}
+		return n, err
+	}
+
+	if readingBody && minBodyRate > 0 {
+		conn.bodyRead += int64(n)
+		elapsed := time.Since(conn.bodyStarted)
+		if elapsed > SLOW_BODY_GRACE && float64(conn.bodyRead) < float64(minBodyRate)*elapsed.Seconds() {
+			conn.kill("slow_body")
+			return 0, errSlowBody
+		}
+	}
+
+	return n, err
+
+}
+
+// Close the connection for being too slow, counting it by the given reason. The caller must
+// hold our mutex.
+func (conn *policedConn) kill(reason string) {
+	if !conn.killed {
+		conn.killed = true
+		incrementCounter("connections_killed_total", "reason", reason)
+	}
+	conn.Conn.Close()
+}
+
+// Mark whether a handler is reading the current request's body
+func (conn *policedConn) readBody(reading bool) {
+	conn.mutex.Lock()
+	conn.readingBody = reading
+	conn.mutex.Unlock()
+}
+
+func (body *policedBody) Read(p []byte) (int, error) {
+	body.conn.readBody(true)
+	defer body.conn.readBody(false)
+	return body.ReadCloser.Read(p)
+}
+
+// Returns a handler which tells the connection of each HTTP/1 request with a body while the
+// body is being read, so that the connection can police it
+func slowBodyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 1 && r.Body != nil && r.Body != http.NoBody {
+			if conn, ok := r.Context().Value(CONNECTION_KEY).(net.Conn); ok {
+				if policed, ok := policedConnOf(conn); ok {
+					r.Body = &policedBody{ReadCloser: r.Body, conn: policed}
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
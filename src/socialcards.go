@@ -0,0 +1,148 @@
+// Open Graph and Twitter card metadata. When a link to one of our pages is shared in a chat app
+// or on social media, the app fetches the page and builds its preview from the og: and twitter:
+// <meta> tags in its <head>, which our main template fills in from the page's SocialCard (via
+// the "social" partial below). A card's title and description default to those of the page, and
+// its image to a QR code of the page's URL drawn by our own code endpoint (see barcode.go), so
+// every page gets a preview. Pages with something better to show give their own image, i.e. the
+// QR code generator shows the code being generated and the uptime page a chart of its recent
+// availability (see charts.go).
+//
+// Apps need absolute URLs, which are built from -site-url (or the request's host, see
+// sitemap.go). Images are only given while the feature serving them is enabled (see
+// features.go), so a preview never points at a 404.
+
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	SOCIAL_SITE_NAME         = "Golang Web Server"
+	SOCIAL_QR_CODE_SCALE     = 8    // The size of each module of our QR code images (in pixels)
+	SOCIAL_CHART_WIDTH       = 1200 // The size of our chart images, as recommended for Open Graph
+	SOCIAL_CHART_HEIGHT      = 630
+	SOCIAL_CODES_ROUTE       = "/api/v1/codes/{type}"
+	SOCIAL_CHARTS_ROUTE      = "/chart"
+	TWITTER_CARD_SUMMARY     = "summary"
+	TWITTER_CARD_LARGE_IMAGE = "summary_large_image"
+)
+
+// The preview shown when one of our pages is shared. Pages only need to set the fields they
+// want to differ from the defaults.
+type SocialCard struct {
+	Title       string // Defaults to the page's title
+	Description string // Defaults to the page's description
+	Image       string // The path of the image shown (i.e. /chart?...), defaults to a QR code of the page's URL
+	ImageAlt    string // A description of the image
+	ImageWidth  int    // The size of the image in pixels, if it's known
+	ImageHeight int
+
+	// Filled in by withSocialCard
+	URL      string // The page's absolute URL
+	SiteName string
+}
+
+// Returns the type of Twitter card our card is shown as: wide images are shown large, while
+// square ones (like our QR codes) are shown as a thumbnail beside the text
+func (card SocialCard) TwitterCard() string {
+	if card.Image != "" && card.ImageWidth > card.ImageHeight {
+		return TWITTER_CARD_LARGE_IMAGE
+	}
+	return TWITTER_CARD_SUMMARY
+}
+
+// Returns the given page data with its social card filled in for the given request
+func withSocialCard(r *http.Request, htmlData HtmlData) HtmlData {
+
+	card := &htmlData.SocialCard
+	baseURL := siteBaseURL(r)
+
+	card.Title = cmp.Or(card.Title, htmlData.Title)
+	card.Description = cmp.Or(card.Description, htmlData.Description)
+	card.URL = baseURL + urlFor(r.URL.Path)
+	card.SiteName = SOCIAL_SITE_NAME
+
+	if card.Image == "" {
+		card.Image = qrCodeImagePath("qr", card.URL)
+		card.ImageAlt = "A QR code of the link to this page"
+		card.ImageWidth, card.ImageHeight = 0, 0
+	}
+
+	if card.Image != "" {
+		card.Image = baseURL + urlFor(card.Image)
+	}
+
+	return htmlData
+
+}
+
+// Returns the path of a PNG image of the given code (i.e. a QR code) for the given text, or ""
+// if our code endpoint is disabled
+func qrCodeImagePath(kind string, text string) string {
+
+	if !routeEnabled(SOCIAL_CODES_ROUTE) {
+		return ""
+	}
+
+	query := url.Values{"text": {text}, "format": {"png"}, "scale": {strconv.Itoa(SOCIAL_QR_CODE_SCALE)}}
+	return "/api/v1/codes/" + kind + "?" + query.Encode()
+
+}
+
+// Returns the path of a PNG image of a bar chart of the given values (our PNG charts are drawn
+// without text, see charts.go), or "" if our chart endpoint is disabled
+func barChartImagePath(values []float64) string {
+
+	if !routeEnabled(SOCIAL_CHARTS_ROUTE) || len(values) == 0 {
+		return ""
+	}
+
+	data := make([]string, len(values))
+	for i, value := range values {
+		data[i] = strconv.FormatFloat(value, 'f', -1, 64)
+	}
+
+	query := url.Values{
+		"type":   {"bar"},
+		"format": {"png"},
+		"w":      {strconv.Itoa(SOCIAL_CHART_WIDTH)},
+		"h":      {strconv.Itoa(SOCIAL_CHART_HEIGHT)},
+		"data":   {strings.Join(data, ",")},
+	}
+	return SOCIAL_CHARTS_ROUTE + "?" + query.Encode()
+
+}
+
+// This is our social card partial, which is rendered within the <head> of our main HTML
+// template. You can find the raw file in the templates folder (social.tmpl).
+const SOCIAL_HTML_TEMPLATE = `
+{{ define "social" }}
+	{{ with .SocialCard }}
+	<meta property="og:type" content="website">
+	<meta property="og:site_name" content="{{ .SiteName }}">
+	<meta property="og:title" content="{{ .Title }}">
+	<meta property="og:description" content="{{ .Description }}">
+	<meta property="og:url" content="{{ .URL }}">
+	{{ if .Image }}
+	<meta property="og:image" content="{{ .Image }}">
+	<meta property="og:image:alt" content="{{ .ImageAlt }}">
+	{{ if .ImageWidth }}
+	<meta property="og:image:width" content="{{ .ImageWidth }}">
+	<meta property="og:image:height" content="{{ .ImageHeight }}">
+	{{ end }}
+	{{ end }}
+	<meta name="twitter:card" content="{{ .TwitterCard }}">
+	<meta name="twitter:title" content="{{ .Title }}">
+	<meta name="twitter:description" content="{{ .Description }}">
+	{{ if .Image }}
+	<meta name="twitter:image" content="{{ .Image }}">
+	<meta name="twitter:image:alt" content="{{ .ImageAlt }}">
+	{{ end }}
+	{{ end }}
+{{ end }}
+`
@@ -0,0 +1,145 @@
+// Metric sparklines. /metrics/sparkline draws a small SVG image of a metric's recent history
+// (the total of the metric over all of its labels, from our time series store in timeseries.go),
+// i.e.
+//
+//	<img src="/metrics/sparkline?metric=http_requests_total&window=1h" alt="Requests">
+//
+// which can be embedded in our own pages (like /uptime) or in status pages elsewhere. Counters
+// are drawn as how much they increased by in each interval (since their totals only ever go
+// up), while gauges are drawn as they are.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_SPARKLINE_WINDOW = time.Hour
+	DEFAULT_SPARKLINE_WIDTH  = 120
+	DEFAULT_SPARKLINE_HEIGHT = 30
+	MAX_SPARKLINE_WIDTH      = 1000
+	MAX_SPARKLINE_HEIGHT     = 400
+	SPARKLINE_COLOUR         = "#1f77b4"
+)
+
+// Draw the values as an SVG sparkline of the given size: a line with the area beneath it
+// shaded, and a dot on the latest value. Too few values to draw a line give an empty sparkline.
+func sparklineSVG(values []float64, width int, height int, colour string, title string) []byte {
+
+	var output bytes.Buffer
+
+	fmt.Fprintf(&output, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`,
+		width, height, width, height)
+	fmt.Fprintf(&output, `<title>%s</title>`, html.EscapeString(title))
+
+	if len(values) < 2 {
+		fmt.Fprintf(&output, `<line x1="0" y1="%d" x2="%d" y2="%d" stroke="#ccc" stroke-width="1"/></svg>`,
+			height-1, width, height-1)
+		return output.Bytes()
+	}
+
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, value := range values {
+		low, high = min(low, value), max(high, value)
+	}
+
+	// Leave room for our dot at the edges, and draw a flat line through the middle when all of
+	// the values are the same
+	const margin = 2.0
+	points := make([]string, len(values))
+	var x, y float64
+	for i, value := range values {
+		x = margin + float64(i)*(float64(width)-2*margin)/float64(len(values)-1)
+		y = float64(height) / 2
+		if high > low {
+			y = float64(height) - margin - (value-low)*(float64(height)-2*margin)/(high-low)
+		}
+		points[i] = strconv.FormatFloat(x, 'f', 1, 64) + "," + strconv.FormatFloat(y, 'f', 1, 64)
+	}
+
+	fmt.Fprintf(&output, `<polygon points="%.1f,%d %s %.1f,%d" fill="%s" fill-opacity="0.15"/>`,
+		margin, height, strings.Join(points, " "), x, height, colour)
+	fmt.Fprintf(&output, `<polyline points="%s" fill="none" stroke="%s" stroke-width="1.5" stroke-linejoin="round"/>`,
+		strings.Join(points, " "), colour)
+	fmt.Fprintf(&output, `<circle cx="%.1f" cy="%.1f" r="2" fill="%s"/></svg>`, x, y, colour)
+
+	return output.Bytes()
+
+}
+
+// This is our sparkline handler, which draws the recent history of a metric (see above). The
+// window (how far back to go) defaults to DEFAULT_SPARKLINE_WINDOW, and the size and colour of
+// the sparkline can be set with the width, height and colour parameters.
+func sparklineHandler(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+
+	name := query.Get("metric")
+	if name == "" {
+		writeError(w, r, badRequestError("Which metric? Give its name as the metric parameter."))
+		return
+	}
+
+	window, err := durationParameter(query.Get("window"), "window", DEFAULT_SPARKLINE_WINDOW, metricsRetention)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	width, err := mazeParameter(query, "width", DEFAULT_SPARKLINE_WIDTH, 20, MAX_SPARKLINE_WIDTH)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	height, err := mazeParameter(query, "height", DEFAULT_SPARKLINE_HEIGHT, 10, MAX_SPARKLINE_HEIGHT)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	colour := SPARKLINE_COLOUR
+	if value := query.Get("colour"); value != "" {
+		parsed, err := parseColour(value)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		colour = parsed.Hex()
+	}
+
+	points, counter, known := timeSeriesHistory.query(name, time.Now().Add(-window))
+	if !known {
+		writeError(w, r, notFoundError().WithDetail("we have no history of the metric %s", name))
+		return
+	}
+	if counter {
+		points = counterIncreases(points)
+	}
+
+	values := make([]float64, len(points))
+	for i, point := range points {
+		values[i] = point.Value
+	}
+
+	title := fmt.Sprintf("%s over the last %s", name, window)
+	if len(values) > 0 {
+		title += fmt.Sprintf(" (latest %g)", values[len(values)-1])
+	}
+
+	incrementCounter("sparklines_total")
+
+	// Our history only changes once a sample is taken
+	setContentType(w, "image/svg+xml")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(metricsInterval.Seconds())))
+	w.Write(sparklineSVG(values, width, height, colour, title))
+
+}
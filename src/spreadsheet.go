@@ -0,0 +1,764 @@
+// Spreadsheet formulas. Our Excel demo's spreadsheet lives in the browser, but its cells can be
+// sent to us (as a JSON array of rows) to be evaluated on the server, so that our exports contain
+// computed values rather than formulas and sheets can be validated without a browser.
+//
+// Cells starting with = are formulas, which support numbers, "text", cell references (A1, with
+// optional $ anchors), the arithmetic operators + - * / ^ along with parentheses, and the
+// functions SUM, AVERAGE (or AVG), MIN, MAX and COUNT, which take values and ranges (A1:B3).
+// Other cells are numbers if they parse as one, and text otherwise. Formulas which can't be
+// evaluated result in Excel style error values: #ERROR! (a syntax error), #NAME? (an unknown
+// function), #VALUE! (text used as a number), #DIV/0!, #NUM! (an overflow) and #REF! (a
+// reference outside of the sheet's limits or a circular reference).
+//
+// POST /api/v1/spreadsheet/evaluate with {"data": [[...], ...]} returns the computed values along
+// with any errors, while /export/spreadsheet?format=csv|xlsx downloads the computed sheet.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	MAX_SPREADSHEET_CELLS        = 100 * 1000 // The largest spreadsheet we'll evaluate or export
+	MAX_SPREADSHEET_REQUEST_SIZE = 4 << 20
+	MAX_SPREADSHEET_ROWS         = 1048576 // The limits of an Excel sheet, which references can't go beyond
+	MAX_SPREADSHEET_COLUMNS      = 16384
+	MAX_FORMULA_STEPS            = 1000 * 1000 // The most cell reads the formulas of a sheet may make
+	MAX_FORMULA_DEPTH            = 10 * 1000   // The longest chain of formulas referring to formulas
+)
+
+// The file names and content types of our spreadsheet exports
+var (
+	spreadsheetExportNames = map[string]string{
+		"csv":  "spreadsheet.csv",
+		"xlsx": "spreadsheet.xlsx",
+	}
+	spreadsheetExportTypes = map[string]string{
+		"csv":  "text/csv; charset=utf-8",
+		"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	}
+)
+
+// The kinds of value a cell can have
+const (
+	VALUE_EMPTY = iota
+	VALUE_NUMBER
+	VALUE_TEXT
+	VALUE_ERROR
+)
+
+// The value of a cell. Errors hold their error value (i.e. #DIV/0!) as their text, along with a
+// detail describing what went wrong.
+type cellValue struct {
+	kind   int
+	number float64
+	text   string
+	detail string
+}
+
+func numberValue(number float64) cellValue {
+	if math.IsInf(number, 0) || math.IsNaN(number) {
+		return errorValue("#NUM!", "the result is too large")
+	}
+	return cellValue{kind: VALUE_NUMBER, number: number}
+}
+
+func errorValue(code string, detail string, arguments ...interface{}) cellValue {
+	return cellValue{kind: VALUE_ERROR, text: code, detail: fmt.Sprintf(detail, arguments...)}
+}
+
+// Returns the value as a number for arithmetic (empty cells count as zero)
+func (value cellValue) asNumber() cellValue {
+	switch value.kind {
+	case VALUE_EMPTY:
+		return numberValue(0)
+	case VALUE_TEXT:
+		return errorValue("#VALUE!", "%q isn't a number", value.text)
+	}
+	return value
+}
+
+// Returns the value as it's displayed in the sheet
+func (value cellValue) String() string {
+	switch value.kind {
+	case VALUE_NUMBER:
+		// Very large and very small numbers are displayed in scientific notation, like Excel
+		if value.number != 0 && (math.Abs(value.number) >= 1e15 || math.Abs(value.number) < 1e-9) {
+			return strconv.FormatFloat(value.number, 'E', -1, 64)
+		}
+		return strconv.FormatFloat(value.number, 'f', -1, 64)
+	case VALUE_EMPTY:
+		return ""
+	}
+	return value.text
+}
+
+// The (zero based) position of a cell
+type cellPosition struct {
+	row    int
+	column int
+}
+
+// Returns the name of the cell at the given position, i.e. B3
+func (position cellPosition) String() string {
+	return spreadsheetColumnName(position.column) + strconv.Itoa(position.row+1)
+}
+
+// A spreadsheet whose formulas are being evaluated
+type spreadsheet struct {
+	cells      [][]string
+	values     map[cellPosition]cellValue
+	evaluating map[cellPosition]bool // The cells whose formulas we're in the middle of evaluating
+	steps      int
+}
+
+// An error in one of the cells of a spreadsheet
+type spreadsheetError struct {
+	Cell    string `json:"cell"`
+	Formula string `json:"formula"`
+	Error   string `json:"error"`
+	Detail  string `json:"detail"`
+}
+
+// A spreadsheet's computed values, along with the errors within its cells
+type spreadsheetResult struct {
+	Values [][]string         `json:"values"`
+	Errors []spreadsheetError `json:"errors"`
+}
+
+var errFormulasTooComplex = badRequestError(fmt.Sprintf("The spreadsheet's formulas take more than %d steps to evaluate.", MAX_FORMULA_STEPS))
+
+// Parse the given JSON array of rows into the cells of a spreadsheet
+func parseSpreadsheetData(data []byte) ([][]string, error) {
+
+	var rows [][]interface{}
+
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, badRequestError("The spreadsheet data must be a JSON array of rows.").Wrap(err)
+	}
+
+	total := 0
+	for _, row := range rows {
+		total += len(row)
+	}
+
+	if total > MAX_SPREADSHEET_CELLS {
+		return nil, badRequestError(fmt.Sprintf("Spreadsheets are limited to %d cells.", MAX_SPREADSHEET_CELLS))
+	}
+
+	cells := make([][]string, len(rows))
+
+	for row := range rows {
+		cells[row] = make([]string, len(rows[row]))
+		for column, cell := range rows[row] {
+			switch cell := cell.(type) {
+			case nil:
+			case string:
+				cells[row][column] = cell
+			case float64:
+				cells[row][column] = numberValue(cell).String()
+			default:
+				cells[row][column] = fmt.Sprint(cell)
+			}
+		}
+	}
+
+	return cells, nil
+
+}
+
+// Evaluate the formulas of the given cells, returning the value of every cell
+func evaluateSpreadsheet(cells [][]string) (spreadsheetResult, error) {
+
+	sheet := &spreadsheet{cells: cells, values: map[cellPosition]cellValue{}, evaluating: map[cellPosition]bool{}}
+	result := spreadsheetResult{Values: make([][]string, len(cells)), Errors: []spreadsheetError{}}
+
+	for row := range cells {
+		result.Values[row] = make([]string, len(cells[row]))
+		for column := range cells[row] {
+
+			position := cellPosition{row: row, column: column}
+			value := sheet.value(position)
+
+			if sheet.steps > MAX_FORMULA_STEPS {
+				return result, errFormulasTooComplex
+			}
+
+			result.Values[row][column] = value.String()
+
+			if value.kind == VALUE_ERROR {
+				result.Errors = append(result.Errors, spreadsheetError{
+					Cell:    position.String(),
+					Formula: cells[row][column],
+					Error:   value.text,
+					Detail:  value.detail,
+				})
+			}
+
+		}
+	}
+
+	return result, nil
+
+}
+
+// Returns the value of the cell at the given position (evaluating its formula if it has one)
+func (sheet *spreadsheet) value(position cellPosition) cellValue {
+
+	sheet.steps++
+
+	if sheet.steps > MAX_FORMULA_STEPS {
+		return errorValue("#REF!", "the sheet's formulas are too complex")
+	}
+
+	if position.row >= len(sheet.cells) || position.column >= len(sheet.cells[position.row]) {
+		return cellValue{}
+	}
+
+	if value, found := sheet.values[position]; found {
+		return value
+	}
+
+	if sheet.evaluating[position] {
+		return errorValue("#REF!", "%s refers to itself", position)
+	}
+
+	if len(sheet.evaluating) >= MAX_FORMULA_DEPTH {
+		return errorValue("#REF!", "more than %d formulas refer to each other in turn", MAX_FORMULA_DEPTH)
+	}
+
+	raw := sheet.cells[position.row][position.column]
+	var value cellValue
+
+	if formula, found := strings.CutPrefix(raw, "="); found {
+		sheet.evaluating[position] = true
+		value = sheet.evaluate(formula)
+		delete(sheet.evaluating, position)
+	} else if number, err := parseCellNumber(raw); err == nil {
+		value = numberValue(number)
+	} else if raw != "" {
+		value = cellValue{kind: VALUE_TEXT, text: raw}
+	}
+
+	sheet.values[position] = value
+
+	return value
+
+}
+
+// Parse the number within a cell. Only plain decimal numbers count (Go's hexadecimal, infinite
+// and not-a-number values are text within a spreadsheet).
+func parseCellNumber(text string) (float64, error) {
+
+	text = strings.TrimSpace(text)
+
+	if strings.ContainsFunc(text, func(r rune) bool { return unicode.IsLetter(r) && r != 'e' && r != 'E' }) {
+		return 0, errors.New("not a decimal number")
+	}
+
+	return strconv.ParseFloat(text, 64)
+
+}
+
+// Evaluate the given formula (without its leading =)
+func (sheet *spreadsheet) evaluate(formula string) cellValue {
+
+	parser := &formulaParser{sheet: sheet, input: formula}
+
+	value := parser.expression()
+
+	if parser.err == nil {
+		parser.skipSpaces()
+		if parser.position < len(parser.input) {
+			parser.fail("unexpected %q", parser.input[parser.position:])
+		}
+	}
+
+	if parser.err != nil {
+		return *parser.err
+	}
+
+	return value
+
+}
+
+// A recursive descent parser which evaluates a formula as it parses it:
+//
+//	expression = term { ("+" | "-") term }
+//	term       = power { ("*" | "/") power }
+//	power      = unary { "^" unary }
+//	unary      = ("-" | "+") unary | primary
+//	primary    = number | string | reference | function "(" [ argument { "," argument } ] ")" | "(" expression ")"
+//	argument   = range | expression
+type formulaParser struct {
+	sheet    *spreadsheet
+	input    string
+	position int
+	err      *cellValue // The first syntax error, which becomes the formula's value
+}
+
+func (parser *formulaParser) fail(detail string, arguments ...interface{}) cellValue {
+	if parser.err == nil {
+		err := errorValue("#ERROR!", detail, arguments...)
+		parser.err = &err
+	}
+	return *parser.err
+}
+
+func (parser *formulaParser) skipSpaces() {
+	for parser.position < len(parser.input) && parser.input[parser.position] == ' ' {
+		parser.position++
+	}
+}
+
+// Skip past the given character if it's next, returning whether it was
+func (parser *formulaParser) accept(character byte) bool {
+	parser.skipSpaces()
+	if parser.position < len(parser.input) && parser.input[parser.position] == character {
+		parser.position++
+		return true
+	}
+	return false
+}
+
+// Apply the given arithmetic operator to the given values
+func applyOperator(operator byte, left, right cellValue) cellValue {
+
+	left, right = left.asNumber(), right.asNumber()
+
+	if left.kind == VALUE_ERROR {
+		return left
+	} else if right.kind == VALUE_ERROR {
+		return right
+	}
+
+	switch operator {
+	case '+':
+		return numberValue(left.number + right.number)
+	case '-':
+		return numberValue(left.number - right.number)
+	case '*':
+		return numberValue(left.number * right.number)
+	case '/':
+		if right.number == 0 {
+			return errorValue("#DIV/0!", "division by zero")
+		}
+		return numberValue(left.number / right.number)
+	}
+
+	return numberValue(math.Pow(left.number, right.number))
+
+}
+
+func (parser *formulaParser) expression() cellValue {
+	value := parser.term()
+	for parser.err == nil {
+		if parser.accept('+') {
+			value = applyOperator('+', value, parser.term())
+		} else if parser.accept('-') {
+			value = applyOperator('-', value, parser.term())
+		} else {
+			break
+		}
+	}
+	return value
+}
+
+func (parser *formulaParser) term() cellValue {
+	value := parser.power()
+	for parser.err == nil {
+		if parser.accept('*') {
+			value = applyOperator('*', value, parser.power())
+		} else if parser.accept('/') {
+			value = applyOperator('/', value, parser.power())
+		} else {
+			break
+		}
+	}
+	return value
+}
+
+func (parser *formulaParser) power() cellValue {
+	value := parser.unary()
+	for parser.err == nil && parser.accept('^') {
+		value = applyOperator('^', value, parser.unary())
+	}
+	return value
+}
+
+func (parser *formulaParser) unary() cellValue {
+	if parser.accept('-') {
+		return applyOperator('-', numberValue(0), parser.unary())
+	} else if parser.accept('+') {
+		return parser.unary().asNumber()
+	}
+	return parser.primary()
+}
+
+func (parser *formulaParser) primary() cellValue {
+
+	parser.skipSpaces()
+
+	if parser.position >= len(parser.input) {
+		return parser.fail("the formula ends unexpectedly")
+	}
+
+	start := parser.position
+	character := parser.input[start]
+
+	switch {
+
+	case parser.accept('('):
+		value := parser.expression()
+		if !parser.accept(')') {
+			return parser.fail("a ) is missing")
+		}
+		return value
+
+	case character == '"':
+		end := strings.IndexByte(parser.input[start+1:], '"')
+		if end < 0 {
+			return parser.fail("a closing \" is missing")
+		}
+		parser.position = start + end + 2
+		return cellValue{kind: VALUE_TEXT, text: parser.input[start+1 : start+end+1]}
+
+	case character == '.' || (character >= '0' && character <= '9'):
+		for parser.position < len(parser.input) && strings.IndexByte("0123456789.eE", parser.input[parser.position]) >= 0 {
+			// An exponent may have a sign
+			if parser.input[parser.position] == 'e' || parser.input[parser.position] == 'E' {
+				if parser.position+1 < len(parser.input) && strings.IndexByte("+-", parser.input[parser.position+1]) >= 0 {
+					parser.position++
+				}
+			}
+			parser.position++
+		}
+		number, err := strconv.ParseFloat(parser.input[start:parser.position], 64)
+		if err != nil {
+			return parser.fail("%q isn't a number", parser.input[start:parser.position])
+		}
+		return numberValue(number)
+
+	}
+
+	name := parser.name()
+
+	if name == "" {
+		return parser.fail("unexpected %q", parser.input[start:])
+	}
+
+	if parser.accept('(') {
+		return parser.function(strings.ToUpper(name))
+	}
+
+	position, err := parseCellReference(name)
+	if err != nil {
+		return parser.fail("%s", err)
+	}
+	if position.row >= MAX_SPREADSHEET_ROWS || position.column >= MAX_SPREADSHEET_COLUMNS {
+		return errorValue("#REF!", "%s is outside of the sheet", name)
+	}
+
+	if parser.accept(':') {
+		return errorValue("#VALUE!", "ranges can only be used within functions")
+	}
+
+	return parser.sheet.value(position)
+
+}
+
+// Read the next name (a function name or cell reference)
+func (parser *formulaParser) name() string {
+	start := parser.position
+	for parser.position < len(parser.input) {
+		character := rune(parser.input[parser.position])
+		if !unicode.IsLetter(character) && !unicode.IsDigit(character) && character != '$' {
+			break
+		}
+		parser.position++
+	}
+	return parser.input[start:parser.position]
+}
+
+// Parse the given cell reference, i.e. B3 or $B$3
+func parseCellReference(reference string) (cellPosition, error) {
+
+	name := strings.ToUpper(strings.ReplaceAll(reference, "$", ""))
+	letters := strings.IndexFunc(name, func(r rune) bool { return r < 'A' || r > 'Z' })
+
+	if letters <= 0 || letters > 3 {
+		return cellPosition{}, fmt.Errorf("%q isn't a cell reference", reference)
+	}
+
+	row, err := strconv.Atoi(name[letters:])
+	if err != nil || row < 1 {
+		return cellPosition{}, fmt.Errorf("%q isn't a cell reference", reference)
+	}
+
+	column := 0
+	for _, letter := range name[:letters] {
+		column = column*26 + int(letter-'A') + 1
+	}
+
+	return cellPosition{row: row - 1, column: column - 1}, nil
+
+}
+
+// Evaluate a call of the given function, whose opening parenthesis we've just read
+func (parser *formulaParser) function(name string) cellValue {
+
+	var arguments []cellValue
+
+	if !parser.accept(')') {
+		for parser.err == nil {
+			arguments = append(arguments, parser.argument()...)
+			if parser.accept(')') {
+				break
+			} else if !parser.accept(',') {
+				return parser.fail("a ) is missing")
+			}
+		}
+	}
+
+	if parser.err != nil {
+		return *parser.err
+	}
+
+	// Our functions only look at numbers, skipping empty and text cells (like Excel) but
+	// passing on errors (other than COUNT, which only counts the numbers)
+	var numbers []float64
+	for _, argument := range arguments {
+		switch argument.kind {
+		case VALUE_ERROR:
+			if name != "COUNT" {
+				return argument
+			}
+		case VALUE_NUMBER:
+			numbers = append(numbers, argument.number)
+		}
+	}
+
+	switch name {
+
+	case "SUM":
+		total := 0.0
+		for _, number := range numbers {
+			total += number
+		}
+		return numberValue(total)
+
+	case "AVERAGE", "AVG":
+		if len(numbers) == 0 {
+			return errorValue("#DIV/0!", "%s of no numbers", name)
+		}
+		total := 0.0
+		for _, number := range numbers {
+			total += number
+		}
+		return numberValue(total / float64(len(numbers)))
+
+	case "MIN", "MAX":
+		if len(numbers) == 0 {
+			return numberValue(0)
+		}
+		result := numbers[0]
+		for _, number := range numbers[1:] {
+			if name == "MIN" {
+				result = math.Min(result, number)
+			} else {
+				result = math.Max(result, number)
+			}
+		}
+		return numberValue(result)
+
+	case "COUNT":
+		return numberValue(float64(len(numbers)))
+
+	}
+
+	return errorValue("#NAME?", "there's no %s function", name)
+
+}
+
+// Evaluate a function argument, which is either a range (returning the values of its cells) or
+// an expression
+func (parser *formulaParser) argument() []cellValue {
+
+	parser.skipSpaces()
+	start := parser.position
+
+	first, err := parseCellReference(parser.name())
+
+	if err != nil || !parser.accept(':') {
+		parser.position = start
+		return []cellValue{parser.expression()}
+	}
+
+	parser.skipSpaces()
+	last, err := parseCellReference(parser.name())
+	if err != nil {
+		return []cellValue{parser.fail("a range must end with a cell reference")}
+	}
+
+	// Ranges may be given in any order, i.e. B3:A1
+	top, bottom := min(first.row, last.row), max(first.row, last.row)
+	left, right := min(first.column, last.column), max(first.column, last.column)
+
+	if bottom >= MAX_SPREADSHEET_ROWS || right >= MAX_SPREADSHEET_COLUMNS {
+		return []cellValue{errorValue("#REF!", "the range is outside of the sheet")}
+	}
+
+	// Cells beyond the end of the sheet are empty, so we only need to read the ones within it
+	var values []cellValue
+	for row := top; row <= min(bottom, len(parser.sheet.cells)-1); row++ {
+		for column := left; column <= min(right, len(parser.sheet.cells[row])-1); column++ {
+			values = append(values, parser.sheet.value(cellPosition{row: row, column: column}))
+			if parser.sheet.steps > MAX_FORMULA_STEPS {
+				return values
+			}
+		}
+	}
+
+	return values
+
+}
+
+// Read and evaluate the spreadsheet sent with the given request (a JSON array of rows in the
+// data parameter)
+func evaluatedSpreadsheet(data string) (spreadsheetResult, error) {
+
+	var cells [][]string
+
+	if data != "" {
+		var err error
+		if cells, err = parseSpreadsheetData([]byte(data)); err != nil {
+			return spreadsheetResult{}, err
+		}
+	}
+
+	return evaluateSpreadsheet(cells)
+
+}
+
+// This is our spreadsheet evaluation API handler. It evaluates a JSON object holding the sheet's
+// cells as a data array of rows, returning their computed values and any errors within them.
+func spreadsheetEvaluateHandler(w http.ResponseWriter, r *http.Request) {
+
+	var request struct {
+		Data json.RawMessage `json:"data"`
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_SPREADSHEET_REQUEST_SIZE))
+
+	if err := decoder.Decode(&request); err != nil || request.Data == nil {
+		writeError(w, r, badRequestError("The request must be a JSON object with a data array of rows.").Wrap(err))
+		return
+	}
+
+	cells, err := parseSpreadsheetData(request.Data)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	endSpan := startSpan(r.Context(), "evaluate")
+	result, err := evaluateSpreadsheet(cells)
+	endSpan()
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if len(result.Errors) == 0 {
+		incrementCounter("spreadsheet_evaluations_total", "result", "valid")
+	} else {
+		incrementCounter("spreadsheet_evaluations_total", "result", "invalid")
+	}
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	json.NewEncoder(w).Encode(struct {
+		Valid bool `json:"valid"`
+		spreadsheetResult
+	}{len(result.Errors) == 0, result})
+
+}
+
+// This is our spreadsheet export handler. The format parameter selects csv or xlsx, while the
+// data parameter holds the sheet's cells as a JSON array of rows (like our PDF export). The
+// exported cells hold the computed values of any formulas.
+func spreadsheetExportHandler(w http.ResponseWriter, r *http.Request) {
+
+	format := r.FormValue("format")
+
+	if spreadsheetExportNames[format] == "" {
+		writeError(w, r, badRequestError("The format parameter must be csv or xlsx."))
+		return
+	}
+
+	endSpan := startSpan(r.Context(), "evaluate")
+	result, err := evaluatedSpreadsheet(r.FormValue("data"))
+	endSpan()
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var output bytes.Buffer
+
+	if format == "csv" {
+		writer := csv.NewWriter(&output)
+		for _, row := range result.Values {
+			writer.Write(csvSafeRow(row))
+		}
+		writer.Flush()
+		err = writer.Error()
+	} else {
+		err = writeXLSX(&output, result.Values)
+	}
+
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("writing the %s export", format))
+		return
+	}
+
+	incrementCounter("spreadsheet_exports_total", "format", format)
+
+	setContentType(w, spreadsheetExportTypes[format])
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": spreadsheetExportNames[format],
+	}))
+	w.Write(output.Bytes())
+
+}
+
+// Returns the given row with any text which a spreadsheet application would run as a formula
+// (text starting with =, +, - or @) prefixed with a ', so that opening our CSV exports can't
+// run anything
+func csvSafeRow(row []string) []string {
+
+	safe := make([]string, len(row))
+
+	for column, value := range row {
+		if _, err := parseCellNumber(value); err != nil && value != "" && strings.IndexByte("=+-@", value[0]) >= 0 {
+			value = "'" + value
+		}
+		safe[column] = value
+	}
+
+	return safe
+
+}
@@ -0,0 +1,174 @@
+// Handlers for our embedded static files (favicon, apple touch icons, web app manifest and the
+// module of our WebAssembly demo). These are compiled into our binary so that the server
+// doesn't depend on any files being present on disk. The WebAssembly module and its shim are
+// embedded by wasm.go, so builds with the nowasm tag leave them out.
+//
+// Each file is served under its plain name (i.e. /favicon.ico, which browsers and crawlers
+// request directly) and under a fingerprinted name which includes a hash of its contents (i.e.
+// /assets/favicon.1a2b3c4d.ico). Our templates link to the fingerprinted names via assetPath,
+// so the fingerprinted files can be cached as immutable: a changed file gets a new URL.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// How long browsers may cache our icons and manifest before revalidating them
+const STATIC_FILE_MAX_AGE = 7 * 24 * time.Hour
+
+// How long browsers may cache the fingerprinted versions of our static files. The URL of a
+// fingerprinted file changes whenever its contents do, so they can be cached "forever".
+const FINGERPRINTED_FILE_MAX_AGE = 365 * 24 * time.Hour
+
+// The path our fingerprinted static files are served under (i.e. /assets/favicon.1a2b3c4d.ico)
+const ASSETS_PATH = "/assets/"
+
+// Our embedded static files. You can find the raw files in the static sub-directory.
+//
+//go:embed static/favicon.ico static/apple-touch-icon.png static/icon-192.png static/icon-512.png static/site.webmanifest
+var staticFiles embed.FS
+
+// The names of our static files
+var staticFileNames = []string{
+	"favicon.ico",
+	"apple-touch-icon.png",
+	"icon-192.png",
+	"icon-512.png",
+	"site.webmanifest",
+}
+
+// A static file along with the details we serve it with
+type staticFile struct {
+	name        string
+	data        []byte
+	eTag        string
+	contentType string
+}
+
+// Our static files by name, along with a lookup of their fingerprinted names (i.e.
+// favicon.1a2b3c4d.ico) to their original names. These are only written to by init.
+var (
+	staticFilesByName   = map[string]*staticFile{}
+	fingerprintedAssets = map[string]string{}
+)
+
+// Load our static files. Our templates need their fingerprinted names whether or not we serve
+// our own routes (i.e. in proxy mode), so we do this up front.
+func init() {
+	addStaticFiles(staticFiles, staticFileNames...)
+}
+
+// Load the static files with the given names from the given embedded file system (under its
+// static directory), to be served along with the rest. This is only called from init.
+func addStaticFiles(files embed.FS, names ...string) {
+	for _, name := range names {
+		file := loadStaticFile(files, name)
+		staticFilesByName[name] = file
+		fingerprintedAssets[fingerprintedName(file)] = name
+	}
+}
+
+// Register the routes for each of our embedded static files, both under their plain names and
+// under their fingerprinted names (see assetPath)
+func registerStaticFiles(router *http.ServeMux) {
+
+	for name, file := range staticFilesByName {
+		handleRoute(router, "/"+name, staticFileHandler(file, STATIC_FILE_MAX_AGE, false))
+	}
+
+	handleRoute(router, ASSETS_PATH+"{name}", http.HandlerFunc(fingerprintedAssetHandler))
+
+}
+
+// Read the embedded static file with the given name. The file contents are read once up front
+// so we can compute an ETag, which allows browsers to revalidate their cached copies without
+// having to download the file again.
+func loadStaticFile(files embed.FS, name string) *staticFile {
+
+	fileData, err := files.ReadFile("static/" + name)
+
+	if err != nil {
+		// Our static files are embedded at compile time, so this can only happen if a list
+		// of names doesn't match the files embedded alongside it.
+		panic(err)
+	}
+
+	return &staticFile{
+		name:        name,
+		data:        fileData,
+		eTag:        fmt.Sprintf("\"%x\"", sha256.Sum256(fileData)),
+		contentType: contentTypeFor(name),
+	}
+
+}
+
+// Returns the fingerprinted name of the given file, which includes a hash of its contents
+// (i.e. favicon.ico becomes favicon.1a2b3c4d.ico)
+func fingerprintedName(file *staticFile) string {
+
+	extension := path.Ext(file.name)
+	hash := strings.Trim(file.eTag, `"`)[:8]
+
+	return strings.TrimSuffix(file.name, extension) + "." + hash + extension
+
+}
+
+// Returns the URL of the fingerprinted version of the static file with the given name. This is
+// available as assetPath within our templates, i.e. {{ assetPath "favicon.ico" }}. Unknown
+// names are an error, which our template checks at startup catch.
+func assetPath(name string) (string, error) {
+
+	file, ok := staticFilesByName[name]
+
+	if !ok {
+		return "", fmt.Errorf("unknown static file %q", name)
+	}
+
+	return urlFor(ASSETS_PATH + fingerprintedName(file)), nil
+
+}
+
+// Serve the static file with the requested fingerprinted name
+func fingerprintedAssetHandler(w http.ResponseWriter, r *http.Request) {
+
+	name, ok := fingerprintedAssets[r.PathValue("name")]
+
+	if !ok {
+		// This includes the fingerprinted names of older versions of our files, which
+		// browsers will request again when they load a page with the current names
+		writeError(w, r, notFoundError())
+		return
+	}
+
+	staticFileHandler(staticFilesByName[name], FINGERPRINTED_FILE_MAX_AGE, true)(w, r)
+
+}
+
+// Returns a handler which serves the given static file, with the given cache lifetime.
+// Immutable files (our fingerprinted files) are never revalidated by browsers.
+func staticFileHandler(file *staticFile, maxAge time.Duration, immutable bool) http.HandlerFunc {
+
+	cacheControl := fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
+
+	if immutable {
+		cacheControl += ", immutable"
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		setContentType(w, file.contentType)
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Header().Set("ETag", file.eTag)
+
+		// ServeContent takes care of conditional (If-None-Match) and range requests for us
+		http.ServeContent(w, r, file.name, time.Time{}, bytes.NewReader(file.data))
+	}
+
+}
@@ -0,0 +1,60 @@
+// JSON file storage. Our demos which keep state across restarts (i.e. cookie choices, uptime
+// history and contact messages) save it as a JSON file, which they load at startup (as a
+// component, see components.go).
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// Load the JSON file at the given path into the given value. A missing file isn't an error, as
+// it's simply created when we first save.
+func loadJSONFile(path string, value interface{}) error {
+
+	data, err := os.ReadFile(path)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, value)
+
+}
+
+// Save the given value as JSON to the file at the given path
+func saveJSONFile(path string, value interface{}) error {
+
+	data, err := json.Marshal(value)
+
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a crash never leaves a half written file
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+
+}
+
+// Returns a component (see components.go) which loads a store from its JSON file when it's
+// started, naming the flag which gave the file in its errors. Our stores save themselves as they
+// change, so there's nothing to do when they stop.
+func newStoreComponent(flagName string, load func() error) Component {
+	return componentFuncs{start: func(ctx context.Context) error {
+		if err := load(); err != nil {
+			return fmt.Errorf("invalid -%s: %w", flagName, err)
+		}
+		return nil
+	}}
+}
@@ -0,0 +1,738 @@
+// Password strength estimates, in the style of Dropbox's zxcvbn. Rather than counting character
+// classes, we estimate how many guesses an attacker who knows how people choose passwords
+// would need. The password is split into the patterns attackers try (common passwords, words,
+// keyboard rows and other sequences, repeats and dates), with brute force covering whatever is
+// left, and we pick the split which needs the fewest guesses.
+//
+// Each pattern's guesses come from how many passwords share it (i.e. a common password's rank,
+// or how many years a date could be from), multiplied up for variations like capital letters,
+// l33t substitutions (p@ssw0rd) and reversed words. A split of several patterns needs the
+// product of their guesses times the number of ways they could be ordered. See "zxcvbn:
+// Low-Budget Password Strength Estimation" (Wheeler, 2016) for the details we follow.
+//
+// Guesses are worked in log10 so that long passwords don't overflow. Passwords are cut off
+// after MAX_STRENGTH_LENGTH characters, as longer passwords are all very strong anyway.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	MAX_STRENGTH_LENGTH = 100 // The most characters of a password we look at
+
+	BRUTE_FORCE_CARDINALITY   = 10    // The guesses per character of a password without patterns
+	MIN_YEAR_SPACE            = 20    // The fewest years a date or year could be from
+	MIN_GUESSES_BEFORE_GROWTH = 10000 // The penalty for each extra pattern in a split
+)
+
+// The passwords people use most, in order of popularity. Their rank is their guesses.
+var commonPasswordList = strings.Fields(`
+	123456 password 123456789 12345678 12345 qwerty 1234567 111111 1234567890 123123 abc123
+	1234 password1 iloveyou 1q2w3e4r 000000 qwerty123 zaq12wsx dragon sunshine princess
+	letmein 654321 monkey 1qaz2wsx 123321 qwertyuiop superman asdfghjkl trustno1
+	football baseball welcome shadow master jordan23 michael login admin starwars passw0rd
+	hello freedom whatever qazwsx ninja mustang access flower 696969 batman solo charlie
+	donald loveme jennifer hunter buster soccer harley ranger daniel thomas tigger robert
+	killer george andrew joshua pepper summer ashley nicole chelsea matthew yankees computer
+	amanda taylor cheese maggie secret 121212 11111111 123qwe password123 abcdef changeme
+	default root test guest qwe123 zxcvbnm asdf asdfgh michelle jessica pass love lovely
+	angel baby family hello123 welcome1 admin123 iloveu samsung google apple orange banana
+	chocolate purple diamond liverpool arsenal cookie pokemon naruto matrix corvette
+	mercedes ferrari internet winter spring autumn monday friday happy silver golden qwerty1
+	123abc a123456 987654321 666666 888888 7777777 159753 147258369 112233 letmein1 zxcvbn
+	123456a 1111 0000 2000 654321a 1qazxsw2 q1w2e3r4 aaaaaa abcd1234 pass123 test123
+	blink182 hockey hunter2 jordan killer1 lakers master1 michael1 mickey money monkey1
+	mother naughty nintendo oliver pass1234 qwertyu rainbow samantha scooter shannon
+	sophie spider steelers sunshine1 super123 tennis tiger toyota trustme william yellow
+`)
+
+// Our dictionaries, mapping lowercase words to their ranks
+var (
+	commonPasswords = map[string]int{}
+	englishWords    = map[string]int{} // The words of our passphrase wordlist (see password.go)
+)
+
+// The characters people substitute for letters, and the letters they might stand for
+var l33tTable = map[rune][]rune{
+	'4': {'a'}, '@': {'a'}, '8': {'b'}, '(': {'c'}, '{': {'c'}, '[': {'c'}, '<': {'c'},
+	'3': {'e'}, '6': {'g'}, '9': {'g'}, '1': {'i', 'l'}, '!': {'i'}, '|': {'i', 'l'},
+	'0': {'o'}, '$': {'s'}, '5': {'s'}, '7': {'t'}, '+': {'t'}, '%': {'x'}, '2': {'z'},
+}
+
+// The runs of characters people type in order
+var sequenceAlphabets = []struct {
+	name     string
+	keyboard bool
+	letters  string
+}{
+	{name: "letters", letters: "abcdefghijklmnopqrstuvwxyz"},
+	{name: "digits", letters: "0123456789"},
+	{name: "keyboard", keyboard: true, letters: "qwertyuiop"},
+	{name: "keyboard", keyboard: true, letters: "asdfghjkl"},
+	{name: "keyboard", keyboard: true, letters: "zxcvbnm"},
+}
+
+// Dates, with or without separators (i.e. 13/05/1987, 1987-05-13 or 130587)
+var (
+	separatedDatePattern = regexp.MustCompile(`^(\d{1,4})([-/._ ])(\d{1,2})([-/._ ])(\d{1,4})$`)
+	yearPattern          = regexp.MustCompile(`^(19|20)\d\d$`)
+)
+
+// How quickly attackers can guess in various scenarios, per second
+var crackScenarios = []struct {
+	name string
+	rate float64
+}{
+	{name: "online_throttling", rate: 100.0 / 3600}, // A site which limits login attempts
+	{name: "online_no_throttling", rate: 10},
+	{name: "offline_slow_hashing", rate: 1e4}, // Stolen hashes from bcrypt, scrypt and the like
+	{name: "offline_fast_hashing", rate: 1e10},
+}
+
+// A pattern within a password
+type strengthMatch struct {
+	Pattern      string  `json:"pattern"` // dictionary, sequence, repeat, date or brute_force
+	Token        string  `json:"token"`
+	GuessesLog10 float64 `json:"guesses_log10"`
+	Dictionary   string  `json:"dictionary,omitempty"` // common_passwords, english or user_inputs
+	Rank         int     `json:"rank,omitempty"`
+	Reversed     bool    `json:"reversed,omitempty"`
+	L33t         bool    `json:"l33t,omitempty"`
+	Sequence     string  `json:"sequence,omitempty"` // letters, digits or keyboard
+	Descending   bool    `json:"descending,omitempty"`
+	RepeatCount  int     `json:"repeat_count,omitempty"`
+	Year         int     `json:"year,omitempty"`
+
+	start, end int // The runes of the password we cover
+}
+
+// Our estimate of a password's strength
+type strengthEstimate struct {
+	Score        int               `json:"score"` // From 0 (too guessable) to 4 (very unguessable)
+	GuessesLog10 float64           `json:"guesses_log10"`
+	CrackTimes   map[string]string `json:"crack_times"`
+	Feedback     strengthFeedback  `json:"feedback"`
+	Sequence     []strengthMatch   `json:"sequence"`
+}
+
+// Advice on improving a password
+type strengthFeedback struct {
+	Warning     string   `json:"warning,omitempty"`
+	Suggestions []string `json:"suggestions"`
+}
+
+func init() {
+	for i, password := range commonPasswordList {
+		if _, found := commonPasswords[password]; !found {
+			commonPasswords[password] = i + 1
+		}
+	}
+}
+
+// Estimate the strength of the given password. The user inputs are words an attacker might
+// know (i.e. the user's name and email address) and are treated as very common passwords.
+func estimateStrength(password string, userInputs []string) strengthEstimate {
+
+	runes := []rune(password)
+	runes = runes[:min(len(runes), MAX_STRENGTH_LENGTH)]
+
+	inputs := map[string]int{}
+	for i, input := range userInputs {
+		inputs[strings.ToLower(input)] = i + 1
+	}
+
+	estimator := &strengthEstimator{userInputs: inputs, memo: map[string]float64{}}
+	sequence, guessesLog10 := estimator.mostGuessable(runes)
+
+	estimate := strengthEstimate{
+		GuessesLog10: math.Round(guessesLog10*1000) / 1000,
+		CrackTimes:   map[string]string{},
+		Sequence:     sequence,
+	}
+
+	for _, threshold := range []float64{1e3, 1e6, 1e8, 1e10} {
+		if guessesLog10 >= math.Log10(threshold+5) {
+			estimate.Score++
+		}
+	}
+
+	for _, scenario := range crackScenarios {
+		estimate.CrackTimes[scenario.name] = describeCrackTime(math.Pow(10, guessesLog10) / scenario.rate)
+	}
+
+	estimate.Feedback = strengthAdvice(estimate.Score, sequence)
+
+	return estimate
+
+}
+
+// Finds the patterns within passwords. Repeats are estimated by estimating the part which is
+// repeated, so we remember the estimates of those parts.
+type strengthEstimator struct {
+	userInputs map[string]int
+	memo       map[string]float64
+}
+
+// Split the given password into the patterns which need the fewest guesses overall, returning
+// them along with the guesses needed (in log10)
+func (estimator *strengthEstimator) mostGuessable(password []rune) ([]strengthMatch, float64) {
+
+	n := len(password)
+	if n == 0 {
+		return []strengthMatch{}, 0
+	}
+
+	matchesByEnd := make([][]strengthMatch, n+1)
+	for _, match := range estimator.findMatches(password) {
+		matchesByEnd[match.end] = append(matchesByEnd[match.end], match)
+	}
+
+	// best[k][l] is the product of the guesses (in log10) of the best split of the first k
+	// runes into l patterns, and last[k][l] the final pattern of that split
+	best := make([][]float64, n+1)
+	last := make([][]strengthMatch, n+1)
+	for k := range best {
+		best[k], last[k] = make([]float64, k+1), make([]strengthMatch, k+1)
+		for l := range best[k] {
+			best[k][l] = math.Inf(1)
+		}
+	}
+	best[0][0] = 0
+
+	for end := 1; end <= n; end++ {
+
+		candidates := matchesByEnd[end]
+		for start := range end {
+			candidates = append(candidates, strengthMatch{Pattern: "brute_force", start: start, end: end,
+				GuessesLog10: float64(end-start) * math.Log10(BRUTE_FORCE_CARDINALITY)})
+		}
+
+		for _, match := range candidates {
+
+			// Patterns which don't cover the whole password need a few guesses, at least
+			if match.end-match.start < n {
+				minimum := 50.0
+				if match.end-match.start == 1 {
+					minimum = 10
+				}
+				match.GuessesLog10 = max(match.GuessesLog10, math.Log10(minimum))
+			}
+			match.Token = string(password[match.start:match.end])
+
+			for l, product := range best[match.start] {
+				if guesses := product + match.GuessesLog10; guesses < best[end][l+1] {
+					best[end][l+1], last[end][l+1] = guesses, match
+				}
+			}
+
+		}
+
+	}
+
+	// The best split weighs up its product against its number of patterns
+	bestLength, bestGuesses := 0, math.Inf(1)
+	for l, product := range best[n] {
+		factorial, _ := math.Lgamma(float64(l + 1))
+		if guesses := addLog10(factorial/math.Ln10+product, float64(l-1)*math.Log10(MIN_GUESSES_BEFORE_GROWTH)); guesses < bestGuesses {
+			bestLength, bestGuesses = l, guesses
+		}
+	}
+
+	sequence := make([]strengthMatch, bestLength)
+	for k, l := n, bestLength; l > 0; l-- {
+		sequence[l-1] = last[k][l]
+		k = last[k][l].start
+	}
+
+	return sequence, bestGuesses
+
+}
+
+// Returns log10(10^a + 10^b)
+func addLog10(a, b float64) float64 {
+	high, low := max(a, b), min(a, b)
+	return high + math.Log10(1+math.Pow(10, low-high))
+}
+
+// Find every pattern within the given password
+func (estimator *strengthEstimator) findMatches(password []rune) []strengthMatch {
+
+	var matches []strengthMatch
+	lower := []rune(strings.ToLower(string(password)))
+	if len(lower) != len(password) {
+		lower = password // Lowercasing changed the number of runes, so we match as is
+	}
+
+	for start := range password {
+		for end := start + 1; end <= len(password); end++ {
+			matches = append(matches, estimator.dictionaryMatches(password, lower, start, end)...)
+			if match, found := dateMatch(string(password[start:end])); found {
+				match.start, match.end = start, end
+				matches = append(matches, match)
+			}
+		}
+	}
+
+	matches = append(matches, sequenceMatches(lower)...)
+	matches = append(matches, estimator.repeatMatches(password)...)
+
+	return matches
+
+}
+
+// Returns the rank of the given lowercase word in our dictionaries (or 0 if it's in none)
+func (estimator *strengthEstimator) lookup(word string) (string, int) {
+	if rank, found := estimator.userInputs[word]; found {
+		return "user_inputs", rank
+	}
+	if rank, found := commonPasswords[word]; found {
+		return "common_passwords", rank
+	}
+	if _, found := englishWords[word]; found && len(word) >= 3 {
+		return "english", len(englishWords)
+	}
+	return "", 0
+}
+
+// Find the dictionary words which the given part of the password spells, as is, reversed or
+// with l33t substitutions
+func (estimator *strengthEstimator) dictionaryMatches(password, lower []rune, start, end int) []strengthMatch {
+
+	var matches []strengthMatch
+	token := password[start:end]
+	word := string(lower[start:end])
+
+	// Capitals multiply the guesses by the ways they could be placed
+	variations := math.Log10(uppercaseVariations(token))
+
+	if dictionary, rank := estimator.lookup(word); rank > 0 {
+		matches = append(matches, strengthMatch{Pattern: "dictionary", Dictionary: dictionary, Rank: rank,
+			GuessesLog10: math.Log10(float64(rank)) + variations, start: start, end: end})
+	}
+
+	if reversed := reverseString(word); reversed != word {
+		if dictionary, rank := estimator.lookup(reversed); rank > 0 {
+			matches = append(matches, strengthMatch{Pattern: "dictionary", Dictionary: dictionary, Rank: rank, Reversed: true,
+				GuessesLog10: math.Log10(float64(rank)) + variations + math.Log10(2), start: start, end: end})
+		}
+	}
+
+	if end-start > 1 {
+		for _, substituted := range l33tVariants(lower[start:end]) {
+			if dictionary, rank := estimator.lookup(substituted); rank > 0 {
+				matches = append(matches, strengthMatch{Pattern: "dictionary", Dictionary: dictionary, Rank: rank, L33t: true,
+					GuessesLog10: math.Log10(float64(rank)) + variations + math.Log10(l33tVariations(lower[start:end], []rune(substituted))),
+					start:        start, end: end})
+			}
+		}
+	}
+
+	return matches
+
+}
+
+func reverseString(text string) string {
+	runes := []rune(text)
+	slices.Reverse(runes)
+	return string(runes)
+}
+
+// Returns the ways the capitals of the given token could have been placed: none for lowercase,
+// 2 for the usual places (the first letter, the last letter or all of them) or otherwise the
+// number of ways of choosing as many (or fewer) letters
+func uppercaseVariations(token []rune) float64 {
+
+	upper, lower := 0, 0
+	for _, r := range token {
+		if unicode.IsUpper(r) {
+			upper++
+		} else if unicode.IsLower(r) {
+			lower++
+		}
+	}
+
+	switch {
+	case upper == 0:
+		return 1
+	case lower == 0 || upper == 1 && (unicode.IsUpper(token[0]) || unicode.IsUpper(token[len(token)-1])):
+		return 2
+	}
+
+	return choices(upper+lower, min(upper, lower))
+
+}
+
+// Returns the sum of n choose i for i from 1 to k
+func choices(n, k int) float64 {
+	total, term := 0.0, 1.0
+	for i := 1; i <= k; i++ {
+		term = term * float64(n-i+1) / float64(i)
+		total += term
+	}
+	return total
+}
+
+// Returns the words the given lowercase token could spell if its l33t characters were
+// substituted back (at most 32 of them, for tokens full of ambiguous characters)
+func l33tVariants(token []rune) []string {
+
+	variants := []string{""}
+	substituted := false
+
+	for _, r := range token {
+		letters, found := l33tTable[r]
+		if !found {
+			for i := range variants {
+				variants[i] += string(r)
+			}
+			continue
+		}
+		substituted = true
+		var next []string
+		for _, variant := range variants {
+			for _, letter := range letters {
+				if len(next) < 32 {
+					next = append(next, variant+string(letter))
+				}
+			}
+		}
+		variants = next
+	}
+
+	if !substituted {
+		return nil
+	}
+
+	return variants
+
+}
+
+// Returns the ways the substitutions between the given token and the word it spells could have
+// been made. Each substituted letter could have been substituted wherever it appears.
+func l33tVariations(token, word []rune) float64 {
+
+	type substitution struct{ from, to rune }
+	counted := map[substitution]bool{}
+	variations := 1.0
+
+	for i := range token {
+		if token[i] == word[i] || counted[substitution{token[i], word[i]}] {
+			continue
+		}
+		counted[substitution{token[i], word[i]}] = true
+
+		substituted, unsubstituted := 0, 0
+		for j := range token {
+			if token[j] == token[i] && word[j] == word[i] {
+				substituted++
+			} else if token[j] == word[i] {
+				unsubstituted++
+			}
+		}
+
+		if unsubstituted == 0 {
+			variations *= 2
+		} else {
+			variations *= choices(substituted+unsubstituted, min(substituted, unsubstituted))
+		}
+	}
+
+	return variations
+
+}
+
+// Find the runs of at least three characters which step through one of our alphabets (i.e. abc,
+// 9876 or qwerty)
+func sequenceMatches(lower []rune) []strengthMatch {
+
+	var matches []strengthMatch
+
+	for _, alphabet := range sequenceAlphabets {
+		for start := 0; start+2 < len(lower); start++ {
+
+			first := strings.IndexRune(alphabet.letters, lower[start])
+			if first < 0 {
+				continue
+			}
+
+			for _, step := range []int{1, -1} {
+				end := start + 1
+				for end < len(lower) && strings.IndexRune(alphabet.letters, lower[end]) == first+(end-start)*step {
+					end++
+				}
+
+				// Sequences starting where people usually start are guessed first
+				base := float64(len(alphabet.letters))
+				if strings.ContainsRune("az019", lower[start]) && !alphabet.keyboard {
+					base = 4
+				}
+				if alphabet.keyboard {
+					base = 47 // The keys of a US keyboard which people start keyboard runs from
+				}
+
+				for length := 3; length <= end-start; length++ {
+					guesses := base * float64(length)
+					if step < 0 {
+						guesses *= 2
+					}
+					matches = append(matches, strengthMatch{Pattern: "sequence", Sequence: alphabet.name, Descending: step < 0,
+						GuessesLog10: math.Log10(guesses), start: start, end: start + length})
+				}
+			}
+
+		}
+	}
+
+	return matches
+
+}
+
+// Find the parts of the given password which repeat (i.e. aaa or abcabc). A repeat needs the
+// guesses of the repeated part, times the number of repeats.
+func (estimator *strengthEstimator) repeatMatches(password []rune) []strengthMatch {
+
+	var matches []strengthMatch
+
+	for start := range password {
+		for length := 1; start+2*length <= len(password); length++ {
+
+			base := string(password[start : start+length])
+			count := 1
+			for start+(count+1)*length <= len(password) && string(password[start+count*length:start+(count+1)*length]) == base {
+				count++
+			}
+			if count < 2 {
+				continue
+			}
+
+			guesses, found := estimator.memo[base]
+			if !found {
+				_, guesses = estimator.mostGuessable([]rune(base))
+				estimator.memo[base] = guesses
+			}
+
+			matches = append(matches, strengthMatch{Pattern: "repeat", RepeatCount: count,
+				GuessesLog10: guesses + math.Log10(float64(count)), start: start, end: start + count*length})
+
+		}
+	}
+
+	return matches
+
+}
+
+// Returns the guesses of the given token as a year or a date
+func dateMatch(token string) (strengthMatch, bool) {
+
+	if len(token) < 4 || len(token) > 10 {
+		return strengthMatch{}, false
+	}
+
+	yearSpace := func(year int) float64 {
+		return float64(max(abs(year-time.Now().Year()), MIN_YEAR_SPACE))
+	}
+
+	if yearPattern.MatchString(token) {
+		year, _ := strconv.Atoi(token)
+		return strengthMatch{Pattern: "date", Year: year, GuessesLog10: math.Log10(yearSpace(year))}, true
+	}
+
+	// Dates could be written day first, month first or year first
+	var layouts [][3]string
+	separated := false
+
+	if parts := separatedDatePattern.FindStringSubmatch(token); parts != nil && parts[2] == parts[4] {
+		layouts = append(layouts, [3]string{parts[1], parts[3], parts[5]})
+		separated = true
+	} else if strings.Trim(token, "0123456789") == "" && (len(token) == 6 || len(token) == 8) {
+		yearLength := len(token) - 4
+		layouts = append(layouts,
+			[3]string{token[:2], token[2:4], token[4:]},
+			[3]string{token[:yearLength], token[yearLength : yearLength+2], token[yearLength+2:]})
+	}
+
+	for _, parts := range layouts {
+		if year, found := datePartsYear(parts); found {
+			guesses := 365 * yearSpace(year)
+			if separated {
+				guesses *= 4
+			}
+			return strengthMatch{Pattern: "date", Year: year, GuessesLog10: math.Log10(guesses)}, true
+		}
+	}
+
+	return strengthMatch{}, false
+
+}
+
+// Returns the year of the given date parts, if they make a valid date with the year first or
+// last (and the day and month either way round)
+func datePartsYear(parts [3]string) (int, bool) {
+
+	values := [3]int{}
+	for i, part := range parts {
+		values[i], _ = strconv.Atoi(part)
+	}
+
+	for _, order := range [][3]int{{2, 0, 1}, {0, 1, 2}} { // Year last, then year first
+		year, first, second := values[order[0]], values[order[1]], values[order[2]]
+		yearText := parts[order[0]]
+
+		switch len(yearText) {
+		case 2:
+			year += 1900
+			if year < 1950 {
+				year += 100
+			}
+		case 4:
+			if year < 1900 || year > 2099 {
+				continue
+			}
+		default:
+			continue
+		}
+
+		if first >= 1 && first <= 31 && second >= 1 && second <= 12 ||
+			first >= 1 && first <= 12 && second >= 1 && second <= 31 {
+			return year, true
+		}
+	}
+
+	return 0, false
+
+}
+
+// Returns how long the given number of seconds is, roughly
+func describeCrackTime(seconds float64) string {
+
+	units := []struct {
+		name    string
+		seconds float64
+	}{
+		{"year", 365.25 * 24 * 60 * 60},
+		{"month", 31 * 24 * 60 * 60},
+		{"day", 24 * 60 * 60},
+		{"hour", 60 * 60},
+		{"minute", 60},
+		{"second", 1},
+	}
+
+	switch {
+	case seconds < 1:
+		return "less than a second"
+	case seconds >= 100*units[0].seconds:
+		return "centuries"
+	}
+
+	for _, unit := range units {
+		if seconds >= unit.seconds {
+			count := int(math.Round(seconds / unit.seconds))
+			if count == 1 {
+				return "1 " + unit.name
+			}
+			return fmt.Sprintf("%d %ss", count, unit.name)
+		}
+	}
+
+	return "less than a second"
+
+}
+
+// Returns our advice for a password with the given score and patterns. Strong passwords need
+// none, otherwise we warn about their longest pattern.
+func strengthAdvice(score int, sequence []strengthMatch) strengthFeedback {
+
+	if len(sequence) == 0 {
+		return strengthFeedback{Suggestions: []string{
+			"Use a few words, avoid common phrases.",
+			"No need for symbols, digits, or uppercase letters.",
+		}}
+	}
+
+	if score > 2 {
+		return strengthFeedback{Suggestions: []string{}}
+	}
+
+	longest := sequence[0]
+	for _, match := range sequence[1:] {
+		if len([]rune(match.Token)) > len([]rune(longest.Token)) {
+			longest = match
+		}
+	}
+
+	feedback := strengthFeedback{Suggestions: []string{"Add another word or two. Uncommon words are better."}}
+
+	switch longest.Pattern {
+
+	case "dictionary":
+		switch {
+		case longest.Dictionary == "common_passwords" && len(sequence) == 1 && !longest.Reversed && !longest.L33t:
+			switch {
+			case longest.Rank <= 10:
+				feedback.Warning = "This is a top-10 common password."
+			case longest.Rank <= 100:
+				feedback.Warning = "This is a top-100 common password."
+			default:
+				feedback.Warning = "This is a very common password."
+			}
+		case longest.Dictionary == "common_passwords":
+			feedback.Warning = "This is similar to a commonly used password."
+		case longest.Dictionary == "user_inputs":
+			feedback.Warning = "Avoid using your name or other personal details."
+		case len(sequence) == 1:
+			feedback.Warning = "A word by itself is easy to guess."
+		}
+
+		token := []rune(longest.Token)
+		switch {
+		case strings.ToUpper(longest.Token) == longest.Token && strings.ToLower(longest.Token) != longest.Token:
+			feedback.Suggestions = append(feedback.Suggestions, "All-uppercase is almost as easy to guess as all-lowercase.")
+		case unicode.IsUpper(token[0]):
+			feedback.Suggestions = append(feedback.Suggestions, "Capitalization doesn't help very much.")
+		}
+		if longest.Reversed {
+			feedback.Suggestions = append(feedback.Suggestions, "Reversed words aren't much harder to guess.")
+		}
+		if longest.L33t {
+			feedback.Suggestions = append(feedback.Suggestions, "Predictable substitutions like '@' instead of 'a' don't help very much.")
+		}
+
+	case "sequence":
+		if longest.Sequence == "keyboard" {
+			feedback.Warning = "Straight rows of keys are easy to guess."
+		} else {
+			feedback.Warning = "Sequences like abc or 6543 are easy to guess."
+		}
+		feedback.Suggestions = append(feedback.Suggestions, "Avoid sequences.")
+
+	case "repeat":
+		if len([]rune(longest.Token))/longest.RepeatCount == 1 {
+			feedback.Warning = `Repeats like "aaa" are easy to guess.`
+		} else {
+			feedback.Warning = `Repeats like "abcabcabc" are only slightly harder to guess than "abc".`
+		}
+		feedback.Suggestions = append(feedback.Suggestions, "Avoid repeated words and characters.")
+
+	case "date":
+		if len(longest.Token) == 4 {
+			feedback.Warning = "Recent years are easy to guess."
+			feedback.Suggestions = append(feedback.Suggestions, "Avoid recent years and years that are associated with you.")
+		} else {
+			feedback.Warning = "Dates are often easy to guess."
+			feedback.Suggestions = append(feedback.Suggestions, "Avoid dates and years that are associated with you.")
+		}
+
+	}
+
+	return feedback
+
+}
@@ -0,0 +1,92 @@
+// Our main stylesheet. Every page needs it to render, so rather than have the browser fetch it
+// (and wait on another request before its first paint), it's inlined into the <head> of each
+// page by our main template. It's kept in css/style.css, compiled into our binary and parsed once
+// at startup, so that a broken stylesheet (i.e. an unclosed block, or a "</style" which would
+// end the element early) stops the server from starting rather than breaking every page.
+//
+// The other CSS and JavaScript files a page uses are listed in its HtmlData as Assets (see
+// assets.go). Those marked Critical are loaded as before, blocking the page until they arrive,
+// while the rest are loaded without holding up the first paint: stylesheets are preloaded and
+// applied once they arrive, and scripts are deferred until the page has been parsed.
+
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"strings"
+)
+
+// Our main stylesheet, as it's inlined into our pages
+var mainStylesheet template.CSS
+
+// The source of our main stylesheet. You can find it in the css sub-directory.
+//
+//go:embed css/style.css
+var mainStylesheetSource string
+
+// Parse our main stylesheet. It's embedded at compile time, so it can only fail to parse if the
+// file itself is broken.
+func init() {
+	stylesheet, err := parseStylesheet(mainStylesheetSource)
+	if err != nil {
+		panic(fmt.Errorf("css/style.css: %w", err))
+	}
+	mainStylesheet = stylesheet
+}
+
+// Parse the given stylesheet, checking that its comments, strings and blocks are all closed and
+// that it can be inlined into a <style> element, and returning it ready to be inlined
+func parseStylesheet(source string) (template.CSS, error) {
+
+	line, depth, quote := 1, 0, byte(0)
+
+	for i := 0; i < len(source); i++ {
+
+		c := source[i]
+
+		switch {
+		case c == '\n':
+			line++
+			if quote != 0 {
+				return "", fmt.Errorf("line %d: unterminated string", line-1)
+			}
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case strings.HasPrefix(source[i:], "/*"):
+			end := strings.Index(source[i+2:], "*/")
+			if end < 0 {
+				return "", fmt.Errorf("line %d: unterminated comment", line)
+			}
+			line += strings.Count(source[i:i+2+end], "\n")
+			i += end + 3
+		case c == '{':
+			depth++
+		case c == '}':
+			if depth == 0 {
+				return "", fmt.Errorf("line %d: unexpected }", line)
+			}
+			depth--
+		case c == '<' && strings.HasPrefix(strings.ToLower(source[i:]), "</style"):
+			return "", fmt.Errorf("line %d: a stylesheet can't contain </style", line)
+		}
+
+	}
+
+	switch {
+	case quote != 0:
+		return "", fmt.Errorf("line %d: unterminated string", line)
+	case depth > 0:
+		return "", fmt.Errorf("%d unclosed block(s)", depth)
+	}
+
+	return template.CSS(source), nil
+
+}
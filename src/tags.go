@@ -0,0 +1,161 @@
+// Request fields and tags. Handlers can attach key/value fields to the log entry of the request
+// they're handling, i.e. the size of an upload:
+//
+//	addLogField(r.Context(), "upload_bytes", size)
+//
+// and tags, which are logged like fields but are also counted as metrics labels, for values from
+// a small set (i.e. the QR code preset used):
+//
+//	tagRequest(r.Context(), "qr_preset", preset)
+//
+// Our logging middleware adds them to the request's log line (as key=value pairs, after the user
+// agent) once the request completes, and our metrics middleware counts each tag in the
+// http_tagged_requests_total metric, labelled by tag, value and status class. So that a tag can't
+// create an unbounded number of series, the values beyond the first MAX_TAG_VALUES of a tag are
+// counted as "other". Both are kept with the request's trace (see trace.go), so they're also shown
+// at /debug/trace/{request-id}. Setting a key again replaces its value.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	MAX_LOG_FIELD_SIZE = 100 // The longest field value we log (longer values are cut short)
+	MAX_TAG_VALUES     = 50  // The values of a tag we count separately
+	OTHER_TAG_VALUE    = "other"
+)
+
+// A field attached to a request's log entry
+type requestField struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Tag   bool   `json:"tag,omitempty"` // Whether it's also counted as a metrics label
+}
+
+// The values we've counted for each tag
+var tagValues = struct {
+	mutex  sync.Mutex
+	values map[string]map[string]bool
+}{values: map[string]map[string]bool{}}
+
+// Attach a field to the log entry of the request with the given context
+func addLogField(ctx context.Context, key string, value any) {
+	setRequestField(ctx, requestField{Key: key, Value: fmt.Sprint(value)})
+}
+
+// Attach a tag to the request with the given context, which is logged like a field and counted
+// as a metrics label
+func tagRequest(ctx context.Context, key string, value string) {
+	setRequestField(ctx, requestField{Key: key, Value: value, Tag: true})
+}
+
+// Add the given field to the trace of the request with the given context, replacing any field
+// with the same key
+func setRequestField(ctx context.Context, field requestField) {
+
+	trace := traceFromContext(ctx)
+	if trace == nil {
+		return
+	}
+
+	field.Key = fieldKey(field.Key)
+	if len(field.Value) > MAX_LOG_FIELD_SIZE {
+		field.Value = field.Value[:MAX_LOG_FIELD_SIZE]
+	}
+
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+
+	for i := range trace.Fields {
+		if trace.Fields[i].Key == field.Key {
+			trace.Fields[i] = field
+			return
+		}
+	}
+	trace.Fields = append(trace.Fields, field)
+
+}
+
+// Returns the given key with everything but lower case letters, digits and underscores replaced
+// by underscores, so that it's a valid metrics label and can't break up our log lines
+func fieldKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(key))
+}
+
+// Returns the fields of the request with the given context
+func requestFields(ctx context.Context) []requestField {
+
+	trace := traceFromContext(ctx)
+	if trace == nil {
+		return nil
+	}
+
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+
+	return append([]requestField(nil), trace.Fields...)
+
+}
+
+// Returns the given fields as they're written to our log, i.e. sheet=budget size=1024 (values
+// with spaces, quotes or equals signs in them are quoted)
+func formatLogFields(fields []requestField) string {
+
+	parts := make([]string, 0, len(fields))
+
+	for _, field := range fields {
+		value := field.Value
+		if value == "" || strings.ContainsAny(value, " \t\"=") || strconv.Quote(value) != `"`+value+`"` {
+			value = strconv.Quote(value)
+		}
+		parts = append(parts, field.Key+"="+value)
+	}
+
+	return strings.Join(parts, " ")
+
+}
+
+// Count the tags of a completed request with the given status
+func countRequestTags(fields []requestField, status int) {
+
+	for _, field := range fields {
+		if field.Tag {
+			incrementCounter("http_tagged_requests_total", "tag", field.Key, "value", countedTagValue(field.Key, field.Value),
+				"status", statusClass(status))
+		}
+	}
+
+}
+
+// Returns the value we count the given tag value as: itself, unless the tag already has
+// MAX_TAG_VALUES other values
+func countedTagValue(key string, value string) string {
+
+	tagValues.mutex.Lock()
+	defer tagValues.mutex.Unlock()
+
+	values := tagValues.values[key]
+	if values == nil {
+		values = map[string]bool{}
+		tagValues.values[key] = values
+	}
+
+	if !values[value] && len(values) >= MAX_TAG_VALUES {
+		return OTHER_TAG_VALUE
+	}
+	values[value] = true
+
+	return value
+
+}
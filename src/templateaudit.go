@@ -0,0 +1,315 @@
+// A template escaping audit for development mode. html/template escapes everything it inserts
+// into our pages except template.HTML values, which it trusts completely, so every conversion of
+// a string to template.HTML is a place where a script could slip into a page. In -dev mode we
+// parse our own source at startup and flag the conversions of strings which aren't constants (or
+// escaped, see escapingFunctions), along with the template.HTML
+// fields of HtmlData built by concatenating them, logging each as a warning and listing them all
+// at /debug/template-audit.
+//
+// Body templates should be rendered with renderFragment (see templates.go) rather than converted
+// by hand. A conversion which has been checked (i.e. of text escaped just before) is marked with
+// a "template-audit:" comment on its line or the line above saying why it's safe, which keeps it
+// listed but stops it being flagged.
+//
+// The audit needs our source, which it finds where we were built from, so it's skipped (with a
+// note in our log) when the server runs without it.
+
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	TEMPLATE_AUDIT_MARKER          = "template-audit:"
+	TEMPLATE_AUDIT_EXPRESSION_SIZE = 80 // How much of a flagged expression we show
+)
+
+// The functions whose results are escaped (for HTML, or for the JavaScript strings of our inline
+// scripts)
+var escapingFunctions = []string{"html.EscapeString", "template.HTMLEscapeString", "template.JSEscapeString"}
+
+// A conversion to template.HTML (or HtmlData field) the audit found
+type templateAuditFinding struct {
+	Position   string `json:"position"` // i.e. main.go:1416
+	Function   string `json:"function"`
+	Field      string `json:"field,omitempty"` // The HtmlData field it's assigned to, if any
+	Expression string `json:"expression"`
+	Reviewed   string `json:"reviewed,omitempty"` // Why it's safe, from its template-audit comment
+}
+
+// The findings of our audit, once it's run
+var templateAudit = struct {
+	mutex    sync.Mutex
+	ran      bool
+	skipped  string
+	findings []templateAuditFinding
+}{}
+
+// Audit our source, logging a warning for each conversion which hasn't been reviewed
+func runTemplateAudit() {
+
+	findings, err := auditTemplateConversions(templateAuditSourceDir())
+
+	templateAudit.mutex.Lock()
+	defer templateAudit.mutex.Unlock()
+
+	templateAudit.ran = true
+
+	if err != nil {
+		templateAudit.skipped = err.Error()
+		logger.Println("Skipping the template audit, as our source isn't available:", err)
+		return
+	}
+
+	templateAudit.findings = findings
+
+	flagged := 0
+	for _, finding := range findings {
+		if finding.Reviewed == "" {
+			flagged++
+			logger.Printf("WARN template audit: %s (in %s) trusts non-constant HTML: %s", finding.Position, finding.Function, finding.Expression)
+		}
+	}
+
+	logger.Printf("Template audit: %d conversions to template.HTML, %d of them unreviewed", len(findings), flagged)
+
+}
+
+// Returns the directory we were built from
+func templateAuditSourceDir() string {
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		return ""
+	}
+	return filepath.Dir(file)
+}
+
+// Parse the Go files in the given directory, returning the conversions of non-constant strings
+// to template.HTML within them
+func auditTemplateConversions(dir string) ([]templateAuditFinding, error) {
+
+	if _, err := os.Stat(filepath.Join(dir, "templateaudit.go")); err != nil {
+		return nil, err
+	}
+
+	fileSet := token.NewFileSet()
+	paths, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*ast.File
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fileSet, path, nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	// Our package level constants, whose conversions are safe, and the template.HTML fields of
+	// HtmlData
+	constants := map[string]bool{}
+	htmlFields := map[string]bool{}
+	for _, file := range files {
+		for _, declaration := range file.Decls {
+			general, ok := declaration.(*ast.GenDecl)
+			if !ok {
+				continue
+			}
+			for _, spec := range general.Specs {
+				switch spec := spec.(type) {
+				case *ast.ValueSpec:
+					for _, name := range spec.Names {
+						constants[name.Name] = general.Tok == token.CONST
+					}
+				case *ast.TypeSpec:
+					if structType, ok := spec.Type.(*ast.StructType); ok && spec.Name.Name == "HtmlData" {
+						for _, field := range structType.Fields.List {
+							if selector, ok := field.Type.(*ast.SelectorExpr); ok && selector.Sel.Name == "HTML" {
+								for _, name := range field.Names {
+									htmlFields[name.Name] = true
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	var findings []templateAuditFinding
+
+	for _, file := range files {
+
+		// The lines of the file which carry a template-audit comment, with their reasons
+		reviewed := map[int]string{}
+		for _, group := range file.Comments {
+			for _, comment := range group.List {
+				if _, reason, found := strings.Cut(comment.Text, TEMPLATE_AUDIT_MARKER); found {
+					reviewed[fileSet.Position(comment.Pos()).Line] = strings.TrimSpace(reason)
+				}
+			}
+		}
+
+		for _, declaration := range file.Decls {
+			function, ok := declaration.(*ast.FuncDecl)
+			if !ok || function.Body == nil {
+				continue
+			}
+			findings = append(findings, auditFunction(fileSet, function, constants, htmlFields, reviewed)...)
+		}
+	}
+
+	slices.SortFunc(findings, func(a, b templateAuditFinding) int {
+		return strings.Compare(a.Position, b.Position)
+	})
+
+	return findings, nil
+
+}
+
+// Returns the conversions of non-constant strings to template.HTML within the given function
+func auditFunction(fileSet *token.FileSet, function *ast.FuncDecl, constants map[string]bool, htmlFields map[string]bool, reviewed map[int]string) []templateAuditFinding {
+
+	var findings []templateAuditFinding
+
+	record := func(node ast.Expr, field string) {
+		position := fileSet.Position(node.Pos())
+		finding := templateAuditFinding{
+			Position:   filepath.Base(position.Filename) + ":" + strconv.Itoa(position.Line),
+			Function:   function.Name.Name,
+			Field:      field,
+			Expression: auditExpressionText(fileSet, node),
+		}
+		if reason, found := reviewed[position.Line]; found {
+			finding.Reviewed = reason
+		} else if reason, found := reviewed[position.Line-1]; found {
+			finding.Reviewed = reason
+		}
+		findings = append(findings, finding)
+	}
+
+	// HtmlData fields keyed by the conversions (and concatenations) assigned to them
+	fields := map[ast.Expr]string{}
+
+	ast.Inspect(function.Body, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.CompositeLit:
+			if name, ok := node.Type.(*ast.Ident); ok && name.Name == "HtmlData" {
+				for _, element := range node.Elts {
+					if pair, ok := element.(*ast.KeyValueExpr); ok {
+						if key, ok := pair.Key.(*ast.Ident); ok {
+							fields[pair.Value] = key.Name
+							// Concatenating HTML in place hides a conversion
+							if binary, ok := pair.Value.(*ast.BinaryExpr); ok && htmlFields[key.Name] && !isTrustedExpression(binary, constants) {
+								record(binary, key.Name)
+							}
+						}
+					}
+				}
+			}
+		case *ast.CallExpr:
+			if isTemplateHTMLConversion(node) && len(node.Args) == 1 && !isTrustedExpression(node.Args[0], constants) {
+				record(node, fields[node])
+			}
+		}
+		return true
+	})
+
+	return findings
+
+}
+
+// Returns whether the given call converts a value to template.HTML
+func isTemplateHTMLConversion(call *ast.CallExpr) bool {
+	selector, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || selector.Sel.Name != "HTML" {
+		return false
+	}
+	pkg, ok := selector.X.(*ast.Ident)
+	return ok && pkg.Name == "template"
+}
+
+// Returns whether the given expression is a constant string (a literal, one of our constants, or
+// a concatenation of them) or escaped text, or a concatenation of them
+func isTrustedExpression(expression ast.Expr, constants map[string]bool) bool {
+	switch expression := expression.(type) {
+	case *ast.BasicLit:
+		return expression.Kind == token.STRING
+	case *ast.Ident:
+		return constants[expression.Name]
+	case *ast.ParenExpr:
+		return isTrustedExpression(expression.X, constants)
+	case *ast.BinaryExpr:
+		return expression.Op == token.ADD && isTrustedExpression(expression.X, constants) && isTrustedExpression(expression.Y, constants)
+	case *ast.CallExpr:
+		if selector, ok := expression.Fun.(*ast.SelectorExpr); ok {
+			if pkg, ok := selector.X.(*ast.Ident); ok && slices.Contains(escapingFunctions, pkg.Name+"."+selector.Sel.Name) {
+				return true
+			}
+		}
+		return isTemplateHTMLConversion(expression) && len(expression.Args) == 1 && isTrustedExpression(expression.Args[0], constants)
+	}
+	return false
+}
+
+// Returns the source of the given expression on one line, shortened to
+// TEMPLATE_AUDIT_EXPRESSION_SIZE
+func auditExpressionText(fileSet *token.FileSet, expression ast.Expr) string {
+
+	start, end := fileSet.Position(expression.Pos()), fileSet.Position(expression.End())
+
+	source, err := os.ReadFile(start.Filename)
+	if err != nil {
+		return ""
+	}
+
+	text := strings.Join(strings.Fields(string(source[start.Offset:end.Offset])), " ")
+	if len(text) > TEMPLATE_AUDIT_EXPRESSION_SIZE {
+		text = text[:TEMPLATE_AUDIT_EXPRESSION_SIZE] + "..."
+	}
+
+	return text
+
+}
+
+// This is our admin-only template audit handler (only in -dev mode), which lists the findings of
+// our audit as JSON
+func templateAuditHandler(w http.ResponseWriter, r *http.Request) {
+
+	templateAudit.mutex.Lock()
+	defer templateAudit.mutex.Unlock()
+
+	flagged := 0
+	for _, finding := range templateAudit.findings {
+		if finding.Reviewed == "" {
+			flagged++
+		}
+	}
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ran":        templateAudit.ran,
+		"skipped":    templateAudit.skipped,
+		"flagged":    flagged,
+		"findings":   templateAudit.findings,
+		"source_dir": templateAuditSourceDir(),
+	})
+
+}
@@ -0,0 +1,285 @@
+// Template loading and validation. All of our templates are parsed (and test executed) once at
+// startup, so that a broken template stops the server from starting with a clear report of
+// which template and line failed, rather than producing 500 responses on every request.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Our parsed templates. These are set by loadTemplates and are safe for concurrent use.
+var (
+	mainTemplate            *template.Template
+	indexBodyTemplate       *template.Template
+	qrCodeBodyTemplate      *template.Template
+	errorPageTemplate       *template.Template
+	tracePageTemplate       *template.Template
+	uploadBodyTemplate      *template.Template
+	graphiQLPageTemplate    *template.Template
+	siteListingTemplate     *template.Template
+	weatherBodyTemplate     *template.Template
+	toolsBodyTemplate       *template.Template
+	uptimeBodyTemplate      *template.Template
+	contactBodyTemplate     *template.Template
+	contactMessagesTemplate *template.Template
+	searchBodyTemplate      *template.Template
+	sheetHistoryTemplate    *template.Template
+	sheetDiffTemplate       *template.Template
+	csvViewerBodyTemplate   *template.Template
+	csvViewerTableTemplate  *template.Template
+	formatBodyTemplate      *template.Template
+	passwordBodyTemplate    *template.Template
+	colorsBodyTemplate      *template.Template
+	asciiBodyTemplate       *template.Template
+	mazeBodyTemplate        *template.Template
+	totpBodyTemplate        *template.Template
+)
+
+// The functions available within all of our templates
+var templateFuncs = template.FuncMap{
+	"url":       urlFor,
+	"assetPath": assetPath,
+}
+
+// A template we parse at startup along with some sample data used to test execute it
+type templateDefinition struct {
+	name       string
+	source     string
+	target     **template.Template
+	sampleData interface{}
+}
+
+// The list of all of our templates, including those of our demo apps (see demoapps.go)
+func templateDefinitions() []templateDefinition {
+	return append([]templateDefinition{
+		{
+			name:   "main",
+			source: MAIN_HTML_TEMPLATE + NAV_HTML_TEMPLATE + CONSENT_HTML_TEMPLATE + SOCIAL_HTML_TEMPLATE + PAGE_METADATA_HTML_TEMPLATE + FLASH_HTML_TEMPLATE,
+			target: &mainTemplate,
+			sampleData: HtmlData{NavPages: pageRegistry, ConsentBanner: true, Experiments: map[string]string{"sample": "sample"}, CssFiles: []Asset{{URL: "sample", Integrity: "sample", CrossOrigin: "anonymous"}, {URL: "sample", Critical: true}},
+				JsFiles: []Asset{{URL: "sample"}, {URL: "sample", Critical: true}}, MainStylesheet: mainStylesheet,
+				SocialCard: SocialCard{Image: "sample", ImageWidth: 1, ImageHeight: 1},
+				Metadata:   PageMetadata{Breadcrumbs: []Breadcrumb{{}, {}}, LastModified: "sample", LinkedData: map[string]interface{}{"sample": "sample"}},
+				Flashes:    []Flash{{Kind: FLASH_SUCCESS, Message: "sample"}}},
+		},
+		{
+			name:       "index.body",
+			source:     INDEX_BODY_TEMPLATE,
+			target:     &indexBodyTemplate,
+			sampleData: []pageSection{{Name: "sample", Anchor: "sample", Pages: []Page{{}, {}}}},
+		},
+		{
+			name:       "qr.code.body",
+			source:     QR_CODE_BODY_TEMPLATE,
+			target:     &qrCodeBodyTemplate,
+			sampleData: qrCodeBodyData{QRCode: "sample", Text: "sample", Presets: qrCodePresetNames, Type: "qr", Types: codeTypes, Form: &Form{Problems: map[string]string{"sample": "sample"}}},
+		},
+		{
+			name:       "error.body",
+			source:     ERROR_PAGE_BODY_TEMPLATE,
+			target:     &errorPageTemplate,
+			sampleData: errorPageData{Status: http.StatusNotFound},
+		},
+		{
+			name:       "trace.body",
+			source:     TRACE_PAGE_BODY_TEMPLATE,
+			target:     &tracePageTemplate,
+			sampleData: tracePageData{Spans: []tracePageSpan{{Name: "sample"}}},
+		},
+		{
+			name:       "upload.body",
+			source:     UPLOAD_BODY_TEMPLATE,
+			target:     &uploadBodyTemplate,
+			sampleData: uploadPageData{Form: &Form{}, Files: []uploadedFile{{}}, IsAdmin: true},
+		},
+		{
+			name:       "graphiql",
+			source:     GRAPHIQL_PAGE_TEMPLATE,
+			target:     &graphiQLPageTemplate,
+			sampleData: graphiQLPageData{DefaultQuery: "{ status { healthy } }"},
+		},
+		{
+			name:       "site.listing.body",
+			source:     SITE_LISTING_BODY_TEMPLATE,
+			target:     &siteListingTemplate,
+			sampleData: siteListingData{Path: "/", HasParent: true, Entries: []siteListingEntry{{}}},
+		},
+		{
+			name:       "weather.body",
+			source:     WEATHER_BODY_TEMPLATE,
+			target:     &weatherBodyTemplate,
+			sampleData: weatherPageData{Report: &weatherReport{}},
+		},
+		{
+			name:       "tools.body",
+			source:     TOOLS_BODY_TEMPLATE,
+			target:     &toolsBodyTemplate,
+			sampleData: toolsPageData{RecordTypes: dnsRecordTypes, Query: map[string]string{}, Result: &toolResult{Records: []string{""}}},
+		},
+		{
+			name:       "uptime.body",
+			source:     UPTIME_BODY_TEMPLATE,
+			target:     &uptimeBodyTemplate,
+			sampleData: uptimePageData{Daily: []uptimeBar{{}}, Weekly: []uptimeBar{{Checks: 1}}, Clients: map[string][]userAgentShare{"browsers": {{}}}},
+		},
+		{
+			name:       "contact.body",
+			source:     CONTACT_BODY_TEMPLATE,
+			target:     &contactBodyTemplate,
+			sampleData: contactPageData{Form: &Form{Problems: map[string]string{"name": "sample"}}},
+		},
+		{
+			name:       "contact.messages.body",
+			source:     CONTACT_MESSAGES_BODY_TEMPLATE,
+			target:     &contactMessagesTemplate,
+			sampleData: []contactMessage{{Subject: "sample"}},
+		},
+		{
+			name:       "search.body",
+			source:     SEARCH_BODY_TEMPLATE,
+			target:     &searchBodyTemplate,
+			sampleData: searchPageData{Query: "sample", Results: []searchResult{{Snippet: "sample", matches: []string{"sample"}}}},
+		},
+		{
+			name:       "sheet.history.body",
+			source:     SHEET_HISTORY_BODY_TEMPLATE,
+			target:     &sheetHistoryTemplate,
+			sampleData: sheetHistoryData{Name: "sample", Revisions: []sheetRevision{{Revision: 2}, {Revision: 1}}, Previous: []int{1, 0}},
+		},
+		{
+			name:       "sheet.diff.body",
+			source:     SHEET_DIFF_BODY_TEMPLATE,
+			target:     &sheetDiffTemplate,
+			sampleData: sheetDiffData{Name: "sample", Changes: []cellChange{{}}, Columns: []string{"A"}, Rows: []sheetDiffRow{{Cells: []sheetDiffCell{{Changed: true}, {}}}}, Truncated: true},
+		},
+		{
+			name:       "csv.viewer.body",
+			source:     CSV_VIEWER_BODY_TEMPLATE,
+			target:     &csvViewerBodyTemplate,
+			sampleData: &Form{},
+		},
+		{
+			name:   "csv.viewer.table",
+			source: CSV_VIEWER_TABLE_TEMPLATE,
+			target: &csvViewerTableTemplate,
+			sampleData: csvViewerTableData{Query: csvViewerQuery{Sort: 0, Filter: "sample"}, Page: csvViewerPage{Columns: []string{"A"}, Rows: [][]string{{"1"}}},
+				Headings: []csvViewerHeading{{}}, Pages: []csvViewerPageLink{{Current: true}, {}, {URL: "/"}}},
+		},
+		{
+			name:       "format.body",
+			source:     FORMAT_BODY_TEMPLATE,
+			target:     &formatBodyTemplate,
+			sampleData: formatPageData{From: "yaml", Actions: formatActions, Output: "sample", Error: "sample", Snippet: "sample"},
+		},
+		{
+			name:       "password.body",
+			source:     PASSWORD_BODY_TEMPLATE,
+			target:     &passwordBodyTemplate,
+			sampleData: passwordPageData{Options: defaultPasswordOptions(), Charsets: passwordCharsets, Passwords: []string{"sample"}, Estimate: &strengthEstimate{Feedback: strengthFeedback{Warning: "sample", Suggestions: []string{"sample"}}, Sequence: []strengthMatch{{Dictionary: "sample"}, {}}}},
+		},
+		{
+			name:       "colors.body",
+			source:     COLORS_BODY_TEMPLATE,
+			target:     &colorsBodyTemplate,
+			sampleData: colourPageData{Shades: []paletteColour{{}}, Palettes: []colourPalette{{Colours: []paletteColour{{}}}}},
+		},
+		{
+			name:       "ascii.body",
+			source:     ASCII_BODY_TEMPLATE,
+			target:     &asciiBodyTemplate,
+			sampleData: asciiPageData{Fonts: []string{"sample"}, Charsets: asciiCharsets, Art: "sample", TextURL: "/sample"},
+		},
+		{
+			name:       "maze.body",
+			source:     MAZE_BODY_TEMPLATE,
+			target:     &mazeBodyTemplate,
+			sampleData: mazePageData{MazeAlgorithms: mazeAlgorithms, TerrainAlgorithms: terrainAlgorithms, Drawing: "sample", JSONURL: "/sample"},
+		},
+		{
+			name:       "totp.body",
+			source:     TOTP_BODY_TEMPLATE,
+			target:     &totpBodyTemplate,
+			sampleData: totpPageData{Account: "sample", RecoveryCodes: []string{"sample"}, Problem: "sample"},
+		},
+	}, demoAppTemplates()...)
+}
+
+// Parse and test execute all of our templates. Templates which fail are left unset and the
+// returned errors describe which template (and line) failed.
+func loadTemplates() []error {
+
+	var templateErrors []error
+
+	for _, definition := range templateDefinitions() {
+
+		// Parse errors from the template package already include the template name and line
+		// number (i.e. "template: main:12: unexpected EOF")
+		parsedTemplate, err := template.New(definition.name).Funcs(templateFuncs).Parse(definition.source)
+
+		if err != nil {
+			templateErrors = append(templateErrors, err)
+			continue
+		}
+
+		// Some errors (i.e. referencing a field which doesn't exist) are only found when the
+		// template is executed, so we do a test run with our sample data
+		if err := parsedTemplate.Execute(ioutil.Discard, definition.sampleData); err != nil {
+			templateErrors = append(templateErrors, err)
+			continue
+		}
+
+		*definition.target = parsedTemplate
+
+	}
+
+	return templateErrors
+
+}
+
+// Format our template errors into a human readable report
+func templateErrorReport(templateErrors []error) string {
+	var report strings.Builder
+	fmt.Fprintf(&report, "%d template(s) failed to load:\n", len(templateErrors))
+	for _, err := range templateErrors {
+		fmt.Fprintf(&report, "  - %v\n", err)
+	}
+	return report.String()
+}
+
+// Returns a handler used in maintenance mode (-dev only) when our templates failed to load.
+// Every request receives a 503 along with our template error report.
+func maintenanceHandler(report string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setContentType(w, CONTENT_TYPE_TEXT)
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "The server is in maintenance mode.")
+		fmt.Fprintln(w)
+		fmt.Fprint(w, report)
+	})
+}
+
+// Executes the given body template with the given data, returning the HTML to nest in our main
+// template as its BodyContent. Our body templates are parsed as HTML which starts (and, as
+// html/template refuses to execute one which doesn't, ends) in the same context as the <body>
+// they're nested in, so their contextual escaping holds end to end. This is how body templates
+// should become template.HTML, rather than by converting their output by hand (see
+// templateaudit.go).
+func renderFragment(fragment *template.Template, data interface{}) (template.HTML, error) {
+
+	var output bytes.Buffer
+
+	if err := fragment.Execute(&output, data); err != nil {
+		return "", err
+	}
+
+	// template-audit: the output of an html/template, escaped as it was executed
+	return template.HTML(output.String()), nil
+
+}
@@ -0,0 +1,337 @@
+// Our in-memory time series store, which keeps the recent history of our metrics (see
+// metrics.go) for our sparklines (see sparkline.go) and /api/v1/metrics/query. Each metric
+// (summed over all of its labels) has its own ring buffer of points, one per -metrics-interval
+// (the store's resolution) for up to -metrics-retention, so the store never grows beyond
+// retention / resolution points per metric however long the server runs.
+//
+// Every resolution our sampler records all of our metrics, along with the go_goroutines and
+// go_memstats_heap_alloc_bytes gauges of how our runtime is doing. Request totals are also
+// recorded by our metrics middleware as requests are served, so they're current between
+// samples.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_METRICS_INTERVAL  = 10 * time.Second
+	DEFAULT_METRICS_RETENTION = 24 * time.Hour
+	MAX_METRIC_POINTS         = 1000 // The most points a query returns
+)
+
+// The value of a metric during one interval. Counters give their total at the end of the
+// interval.
+type timePoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// The points of one metric, oldest first. Once the buffer is full, each new point replaces the
+// oldest one (at start).
+type timeSeries struct {
+	points []timePoint
+	start  int
+}
+
+// Add a point to the series, which holds at most capacity points
+func (series *timeSeries) append(point timePoint, capacity int) {
+	if len(series.points) < capacity {
+		series.points = append(series.points, point)
+		return
+	}
+	series.points[series.start] = point
+	series.start = (series.start + 1) % len(series.points)
+}
+
+// Returns the latest point of the series (or nil if it has none)
+func (series *timeSeries) last() *timePoint {
+	if len(series.points) == 0 {
+		return nil
+	}
+	return &series.points[(series.start+len(series.points)-1)%len(series.points)]
+}
+
+// Returns the points of the series from the given time on, oldest first
+func (series *timeSeries) since(from time.Time) []timePoint {
+	var points []timePoint
+	for i := range len(series.points) {
+		point := series.points[(series.start+i)%len(series.points)]
+		if !point.Time.Before(from) {
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+// Our time series, by metric name
+type timeSeriesStore struct {
+	mutex      sync.Mutex
+	resolution time.Duration
+	retention  time.Duration
+	series     map[string]*timeSeries
+	counters   map[string]bool // Which of our metrics are counters
+}
+
+var timeSeriesHistory = &timeSeriesStore{
+	resolution: DEFAULT_METRICS_INTERVAL,
+	retention:  DEFAULT_METRICS_RETENTION,
+	series:     map[string]*timeSeries{},
+	counters:   map[string]bool{},
+}
+
+// Returns a component which keeps the history of our metrics at the given resolution for the
+// given retention, sampling them every resolution (see components.go)
+func newMetricsSampler(resolution time.Duration, retention time.Duration) Component {
+
+	timeSeriesHistory.mutex.Lock()
+	timeSeriesHistory.resolution, timeSeriesHistory.retention = resolution, retention
+	timeSeriesHistory.mutex.Unlock()
+
+	return newTickerComponent(resolution, sampleMetrics)
+
+}
+
+// Record our metrics at the given time
+func sampleMetrics(now time.Time) {
+
+	// Note how our runtime is doing, so that it has a history too
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	setGauge("go_goroutines", float64(runtime.NumGoroutine()))
+	setGauge("go_memstats_heap_alloc_bytes", float64(memory.HeapAlloc))
+
+	totals := map[string]float64{}
+	counters := map[string]bool{}
+
+	metrics.mutex.Lock()
+	for series, value := range metrics.counters {
+		totals[series.name] += value
+		counters[series.name] = true
+	}
+	for series, value := range metrics.gauges {
+		totals[series.name] += value
+	}
+	metrics.mutex.Unlock()
+
+	for name, total := range totals {
+		timeSeriesHistory.record(name, counters[name], now, func(float64) float64 { return total })
+	}
+
+}
+
+// Record a metric at the given time. The update is given the metric's previous value (0 for a
+// new metric) and returns its new one, which replaces the latest point if it's for the same
+// interval.
+func (store *timeSeriesStore) record(name string, counter bool, now time.Time, update func(float64) float64) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	series, found := store.series[name]
+	if !found {
+		series = &timeSeries{}
+		store.series[name] = series
+	}
+	store.counters[name] = store.counters[name] || counter
+
+	interval := now.Truncate(store.resolution)
+	last := series.last()
+
+	switch {
+	case last != nil && last.Time.Equal(interval):
+		last.Value = update(last.Value)
+	case last != nil:
+		series.append(timePoint{Time: interval, Value: update(last.Value)}, store.capacity())
+	default:
+		series.append(timePoint{Time: interval, Value: update(0)}, store.capacity())
+	}
+
+}
+
+// Add to a counter's latest value. This is how our metrics middleware keeps our request totals
+// current.
+func (store *timeSeriesStore) add(name string, now time.Time, amount float64) {
+	store.record(name, true, now, func(previous float64) float64 { return previous + amount })
+}
+
+// Returns how many points each of our series holds
+func (store *timeSeriesStore) capacity() int {
+	return max(int(store.retention/store.resolution), 1)
+}
+
+// Returns the points of the named metric from the given time on, whether it's a counter, and
+// whether we know of the metric at all
+func (store *timeSeriesStore) query(name string, from time.Time) ([]timePoint, bool, bool) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	series, found := store.series[name]
+	if !found {
+		return nil, false, false
+	}
+
+	// Points older than our retention may still be in the buffer if we've been quiet
+	if cutoff := time.Now().Add(-store.retention); from.Before(cutoff) {
+		from = cutoff
+	}
+
+	return series.since(from), store.counters[name], true
+
+}
+
+// Returns the names of the metrics we have a history of, in order
+func (store *timeSeriesStore) names() []string {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var names []string
+	for name := range store.series {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+
+}
+
+// Returns how much a counter increased by between each of its points (so one point fewer than
+// it has). Counters only ever increase, so a decrease is taken as a reset.
+func counterIncreases(points []timePoint) []timePoint {
+	var increases []timePoint
+	for i := 1; i < len(points); i++ {
+		increases = append(increases, timePoint{Time: points[i].Time, Value: max(points[i].Value-points[i-1].Value, 0)})
+	}
+	return increases
+}
+
+// Combine the points into one per step (each starting at a multiple of the step): the latest
+// value for counters (as they're totals) or the average for gauges
+func downsamplePoints(points []timePoint, step time.Duration, counter bool) []timePoint {
+
+	var combined []timePoint
+	count := 0
+
+	for _, point := range points {
+		interval := point.Time.Truncate(step)
+		if len(combined) == 0 || !combined[len(combined)-1].Time.Equal(interval) {
+			combined = append(combined, timePoint{Time: interval, Value: point.Value})
+			count = 1
+			continue
+		}
+		current := &combined[len(combined)-1]
+		if counter {
+			current.Value = point.Value
+		} else {
+			count++
+			current.Value += (point.Value - current.Value) / float64(count)
+		}
+	}
+
+	return combined
+
+}
+
+// This is our metrics query API. Without a metric it lists the metrics we have a history of,
+// otherwise it returns the points of the metric over the window (1h by default), combined into
+// one per step (by default the resolution, or whatever multiple of it keeps us within
+// MAX_METRIC_POINTS). rate=true gives how much a counter increased by per
+// second instead of its totals.
+func metricsQueryHandler(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	name := query.Get("metric")
+
+	timeSeriesHistory.mutex.Lock()
+	resolution, retention := timeSeriesHistory.resolution, timeSeriesHistory.retention
+	timeSeriesHistory.mutex.Unlock()
+
+	if name == "" {
+		setContentType(w, CONTENT_TYPE_JSON)
+		json.NewEncoder(w).Encode(struct {
+			Resolution string   `json:"resolution"`
+			Retention  string   `json:"retention"`
+			Metrics    []string `json:"metrics"`
+		}{resolution.String(), retention.String(), timeSeriesHistory.names()})
+		return
+	}
+
+	window, err := durationParameter(query.Get("window"), "window", time.Hour, retention)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	fallback := (window/MAX_METRIC_POINTS + resolution - 1).Truncate(resolution)
+	step, err := durationParameter(query.Get("step"), "step", fallback, window)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	step = max(step.Truncate(resolution), resolution)
+	if window/step > MAX_METRIC_POINTS {
+		writeError(w, r, badRequestError(fmt.Sprintf("That's more than %d points. Use a larger step.", MAX_METRIC_POINTS)))
+		return
+	}
+
+	points, counter, known := timeSeriesHistory.query(name, time.Now().Add(-window))
+	if !known {
+		writeError(w, r, notFoundError().WithDetail("we have no history of the metric %s", name))
+		return
+	}
+
+	points = downsamplePoints(points, step, counter)
+
+	rate := query.Get("rate") == "true"
+	if rate {
+		if !counter {
+			writeError(w, r, badRequestError("Only counters have a rate."))
+			return
+		}
+		points = counterIncreases(points)
+		for i := range points {
+			points[i].Value /= step.Seconds()
+		}
+	}
+
+	if points == nil {
+		points = []timePoint{}
+	}
+
+	incrementCounter("metric_queries_total")
+
+	setContentType(w, CONTENT_TYPE_JSON)
+	json.NewEncoder(w).Encode(struct {
+		Metric string      `json:"metric"`
+		Type   string      `json:"type"`
+		Rate   bool        `json:"rate,omitempty"`
+		Step   string      `json:"step"`
+		Points []timePoint `json:"points"`
+	}{name, map[bool]string{false: "gauge", true: "counter"}[counter], rate, step.String(), points})
+
+}
+
+// Parse a duration parameter of up to the given maximum, or return its default if it's missing
+func durationParameter(value string, name string, fallback time.Duration, maximum time.Duration) (time.Duration, error) {
+
+	if value == "" {
+		return min(fallback, maximum), nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 || duration > maximum {
+		return 0, badRequestError(fmt.Sprintf("The %s must be a duration (like 15m or 6h) of up to %s.", name, maximum))
+	}
+
+	return duration, nil
+
+}
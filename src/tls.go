@@ -0,0 +1,531 @@
+// TLS. With -tls-cert and -tls-key we serve HTTPS (and HTTP/2) rather than plain HTTP. On top of
+// the defaults of crypto/tls:
+//
+//   - session tickets (which let returning clients resume their sessions without a full
+//     handshake) are encrypted with the keys in -tls-ticket-keys when it's given, so that
+//     several instances behind a load balancer can resume each other's sessions. The file
+//     holds one key per line (64 hex characters, i.e. from openssl rand -hex 32): the first
+//     encrypts new tickets and all of them decrypt, so keys are rotated by adding a new key at
+//     the top and dropping the last one a while later. We re-read the file every
+//     TLS_TICKET_KEYS_INTERVAL. Without it, crypto/tls rotates keys of its own (which only this
+//     instance knows) every day.
+//   - OCSP stapling (-tls-ocsp): we fetch our certificate's revocation status from its issuer's
+//     OCSP responder and staple the response to our handshakes, so that clients needn't ask
+//     the responder themselves. We refresh it halfway through its validity. This needs the
+//     issuer's certificate after ours in -tls-cert (as in the usual fullchain.pem).
+//   - our outbound HTTPS clients (the proxy, its health checks, webhooks and the APIs our
+//     pages call, which all use http.DefaultTransport) keep a cache of
+//     -tls-client-session-cache sessions, so that they resume their sessions with the hosts
+//     they call.
+//
+// See certwatch.go for how renewed certificates are picked up and how we warn of expiry.
+//
+// /status reports our handshakes by protocol version, cipher suite and ALPN protocol, how many
+// of them were resumed, and the state of our ticket keys and OCSP staple.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TLS_TICKET_KEYS_INTERVAL         = time.Minute
+	DEFAULT_TLS_CLIENT_SESSION_CACHE = 64
+	OCSP_TIMEOUT                     = 10 * time.Second
+	OCSP_RETRY_INTERVAL              = 10 * time.Minute
+	OCSP_DEFAULT_REFRESH             = 12 * time.Hour // When a response doesn't say when it's next updated
+	OCSP_MAX_RESPONSE_SIZE           = 64 << 10
+)
+
+// The SHA-1 algorithm identifier, which OCSP responders universally accept for certificate IDs
+var oidSHA1 = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+
+// The response type of a basic OCSP response
+var oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+// Our TLS state: the certificate we serve (with its OCSP staple, if we have one), what our
+// handshakes negotiated, and our ticket keys and OCSP status for /status
+var tlsState = struct {
+	mutex        sync.Mutex
+	certificate  *tls.Certificate
+	handshakes   int
+	resumed      int
+	versions     map[string]int
+	cipherSuites map[string]int
+	protocols    map[string]int
+	ticketKeys   *ticketKeysStatus
+	ocsp         *ocspStatus
+
+	ticketKeyValues [][32]byte // The session ticket keys we last loaded
+}{versions: make(map[string]int), cipherSuites: make(map[string]int), protocols: make(map[string]int)}
+
+// Our TLS section of /status
+type tlsStatus struct {
+	Serving            bool               `json:"serving"`
+	Certificate        *certificateStatus `json:"certificate,omitempty"`
+	Handshakes         int                `json:"handshakes,omitempty"`
+	Resumed            int                `json:"resumed,omitempty"`
+	Versions           map[string]int     `json:"versions,omitempty"`
+	CipherSuites       map[string]int     `json:"cipher_suites,omitempty"`
+	Protocols          map[string]int     `json:"protocols,omitempty"`
+	TicketKeys         *ticketKeysStatus  `json:"ticket_keys,omitempty"`
+	OCSP               *ocspStatus        `json:"ocsp,omitempty"`
+	ClientSessionCache int                `json:"client_session_cache"`
+}
+
+// Our session ticket keys, as last loaded from -tls-ticket-keys
+type ticketKeysStatus struct {
+	File   string    `json:"file"`
+	Keys   int       `json:"keys"`
+	Loaded time.Time `json:"loaded,omitzero"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// Our OCSP staple, as last fetched
+type ocspStatus struct {
+	Responder  string    `json:"responder,omitempty"`
+	Status     string    `json:"status,omitempty"` // good, revoked or unknown
+	Stapled    bool      `json:"stapled"`
+	Fetched    time.Time `json:"fetched,omitzero"`
+	ThisUpdate time.Time `json:"this_update,omitzero"`
+	NextUpdate time.Time `json:"next_update,omitzero"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// The ASN.1 structures of OCSP (RFC 6960) which we send and read
+type ocspCertID struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest struct {
+		RequestList []struct {
+			CertID ocspCertID
+		}
+	}
+}
+
+type ocspResponse struct {
+	Status        asn1.Enumerated
+	ResponseBytes struct {
+		ResponseType asn1.ObjectIdentifier
+		Response     []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData struct {
+		Version            int `asn1:"optional,default:0,explicit,tag:0"`
+		ResponderID        asn1.RawValue
+		ProducedAt         time.Time `asn1:"generalized"`
+		Responses          []ocspSingleResponse
+		ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+	}
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID  ocspCertID
+	Good    asn1.Flag `asn1:"tag:0,optional"`
+	Revoked struct {
+		RevocationTime time.Time       `asn1:"generalized"`
+		Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+	} `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+// Returns the TLS configuration we serve with, starting our ticket key and OCSP refreshes
+func newTLSConfig(certFile string, keyFile string, ticketKeysFile string, staple bool) (*tls.Config, error) {
+
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading the TLS certificate: %w", err)
+	}
+
+	// An invalid chain is better served than nothing at all, but it needs fixing
+	if err := checkCertificateChain(&certificate); err != nil {
+		logger.Printf("ERROR the TLS certificate in %s is invalid: %v", certFile, err)
+	}
+
+	tlsState.mutex.Lock()
+	tlsState.certificate = &certificate
+	tlsState.mutex.Unlock()
+
+	// Renewed certificates are picked up without a restart (see certwatch.go)
+	watchCertificate(certFile, keyFile)
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		// Our certificate changes as its OCSP staple is refreshed and as it's renewed
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			tlsState.mutex.Lock()
+			defer tlsState.mutex.Unlock()
+			return tlsState.certificate, nil
+		},
+		// Called for every handshake (resumed or not), so it's where we count them
+		VerifyConnection: recordHandshake,
+	}
+
+	if ticketKeysFile != "" {
+		if err := loadTicketKeys(config, ticketKeysFile); err != nil {
+			return nil, err
+		}
+		go func() {
+			for range time.Tick(TLS_TICKET_KEYS_INTERVAL) {
+				if err := loadTicketKeys(config, ticketKeysFile); err != nil {
+					logger.Println("WARN keeping our session ticket keys:", err)
+				}
+			}
+		}()
+	}
+
+	if staple {
+		go refreshOCSPStaple()
+	}
+
+	return config, nil
+
+}
+
+// Give our outbound clients (everything using http.DefaultTransport) a TLS session cache of the
+// given size, so that they resume their sessions (0 for no cache)
+func applyTLSClientSessionCache(size int) {
+	if size <= 0 {
+		return
+	}
+	if transport, ok := http.DefaultTransport.(*http.Transport); ok {
+		transport.TLSClientConfig = &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(size)}
+	}
+}
+
+// Count what a handshake negotiated
+func recordHandshake(state tls.ConnectionState) error {
+
+	version := tls.VersionName(state.Version)
+	protocol := cmp.Or(state.NegotiatedProtocol, "none")
+
+	tlsState.mutex.Lock()
+	tlsState.handshakes++
+	if state.DidResume {
+		tlsState.resumed++
+	}
+	tlsState.versions[version]++
+	tlsState.cipherSuites[tls.CipherSuiteName(state.CipherSuite)]++
+	tlsState.protocols[protocol]++
+	tlsState.mutex.Unlock()
+
+	incrementCounter("tls_handshakes_total", "version", version, "resumed", fmt.Sprint(state.DidResume))
+
+	return nil
+
+}
+
+// Returns our TLS section of /status
+func currentTLSStatus() tlsStatus {
+
+	certificate := currentCertificateStatus()
+
+	tlsState.mutex.Lock()
+	defer tlsState.mutex.Unlock()
+
+	status := tlsStatus{
+		Certificate:        certificate,
+		Serving:            tlsState.certificate != nil,
+		Handshakes:         tlsState.handshakes,
+		Resumed:            tlsState.resumed,
+		Versions:           maps.Clone(tlsState.versions),
+		CipherSuites:       maps.Clone(tlsState.cipherSuites),
+		Protocols:          maps.Clone(tlsState.protocols),
+		ClientSessionCache: max(tlsClientSessionCache, 0),
+	}
+	if tlsState.ticketKeys != nil {
+		keys := *tlsState.ticketKeys
+		status.TicketKeys = &keys
+	}
+	if tlsState.ocsp != nil {
+		ocsp := *tlsState.ocsp
+		status.OCSP = &ocsp
+	}
+
+	return status
+
+}
+
+// Load our session ticket keys from the given file into our configuration, if they've changed.
+// A file we can't read (or which holds no valid keys) leaves our current keys as they are.
+func loadTicketKeys(config *tls.Config, path string) error {
+
+	contents, err := os.ReadFile(path)
+
+	tlsState.mutex.Lock()
+	defer tlsState.mutex.Unlock()
+
+	status := tlsState.ticketKeys
+	if status == nil {
+		status = &ticketKeysStatus{File: path}
+		tlsState.ticketKeys = status
+	}
+
+	var keys [][32]byte
+	if err == nil {
+		keys, err = parseTicketKeys(contents)
+	}
+	if err != nil {
+		status.Error = err.Error()
+		return fmt.Errorf("reading the session ticket keys in %s: %w", path, err)
+	}
+
+	status.Error = ""
+
+	// We're called every minute, but only rotate when the keys have changed
+	if slices.Equal(keys, tlsState.ticketKeyValues) {
+		return nil
+	}
+
+	config.SetSessionTicketKeys(keys)
+	tlsState.ticketKeyValues = keys
+	status.Keys, status.Loaded = len(keys), time.Now().UTC()
+
+	logger.Printf("Loaded %d session ticket keys from %s", len(keys), path)
+
+	return nil
+
+}
+
+// Parse a session ticket keys file: one key of 64 hex characters per line, newest first.
+// Blank lines and lines starting with # are ignored.
+func parseTicketKeys(contents []byte) ([][32]byte, error) {
+
+	var keys [][32]byte
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		decoded, err := hex.DecodeString(text)
+		if err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("line %d isn't a key of 64 hex characters", line)
+		}
+		keys = append(keys, [32]byte(decoded))
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("there aren't any keys")
+	}
+
+	return keys, nil
+
+}
+
+// Signals our OCSP refresh that our certificate has been replaced (see certwatch.go)
+var ocspRefresh = make(chan struct{}, 1)
+
+// Keep our OCSP staple fresh until the server exits, fetching it halfway through the validity
+// of the last one (or sooner after a failure), and again whenever our certificate is replaced.
+// Certificates without an OCSP responder (i.e. self-signed ones) aren't stapled at all.
+func refreshOCSPStaple() {
+
+	for {
+
+		select {
+		case <-ocspRefresh:
+		default:
+		}
+
+		tlsState.mutex.Lock()
+		certificate := tlsState.certificate
+		tlsState.mutex.Unlock()
+
+		if certificate.Leaf == nil || len(certificate.Leaf.OCSPServer) == 0 {
+			tlsState.mutex.Lock()
+			tlsState.ocsp = &ocspStatus{Error: "the certificate doesn't name an OCSP responder"}
+			tlsState.mutex.Unlock()
+			<-ocspRefresh
+			continue
+		}
+
+		status := &ocspStatus{Responder: certificate.Leaf.OCSPServer[0], Fetched: time.Now().UTC()}
+		staple, response, err := fetchOCSPResponse(certificate, status.Responder)
+
+		next := time.Now().Add(OCSP_RETRY_INTERVAL)
+
+		if err == nil {
+			status.ThisUpdate, status.NextUpdate = response.ThisUpdate, response.NextUpdate
+			switch {
+			case bool(response.Good):
+				status.Status, status.Stapled = "good", true
+			case !response.Revoked.RevocationTime.IsZero():
+				status.Status = "revoked"
+				err = fmt.Errorf("our certificate was revoked at %v", response.Revoked.RevocationTime)
+			default:
+				status.Status = "unknown"
+				err = errors.New("the responder doesn't know our certificate")
+			}
+		}
+
+		if status.Stapled {
+			refresh := OCSP_DEFAULT_REFRESH
+			if !response.NextUpdate.IsZero() {
+				refresh = response.NextUpdate.Sub(response.ThisUpdate) / 2
+			}
+			next = response.ThisUpdate.Add(refresh)
+			if soonest := time.Now().Add(time.Minute); next.Before(soonest) {
+				next = soonest
+			}
+		}
+
+		if err != nil {
+			status.Error = err.Error()
+			incrementCounter("tls_ocsp_failures_total")
+			logger.Println("WARN OCSP stapling failed:", err)
+		}
+
+		// A failed refresh keeps the last good staple until it's out of date. A response for a
+		// certificate which was replaced while we fetched it is no use to us.
+		tlsState.mutex.Lock()
+		if tlsState.certificate != certificate {
+			tlsState.mutex.Unlock()
+			continue
+		}
+		stapled := *certificate
+		switch {
+		case status.Stapled:
+			stapled.OCSPStaple = staple
+		case tlsState.ocsp != nil && tlsState.ocsp.Stapled && time.Now().Before(tlsState.ocsp.NextUpdate):
+			status.Stapled, status.ThisUpdate, status.NextUpdate = true, tlsState.ocsp.ThisUpdate, tlsState.ocsp.NextUpdate
+		default:
+			stapled.OCSPStaple = nil
+		}
+		tlsState.certificate, tlsState.ocsp = &stapled, status
+		tlsState.mutex.Unlock()
+
+		select {
+		case <-time.After(time.Until(next)):
+		case <-ocspRefresh:
+		}
+
+	}
+
+}
+
+// Ask the given OCSP responder for the status of our certificate, returning the raw response
+// (our staple) and our certificate's entry in it. We don't check the responder's signature,
+// since clients check it for themselves before trusting our staple.
+func fetchOCSPResponse(certificate *tls.Certificate, responder string) ([]byte, ocspSingleResponse, error) {
+
+	var single ocspSingleResponse
+
+	if len(certificate.Certificate) < 2 {
+		return nil, single, errors.New("the issuer's certificate isn't in our certificate chain")
+	}
+	issuer, err := x509.ParseCertificate(certificate.Certificate[1])
+	if err != nil {
+		return nil, single, fmt.Errorf("parsing the issuer's certificate: %w", err)
+	}
+
+	// Our certificate is identified by hashes of its issuer's name and public key
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return nil, single, fmt.Errorf("parsing the issuer's public key: %w", err)
+	}
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(publicKeyInfo.PublicKey.RightAlign())
+
+	var request ocspRequest
+	request.TBSRequest.RequestList = make([]struct{ CertID ocspCertID }, 1)
+	request.TBSRequest.RequestList[0].CertID = ocspCertID{
+		HashAlgorithm:  pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		IssuerNameHash: nameHash[:],
+		IssuerKeyHash:  keyHash[:],
+		SerialNumber:   certificate.Leaf.SerialNumber,
+	}
+	body, err := asn1.Marshal(request)
+	if err != nil {
+		return nil, single, err
+	}
+
+	httpRequest, err := http.NewRequest(http.MethodPost, responder, bytes.NewReader(body))
+	if err != nil {
+		return nil, single, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/ocsp-request")
+
+	client := &http.Client{Timeout: OCSP_TIMEOUT}
+	started := time.Now()
+	response, err := client.Do(httpRequest)
+	logOutboundCall(httpRequest, 0, response, err, time.Since(started))
+	if err != nil {
+		return nil, single, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, single, fmt.Errorf("the OCSP responder answered with a %d", response.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(response.Body, OCSP_MAX_RESPONSE_SIZE))
+	if err != nil {
+		return nil, single, err
+	}
+
+	var parsed ocspResponse
+	if _, err := asn1.Unmarshal(raw, &parsed); err != nil {
+		return nil, single, fmt.Errorf("parsing the OCSP response: %w", err)
+	}
+	if parsed.Status != 0 {
+		return nil, single, fmt.Errorf("the OCSP responder answered with status %d", parsed.Status)
+	}
+	if !parsed.ResponseBytes.ResponseType.Equal(oidOCSPBasic) {
+		return nil, single, errors.New("the OCSP response isn't a basic response")
+	}
+
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(parsed.ResponseBytes.Response, &basic); err != nil {
+		return nil, single, fmt.Errorf("parsing the OCSP response: %w", err)
+	}
+
+	for _, entry := range basic.TBSResponseData.Responses {
+		if entry.CertID.SerialNumber != nil && entry.CertID.SerialNumber.Cmp(certificate.Leaf.SerialNumber) == 0 {
+			if !entry.NextUpdate.IsZero() && time.Now().After(entry.NextUpdate) {
+				return nil, single, errors.New("the OCSP response is out of date")
+			}
+			return raw, entry, nil
+		}
+	}
+
+	return nil, single, errors.New("the OCSP response doesn't cover our certificate")
+
+}
@@ -0,0 +1,494 @@
+// Our network diagnostics tools. /tools offers DNS lookups, reverse DNS lookups and TCP port
+// checks which run on the server, which makes the server a handy diagnostics box for the
+// network it runs on (i.e. checking what a LAN's DNS server returns, or whether a service is
+// reachable from the server's machine).
+//
+// As these let visitors probe the server's network, the tools are disabled unless the -tools
+// flag is set. Every lookup has a strict timeout, all input is validated, and each client IP
+// address is rate limited to TOOLS_RATE_LIMIT lookups per minute.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TOOLS_TIMEOUT        = 3 * time.Second // How long a single lookup or port check may take
+	TOOLS_RATE_LIMIT     = 20              // How many lookups a client may make per minute
+	TOOLS_RATE_BURST     = 5               // How many lookups a client may make in quick succession
+	MAX_HOST_NAME_LENGTH = 253             // The longest valid DNS name
+	MAX_RATE_LIMIT_USERS = 10000           // How many clients we track before forgetting idle ones
+)
+
+// The DNS record types our lookup tool supports
+var dnsRecordTypes = []string{"A", "AAAA", "CNAME", "MX", "NS", "TXT"}
+
+// The result of one of our tools
+type toolResult struct {
+	Tool     string   `json:"tool"`
+	Query    string   `json:"query"`
+	Records  []string `json:"records,omitempty"`
+	Status   string   `json:"status,omitempty"` // For port checks: open, closed or timed out
+	Error    string   `json:"error,omitempty"`
+	Duration string   `json:"duration"`
+}
+
+// The data we pass into our tools body template
+type toolsPageData struct {
+	Enabled     bool
+	RecordTypes []string
+	Query       map[string]string // The submitted form values, so that the forms keep them
+	Result      *toolResult
+}
+
+// The body content of our tools page. The values are escaped by html/template.
+const TOOLS_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>Network Tools</h2>
+		{{ if not .Enabled }}
+		<p>The network tools are disabled on this server (see the -tools flag).</p>
+		{{ end }}
+		<h4>DNS Lookup</h4>
+		<form action="{{ url "/tools" }}" method="GET">
+			<input type="hidden" name="tool" value="dns">
+			<input maxLength=253 size=40 name="name" value="{{ index .Query "name" }}" placeholder="Host name (i.e. example.com)">
+			<select name="type">
+				{{ range .RecordTypes }}
+				<option{{ if eq . (index $.Query "type") }} selected{{ end }}>{{ . }}</option>
+				{{ end }}
+			</select>
+			<input type="submit" value="Look Up">
+		</form>
+		<h4>Reverse DNS</h4>
+		<form action="{{ url "/tools" }}" method="GET">
+			<input type="hidden" name="tool" value="rdns">
+			<input maxLength=45 size=40 name="ip" value="{{ index .Query "ip" }}" placeholder="IP address (i.e. 192.168.1.1)">
+			<input type="submit" value="Look Up">
+		</form>
+		<h4>TCP Port Check</h4>
+		<form action="{{ url "/tools" }}" method="GET">
+			<input type="hidden" name="tool" value="port">
+			<input maxLength=253 size=40 name="host" value="{{ index .Query "host" }}" placeholder="Host name or IP address">
+			<input maxLength=5 size=6 name="port" value="{{ index .Query "port" }}" placeholder="Port">
+			<input type="submit" value="Check">
+		</form>
+		{{ with .Result }}
+		<h4>{{ .Tool }} {{ .Query }}</h4>
+		{{ if .Error }}<p>{{ .Error }}</p>{{ end }}
+		{{ if .Status }}<p>The port is {{ .Status }}.</p>{{ end }}
+		{{ range .Records }}<p><code>{{ . }}</code></p>{{ end }}
+		<p><small>Took {{ .Duration }}</small></p>
+		{{ end }}
+	</div>
+`
+
+func init() {
+	registerPage(Page{Title: "Tools", Path: "/tools", Order: 70, Visible: true, Section: SECTION_UTILITIES, Handler: toolsHandler})
+}
+
+// This is our tools handler. Without a tool it displays our forms, otherwise it runs the
+// requested tool and displays its result below them.
+func toolsHandler(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+
+	data := toolsPageData{
+		Enabled:     toolsEnabled,
+		RecordTypes: dnsRecordTypes,
+		Query: map[string]string{
+			"name": query.Get("name"),
+			"type": query.Get("type"),
+			"ip":   query.Get("ip"),
+			"host": query.Get("host"),
+			"port": query.Get("port"),
+		},
+	}
+
+	if tool := query.Get("tool"); tool != "" {
+
+		if !toolsEnabled {
+			writeError(w, r, newAppError(http.StatusServiceUnavailable, "tools_disabled",
+				"The network tools are disabled on this server."))
+			return
+		}
+
+		if wait := toolsRateLimiter.reserve(clientAddress(r)); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, r, newAppError(http.StatusTooManyRequests, "rate_limited",
+				"You're using the network tools too quickly. Please wait a moment and try again."))
+			return
+		}
+
+		result, err := runTool(r.Context(), tool, data.Query)
+
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		incrementCounter("tools_lookups_total", "tool", tool)
+		data.Result = result
+
+		if wantsJSON(r) {
+			setContentType(w, CONTENT_TYPE_JSON)
+			json.NewEncoder(w).Encode(result)
+			return
+		}
+
+	}
+
+	body, err := renderFragment(toolsBodyTemplate, data)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the tools body template"))
+		return
+	}
+
+	renderMainTemplate(w, r, "tools", HtmlData{
+		Title:       "Golang Network Tools",
+		Description: "Server side DNS lookups and TCP port checks.",
+		Keywords:    "golang web server dns lookup reverse dns port check",
+		CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+		BodyContent: body,
+	})
+
+}
+
+// Validate the input of the given tool and run it. Lookups which fail (i.e. a name which
+// doesn't exist) are results rather than errors, while invalid input is a bad request.
+func runTool(ctx context.Context, tool string, input map[string]string) (*toolResult, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, TOOLS_TIMEOUT)
+	defer cancel()
+
+	endSpan := startSpan(ctx, "tool: "+tool)
+	defer endSpan()
+
+	started := time.Now()
+	var result *toolResult
+	var err error
+
+	switch tool {
+	case "dns", "rdns", "port":
+		tagRequest(ctx, "tool", tool)
+	}
+
+	switch tool {
+	case "dns":
+		result, err = lookupDNS(ctx, input["name"], input["type"])
+	case "rdns":
+		result, err = lookupReverseDNS(ctx, input["ip"])
+	case "port":
+		result, err = checkPort(ctx, input["host"], input["port"])
+	default:
+		return nil, badRequestError("Unknown tool. Choose one of dns, rdns or port.")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	result.Duration = time.Since(started).Round(time.Millisecond).String()
+
+	return result, nil
+
+}
+
+// Look up the DNS records of the given type for the given name
+func lookupDNS(ctx context.Context, name string, recordType string) (*toolResult, error) {
+
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+
+	if err := validateHostName(name); err != nil {
+		return nil, err
+	}
+
+	if recordType == "" {
+		recordType = "A"
+	}
+
+	result := &toolResult{Tool: recordType + " lookup", Query: name}
+	var err error
+
+	switch recordType {
+	case "A", "AAAA":
+		network := map[string]string{"A": "ip4", "AAAA": "ip6"}[recordType]
+		var addresses []netip.Addr
+		addresses, err = net.DefaultResolver.LookupNetIP(ctx, network, name)
+		for _, address := range addresses {
+			result.Records = append(result.Records, address.Unmap().String())
+		}
+
+	case "CNAME":
+		var canonicalName string
+		canonicalName, err = net.DefaultResolver.LookupCNAME(ctx, name)
+		result.Records = []string{canonicalName}
+
+	case "MX":
+		var records []*net.MX
+		records, err = net.DefaultResolver.LookupMX(ctx, name)
+		for _, record := range records {
+			result.Records = append(result.Records, fmt.Sprintf("%d %s", record.Pref, record.Host))
+		}
+
+	case "NS":
+		var records []*net.NS
+		records, err = net.DefaultResolver.LookupNS(ctx, name)
+		for _, record := range records {
+			result.Records = append(result.Records, record.Host)
+		}
+
+	case "TXT":
+		result.Records, err = net.DefaultResolver.LookupTXT(ctx, name)
+
+	default:
+		return nil, badRequestError("Unknown record type. Choose one of " + strings.Join(dnsRecordTypes, ", ") + ".")
+	}
+
+	if err != nil {
+		result.Records = nil
+		result.Error = lookupErrorMessage(err)
+	}
+
+	return result, nil
+
+}
+
+// Look up the names of the given IP address
+func lookupReverseDNS(ctx context.Context, ip string) (*toolResult, error) {
+
+	address, err := netip.ParseAddr(strings.TrimSpace(ip))
+
+	if err != nil {
+		return nil, badRequestError("Please enter a valid IPv4 or IPv6 address.")
+	}
+
+	result := &toolResult{Tool: "Reverse lookup", Query: address.String()}
+
+	result.Records, err = net.DefaultResolver.LookupAddr(ctx, address.String())
+
+	if err != nil {
+		result.Records = nil
+		result.Error = lookupErrorMessage(err)
+	}
+
+	return result, nil
+
+}
+
+// Check whether we can open a TCP connection to the given host and port
+func checkPort(ctx context.Context, host string, port string) (*toolResult, error) {
+
+	host = strings.TrimSpace(host)
+
+	if _, err := netip.ParseAddr(host); err != nil {
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+		if err := validateHostName(host); err != nil {
+			return nil, err
+		}
+	}
+
+	portNumber, err := strconv.Atoi(strings.TrimSpace(port))
+
+	if err != nil || portNumber < 1 || portNumber > 65535 {
+		return nil, badRequestError("Please enter a port number from 1 to 65535.")
+	}
+
+	address := net.JoinHostPort(host, strconv.Itoa(portNumber))
+	result := &toolResult{Tool: "TCP port check", Query: address}
+
+	var dialer net.Dialer
+	connection, err := dialer.DialContext(ctx, "tcp", address)
+
+	switch {
+	case err == nil:
+		connection.Close()
+		result.Status = "open"
+
+	case errors.Is(err, context.DeadlineExceeded):
+		// Nothing answered (usually a firewall dropping our connection attempt)
+		result.Status = "not responding (timed out)"
+
+	default:
+		var dnsError *net.DNSError
+		if errors.As(err, &dnsError) {
+			result.Error = lookupErrorMessage(err)
+		} else {
+			result.Status = "closed"
+		}
+	}
+
+	return result, nil
+
+}
+
+// Make sure the given name is a valid DNS host name (letters, digits and hyphens in labels of
+// up to 63 characters, separated by dots)
+func validateHostName(name string) error {
+
+	invalid := badRequestError("Please enter a valid host name (i.e. example.com).")
+
+	if name == "" || len(name) > MAX_HOST_NAME_LENGTH {
+		return invalid
+	}
+
+	for _, label := range strings.Split(name, ".") {
+
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return invalid
+		}
+
+		for _, character := range label {
+			// Underscores aren't valid in host names, but are common in other records (i.e.
+			// _dmarc.example.com TXT records)
+			if !(character >= 'a' && character <= 'z' || character >= '0' && character <= '9' ||
+				character == '-' || character == '_') {
+				return invalid
+			}
+		}
+
+	}
+
+	return nil
+
+}
+
+// Returns a readable message for a failed lookup
+func lookupErrorMessage(err error) string {
+
+	var dnsError *net.DNSError
+
+	switch {
+	case errors.As(err, &dnsError) && dnsError.IsNotFound:
+		return "No records were found."
+	case errors.As(err, &dnsError) && dnsError.IsTimeout, errors.Is(err, context.DeadlineExceeded):
+		return "The lookup timed out."
+	}
+
+	return "The lookup failed: " + err.Error()
+
+}
+
+// Returns the IP address of the client which made the given request. We don't trust
+// forwarding headers here, as clients could set them to dodge our rate limits.
+func clientAddress(r *http.Request) string {
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+
+}
+
+// A rateLimiter allows each client a number of actions per minute using a token bucket per
+// client: buckets hold up to burst tokens and refill at the given rate, and each action takes
+// a token. Each limiter is a named tier whose rate admins can change at runtime (see
+// accessrules.go).
+type rateLimiter struct {
+	name      string
+	mutex     sync.Mutex
+	perMinute float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// The rate limiter for our network tools
+var toolsRateLimiter = newRateLimiter("tools", TOOLS_RATE_LIMIT, TOOLS_RATE_BURST)
+
+// Our rate limiters, by name
+var rateLimiters = map[string]*rateLimiter{}
+
+// Create a new rate limiter with the given name, adding it to rateLimiters
+func newRateLimiter(name string, perMinute int, burst int) *rateLimiter {
+	limiter := &rateLimiter{
+		name:      name,
+		perMinute: float64(perMinute),
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+	}
+	rateLimiters[name] = limiter
+	return limiter
+}
+
+// Change our rate. Clients keep the tokens they have (up to our new burst).
+func (limiter *rateLimiter) setRate(perMinute int, burst int) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.perMinute, limiter.burst = float64(perMinute), float64(burst)
+	for _, bucket := range limiter.buckets {
+		bucket.tokens = min(bucket.tokens, limiter.burst)
+	}
+}
+
+// Returns our rate
+func (limiter *rateLimiter) rate() (int, int) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return int(limiter.perMinute), int(limiter.burst)
+}
+
+// Take a token for the given client. Returns zero when the client may go ahead, otherwise how
+// long the client has to wait for its next token. Clients on our allow list (see
+// accessrules.go) always go ahead.
+func (limiter *rateLimiter) reserve(client string) time.Duration {
+
+	if clientAllowed(client) {
+		return 0
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	refill := func(bucket *tokenBucket) {
+		elapsed := now.Sub(bucket.updated).Minutes()
+		bucket.tokens = min(limiter.burst, bucket.tokens+elapsed*limiter.perMinute)
+		bucket.updated = now
+	}
+
+	bucket, ok := limiter.buckets[client]
+
+	if !ok {
+		// Forget the clients whose buckets have filled back up, as they're the same as new
+		if len(limiter.buckets) >= MAX_RATE_LIMIT_USERS {
+			for key, idle := range limiter.buckets {
+				if refill(idle); idle.tokens >= limiter.burst {
+					delete(limiter.buckets, key)
+				}
+			}
+		}
+		bucket = &tokenBucket{tokens: limiter.burst, updated: now}
+		limiter.buckets[client] = bucket
+	}
+
+	refill(bucket)
+
+	if bucket.tokens < 1 {
+		incrementCounter("rate_limited_requests_total", "limiter", limiter.name)
+		return time.Duration((1 - bucket.tokens) / limiter.perMinute * float64(time.Minute))
+	}
+
+	bucket.tokens--
+
+	return 0
+
+}
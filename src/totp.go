@@ -0,0 +1,502 @@
+// Two-factor authentication for our admins, with time-based one-time passwords (TOTP, RFC 6238)
+// from an authenticator app. An admin enrols their account (the basic auth username, or the
+// X-Admin-Account header for bearer token clients) at /debug/totp, which generates a secret and
+// shows it as a QR code (drawn by our own QR encoder) for their app to scan, and which only
+// enrols them once they've entered a code from their app, so that a mistyped secret can't lock
+// them out. Enrolment also hands out RECOVERY_CODE_COUNT single-use recovery codes, which we
+// only store as SHA-256 hashes.
+//
+// Once any account is enrolled, every admin login needs a second factor: the account must be
+// enrolled, and along with our admin token it must supply a current code (or one of its
+// recovery codes), either in the X-Admin-OTP header or, since browsers only prompt for a
+// username and password, straight after the token in its basic auth password. A code is only
+// accepted once, and codes from one step either side of the current one are accepted to allow
+// for clock drift. Wrong codes count as failed logins (see loginguard.go).
+//
+// Browsers keep sending the password they were given, so after a login with a second factor
+// adminOnly gives the browser a signed admin session cookie (see signing.go) for
+// ADMIN_SESSION_LIFETIME, and requests carrying our token and a valid session cookie for their
+// account needn't supply a code again.
+//
+// Enrolments are kept in -admin-totp-file (or in memory without it), which holds the accounts'
+// secrets and so must only be readable by its owner.
+
+package main
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TOTP_STEP                 = 30 * time.Second
+	TOTP_DIGITS               = 6
+	TOTP_SKEW                 = 1  // How many steps either side of the current one we accept
+	TOTP_SECRET_LENGTH        = 20 // In bytes, as RFC 4226 recommends for HMAC-SHA1
+	TOTP_ISSUER               = "Go Web Server"
+	TOTP_CODE_HEADER          = "X-Admin-OTP"
+	TOTP_ENROLMENT_LIFETIME   = 15 * time.Minute // How long an admin has to confirm a new secret
+	RECOVERY_CODE_COUNT       = 10
+	RECOVERY_CODE_LENGTH      = 5 // In bytes, before they're hex encoded
+	ADMIN_ACCOUNT_HEADER      = "X-Admin-Account"
+	ADMIN_SESSION_COOKIE_NAME = "admin_session"
+	ADMIN_SESSION_LIFETIME    = 12 * time.Hour
+)
+
+// The encoding of TOTP secrets, as authenticator apps expect them
+var totpSecretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// An account enrolled in two-factor authentication
+type totpAccount struct {
+	Secret        string    `json:"secret"`         // Base32 encoded
+	RecoveryCodes []string  `json:"recovery_codes"` // The SHA-256 hashes of its unused recovery codes
+	LastStep      int64     `json:"last_step"`      // The step of the last code it used, which can't be used again
+	Enrolled      time.Time `json:"enrolled"`
+}
+
+// Our enrolled accounts, by name, and the file they're saved in (if any)
+var totpAccounts = struct {
+	mutex    sync.Mutex
+	file     string
+	accounts map[string]*totpAccount
+}{accounts: make(map[string]*totpAccount)}
+
+// Load our enrolled accounts from the given file
+func loadTOTPAccounts(path string) error {
+
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0o077 != 0 {
+		return fmt.Errorf("%s can be read by others (its permissions are %v), it should only be readable by its owner (chmod 600)", path, info.Mode().Perm())
+	}
+
+	totpAccounts.mutex.Lock()
+	defer totpAccounts.mutex.Unlock()
+
+	totpAccounts.file = path
+
+	if err := loadJSONFile(path, &totpAccounts.accounts); err != nil {
+		return err
+	}
+	if totpAccounts.accounts == nil {
+		totpAccounts.accounts = make(map[string]*totpAccount)
+	}
+
+	return nil
+
+}
+
+// Save our enrolled accounts, if we have a file for them. The caller must hold our mutex.
+func saveTOTPAccounts() {
+	if totpAccounts.file == "" {
+		return
+	}
+	if err := saveJSONFile(totpAccounts.file, totpAccounts.accounts); err != nil {
+		logger.Println("ERROR failed to save the two-factor enrolments:", err)
+	}
+}
+
+// Returns whether admin logins need a second factor, which they do once any account is enrolled
+func twoFactorRequired() bool {
+	totpAccounts.mutex.Lock()
+	defer totpAccounts.mutex.Unlock()
+	return len(totpAccounts.accounts) > 0
+}
+
+// Returns the name of the admin account a request is for: its basic auth username, or the
+// X-Admin-Account header of bearer token clients
+func adminAccount(r *http.Request) string {
+	if account, _, ok := r.BasicAuth(); ok {
+		return account
+	}
+	return r.Header.Get(ADMIN_ACCOUNT_HEADER)
+}
+
+// Returns the code for the given secret at the given step (RFC 4226's HOTP, with the step as its
+// counter)
+func totpCode(secret []byte, step int64) string {
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation: the low nibble of the last byte picks which four bytes we use
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%uint32(math.Pow10(TOTP_DIGITS)))
+
+}
+
+// Returns the step of the given code for the given secret if it's one of the codes we currently
+// accept (and 0 otherwise)
+func matchTOTPCode(secret []byte, code string) int64 {
+
+	current := time.Now().Unix() / int64(TOTP_STEP.Seconds())
+
+	for step := current - TOTP_SKEW; step <= current+TOTP_SKEW; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step
+		}
+	}
+
+	return 0
+
+}
+
+// Check the given code (or recovery code) for the given account, using it up if it's valid
+func checkSecondFactor(account string, code string) bool {
+
+	code = strings.TrimSpace(code)
+
+	totpAccounts.mutex.Lock()
+	defer totpAccounts.mutex.Unlock()
+
+	enrolled, found := totpAccounts.accounts[account]
+	if !found || code == "" {
+		incrementCounter("admin_second_factor_total", "result", "failed")
+		return false
+	}
+
+	if len(code) == TOTP_DIGITS {
+		secret, err := totpSecretEncoding.DecodeString(enrolled.Secret)
+		if err != nil {
+			return false
+		}
+		step := matchTOTPCode(secret, code)
+		if step == 0 {
+			incrementCounter("admin_second_factor_total", "result", "failed")
+			return false
+		}
+		// Someone who's seen a code mustn't be able to use it while it's still current
+		if step <= enrolled.LastStep {
+			incrementCounter("admin_second_factor_total", "result", "replayed")
+			logger.Printf("AUDIT admin login for account %q replayed a two-factor code", account)
+			return false
+		}
+		enrolled.LastStep = step
+		saveTOTPAccounts()
+		incrementCounter("admin_second_factor_total", "result", "code")
+		return true
+	}
+
+	hashed := hashRecoveryCode(code)
+	index := slices.IndexFunc(enrolled.RecoveryCodes, func(stored string) bool {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(hashed)) == 1
+	})
+	if index < 0 {
+		incrementCounter("admin_second_factor_total", "result", "failed")
+		return false
+	}
+
+	enrolled.RecoveryCodes = slices.Delete(enrolled.RecoveryCodes, index, index+1)
+	saveTOTPAccounts()
+	incrementCounter("admin_second_factor_total", "result", "recovery_code")
+	logger.Printf("AUDIT admin login for account %q used a recovery code (%d left)", account, len(enrolled.RecoveryCodes))
+
+	return true
+
+}
+
+// Returns new recovery codes (in the form 0a1b2-c3d4e) along with the hashes we store
+func newRecoveryCodes() ([]string, []string) {
+
+	codes := make([]string, RECOVERY_CODE_COUNT)
+	hashes := make([]string, RECOVERY_CODE_COUNT)
+
+	for i := range codes {
+		random := make([]byte, RECOVERY_CODE_LENGTH)
+		rand.Read(random)
+		encoded := hex.EncodeToString(random)
+		codes[i] = encoded[:len(encoded)/2] + "-" + encoded[len(encoded)/2:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	return codes, hashes
+
+}
+
+// Returns the hash we store of a recovery code, ignoring its case and dashes as people type them
+func hashRecoveryCode(code string) string {
+	normalised := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalised))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns whether the request carries a valid admin session cookie for the given account
+func validAdminSession(r *http.Request, account string) bool {
+
+	cookie, err := r.Cookie(ADMIN_SESSION_COOKIE_NAME)
+	if err != nil {
+		return false
+	}
+
+	value, ok := verifySignedValue(cookie.Value)
+	if !ok {
+		return false
+	}
+
+	kind, rest, _ := strings.Cut(value, ":")
+	expiry, name, _ := strings.Cut(rest, ":")
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	if kind != "admin" || err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(name), []byte(account)) == 1
+
+}
+
+// Give the client an admin session cookie for the given account, so that it needn't supply a
+// second factor again until the session expires
+func startAdminSession(w http.ResponseWriter, r *http.Request, account string) {
+
+	expires := time.Now().Add(ADMIN_SESSION_LIFETIME)
+
+	// The account goes last, as it's the only part which can contain colons
+	http.SetCookie(w, &http.Cookie{
+		Name:     ADMIN_SESSION_COOKIE_NAME,
+		Value:    signValue("admin:" + strconv.FormatInt(expires.Unix(), 10) + ":" + account),
+		Path:     urlFor("/"),
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+}
+
+// This is a template string we use to construct the body of our two-factor enrolment page
+const TOTP_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>Two-Factor Authentication</h2>
+		{{ if .RecoveryCodes }}
+		<p>Two-factor authentication is on for <b>{{ .Account }}</b>. These are its recovery codes, each of which can be used once instead of a code if you lose your authenticator app. Keep them somewhere safe, as they won't be shown again.</p>
+		<pre>{{ range .RecoveryCodes }}{{ . }}
+{{ end }}</pre>
+		<p><a href="{{ url "/debug/totp" }}">Done</a></p>
+		{{ else if not .Enrolled.IsZero }}
+		<p>Two-factor authentication is on for <b>{{ .Account }}</b> (since {{ .Enrolled.Format "2 Jan 2006 15:04 MST" }}), which has {{ .RecoveryCodesLeft }} recovery codes left.</p>
+		<form action="{{ url "/debug/totp" }}" method="POST">
+			<input type="hidden" name="account" value="{{ .Account }}">
+			<input type="hidden" name="csrf_token" value="{{ .CSRFToken }}">
+			<p><input name="code" size=12 autocomplete="one-time-code" placeholder="Current code"></p>
+			<button name="action" value="recovery-codes">New recovery codes</button>
+			<button name="action" value="disable">Turn off</button>
+		</form>
+		{{ else }}
+		<p>Scan this code with your authenticator app to turn on two-factor authentication for <b>{{ .Account }}</b>, then enter the code it shows.</p>
+		<div>{{ .QRCode }}</div>
+		<p><small>Or enter the key <code>{{ .Secret }}</code> by hand.</small></p>
+		<form action="{{ url "/debug/totp" }}" method="POST">
+			<input type="hidden" name="account" value="{{ .Account }}">
+			<input type="hidden" name="pending" value="{{ .Pending }}">
+			<input type="hidden" name="csrf_token" value="{{ .CSRFToken }}">
+			<p><input name="code" size=12 autocomplete="one-time-code" placeholder="Code from your app"></p>
+			<button name="action" value="enrol">Turn on</button>
+		</form>
+		{{ end }}
+		{{ with .Problem }}<p><small>{{ . }}</small></p>{{ end }}
+	</div>
+`
+
+// The data we pass into our two-factor enrolment body template
+type totpPageData struct {
+	Account           string
+	Enrolled          time.Time
+	RecoveryCodesLeft int
+	RecoveryCodes     []string // Only set straight after they're generated
+	Secret            string
+	Pending           string // The secret waiting to be confirmed, signed so that it can't be swapped
+	QRCode            template.HTML
+	CSRFToken         string
+	Problem           string
+}
+
+// This is our admin-only two-factor enrolment handler. GET shows an account's enrolment (or a
+// new secret to enrol it with), while POST enrols it, gives it new recovery codes or turns two
+// factor authentication off for it, each of which needs a current code. The account defaults to
+// the signed in one.
+func totpAdminHandler(w http.ResponseWriter, r *http.Request) {
+
+	account := cmp.Or(r.FormValue("account"), adminAccount(r))
+	if account == "" {
+		writeError(w, r, badRequestError("Two-factor authentication is per account, so sign in with a username (or give bearer tokens an "+ADMIN_ACCOUNT_HEADER+" header)."))
+		return
+	}
+
+	data := totpPageData{Account: account}
+	if !wantsJSON(r) {
+		data.CSRFToken = csrfToken(w, r)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.Method == http.MethodPost {
+
+		switch action := r.FormValue("action"); action {
+		case "enrol":
+			data.Problem = enrolTOTPAccount(account, r.FormValue("pending"), r.FormValue("code"), &data)
+			// The admin who enrolled has just shown a code, so they needn't sign in again
+			if data.Problem == "" && account == adminAccount(r) {
+				startAdminSession(w, r, account)
+			}
+		case "recovery-codes", "disable":
+			if !checkSecondFactor(account, r.FormValue("code")) {
+				data.Problem = "That code isn't valid."
+				break
+			}
+			totpAccounts.mutex.Lock()
+			if action == "disable" {
+				delete(totpAccounts.accounts, account)
+				logger.Printf("AUDIT two-factor authentication turned off for admin account %q", account)
+			} else if enrolled := totpAccounts.accounts[account]; enrolled != nil {
+				data.RecoveryCodes, enrolled.RecoveryCodes = newRecoveryCodes()
+				logger.Printf("AUDIT new recovery codes generated for admin account %q", account)
+			}
+			saveTOTPAccounts()
+			totpAccounts.mutex.Unlock()
+		default:
+			writeError(w, r, badRequestError("The action must be enrol, recovery-codes or disable."))
+			return
+		}
+
+		if data.Problem != "" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+
+	}
+
+	totpAccounts.mutex.Lock()
+	if enrolled := totpAccounts.accounts[account]; enrolled != nil {
+		data.Enrolled, data.RecoveryCodesLeft = enrolled.Enrolled, len(enrolled.RecoveryCodes)
+	}
+	totpAccounts.mutex.Unlock()
+
+	if data.Enrolled.IsZero() && data.RecoveryCodes == nil {
+		if err := prepareTOTPEnrolment(&data); err != nil {
+			writeError(w, r, internalError(err).WithDetail("drawing the two-factor QR code"))
+			return
+		}
+	}
+
+	if wantsJSON(r) {
+		setContentType(w, CONTENT_TYPE_JSON)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"account":             data.Account,
+			"enrolled":            !data.Enrolled.IsZero(),
+			"recovery_codes_left": data.RecoveryCodesLeft,
+			"recovery_codes":      data.RecoveryCodes,
+			"secret":              data.Secret,
+			"pending":             data.Pending,
+			"problem":             data.Problem,
+		})
+		return
+	}
+
+	body, err := renderFragment(totpBodyTemplate, data)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the two-factor body template"))
+		return
+	}
+
+	renderMainTemplate(w, r, "two-factor authentication", HtmlData{
+		Title:       "Two-Factor Authentication",
+		BodyContent: body,
+	})
+
+}
+
+// Generate a new secret for the given page's account, along with its QR code and its signed
+// pending form
+func prepareTOTPEnrolment(data *totpPageData) error {
+
+	secret := make([]byte, TOTP_SECRET_LENGTH)
+	rand.Read(secret)
+	data.Secret = totpSecretEncoding.EncodeToString(secret)
+
+	expires := time.Now().Add(TOTP_ENROLMENT_LIFETIME).Unix()
+	data.Pending = signValue("totp:" + strconv.FormatInt(expires, 10) + ":" + data.Secret + ":" + data.Account)
+
+	// The key URI format authenticator apps understand (see
+	// https://github.com/google/google-authenticator/wiki/Key-Uri-Format)
+	query := url.Values{}
+	query.Set("secret", data.Secret)
+	query.Set("issuer", TOTP_ISSUER)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(TOTP_DIGITS))
+	query.Set("period", strconv.Itoa(int(TOTP_STEP.Seconds())))
+	uri := "otpauth://totp/" + url.PathEscape(TOTP_ISSUER+":"+data.Account) + "?" + query.Encode()
+
+	code, err := generateCode("qr", uri)
+	if err != nil {
+		return err
+	}
+	// template-audit: the SVG we draw only carries numbers
+	data.QRCode = template.HTML(code.svg(4, 0))
+
+	return nil
+
+}
+
+// Enrol the given account with its pending secret once the given code shows the admin's app has
+// it, returning what's wrong otherwise
+func enrolTOTPAccount(account string, pending string, code string, data *totpPageData) string {
+
+	value, ok := verifySignedValue(pending)
+	fields := strings.SplitN(value, ":", 4)
+	if !ok || len(fields) != 4 || fields[0] != "totp" || fields[3] != account {
+		return "This enrolment isn't valid. Please start again."
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "This enrolment has expired. Please start again."
+	}
+	secret, err := totpSecretEncoding.DecodeString(fields[2])
+	if err != nil {
+		return "This enrolment isn't valid. Please start again."
+	}
+
+	step := matchTOTPCode(secret, strings.TrimSpace(code))
+	if step == 0 {
+		return "That code isn't valid. Check your app's clock and try the next one."
+	}
+
+	codes, hashes := newRecoveryCodes()
+
+	totpAccounts.mutex.Lock()
+	defer totpAccounts.mutex.Unlock()
+
+	if _, found := totpAccounts.accounts[account]; found {
+		return "This account is already enrolled."
+	}
+
+	totpAccounts.accounts[account] = &totpAccount{Secret: fields[2], RecoveryCodes: hashes, LastStep: step, Enrolled: time.Now().UTC()}
+	saveTOTPAccounts()
+
+	data.RecoveryCodes = codes
+	logger.Printf("AUDIT two-factor authentication turned on for admin account %q", account)
+
+	return ""
+
+}
@@ -0,0 +1,231 @@
+// Request tracing waterfall. Our tracing middleware records a timing breakdown (middleware
+// stages, handler time, template render time) for each request into a bounded in-memory store,
+// which admins can view at /debug/trace/{request-id}.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	TRACE_STORE_CAPACITY = 500 // The number of recent request traces we keep in memory
+	SPAN_IN_PROGRESS     = -1  // The duration of spans which haven't ended yet
+)
+
+// A single timed stage of a request. The start is relative to the start of the request.
+type traceSpan struct {
+	Name     string        `json:"name"`
+	Start    time.Duration `json:"start_ns"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// The timing breakdown of a single request
+type requestTrace struct {
+	mutex     sync.Mutex
+	RequestID string         `json:"request_id"`
+	Method    string         `json:"method"`
+	Path      string         `json:"path"`
+	Route     string         `json:"route,omitempty"` // The router pattern which handled the request
+	Status    int            `json:"status"`
+	Started   time.Time      `json:"started"`
+	Duration  time.Duration  `json:"duration_ns"`
+	Error     string         `json:"error,omitempty"`
+	Fields    []requestField `json:"fields,omitempty"` // The fields handlers attached (see tags.go)
+	Spans     []traceSpan    `json:"spans"`
+}
+
+// Start timing a new stage of our request. The returned function ends the stage. Spans are
+// recorded as they start (with a duration of SPAN_IN_PROGRESS until they end), so that our
+// Server-Timing headers can include the stages still running when the headers are written.
+func (trace *requestTrace) startSpan(name string) func() {
+
+	spanStart := time.Now()
+
+	trace.mutex.Lock()
+	index := len(trace.Spans)
+	trace.Spans = append(trace.Spans, traceSpan{
+		Name:     name,
+		Start:    spanStart.Sub(trace.Started),
+		Duration: SPAN_IN_PROGRESS,
+	})
+	trace.mutex.Unlock()
+
+	return func() {
+		trace.mutex.Lock()
+		defer trace.mutex.Unlock()
+
+		trace.Spans[index].Duration = time.Since(spanStart)
+	}
+
+}
+
+// Record the router pattern which handled the request with the given context
+func setTraceRoute(ctx context.Context, pattern string) {
+	if trace := traceFromContext(ctx); trace != nil {
+		trace.mutex.Lock()
+		trace.Route = pattern
+		trace.mutex.Unlock()
+	}
+}
+
+// Returns the trace for the request with the given context (or nil if it isn't being traced)
+func traceFromContext(ctx context.Context) *requestTrace {
+	trace, _ := ctx.Value(TRACE_KEY).(*requestTrace)
+	return trace
+}
+
+// Start timing a new stage of the request with the given context, i.e.
+//
+//	defer startSpan(r.Context(), "render")()
+func startSpan(ctx context.Context, name string) func() {
+	if trace := traceFromContext(ctx); trace != nil {
+		return trace.startSpan(name)
+	}
+	return func() {}
+}
+
+// Returns a handler which records the time spent in the given middleware stage (including
+// the time spent in the handlers it calls)
+func traceStage(name string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer startSpan(r.Context(), name)()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Our bounded store of recent request traces. Once full, the oldest trace is evicted.
+type traceStore struct {
+	mutex  sync.Mutex
+	order  []string
+	traces map[string]*requestTrace
+}
+
+var traces = &traceStore{traces: make(map[string]*requestTrace)}
+
+func (store *traceStore) add(trace *requestTrace) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	// Clients can supply their own request IDs, so we may see the same ID more than once
+	if _, exists := store.traces[trace.RequestID]; !exists {
+		store.order = append(store.order, trace.RequestID)
+	}
+	store.traces[trace.RequestID] = trace
+
+	if len(store.order) > TRACE_STORE_CAPACITY {
+		delete(store.traces, store.order[0])
+		store.order = store.order[1:]
+	}
+
+}
+
+func (store *traceStore) get(requestID string) *requestTrace {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.traces[requestID]
+}
+
+// The body content of our trace waterfall page. Each span is drawn as a bar offset and sized
+// relative to the total duration of the request.
+const TRACE_PAGE_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>Request {{ .RequestID }}</h2>
+		<p>{{ .Method }} {{ .Path }} &rarr; {{ .Status }} in {{ .Duration }}</p>
+		<table style="width: 100%; text-align: left; border-collapse: collapse;">
+			{{ range .Spans }}
+			<tr>
+				<td style="width: 25%; padding: 4px;">{{ .Name }}</td>
+				<td style="width: 15%; padding: 4px;">{{ .Duration }}</td>
+				<td style="padding: 4px;">
+					<div style="margin-left: {{ printf "%.2f" .Offset }}%; width: {{ printf "%.2f" .Width }}%; min-width: 2px; height: 12px; background: cornflowerblue;"></div>
+				</td>
+			</tr>
+			{{ end }}
+		</table>
+	</div>
+`
+
+// The data we pass into our trace page body template
+type tracePageData struct {
+	RequestID string
+	Method    string
+	Path      string
+	Status    int
+	Duration  time.Duration
+	Spans     []tracePageSpan
+}
+
+type tracePageSpan struct {
+	Name     string
+	Duration time.Duration
+	Offset   float64 // Percentage of the total request duration
+	Width    float64 // Percentage of the total request duration
+}
+
+// This is our trace waterfall handler. It displays the timing breakdown of a recent request as
+// an HTML page, or as JSON if the client asks for it.
+func traceHandler(w http.ResponseWriter, r *http.Request) {
+
+	trace := traces.get(r.PathValue("id"))
+
+	if trace == nil {
+		writeError(w, r, newAppError(http.StatusNotFound, "trace_not_found",
+			"No trace was found for that request ID. Only recent requests are kept."))
+		return
+	}
+
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+
+	if wantsJSON(r) {
+		setContentType(w, CONTENT_TYPE_JSON)
+		json.NewEncoder(w).Encode(trace)
+		return
+	}
+
+	data := tracePageData{
+		RequestID: trace.RequestID,
+		Method:    trace.Method,
+		Path:      trace.Path,
+		Status:    trace.Status,
+		Duration:  trace.Duration,
+	}
+
+	// Spans are recorded as they start, and nested spans can start at the same time, so we
+	// sort them to display the earliest starting (outermost) stages first
+	spans := append([]traceSpan(nil), trace.Spans...)
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].Start < spans[j].Start
+	})
+
+	for _, span := range spans {
+		pageSpan := tracePageSpan{Name: span.Name, Duration: span.Duration}
+		if trace.Duration > 0 {
+			pageSpan.Offset = 100 * float64(span.Start) / float64(trace.Duration)
+			pageSpan.Width = 100 * float64(span.Duration) / float64(trace.Duration)
+		}
+		data.Spans = append(data.Spans, pageSpan)
+	}
+
+	body, err := renderFragment(tracePageTemplate, data)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the trace page template"))
+		return
+	}
+
+	renderMainTemplate(w, r, "trace", HtmlData{
+		Title:       "Request Trace",
+		CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+		BodyContent: body,
+	})
+
+}
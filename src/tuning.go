@@ -0,0 +1,208 @@
+// Runtime tuning for containers. Inside a container with CPU and memory limits, the Go runtime
+// needs to know about them to behave: GOMAXPROCS should follow our CPU quota rather than the
+// host's CPUs (or we're throttled), and a soft memory limit (GOMEMLIMIT) a little below our
+// memory limit makes the garbage collector work harder as we near it, rather than letting us be
+// killed for running out.
+//
+// Go has set GOMAXPROCS from the CPU quota by itself since Go 1.25, so -gomaxprocs only
+// overrides it; we read the quota from our cgroup too, so that /status can show it. GOGC and
+// GOMEMLIMIT can be set through the environment as usual or through our -gogc and -gomemlimit
+// flags (which win), and -gomemlimit=auto (the default) sets the soft memory limit to
+// CONTAINER_MEMORY_FRACTION of our cgroup's memory limit, unless GOMEMLIMIT is set.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// How much of our container's memory limit we set our soft memory limit to, leaving the rest
+// for memory the garbage collector doesn't manage (i.e. goroutine stacks and the OS)
+const CONTAINER_MEMORY_FRACTION = 0.9
+
+// Where cgroups v2 and v1 keep our limits
+const (
+	CGROUP_CPU_MAX       = "/sys/fs/cgroup/cpu.max"
+	CGROUP_MEMORY_MAX    = "/sys/fs/cgroup/memory.max"
+	CGROUP_V1_CPU_QUOTA  = "/sys/fs/cgroup/cpu/cpu.cfs_quota_us"
+	CGROUP_V1_CPU_PERIOD = "/sys/fs/cgroup/cpu/cpu.cfs_period_us"
+	CGROUP_V1_MEMORY_MAX = "/sys/fs/cgroup/memory/memory.limit_in_bytes"
+)
+
+// The limits we found and the settings we ended up with, for /status
+type runtimeTuningStatus struct {
+	GOMAXPROCS      int     `json:"gomaxprocs"`
+	NumCPU          int     `json:"num_cpu"`
+	CPUQuota        float64 `json:"cpu_quota,omitempty"` // In CPUs, if we have one
+	GOGC            string  `json:"gogc"`
+	MemoryLimit     int64   `json:"memory_limit,omitempty"` // Our soft memory limit, if we have one
+	ContainerMemory int64   `json:"container_memory,omitempty"`
+}
+
+// What we found and set at startup
+var runtimeTuning runtimeTuningStatus
+
+// Apply our -gomaxprocs, -gogc and -gomemlimit flags along with our container's limits, and log
+// what we ended up with
+func applyRuntimeTuning(maxProcs int, gcPercent string, memoryLimit string) error {
+
+	runtimeTuning.NumCPU = runtime.NumCPU()
+	runtimeTuning.CPUQuota, _ = cgroupCPUQuota()
+	runtimeTuning.ContainerMemory, _ = cgroupMemoryLimit()
+
+	if maxProcs < 0 {
+		return errors.New("-gomaxprocs can't be negative")
+	}
+	if maxProcs > 0 {
+		runtime.GOMAXPROCS(maxProcs)
+	}
+
+	runtimeTuning.GOGC = flagOrEnv(gcPercent, "GOGC", "100")
+	switch gcPercent {
+	case "":
+	case "off":
+		debug.SetGCPercent(-1)
+	default:
+		percent, err := strconv.Atoi(gcPercent)
+		if err != nil || percent < 0 {
+			return fmt.Errorf("-gogc must be off or a percentage, not %q", gcPercent)
+		}
+		debug.SetGCPercent(percent)
+	}
+
+	switch {
+	case memoryLimit == "auto" && os.Getenv("GOMEMLIMIT") == "":
+		if runtimeTuning.ContainerMemory > 0 {
+			debug.SetMemoryLimit(int64(float64(runtimeTuning.ContainerMemory) * CONTAINER_MEMORY_FRACTION))
+		}
+	case memoryLimit == "auto", memoryLimit == "":
+	default:
+		limit, err := parseMemoryLimit(memoryLimit)
+		if err != nil {
+			return err
+		}
+		debug.SetMemoryLimit(limit)
+	}
+
+	status := currentRuntimeTuning()
+	summary := fmt.Sprintf("GOMAXPROCS=%d (of %d CPUs", status.GOMAXPROCS, status.NumCPU)
+	if status.CPUQuota > 0 {
+		summary += fmt.Sprintf(", with a quota of %g", status.CPUQuota)
+	}
+	summary += ") GOGC=" + status.GOGC
+	if status.MemoryLimit > 0 {
+		summary += " GOMEMLIMIT=" + formatFileSize(status.MemoryLimit)
+	}
+	if status.ContainerMemory > 0 {
+		summary += " (container memory " + formatFileSize(status.ContainerMemory) + ")"
+	}
+	logger.Println("Runtime settings:", summary)
+
+	return nil
+
+}
+
+// Returns our runtime settings as they are now
+func currentRuntimeTuning() runtimeTuningStatus {
+
+	status := runtimeTuning
+	status.GOMAXPROCS = runtime.GOMAXPROCS(0)
+
+	// A negative limit leaves the limit as it is (and math.MaxInt64 means we don't have one)
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		status.MemoryLimit = limit
+	}
+
+	return status
+
+}
+
+// Returns the flag's value, or failing that the environment variable's, or failing that the
+// runtime's default
+func flagOrEnv(value string, variable string, fallback string) string {
+	if value != "" {
+		return value
+	}
+	if value := os.Getenv(variable); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Parse a memory limit in the form GOMEMLIMIT takes: a number of bytes with an optional unit
+// (B, KiB, MiB, GiB or TiB), i.e. 512MiB
+func parseMemoryLimit(value string) (int64, error) {
+
+	number, multiplier := value, int64(1)
+	for i, unit := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		if trimmed, found := strings.CutSuffix(value, unit); found {
+			number, multiplier = trimmed, int64(1)<<(10*(i+1))
+			break
+		}
+	}
+	number = strings.TrimSuffix(number, "B")
+
+	limit, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || limit <= 0 || limit > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("-gomemlimit must be auto or a size like 512MiB, not %q", value)
+	}
+
+	return limit * multiplier, nil
+
+}
+
+// Returns our cgroup's CPU quota in CPUs (i.e. 1.5), if we have one
+func cgroupCPUQuota() (float64, bool) {
+
+	// cgroups v2 gives "max 100000" without a quota, or the quota and period in microseconds
+	if fields := strings.Fields(readCgroupFile(CGROUP_CPU_MAX)); len(fields) == 2 {
+		quota, quotaErr := strconv.ParseFloat(fields[0], 64)
+		period, periodErr := strconv.ParseFloat(fields[1], 64)
+		if quotaErr == nil && periodErr == nil && quota > 0 && period > 0 {
+			return quota / period, true
+		}
+		return 0, false
+	}
+
+	// cgroups v1 gives a quota of -1 without one
+	quota, quotaErr := strconv.ParseFloat(readCgroupFile(CGROUP_V1_CPU_QUOTA), 64)
+	period, periodErr := strconv.ParseFloat(readCgroupFile(CGROUP_V1_CPU_PERIOD), 64)
+	if quotaErr == nil && periodErr == nil && quota > 0 && period > 0 {
+		return quota / period, true
+	}
+
+	return 0, false
+
+}
+
+// Returns our cgroup's memory limit in bytes, if we have one
+func cgroupMemoryLimit() (int64, bool) {
+
+	for _, path := range []string{CGROUP_MEMORY_MAX, CGROUP_V1_MEMORY_MAX} {
+		// Without a limit, v2 gives "max" and v1 a huge number (which is rounded down to a
+		// page from math.MaxInt64)
+		limit, err := strconv.ParseInt(readCgroupFile(path), 10, 64)
+		if err == nil && limit > 0 && limit < 1<<62 {
+			return limit, true
+		}
+	}
+
+	return 0, false
+
+}
+
+// Returns the trimmed contents of a cgroup file ("" if we can't read it, i.e. outside Linux)
+func readCgroupFile(path string) string {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(contents))
+}
@@ -0,0 +1,574 @@
+// File uploads. Multipart uploads are streamed part by part directly to disk (never buffered
+// in memory) while we compute their SHA-256 digest, so that clients can supply the digest they
+// expect and have corrupted or truncated uploads rejected.
+//
+// Upload forms are Forms (see forms.go), so uploads must carry a CSRF token (unless they can't
+// have been forged, see csrfExempt). As we stream the body rather than parse it up front, the
+// token has to be sent before the files (our forms put it first), and is checked as the first
+// file part arrives.
+//
+// Each client can only upload so often, and given -max-upload-dir-size, uploads which would take
+// the upload directory past it are refused with a 507.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long an upload request may take to be read
+const UPLOAD_READ_TIMEOUT = 10 * time.Minute
+
+// The most files we'll put in a single ZIP download
+const MAX_DOWNLOAD_ALL_FILES = 1000
+
+const (
+	UPLOAD_RATE_LIMIT = 10 // How many uploads a client may make per minute
+	UPLOAD_RATE_BURST = 10
+)
+
+// The rate limiter for uploads
+var uploadRateLimiter = newRateLimiter("upload", UPLOAD_RATE_LIMIT, UPLOAD_RATE_BURST)
+
+// Held while uploads are moved into place, so that concurrent uploads can't together take our
+// upload directory past its size limit
+var uploadPlacementMutex sync.Mutex
+
+// An uploaded file
+type uploadedFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Modified time.Time `json:"modified,omitzero"`
+	ShareURL string    `json:"share_url,omitempty"` // A signed link to the file, for admins (see sharedlinks.go)
+}
+
+// A file part which has been streamed to a temporary file but not yet verified
+type pendingUpload struct {
+	uploadedFile
+	tempPath string
+}
+
+func init() {
+	registerPage(Page{
+		Title:   "File Upload",
+		Path:    "/upload",
+		Order:   50,
+		Visible: true,
+		Section: SECTION_UTILITIES,
+		Handler: uploadHandler,
+		Methods: []string{http.MethodGet, http.MethodPost},
+	})
+}
+
+// This is our upload handler. GET requests display our upload form, while POST requests
+// receive the uploaded files, sending browsers back to our form with a flash listing them (see
+// flash.go).
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Our token (and the cookie behind it) must be set before we write anything
+	form := newForm(w, r)
+
+	if r.Method != http.MethodPost {
+		renderUploadPage(w, r, form, http.StatusOK)
+		return
+	}
+
+	uploadedFiles, err := receiveUpload(w, r, form)
+
+	// Problems with what was uploaded are shown beside our form
+	var appError *AppError
+	if err != nil && !wantsJSON(r) && errors.As(err, &appError) && appError.Status < http.StatusInternalServerError {
+		form.AddProblem(FORM_FILE_FIELD, "%s", appError.Message)
+		renderUploadPage(w, r, form, appError.Status)
+		return
+	}
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if wantsJSON(r) {
+		setContentType(w, CONTENT_TYPE_JSON)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"files": uploadedFiles})
+		return
+	}
+
+	// Redirecting means a refresh of the page doesn't upload the files again. Only so many
+	// flashes are kept, so larger uploads are summed up in one.
+	if len(uploadedFiles) > MAX_FLASHES {
+		addFlash(w, r, FLASH_SUCCESS, "Uploaded %d files.", len(uploadedFiles))
+	} else {
+		for _, file := range uploadedFiles {
+			addFlash(w, r, FLASH_SUCCESS, "Uploaded %s (%d bytes, SHA-256 %s)", file.Name, file.Size, file.SHA256)
+		}
+	}
+	http.Redirect(w, r, urlFor("/upload"), http.StatusSeeOther)
+
+}
+
+// Stream the files of a multipart upload into our upload directory. Expected digests can be
+// supplied via the X-Expected-Sha256 header (for single file uploads) or via sha256 form
+// fields, where the n-th sha256 field is the digest of the n-th file. All of the files are
+// rejected if any of them fail verification. Uploads must pass the CSRF check of the given form
+// ahead of their files.
+func receiveUpload(w http.ResponseWriter, r *http.Request, form *Form) ([]uploadedFile, error) {
+
+	if wait := uploadRateLimiter.reserve(clientAddress(r)); wait > 0 {
+		incrementCounter("uploads_rejected_total", "reason", "rate_limited")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return nil, newAppError(http.StatusTooManyRequests, "rate_limited",
+			"You're uploading files too quickly. Please wait a moment and try again.")
+	}
+
+	// Large uploads take longer than our server's global read timeout
+	extendReadDeadline(w, r, UPLOAD_READ_TIMEOUT)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+	multipartReader, err := r.MultipartReader()
+
+	if err != nil {
+		return nil, badRequestError("Uploads must be sent as multipart/form-data.").Wrap(err)
+	}
+
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		return nil, internalError(err).WithDetail("creating the upload directory %s", uploadDir)
+	}
+
+	var pending []pendingUpload
+	var expectedDigests []string
+
+	// Our form's checks read its fields as they arrive
+	form.streamed = url.Values{}
+
+	// Make sure we never leave temporary files behind, whatever happens
+	defer func() {
+		for _, upload := range pending {
+			os.Remove(upload.tempPath)
+		}
+	}()
+
+	if digest := r.Header.Get("X-Expected-Sha256"); digest != "" {
+		expectedDigests = append(expectedDigests, digest)
+	}
+
+	for {
+		part, err := multipartReader.NextPart()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, uploadReadError(err)
+		}
+
+		// Regular form fields carry the digests we expect (and our CSRF token)
+		if part.FileName() == "" {
+			switch part.FormName() {
+			case "sha256":
+				value, err := io.ReadAll(io.LimitReader(part, 128))
+				if err != nil {
+					return nil, uploadReadError(err)
+				}
+				expectedDigests = append(expectedDigests, strings.TrimSpace(string(value)))
+			case CSRF_FIELD_NAME:
+				value, err := io.ReadAll(io.LimitReader(part, 256))
+				if err != nil {
+					return nil, uploadReadError(err)
+				}
+				form.streamed.Set(CSRF_FIELD_NAME, string(value))
+			}
+			continue
+		}
+
+		// We don't write a thing to disk for a forged upload
+		if len(pending) == 0 {
+			if err := form.CheckCSRF(r); err != nil {
+				incrementCounter("uploads_rejected_total", "reason", "csrf")
+				return nil, err
+			}
+		}
+
+		upload, err := streamPartToDisk(part, part.FileName())
+
+		if upload.tempPath != "" {
+			pending = append(pending, upload)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(pending) == 0 {
+		return nil, badRequestError("No files were uploaded.")
+	}
+
+	// Verify our files against the digests the client expected
+	for i, upload := range pending {
+		if i < len(expectedDigests) && expectedDigests[i] != "" &&
+			!strings.EqualFold(expectedDigests[i], upload.SHA256) {
+			incrementCounter("uploads_rejected_total", "reason", "checksum")
+			return nil, newAppError(http.StatusUnprocessableEntity, "checksum_mismatch",
+				fmt.Sprintf("The SHA-256 digest of %s doesn't match the expected digest.", upload.Name)).
+				WithDetail("expected %s, received %s", expectedDigests[i], upload.SHA256)
+		}
+	}
+
+	// Everything checks out, so we move our files into place if there's room for them
+	uploadPlacementMutex.Lock()
+	defer uploadPlacementMutex.Unlock()
+
+	if err := checkUploadRoom(pending); err != nil {
+		return nil, err
+	}
+
+	var uploadedFiles []uploadedFile
+
+	for i, upload := range pending {
+		finalPath, err := moveUploadIntoPlace(upload.tempPath, upload.Name)
+
+		if err != nil {
+			return nil, internalError(err).WithDetail("moving %s into place", upload.Name)
+		}
+
+		pending[i].tempPath = ""
+		upload.Name = filepath.Base(finalPath)
+		uploadedFiles = append(uploadedFiles, upload.uploadedFile)
+
+		incrementCounter("uploads_total")
+		addCounter("upload_bytes_total", float64(upload.Size))
+	}
+
+	totalSize := int64(0)
+	for _, file := range uploadedFiles {
+		totalSize += file.Size
+	}
+	addLogField(r.Context(), "upload_files", len(uploadedFiles))
+	addLogField(r.Context(), "upload_bytes", totalSize)
+
+	return uploadedFiles, nil
+
+}
+
+// Stream a single file part to a temporary file within our upload directory, computing its
+// digest as we go
+func streamPartToDisk(part io.Reader, fileName string) (pendingUpload, error) {
+
+	upload := pendingUpload{}
+	upload.Name = sanitiseFileName(fileName)
+
+	if upload.Name == "" {
+		return upload, badRequestError(fmt.Sprintf("%q is not a valid file name.", fileName))
+	}
+
+	tempFile, err := os.CreateTemp(uploadDir, ".upload-*")
+
+	if err != nil {
+		return upload, internalError(err).WithDetail("creating a temporary upload file")
+	}
+	defer tempFile.Close()
+
+	upload.tempPath = tempFile.Name()
+
+	hash := sha256.New()
+	upload.Size, err = io.Copy(io.MultiWriter(tempFile, hash), part)
+
+	if err != nil {
+		return upload, uploadReadError(err)
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return upload, internalError(err).WithDetail("writing %s", upload.Name)
+	}
+
+	upload.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	return upload, nil
+
+}
+
+// Turn an error encountered while reading an upload into the error we report to the client
+func uploadReadError(err error) error {
+
+	var maxBytesError *http.MaxBytesError
+
+	if errors.As(err, &maxBytesError) {
+		incrementCounter("uploads_rejected_total", "reason", "too_large")
+		return newAppError(http.StatusRequestEntityTooLarge, "upload_too_large",
+			fmt.Sprintf("Uploads are limited to %d bytes.", maxUploadSize)).Wrap(err)
+	}
+
+	incrementCounter("uploads_rejected_total", "reason", "truncated")
+	return badRequestError("The upload was incomplete or malformed.").Wrap(err)
+
+}
+
+// Strip any directories from an uploaded file name and reject names we can't store safely
+func sanitiseFileName(fileName string) string {
+
+	name := filepath.Base(filepath.Clean("/" + strings.ReplaceAll(fileName, "\\", "/")))
+
+	if name == "/" || name == "." || strings.HasPrefix(name, ".") {
+		return ""
+	}
+
+	return name
+
+}
+
+// Returns an error when the given uploads would take our upload directory past
+// -max-upload-dir-size
+func checkUploadRoom(pending []pendingUpload) error {
+
+	if maxUploadDirSize <= 0 {
+		return nil
+	}
+
+	files, err := listUploads()
+	if err != nil {
+		return internalError(err).WithDetail("listing the upload directory")
+	}
+
+	used := int64(0)
+	for _, file := range files {
+		used += file.Size
+	}
+	for _, upload := range pending {
+		used += upload.Size
+	}
+
+	if used > maxUploadDirSize {
+		incrementCounter("uploads_rejected_total", "reason", "storage_full")
+		return newAppError(http.StatusInsufficientStorage, "upload_storage_full",
+			"There's no room left for uploads.").WithDetail("the upload directory would hold %d bytes", used)
+	}
+
+	return nil
+
+}
+
+// Move the given temporary file into our upload directory under the given file name, adding a
+// numeric suffix if the name is taken (i.e. photo.png becomes photo-1.png), and return its path.
+// Each name is reserved by creating it exclusively, so that two uploads never get the same one.
+func moveUploadIntoPlace(tempPath string, name string) (string, error) {
+
+	extension := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, extension)
+
+	candidate := filepath.Join(uploadDir, name)
+	for i := 1; ; i++ {
+		reserved, err := os.OpenFile(candidate, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			reserved.Close()
+			if err := os.Rename(tempPath, candidate); err != nil {
+				os.Remove(candidate)
+				return "", err
+			}
+			return candidate, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+		candidate = filepath.Join(uploadDir, fmt.Sprintf("%s-%d%s", stem, i, extension))
+	}
+
+}
+
+// Returns the files in our upload directory, most recently modified first
+func listUploads() ([]uploadedFile, error) {
+
+	entries, err := os.ReadDir(uploadDir)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var files []uploadedFile
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, uploadedFile{Name: entry.Name(), Size: info.Size(), Modified: info.ModTime()})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Modified.After(files[j].Modified)
+	})
+
+	return files, nil
+
+}
+
+// This is our upload body template. Admins also see the files in our upload directory.
+const UPLOAD_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>File Upload</h2>
+		<form action="{{ url "/upload" }}" method="POST" enctype="multipart/form-data">
+			<input type="hidden" name="csrf_token" value="{{ .Form.CSRFToken }}">
+			<input type="file" name="file" multiple>
+			{{ with .Form.Problem "file" }}<p><small>{{ . }}</small></p>{{ end }}
+			<br>
+			<input type="text" name="sha256" placeholder="Expected SHA-256 (optional)">
+			<br>
+			<input type="submit" value="Upload">
+		</form>
+		{{ if .IsAdmin }}
+		<h4>Uploaded files</h4>
+		<form action="{{ url "/files/download-all" }}" method="GET">
+			{{ range .Files }}
+			<p><input type="checkbox" name="name" value="{{ .Name }}"> <a href="{{ url "/uploads/" }}{{ .Name }}">{{ .Name }}</a> ({{ .Size }} bytes, <a href="{{ .ShareURL }}">share link</a>)</p>
+			{{ else }}
+			<p>No files have been uploaded yet.</p>
+			{{ end }}
+			{{ if .Files }}<input type="submit" value="Download as ZIP"> <small>(every file if none are selected)</small>{{ end }}
+		</form>
+		{{ end }}
+	</div>
+`
+
+// The data we pass into our upload body template
+type uploadPageData struct {
+	Form    *Form
+	Files   []uploadedFile
+	IsAdmin bool
+}
+
+// Render our upload page with the given status
+func renderUploadPage(w http.ResponseWriter, r *http.Request, form *Form, status int) {
+
+	data := uploadPageData{Form: form, IsAdmin: isAdminRequest(r)}
+
+	if data.IsAdmin {
+		files, err := listUploads()
+		if err != nil {
+			writeError(w, r, internalError(err).WithDetail("listing the upload directory"))
+			return
+		}
+		for i := range files {
+			files[i].ShareURL, _ = signedUploadURL(files[i].Name, shareLifetime)
+		}
+		data.Files = files
+	}
+
+	body, err := renderFragment(uploadBodyTemplate, data)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the upload body template"))
+		return
+	}
+
+	renderMainTemplate(w, r, "upload", HtmlData{
+		Title:       "Golang File Upload",
+		Description: "Simple golang streaming file upload with checksum verification.",
+		Keywords:    "golang web server file upload sha256",
+		CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+		BodyContent: body,
+		Status:      status,
+	})
+
+}
+
+// This is our uploaded file handler. Uploaded files are private, so only admins can download
+// them (see adminOnly). They're always sent as attachments, as an uploaded HTML or SVG file shown
+// inline would run its scripts as our own.
+func uploadedFileHandler(w http.ResponseWriter, r *http.Request) {
+
+	name := sanitiseFileName(r.PathValue("name"))
+
+	if name == "" {
+		writeError(w, r, notFoundError())
+		return
+	}
+
+	extendWriteDeadline(w, r, DOWNLOAD_WRITE_TIMEOUT)
+	serveFile(w, r, filepath.Join(uploadDir, name), name)
+
+}
+
+// This is our download all handler, which streams a ZIP archive of the uploaded files given by
+// its name parameters (i.e. /files/download-all?name=a.txt&name=b.csv), or of every uploaded
+// file if none are given. Like the uploaded files themselves, it's for admins only.
+func downloadAllHandler(w http.ResponseWriter, r *http.Request) {
+
+	var names []string
+
+	if selected := r.URL.Query()["name"]; len(selected) > 0 {
+		for _, name := range selected {
+			if sanitiseFileName(name) != name {
+				writeError(w, r, badRequestError(fmt.Sprintf("%q isn't the name of an uploaded file.", name)))
+				return
+			}
+			if _, err := os.Stat(filepath.Join(uploadDir, name)); err != nil {
+				writeError(w, r, newAppError(http.StatusNotFound, "not_found", fmt.Sprintf("%s hasn't been uploaded.", name)).Wrap(err))
+				return
+			}
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	} else {
+		files, err := listUploads()
+		if err != nil {
+			writeError(w, r, internalError(err).WithDetail("listing the upload directory"))
+			return
+		}
+		for _, file := range files {
+			names = append(names, file.Name)
+		}
+	}
+
+	if len(names) == 0 {
+		writeError(w, r, newAppError(http.StatusNotFound, "not_found", "No files have been uploaded yet."))
+		return
+	}
+
+	if len(names) > MAX_DOWNLOAD_ALL_FILES {
+		writeError(w, r, badRequestError(fmt.Sprintf("At most %d files can be downloaded at once.", MAX_DOWNLOAD_ALL_FILES)))
+		return
+	}
+
+	stream := newZipStream(w, r, "uploads.zip")
+
+	for _, name := range names {
+		if err := stream.addFile(name, filepath.Join(uploadDir, name)); err != nil {
+			stream.abort(err)
+		}
+	}
+
+	if err := stream.close(); err != nil {
+		stream.abort(err)
+	}
+
+	incrementCounter("zip_downloads_total")
+
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Returns a multipart body holding a single file with the given contents, along with its
+// content type
+func multipartUpload(t *testing.T, contents []byte) ([]byte, string) {
+
+	t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	part, err := writer.CreateFormFile("file", "upload.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(contents)
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return body.Bytes(), writer.FormDataContentType()
+
+}
+
+func TestUploadHandlerRejectsOversizedAndTruncatedUploads(t *testing.T) {
+
+	defer func(dir string, size int64) { uploadDir, maxUploadSize = dir, size }(uploadDir, maxUploadSize)
+	maxUploadSize = 1 << 10
+
+	small, smallType := multipartUpload(t, []byte("hello"))
+	large, largeType := multipartUpload(t, bytes.Repeat([]byte("x"), 4<<10))
+	whole, wholeType := multipartUpload(t, bytes.Repeat([]byte("y"), 512))
+
+	tests := []struct {
+		name        string
+		body        []byte
+		contentType string
+		status      int
+		code        string // The error code of the response ("" for none)
+	}{
+		{"accepted", small, smallType, http.StatusCreated, ""},
+		{"over the size limit", large, largeType, http.StatusRequestEntityTooLarge, "upload_too_large"},
+		{"cut off within the file", whole[:len(whole)/2], wholeType, http.StatusBadRequest, "bad_request"},
+		{"cut off before the closing boundary", whole[:len(whole)-10], wholeType, http.StatusBadRequest, "bad_request"},
+		{"not multipart", []byte("hello"), "text/plain", http.StatusBadRequest, "bad_request"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			uploadDir = t.TempDir()
+
+			r := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(test.body))
+			r.Header.Set("Content-Type", test.contentType)
+			r.Header.Set("Accept", "application/json")
+			r.Header.Set(CSRF_SCRIPT_HEADER, "test")
+			w := httptest.NewRecorder()
+
+			uploadHandler(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("got status %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+			if test.code != "" && !strings.Contains(w.Body.String(), `"code":"`+test.code+`"`) {
+				t.Errorf("got %s, want the error code %q", w.Body, test.code)
+			}
+
+			// Rejected uploads never leave files (or temporary files) behind
+			entries, err := os.ReadDir(uploadDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := 0
+			if test.status == http.StatusCreated {
+				want = 1
+			}
+			if len(entries) != want {
+				t.Errorf("got %d files in the upload directory, want %d", len(entries), want)
+			}
+
+		})
+	}
+
+}
+
+func TestUploadedFileHandlerSendsAttachments(t *testing.T) {
+
+	defer func(dir string) { uploadDir = dir }(uploadDir)
+	uploadDir = t.TempDir()
+
+	if err := os.WriteFile(uploadDir+"/page.html", []byte("<script>alert(1)</script>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/uploads/page.html", nil)
+	r.SetPathValue("name", "page.html")
+	w := httptest.NewRecorder()
+
+	uploadedFileHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if disposition := w.Header().Get("Content-Disposition"); disposition != "attachment; filename=page.html" {
+		t.Errorf("got Content-Disposition %q, want an attachment", disposition)
+	}
+
+}
+
+// Post the given multipart upload from the given client address
+func postUpload(t *testing.T, body []byte, contentType string, client string) *httptest.ResponseRecorder {
+
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(body))
+	r.RemoteAddr = client
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set(CSRF_SCRIPT_HEADER, "test")
+	w := httptest.NewRecorder()
+
+	uploadHandler(w, r)
+
+	return w
+
+}
+
+func TestUploadHandlerLimitsUploads(t *testing.T) {
+
+	defer func(dir string, size int64, dirSize int64) {
+		uploadDir, maxUploadSize, maxUploadDirSize = dir, size, dirSize
+	}(uploadDir, maxUploadSize, maxUploadDirSize)
+	uploadDir, maxUploadSize, maxUploadDirSize = t.TempDir(), 1<<10, 10
+
+	body, contentType := multipartUpload(t, []byte("hello"))
+
+	// Uploads of the same name are kept apart, until the directory is full
+	for i, want := range []int{http.StatusCreated, http.StatusCreated, http.StatusInsufficientStorage} {
+		if w := postUpload(t, body, contentType, "198.51.100.1:1234"); w.Code != want {
+			t.Fatalf("upload %d: got status %d, want %d: %s", i+1, w.Code, want, w.Body)
+		}
+	}
+
+	for _, name := range []string{"upload.txt", "upload-1.txt"} {
+		if _, err := os.Stat(uploadDir + "/" + name); err != nil {
+			t.Errorf("%s wasn't uploaded: %v", name, err)
+		}
+	}
+
+	// Each client can only upload so often
+	maxUploadDirSize = 0
+	for i := range UPLOAD_RATE_BURST {
+		if w := postUpload(t, body, contentType, "198.51.100.2:1234"); w.Code != http.StatusCreated {
+			t.Fatalf("upload %d: got status %d, want %d: %s", i+1, w.Code, http.StatusCreated, w.Body)
+		}
+	}
+	if w := postUpload(t, body, contentType, "198.51.100.2:1234"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d, want %d: %s", w.Code, http.StatusTooManyRequests, w.Body)
+	}
+
+}
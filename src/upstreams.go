@@ -0,0 +1,322 @@
+// Upstream health for our proxy mode. The -proxy flag takes one or more upstream origins (i.e.
+// -proxy http://10.0.0.1:3000,http://10.0.0.2:3000) which requests are spread across, and we
+// keep track of the health of each of them (and of our canary, see canary.go):
+//
+//   - Active checks: every -proxy-health-interval we GET -proxy-health-path from each upstream,
+//     and any response other than a 2xx or 3xx (or no response at all) counts as a failure.
+//   - Passive checks: proxied requests which fail to reach an upstream, or which it answers
+//     with a 502, 503 or 504, count as failures too.
+//
+// An upstream with PROXY_UNHEALTHY_THRESHOLD failures in a row is taken out of rotation until
+// PROXY_HEALTHY_THRESHOLD active checks in a row succeed (or, with active checks disabled, until
+// a request sent its way after PROXY_RETRY_INTERVAL succeeds). Requests for an unhealthy canary
+// go to our main upstreams, and when every main upstream is unhealthy we keep trying them all
+// rather than turning every visitor away. The state of our upstreams is shown on /status, and
+// /readyz only reports us as ready while at least one main upstream is healthy.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PROXY_UNHEALTHY_THRESHOLD     = 3                // Consecutive failures before an upstream is taken out of rotation
+	PROXY_HEALTHY_THRESHOLD       = 2                // Consecutive successful active checks before it's put back
+	PROXY_RETRY_INTERVAL          = 30 * time.Second // How long an unhealthy upstream is avoided without active checks
+	PROXY_HEALTH_CHECK_TIMEOUT    = 2 * time.Second
+	DEFAULT_PROXY_HEALTH_PATH     = "/"
+	DEFAULT_PROXY_HEALTH_INTERVAL = 10 * time.Second
+)
+
+// An upstream origin we proxy to, along with its health
+type proxyTarget struct {
+	name   string // How the target is known in our metrics and cache (i.e. primary or canary)
+	url    *url.URL
+	id     string       // How the target is known in our sticky session cookie (see loadbalancer.go)
+	active atomic.Int64 // The number of requests in flight to the target
+
+	mutex     sync.Mutex
+	healthy   bool
+	failures  int       // Consecutive failures
+	successes int       // Consecutive successful active checks (while unhealthy)
+	downSince time.Time // When the target was taken out of rotation
+	tripped   bool      // Whether an admin took the target out of rotation, until they reset it
+	lastCheck time.Time // When the target was last actively checked
+	lastError string    // Why the target last failed
+}
+
+// Create a new (healthy) proxy target for the given upstream origin (i.e. http://localhost:3000)
+func newProxyTarget(name, upstream string) (*proxyTarget, error) {
+
+	upstreamURL, err := url.Parse(upstream)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https" || upstreamURL.Host == "" {
+		return nil, fmt.Errorf("the upstream %q must be an absolute http:// or https:// URL", upstream)
+	}
+
+	target := &proxyTarget{name: name, url: upstreamURL, id: proxyTargetID(upstreamURL.String()), healthy: true}
+	target.setHealthGauge()
+
+	return target, nil
+
+}
+
+// Returns whether requests should be sent to our target. Without active checks, an unhealthy
+// target is given another chance every PROXY_RETRY_INTERVAL.
+func (target *proxyTarget) available() bool {
+
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	return target.healthy || !target.tripped && proxyHealthInterval <= 0 && time.Since(target.downSince) >= PROXY_RETRY_INTERVAL
+
+}
+
+// Record a failed request to (or health check of) our target
+func (target *proxyTarget) recordFailure(reason string) {
+
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	target.failures++
+	target.successes = 0
+	target.lastError = reason
+
+	// Without active checks, a failed retry starts a new retry interval
+	if !target.healthy {
+		target.downSince = time.Now()
+	}
+
+	if target.healthy && target.failures >= PROXY_UNHEALTHY_THRESHOLD {
+		target.healthy = false
+		target.downSince = time.Now()
+		incrementCounter("proxy_upstream_ejections_total", "upstream", target.name, "host", target.url.Host)
+		logger.Printf("AUDIT proxy upstream %s (%s) is unhealthy after %d failures: %s", target.url.Host, target.name, target.failures, reason)
+		target.setHealthGauge()
+	}
+
+}
+
+// Record a successful request to our target. Unhealthy targets are only put back into rotation
+// by our active checks when they're enabled.
+func (target *proxyTarget) recordSuccess() {
+
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	target.failures = 0
+
+	if !target.healthy && !target.tripped && proxyHealthInterval <= 0 {
+		target.markHealthy()
+	}
+
+}
+
+// Record the result of an active health check of our target
+func (target *proxyTarget) recordCheck(err error) {
+
+	target.mutex.Lock()
+	target.lastCheck = time.Now()
+	target.mutex.Unlock()
+
+	if err != nil {
+		target.recordFailure(err.Error())
+		return
+	}
+
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	target.failures = 0
+	target.successes++
+
+	if !target.healthy && !target.tripped && target.successes >= PROXY_HEALTHY_THRESHOLD {
+		target.markHealthy()
+	}
+
+}
+
+// Put our target back into rotation. The caller must hold our target's mutex.
+func (target *proxyTarget) markHealthy() {
+	target.healthy = true
+	target.successes = 0
+	logger.Printf("AUDIT proxy upstream %s (%s) is healthy again", target.url.Host, target.name)
+	target.setHealthGauge()
+}
+
+func (target *proxyTarget) setHealthGauge() {
+	setGauge("proxy_upstream_healthy", map[bool]float64{false: 0, true: 1}[target.healthy],
+		"upstream", target.name, "host", target.url.Host)
+}
+
+// Record the outcome of a proxied request, given the status the upstream responded with
+func (target *proxyTarget) recordResponse(status int) {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		target.recordFailure(fmt.Sprintf("responded with %d %s", status, http.StatusText(status)))
+	default:
+		target.recordSuccess()
+	}
+}
+
+// Check the health of our target
+func (target *proxyTarget) check(client *http.Client, path string) error {
+
+	response, err := client.Get(target.url.JoinPath(path).String())
+
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode >= 400 {
+		return fmt.Errorf("the health check responded with %s", response.Status)
+	}
+
+	return nil
+
+}
+
+// Returns a component which actively checks the health of the given targets every interval
+// (see components.go). The targets are checked at the same time, so that a slow one doesn't hold
+// up the others.
+func newHealthChecker(targets []*proxyTarget, interval time.Duration, path string) Component {
+
+	client := &http.Client{
+		Timeout: PROXY_HEALTH_CHECK_TIMEOUT,
+		// A redirect is a healthy response in itself
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	return newTickerComponent(interval, func(time.Time) {
+		var wait sync.WaitGroup
+		for _, target := range targets {
+			wait.Go(func() {
+				target.recordCheck(target.check(client, path))
+			})
+		}
+		wait.Wait()
+	})
+
+}
+
+// Returns whether our server is ready for traffic: it isn't shutting down, it has warmed up (see
+// warmup.go) and, in proxy mode, at least one of our main upstreams is healthy
+func serverReady(proxy *cachingProxy) bool {
+	return atomic.LoadInt32(&healthy) == 1 && atomic.LoadInt32(&warmedUp) == 1 &&
+		(proxy == nil || proxy.primaries.healthy())
+}
+
+// Returns our readiness handler (the proxy is nil when we're not in proxy mode). Unlike /health
+// (which only says whether the server is up), /readyz says whether we can serve requests.
+func readinessHandler(proxy *cachingProxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		setContentType(w, CONTENT_TYPE_TEXT)
+		w.Header().Set("Cache-Control", "no-store")
+
+		if !serverReady(proxy) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "not ready")
+			return
+		}
+
+		fmt.Fprintln(w, "ready")
+
+	}
+}
+
+// Returns the targets of the given proxy (nil when we're not in proxy mode)
+func proxyTargets(proxy *cachingProxy) []*proxyTarget {
+	if proxy == nil {
+		return nil
+	}
+	targets := append([]*proxyTarget(nil), proxy.primaries.targets...)
+	if proxy.canary != nil {
+		targets = append(targets, proxy.canary.target)
+	}
+	return targets
+}
+
+// The state of an upstream as shown on /status
+type upstreamStatus struct {
+	Name                string    `json:"name"`
+	Host                string    `json:"host"`
+	Healthy             bool      `json:"healthy"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastCheck           time.Time `json:"last_check,omitzero"`
+	LastError           string    `json:"last_error,omitempty"`
+}
+
+// Returns our status handler (the proxy is nil when we're not in proxy mode), which describes
+// the state of the server (and its upstreams) as JSON
+func serverStatusHandler(proxy *cachingProxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		status := map[string]interface{}{
+			"ready":          serverReady(proxy),
+			"started_at":     serverStarted.UTC(),
+			"uptime_seconds": time.Since(serverStarted).Seconds(),
+			"go_version":     runtime.Version(),
+			"mode":           "demo",
+			"runtime":        currentRuntimeTuning(),
+			"tls":            currentTLSStatus(),
+			"secrets":        currentSecretSources(),
+			"signing_keys":   currentSigningKeysStatus(),
+			"components":     currentComponentStatus(),
+		}
+
+		// Our leak watchdog (see watchdog.go) flags us as degraded while our goroutines or heap
+		// keep growing, as does a TLS certificate nearing its expiry (see certwatch.go)
+		degraded := false
+		if watchdogInterval > 0 {
+			watchdog := currentWatchdogStatus()
+			status["watchdog"] = watchdog
+			degraded = watchdog.Degraded
+		}
+		if certificate := currentCertificateStatus(); certificate != nil && certificate.Expiring {
+			degraded = true
+		}
+		status["degraded"] = degraded
+
+		if proxy != nil {
+
+			status["mode"] = "proxy"
+
+			var upstreams []upstreamStatus
+
+			for _, target := range proxyTargets(proxy) {
+				target.mutex.Lock()
+				upstreams = append(upstreams, upstreamStatus{
+					Name:                target.name,
+					Host:                target.url.Host,
+					Healthy:             target.healthy,
+					ConsecutiveFailures: target.failures,
+					LastCheck:           target.lastCheck,
+					LastError:           target.lastError,
+				})
+				target.mutex.Unlock()
+			}
+
+			status["upstreams"] = upstreams
+
+		}
+
+		setContentType(w, CONTENT_TYPE_JSON)
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(status)
+
+	}
+}
@@ -0,0 +1,310 @@
+// Uptime recording. Every -uptime-interval we check our own health (see serverReady) and note
+// how many requests we served and how many of them failed (with a 5xx) since the last check.
+// The results are kept per hour for UPTIME_HISTORY_DAYS days (and saved to -uptime-file, if
+// given, so that they survive restarts), and the /uptime page shows our availability as daily
+// and weekly bars, so that the demo server doubles as its own status page.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	UPTIME_HISTORY_DAYS     = 91 // Enough for our weekly bars
+	UPTIME_DAILY_BARS       = 30
+	UPTIME_WEEKLY_BARS      = 13
+	DEFAULT_UPTIME_INTERVAL = time.Minute
+)
+
+// What we recorded during one hour
+type uptimeHour struct {
+	Hour          time.Time `json:"hour"`
+	Checks        int       `json:"checks"`
+	HealthyChecks int       `json:"healthy_checks"`
+	Requests      int64     `json:"requests"`
+	Errors        int64     `json:"errors"`
+}
+
+// Our uptime history, oldest hour first
+var uptimeHistory = struct {
+	mutex        sync.Mutex
+	file         string // Where our history is saved ("" to keep it in memory only)
+	hours        []uptimeHour
+	lastRequests float64 // Our request and error totals at the last check
+	lastErrors   float64
+}{}
+
+func init() {
+	registerPage(Page{Title: "Uptime", Path: "/uptime", Order: 80, Visible: true, Section: SECTION_SITE, Handler: uptimeHandler})
+}
+
+// Load our uptime history from the given JSON file (if it exists), saving our history to it from
+// now on
+func loadUptimeHistory(path string) error {
+
+	uptimeHistory.mutex.Lock()
+	defer uptimeHistory.mutex.Unlock()
+
+	uptimeHistory.file = path
+
+	return loadJSONFile(path, &uptimeHistory.hours)
+
+}
+
+// Returns a component which records our uptime every interval (see components.go)
+func newUptimeRecorder(interval time.Duration) Component {
+	return newTickerComponent(interval, func(now time.Time) {
+		recordUptime(now, serverReady(nil))
+	})
+}
+
+// Record the result of a health check at the given time, along with the requests (and errors)
+// since our last check
+func recordUptime(now time.Time, healthy bool) {
+
+	requests := sumCounters("http_requests_total")
+	failures := sumCounters("http_requests_total", "status", "5xx")
+
+	uptimeHistory.mutex.Lock()
+	defer uptimeHistory.mutex.Unlock()
+
+	hour := now.UTC().Truncate(time.Hour)
+	hours := uptimeHistory.hours
+
+	if len(hours) == 0 || !hours[len(hours)-1].Hour.Equal(hour) {
+		hours = append(hours, uptimeHour{Hour: hour})
+	}
+
+	current := &hours[len(hours)-1]
+	current.Checks++
+	if healthy {
+		current.HealthyChecks++
+	}
+	current.Requests += int64(requests - uptimeHistory.lastRequests)
+	current.Errors += int64(failures - uptimeHistory.lastErrors)
+
+	uptimeHistory.lastRequests, uptimeHistory.lastErrors = requests, failures
+
+	// Forget the hours we no longer show
+	cutoff := hour.Add(-UPTIME_HISTORY_DAYS * 24 * time.Hour)
+	for len(hours) > 0 && hours[0].Hour.Before(cutoff) {
+		hours = hours[1:]
+	}
+
+	uptimeHistory.hours = hours
+
+	if uptimeHistory.file == "" {
+		return
+	}
+
+	if err := saveJSONFile(uptimeHistory.file, hours); err != nil {
+		logger.Println("Failed to save the uptime history:", err)
+	}
+
+}
+
+// Our availability over a period (one of the bars of our /uptime page)
+type uptimeBar struct {
+	Start        time.Time `json:"start"`
+	Checks       int       `json:"checks"`
+	Availability float64   `json:"availability"` // The percentage of healthy checks
+	Requests     int64     `json:"requests"`
+	ErrorRate    float64   `json:"error_rate"` // The percentage of requests which failed
+}
+
+// Returns the CSS colour of our bar
+func (bar uptimeBar) Colour() string {
+	switch {
+	case bar.Checks == 0:
+		return "#ccc"
+	case bar.Availability >= 99.9:
+		return "#3a3"
+	case bar.Availability >= 99:
+		return "#ec3"
+	default:
+		return "#d33"
+	}
+}
+
+// Returns the tooltip of our bar
+func (bar uptimeBar) Summary() string {
+	if bar.Checks == 0 {
+		return bar.Start.Format("2 Jan 2006") + ": no data"
+	}
+	return fmt.Sprintf("%s: %.2f%% available, %d requests, %.2f%% errors",
+		bar.Start.Format("2 Jan 2006"), bar.Availability, bar.Requests, bar.ErrorRate)
+}
+
+// Returns count bars of the given length, ending with the one covering now
+func uptimeBars(now time.Time, length time.Duration, count int) []uptimeBar {
+
+	uptimeHistory.mutex.Lock()
+	defer uptimeHistory.mutex.Unlock()
+
+	end := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	start := end.Add(-length * time.Duration(count))
+
+	bars := make([]uptimeBar, count)
+	healthy := make([]int, count)
+	failures := make([]int64, count)
+
+	for index := range bars {
+		bars[index].Start = start.Add(length * time.Duration(index))
+	}
+
+	for _, hour := range uptimeHistory.hours {
+		if hour.Hour.Before(start) || !hour.Hour.Before(end) {
+			continue
+		}
+		index := int(hour.Hour.Sub(start) / length)
+		bars[index].Checks += hour.Checks
+		bars[index].Requests += hour.Requests
+		healthy[index] += hour.HealthyChecks
+		failures[index] += hour.Errors
+	}
+
+	for index := range bars {
+		if bars[index].Checks > 0 {
+			bars[index].Availability = float64(healthy[index]) * 100 / float64(bars[index].Checks)
+		}
+		if bars[index].Requests > 0 {
+			bars[index].ErrorRate = float64(failures[index]) * 100 / float64(bars[index].Requests)
+		}
+	}
+
+	return bars
+
+}
+
+// This is a template string we use to construct the body of our uptime page
+const UPTIME_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>Uptime</h2>
+		{{ if not .Recording }}
+		<p>Uptime recording is disabled on this server (see the -uptime-interval flag).</p>
+		{{ end }}
+		<h4>Last {{ len .Daily }} days</h4>
+		<div style="display: flex; gap: 2px; height: 40px;">
+			{{ range .Daily }}<div style="flex: 1; background: {{ .Colour }};" title="{{ .Summary }}"></div>{{ end }}
+		</div>
+		<h4>Last {{ len .Weekly }} weeks</h4>
+		<div style="display: flex; gap: 2px; height: 40px;">
+			{{ range .Weekly }}<div style="flex: 1; background: {{ .Colour }};" title="Week of {{ .Summary }}"></div>{{ end }}
+		</div>
+		<p><small>Green is at least 99.9% available, yellow at least 99% and red below that. Grey means there's no data.</small></p>
+		{{ if .Sparklines }}
+		<h4>The last hour</h4>
+		<p>
+			Requests <img src="{{ url "/metrics/sparkline" }}?metric=http_requests_total" alt="Requests over the last hour" style="vertical-align: middle;">
+			Goroutines <img src="{{ url "/metrics/sparkline" }}?metric=go_goroutines" alt="Goroutines over the last hour" style="vertical-align: middle;">
+		</p>
+		{{ end }}
+		{{ with .Clients }}
+		<h4>Clients since the server started</h4>
+		<div style="display: flex; flex-wrap: wrap; gap: 24px;">
+			{{ range $breakdown := $.ClientBreakdowns }}{{ with index $.Clients $breakdown.Key }}
+			<table>
+				<tr><th style="text-align: left;">{{ $breakdown.Title }}</th><th>Requests</th><th></th></tr>
+				{{ range . }}<tr><td>{{ .Name }}</td><td style="text-align: right;">{{ .Requests }}</td><td style="text-align: right;">{{ printf "%.1f" .Percent }}%</td></tr>{{ end }}
+			</table>
+			{{ end }}{{ end }}
+		</div>
+		{{ end }}
+	</div>
+`
+
+// The data we pass into our uptime body template (and return as JSON)
+type uptimePageData struct {
+	Recording bool        `json:"recording"`
+	Daily     []uptimeBar `json:"daily"`
+	Weekly    []uptimeBar `json:"weekly"`
+
+	// The requests we've seen by category, browser, operating system, bot and tool (see
+	// useragents.go)
+	Clients map[string][]userAgentShare `json:"clients"`
+
+	Sparklines bool `json:"-"` // Whether we're sampling our metrics (see sparkline.go)
+}
+
+// A breakdown of our clients, as we list it on our uptime page
+type clientBreakdown struct {
+	Key   string
+	Title string
+}
+
+// The breakdowns of our clients we list, in order
+func (uptimePageData) ClientBreakdowns() []clientBreakdown {
+	return []clientBreakdown{
+		{"categories", "Category"},
+		{"browsers", "Browser"},
+		{"operating_systems", "Operating system"},
+		{"bots", "Bot"},
+		{"tools", "Tool"},
+	}
+}
+
+// This is our uptime handler, which shows our availability over the last days and weeks
+func uptimeHandler(w http.ResponseWriter, r *http.Request) {
+
+	now := time.Now()
+
+	data := uptimePageData{
+		Recording:  uptimeInterval > 0,
+		Sparklines: metricsInterval > 0,
+		Daily:      uptimeBars(now, 24*time.Hour, UPTIME_DAILY_BARS),
+		Weekly:     uptimeBars(now, 7*24*time.Hour, UPTIME_WEEKLY_BARS),
+		Clients:    userAgentStats.breakdowns(),
+	}
+
+	if wantsJSON(r) {
+		setContentType(w, CONTENT_TYPE_JSON)
+		json.NewEncoder(w).Encode(data)
+		return
+	}
+
+	body, err := renderFragment(uptimeBodyTemplate, data)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the uptime body template"))
+		return
+	}
+
+	renderMainTemplate(w, r, "uptime", HtmlData{
+		Title:       "Golang Uptime",
+		Description: "The server's own availability and error rates.",
+		Keywords:    "golang web server uptime status page",
+		CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+		BodyContent: body,
+		SocialCard:  uptimeSocialCard(data.Daily),
+	})
+
+}
+
+// Returns the preview of our uptime page: a chart of our availability over the days we have
+// checks for (see socialcards.go)
+func uptimeSocialCard(daily []uptimeBar) SocialCard {
+
+	var availability []float64
+	for _, bar := range daily {
+		if bar.Checks > 0 {
+			availability = append(availability, bar.Availability)
+		}
+	}
+
+	image := barChartImagePath(availability)
+	if image == "" {
+		return SocialCard{}
+	}
+
+	return SocialCard{
+		Image:       image,
+		ImageAlt:    "A bar chart of the server's availability each day",
+		ImageWidth:  SOCIAL_CHART_WIDTH,
+		ImageHeight: SOCIAL_CHART_HEIGHT,
+	}
+
+}
@@ -0,0 +1,290 @@
+// User agent parsing and bot classification. Our logging middleware parses the user agent of
+// each request into a category (browser, bot, tool such as curl, or unknown), a browser and an
+// operating system (or the name of the bot or tool), using the tables below. Requests are counted
+// by them in the http_requests_by_client_total metric, bots are named in the access log (as a
+// bot= field, see tags.go), and the /uptime page shows the breakdown since we started. Names
+// come only from our tables (anything else is "Other"), so they can't grow our metrics without
+// bound.
+//
+// Handlers can make decisions for known bots via requestUserAgent. For example, pages which are
+// little more than a JavaScript demo can give a BotSnapshot (see pages.go), which search engine
+// and link preview bots are served instead of the page when -bot-snapshots is set: a static page
+// with the page's title and the snapshot's description, which costs far less to serve and index.
+
+package main
+
+import (
+	"context"
+	"html"
+	"html/template"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// The categories of user agents
+const (
+	USER_AGENT_BROWSER = "browser"
+	USER_AGENT_BOT     = "bot"
+	USER_AGENT_TOOL    = "tool"
+	USER_AGENT_UNKNOWN = "unknown"
+	USER_AGENT_OTHER   = "Other"
+)
+
+// A user agent token and the name we give the agents whose user agent contains it
+type userAgentToken struct {
+	token string
+	name  string
+}
+
+// The bots we know, checked in order (the tokens are matched case insensitively). Search engine
+// and link preview bots are marked as crawlers, which are served our bot snapshots.
+var knownBots = []userAgentToken{
+	{"googlebot", "Googlebot"},
+	{"bingbot", "Bingbot"},
+	{"duckduckbot", "DuckDuckBot"},
+	{"yandexbot", "YandexBot"},
+	{"baiduspider", "Baiduspider"},
+	{"applebot", "Applebot"},
+	{"facebookexternalhit", "Facebook"},
+	{"twitterbot", "Twitterbot"},
+	{"slackbot", "Slackbot"},
+	{"linkedinbot", "LinkedInBot"},
+	{"discordbot", "Discordbot"},
+	{"ahrefsbot", "AhrefsBot"},
+	{"semrushbot", "SemrushBot"},
+	{"gptbot", "GPTBot"},
+	{"ccbot", "CCBot"},
+	{"kube-probe", "kube-probe"},
+	{"uptimerobot", "UptimeRobot"},
+	{"bot", USER_AGENT_OTHER},
+	{"crawler", USER_AGENT_OTHER},
+	{"spider", USER_AGENT_OTHER},
+}
+
+// The bots which index our pages or show previews of them
+var crawlerBots = map[string]bool{
+	"Googlebot": true, "Bingbot": true, "DuckDuckBot": true, "YandexBot": true, "Baiduspider": true,
+	"Applebot": true, "Facebook": true, "Twitterbot": true, "Slackbot": true, "LinkedInBot": true,
+	"Discordbot": true,
+}
+
+// The tools and HTTP libraries we know
+var knownTools = []userAgentToken{
+	{"curl/", "curl"},
+	{"wget/", "Wget"},
+	{"python-requests", "Python"},
+	{"python-urllib", "Python"},
+	{"go-http-client", "Go"},
+	{"postmanruntime", "Postman"},
+	{"okhttp", "OkHttp"},
+	{"node-fetch", "Node.js"},
+	{"axios/", "Node.js"},
+	{"httpie/", "HTTPie"},
+}
+
+// Browsers, checked in order, as most browsers include the tokens of the ones they're based on
+// (i.e. Edge's user agent includes Chrome and Safari)
+var knownBrowsers = []userAgentToken{
+	{"Edg/", "Edge"},
+	{"EdgiOS/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Version/", "Safari"},
+}
+
+// Operating systems, checked in order
+var knownOperatingSystems = []userAgentToken{
+	{"Windows", "Windows"},
+	{"iPhone", "iOS"},
+	{"iPad", "iOS"},
+	{"Android", "Android"},
+	{"CrOS", "ChromeOS"},
+	{"Mac OS X", "macOS"},
+	{"Macintosh", "macOS"},
+	{"Linux", "Linux"},
+}
+
+// A parsed user agent
+type userAgentInfo struct {
+	Category string `json:"category"`
+	Name     string `json:"name"`         // The browser, bot or tool
+	OS       string `json:"os,omitempty"` // For browsers
+}
+
+// Returns whether the user agent is a bot which indexes or previews our pages
+func (info userAgentInfo) Crawler() bool {
+	return info.Category == USER_AGENT_BOT && crawlerBots[info.Name]
+}
+
+// Returns the name of the first of the given tokens the user agent contains, if any
+func matchUserAgent(userAgent string, tokens []userAgentToken) (string, bool) {
+	for _, token := range tokens {
+		if strings.Contains(userAgent, token.token) {
+			return token.name, true
+		}
+	}
+	return "", false
+}
+
+// Parse the given user agent
+func parseUserAgent(userAgent string) userAgentInfo {
+
+	if strings.TrimSpace(userAgent) == "" {
+		return userAgentInfo{Category: USER_AGENT_UNKNOWN, Name: USER_AGENT_OTHER}
+	}
+
+	lower := strings.ToLower(userAgent)
+
+	if name, found := matchUserAgent(lower, knownBots); found {
+		return userAgentInfo{Category: USER_AGENT_BOT, Name: name}
+	}
+
+	if name, found := matchUserAgent(lower, knownTools); found {
+		return userAgentInfo{Category: USER_AGENT_TOOL, Name: name}
+	}
+
+	if !strings.HasPrefix(userAgent, "Mozilla/") {
+		return userAgentInfo{Category: USER_AGENT_UNKNOWN, Name: USER_AGENT_OTHER}
+	}
+
+	info := userAgentInfo{Category: USER_AGENT_BROWSER, Name: USER_AGENT_OTHER, OS: USER_AGENT_OTHER}
+	if name, found := matchUserAgent(userAgent, knownBrowsers); found {
+		info.Name = name
+	}
+	if os, found := matchUserAgent(userAgent, knownOperatingSystems); found {
+		info.OS = os
+	}
+
+	return info
+
+}
+
+// Returns the parsed user agent of the given request
+func requestUserAgent(r *http.Request) userAgentInfo {
+	if info, ok := r.Context().Value(USER_AGENT_KEY).(userAgentInfo); ok {
+		return info
+	}
+	return parseUserAgent(r.UserAgent())
+}
+
+// Returns the given request with its parsed user agent in its context, having counted it
+func withUserAgent(r *http.Request) *http.Request {
+
+	info := parseUserAgent(r.UserAgent())
+
+	incrementCounter("http_requests_by_client_total", "category", info.Category, "name", info.Name, "os", info.OS)
+	userAgentStats.add(info)
+
+	if info.Category == USER_AGENT_BOT {
+		addLogField(r.Context(), "bot", info.Name)
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), USER_AGENT_KEY, info))
+
+}
+
+// The requests we've seen since we started, by category, browser, operating system, bot and tool
+var userAgentStats = &userAgentCounts{counts: map[string]map[string]int64{}}
+
+type userAgentCounts struct {
+	mutex  sync.Mutex
+	counts map[string]map[string]int64
+}
+
+func (stats *userAgentCounts) add(info userAgentInfo) {
+
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	count := func(breakdown string, name string) {
+		if stats.counts[breakdown] == nil {
+			stats.counts[breakdown] = map[string]int64{}
+		}
+		stats.counts[breakdown][name]++
+	}
+
+	count("categories", info.Category)
+	switch info.Category {
+	case USER_AGENT_BROWSER:
+		count("browsers", info.Name)
+		count("operating_systems", info.OS)
+	case USER_AGENT_BOT:
+		count("bots", info.Name)
+	case USER_AGENT_TOOL:
+		count("tools", info.Name)
+	}
+
+}
+
+// A name and its count in one of our breakdowns
+type userAgentShare struct {
+	Name     string  `json:"name"`
+	Requests int64   `json:"requests"`
+	Percent  float64 `json:"percent"`
+}
+
+// Returns our breakdowns, each with its most common names first
+func (stats *userAgentCounts) breakdowns() map[string][]userAgentShare {
+
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	breakdowns := map[string][]userAgentShare{}
+	for breakdown, counts := range stats.counts {
+		total := int64(0)
+		for _, count := range counts {
+			total += count
+		}
+		var shares []userAgentShare
+		for _, name := range slices.Sorted(maps.Keys(counts)) {
+			shares = append(shares, userAgentShare{Name: name, Requests: counts[name], Percent: float64(counts[name]) * 100 / float64(total)})
+		}
+		slices.SortStableFunc(shares, func(a, b userAgentShare) int {
+			return int(b.Requests - a.Requests)
+		})
+		breakdowns[breakdown] = shares
+	}
+
+	return breakdowns
+
+}
+
+// Returns the given page's handler, serving its bot snapshot to crawlers when we have one (and
+// -bot-snapshots is set)
+func botSnapshotHandler(page Page) http.HandlerFunc {
+
+	if page.BotSnapshot == "" || !botSnapshots {
+		return page.Handler
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// Caches have to tell our bots and our visitors apart
+		w.Header().Add("Vary", "User-Agent")
+
+		info := requestUserAgent(r)
+		if !info.Crawler() || r.Method != http.MethodGet && r.Method != http.MethodHead {
+			page.Handler(w, r)
+			return
+		}
+
+		incrementCounter("bot_snapshots_total", "page", page.Path, "bot", info.Name)
+
+		renderMainTemplate(w, r, "bot snapshot", HtmlData{
+			Title:       "Golang " + page.Title,
+			Description: page.BotSnapshot,
+			// template-audit: the title and snapshot are escaped
+			BodyContent: template.HTML(`<div class = "main-content"><h2>` + html.EscapeString(page.Title) + `</h2><p>` +
+				html.EscapeString(page.BotSnapshot) + `</p></div>`),
+		})
+
+	}
+
+}
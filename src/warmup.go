@@ -0,0 +1,89 @@
+// Our startup warm-up. Before /readyz reports us ready, we request our slowest pages (the index,
+// the SVG surface and the sphere) from our own routes, so that the first visitors after a
+// deploy don't pay for our cold paths: each page is rendered into our page cache (see
+// pagecache.go) and served from it from then on, and the default SVG surface is drawn into its
+// own cache (see defaultSurface). Pages are cached for each variation of them, so visitors whose
+// pages differ from our warm-up request's (i.e. by their experiment buckets or cookie choices)
+// have theirs rendered, and then cached, on their first request.
+//
+// With -site-url our pages are the same whichever host they're requested from, so the pages we
+// warm up are served to every visitor. Without it our pages render the host they were requested
+// from, and we can't know which host our visitors will use, so we warm up the address we're
+// listening on and warn that the pages we warmed up may not be the ones visitors get.
+//
+// Warm-up happens once we're listening, so /health says we're up while /readyz (and the
+// serverReady check behind it) waits for us to finish. It's skipped with -warm-up=false and in
+// proxy mode, where our pages come from the origin.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// The pages we request before we're ready
+var warmUpPaths = []string{"/", "/svg", "/sphere"}
+
+// Whether we've warmed up (1 once we have, or if we aren't warming up at all)
+var warmedUp int32
+
+// Request our warm-up pages from the given handler, then mark ourselves as warmed up. Pages which
+// fail are logged, but don't stop us from becoming ready.
+func warmUp(handler http.Handler) {
+
+	started := time.Now()
+	warnedHost := false
+
+	for _, path := range warmUpPaths {
+
+		request := httptest.NewRequest(http.MethodGet, urlFor(path), nil)
+		request.Header.Set("Accept", "text/html")
+		request.Host = warmUpHost()
+		recorder := httptest.NewRecorder()
+
+		pageStarted := time.Now()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code >= 400 {
+			logger.Printf("WARN warming up %s failed with a %d", path, recorder.Code)
+			continue
+		}
+		logger.Printf("Warmed up %s in %v", path, time.Since(pageStarted).Round(time.Microsecond))
+
+		if pageRendersHost(recorder.Body.Bytes(), request) && !warnedHost {
+			logger.Printf("WARN our pages render the host they're requested from, so the pages warmed up for %s are only served to visitors using it. Set -site-url to serve them to every visitor.", request.Host)
+			warnedHost = true
+		}
+
+	}
+
+	atomic.StoreInt32(&warmedUp, 1)
+	setGauge("warm_up_seconds", time.Since(started).Seconds())
+
+}
+
+// Returns the host our warm-up requests are sent to: the host of our -site-url, or without one
+// the address we're listening on
+func warmUpHost() string {
+
+	if parsed, err := url.Parse(siteURL); err == nil && parsed.Host != "" {
+		return parsed.Host
+	}
+
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return listenAddr
+	}
+
+	if host == "" {
+		host = "localhost"
+	}
+
+	return net.JoinHostPort(host, port)
+
+}
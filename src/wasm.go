@@ -0,0 +1,144 @@
+// Our WebAssembly demo. /wasm loads a small Go program compiled to WebAssembly (see
+// wasm/main.go), so the page runs Go in the browser as well as on the server: the module works
+// out the SHA-256 digest and statistics of the text you type, and the page can check the
+// digest against our hash API (see hash.go).
+//
+// The module and Go's wasm_exec.js shim (which the module needs to run) are built into the
+// static directory by go generate, embedded here (so builds with the nowasm tag don't carry
+// the 2.4MB module) and served like our other static files (see static.go):
+// fingerprinted, with the application/wasm content type (which WebAssembly.instantiateStreaming
+// insists on) and compressed by our compression middleware, which shrinks the module by about
+// three quarters. Run go generate after changing wasm/main.go or upgrading Go, since the shim
+// has to match the version of Go the module was compiled with.
+
+//go:build !nowasm
+
+//go:generate env GOOS=js GOARCH=wasm go build -trimpath "-ldflags=-s -w" -o static/wasm-demo.wasm wasm/main.go
+//go:generate cp $GOROOT/lib/wasm/wasm_exec.js static/wasm_exec.js
+
+package main
+
+import (
+	"embed"
+	"html/template"
+	"net/http"
+)
+
+// Our module and its shim
+//
+//go:embed static/wasm-demo.wasm static/wasm_exec.js
+var wasmFiles embed.FS
+
+const WASM_BODY_TEMPLATE = `
+	<div class = "main-content" id="wasm-demo" data-module="{{ assetPath "wasm-demo.wasm" }}" data-hash-api="{{ url "/api/v1/hash" }}">
+		<h2>Go and WebAssembly</h2>
+		<p id="wasm-status">Loading the Go module…</p>
+		<textarea id="wasm-text" rows=6 cols=80 spellcheck="false" placeholder="Type something" disabled></textarea>
+		<table style="margin: auto; text-align: left;">
+			<tr><th>Bytes</th><td id="wasm-bytes">0</td></tr>
+			<tr><th>Characters</th><td id="wasm-characters">0</td></tr>
+			<tr><th>Words</th><td id="wasm-words">0</td></tr>
+			<tr><th>Lines</th><td id="wasm-lines">0</td></tr>
+			<tr><th>SHA-256 (in your browser)</th><td><code id="wasm-digest"></code></td></tr>
+			<tr><th>SHA-256 (on the server)</th><td><code id="wasm-server-digest"></code></td></tr>
+		</table>
+		<p><button id="wasm-check" disabled>Check on the server</button></p>
+	</div>
+`
+
+// The page's script, which starts the Go module and calls its functions as you type
+const WASM_SCRIPT = `
+<script>
+
+	var demo = document.getElementById("wasm-demo");
+	var text = document.getElementById("wasm-text");
+	var statusLine = document.getElementById("wasm-status");
+
+	// Show what our Go module makes of the text
+	function update() {
+		var stats = goTextStats(text.value);
+		for (var name of ["bytes", "characters", "words", "lines"]) {
+			document.getElementById("wasm-" + name).textContent = stats[name];
+		}
+		document.getElementById("wasm-digest").textContent = goSHA256(text.value);
+		document.getElementById("wasm-server-digest").textContent = "";
+	}
+
+	// Ask our hash API for the digest of the same text, to show that both ends agree
+	function check() {
+		fetch(demo.dataset.hashApi, {method: "POST", body: text.value})
+			.then(function (response) { return response.json(); })
+			.then(function (result) {
+				var matches = result.digests.sha256 === goSHA256(text.value);
+				document.getElementById("wasm-server-digest").textContent =
+					result.digests.sha256 + (matches ? " (matches)" : " (doesn't match)");
+			});
+	}
+
+	window.addEventListener("go-ready", function () {
+		statusLine.textContent = "The Go module is running in your browser.";
+		text.disabled = document.getElementById("wasm-check").disabled = false;
+		text.addEventListener("input", update);
+		document.getElementById("wasm-check").addEventListener("click", check);
+		update();
+	});
+
+	var go = new Go();
+	WebAssembly.instantiateStreaming(fetch(demo.dataset.module), go.importObject)
+		.then(function (result) { go.run(result.instance); })
+		.catch(function (error) { statusLine.textContent = "The Go module couldn't be loaded: " + error; });
+
+</script>
+`
+
+var wasmBodyTemplate *template.Template
+
+// Our WebAssembly demo app (see demoapps.go)
+type wasmApp struct {
+	demoAppDefaults
+}
+
+func init() {
+	addStaticFiles(wasmFiles, "wasm-demo.wasm", "wasm_exec.js")
+	registerDemoApp(wasmApp{})
+}
+
+func (wasmApp) Name() string {
+	return "wasm"
+}
+
+func (wasmApp) NavEntry() *Page {
+	return &Page{Title: "WebAssembly", Path: "/wasm", Order: 46, Visible: true, Section: SECTION_DEMOS, Handler: wasmHandler,
+		BotSnapshot: "Go compiled to WebAssembly and run in the browser."}
+}
+
+func (wasmApp) Templates() []templateDefinition {
+	return []templateDefinition{{name: "wasm.body", source: WASM_BODY_TEMPLATE, target: &wasmBodyTemplate}}
+}
+
+// This is our WebAssembly demo page
+func wasmHandler(w http.ResponseWriter, r *http.Request) {
+
+	body, err := renderFragment(wasmBodyTemplate, nil)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the wasm body template"))
+		return
+	}
+
+	shim, err := assetPath("wasm_exec.js")
+	if err != nil {
+		writeError(w, r, internalError(err))
+		return
+	}
+
+	renderMainTemplate(w, r, "wasm", HtmlData{
+		Title:       "Golang WebAssembly",
+		Description: "A Go program compiled to WebAssembly, running in the browser alongside our Go server.",
+		Keywords:    "golang web server webassembly wasm syscall/js",
+		CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+		JsFiles:     []Asset{{URL: shim, Critical: true}}, // Our script starts the module straight away
+		JsScript:    template.HTML(WASM_SCRIPT),
+		BodyContent: body,
+	})
+
+}
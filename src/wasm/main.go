@@ -0,0 +1,45 @@
+//go:build js && wasm
+
+// The WebAssembly module of our /wasm page (see wasm.go in the directory above). It's compiled
+// to static/wasm-demo.wasm by go generate and gives the page's JavaScript a couple of Go
+// functions to call, which work out the same things in the browser that our server does.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"syscall/js"
+	"unicode/utf8"
+)
+
+func main() {
+
+	// goSHA256(text) returns the hex SHA-256 digest of the text's UTF-8 bytes, which is what
+	// POST /api/v1/hash returns as its sha256 for the same text
+	js.Global().Set("goSHA256", js.FuncOf(func(this js.Value, args []js.Value) any {
+		sum := sha256.Sum256([]byte(args[0].String()))
+		return hex.EncodeToString(sum[:])
+	}))
+
+	// goTextStats(text) returns the numbers of bytes, characters, words and lines in the text
+	js.Global().Set("goTextStats", js.FuncOf(func(this js.Value, args []js.Value) any {
+		text := args[0].String()
+		lines := strings.Count(text, "\n")
+		if text != "" && !strings.HasSuffix(text, "\n") {
+			lines++
+		}
+		return map[string]any{
+			"bytes":      len(text),
+			"characters": utf8.RuneCountInString(text),
+			"words":      len(strings.Fields(text)),
+			"lines":      lines,
+		}
+	}))
+
+	// Tell the page we're ready, then keep running so that our functions can still be called
+	js.Global().Call("dispatchEvent", js.Global().Get("Event").New("go-ready"))
+	select {}
+
+}
@@ -0,0 +1,158 @@
+// Our goroutine and memory leak watchdog. Every -watchdog-interval we note how many goroutines
+// we have and how big our heap is, and if either has grown by more than its threshold
+// (-watchdog-goroutines, -watchdog-heap) over the last -watchdog-window, we log a warning along
+// with a dump of our goroutines and flag ourselves as degraded on /status, until it stops
+// growing.
+//
+// Busy periods start goroutines and fill the heap too, so we compare the lowest values of the
+// oldest and newest quarters of the window rather than its first and last samples: a leak raises the floor
+// that our goroutines and heap drop back to, while a burst of traffic (or garbage waiting for
+// the next collection) doesn't.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_WATCHDOG_INTERVAL   = time.Minute
+	DEFAULT_WATCHDOG_WINDOW     = 15 * time.Minute
+	DEFAULT_WATCHDOG_GOROUTINES = 500
+	DEFAULT_WATCHDOG_HEAP       = 256 << 20
+	WATCHDOG_DUMP_SIZE          = 64 << 10 // The most of our goroutine dump we log
+)
+
+// What our watchdog noted at one point in time
+type watchdogSample struct {
+	time       time.Time
+	goroutines int
+	heap       uint64
+}
+
+// Our watchdog's samples over its window (oldest first) and what it found
+var watchdog = struct {
+	mutex    sync.Mutex
+	samples  []watchdogSample
+	problems []string  // What's growing, if we're degraded
+	since    time.Time // When we became degraded
+}{}
+
+// The watchdog's part of /status
+type watchdogStatus struct {
+	Degraded   bool      `json:"degraded"`
+	Problems   []string  `json:"problems,omitempty"`
+	Since      time.Time `json:"since,omitzero"`
+	Goroutines int       `json:"goroutines"`
+	HeapBytes  uint64    `json:"heap_bytes"`
+}
+
+// Returns a component which watches our goroutines and heap every interval (see components.go)
+func newWatchdog(interval time.Duration) Component {
+	return newTickerComponent(interval, func(now time.Time) {
+		var memory runtime.MemStats
+		runtime.ReadMemStats(&memory)
+		checkWatchdog(watchdogSample{time: now, goroutines: runtime.NumGoroutine(), heap: memory.HeapAlloc})
+	})
+}
+
+// Add a sample to our window, and check whether our goroutines or heap are growing
+func checkWatchdog(sample watchdogSample) {
+
+	watchdog.mutex.Lock()
+	defer watchdog.mutex.Unlock()
+
+	samples := append(watchdog.samples, sample)
+	for len(samples) > 0 && samples[0].time.Before(sample.time.Add(-watchdogWindow)) {
+		samples = samples[1:]
+	}
+	watchdog.samples = samples
+
+	// We can't tell whether we're growing until we've watched for a whole window
+	if len(samples) < 4 || sample.time.Sub(samples[0].time) < watchdogWindow*3/4 {
+		return
+	}
+
+	older, newer := samples[:len(samples)/4], samples[len(samples)-len(samples)/4:]
+	goroutines := lowestSample(newer, func(s watchdogSample) int64 { return int64(s.goroutines) }) -
+		lowestSample(older, func(s watchdogSample) int64 { return int64(s.goroutines) })
+	heap := lowestSample(newer, func(s watchdogSample) int64 { return int64(s.heap) }) -
+		lowestSample(older, func(s watchdogSample) int64 { return int64(s.heap) })
+
+	var problems []string
+	if goroutines > int64(watchdogGoroutines) {
+		problems = append(problems, fmt.Sprintf("goroutines grew by %d over %v (now %d)", goroutines, watchdogWindow, sample.goroutines))
+	}
+	if heap > watchdogHeap {
+		problems = append(problems, fmt.Sprintf("the heap grew by %s over %v (now %s)",
+			formatFileSize(heap), watchdogWindow, formatFileSize(int64(sample.heap))))
+	}
+
+	wasDegraded := len(watchdog.problems) > 0
+	watchdog.problems = problems
+
+	switch {
+	case len(problems) > 0 && !wasDegraded:
+		watchdog.since = sample.time
+		setGauge("watchdog_degraded", 1)
+		incrementCounter("watchdog_warnings_total")
+		logger.Printf("WARN possible leak: %s. Our goroutines are:\n%s", strings.Join(problems, ", and "), goroutineDump())
+	case len(problems) == 0 && wasDegraded:
+		watchdog.since = time.Time{}
+		setGauge("watchdog_degraded", 0)
+		logger.Printf("Our goroutines and heap have stopped growing (now %d goroutines and %s)",
+			sample.goroutines, formatFileSize(int64(sample.heap)))
+	}
+
+}
+
+// Returns the lowest value of the samples
+func lowestSample(samples []watchdogSample, value func(watchdogSample) int64) int64 {
+	values := make([]int64, len(samples))
+	for i, sample := range samples {
+		values[i] = value(sample)
+	}
+	return slices.Min(values)
+}
+
+// Returns the stacks of our goroutines, with the goroutines that share a stack counted together
+// (so that thousands of leaked goroutines show up as one stack), cut short at WATCHDOG_DUMP_SIZE
+func goroutineDump() string {
+
+	var dump bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&dump, 1)
+
+	if dump.Len() > WATCHDOG_DUMP_SIZE {
+		dump.Truncate(WATCHDOG_DUMP_SIZE)
+		dump.WriteString("\n... (cut short)")
+	}
+
+	return dump.String()
+
+}
+
+// Returns how our watchdog sees us, for /status
+func currentWatchdogStatus() watchdogStatus {
+
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+
+	watchdog.mutex.Lock()
+	defer watchdog.mutex.Unlock()
+
+	return watchdogStatus{
+		Degraded:   len(watchdog.problems) > 0,
+		Problems:   watchdog.problems,
+		Since:      watchdog.since,
+		Goroutines: runtime.NumGoroutine(),
+		HeapBytes:  memory.HeapAlloc,
+	}
+
+}
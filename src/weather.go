@@ -0,0 +1,311 @@
+// Our weather demo. /weather?city=... fetches the current weather for a city from an upstream
+// weather API on the server side (through our outbound client, see outbound.go) and renders
+// it within our main template, so the API key never reaches the browser. Results are cached
+// per city for -weather-ttl, which keeps us well within the API's rate limits.
+//
+// The upstream API is OpenWeatherMap's current weather endpoint by default (set -weather-key
+// to your API key), and any API answering in the same format can be used via -weather-url.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	DEFAULT_WEATHER_URL     = "https://api.openweathermap.org/data/2.5/weather"
+	MAX_CITY_NAME_LENGTH    = 100     // The longest city name we look up
+	MAX_WEATHER_CACHE_SIZE  = 1000    // How many cities we keep cached results for
+	MAX_WEATHER_RESPONSE    = 1 << 20 // The largest upstream response we read
+	WEATHER_NOT_FOUND_ERROR = "city_not_found"
+)
+
+// The current weather for a city
+type weatherReport struct {
+	City        string    `json:"city"`
+	Country     string    `json:"country"`
+	Description string    `json:"description"`
+	Temperature float64   `json:"temperature"` // Degrees Celsius
+	FeelsLike   float64   `json:"feels_like"`  // Degrees Celsius
+	Humidity    int       `json:"humidity"`    // Percent
+	WindSpeed   float64   `json:"wind_speed"`  // Metres per second
+	Fetched     time.Time `json:"fetched"`
+}
+
+// The parts of the upstream API's response we use
+type upstreamWeather struct {
+	Name string `json:"name"`
+	Sys  struct {
+		Country string `json:"country"`
+	} `json:"sys"`
+	Weather []struct {
+		Description string `json:"description"`
+	} `json:"weather"`
+	Main struct {
+		Temp      float64 `json:"temp"`
+		FeelsLike float64 `json:"feels_like"`
+		Humidity  int     `json:"humidity"`
+	} `json:"main"`
+	Wind struct {
+		Speed float64 `json:"speed"`
+	} `json:"wind"`
+}
+
+// A cached lookup. Cities the API doesn't know are cached too (with a nil report), so that
+// repeated requests for them don't reach the API either.
+type weatherCacheEntry struct {
+	report  *weatherReport
+	expires time.Time
+}
+
+// Our cache of weather reports, keyed by the lower cased city name
+var weatherCache = struct {
+	mutex   sync.Mutex
+	entries map[string]weatherCacheEntry
+}{entries: make(map[string]weatherCacheEntry)}
+
+func init() {
+	registerPage(Page{Title: "Weather", Path: "/weather", Order: 60, Visible: true, Section: SECTION_DEMOS, Handler: weatherHandler})
+}
+
+// The body content of our weather page. The values are escaped by html/template.
+const WEATHER_BODY_TEMPLATE = `
+	<div class = "main-content">
+		<h2>Weather</h2>
+		<form action="{{ url "/weather" }}" method="GET">
+			<input maxLength=100 size=40 name="city" value="{{ .City }}" placeholder="City (i.e. London or Paris, FR)">
+			<input type="submit" value="Show Weather">
+		</form>
+		{{ if not .Configured }}
+		<p>The weather API isn't configured on this server (see the -weather-key flag).</p>
+		{{ end }}
+		{{ with .Report }}
+		<h4>{{ .City }}{{ if .Country }}, {{ .Country }}{{ end }}</h4>
+		<p>{{ .Description }}</p>
+		<p>Temperature: {{ printf "%.1f" .Temperature }} &deg;C (feels like {{ printf "%.1f" .FeelsLike }} &deg;C)</p>
+		<p>Humidity: {{ .Humidity }}%</p>
+		<p>Wind: {{ printf "%.1f" .WindSpeed }} m/s</p>
+		<p><small>Fetched at {{ .Fetched.Format "15:04:05 MST" }}</small></p>
+		{{ end }}
+	</div>
+`
+
+// The data we pass into our weather body template
+type weatherPageData struct {
+	City       string
+	Configured bool
+	Report     *weatherReport
+}
+
+// This is our weather handler. Without a city it displays our search form, otherwise it looks
+// up (or serves from our cache) the current weather for the city.
+func weatherHandler(w http.ResponseWriter, r *http.Request) {
+
+	data := weatherPageData{
+		City:       strings.TrimSpace(r.URL.Query().Get("city")),
+		Configured: weatherKey != "" || weatherURL != DEFAULT_WEATHER_URL,
+	}
+
+	if data.City != "" {
+
+		if err := validateCityName(data.City); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		if !data.Configured {
+			writeError(w, r, newAppError(http.StatusServiceUnavailable, "weather_unavailable",
+				"The weather API isn't configured on this server."))
+			return
+		}
+
+		report, err := lookupWeather(r, data.City)
+
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		data.Report = report
+
+		if wantsJSON(r) {
+			setContentType(w, CONTENT_TYPE_JSON)
+			json.NewEncoder(w).Encode(report)
+			return
+		}
+
+	}
+
+	body, err := renderFragment(weatherBodyTemplate, data)
+	if err != nil {
+		writeError(w, r, internalError(err).WithDetail("executing the weather body template"))
+		return
+	}
+
+	renderMainTemplate(w, r, "weather", HtmlData{
+		Title:       "Golang Weather",
+		Description: "Server side weather API calls with caching.",
+		Keywords:    "golang web server weather api cache",
+		CssFiles:    assets("https://fonts.googleapis.com/css?family=Open+Sans"),
+		BodyContent: body,
+	})
+
+}
+
+// Make sure the given city name looks like one (letters, spaces and the punctuation found in
+// place names, i.e. "St. John's, CA")
+func validateCityName(city string) error {
+
+	if len(city) > MAX_CITY_NAME_LENGTH {
+		return badRequestError(fmt.Sprintf("City names can be at most %d characters long.", MAX_CITY_NAME_LENGTH))
+	}
+
+	for _, character := range city {
+		if !unicode.IsLetter(character) && !unicode.IsMark(character) && !strings.ContainsRune(" ,.'-", character) {
+			return badRequestError("City names may only contain letters, spaces and the characters , . ' -")
+		}
+	}
+
+	return nil
+
+}
+
+// Returns the current weather for the given city, from our cache when we have a recent report
+func lookupWeather(r *http.Request, city string) (*weatherReport, error) {
+
+	key := strings.ToLower(city)
+	now := time.Now()
+
+	weatherCache.mutex.Lock()
+	entry, cached := weatherCache.entries[key]
+	weatherCache.mutex.Unlock()
+
+	if cached && now.Before(entry.expires) {
+		incrementCounter("weather_cache_total", "result", "hit")
+		if entry.report == nil {
+			return nil, cityNotFoundError(city)
+		}
+		return entry.report, nil
+	}
+
+	incrementCounter("weather_cache_total", "result", "miss")
+
+	report, err := fetchWeather(r, city)
+
+	if err != nil && !isCityNotFound(err) {
+		return nil, err
+	}
+
+	weatherCache.mutex.Lock()
+	defer weatherCache.mutex.Unlock()
+
+	// When our cache is full we make room by dropping expired entries, or failing that,
+	// everything (our entries are cheap to fetch again)
+	if len(weatherCache.entries) >= MAX_WEATHER_CACHE_SIZE {
+		for cachedKey, cachedEntry := range weatherCache.entries {
+			if now.After(cachedEntry.expires) {
+				delete(weatherCache.entries, cachedKey)
+			}
+		}
+		if len(weatherCache.entries) >= MAX_WEATHER_CACHE_SIZE {
+			clear(weatherCache.entries)
+		}
+	}
+
+	weatherCache.entries[key] = weatherCacheEntry{report: report, expires: now.Add(weatherTTL)}
+
+	return report, err
+
+}
+
+// Fetch the current weather for the given city from our upstream API
+func fetchWeather(r *http.Request, city string) (*weatherReport, error) {
+
+	upstreamURL, err := url.Parse(weatherURL)
+
+	if err != nil {
+		return nil, internalError(err).WithDetail("parsing the weather URL")
+	}
+
+	query := upstreamURL.Query()
+	query.Set("q", city)
+	query.Set("units", "metric")
+	if weatherKey != "" {
+		query.Set("appid", weatherKey)
+	}
+	upstreamURL.RawQuery = query.Encode()
+
+	unavailable := newAppError(http.StatusBadGateway, "weather_unavailable",
+		"The weather service isn't available right now. Please try again later.")
+
+	request, err := http.NewRequestWithContext(r.Context(), http.MethodGet, upstreamURL.String(), nil)
+
+	if err != nil {
+		return nil, internalError(err).WithDetail("creating the weather request")
+	}
+
+	request.Header.Set("Accept", "application/json")
+
+	response, err := outbound.Do(request)
+
+	if err != nil {
+		// Make sure our API key (which is part of the URL) doesn't end up in our logs
+		var urlError *url.Error
+		if errors.As(err, &urlError) {
+			urlError.URL = weatherURL
+		}
+		return nil, unavailable.Wrap(err)
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusNotFound:
+		return nil, cityNotFoundError(city)
+
+	case response.StatusCode != http.StatusOK:
+		return nil, unavailable.WithDetail("the weather API responded with %s", response.Status)
+	}
+
+	var upstream upstreamWeather
+
+	if err := json.NewDecoder(io.LimitReader(response.Body, MAX_WEATHER_RESPONSE)).Decode(&upstream); err != nil {
+		return nil, unavailable.WithDetail("decoding the weather API response").Wrap(err)
+	}
+
+	report := &weatherReport{
+		City:        upstream.Name,
+		Country:     upstream.Sys.Country,
+		Temperature: upstream.Main.Temp,
+		FeelsLike:   upstream.Main.FeelsLike,
+		Humidity:    upstream.Main.Humidity,
+		WindSpeed:   upstream.Wind.Speed,
+		Fetched:     time.Now(),
+	}
+
+	if len(upstream.Weather) > 0 {
+		report.Description = upstream.Weather[0].Description
+	}
+
+	return report, nil
+
+}
+
+func cityNotFoundError(city string) *AppError {
+	return newAppError(http.StatusNotFound, WEATHER_NOT_FOUND_ERROR,
+		fmt.Sprintf("We couldn't find the weather for %q.", city))
+}
+
+// Returns whether the given error is a city not found error
+func isCityNotFound(err error) bool {
+	var appError *AppError
+	return errors.As(err, &appError) && appError.Code == WEATHER_NOT_FOUND_ERROR
+}
@@ -0,0 +1,173 @@
+// Webhook notifications (i.e. for our slow request and error alerts). Messages are queued and
+// delivered by a background worker so that we never hold up a response, and any queued
+// messages are flushed when the server shuts down.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	WEBHOOK_TIMEOUT    = 5 * time.Second // How long we wait for a webhook to respond
+	WEBHOOK_QUEUE_SIZE = 100             // How many messages we queue before dropping them
+)
+
+// A message we send to a webhook. Slack and Discord webhooks only receive the text, while
+// generic webhooks receive the text along with all of the fields.
+type webhookMessage struct {
+	Text      string
+	Fields    map[string]interface{}
+	RequestID string // The request the message is about, which our outbound logs link the call to
+}
+
+// A webhookNotifier delivers messages to a single webhook URL in the background
+type webhookNotifier struct {
+	url    string
+	format string // One of "slack", "discord" or "generic"
+	queue  chan webhookMessage
+	done   chan struct{}
+}
+
+// Create a new notifier for the given URL, whose background worker runs once it's started as a
+// component (see components.go). If no format is specified, we try to detect it from the
+// webhook's host name.
+func newWebhookNotifier(url string, format string) *webhookNotifier {
+
+	if format == "" {
+		switch {
+		case strings.Contains(url, "hooks.slack.com"):
+			format = "slack"
+		case strings.Contains(url, "discord.com") || strings.Contains(url, "discordapp.com"):
+			format = "discord"
+		default:
+			format = "generic"
+		}
+	}
+
+	notifier := &webhookNotifier{
+		url:    url,
+		format: format,
+		queue:  make(chan webhookMessage, WEBHOOK_QUEUE_SIZE),
+		done:   make(chan struct{}),
+	}
+
+	return notifier
+
+}
+
+// Queue a message for delivery. If our queue is full (i.e. the webhook is down or slow) the
+// message is dropped rather than blocking the caller.
+func (notifier *webhookNotifier) notify(message webhookMessage) {
+	select {
+	case notifier.queue <- message:
+	default:
+		incrementCounter("webhook_messages_dropped_total")
+		logger.Println("WARN webhook queue is full, dropping message:", message.Text)
+	}
+}
+
+// Our background worker which delivers queued messages until the queue is closed
+func (notifier *webhookNotifier) run() {
+
+	defer close(notifier.done)
+
+	for message := range notifier.queue {
+		if err := notifier.send(message); err != nil {
+			incrementCounter("webhook_messages_failed_total")
+			logger.Println("ERROR could not deliver webhook message:", err)
+		}
+	}
+
+}
+
+// Send a single message to our webhook in the format it expects
+func (notifier *webhookNotifier) send(message webhookMessage) error {
+
+	var payload interface{}
+
+	switch notifier.format {
+	case "slack":
+		payload = map[string]string{"text": message.Text}
+	case "discord":
+		payload = map[string]string{"content": message.Text}
+	default:
+		fields := map[string]interface{}{"text": message.Text}
+		for key, value := range message.Fields {
+			fields[key] = value
+		}
+		payload = fields
+	}
+
+	payloadJSON, err := json.Marshal(payload)
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), WEBHOOK_TIMEOUT)
+	defer cancel()
+
+	if message.RequestID != "" {
+		ctx = context.WithValue(ctx, REQUEST_ID_KEY, message.RequestID)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, notifier.url, bytes.NewReader(payloadJSON))
+
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+
+	// Our outbound client stops calling webhooks which keep failing for a while (see
+	// outbound.go). Webhook calls aren't retried, as a retry could post a message twice.
+	response, err := outbound.Do(request)
+
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return &webhookStatusError{status: response.Status}
+	}
+
+	return nil
+
+}
+
+type webhookStatusError struct {
+	status string
+}
+
+func (err *webhookStatusError) Error() string {
+	return "webhook responded with " + err.status
+}
+
+// Start delivering queued messages
+func (notifier *webhookNotifier) Start(ctx context.Context) error {
+	go notifier.run()
+	return nil
+}
+
+// Stop accepting new messages and wait (until the given context is done) for our queued
+// messages to be delivered
+func (notifier *webhookNotifier) Stop(ctx context.Context) error {
+
+	close(notifier.queue)
+
+	select {
+	case <-notifier.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("gave up flushing %d webhook messages: %w", len(notifier.queue), ctx.Err())
+	}
+
+}
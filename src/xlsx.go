@@ -0,0 +1,89 @@
+// XLSX export of our spreadsheet. An XLSX file is a zip archive of XML parts (Office Open XML,
+// ECMA-376), and a single sheet of values only needs a handful of them, so rather than pulling
+// in a library we write them ourselves (like our PDF export). Numbers are written as numbers and
+// everything else as inline text, so no shared strings table or styles are needed.
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The parts of our XLSX files which are the same for every export
+var xlsxParts = []struct {
+	name    string
+	content string
+}{
+	{"[Content_Types].xml", `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+// Write the given rows of values out as an XLSX file with a single sheet
+func writeXLSX(w io.Writer, values [][]string) error {
+
+	archive := zip.NewWriter(w)
+
+	for _, part := range xlsxParts {
+		file, err := archive.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(file, xml.Header+part.content); err != nil {
+			return err
+		}
+	}
+
+	file, err := archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+
+	var sheet strings.Builder
+
+	sheet.WriteString(xml.Header)
+	sheet.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+
+	for row := range values {
+		fmt.Fprintf(&sheet, `<row r="%d">`, row+1)
+		for column, value := range values[row] {
+			if value == "" {
+				continue
+			}
+			reference := cellPosition{row: row, column: column}.String()
+			if _, err := parseCellNumber(value); err == nil {
+				fmt.Fprintf(&sheet, `<c r="%s"><v>%s</v></c>`, reference, strings.TrimSpace(value))
+			} else {
+				fmt.Fprintf(&sheet, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, reference)
+				xml.EscapeText(&sheet, []byte(value))
+				sheet.WriteString(`</t></is></c>`)
+			}
+		}
+		sheet.WriteString(`</row>`)
+	}
+
+	sheet.WriteString(`</sheetData></worksheet>`)
+
+	if _, err := io.WriteString(file, sheet.String()); err != nil {
+		return err
+	}
+
+	return archive.Close()
+
+}
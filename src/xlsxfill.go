@@ -0,0 +1,638 @@
+// XLSX template filling, i.e. for generating reports from a workbook designed in Excel. POST
+// /api/v1/xlsx/fill takes a multipart form holding an XLSX template (the template file) and a
+// JSON object (the data field) mapping cells to their values:
+//
+//	{"Summary!B2": "Q3 report", "B3": 1250.5, "'Raw Data'!C10": true, "D4": null}
+//
+// Cells without a sheet are on the workbook's first sheet. Strings are written as text, numbers
+// as numbers and booleans as booleans, while null clears a cell. Filled cells keep their style
+// (so a template's number formats and fonts apply), and the workbook is marked to recalculate
+// its formulas when it's opened, so formulas referring to the filled cells are up to date.
+//
+// The filled workbook is streamed back: only the sheets we fill (along with the workbook and its
+// part lists) are rewritten, while all of the template's other parts are copied across as they
+// are, without being decompressed.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	MAX_XLSX_TEMPLATE_SIZE = 10 << 20 // The largest template we'll fill
+	MAX_XLSX_PART_SIZE     = 50 << 20 // The largest (uncompressed) sheet or workbook part we'll rewrite
+	MAX_XLSX_FILL_CELLS    = 10 * 1000
+	MAX_XLSX_FILL_TEXT     = 32767 // The most characters an Excel cell can hold
+)
+
+// The parts of an XLSX file we rewrite (other than its sheets)
+const (
+	XLSX_CONTENT_TYPES_PART  = "[Content_Types].xml"
+	XLSX_WORKBOOK_PART       = "xl/workbook.xml"
+	XLSX_WORKBOOK_RELS_PART  = "xl/_rels/workbook.xml.rels"
+	XLSX_CALCULATION_CHAIN   = "xl/calcChain.xml"
+	XLSX_FULL_CALC_ON_LOAD   = `fullCalcOnLoad="1"`
+	XLSX_RELATIONSHIP_PREFIX = "r" // The usual prefix of the relationships namespace
+)
+
+// The workbook elements which come after calcPr, one of which we insert calcPr before if the
+// workbook doesn't have one (the elements of a workbook must be in the schema's order)
+var xlsxElementsAfterCalcPr = []string{"<oleSize", "<customWorkbookViews", "<pivotCaches", "<smartTagPr",
+	"<smartTagTypes", "<webPublishing", "<fileRecoveryPr", "<webPublishObjects", "<extLst", "</workbook>"}
+
+// The references to the calculation chain, which we drop since filling cells can invalidate it
+// (Excel rebuilds it when it recalculates the workbook)
+var (
+	xlsxCalcChainOverride     = regexp.MustCompile(`<Override[^>]*PartName="/xl/calcChain\.xml"[^>]*/>`)
+	xlsxCalcChainRelationship = regexp.MustCompile(`<Relationship[^>]*Target="(/xl/)?calcChain\.xml"[^>]*/>`)
+)
+
+// Escapes the text between elements
+var xmlCharDataEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// A sheet of a workbook, along with the path of its part within the XLSX file
+type xlsxSheet struct {
+	name string
+	part string
+}
+
+// The values to fill a sheet with, by (zero based) row and column
+type xlsxFills map[int]map[int]interface{}
+
+// Open the given XLSX file, returning its sheets in workbook order
+func xlsxSheets(archive *zip.Reader) ([]xlsxSheet, error) {
+
+	workbook, err := readXLSXPart(archive, XLSX_WORKBOOK_PART)
+	if err != nil {
+		return nil, err
+	}
+
+	relationships, err := readXLSXPart(archive, XLSX_WORKBOOK_RELS_PART)
+	if err != nil {
+		return nil, err
+	}
+
+	// The IDs of the workbook's relationships, and the parts they point to
+	targets := map[string]string{}
+
+	decoder := xml.NewDecoder(bytes.NewReader(relationships))
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, xlsxTemplateError("its workbook relationships are malformed").Wrap(err)
+		}
+		if element, ok := token.(xml.StartElement); ok && element.Name.Local == "Relationship" {
+			target := xmlAttribute(element, "", "Target")
+			// Targets are relative to the workbook, unless they're absolute
+			if strings.HasPrefix(target, "/") {
+				target = strings.TrimPrefix(target, "/")
+			} else {
+				target = path.Join(path.Dir(XLSX_WORKBOOK_PART), target)
+			}
+			targets[xmlAttribute(element, "", "Id")] = target
+		}
+	}
+
+	var sheets []xlsxSheet
+
+	decoder = xml.NewDecoder(bytes.NewReader(workbook))
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, xlsxTemplateError("its workbook is malformed").Wrap(err)
+		}
+		if element, ok := token.(xml.StartElement); ok && element.Name.Local == "sheet" {
+			part := targets[xmlAttribute(element, XLSX_RELATIONSHIP_PREFIX, "id")]
+			if part == "" {
+				return nil, xlsxTemplateError(fmt.Sprintf("the part of its %q sheet is missing", xmlAttribute(element, "", "name")))
+			}
+			sheets = append(sheets, xlsxSheet{name: xmlAttribute(element, "", "name"), part: part})
+		}
+	}
+
+	if len(sheets) == 0 {
+		return nil, xlsxTemplateError("its workbook has no sheets")
+	}
+
+	return sheets, nil
+
+}
+
+// Returns an error describing why the uploaded template isn't usable
+func xlsxTemplateError(reason string) *AppError {
+	return newAppError(http.StatusUnprocessableEntity, "invalid_template", "The template isn't a usable XLSX workbook: "+reason+".")
+}
+
+// Returns the value of the given attribute of the given (raw) element
+func xmlAttribute(element xml.StartElement, prefix string, name string) string {
+	for _, attribute := range element.Attr {
+		if attribute.Name.Space == prefix && attribute.Name.Local == name {
+			return attribute.Value
+		}
+	}
+	return ""
+}
+
+// Read the (uncompressed) contents of the given part of the given XLSX file
+func readXLSXPart(archive *zip.Reader, name string) ([]byte, error) {
+
+	file, err := archive.Open(name)
+	if err != nil {
+		return nil, xlsxTemplateError(fmt.Sprintf("%s is missing", name))
+	}
+	defer file.Close()
+
+	// The sizes in a zip file's directory can't be trusted, so we limit what we read ourselves
+	contents, err := io.ReadAll(io.LimitReader(file, MAX_XLSX_PART_SIZE+1))
+	if err != nil {
+		return nil, xlsxTemplateError(fmt.Sprintf("%s can't be read", name)).Wrap(err)
+	} else if len(contents) > MAX_XLSX_PART_SIZE {
+		return nil, xlsxTemplateError(fmt.Sprintf("%s is larger than %d bytes", name, MAX_XLSX_PART_SIZE))
+	}
+
+	return contents, nil
+
+}
+
+// Parse the given fill data (a JSON object mapping cells to their values) into the values to
+// fill each of the given sheets with, by the path of the sheet's part
+func parseXLSXFillData(data string, sheets []xlsxSheet) (map[string]xlsxFills, error) {
+
+	var values map[string]interface{}
+
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber() // Numbers are written as they're given, without losing any precision
+
+	if err := decoder.Decode(&values); err != nil {
+		return nil, badRequestError("The data field must be a JSON object mapping cells (i.e. Sheet1!B2) to their values.").Wrap(err)
+	}
+
+	if len(values) > MAX_XLSX_FILL_CELLS {
+		return nil, badRequestError(fmt.Sprintf("At most %d cells can be filled.", MAX_XLSX_FILL_CELLS))
+	}
+
+	fills := map[string]xlsxFills{}
+
+	for key, value := range values {
+
+		sheet, position, err := parseXLSXCellKey(key, sheets)
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch value := value.(type) {
+		case nil, bool:
+		case json.Number:
+			if _, err := strconv.ParseFloat(string(value), 64); err != nil {
+				return nil, badRequestError(fmt.Sprintf("The value of %s is out of range.", key))
+			}
+		case string:
+			if len([]rune(value)) > MAX_XLSX_FILL_TEXT {
+				return nil, badRequestError(fmt.Sprintf("The value of %s is longer than the %d characters a cell can hold.", key, MAX_XLSX_FILL_TEXT))
+			}
+		default:
+			return nil, badRequestError(fmt.Sprintf("The value of %s must be a string, number, boolean or null.", key))
+		}
+
+		if fills[sheet.part] == nil {
+			fills[sheet.part] = xlsxFills{}
+		}
+		if fills[sheet.part][position.row] == nil {
+			fills[sheet.part][position.row] = map[int]interface{}{}
+		}
+		fills[sheet.part][position.row][position.column] = value
+
+	}
+
+	return fills, nil
+
+}
+
+// Parse a cell of our fill data, i.e. B2, Sheet1!B2 or 'Raw Data'!B2, returning its sheet and
+// position
+func parseXLSXCellKey(key string, sheets []xlsxSheet) (xlsxSheet, cellPosition, error) {
+
+	sheet := sheets[0]
+	reference := key
+
+	if separator := strings.LastIndex(key, "!"); separator >= 0 {
+
+		name := key[:separator]
+		reference = key[separator+1:]
+
+		// Names with spaces or punctuation are quoted, with any quotes within them doubled
+		if len(name) >= 2 && strings.HasPrefix(name, "'") && strings.HasSuffix(name, "'") {
+			name = strings.ReplaceAll(name[1:len(name)-1], "''", "'")
+		}
+
+		index := slices.IndexFunc(sheets, func(sheet xlsxSheet) bool { return strings.EqualFold(sheet.name, name) })
+		if index < 0 {
+			return sheet, cellPosition{}, badRequestError(fmt.Sprintf("The template has no %q sheet (for %s).", name, key))
+		}
+		sheet = sheets[index]
+
+	}
+
+	position, err := parseCellReference(reference)
+
+	if err != nil || position.row >= MAX_SPREADSHEET_ROWS || position.column >= MAX_SPREADSHEET_COLUMNS {
+		return sheet, cellPosition{}, badRequestError(fmt.Sprintf("%q isn't a cell within a sheet (i.e. B2 or Sheet1!B2).", key))
+	}
+
+	return sheet, position, nil
+
+}
+
+// Rewrite the given sheet XML with the given values filled in. We stream the sheet's tokens
+// through, replacing the cells we fill and inserting the ones which don't exist yet (in order,
+// since the rows of a sheet and the cells of a row must be in order). Every row and cell we pass
+// through is given an explicit reference, since the positions of those without one depend on
+// what comes before them.
+func fillXLSXSheet(input []byte, fills xlsxFills) ([]byte, error) {
+
+	var output bytes.Buffer
+
+	decoder := xml.NewDecoder(bytes.NewReader(input))
+
+	inSheetData := false
+	row, lastRow, lastColumn := -1, -1, -1
+	skipping := 0 // The depth within a cell we're replacing
+
+	// Write out the filled cells of the given row before the given column
+	writeCells := func(row int, before int) {
+		var columns []int
+		for column := range fills[row] {
+			if column < before {
+				columns = append(columns, column)
+			}
+		}
+		slices.Sort(columns)
+		for _, column := range columns {
+			writeXLSXFillCell(&output, cellPosition{row: row, column: column}, "", fills[row][column])
+			delete(fills[row], column)
+		}
+	}
+
+	// Write out the filled rows before the given row
+	writeRows := func(before int) {
+		var rows []int
+		for row := range fills {
+			if row < before {
+				rows = append(rows, row)
+			}
+		}
+		slices.Sort(rows)
+		for _, row := range rows {
+			fmt.Fprintf(&output, `<row r="%d">`, row+1)
+			writeCells(row, MAX_SPREADSHEET_COLUMNS)
+			output.WriteString(`</row>`)
+			delete(fills, row)
+		}
+	}
+
+	for {
+
+		token, err := decoder.RawToken()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if skipping > 0 {
+			switch token.(type) {
+			case xml.StartElement:
+				skipping++
+			case xml.EndElement:
+				skipping--
+			}
+			continue
+		}
+
+		switch element := token.(type) {
+
+		case xml.StartElement:
+
+			switch {
+
+			case element.Name.Local == "sheetData":
+				inSheetData = true
+
+			case inSheetData && element.Name.Local == "row":
+				row = lastRow + 1
+				if reference, err := strconv.Atoi(xmlAttribute(element, "", "r")); err == nil {
+					row = reference - 1
+				}
+				writeRows(row)
+				element = withXMLAttribute(element, "r", strconv.Itoa(row+1))
+				lastColumn = -1
+
+			case inSheetData && element.Name.Local == "c":
+				column := lastColumn + 1
+				if position, err := parseCellReference(xmlAttribute(element, "", "r")); err == nil {
+					column = position.column
+				}
+				lastColumn = column
+				writeCells(row, column)
+				if value, found := fills[row][column]; found {
+					writeXLSXFillCell(&output, cellPosition{row: row, column: column}, xmlAttribute(element, "", "s"), value)
+					delete(fills[row], column)
+					skipping = 1
+					continue
+				}
+				element = withXMLAttribute(element, "r", cellPosition{row: row, column: column}.String())
+
+			}
+
+			writeRawXMLToken(&output, element)
+
+		case xml.EndElement:
+
+			switch {
+			case inSheetData && element.Name.Local == "row":
+				writeCells(row, MAX_SPREADSHEET_COLUMNS)
+				delete(fills, row)
+				lastRow = row
+			case element.Name.Local == "sheetData":
+				writeRows(MAX_SPREADSHEET_ROWS)
+				inSheetData = false
+			}
+
+			writeRawXMLToken(&output, element)
+
+		default:
+			writeRawXMLToken(&output, token)
+
+		}
+
+	}
+
+	if len(fills) > 0 {
+		return nil, errors.New("the sheet has no sheetData element")
+	}
+
+	return output.Bytes(), nil
+
+}
+
+// Returns the given element with the given (unprefixed) attribute set
+func withXMLAttribute(element xml.StartElement, name string, value string) xml.StartElement {
+
+	attributes := slices.Clone(element.Attr)
+
+	for index := range attributes {
+		if attributes[index].Name.Space == "" && attributes[index].Name.Local == name {
+			attributes[index].Value = value
+			element.Attr = attributes
+			return element
+		}
+	}
+
+	element.Attr = append(attributes, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+	return element
+
+}
+
+// Write a cell holding the given value (with the given style, if any)
+func writeXLSXFillCell(output *bytes.Buffer, position cellPosition, style string, value interface{}) {
+
+	output.WriteString(`<c r="` + position.String() + `"`)
+	if style != "" {
+		output.WriteString(` s="`)
+		xml.EscapeText(output, []byte(style))
+		output.WriteString(`"`)
+	}
+
+	switch value := value.(type) {
+	case nil:
+		output.WriteString(`/>`)
+	case bool:
+		if value {
+			output.WriteString(` t="b"><v>1</v></c>`)
+		} else {
+			output.WriteString(` t="b"><v>0</v></c>`)
+		}
+	case json.Number:
+		fmt.Fprintf(output, `><v>%s</v></c>`, value)
+	case string:
+		output.WriteString(` t="inlineStr"><is><t xml:space="preserve">`)
+		xml.EscapeText(output, []byte(value))
+		output.WriteString(`</t></is></c>`)
+	}
+
+}
+
+// Write out the given raw token (as returned by RawToken, so names keep their prefixes rather
+// than being resolved to namespaces, which encoding/xml's encoder can't write back out)
+func writeRawXMLToken(output *bytes.Buffer, token xml.Token) {
+
+	name := func(name xml.Name) string {
+		if name.Space != "" {
+			return name.Space + ":" + name.Local
+		}
+		return name.Local
+	}
+
+	switch token := token.(type) {
+	case xml.StartElement:
+		output.WriteString("<" + name(token.Name))
+		for _, attribute := range token.Attr {
+			output.WriteString(" " + name(attribute.Name) + `="`)
+			xml.EscapeText(output, []byte(attribute.Value))
+			output.WriteString(`"`)
+		}
+		output.WriteString(">")
+	case xml.EndElement:
+		output.WriteString("</" + name(token.Name) + ">")
+	case xml.CharData:
+		// xml.EscapeText would escape newlines as character references, which aren't allowed
+		// outside of the root element (i.e. after the XML declaration)
+		xmlCharDataEscaper.WriteString(output, string(token))
+	case xml.Comment:
+		output.WriteString("<!--" + string(token) + "-->")
+	case xml.ProcInst:
+		output.WriteString("<?" + token.Target + " " + string(token.Inst) + "?>")
+	case xml.Directive:
+		output.WriteString("<!" + string(token) + ">")
+	}
+
+}
+
+// Mark the given workbook XML to recalculate its formulas when it's opened
+func recalculateXLSXWorkbook(workbook string) string {
+
+	if start := strings.Index(workbook, "<calcPr"); start >= 0 {
+		if strings.Contains(workbook[start:], XLSX_FULL_CALC_ON_LOAD) {
+			return workbook
+		}
+		return workbook[:start] + "<calcPr " + XLSX_FULL_CALC_ON_LOAD + workbook[start+len("<calcPr"):]
+	}
+
+	for _, element := range xlsxElementsAfterCalcPr {
+		if position := strings.Index(workbook, element); position >= 0 {
+			return workbook[:position] + "<calcPr " + XLSX_FULL_CALC_ON_LOAD + "/>" + workbook[position:]
+		}
+	}
+
+	return workbook
+
+}
+
+// This is our XLSX template filling handler
+func xlsxFillHandler(w http.ResponseWriter, r *http.Request) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_XLSX_TEMPLATE_SIZE+1<<20)
+
+	if err := r.ParseMultipartForm(MAX_XLSX_TEMPLATE_SIZE); err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			writeError(w, r, newAppError(http.StatusRequestEntityTooLarge, "template_too_large",
+				fmt.Sprintf("Templates are limited to %d bytes.", MAX_XLSX_TEMPLATE_SIZE)).Wrap(err))
+			return
+		}
+		writeError(w, r, badRequestError("The template must be sent as multipart/form-data.").Wrap(err))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("template")
+
+	if err != nil {
+		writeError(w, r, badRequestError("The template file is missing.").Wrap(err))
+		return
+	}
+	defer file.Close()
+
+	archive, err := zip.NewReader(file, header.Size)
+
+	if err != nil {
+		writeError(w, r, xlsxTemplateError("it isn't a zip archive").Wrap(err))
+		return
+	}
+
+	endSpan := startSpan(r.Context(), "fill")
+
+	parts, err := filledXLSXParts(archive, r.FormValue("data"))
+
+	endSpan()
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	setContentType(w, spreadsheetExportTypes["xlsx"])
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": "filled.xlsx",
+	}))
+
+	// Our response is streamed, so an error from here on can only be logged (the client
+	// receives a truncated file)
+	output := zip.NewWriter(w)
+
+	for _, file := range archive.File {
+		if contents, rewritten := parts[file.Name]; rewritten {
+			if contents == nil {
+				continue
+			}
+			writer, err := output.CreateHeader(&zip.FileHeader{Name: file.Name, Method: zip.Deflate, Modified: file.Modified})
+			if err == nil {
+				_, err = writer.Write(contents)
+			}
+			if err != nil {
+				logger.Printf("Writing the filled XLSX failed: %v", err)
+				return
+			}
+		} else if err := output.Copy(file); err != nil {
+			logger.Printf("Writing the filled XLSX failed: %v", err)
+			return
+		}
+	}
+
+	if err := output.Close(); err != nil {
+		logger.Printf("Writing the filled XLSX failed: %v", err)
+		return
+	}
+
+	incrementCounter("xlsx_templates_filled_total")
+
+}
+
+// Returns the rewritten parts of the given template filled with the given data, by name (parts
+// which are dropped are nil)
+func filledXLSXParts(archive *zip.Reader, data string) (map[string][]byte, error) {
+
+	sheets, err := xlsxSheets(archive)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fills, err := parseXLSXFillData(data, sheets)
+
+	if err != nil {
+		return nil, err
+	}
+
+	parts := map[string][]byte{}
+
+	for part, sheetFills := range fills {
+
+		sheet, err := readXLSXPart(archive, part)
+		if err != nil {
+			return nil, err
+		}
+
+		if parts[part], err = fillXLSXSheet(sheet, sheetFills); err != nil {
+			return nil, xlsxTemplateError(fmt.Sprintf("%s is malformed", part)).Wrap(err)
+		}
+
+	}
+
+	workbook, err := readXLSXPart(archive, XLSX_WORKBOOK_PART)
+	if err != nil {
+		return nil, err
+	}
+	parts[XLSX_WORKBOOK_PART] = []byte(recalculateXLSXWorkbook(string(workbook)))
+
+	// Drop the calculation chain (Excel rebuilds it when it recalculates)
+	if _, err := archive.Open(XLSX_CALCULATION_CHAIN); err == nil {
+
+		contentTypes, err := readXLSXPart(archive, XLSX_CONTENT_TYPES_PART)
+		if err != nil {
+			return nil, err
+		}
+		relationships, err := readXLSXPart(archive, XLSX_WORKBOOK_RELS_PART)
+		if err != nil {
+			return nil, err
+		}
+
+		parts[XLSX_CALCULATION_CHAIN] = nil
+		parts[XLSX_CONTENT_TYPES_PART] = xlsxCalcChainOverride.ReplaceAll(contentTypes, nil)
+		parts[XLSX_WORKBOOK_RELS_PART] = xlsxCalcChainRelationship.ReplaceAll(relationships, nil)
+
+	}
+
+	return parts, nil
+
+}
@@ -0,0 +1,1168 @@
+// JSON and YAML documents for our formatter (see format.go). The standard library has no YAML
+// support, so this file has a small YAML parser and emitter covering the parts of YAML 1.2
+// which configuration files use: block mappings and sequences, flow collections ([a, b] and
+// {a: 1}), plain, single and double quoted scalars, literal (|) and folded (>) block scalars
+// and comments. Anchors, aliases, tags and multiple documents are reported as unsupported.
+// Plain scalars are resolved with the YAML 1.2 core schema (so yes and no are strings).
+//
+// Documents are parsed into nil, bool, string, json.Number, []any and documentObject values.
+// Objects keep their keys in order, so converting between the two formats doesn't shuffle
+// them. Errors report the line and column they were found at.
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// How deeply documents may nest
+const MAX_DOCUMENT_DEPTH = 1000
+
+// An object, with its members in the order they were written
+type documentObject []documentMember
+
+type documentMember struct {
+	Key   string
+	Value any
+}
+
+// YAML's infinity and not-a-number floats (i.e. .inf), which JSON can't represent
+type yamlSpecialFloat string
+
+// An error at a location within a document
+type documentError struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+func (err *documentError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", err.Line, err.Column, err.Message)
+}
+
+// Returns an error at the given byte offset of the given source
+func documentErrorAt(source string, offset int, format string, args ...any) *documentError {
+	offset = min(max(offset, 0), len(source))
+	lineStart := strings.LastIndexByte(source[:offset], '\n') + 1
+	return &documentError{
+		Line:    strings.Count(source[:offset], "\n") + 1,
+		Column:  utf8.RuneCountInString(source[lineStart:offset]) + 1,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+var (
+	yamlIntegerPattern = regexp.MustCompile(`^[-+]?[0-9]+$`)
+	yamlFloatPattern   = regexp.MustCompile(`^([-+]?)([0-9]*)(?:\.([0-9]*))?([eE][-+]?[0-9]+)?$`)
+)
+
+// Parse the given JSON document
+func parseJSONDocument(source string) (any, error) {
+
+	decoder := json.NewDecoder(strings.NewReader(source))
+	decoder.UseNumber()
+
+	locate := func(err error) error {
+		var syntaxError *json.SyntaxError
+		if errors.As(err, &syntaxError) {
+			return documentErrorAt(source, int(syntaxError.Offset)-1, "%s", syntaxError.Error())
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return documentErrorAt(source, len(source), "unexpected end of the document")
+		}
+		return documentErrorAt(source, int(decoder.InputOffset()), "%s", err.Error())
+	}
+
+	var parse func(depth int) (any, error)
+	parse = func(depth int) (any, error) {
+
+		if depth > MAX_DOCUMENT_DEPTH {
+			return nil, documentErrorAt(source, int(decoder.InputOffset()), "the document is nested too deeply")
+		}
+
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, locate(err)
+		}
+
+		switch token {
+		case json.Delim('['):
+			array := []any{}
+			for decoder.More() {
+				value, err := parse(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, value)
+			}
+			if _, err := decoder.Token(); err != nil {
+				return nil, locate(err)
+			}
+			return array, nil
+
+		case json.Delim('{'):
+			object := documentObject{}
+			seen := map[string]bool{}
+			for decoder.More() {
+				offset := int(decoder.InputOffset())
+				key, err := decoder.Token()
+				if err != nil {
+					return nil, locate(err)
+				}
+				if seen[key.(string)] {
+					return nil, documentErrorAt(source, offset+strings.IndexByte(source[offset:], '"'), "duplicate key %q", key)
+				}
+				seen[key.(string)] = true
+				value, err := parse(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				object = append(object, documentMember{key.(string), value})
+			}
+			if _, err := decoder.Token(); err != nil {
+				return nil, locate(err)
+			}
+			return object, nil
+		}
+
+		return token, nil
+
+	}
+
+	document, err := parse(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := decoder.Token(); err != io.EOF {
+		offset := int(decoder.InputOffset())
+		offset += len(source[offset:]) - len(strings.TrimLeft(source[offset:], " \t\r\n"))
+		return nil, documentErrorAt(source, offset, "unexpected content after the end of the document")
+	}
+
+	return document, nil
+
+}
+
+// Write the given document as compact JSON
+func writeJSONDocument(output *bytes.Buffer, value any) error {
+
+	switch value := value.(type) {
+	case nil:
+		output.WriteString("null")
+	case bool:
+		output.WriteString(strconv.FormatBool(value))
+	case json.Number:
+		output.WriteString(value.String())
+	case yamlSpecialFloat:
+		return fmt.Errorf("%s can't be represented in JSON", value)
+	case string:
+		writeJSONString(output, value)
+	case []any:
+		output.WriteByte('[')
+		for i, item := range value {
+			if i > 0 {
+				output.WriteByte(',')
+			}
+			if err := writeJSONDocument(output, item); err != nil {
+				return err
+			}
+		}
+		output.WriteByte(']')
+	case documentObject:
+		output.WriteByte('{')
+		for i, member := range value {
+			if i > 0 {
+				output.WriteByte(',')
+			}
+			writeJSONString(output, member.Key)
+			output.WriteByte(':')
+			if err := writeJSONDocument(output, member.Value); err != nil {
+				return err
+			}
+		}
+		output.WriteByte('}')
+	}
+
+	return nil
+
+}
+
+// Write the given string as a JSON string (without escaping HTML characters, which
+// json.Marshal would)
+func writeJSONString(output *bytes.Buffer, value string) {
+	encoder := json.NewEncoder(output)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+	output.Truncate(output.Len() - 1) // Encode adds a newline
+}
+
+// A YAML parser, which works through its source a character at a time. Between nodes, the
+// position is left at the first character of the next line with any content.
+type yamlParser struct {
+	source string
+	pos    int
+	depth  int
+}
+
+// Parse the given YAML document
+func parseYAMLDocument(source string) (any, error) {
+
+	parser := &yamlParser{source: strings.ReplaceAll(source, "\r\n", "\n")}
+
+	if err := parser.skipBlankLines(); err != nil {
+		return nil, err
+	}
+
+	var document any
+	var err error
+
+	// The document may start on its marker's line (i.e. "--- text")
+	if parser.atDocumentMarker("---") {
+		parser.pos += 3
+		parser.skipSpaces()
+		if !parser.atLineEnd() {
+			document, err = parser.parseInline(-1)
+		} else if err = parser.finishLine(); err == nil {
+			document, err = parser.parseBlock(0)
+		}
+	} else {
+		document, err = parser.parseBlock(0)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.atDocumentMarker("...") {
+		parser.pos += 3
+		if err := parser.finishLine(); err != nil {
+			return nil, err
+		}
+	}
+
+	if parser.atDocumentMarker("---") {
+		return nil, parser.errorf("only a single document is supported")
+	}
+
+	if !parser.eof() {
+		return nil, parser.errorf("unexpected content (check its indentation)")
+	}
+
+	return document, nil
+
+}
+
+func (parser *yamlParser) errorf(format string, args ...any) error {
+	return documentErrorAt(parser.source, parser.pos, format, args...)
+}
+
+func (parser *yamlParser) eof() bool {
+	return parser.pos >= len(parser.source)
+}
+
+func (parser *yamlParser) peek() byte {
+	if parser.eof() {
+		return 0
+	}
+	return parser.source[parser.pos]
+}
+
+// The byte after the current one (or 0)
+func (parser *yamlParser) peekNext() byte {
+	if parser.pos+1 >= len(parser.source) {
+		return 0
+	}
+	return parser.source[parser.pos+1]
+}
+
+// The (zero based) column of our position
+func (parser *yamlParser) column() int {
+	return parser.pos - (strings.LastIndexByte(parser.source[:parser.pos], '\n') + 1)
+}
+
+// Returns true if we're at a document start (---) or end (...) marker
+func (parser *yamlParser) atDocumentMarker(marker string) bool {
+	next := parser.pos + len(marker)
+	return parser.column() == 0 && strings.HasPrefix(parser.source[parser.pos:], marker) &&
+		(next == len(parser.source) || parser.source[next] == ' ' || parser.source[next] == '\n')
+}
+
+func (parser *yamlParser) skipSpaces() {
+	for parser.peek() == ' ' || parser.peek() == '\t' {
+		parser.pos++
+	}
+}
+
+// Returns true if the rest of our line is empty (or a comment)
+func (parser *yamlParser) atLineEnd() bool {
+	return parser.eof() || parser.peek() == '\n' || parser.peek() == '#'
+}
+
+// Skip over the rest of our line, which may only hold a comment, then any blank lines
+func (parser *yamlParser) finishLine() error {
+
+	parser.skipSpaces()
+
+	if parser.peek() == '#' {
+		for !parser.eof() && parser.peek() != '\n' {
+			parser.pos++
+		}
+	}
+
+	if !parser.eof() && parser.peek() != '\n' {
+		return parser.errorf("unexpected %q", parser.peek())
+	}
+
+	return parser.skipBlankLines()
+
+}
+
+// Move to the first character of the next line with content, skipping blank and comment lines
+func (parser *yamlParser) skipBlankLines() error {
+
+	for !parser.eof() {
+
+		if parser.peek() == '\n' {
+			parser.pos++
+		}
+
+		for parser.peek() == ' ' {
+			parser.pos++
+		}
+
+		switch parser.peek() {
+		case '\t':
+			if parser.lineIsBlank() {
+				for !parser.eof() && parser.peek() != '\n' {
+					parser.pos++
+				}
+				continue
+			}
+			return parser.errorf("tabs can't be used for indentation")
+		case '\n':
+			continue
+		case '#':
+			for !parser.eof() && parser.peek() != '\n' {
+				parser.pos++
+			}
+			continue
+		}
+
+		return nil
+
+	}
+
+	return nil
+
+}
+
+// Returns true if the rest of our line is white space
+func (parser *yamlParser) lineIsBlank() bool {
+	end := strings.IndexByte(parser.source[parser.pos:], '\n')
+	if end < 0 {
+		end = len(parser.source) - parser.pos
+	}
+	return strings.TrimSpace(parser.source[parser.pos:parser.pos+end]) == ""
+}
+
+// Returns true if we're at a block sequence entry (a dash followed by white space)
+func (parser *yamlParser) atSequenceEntry() bool {
+	next := parser.peekNext()
+	return parser.peek() == '-' && (next == 0 || next == ' ' || next == '\n')
+}
+
+// Returns true if our line holds a mapping key (i.e. "name: value" or "name:")
+func (parser *yamlParser) atMappingKey() bool {
+
+	line := parser.source[parser.pos:]
+	if end := strings.IndexByte(line, '\n'); end >= 0 {
+		line = line[:end]
+	}
+
+	if line == "" || strings.IndexByte("[{", line[0]) >= 0 {
+		return false
+	}
+
+	i := 0
+	if line[0] == '"' || line[0] == '\'' {
+		i = quotedEnd(line)
+		if i < 0 {
+			return false
+		}
+	}
+
+	for ; i < len(line); i++ {
+		if line[i] == ':' && (i+1 == len(line) || line[i+1] == ' ' || line[i+1] == '\t') {
+			return true
+		}
+		if line[i] == '#' && i > 0 && (line[i-1] == ' ' || line[i-1] == '\t') {
+			return false
+		}
+	}
+
+	return false
+
+}
+
+// Returns the offset just after the quoted string at the start of the given line (or -1)
+func quotedEnd(line string) int {
+	quote := line[0]
+	for i := 1; i < len(line); i++ {
+		switch {
+		case quote == '"' && line[i] == '\\':
+			i++
+		case quote == '\'' && line[i] == '\'' && i+1 < len(line) && line[i+1] == '\'':
+			i++
+		case line[i] == quote:
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// Parse the block node on the next line with content, if it's indented by at least the given
+// number of spaces (otherwise the node is empty, and null)
+func (parser *yamlParser) parseBlock(minimumIndent int) (any, error) {
+
+	if err := parser.skipBlankLines(); err != nil {
+		return nil, err
+	}
+
+	if parser.eof() || parser.column() < minimumIndent || parser.atDocumentMarker("...") {
+		return nil, nil
+	}
+
+	return parser.parseNode(parser.column(), minimumIndent-1)
+
+}
+
+// Parse the node at our position, which is indented by the given number of spaces within a
+// parent node which is indented by parentIndent spaces
+func (parser *yamlParser) parseNode(indent int, parentIndent int) (any, error) {
+
+	if parser.depth++; parser.depth > MAX_DOCUMENT_DEPTH {
+		return nil, parser.errorf("the document is nested too deeply")
+	}
+	defer func() { parser.depth-- }()
+
+	switch {
+	case parser.atSequenceEntry():
+		return parser.parseSequence(indent)
+	case parser.peek() == '?' && (parser.peekNext() == ' ' || parser.peekNext() == '\n'):
+		return nil, parser.errorf("complex mapping keys aren't supported")
+	case parser.atMappingKey():
+		return parser.parseMapping(indent)
+	}
+
+	return parser.parseInline(parentIndent)
+
+}
+
+// Parse a block sequence, whose entries are indented by the given number of spaces
+func (parser *yamlParser) parseSequence(indent int) (any, error) {
+
+	sequence := []any{}
+
+	for {
+
+		parser.pos++ // Our entry's dash
+		parser.skipSpaces()
+
+		var item any
+		var err error
+
+		if parser.atLineEnd() {
+			if err = parser.finishLine(); err == nil {
+				item, err = parser.parseBlock(indent + 1)
+			}
+		} else {
+			item, err = parser.parseNode(parser.column(), indent)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		sequence = append(sequence, item)
+
+		if parser.eof() || parser.column() < indent || parser.column() == indent && !parser.atSequenceEntry() {
+			return sequence, nil
+		}
+
+		if parser.column() > indent {
+			return nil, parser.errorf("bad indentation of a sequence entry")
+		}
+
+	}
+
+}
+
+// Parse a block mapping, whose keys are indented by the given number of spaces
+func (parser *yamlParser) parseMapping(indent int) (any, error) {
+
+	object := documentObject{}
+	seen := map[string]bool{}
+
+	for {
+
+		keyOffset := parser.pos
+		key, err := parser.parseKey()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if seen[key] {
+			return nil, documentErrorAt(parser.source, keyOffset, "duplicate key %q", key)
+		}
+		seen[key] = true
+
+		parser.skipSpaces()
+
+		var value any
+
+		if parser.atLineEnd() {
+			// The value is on the following lines. Sequences may be indented by as much as
+			// their key.
+			if err := parser.finishLine(); err != nil {
+				return nil, err
+			}
+			switch {
+			case parser.eof():
+			case parser.column() > indent:
+				value, err = parser.parseNode(parser.column(), indent)
+			case parser.column() == indent && parser.atSequenceEntry():
+				value, err = parser.parseSequence(indent)
+			}
+		} else {
+			value, err = parser.parseInline(indent)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		object = append(object, documentMember{key, value})
+
+		if parser.eof() || parser.column() < indent || parser.atDocumentMarker("...") {
+			return object, nil
+		}
+
+		if parser.column() > indent {
+			return nil, parser.errorf("bad indentation of a mapping entry")
+		}
+
+		if !parser.atMappingKey() {
+			return nil, parser.errorf("expected a mapping key")
+		}
+
+	}
+
+}
+
+// Parse a mapping key, along with its colon
+func (parser *yamlParser) parseKey() (string, error) {
+
+	var key string
+
+	switch parser.peek() {
+	case '"', '\'':
+		quoted, err := parser.parseQuoted()
+		if err != nil {
+			return "", err
+		}
+		key = quoted
+		parser.skipSpaces()
+	case '&', '*', '!':
+		return "", parser.errorf("anchors, aliases and tags aren't supported")
+	default:
+		start := parser.pos
+		for !parser.eof() && !(parser.peek() == ':' && (parser.peekNext() == 0 || parser.peekNext() == ' ' ||
+			parser.peekNext() == '\t' || parser.peekNext() == '\n')) {
+			parser.pos++
+		}
+		key = strings.TrimSpace(parser.source[start:parser.pos])
+	}
+
+	if parser.peek() != ':' {
+		return "", parser.errorf("expected a colon after the key")
+	}
+	parser.pos++
+
+	return key, nil
+
+}
+
+// Parse the value which starts at our position and runs to the end of the line (unless it's
+// a block scalar, a flow collection or quoted scalar which continues onto the following lines)
+func (parser *yamlParser) parseInline(parentIndent int) (any, error) {
+
+	var value any
+	var err error
+
+	switch parser.peek() {
+	case '|', '>':
+		return parser.parseBlockScalar(parentIndent)
+	case '[', '{':
+		value, err = parser.parseFlow()
+	case '"', '\'':
+		value, err = parser.parseQuoted()
+	case '&', '*', '!':
+		return nil, parser.errorf("anchors, aliases and tags aren't supported")
+	case '@', '`':
+		return nil, parser.errorf("%q can't start a plain scalar", parser.peek())
+	default:
+		start := parser.pos
+		for !parser.eof() && parser.peek() != '\n' &&
+			!(parser.peek() == '#' && (parser.source[parser.pos-1] == ' ' || parser.source[parser.pos-1] == '\t')) {
+			parser.pos++
+		}
+		text := strings.TrimSpace(parser.source[start:parser.pos])
+		if strings.Contains(text, ": ") {
+			return nil, documentErrorAt(parser.source, start+strings.Index(parser.source[start:], ": "),
+				"mapping values aren't allowed here (quote the value if it contains \": \")")
+		}
+		value = resolveYAMLScalar(text)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return value, parser.finishLine()
+
+}
+
+// Parse a literal (|) or folded (>) block scalar, whose lines are indented further than its
+// parent node
+func (parser *yamlParser) parseBlockScalar(parentIndent int) (any, error) {
+
+	folded := parser.peek() == '>'
+	parser.pos++
+
+	chomping, indent := byte(0), 0
+	for range 2 {
+		switch c := parser.peek(); {
+		case (c == '+' || c == '-') && chomping == 0:
+			chomping = c
+			parser.pos++
+		case c >= '1' && c <= '9' && indent == 0:
+			indent = max(parentIndent, 0) + int(c-'0')
+			parser.pos++
+		}
+	}
+
+	parser.skipSpaces()
+	if parser.peek() == '#' {
+		for !parser.eof() && parser.peek() != '\n' {
+			parser.pos++
+		}
+	}
+	if !parser.eof() && parser.peek() != '\n' {
+		return nil, parser.errorf("unexpected %q after the block scalar indicator", parser.peek())
+	}
+
+	// Collect our lines (the first line with content sets the indentation, unless it was given)
+	var lines []string
+	for !parser.eof() {
+		lineStart := parser.pos + 1
+		end := strings.IndexByte(parser.source[lineStart:], '\n')
+		if end < 0 {
+			end = len(parser.source) - lineStart
+		}
+		line := parser.source[lineStart : lineStart+end]
+		spaces := len(line) - len(strings.TrimLeft(line, " "))
+
+		if strings.TrimSpace(line) == "" {
+			lines = append(lines, line[min(len(line), max(indent, 0)):])
+			parser.pos = lineStart + end
+			continue
+		}
+		if indent == 0 {
+			indent = spaces
+		}
+		if spaces < indent || indent <= parentIndent {
+			break
+		}
+		lines = append(lines, line[indent:])
+		parser.pos = lineStart + end
+	}
+
+	// Trailing blank lines are dropped or kept by our chomping indicator
+	trailing := 0
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+
+	var text string
+
+	if folded {
+		// Lines are joined with spaces, except around blank and more indented lines
+		var builder strings.Builder
+		empty, previousIndented := 0, false
+		for i, line := range lines {
+			if line == "" {
+				empty++
+				continue
+			}
+			indented := line[0] == ' '
+			switch {
+			case i == 0 || builder.Len() == 0:
+				builder.WriteString(strings.Repeat("\n", empty))
+			case indented || previousIndented:
+				builder.WriteString(strings.Repeat("\n", empty+1))
+			case empty > 0:
+				builder.WriteString(strings.Repeat("\n", empty))
+			default:
+				builder.WriteString(" ")
+			}
+			builder.WriteString(line)
+			empty, previousIndented = 0, indented
+		}
+		text = builder.String()
+	} else {
+		text = strings.Join(lines, "\n")
+	}
+
+	switch {
+	case chomping == '-' || len(lines) == 0 && chomping != '+':
+	case chomping == '+':
+		text += strings.Repeat("\n", trailing+min(len(lines), 1))
+	default:
+		text += "\n"
+	}
+
+	if parser.eof() {
+		return text, nil
+	}
+
+	return text, parser.skipBlankLines()
+
+}
+
+// Skip white space, line breaks and comments within a flow collection
+func (parser *yamlParser) skipFlowSpace() {
+	for !parser.eof() {
+		switch parser.peek() {
+		case ' ', '\t', '\n':
+			parser.pos++
+		case '#':
+			for !parser.eof() && parser.peek() != '\n' {
+				parser.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Parse a flow collection ([a, b] or {a: 1}) or a scalar within one
+func (parser *yamlParser) parseFlow() (any, error) {
+
+	if parser.depth++; parser.depth > MAX_DOCUMENT_DEPTH {
+		return nil, parser.errorf("the document is nested too deeply")
+	}
+	defer func() { parser.depth-- }()
+
+	parser.skipFlowSpace()
+
+	switch parser.peek() {
+
+	case '[':
+		parser.pos++
+		sequence := []any{}
+		for {
+			parser.skipFlowSpace()
+			if parser.peek() == ']' {
+				parser.pos++
+				return sequence, nil
+			}
+			item, err := parser.parseFlow()
+			if err != nil {
+				return nil, err
+			}
+			sequence = append(sequence, item)
+			parser.skipFlowSpace()
+			if parser.peek() == ',' {
+				parser.pos++
+			} else if parser.peek() != ']' {
+				return nil, parser.errorf("expected , or ] in a flow sequence")
+			}
+		}
+
+	case '{':
+		parser.pos++
+		object := documentObject{}
+		seen := map[string]bool{}
+		for {
+			parser.skipFlowSpace()
+			if parser.peek() == '}' {
+				parser.pos++
+				return object, nil
+			}
+			keyOffset := parser.pos
+			key, err := parser.parseFlow()
+			if err != nil {
+				return nil, err
+			}
+			keyText, isString := key.(string)
+			if !isString {
+				keyText = strings.TrimSpace(parser.source[keyOffset:parser.pos])
+			}
+			if seen[keyText] {
+				return nil, documentErrorAt(parser.source, keyOffset, "duplicate key %q", keyText)
+			}
+			seen[keyText] = true
+			parser.skipFlowSpace()
+			var value any
+			if parser.peek() == ':' {
+				parser.pos++
+				if value, err = parser.parseFlow(); err != nil {
+					return nil, err
+				}
+				parser.skipFlowSpace()
+			}
+			object = append(object, documentMember{keyText, value})
+			if parser.peek() == ',' {
+				parser.pos++
+			} else if parser.peek() != '}' {
+				return nil, parser.errorf("expected , or } in a flow mapping")
+			}
+		}
+
+	case '"', '\'':
+		return parser.parseQuoted()
+
+	case '&', '*', '!':
+		return nil, parser.errorf("anchors, aliases and tags aren't supported")
+
+	case ',', ']', '}', 0:
+		return nil, parser.errorf("expected a value")
+	}
+
+	// A plain scalar, which ends at a flow indicator or a colon followed by white space
+	start := parser.pos
+	for !parser.eof() && strings.IndexByte(",[]{}\n", parser.peek()) < 0 &&
+		!(parser.peek() == ':' && strings.IndexByte(" \t\n,[]{}", parser.peekNext()) >= 0) &&
+		!(parser.peek() == '#' && (parser.source[parser.pos-1] == ' ' || parser.source[parser.pos-1] == '\t')) {
+		parser.pos++
+	}
+
+	return resolveYAMLScalar(strings.TrimSpace(parser.source[start:parser.pos])), nil
+
+}
+
+// Parse a single or double quoted scalar. Line breaks within it are folded into spaces (or
+// kept, where there are blank lines).
+func (parser *yamlParser) parseQuoted() (string, error) {
+
+	quote := parser.peek()
+	start := parser.pos
+	parser.pos++
+
+	var text strings.Builder
+
+	for {
+
+		if parser.eof() {
+			return "", documentErrorAt(parser.source, start, "unterminated quoted string")
+		}
+
+		c := parser.peek()
+
+		switch {
+
+		case c == quote && quote == '\'' && parser.peekNext() == '\'':
+			text.WriteByte('\'')
+			parser.pos += 2
+
+		case c == quote:
+			parser.pos++
+			return text.String(), nil
+
+		case c == '\n':
+			trimmed := strings.TrimRight(text.String(), " \t")
+			text.Reset()
+			text.WriteString(trimmed)
+			breaks := 0
+			for parser.peek() == '\n' || parser.peek() == ' ' || parser.peek() == '\t' {
+				if parser.peek() == '\n' {
+					breaks++
+				}
+				parser.pos++
+			}
+			if breaks == 1 {
+				text.WriteByte(' ')
+			} else {
+				text.WriteString(strings.Repeat("\n", breaks-1))
+			}
+
+		case c == '\\' && quote == '"':
+			if err := parser.parseEscape(&text); err != nil {
+				return "", err
+			}
+
+		default:
+			r, size := utf8.DecodeRuneInString(parser.source[parser.pos:])
+			text.WriteRune(r)
+			parser.pos += size
+		}
+	}
+
+}
+
+// The single character escape sequences of double quoted scalars
+var yamlEscapes = map[byte]string{
+	'0': "\x00", 'a': "\a", 'b': "\b", 't': "\t", '\t': "\t", 'n': "\n", 'v': "\v", 'f': "\f",
+	'r': "\r", 'e': "\x1b", ' ': " ", '"': "\"", '/': "/", '\\': "\\", 'N': "\u0085",
+	'_': " ", 'L': " ", 'P': " ",
+}
+
+// Parse the escape sequence at our position
+func (parser *yamlParser) parseEscape(text *strings.Builder) error {
+
+	start := parser.pos
+	parser.pos++
+	c := parser.peek()
+	parser.pos++
+
+	if escaped, found := yamlEscapes[c]; found {
+		text.WriteString(escaped)
+		return nil
+	}
+
+	// An escaped line break joins the lines without a space
+	if c == '\n' {
+		for parser.peek() == ' ' || parser.peek() == '\t' {
+			parser.pos++
+		}
+		return nil
+	}
+
+	digits := map[byte]int{'x': 2, 'u': 4, 'U': 8}[c]
+	if digits > 0 && parser.pos+digits <= len(parser.source) {
+		code, err := strconv.ParseUint(parser.source[parser.pos:parser.pos+digits], 16, 32)
+		if err == nil && utf8.ValidRune(rune(code)) {
+			text.WriteRune(rune(code))
+			parser.pos += digits
+			return nil
+		}
+	}
+
+	return documentErrorAt(parser.source, start, "invalid escape sequence")
+
+}
+
+// Resolve the given plain scalar to a null, boolean, number or string using the YAML 1.2
+// core schema
+func resolveYAMLScalar(text string) any {
+
+	switch text {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+
+	switch strings.ToLower(strings.TrimLeft(text, "+-")) {
+	case ".inf", ".nan":
+		return yamlSpecialFloat(text)
+	}
+
+	// Numbers are normalised into JSON's syntax (i.e. +1 becomes 1, 0x1F 31 and .5 0.5)
+	if yamlIntegerPattern.MatchString(text) {
+		number, _ := new(big.Int).SetString(strings.TrimPrefix(text, "+"), 10)
+		return json.Number(number.String())
+	}
+	for prefix, base := range map[string]int{"0x": 16, "0o": 8} {
+		if digits, found := strings.CutPrefix(text, prefix); found {
+			if number, ok := new(big.Int).SetString(digits, base); ok && !strings.HasPrefix(digits, "-") {
+				return json.Number(number.String())
+			}
+		}
+	}
+	if match := yamlFloatPattern.FindStringSubmatch(text); match != nil && match[2]+match[3] != "" {
+		number := strings.TrimPrefix(match[1], "+") + cmp.Or(strings.TrimLeft(match[2], "0"), "0")
+		if match[3] != "" {
+			number += "." + match[3]
+		}
+		return json.Number(number + match[4])
+	}
+
+	return text
+
+}
+
+// Write the given document as YAML
+func writeYAMLDocument(output *strings.Builder, value any) {
+
+	switch value := value.(type) {
+	case documentObject:
+		if len(value) > 0 {
+			writeYAMLNode(output, value, 0)
+			return
+		}
+	case []any:
+		if len(value) > 0 {
+			writeYAMLNode(output, value, 0)
+			return
+		}
+	}
+
+	output.WriteString(yamlScalar(value, 0) + "\n")
+
+}
+
+// Write the given non-empty collection as a block, indented by the given number of spaces
+func writeYAMLNode(output *strings.Builder, value any, indent int) {
+
+	prefix := strings.Repeat(" ", indent)
+
+	// Writes a value after its key or dash, either on the same line or indented below it
+	writeValue := func(value any, childIndent int, inlineCollections bool) {
+		switch child := value.(type) {
+		case documentObject:
+			if len(child) > 0 {
+				if inlineCollections {
+					var nested strings.Builder
+					writeYAMLNode(&nested, child, childIndent)
+					output.WriteString(" " + nested.String()[childIndent:])
+				} else {
+					output.WriteString("\n")
+					writeYAMLNode(output, child, childIndent)
+				}
+				return
+			}
+		case []any:
+			if len(child) > 0 {
+				if inlineCollections {
+					var nested strings.Builder
+					writeYAMLNode(&nested, child, childIndent)
+					output.WriteString(" " + nested.String()[childIndent:])
+				} else {
+					output.WriteString("\n")
+					writeYAMLNode(output, child, childIndent)
+				}
+				return
+			}
+		}
+		output.WriteString(" " + yamlScalar(value, childIndent) + "\n")
+	}
+
+	switch value := value.(type) {
+	case documentObject:
+		for _, member := range value {
+			output.WriteString(prefix + yamlString(member.Key, true) + ":")
+			writeValue(member.Value, indent+2, false)
+		}
+	case []any:
+		for _, item := range value {
+			output.WriteString(prefix + "-")
+			writeValue(item, indent+2, true)
+		}
+	}
+
+}
+
+// Returns the given scalar (or empty collection) as YAML. Multi-line strings are written as
+// literal block scalars, indented by the given number of spaces.
+func yamlScalar(value any, indent int) string {
+
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(value)
+	case json.Number:
+		return value.String()
+	case yamlSpecialFloat:
+		return string(value)
+	case documentObject:
+		return "{}"
+	case []any:
+		return "[]"
+	case string:
+		return yamlBlockString(value, indent)
+	}
+
+	return "null"
+
+}
+
+// Returns the given string as a literal block scalar if it's made up of several lines (and can
+// be), otherwise as a plain or quoted scalar
+func yamlBlockString(value string, indent int) string {
+
+	body, header := value, "|-"
+	if trimmed, found := strings.CutSuffix(value, "\n"); found {
+		body, header = trimmed, "|"
+	}
+
+	literal := strings.Contains(body, "\n") && !strings.HasSuffix(body, "\n") &&
+		!strings.HasPrefix(body, " ") && !strings.HasPrefix(body, "\n") &&
+		!strings.Contains(body, " \n") &&
+		!strings.ContainsFunc(body, func(r rune) bool { return r != '\n' && !unicode.IsPrint(r) })
+
+	if !literal {
+		return yamlString(value, false)
+	}
+
+	prefix := strings.Repeat(" ", indent)
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = prefix + line
+		}
+	}
+
+	return header + "\n" + strings.Join(lines, "\n")
+
+}
+
+// The words which YAML 1.1 parsers read as booleans, which we quote so that they don't
+var yamlBooleanWords = []string{"y", "n", "yes", "no", "on", "off"}
+
+// Returns the given string as a plain scalar if it would be read back as the same string,
+// otherwise as a double quoted scalar
+func yamlString(value string, key bool) string {
+
+	plain := value != "" && strings.TrimSpace(value) == value &&
+		strings.IndexByte("-?:,[]{}#&*!|>'\"%@`.", value[0]) < 0 &&
+		!strings.Contains(value, ": ") && !strings.Contains(value, " #") && !strings.HasSuffix(value, ":") &&
+		!strings.ContainsFunc(value, func(r rune) bool { return !unicode.IsPrint(r) }) &&
+		resolveYAMLScalar(value) == any(value)
+
+	for _, word := range yamlBooleanWords {
+		plain = plain && !strings.EqualFold(value, word)
+	}
+
+	if key {
+		plain = plain && !strings.ContainsAny(value, "[]{},")
+	}
+
+	if plain {
+		return value
+	}
+
+	// JSON's escape sequences are all valid in YAML's double quoted scalars
+	var quoted bytes.Buffer
+	writeJSONString(&quoted, value)
+
+	return quoted.String()
+
+}
@@ -0,0 +1,147 @@
+// ZIP streaming. A zipStream writes a ZIP archive straight into a response as files are added to
+// it, so archives of any size are sent without first being built in memory or on disk. The ZIP
+// format suits this well, since each file's sizes and CRC can follow its data (in a data
+// descriptor) and the central directory is written last.
+//
+// Streams flush the response every ZIP_STREAM_FLUSH_SIZE bytes, so that the client sees steady
+// progress, and push back the response's write deadline at the same time (see deadlines.go),
+// so that large archives aren't cut off by our global write timeout while slow clients still
+// time out if they stop reading. Files whose content type we wouldn't compress (i.e. images
+// and archives, see compression.go) are stored rather than deflated.
+//
+// Errors after the archive has started can't be reported in the response, so they abort it
+// instead (see abort), which leaves the client with a download that fails rather than a ZIP
+// file which silently lacks some of its files.
+
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	ZIP_STREAM_FLUSH_SIZE   = 1 << 20
+	ZIP_STREAM_IDLE_TIMEOUT = time.Minute // How long we'll wait for a client to read each flush
+)
+
+// A ZIP archive which is being streamed into a response
+type zipStream struct {
+	w         http.ResponseWriter
+	r         *http.Request
+	archive   *zip.Writer
+	unflushed int64 // The bytes we've read since we last flushed
+}
+
+// Start streaming a ZIP archive with the given download name into the given response
+func newZipStream(w http.ResponseWriter, r *http.Request, downloadName string) *zipStream {
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": downloadName,
+	}))
+	w.Header().Set("Cache-Control", "no-store")
+	setContentType(w, "application/zip")
+
+	extendWriteDeadline(w, r, ZIP_STREAM_IDLE_TIMEOUT)
+
+	return &zipStream{w: w, r: r, archive: zip.NewWriter(w)}
+
+}
+
+// Add the file at the given path to our archive under the given name
+func (stream *zipStream) addFile(name string, path string) error {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+	header.Method = zip.Store
+	if compressionLevel(contentTypeFor(path)) > 0 {
+		header.Method = zip.Deflate
+	}
+
+	entry, err := stream.archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(entry, zipStreamReader{file, stream}); err != nil {
+		return err
+	}
+
+	return stream.flush()
+
+}
+
+// Write out everything we've archived so far and give the client another
+// ZIP_STREAM_IDLE_TIMEOUT to read it
+func (stream *zipStream) flush() error {
+
+	stream.unflushed = 0
+
+	if err := stream.archive.Flush(); err != nil {
+		return err
+	}
+
+	extendWriteDeadline(stream.w, stream.r, ZIP_STREAM_IDLE_TIMEOUT)
+
+	if err := http.NewResponseController(stream.w).Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+
+	return nil
+
+}
+
+// Finish our archive by writing its central directory
+func (stream *zipStream) close() error {
+	return stream.archive.Close()
+}
+
+// Abort our response after the given error, which is logged. Panicking with
+// http.ErrAbortHandler has the server drop the connection (or reset the HTTP/2 stream) without
+// ending the response properly, so the client knows that the archive is incomplete.
+func (stream *zipStream) abort(err error) {
+	requestID, _ := stream.r.Context().Value(REQUEST_ID_KEY).(string)
+	logger.Println("WARN aborting the ZIP stream for", requestID, stream.r.URL.Path, err)
+	panic(http.ErrAbortHandler)
+}
+
+// Reads a file into our archive, flushing our stream every ZIP_STREAM_FLUSH_SIZE bytes
+type zipStreamReader struct {
+	file   io.Reader
+	stream *zipStream
+}
+
+func (reader zipStreamReader) Read(data []byte) (int, error) {
+
+	n, err := reader.file.Read(data)
+	reader.stream.unflushed += int64(n)
+
+	if reader.stream.unflushed >= ZIP_STREAM_FLUSH_SIZE {
+		if flushErr := reader.stream.flush(); flushErr != nil {
+			return n, flushErr
+		}
+	}
+
+	return n, err
+
+}